@@ -0,0 +1,45 @@
+package cmd_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// TestMainPackagesBuild builds every command against the one module tree, so
+// a change that breaks a binary nobody unit-tests fails here
+func TestMainPackagesBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds binaries")
+	}
+	goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mains []string
+	for _, e := range entries {
+		if e.IsDir() {
+			mains = append(mains, e.Name())
+		}
+	}
+	for _, want := range []string{"kedr", "keygen", "node"} {
+		if !slices.Contains(mains, want) {
+			t.Fatalf("cmd/%s is missing", want)
+		}
+	}
+
+	for _, name := range mains {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			out, err := exec.Command(goTool, "build", "-o", t.TempDir(), "./"+name).CombinedOutput()
+			if err != nil {
+				t.Fatalf("go build ./cmd/%s: %v\n%s", name, err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/vpn"
+	"seras-protocol/internal/tun"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// doctorTimeout bounds each network check
+const doctorTimeout = 5 * time.Second
+
+// Dependencies of the checks, replaceable for tests
+var (
+	geteuid     = os.Geteuid
+	probeTUN    = tun.Probe
+	lookupHost  = net.DefaultResolver.LookupHost
+	dialTimeout = net.DialTimeout
+)
+
+// errSkipped marks a check that does not apply to this configuration
+var errSkipped = errors.New("skipped")
+
+// check is one diagnostic; detail is printed on success
+type check struct {
+	name string
+	run  func() (detail string, err error)
+}
+
+// runDoctor checks the environment and configuration without touching
+// routes, prints a report and returns the process exit code
+func runDoctor() int {
+	fmt.Println("Kedr doctor")
+
+	connType, err := config.GetConnTypeFromEnv()
+	if err == nil {
+		var cfg *config.ConnConfig
+		cfg, err = config.ParseConfigFromEnv(connType)
+		if err == nil {
+			return report(doctorChecks(cfg))
+		}
+	}
+
+	// Without a config only the local checks can run
+	failed := report([]check{
+		{"root privileges", checkRoot},
+		{"TUN device", func() (string, error) { return checkTUN(os.Getenv("TUN_NAME")) }},
+		{"configuration", func() (string, error) { return "", err }},
+	})
+	return max(failed, 1)
+}
+
+func doctorChecks(cfg *config.ConnConfig) []check {
+	checks := []check{
+		{"configuration", func() (string, error) {
+			return fmt.Sprintf("%s mode, %d node(s), %d extra hop(s)", cfg.Mode, len(cfg.Upstreams), len(cfg.Hops)), nil
+		}},
+	}
+	if cfg.Mode == config.ModeTUN {
+		checks = append(checks,
+			check{"root privileges", checkRoot},
+			check{"TUN device", func() (string, error) { return checkTUN(cfg.TunName) }},
+		)
+	}
+	checks = append(checks, check{"keys", func() (string, error) { return checkKeys(cfg) }})
+	for _, up := range cfg.Upstreams {
+		checks = append(checks,
+			check{"DNS " + up.Endpoint, func() (string, error) { return checkDNS(up.Endpoint) }},
+			check{"reachability " + up.Endpoint, func() (string, error) { return checkReachable(up.Type, up.Endpoint) }},
+		)
+	}
+
+	client := vpn.NewClient(cfg, nil)
+	for i, up := range cfg.Upstreams {
+		checks = append(checks, check{"handshake " + up.Endpoint, func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout*time.Duration(cfg.HandshakeRetries))
+			defer cancel()
+			rtt, err := client.ProbeUpstream(ctx, i)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("completed in %s", rtt.Round(time.Millisecond)), nil
+		}})
+	}
+	return checks
+}
+
+// report runs checks in order, prints one line each and returns 1 if any failed
+func report(checks []check) int {
+	code := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Printf("[SKIP] %s\n", c.name)
+		case err != nil:
+			fmt.Printf("[FAIL] %s: %v\n", c.name, err)
+			code = 1
+		case detail != "":
+			fmt.Printf("[PASS] %s: %s\n", c.name, detail)
+		default:
+			fmt.Printf("[PASS] %s\n", c.name)
+		}
+	}
+	return code
+}
+
+// checkRoot verifies the privileges needed to configure the TUN and routes
+func checkRoot() (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", errSkipped
+	}
+	if uid := geteuid(); uid != 0 {
+		return "", fmt.Errorf("running as uid %d, root is required to manage the TUN and routes", uid)
+	}
+	return "", nil
+}
+
+// checkTUN creates and removes a TUN device
+func checkTUN(name string) (string, error) {
+	if err := probeTUN(name); err != nil {
+		return "", err
+	}
+	return "device can be created", nil
+}
+
+// checkKeys verifies that the client key derives a usable public key and,
+// if CLIENT_PUBLIC_KEY is set, that it matches
+func checkKeys(cfg *config.ConnConfig) (string, error) {
+	pub, err := msg.PublicKeyFromPrivate(cfg.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	if err := pub.Validate(); err != nil {
+		return "", fmt.Errorf("derived public key: %w", err)
+	}
+
+	if env := os.Getenv("CLIENT_PUBLIC_KEY"); env != "" {
+		configured, err := msg.ParsePublicKey(env)
+		if err != nil {
+			return "", fmt.Errorf("CLIENT_PUBLIC_KEY: %w", err)
+		}
+		if configured != pub {
+			return "", fmt.Errorf("CLIENT_PUBLIC_KEY does not match PRIVATE_KEY (derived %x)", pub[:])
+		}
+	}
+	return fmt.Sprintf("client public key %x", pub[:]), nil
+}
+
+// checkDNS resolves the host of an endpoint; IP literals need no lookup
+func checkDNS(endpoint string) (string, error) {
+	host, _, err := splitEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return "", errSkipped
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s resolves to %v", host, addrs), nil
+}
+
+// checkReachable opens a TCP connection to a wss node. UDP has no
+// connection to open, so that only confirms a route and the handshake
+// check is the real probe.
+func checkReachable(connType, endpoint string) (string, error) {
+	host, port, err := splitEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	network := "tcp"
+	if connType == "udp" {
+		network = "udp"
+	}
+
+	start := time.Now()
+	conn, err := dialTimeout(network, net.JoinHostPort(host, port), doctorTimeout)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	if network == "udp" {
+		return "route available", nil
+	}
+	return fmt.Sprintf("TCP connect in %s", time.Since(start).Round(time.Millisecond)), nil
+}
+
+// splitEndpoint returns the host and port of a WebSocket URL or host:port
+func splitEndpoint(endpoint string) (string, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return net.SplitHostPort(endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" || u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u.Hostname(), port, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// stub replaces *v with fake until the test ends
+func stub[T any](t *testing.T, v *T, fake T) {
+	t.Helper()
+	old := *v
+	*v = fake
+	t.Cleanup(func() { *v = old })
+}
+
+func TestCheckRoot(t *testing.T) {
+	stub(t, &geteuid, func() int { return 0 })
+	if _, err := checkRoot(); err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	stub(t, &geteuid, func() int { return 1000 })
+	if _, err := checkRoot(); err == nil || !strings.Contains(err.Error(), "uid 1000") {
+		t.Fatalf("uid 1000: got %v, want a failure naming the uid", err)
+	}
+}
+
+func TestCheckTUN(t *testing.T) {
+	var probed string
+	stub(t, &probeTUN, func(name string) error {
+		probed = name
+		return nil
+	})
+	if _, err := checkTUN("seras9"); err != nil || probed != "seras9" {
+		t.Fatalf("probed %q, %v; want seras9 to pass", probed, err)
+	}
+
+	denied := errors.New("operation not permitted")
+	stub(t, &probeTUN, func(string) error { return denied })
+	if _, err := checkTUN(""); !errors.Is(err, denied) {
+		t.Fatalf("got %v, want the probe's error", err)
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	private, public, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ConnConfig{PrivateKey: private}
+
+	tests := []struct {
+		name    string
+		env     string // CLIENT_PUBLIC_KEY
+		wantErr string
+	}{
+		{"derived only", "", ""},
+		{"matching public key", public.Hex(), ""},
+		{"mismatched public key", other.Hex(), "does not match"},
+		{"unparsable public key", "zz", "CLIENT_PUBLIC_KEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CLIENT_PUBLIC_KEY", tt.env)
+			detail, err := checkKeys(cfg)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr == "" && !strings.Contains(detail, public.Hex()):
+				t.Fatalf("detail %q doesn't show the public key", detail)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	var looked []string
+	stub(t, &lookupHost, func(ctx context.Context, host string) ([]string, error) {
+		looked = append(looked, host)
+		if host == "missing.example" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"203.0.113.7"}, nil
+	})
+
+	if _, err := checkDNS("203.0.113.7:5555"); !errors.Is(err, errSkipped) {
+		t.Fatalf("IP literal: got %v, want it skipped", err)
+	}
+	detail, err := checkDNS("wss://node.example/ws")
+	if err != nil || !strings.Contains(detail, "203.0.113.7") {
+		t.Fatalf("got %q, %v; want the resolved address", detail, err)
+	}
+	if _, err := checkDNS("missing.example:5555"); err == nil {
+		t.Fatal("lookup failure passed")
+	}
+	if want := []string{"node.example", "missing.example"}; strings.Join(looked, ",") != strings.Join(want, ",") {
+		t.Fatalf("looked up %v, want %v", looked, want)
+	}
+}
+
+func TestCheckReachable(t *testing.T) {
+	var dialed []string
+	stub(t, &dialTimeout, func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		if address == "203.0.113.9:5555" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	tests := []struct {
+		connType, endpoint string
+		want               string // What was dialed
+		wantErr            bool
+	}{
+		{"wss", "wss://node.example/ws", "tcp node.example:443", false},
+		{"wss", "ws://node.example:8080/ws", "tcp node.example:8080", false},
+		{"udp", "203.0.113.7:5555", "udp 203.0.113.7:5555", false},
+		{"tcp", "203.0.113.9:5555", "tcp 203.0.113.9:5555", true},
+	}
+	for _, tt := range tests {
+		dialed = nil
+		_, err := checkReachable(tt.connType, tt.endpoint)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, want error %v", tt.endpoint, err, tt.wantErr)
+		}
+		if len(dialed) != 1 || dialed[0] != tt.want {
+			t.Errorf("%s: dialed %v, want %s", tt.endpoint, dialed, tt.want)
+		}
+	}
+	if _, err := checkReachable("udp", "no port"); err == nil {
+		t.Error("endpoint without a port passed")
+	}
+}
+
+func TestReport(t *testing.T) {
+	pass := check{"pass", func() (string, error) { return "fine", nil }}
+	skip := check{"skip", func() (string, error) { return "", errSkipped }}
+	fail := check{"fail", func() (string, error) { return "", errors.New("broken") }}
+
+	ran := 0
+	counted := check{"counted", func() (string, error) {
+		ran++
+		return "", nil
+	}}
+	if code := report([]check{pass, skip, counted}); code != 0 {
+		t.Fatalf("passing checks exited %d", code)
+	}
+	// A failure doesn't stop the checks after it
+	if code := report([]check{fail, pass, counted}); code != 1 {
+		t.Fatalf("failing check exited %d, want 1", code)
+	}
+	if ran != 2 {
+		t.Fatalf("ran the last check %d times, want 2", ran)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -9,18 +11,50 @@ import (
 
 	"github.com/joho/godotenv"
 	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/proxy"
 	"seras-protocol/internal/kedr/vpn"
-	"seras-protocol/internal/transport/client"
+	"seras-protocol/internal/logging"
+	"seras-protocol/internal/netstack"
+	"seras-protocol/internal/tap"
 	"seras-protocol/internal/tun"
+	"seras-protocol/internal/version"
+	"seras-protocol/pkg/taiga/msg"
 )
 
 func main() {
-	slog.Info("Starting Kedr VPN client")
+	configPath := flag.String("config", "", "Path to config file (env vars override its values)")
+	excludeLAN := flag.Bool("exclude-lan", false, "Keep the local LAN subnet off the tunnel")
+	doctor := flag.Bool("doctor", false, "Check the setup, print a report and exit without connecting")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if err := godotenv.Load(); err != nil {
 		slog.Warn("No .env file found", "error", err)
 	}
 
+	if *configPath != "" {
+		if err := config.LoadFile(*configPath); err != nil {
+			slog.Error("Failed to load config file", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Config file loaded", "path", *configPath)
+	}
+
+	if err := logging.Setup(); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Starting Kedr VPN client", "version", version.Version, "commit", version.Revision())
+
+	if *doctor {
+		os.Exit(runDoctor())
+	}
+
 	connType, err := config.GetConnTypeFromEnv()
 	if err != nil {
 		slog.Error("Failed to get connection type", "error", err)
@@ -33,28 +67,52 @@ func main() {
 		slog.Error("Failed to parse config", "error", err)
 		os.Exit(1)
 	}
-	slog.Info("Config loaded", "localIP", cfg.LocalIP, "nodeVPNIP", cfg.NodeVPNIP, "remoteHost", cfg.RemoteHost)
+	slog.Info("Config loaded", "localIP", cfg.LocalIP, "nodeVPNIP", cfg.NodeVPNIP, "remoteHost", cfg.RemoteHost, "nodes", len(cfg.Upstreams), "policy", cfg.NodePolicy)
 
-	// Create TUN interface
-	tunDev, err := tun.New(cfg.LocalIP, cfg.GatewayIP, cfg.RemoteHost, cfg.NodeVPNIP)
-	if err != nil {
-		slog.Error("Failed to create TUN interface", "error", err)
-		os.Exit(1)
+	msg.SetDictionary(cfg.CompressionDict)
+
+	if cfg.DryRun {
+		tun.SetRunner(tun.DryRunner{Out: os.Stdout})
+		slog.Info("Dry run: host commands are printed, not run")
 	}
-	slog.Info("TUN interface created", "name", tunDev.Name())
 
-	// Create transport
-	factory := &client.Factory{}
-	transport, err := factory.NewClient(cfg.Type, cfg.TransportConfig)
-	if err != nil {
-		tunDev.Close()
-		slog.Error("Failed to create transport", "error", err)
-		os.Exit(1)
+	// Proxy mode tunnels TCP streams through a local SOCKS5 proxy and needs no
+	// TUN. The netstack datapath carries packets like a TUN, but from a
+	// userspace stack that its own SOCKS5 proxy dials through.
+	var tunDev vpn.Device
+	var hostRouter func(ip string) error
+	var stack *netstack.Stack
+	if cfg.Mode == config.ModeTUN && cfg.Datapath == config.DatapathNetstack {
+		stack = setupNetstack(cfg)
+		tunDev = stack
+	} else if cfg.Mode == config.ModeTUN {
+		dev, t := setupTUN(cfg, *excludeLAN)
+		tunDev, hostRouter = dev, t.AddHostRoute
+	}
+
+	// A dry run stops once setup and cleanup have been shown
+	if cfg.DryRun {
+		if tunDev != nil {
+			tunDev.Close()
+		}
+		slog.Info("Dry run complete")
+		return
 	}
-	slog.Info("Transport connected")
 
 	// Create VPN client
-	vpnClient := vpn.NewClient(cfg, tunDev, transport)
+	vpnClient := vpn.NewClient(cfg, tunDev)
+	if cfg.Discovery != nil && hostRouter != nil {
+		vpnClient.SetHostRouter(hostRouter)
+	}
+
+	packetTap, err := tap.Open(cfg.DebugPcap)
+	if err != nil {
+		slog.Warn("Failed to open packet tap", "error", err)
+	} else if packetTap != nil {
+		defer packetTap.Close()
+		vpnClient.SetTap(packetTap)
+		slog.Info("Packet tap enabled", "target", cfg.DebugPcap)
+	}
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -67,6 +125,34 @@ func main() {
 		cancel()
 	}()
 
+	if cfg.StatsInterval > 0 {
+		go vpnClient.LogStats(ctx, cfg.StatsInterval)
+	}
+	if cfg.StatsAddr != "" {
+		go func() {
+			if err := vpnClient.ServeStats(cfg.StatsAddr); err != nil {
+				slog.Error("Stats endpoint error", "error", err)
+			}
+		}()
+	}
+
+	var dialer proxy.Dialer
+	switch {
+	case cfg.Mode == config.ModeProxy:
+		dialer = vpnClient
+	case stack != nil:
+		dialer = stack
+	}
+	if dialer != nil {
+		proxyServer := proxy.NewServer(cfg.ProxyAddr, dialer)
+		go func() {
+			if err := proxyServer.Serve(ctx); err != nil {
+				slog.Error("Proxy server error", "error", err)
+				cancel()
+			}
+		}()
+	}
+
 	// Run VPN client
 	slog.Info("VPN client running")
 	if err := vpnClient.Run(ctx); err != nil && err != context.Canceled {
@@ -80,3 +166,97 @@ func main() {
 
 	slog.Info("Kedr VPN client stopped")
 }
+
+// setupNetstack creates the userspace stack for DATAPATH=netstack, exiting
+// on failure
+func setupNetstack(cfg *config.ConnConfig) *netstack.Stack {
+	stack, err := netstack.New(cfg.LocalIP, cfg.MTU)
+	if err != nil {
+		slog.Error("Failed to create netstack", "error", err)
+		os.Exit(1)
+	}
+	if cfg.EnableIPv6 && cfg.LocalIP6 != "" {
+		if err := stack.SetLocalIP6(cfg.LocalIP6); err != nil {
+			stack.Close()
+			slog.Error("Failed to set up IPv6", "error", err)
+			os.Exit(1)
+		}
+	}
+	slog.Info("Netstack datapath created", "mtu", stack.MTU(), "proxy", cfg.ProxyAddr)
+	return stack
+}
+
+// setupTUN creates the TUN interface and installs the client's routes,
+// exiting on failure. It returns the device to move packets through (an
+// io_uring FastTUN when TUN_BATCH is above 1) and the TUN it wraps.
+func setupTUN(cfg *config.ConnConfig, excludeLAN bool) (vpn.Device, *tun.TUN) {
+	// Undo routes and rules left behind by a crashed previous run
+	if cleaned, err := tun.CleanupStale(); err != nil {
+		slog.Warn("Failed to clean up stale TUN state", "error", err)
+	} else if len(cleaned) > 0 {
+		slog.Info("Cleaned up stale TUN state", "interfaces", cleaned)
+	}
+
+	// Create TUN interface
+	var dev vpn.Device
+	var tunDev *tun.TUN
+	if cfg.TUNBatch > 1 {
+		fast, err := tun.NewFast(cfg.LocalIP, cfg.GatewayIP, cfg.RemoteHost, cfg.NodeVPNIP, cfg.MTU, cfg.TunName, cfg.AllowedIPs)
+		if err != nil {
+			slog.Error("Failed to create TUN interface", "error", err)
+			os.Exit(1)
+		}
+		if !fast.HasIOURing() {
+			slog.Warn("io_uring unavailable, TUN_BATCH ignored")
+		}
+		dev, tunDev = fast, fast.TUN
+	} else {
+		t, err := tun.New(cfg.LocalIP, cfg.GatewayIP, cfg.RemoteHost, cfg.NodeVPNIP, cfg.MTU, cfg.TunName, cfg.AllowedIPs)
+		if err != nil {
+			slog.Error("Failed to create TUN interface", "error", err)
+			os.Exit(1)
+		}
+		dev, tunDev = t, t
+	}
+	slog.Info("TUN interface created", "name", tunDev.Name(), "mtu", tunDev.MTU(), "batch", cfg.TUNBatch)
+
+	if cfg.EnableIPv6 {
+		if err := tunDev.SetupIPv6(cfg.LocalIP6); err != nil {
+			dev.Close()
+			slog.Error("Failed to set up IPv6", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("IPv6 routed through tunnel")
+	}
+
+	// Keep failover nodes reachable outside the tunnel
+	for _, up := range cfg.Upstreams[1:] {
+		if up.RemoteHost == "" {
+			continue // Routed once node discovery finds it
+		}
+		if err := tunDev.AddHostRoute(up.RemoteHost); err != nil {
+			slog.Warn("Failed to route failover node", "endpoint", up.Endpoint, "error", err)
+		}
+	}
+
+	// Keep excluded prefixes (and optionally the LAN) off the tunnel
+	excludeIPs := cfg.ExcludeIPs
+	if excludeLAN {
+		lan, err := tun.LANPrefix(cfg.GatewayIP)
+		if err != nil {
+			slog.Warn("Failed to detect LAN subnet", "error", err)
+		} else {
+			excludeIPs = append(excludeIPs, lan)
+		}
+	}
+	for _, prefix := range excludeIPs {
+		if err := tunDev.AddExcludeRoute(prefix); err != nil {
+			dev.Close()
+			slog.Error("Failed to exclude route", "prefix", prefix, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Excluded from tunnel", "prefix", prefix)
+	}
+
+	return dev, tunDev
+}
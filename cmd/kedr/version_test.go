@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"seras-protocol/internal/version"
+)
+
+// TestVersionSkipsSetup runs main with -version in a child process, since
+// main exits on errors, and checks it prints the version before any
+// config file, doctor checks or TUN is touched
+func TestVersionSkipsSetup(t *testing.T) {
+	if os.Getenv("SERAS_TEST_MAIN") == "1" {
+		os.Args = []string{"kedr", "-version", "-doctor", "-config", filepath.Join(t.TempDir(), "missing.yaml")}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionSkipsSetup$")
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), "SERAS_TEST_MAIN=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("kedr -version: %v\n%s", err, stderr.Bytes())
+	}
+	// The test binary's own PASS follows what main printed
+	if got, want := string(bytes.TrimSuffix(out, []byte("PASS\n"))), version.String()+"\n"; got != want {
+		t.Fatalf("printed %q, want %q", got, want)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("logged before exiting:\n%s", stderr.Bytes())
+	}
+}
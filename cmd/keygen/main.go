@@ -2,84 +2,252 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 
+	"seras-protocol/internal/logging"
+	"seras-protocol/internal/qr"
+	"seras-protocol/internal/version"
+	"seras-protocol/pkg/helpers"
 	"seras-protocol/pkg/taiga/msg"
 )
 
+// Output formats
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatEnv  = "env"
+	formatQR   = "qr"
+)
+
+// keyPair is a private key and its public key
+type keyPair struct {
+	private msg.Key
+	public  msg.Key
+}
+
+// jsonKeys is one key pair in the JSON output. PrivateFile replaces Private
+// when -out wrote the private key to a file.
+type jsonKeys struct {
+	Private     string `json:"private,omitempty"`
+	PrivateFile string `json:"private_file,omitempty"`
+	Public      string `json:"public"`
+}
+
 func main() {
+	if err := logging.Setup(); err != nil {
+		fail(err.Error())
+	}
+
 	genClient := flag.Bool("client", false, "Generate client key pair")
 	genNode := flag.Bool("node", false, "Generate node key pair")
-	privKeyHex := flag.String("derive", "", "Derive public key from private key (hex)")
+	privKeyText := flag.String("derive", "", "Derive public key from private key (hex, base64 or bech32)")
+	outPath := flag.String("out", "", "With -client or -node, write the private key to this file (mode 0600) instead of printing it")
+	format := flag.String("format", formatText, "Output format: text, json, env or qr")
+	endpoint := flag.String("endpoint", "", "Node endpoint to encode with the node public key in qr output (e.g. wss://host/ws)")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
-	if *privKeyHex != "" {
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if *outPath != "" && *genClient == *genNode {
+		fail("-out requires exactly one of -client or -node")
+	}
+	switch *format {
+	case formatText, formatJSON, formatEnv, formatQR:
+	default:
+		fail(fmt.Sprintf("unknown format %q (want text, json, env or qr)", *format))
+	}
+
+	if *privKeyText != "" {
 		// Derive public key from private
-		privBytes, err := hex.DecodeString(*privKeyHex)
-		if err != nil || len(privBytes) != 32 {
-			fmt.Println("Error: private key must be 64 hex characters")
-			os.Exit(1)
+		var pair keyPair
+		var err error
+		if pair.private, err = msg.ParsePrivateKey(*privKeyText); err != nil {
+			fail("private key: " + err.Error())
 		}
-		var privKey msg.Key
-		copy(privKey[:], privBytes)
-
-		pubKey, err := msg.PublicKeyFromPrivate(privKey)
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+		pair.private.Clamp()
+		if pair.public, err = msg.PublicKeyFromPrivate(pair.private); err != nil {
+			fail(err.Error())
 		}
-
-		fmt.Printf("Private: %s\n", hex.EncodeToString(privKey[:]))
-		fmt.Printf("Public:  %s\n", hex.EncodeToString(pubKey[:]))
+		printDerived(*format, &pair)
 		return
 	}
 
-	if *genClient {
-		priv, pub, err := msg.GenerateKeyPair()
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
-		}
+	var client, node *keyPair
+	if *genClient || !*genNode {
+		client = generate()
+	}
+	if *genNode || !*genClient {
+		node = generate()
+	}
+
+	switch *format {
+	case formatJSON:
+		printJSON(client, node, *outPath)
+	case formatEnv:
+		printEnv(client, node, *outPath)
+	case formatQR:
+		printQR(client, node, *outPath, *endpoint)
+	default:
+		printText(client, node, *outPath)
+	}
+}
+
+func generate() *keyPair {
+	priv, pub, err := msg.GenerateKeyPair()
+	if err != nil {
+		fail(err.Error())
+	}
+	return &keyPair{private: priv, public: pub}
+}
+
+func fail(reason string) {
+	fmt.Printf("Error: %s\n", reason)
+	os.Exit(1)
+}
+
+func printDerived(format string, pair *keyPair) {
+	defer clear(pair.private[:])
+	switch format {
+	case formatJSON:
+		printJSONValue(jsonKeys{Private: hex.EncodeToString(pair.private[:]), Public: hex.EncodeToString(pair.public[:])})
+	case formatEnv:
+		fmt.Printf("export PRIVATE_KEY=%x\n", pair.private[:])
+		fmt.Printf("export PUBLIC_KEY=%x\n", pair.public[:])
+	case formatQR:
+		printQRCode(hex.EncodeToString(pair.public[:]))
+	default:
+		fmt.Printf("Private: %s\n", hex.EncodeToString(pair.private[:]))
+		fmt.Printf("Public:  %s\n", hex.EncodeToString(pair.public[:]))
+	}
+}
+
+func printText(client, node *keyPair, outPath string) {
+	switch {
+	case node == nil:
 		fmt.Println("# Client keys (add to .env.client)")
-		fmt.Printf("PRIVATE_KEY=%s\n", hex.EncodeToString(priv[:]))
+		printPrivateKey("", "PRIVATE_KEY", &client.private, outPath)
 		fmt.Println()
 		fmt.Println("# Add this to .env.node as CLIENT_PUBLIC_KEY")
-		fmt.Printf("CLIENT_PUBLIC_KEY=%s\n", hex.EncodeToString(pub[:]))
-		return
-	}
-
-	if *genNode {
-		priv, pub, err := msg.GenerateKeyPair()
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
-		}
+		fmt.Printf("CLIENT_PUBLIC_KEY=%s\n", hex.EncodeToString(client.public[:]))
+	case client == nil:
 		fmt.Println("# Node keys (add to .env.node)")
-		fmt.Printf("NODE_PRIVATE_KEY=%s\n", hex.EncodeToString(priv[:]))
-		fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(pub[:]))
+		printPrivateKey("", "NODE_PRIVATE_KEY", &node.private, outPath)
+		fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(node.public[:]))
 		fmt.Println()
 		fmt.Println("# Add NODE_PUBLIC_KEY to .env.client")
-		return
+	default:
+		fmt.Println("=== Generating new key pairs ===")
+		fmt.Println()
+
+		fmt.Println("# .env.node")
+		printPrivateKey("", "NODE_PRIVATE_KEY", &node.private, "")
+		fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(node.public[:]))
+		fmt.Printf("CLIENT_PUBLIC_KEY=%s\n", hex.EncodeToString(client.public[:]))
+		fmt.Println()
+
+		fmt.Println("# .env.client")
+		printPrivateKey("", "PRIVATE_KEY", &client.private, "")
+		fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(node.public[:]))
 	}
+}
 
-	// Default: generate both
-	fmt.Println("=== Generating new key pairs ===")
-	fmt.Println()
+// printEnv prints lines ready to source in a shell or load as a .env file
+func printEnv(client, node *keyPair, outPath string) {
+	if node != nil {
+		printPrivateKey("export ", "NODE_PRIVATE_KEY", &node.private, outPath)
+		fmt.Printf("export NODE_PUBLIC_KEY=%x\n", node.public[:])
+	}
+	if client != nil {
+		printPrivateKey("export ", "PRIVATE_KEY", &client.private, outPath)
+		fmt.Printf("export CLIENT_PUBLIC_KEY=%x\n", client.public[:])
+	}
+}
+
+func printJSON(client, node *keyPair, outPath string) {
+	out := struct {
+		Client *jsonKeys `json:"client,omitempty"`
+		Node   *jsonKeys `json:"node,omitempty"`
+	}{
+		Client: toJSON(client, outPath),
+		Node:   toJSON(node, outPath),
+	}
+	printJSONValue(out)
+}
 
-	// Node keys
-	nodePriv, nodePub, _ := msg.GenerateKeyPair()
-	fmt.Println("# .env.node")
-	fmt.Printf("NODE_PRIVATE_KEY=%s\n", hex.EncodeToString(nodePriv[:]))
-	fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(nodePub[:]))
+func toJSON(pair *keyPair, outPath string) *jsonKeys {
+	if pair == nil {
+		return nil
+	}
+	defer clear(pair.private[:])
 
-	// Client keys
-	clientPriv, clientPub, _ := msg.GenerateKeyPair()
-	fmt.Printf("CLIENT_PUBLIC_KEY=%s\n", hex.EncodeToString(clientPub[:]))
+	keys := &jsonKeys{Public: hex.EncodeToString(pair.public[:])}
+	if outPath != "" {
+		if err := helpers.WriteKeyFile(outPath, pair.private); err != nil {
+			fail(err.Error())
+		}
+		keys.PrivateFile = outPath
+	} else {
+		keys.Private = hex.EncodeToString(pair.private[:])
+	}
+	return keys
+}
+
+func printJSONValue(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Println(string(data))
+}
+
+// printQR prints the private keys as env lines, then the public key a mobile
+// client needs as a QR code: the node's, as a NODES entry when an endpoint is
+// given, else the client's
+func printQR(client, node *keyPair, outPath, endpoint string) {
+	printEnv(client, node, outPath)
 	fmt.Println()
 
-	fmt.Println("# .env.client")
-	fmt.Printf("PRIVATE_KEY=%s\n", hex.EncodeToString(clientPriv[:]))
-	fmt.Printf("NODE_PUBLIC_KEY=%s\n", hex.EncodeToString(nodePub[:]))
+	if node == nil {
+		fmt.Println("# Client public key")
+		printQRCode(hex.EncodeToString(client.public[:]))
+		return
+	}
+	content := hex.EncodeToString(node.public[:])
+	if endpoint != "" {
+		content = endpoint + ":" + content
+		fmt.Println("# Node endpoint and public key")
+	} else {
+		fmt.Println("# Node public key")
+	}
+	printQRCode(content)
+}
+
+func printQRCode(content string) {
+	code, err := qr.Encode([]byte(content))
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Print(code.Terminal())
+	fmt.Println(content)
+}
+
+// printPrivateKey prints the env line for a private key, or writes the key to
+// path and prints the matching _FILE line. The key is zeroed afterwards.
+func printPrivateKey(prefix, name string, key *msg.Key, path string) {
+	defer clear(key[:])
+	if path == "" {
+		fmt.Printf("%s%s=%s\n", prefix, name, hex.EncodeToString(key[:]))
+		return
+	}
+	if err := helpers.WriteKeyFile(path, *key); err != nil {
+		fail(err.Error())
+	}
+	fmt.Printf("%s%s_FILE=%s\n", prefix, name, path)
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"seras-protocol/pkg/helpers"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// capture returns what f prints to stdout
+func capture(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+// fixedPair returns a copy of pair, since printing zeroes the private key
+func fixedPair(pair keyPair) *keyPair {
+	return &pair
+}
+
+// parseKey decodes a hex key from the output
+func parseKey(t *testing.T, s string) msg.Key {
+	t.Helper()
+	var key msg.Key
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != len(key) {
+		t.Fatalf("%q is not a hex key", s)
+	}
+	copy(key[:], data)
+	return key
+}
+
+// checkPair verifies that public is the key derived from private
+func checkPair(t *testing.T, private, public msg.Key) {
+	t.Helper()
+	derived, err := msg.PublicKeyFromPrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derived != public {
+		t.Fatalf("public key %x does not derive from the private key", public[:])
+	}
+}
+
+// envLines parses "export NAME=value" lines
+func envLines(t *testing.T, out string) map[string]string {
+	t.Helper()
+	vars := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok || !strings.HasPrefix(line, "export ") {
+			t.Fatalf("not an export line: %q", line)
+		}
+		vars[name] = value
+	}
+	return vars
+}
+
+func TestJSONSchema(t *testing.T) {
+	out := capture(t, func() { printJSON(generate(), generate(), "") })
+
+	var keys struct {
+		Client *jsonKeys `json:"client"`
+		Node   *jsonKeys `json:"node"`
+	}
+	dec := json.NewDecoder(strings.NewReader(out))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&keys); err != nil {
+		t.Fatalf("%v in:\n%s", err, out)
+	}
+	for name, k := range map[string]*jsonKeys{"client": keys.Client, "node": keys.Node} {
+		if k == nil || k.PrivateFile != "" {
+			t.Fatalf("%s: got %+v, want private and public", name, k)
+		}
+		checkPair(t, parseKey(t, k.Private), parseKey(t, k.Public))
+	}
+
+	// One pair only leaves the other out entirely
+	out = capture(t, func() { printJSON(generate(), nil, "") })
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(out), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["node"]; ok || len(fields) != 1 {
+		t.Fatalf("client-only output has fields %v", fields)
+	}
+}
+
+func TestJSONWithKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.key")
+	out := capture(t, func() { printJSON(generate(), nil, path) })
+
+	var keys struct {
+		Client map[string]string `json:"client"`
+	}
+	if err := json.Unmarshal([]byte(out), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.Client["private"]; ok || keys.Client["private_file"] != path {
+		t.Fatalf("got %v, want private_file %s and no private key", keys.Client, path)
+	}
+	data, err := helpers.ReadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPair(t, parseKey(t, string(bytes.TrimSpace(data))), parseKey(t, keys.Client["public"]))
+}
+
+func TestFormatsAgree(t *testing.T) {
+	pair := *generate()
+
+	var fromJSON jsonKeys
+	if err := json.Unmarshal([]byte(capture(t, func() { printDerived(formatJSON, fixedPair(pair)) })), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	env := envLines(t, capture(t, func() { printDerived(formatEnv, fixedPair(pair)) }))
+	text := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(capture(t, func() { printDerived(formatText, fixedPair(pair)) })), "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		text[name] = strings.TrimSpace(value)
+	}
+	qrLines := strings.Split(strings.TrimSpace(capture(t, func() { printDerived(formatQR, fixedPair(pair)) })), "\n")
+
+	private, public := hex.EncodeToString(pair.private[:]), hex.EncodeToString(pair.public[:])
+	privates := []string{fromJSON.Private, env["PRIVATE_KEY"], text["Private"]}
+	publics := []string{fromJSON.Public, env["PUBLIC_KEY"], text["Public"], qrLines[len(qrLines)-1]}
+	for _, got := range privates {
+		if got != private {
+			t.Fatalf("private keys %q, want %s in every format", privates, private)
+		}
+	}
+	for _, got := range publics {
+		if got != public {
+			t.Fatalf("public keys %q, want %s in every format", publics, public)
+		}
+	}
+	checkPair(t, parseKey(t, fromJSON.Private), parseKey(t, fromJSON.Public))
+}
+
+func TestEnvFormat(t *testing.T) {
+	client, node := generate(), generate()
+	want := map[string]string{
+		"PRIVATE_KEY":       hex.EncodeToString(client.private[:]),
+		"CLIENT_PUBLIC_KEY": hex.EncodeToString(client.public[:]),
+		"NODE_PRIVATE_KEY":  hex.EncodeToString(node.private[:]),
+		"NODE_PUBLIC_KEY":   hex.EncodeToString(node.public[:]),
+	}
+	vars := envLines(t, capture(t, func() { printEnv(client, node, "") }))
+	if len(vars) != len(want) {
+		t.Fatalf("got %v, want %v", vars, want)
+	}
+	for name, value := range want {
+		if vars[name] != value {
+			t.Fatalf("%s=%s, want %s", name, vars[name], value)
+		}
+	}
+}
+
+func TestQRContent(t *testing.T) {
+	node := generate()
+	public := hex.EncodeToString(node.public[:])
+	out := capture(t, func() { printQR(nil, node, "", "wss://node.example/ws") })
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if got, want := lines[len(lines)-1], "wss://node.example/ws:"+public; got != want {
+		t.Fatalf("encoded %q, want %q", got, want)
+	}
+	if !strings.Contains(out, "█") && !strings.Contains(out, "▀") && !strings.Contains(out, "▄") {
+		t.Fatalf("no QR code in:\n%s", out)
+	}
+}
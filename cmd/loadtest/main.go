@@ -0,0 +1,719 @@
+// Command loadtest runs a node in-process and connects N clients to it at
+// once over the loopback, UDP or TCP transport. Every client handshakes, then
+// streams synthetic packets that the node's side of the TUN echoes back.
+// Meanwhile -churn extra clients connect, handshake and disconnect in a loop,
+// racing the node's connection teardown against its handshakes and routing;
+// build with -race to check them. It reports handshake times, throughput,
+// losses, errors and the node's connection table, and fails on dropped
+// handshakes, leaked sessions or goroutines, or losses over the allowed rate.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/vpn"
+	"seras-protocol/internal/netpkt"
+	"seras-protocol/internal/node/handler"
+	"seras-protocol/internal/transport/client/tcp"
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/loopback"
+	"seras-protocol/internal/transport/server"
+	tcpserver "seras-protocol/internal/transport/server/tcp"
+	udpserver "seras-protocol/internal/transport/server/udp"
+	"seras-protocol/internal/tun/tuntest"
+	"seras-protocol/internal/version"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// Output formats
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+const (
+	// loopbackName is the in-process server clients dial
+	loopbackName = "loadtest"
+	// echoDst is where synthetic packets are addressed (TEST-NET-2)
+	echoDst = "198.51.100.1"
+	// headerSize is the IPv4 and UDP headers of a synthetic packet
+	headerSize = 20 + 8
+	// settleTimeout bounds waiting for sessions and goroutines to wind down
+	settleTimeout = 5 * time.Second
+	// stallTimeout is how long a client waits for an echo before sending
+	// past its window, and for stragglers once everything is sent
+	stallTimeout = 2 * time.Second
+)
+
+// options are the command-line settings
+type options struct {
+	clients   int
+	packets   int
+	size      int
+	transport string
+	subnet    string
+	timeout   time.Duration
+	maxLoss   float64
+	session   bool
+	suites    []msg.Suite
+	window    int
+	churn     int
+}
+
+// clientResult is what one client saw
+type clientResult struct {
+	handshake time.Duration
+	sent      int
+	received  int
+	err       error
+}
+
+// report is the run summary, also the JSON output
+type report struct {
+	Transport        string  `json:"transport"`
+	Clients          int     `json:"clients"`
+	Handshakes       int     `json:"handshakes"`
+	HandshakesFailed int     `json:"handshakes_failed"`
+	HandshakeP50Ms   float64 `json:"handshake_p50_ms"`
+	HandshakeMaxMs   float64 `json:"handshake_max_ms"`
+	PeakConnections  int     `json:"peak_connections"`  // Node sessions once every client was in
+	FinalConnections int     `json:"final_connections"` // Node sessions left after clients disconnected
+	PacketsSent      int     `json:"packets_sent"`
+	PacketsReceived  int     `json:"packets_received"`
+	LossRate         float64 `json:"loss_rate"`
+	Errors           int     `json:"errors"`
+	DurationSec      float64 `json:"duration_sec"`
+	PacketsPerSec    float64 `json:"packets_per_sec"`
+	MBPerSec         float64 `json:"mb_per_sec"`
+	LeakedGoroutines int     `json:"leaked_goroutines"`
+	Reconnects       int     `json:"reconnects"`   // Handshakes completed by churning clients
+	ChurnFailed      int     `json:"churn_failed"` // Churning clients that failed to connect or stop
+}
+
+func main() {
+	var opts options
+	flag.IntVar(&opts.clients, "clients", 50, "Number of concurrent clients")
+	flag.IntVar(&opts.packets, "packets", 1000, "Packets each client sends")
+	flag.IntVar(&opts.size, "size", 512, "Packet size in bytes")
+	flag.IntVar(&opts.window, "window", 16, "Packets each client keeps in flight")
+	flag.StringVar(&opts.transport, "transport", "loopback", "Transport: loopback, udp or tcp")
+	flag.StringVar(&opts.subnet, "subnet", "10.250.0.0/16", "Subnet the node assigns client addresses from")
+	flag.DurationVar(&opts.timeout, "timeout", time.Minute, "Time allowed for handshakes and for streaming")
+	flag.Float64Var(&opts.maxLoss, "max-loss", 0, "Highest fraction of packets allowed to go missing")
+	flag.IntVar(&opts.churn, "churn", 0, "Extra clients that reconnect in a loop while the others stream")
+	flag.BoolVar(&opts.session, "session", false, "Use session keys instead of per-message ECDH")
+	flag.Func("suites", "Cipher suites clients offer, preferred first (default: all)", func(s string) (err error) {
+		opts.suites, err = msg.ParseSuites(s)
+		return err
+	})
+	format := flag.String("format", formatText, "Output format: text or json")
+	verbose := flag.Bool("verbose", false, "Log node and client activity")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	switch *format {
+	case formatText, formatJSON:
+	default:
+		fail(fmt.Sprintf("unknown format %q (want text or json)", *format))
+	}
+	if err := opts.validate(); err != nil {
+		fail(err.Error())
+	}
+	// The report says what went wrong; logs from every client would bury it
+	if !*verbose {
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	}
+
+	r, err := run(opts)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	if *format == formatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fail(err.Error())
+		}
+	} else {
+		r.print()
+	}
+
+	if problems := r.problems(opts); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Printf("FAIL: %s\n", p)
+		}
+		os.Exit(1)
+	}
+}
+
+func fail(reason string) {
+	fmt.Printf("Error: %s\n", reason)
+	os.Exit(1)
+}
+
+func (o options) validate() error {
+	if o.clients < 1 {
+		return fmt.Errorf("clients must be a positive integer, got: %d", o.clients)
+	}
+	if o.packets < 0 {
+		return fmt.Errorf("packets must be a non-negative integer, got: %d", o.packets)
+	}
+	if o.churn < 0 {
+		return fmt.Errorf("churn must be a non-negative integer, got: %d", o.churn)
+	}
+	if o.window < 1 {
+		return fmt.Errorf("window must be a positive integer, got: %d", o.window)
+	}
+	if o.size < headerSize || o.size > 1400 {
+		return fmt.Errorf("size must be an integer between %d and 1400, got: %d", headerSize, o.size)
+	}
+	switch o.transport {
+	case "loopback", "udp", "tcp":
+	default:
+		return fmt.Errorf("transport must be 'loopback', 'udp' or 'tcp', got: %s", o.transport)
+	}
+	prefix, err := netip.ParsePrefix(o.subnet)
+	if err != nil || !prefix.Addr().Is4() {
+		return fmt.Errorf("subnet must be an IPv4 CIDR, got: %s", o.subnet)
+	}
+	// Network, gateway and broadcast addresses aren't handed out
+	if hosts := 1<<(32-prefix.Bits()) - 3; o.clients+o.churn > hosts {
+		return fmt.Errorf("subnet %s holds %d clients, fewer than %d", o.subnet, hosts, o.clients+o.churn)
+	}
+	if o.maxLoss < 0 || o.maxLoss > 1 {
+		return fmt.Errorf("max-loss must be between 0 and 1, got: %v", o.maxLoss)
+	}
+	return nil
+}
+
+// node is the in-process node: the real handler on an in-memory TUN whose
+// far side echoes every packet back to its sender
+type node struct {
+	handler   *handler.Handler
+	dev       *tuntest.Device
+	publicKey msg.Key
+	server    server.Server
+	endpoint  string // What clients dial
+	// Whether the transport is a lossless stream that tells the node when a
+	// client leaves; UDP drops datagrams under load, and its sessions only
+	// end when idle or when the server stops
+	disconnects bool
+	stopReader  context.CancelFunc
+	stopEcho    context.CancelFunc
+	reader      sync.WaitGroup
+	echoer      sync.WaitGroup
+}
+
+func startNode(opts options) (*node, error) {
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	prefix := netip.MustParsePrefix(opts.subnet).Masked()
+	pool, err := handler.NewIPPool(prefix.String(), prefix.Addr().Next().String())
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{
+		dev:       tuntest.New("loadtest0", 1500, 1024),
+		publicKey: publicKey,
+	}
+	n.handler = handler.NewHandler(n.dev, privateKey, pool)
+
+	listening := make(chan struct{})
+	switch opts.transport {
+	case "loopback":
+		s := loopback.NewServer(loopbackName, func(conn *loopback.Connection, data []byte) {
+			n.handler.HandleMessage(conn, data)
+		})
+		s.SetOnDisconnect(func(conn *loopback.Connection) { n.handler.RemoveConnection(conn) })
+		s.SetOnListening(func() { close(listening) })
+		n.server, n.endpoint, n.disconnects = s, loopbackName, true
+	case "udp":
+		addr, err := freeUDPAddr()
+		if err != nil {
+			return nil, err
+		}
+		s := udpserver.NewServer(addr, func(conn *udpserver.Connection, data []byte) {
+			n.handler.HandleMessage(conn, data)
+		})
+		s.SetOnDisconnect(func(conn *udpserver.Connection) { n.handler.RemoveConnection(conn) })
+		s.SetOnListening(func() { close(listening) })
+		n.server, n.endpoint = s, addr
+	case "tcp":
+		addr, err := freeTCPAddr()
+		if err != nil {
+			return nil, err
+		}
+		s := tcpserver.NewServer(addr, func(conn *tcpserver.Connection, data []byte) {
+			n.handler.HandleMessage(conn, data)
+		})
+		s.SetOnDisconnect(func(conn *tcpserver.Connection) { n.handler.RemoveConnection(conn) })
+		s.SetOnListening(func() { close(listening) })
+		n.server, n.endpoint, n.disconnects = s, addr, true
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- n.server.Start() }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		return nil, fmt.Errorf("start %s server: %w", opts.transport, err)
+	}
+
+	readerCtx, stopReader := context.WithCancel(context.Background())
+	echoCtx, stopEcho := context.WithCancel(context.Background())
+	n.stopReader, n.stopEcho = stopReader, stopEcho
+	n.reader.Add(1)
+	go func() {
+		defer n.reader.Done()
+		n.handler.StartTUNReader(readerCtx)
+	}()
+	n.echoer.Add(1)
+	go func() {
+		defer n.echoer.Done()
+		n.echo(echoCtx)
+	}()
+	return n, nil
+}
+
+// freeUDPAddr returns a loopback address with a port free a moment ago
+func freeUDPAddr() (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String(), nil
+}
+
+// freeTCPAddr returns a loopback address with a port free a moment ago
+func freeTCPAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// echo returns each packet the handler writes to the TUN with its addresses
+// swapped, as a host answering every client would, until ctx is done
+func (n *node) echo(ctx context.Context) {
+	for {
+		select {
+		case packet := <-n.dev.Written:
+			// Swapping addresses leaves the IPv4 and UDP checksums valid
+			var src [4]byte
+			copy(src[:], packet[12:16])
+			copy(packet[12:16], packet[16:20])
+			copy(packet[16:20], src[:])
+			n.dev.Inject(packet)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stop waits for the connection table to empty, then stops the server and
+// the TUN side. It returns the sessions left once clients were gone: after
+// their disconnects, or for UDP after the server dropped them.
+func (n *node) stop() int {
+	if n.disconnects {
+		deadline := time.Now().Add(settleTimeout)
+		for n.handler.Clients() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	remaining := n.handler.Clients()
+
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+	if err := n.server.Stop(ctx); err != nil {
+		slog.Error("Failed to stop server", "error", err)
+	}
+	if !n.disconnects {
+		remaining = n.handler.Clients()
+	}
+	// The reader keeps draining while echo stops, so an Inject can't block it
+	n.stopEcho()
+	n.echoer.Wait()
+	n.stopReader()
+	n.dev.Close()
+	n.reader.Wait()
+	return remaining
+}
+
+// clientDevice is an in-memory client TUN that reports the address the node
+// assigns, which marks the handshake complete
+type clientDevice struct {
+	*tuntest.Device
+	assigned chan netip.Addr
+}
+
+func (d *clientDevice) SetLocalIP(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	select {
+	case d.assigned <- addr:
+	default:
+	}
+	return nil
+}
+
+// loadClient is one VPN client and its device
+type loadClient struct {
+	vpn    *vpn.Client
+	dev    *clientDevice
+	cancel context.CancelFunc
+	runErr chan error
+}
+
+func startClient(opts options, n *node, privateKey msg.Key) *loadClient {
+	up := config.Upstream{PublicKey: n.publicKey, Type: opts.transport, Endpoint: n.endpoint}
+	switch opts.transport {
+	case "loopback":
+		up.TransportConfig = &loopback.Config{Name: n.endpoint}
+	case "udp":
+		up.TransportConfig = &udp.Config{Addr: n.endpoint}
+	case "tcp":
+		up.TransportConfig = &tcp.Config{Addr: n.endpoint}
+	}
+
+	dev := &clientDevice{
+		Device:   tuntest.New("client0", 1500, opts.window+1),
+		assigned: make(chan netip.Addr, 1),
+	}
+	cfg := &config.ConnConfig{
+		PrivateKey:       privateKey,
+		Upstreams:        []config.Upstream{up},
+		HandshakeTimeout: opts.timeout,
+		HandshakeRetries: 1,
+		SessionMode:      opts.session,
+		CipherSuites:     opts.suites,
+		TUNBatch:         1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &loadClient{vpn: vpn.NewClient(cfg, dev), dev: dev, cancel: cancel, runErr: make(chan error, 1)}
+	go func() { c.runErr <- c.vpn.Run(ctx) }()
+	return c
+}
+
+// stream sends opts.packets packets from src, keeping up to opts.window in
+// flight, and counts the echoes that come back before the deadline. When no
+// echo arrives for stallTimeout the window is refilled, so lost packets slow
+// the client down rather than stopping it; late echoes still count. Over a
+// lossless transport every echo is awaited, however long the queues get.
+func (c *loadClient) stream(opts options, src netip.Addr, lossless bool, deadline time.Time, res *clientResult) {
+	dst := netip.MustParseAddr(echoDst)
+	end := time.NewTimer(time.Until(deadline))
+	defer end.Stop()
+	stall := time.NewTimer(stallTimeout)
+	defer stall.Stop()
+	if lossless {
+		stall.Stop()
+	}
+
+	inFlight := 0
+	for res.received < opts.packets {
+		for inFlight < opts.window && res.sent < opts.packets {
+			c.dev.Inject(syntheticPacket(src, dst, uint16(res.sent), opts.size))
+			res.sent++
+			inFlight++
+		}
+
+		select {
+		case <-c.dev.Written:
+			res.received++
+			inFlight = max(inFlight-1, 0)
+			if !lossless {
+				stall.Reset(stallTimeout)
+			}
+		case <-stall.C:
+			inFlight = 0
+			if res.sent == opts.packets {
+				// Nothing more arrived; the rest is lost
+				return
+			}
+			stall.Reset(stallTimeout)
+		case err := <-c.runErr:
+			res.err = fmt.Errorf("client stopped: %w", err)
+			c.runErr <- err
+			return
+		case <-end.C:
+			return
+		}
+	}
+}
+
+// stop ends the client's session and waits for Run to return
+func (c *loadClient) stop() error {
+	c.cancel()
+	err := <-c.runErr
+	c.vpn.Close()
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// syntheticPacket builds an IPv4/UDP packet of size bytes
+func syntheticPacket(src, dst netip.Addr, id uint16, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45 // IPv4, 20-byte header
+	binary.BigEndian.PutUint16(packet[2:], uint16(size))
+	binary.BigEndian.PutUint16(packet[4:], id)
+	packet[8] = 64 // TTL
+	packet[9] = 17 // UDP
+	s, d := src.As4(), dst.As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 9) // discard
+	binary.BigEndian.PutUint16(packet[24:], uint16(size-20))
+	for i := headerSize; i < size; i++ {
+		packet[i] = byte(i)
+	}
+	netpkt.Fix(packet)
+	return packet
+}
+
+// run starts the node, connects every client, streams and tears it all down
+func run(opts options) (*report, error) {
+	baseline := runtime.NumGoroutine()
+
+	n, err := startNode(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*loadClient, opts.clients)
+	results := make([]clientResult, opts.clients)
+	addrs := make([]netip.Addr, opts.clients)
+
+	// Every client handshakes at once; streaming starts once all are in
+	var joined sync.WaitGroup
+	handshakeDeadline := time.Now().Add(opts.timeout)
+	for i := range clients {
+		joined.Add(1)
+		go func() {
+			defer joined.Done()
+			start := time.Now()
+			privateKey, _, _ := msg.GenerateKeyPair()
+			clients[i] = startClient(opts, n, privateKey)
+			select {
+			case addrs[i] = <-clients[i].dev.assigned:
+				results[i].handshake = time.Since(start)
+			case err := <-clients[i].runErr:
+				results[i].err = fmt.Errorf("handshake: %w", err)
+				clients[i].runErr <- err
+			case <-time.After(time.Until(handshakeDeadline)):
+				results[i].err = errors.New("handshake: no address assigned in time")
+			}
+		}()
+	}
+	joined.Wait()
+	peak := n.handler.Clients()
+
+	stopChurn := make(chan struct{})
+	churnResults := make([]churnResult, opts.churn)
+	var churned sync.WaitGroup
+	for i := range churnResults {
+		churned.Add(1)
+		go func() {
+			defer churned.Done()
+			churnResults[i] = churn(opts, n, stopChurn)
+		}()
+	}
+
+	var streamed sync.WaitGroup
+	start := time.Now()
+	streamDeadline := start.Add(opts.timeout)
+	for i, c := range clients {
+		if results[i].err != nil {
+			continue
+		}
+		streamed.Add(1)
+		go func() {
+			defer streamed.Done()
+			c.stream(opts, addrs[i], n.disconnects, streamDeadline, &results[i])
+		}()
+	}
+	streamed.Wait()
+	elapsed := time.Since(start)
+	close(stopChurn)
+	churned.Wait()
+
+	errorCount := 0
+	for i, c := range clients {
+		// A client that failed earlier was already counted
+		if err := c.stop(); err != nil && results[i].err == nil {
+			slog.Error("Client failed", "client", i, "error", err)
+			errorCount++
+		}
+	}
+	remaining := n.stop()
+
+	r := summarize(opts, results, elapsed)
+	r.PeakConnections = peak
+	r.FinalConnections = remaining
+	r.Errors += errorCount
+	r.LeakedGoroutines = settleGoroutines(baseline)
+	for _, cr := range churnResults {
+		r.Reconnects += cr.handshakes
+		r.ChurnFailed += cr.failed
+	}
+	return r, nil
+}
+
+// churnResult is what one churning client saw
+type churnResult struct {
+	handshakes int
+	failed     int
+}
+
+// churn connects a client, waits for its handshake and disconnects it, over
+// and over until stop is closed. It keeps one key throughout, so over UDP,
+// where the node isn't told of disconnects, each handshake replaces the
+// previous session rather than adding one.
+func churn(opts options, n *node, stop <-chan struct{}) churnResult {
+	var res churnResult
+	privateKey, _, _ := msg.GenerateKeyPair()
+	for {
+		select {
+		case <-stop:
+			return res
+		default:
+		}
+
+		c := startClient(opts, n, privateKey)
+		failed := true
+		select {
+		case <-c.dev.assigned:
+			res.handshakes++
+			failed = false
+		case err := <-c.runErr:
+			slog.Error("Churning client failed", "error", err)
+			c.runErr <- err
+		case <-time.After(opts.timeout):
+			slog.Error("Churning client got no address in time")
+		}
+		// A client that failed to connect is counted once
+		if err := c.stop(); err != nil && !failed {
+			slog.Error("Churning client failed to stop", "error", err)
+			failed = true
+		}
+		if failed {
+			res.failed++
+		}
+	}
+}
+
+// settleGoroutines waits for goroutines to wind down to the baseline and
+// returns how many are left over it
+func settleGoroutines(baseline int) int {
+	deadline := time.Now().Add(settleTimeout)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return max(runtime.NumGoroutine()-baseline, 0)
+}
+
+func summarize(opts options, results []clientResult, elapsed time.Duration) *report {
+	r := &report{
+		Transport:   opts.transport,
+		Clients:     opts.clients,
+		DurationSec: elapsed.Seconds(),
+	}
+	var handshakes []time.Duration
+	for _, res := range results {
+		if res.handshake > 0 {
+			handshakes = append(handshakes, res.handshake)
+		} else {
+			r.HandshakesFailed++
+		}
+		if res.err != nil {
+			r.Errors++
+		}
+		r.PacketsSent += res.sent
+		r.PacketsReceived += res.received
+	}
+	r.Handshakes = len(handshakes)
+	if len(handshakes) > 0 {
+		slices.Sort(handshakes)
+		r.HandshakeP50Ms = float64(handshakes[len(handshakes)/2].Microseconds()) / 1000
+		r.HandshakeMaxMs = float64(handshakes[len(handshakes)-1].Microseconds()) / 1000
+	}
+	if r.PacketsSent > 0 {
+		r.LossRate = 1 - float64(r.PacketsReceived)/float64(r.PacketsSent)
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.PacketsPerSec = float64(r.PacketsReceived) / secs
+		// Each packet crosses the tunnel twice
+		r.MBPerSec = float64(2*r.PacketsReceived*opts.size) / 1e6 / secs
+	}
+	return r
+}
+
+func (r *report) print() {
+	fmt.Printf("Transport:          %s\n", r.Transport)
+	fmt.Printf("Clients:            %d\n", r.Clients)
+	fmt.Printf("Handshakes:         %d ok, %d failed (p50 %.1fms, max %.1fms)\n", r.Handshakes, r.HandshakesFailed, r.HandshakeP50Ms, r.HandshakeMaxMs)
+	fmt.Printf("Node connections:   %d at peak, %d after disconnect\n", r.PeakConnections, r.FinalConnections)
+	fmt.Printf("Packets:            %d sent, %d echoed (%.2f%% lost)\n", r.PacketsSent, r.PacketsReceived, r.LossRate*100)
+	fmt.Printf("Throughput:         %.0f pkts/s, %.2f MB/s over %.2fs\n", r.PacketsPerSec, r.MBPerSec, r.DurationSec)
+	fmt.Printf("Reconnects:         %d ok, %d failed\n", r.Reconnects, r.ChurnFailed)
+	fmt.Printf("Errors:             %d\n", r.Errors)
+	fmt.Printf("Leaked goroutines:  %d\n", r.LeakedGoroutines)
+}
+
+// problems lists what makes the run a failure
+func (r *report) problems(opts options) []string {
+	var problems []string
+	if r.HandshakesFailed > 0 {
+		problems = append(problems, fmt.Sprintf("%d of %d handshakes failed", r.HandshakesFailed, r.Clients))
+	}
+	if r.PeakConnections != r.Handshakes {
+		problems = append(problems, fmt.Sprintf("node held %d connections for %d handshakes", r.PeakConnections, r.Handshakes))
+	}
+	if r.FinalConnections > 0 {
+		problems = append(problems, fmt.Sprintf("%d connections left on the node after disconnect", r.FinalConnections))
+	}
+	if r.LossRate > opts.maxLoss {
+		problems = append(problems, fmt.Sprintf("lost %.2f%% of packets, over the %.2f%% allowed", r.LossRate*100, opts.maxLoss*100))
+	}
+	if r.Errors > 0 {
+		problems = append(problems, fmt.Sprintf("%d client errors", r.Errors))
+	}
+	if r.ChurnFailed > 0 {
+		problems = append(problems, fmt.Sprintf("%d reconnects failed", r.ChurnFailed))
+	}
+	if r.LeakedGoroutines > 0 {
+		problems = append(problems, fmt.Sprintf("%d goroutines leaked", r.LeakedGoroutines))
+	}
+	return problems
+}
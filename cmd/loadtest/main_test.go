@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quiet discards logs until the test ends, as main does without -verbose
+func quiet(t *testing.T) {
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+}
+
+// testOptions returns a moderate load over transport
+func testOptions(transport string) options {
+	return options{
+		clients:   10,
+		packets:   20,
+		size:      256,
+		window:    8,
+		transport: transport,
+		subnet:    "10.250.0.0/24",
+		timeout:   30 * time.Second,
+	}
+}
+
+func TestRunModerateLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	quiet(t)
+	tests := []struct {
+		name string
+		opts func(o *options)
+	}{
+		{"loopback", func(o *options) {}},
+		{"udp", func(o *options) { o.transport = "udp" }},
+		{"tcp", func(o *options) { o.transport = "tcp" }},
+		{"session keys", func(o *options) { o.session = true }},
+		{"churn", func(o *options) { o.churn = 3 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions("loopback")
+			tt.opts(&opts)
+			if err := opts.validate(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := run(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := r.problems(opts); len(problems) > 0 {
+				t.Fatalf("run failed: %s\n%+v", strings.Join(problems, "; "), r)
+			}
+			// Every handshake lands and every packet comes back
+			if r.Handshakes != opts.clients || r.PeakConnections != opts.clients {
+				t.Fatalf("%d handshakes, %d node sessions; want %d of each", r.Handshakes, r.PeakConnections, opts.clients)
+			}
+			if want := opts.clients * opts.packets; r.PacketsSent != want || r.PacketsReceived != want {
+				t.Fatalf("%d sent, %d echoed; want %d", r.PacketsSent, r.PacketsReceived, want)
+			}
+			if opts.churn > 0 && r.Reconnects == 0 {
+				t.Fatal("churning clients never reconnected")
+			}
+		})
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *options)
+	}{
+		{"no clients", func(o *options) { o.clients = 0 }},
+		{"negative packets", func(o *options) { o.packets = -1 }},
+		{"negative churn", func(o *options) { o.churn = -1 }},
+		{"no window", func(o *options) { o.window = 0 }},
+		{"packet under a header", func(o *options) { o.size = headerSize - 1 }},
+		{"packet over 1400", func(o *options) { o.size = 1401 }},
+		{"unknown transport", func(o *options) { o.transport = "wss" }},
+		{"IPv6 subnet", func(o *options) { o.subnet = "fd00::/64" }},
+		{"subnet too small", func(o *options) { o.subnet = "10.250.0.0/29" }},
+		{"loss over 1", func(o *options) { o.maxLoss = 1.5 }},
+	}
+	if err := testOptions("loopback").validate(); err != nil {
+		t.Fatalf("valid options: %v", err)
+	}
+	for _, tt := range tests {
+		opts := testOptions("loopback")
+		tt.change(&opts)
+		if err := opts.validate(); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestReportProblems(t *testing.T) {
+	opts := testOptions("loopback")
+	clean := report{Clients: 10, Handshakes: 10, PeakConnections: 10, PacketsSent: 200, PacketsReceived: 200}
+	if problems := clean.problems(opts); len(problems) != 0 {
+		t.Fatalf("clean run reported %q", problems)
+	}
+
+	tests := map[string]func(r *report){
+		"handshakes failed": func(r *report) { r.Handshakes, r.HandshakesFailed, r.PeakConnections = 9, 1, 9 },
+		"held 19":           func(r *report) { r.PeakConnections = 19 },
+		"left on the node":  func(r *report) { r.FinalConnections = 2 },
+		"lost":              func(r *report) { r.LossRate = 0.01 },
+		"client errors":     func(r *report) { r.Errors = 1 },
+		"reconnects failed": func(r *report) { r.ChurnFailed = 1 },
+		"goroutines leaked": func(r *report) { r.LeakedGoroutines = 3 },
+	}
+	for want, change := range tests {
+		r := clean
+		change(&r)
+		problems := r.problems(opts)
+		if len(problems) != 1 || !strings.Contains(problems[0], want) {
+			t.Errorf("got %q, want one problem mentioning %q", problems, want)
+		}
+	}
+}
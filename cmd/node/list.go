@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"seras-protocol/internal/node/admin"
+)
+
+// listClients prints the running node's connection table and returns the
+// exit code
+func listClients(socket string) int {
+	if socket == "" {
+		fmt.Fprintln(os.Stderr, "Error: ADMIN_SOCKET is not set")
+		return 1
+	}
+	clients, err := admin.FetchClients(socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tIP\tIP6\tCONNECTED\tIN\tOUT\tREORDERED\tGAPS")
+	for _, c := range clients {
+		ip6 := c.IP6
+		if ip6 == "" {
+			ip6 = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			c.Key, c.IP, ip6, time.Since(c.Connected).Round(time.Second), c.BytesIn, c.BytesOut,
+			c.Reorder.Reordered, c.Reorder.Gaps)
+	}
+	w.Flush()
+	fmt.Printf("%d client(s)\n", len(clients))
+	return 0
+}
@@ -1,28 +1,84 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"seras-protocol/internal/logging"
+	"seras-protocol/internal/node/admin"
 	"seras-protocol/internal/node/config"
 	"seras-protocol/internal/node/handler"
+	"seras-protocol/internal/node/health"
+	"seras-protocol/internal/tap"
+	"seras-protocol/internal/transport/obfs"
+	"seras-protocol/internal/transport/server"
+	"seras-protocol/internal/transport/server/tcp"
 	"seras-protocol/internal/transport/server/udp"
+	"seras-protocol/internal/transport/server/v2ray"
 	"seras-protocol/internal/transport/server/wss"
 	"seras-protocol/internal/tun"
+	"seras-protocol/internal/version"
+	"seras-protocol/pkg/taiga/msg"
 )
 
+// shutdownTimeout bounds how long a graceful stop may take
+const shutdownTimeout = 10 * time.Second
+
+// readerStopTimeout bounds the wait for the TUN reader after the TUN closes
+const readerStopTimeout = 2 * time.Second
+
 func main() {
-	slog.Info("Starting Seras Node")
+	configPath := flag.String("config", "", "Path to config file (env vars override its values)")
+	list := flag.Bool("list", false, "List clients connected to the running node (via ADMIN_SOCKET) and exit")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if err := godotenv.Load(); err != nil {
 		slog.Warn("No .env file found", "error", err)
 	}
 
+	if *configPath != "" {
+		if err := config.LoadFile(*configPath); err != nil {
+			slog.Error("Failed to load config file", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Config file loaded", "path", *configPath)
+	}
+
+	if err := logging.Setup(); err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Starting Seras Node", "version", version.Version, "commit", version.Revision())
+
+	if *list {
+		os.Exit(listClients(os.Getenv("ADMIN_SOCKET")))
+	}
+
+	if err := run(); err != nil {
+		slog.Error("Node failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run sets up the node and serves until shutdown. Every return after the TUN
+// is created goes through its deferred cleanup, so the host is left as found.
+func run() error {
 	cfg, err := config.ParseNodeConfigFromEnv()
 	if err != nil {
-		slog.Error("Failed to parse config", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to parse config: %w", err)
 	}
 	slog.Info("Config loaded",
 		"transport", cfg.TransportType,
@@ -30,59 +86,329 @@ func main() {
 		"tunIP", cfg.TunIP,
 		"vpnSubnet", cfg.VPNSubnet)
 
+	if cfg.DryRun {
+		tun.SetRunner(tun.DryRunner{Out: os.Stdout})
+		slog.Info("Dry run: host commands are printed, not run")
+	}
+
+	// Serve health checks from the start so /readyz reports 503 until we're up
+	checker := health.NewChecker()
+	if cfg.HealthAddr != "" {
+		go func() {
+			if err := checker.Serve(cfg.HealthAddr); err != nil {
+				slog.Error("Health endpoint error", "error", err)
+			}
+		}()
+	}
+
+	// Undo routes and rules left behind by a crashed previous run
+	if cleaned, err := tun.CleanupStale(); err != nil {
+		slog.Warn("Failed to clean up stale TUN state", "error", err)
+	} else if len(cleaned) > 0 {
+		slog.Info("Cleaned up stale TUN state", "interfaces", cleaned)
+	}
+
 	// Create TUN interface for node with routing and NAT
-	tunDev, err := tun.NewNodeTUN(cfg.TunIP, cfg.VPNSubnet)
+	tunDev, err := tun.NewNodeTUN(cfg.TunIP, cfg.VPNSubnet, cfg.MTU, cfg.TunName, cfg.EgressIface)
 	if err != nil {
-		slog.Error("Failed to create TUN interface", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+	checker.SetTUN(true)
+	slog.Info("TUN interface created", "name", tunDev.Name(), "mtu", tunDev.MTU())
+
+	// Closing the TUN removes its routes and NAT rules and ends the reader,
+	// once one has started
+	var readerDone chan struct{}
+	defer func() {
+		checker.SetTUN(false)
+		closeTUN(tunDev, readerDone)
+	}()
+
+	// A dry run stops once setup and cleanup have been shown
+	if cfg.DryRun {
+		if cfg.EnableIPv6 {
+			if err := tunDev.SetupNodeIPv6(cfg.TunIP6, cfg.VPNSubnet6); err != nil {
+				slog.Error("Failed to set up IPv6", "error", err)
+			}
+		}
+		slog.Info("Dry run complete")
+		return nil
+	}
+
+	// Create client address pool
+	pool, err := handler.NewIPPool(cfg.VPNSubnet, cfg.TunIP)
+	if err != nil {
+		return fmt.Errorf("failed to create IP pool: %w", err)
 	}
-	defer tunDev.Close()
-	slog.Info("TUN interface created", "name", tunDev.Name())
 
 	// Create handler
-	h := handler.NewHandler(tunDev, cfg.PrivateKey)
+	h := handler.NewHandler(tunDev, cfg.PrivateKey, pool)
+	checker.SetClients(h.Clients)
+	if cfg.AdminSocket != "" {
+		go func() {
+			if err := admin.Serve(cfg.AdminSocket, h); err != nil {
+				slog.Error("Admin socket error", "error", err)
+			}
+		}()
+	}
+	msg.SetDictionary(cfg.CompressionDict)
+	h.SetCipherSuites(cfg.CipherSuites)
+	h.SetCompression(cfg.Compression)
+	h.SetPadding(cfg.Padding, tunDev.MTU())
+	h.SetTimestampSkew(cfg.TimestampSkew)
+	h.SetRelayIdleTimeout(cfg.RelayIdle)
+	h.SetRateLimit(
+		handler.RateLimit{PacketsPerSec: cfg.ClientPPS, BytesPerSec: cfg.ClientBPS},
+		handler.RateLimit{PacketsPerSec: cfg.GlobalPPS, BytesPerSec: cfg.GlobalBPS},
+	)
+	h.SetACL(handler.NewACL(cfg.EgressDeny, cfg.EgressDenyPorts))
+	if cfg.MSSClamp {
+		h.SetMSSClamp(tunDev.MTU())
+	}
+	h.SetClientNetwork(cfg.ClientMTU, cfg.ClientDNS)
+
+	if cfg.EnableIPv6 {
+		if err := tunDev.SetupNodeIPv6(cfg.TunIP6, cfg.VPNSubnet6); err != nil {
+			return fmt.Errorf("failed to set up IPv6: %w", err)
+		}
+		pool6, err := handler.NewIPPool(cfg.VPNSubnet6, cfg.TunIP6)
+		if err != nil {
+			return fmt.Errorf("failed to create IPv6 pool: %w", err)
+		}
+		h.SetIPv6Pool(pool6)
+		slog.Info("IPv6 enabled", "tunIP6", cfg.TunIP6, "vpnSubnet6", cfg.VPNSubnet6)
+	}
+
+	packetTap, err := tap.Open(cfg.DebugPcap)
+	if err != nil {
+		slog.Warn("Failed to open packet tap", "error", err)
+	} else if packetTap != nil {
+		defer packetTap.Close()
+		h.SetTap(packetTap)
+		slog.Info("Packet tap enabled", "target", cfg.DebugPcap)
+	}
 
-	// Start TUN reader in background
-	go h.StartTUNReader()
+	// Restrict clients when an allowlist is configured
+	if len(cfg.AllowedClients) > 0 || cfg.AllowedFile != "" {
+		allowlist, err := handler.NewAllowlist(cfg.AllowedClients, cfg.AllowedFile)
+		if err != nil {
+			return fmt.Errorf("failed to load allowlist: %w", err)
+		}
+		h.SetAllowlist(allowlist)
+		slog.Info("Client allowlist enabled", "keys", allowlist.Len(), "file", cfg.AllowedFile)
+
+		// Reload the allowlist file on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := h.ReloadAllowlist(); err != nil {
+					slog.Error("Failed to reload allowlist, keeping previous", "error", err)
+				}
+			}
+		}()
+	}
+
+	if cfg.Obfuscator != nil {
+		h.SetObfuscator(cfg.Obfuscator)
+		slog.Info("Frame obfuscation enabled")
+	}
+
+	// Start TUN reader in background; cancelling readerCtx and closing the
+	// TUN stops it
+	readerCtx, stopReader := context.WithCancel(context.Background())
+	defer stopReader()
+	readerDone = make(chan struct{})
+	go func() {
+		h.StartTUNReader(readerCtx)
+		close(readerDone)
+	}()
 
 	// Start server based on transport type
+	var serveErr error
 	switch cfg.TransportType {
 	case "wss":
-		startWSSServer(cfg, h)
+		serveErr = startWSSServer(cfg, h, checker)
 	case "udp":
-		startUDPServer(cfg, h)
+		serveErr = startUDPServer(cfg, h, checker)
+	case "v2ray":
+		serveErr = startV2RayServer(cfg, h, checker)
+	case "tcp":
+		serveErr = startTCPServer(cfg, h, checker)
 	default:
-		slog.Error("Unknown transport type", "type", cfg.TransportType)
-		os.Exit(1)
+		serveErr = fmt.Errorf("unknown transport type: %s", cfg.TransportType)
+	}
+
+	// The server has disconnected every client by now; the deferred cleanup
+	// stops the reader and closes the TUN
+	return serveErr
+}
+
+// closeTUN closes the TUN, interrupting a pending read, and waits briefly
+// for the reader to stop. A nil readerDone means no reader was started.
+func closeTUN(tunDev tun.Device, readerDone <-chan struct{}) {
+	if err := tunDev.Close(); err != nil {
+		slog.Warn("Failed to close TUN interface", "error", err)
+	}
+	if readerDone != nil {
+		select {
+		case <-readerDone:
+		case <-time.After(readerStopTimeout):
+			slog.Warn("TUN reader did not stop", "timeout", readerStopTimeout)
+		}
+	}
+	slog.Info("TUN interface closed", "name", tunDev.Name())
+}
+
+// clientCallbacks returns what servers call on messages and disconnects,
+// unmasking frames first when obfuscation is enabled
+func clientCallbacks(cfg *config.NodeConfig, h *handler.Handler) (func(conn server.Connection, data []byte), func(conn server.Connection)) {
+	onMessage := func(conn server.Connection, data []byte) { h.HandleMessage(conn, data) }
+	onDisconnect := func(conn server.Connection) { h.RemoveConnection(conn) }
+	if cfg.Obfuscator == nil {
+		return onMessage, onDisconnect
 	}
+	decorated := obfs.NewServer(cfg.Obfuscator, onMessage, onDisconnect)
+	return decorated.HandleMessage, decorated.RemoveConnection
 }
 
-func startWSSServer(cfg *config.NodeConfig, h *handler.Handler) {
+func startWSSServer(cfg *config.NodeConfig, h *handler.Handler, checker *health.Checker) error {
+	onMessage, onDisconnect := clientCallbacks(cfg, h)
 	server := wss.NewServer(cfg.ListenAddr, func(conn *wss.Connection, data []byte) {
-		h.HandleMessage(conn, data)
+		onMessage(conn, data)
 	})
 	server.SetOnDisconnect(func(conn *wss.Connection) {
-		h.RemoveConnection(conn)
+		onDisconnect(conn)
 	})
+	server.SetOnListening(func() { checker.SetListening(true) })
+	server.SetKeepalive(cfg.PingInterval, cfg.PongTimeout)
+	server.SetSendPolicy(cfg.SendPolicy, cfg.SendTimeout)
+	server.SetMaxMessageSize(cfg.MaxMessageSize)
+	server.SetMaxClients(cfg.MaxClients)
+	checker.SetRejected(server.Rejected)
 
-	slog.Info("Starting WSS server", "addr", cfg.ListenAddr)
-	if err := server.Start(); err != nil {
-		slog.Error("WSS server error", "error", err)
-		os.Exit(1)
+	start := server.Start
+	if cfg.TLSCert != "" {
+		slog.Info("Starting WSS server with TLS", "addr", cfg.ListenAddr)
+		start = func() error { return server.StartTLS(cfg.TLSCert, cfg.TLSKey) }
+	} else {
+		slog.Info("Starting WSS server", "addr", cfg.ListenAddr)
 	}
+	return serveUntilSignal("WSS", start, server.Stop, checker)
 }
 
-func startUDPServer(cfg *config.NodeConfig, h *handler.Handler) {
-	server := udp.NewServer(cfg.ListenAddr, func(conn *udp.Connection, data []byte) {
-		h.HandleMessage(conn, data)
+func startUDPServer(cfg *config.NodeConfig, h *handler.Handler, checker *health.Checker) error {
+	onMessage, onDisconnect := clientCallbacks(cfg, h)
+	server := newUDPServer(cfg, func(conn *udp.Connection, data []byte) {
+		onMessage(conn, data)
 	})
 	server.SetOnDisconnect(func(conn *udp.Connection) {
-		h.RemoveConnection(conn)
+		onDisconnect(conn)
 	})
+	server.SetOnListening(func() { checker.SetListening(true) })
+	server.SetWorkers(cfg.UDPWorkers, cfg.UDPQueueSize)
+	server.SetIdleTimeout(cfg.UDPIdleTimeout)
+	server.SetMaxMessageSize(cfg.MaxMessageSize)
+	server.SetMaxClients(cfg.MaxClients)
+	checker.SetRejected(server.Rejected)
 
 	slog.Info("Starting UDP server", "addr", cfg.ListenAddr)
-	if err := server.Start(); err != nil {
-		slog.Error("UDP server error", "error", err)
-		os.Exit(1)
+	return serveUntilSignal("UDP", server.Start, server.Stop, checker)
+}
+
+func startV2RayServer(cfg *config.NodeConfig, h *handler.Handler, checker *health.Checker) error {
+	onMessage, onDisconnect := clientCallbacks(cfg, h)
+	server := v2ray.NewServer(cfg.ListenAddr, cfg.V2RayID, func(conn *v2ray.Connection, data []byte) {
+		onMessage(conn, data)
+	})
+	server.SetOnDisconnect(func(conn *v2ray.Connection) {
+		onDisconnect(conn)
+	})
+	server.SetOnListening(func() { checker.SetListening(true) })
+	server.SetMaxMessageSize(cfg.MaxMessageSize)
+	server.SetMaxClients(cfg.MaxClients)
+	checker.SetRejected(server.Rejected)
+
+	start := server.Start
+	if cfg.TLSCert != "" {
+		slog.Info("Starting V2Ray server with TLS", "addr", cfg.ListenAddr)
+		start = func() error { return server.StartTLS(cfg.TLSCert, cfg.TLSKey) }
+	} else {
+		slog.Info("Starting V2Ray server", "addr", cfg.ListenAddr)
+	}
+	return serveUntilSignal("V2Ray", start, server.Stop, checker)
+}
+
+func startTCPServer(cfg *config.NodeConfig, h *handler.Handler, checker *health.Checker) error {
+	onMessage, onDisconnect := clientCallbacks(cfg, h)
+	server := tcp.NewServer(cfg.ListenAddr, func(conn *tcp.Connection, data []byte) {
+		onMessage(conn, data)
+	})
+	server.SetOnDisconnect(func(conn *tcp.Connection) {
+		onDisconnect(conn)
+	})
+	server.SetOnListening(func() { checker.SetListening(true) })
+	server.SetMaxMessageSize(cfg.MaxMessageSize)
+	server.SetMaxClients(cfg.MaxClients)
+	checker.SetRejected(server.Rejected)
+
+	slog.Info("Starting TCP server", "addr", cfg.ListenAddr)
+	return serveUntilSignal("TCP", server.Start, server.Stop, checker)
+}
+
+// udpServer is what the standard and io_uring UDP servers have in common
+type udpServer interface {
+	Start() error
+	Stop(ctx context.Context) error
+	SetOnDisconnect(callback func(conn *udp.Connection))
+	SetOnListening(callback func())
+	SetWorkers(workers, queueSize int)
+	SetIdleTimeout(ttl time.Duration)
+	SetMaxMessageSize(size int)
+	SetMaxClients(n int)
+	Rejected() uint64
+}
+
+// newUDPServer returns the io_uring server when enabled and supported,
+// otherwise the standard one
+func newUDPServer(cfg *config.NodeConfig, onMessage func(conn *udp.Connection, data []byte)) udpServer {
+	if cfg.UDPIOURing {
+		fast, err := udp.NewFastServer(cfg.ListenAddr, onMessage, cfg.UDPRing)
+		if err == nil {
+			slog.Info("Using io_uring for UDP")
+			return fast
+		}
+		slog.Warn("io_uring unavailable, using standard UDP server", "error", err)
+	}
+	return udp.NewServer(cfg.ListenAddr, onMessage)
+}
+
+// serveUntilSignal runs start until it fails or SIGINT/SIGTERM arrives,
+// in which case the server is stopped gracefully. Either way it returns so
+// run can clean up. The node reports not ready as soon as shutdown
+// begins.
+func serveUntilSignal(name string, start func() error, stop func(ctx context.Context) error, checker *health.Checker) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- start() }()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errCh:
+		checker.SetListening(false)
+		if err != nil {
+			return fmt.Errorf("%s server: %w", name, err)
+		}
+	case s := <-sig:
+		slog.Info("Shutting down", "signal", s.String())
+		checker.SetListening(false)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := stop(ctx); err != nil {
+			slog.Warn(name+" server did not stop cleanly", "error", err)
+		}
 	}
+	return nil
 }
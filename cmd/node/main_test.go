@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/node/health"
+	"seras-protocol/internal/tun"
+	"seras-protocol/internal/tun/tuntest"
+)
+
+// events records the shutdown steps in the order they happen
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *events) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, event)
+}
+
+func (e *events) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.list)
+}
+
+// fakeServer blocks in start until stop is called
+type fakeServer struct {
+	checker *health.Checker
+	events  *events
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newFakeServer(checker *health.Checker, e *events) *fakeServer {
+	return &fakeServer{checker: checker, events: e, stopped: make(chan struct{})}
+}
+
+func (s *fakeServer) start() error {
+	s.checker.SetListening(true)
+	<-s.stopped
+	return nil
+}
+
+func (s *fakeServer) stop(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		s.events.add("stop without deadline")
+	}
+	if s.checker.Status().Ready() {
+		s.events.add("stop while ready")
+	} else {
+		s.events.add("stop")
+	}
+	s.once.Do(func() { close(s.stopped) })
+	return nil
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	// Keeps a signal sent before serveUntilSignal listens from killing the test
+	ignore := make(chan os.Signal, 16)
+	signal.Notify(ignore, syscall.SIGTERM)
+	defer signal.Stop(ignore)
+
+	checker := health.NewChecker()
+	checker.SetTUN(true)
+	var e events
+	s := newFakeServer(checker, &e)
+
+	dev := tuntest.New("node0", 1500, 1)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			if _, err := dev.Read(make([]byte, 1500)); err != nil {
+				e.add("reader stopped")
+				return
+			}
+		}
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilSignal("test", s.start, s.stop, checker)
+		e.add("served")
+		closeTUN(dev, readerDone)
+		e.add("TUN closed")
+	}()
+
+	// Resent until serveUntilSignal is listening for it
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Fatalf("serveUntilSignal returned %v", err)
+			}
+			done = true
+		case <-ticker.C:
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		case <-timeout:
+			t.Fatal("server never stopped")
+		}
+	}
+
+	<-readerDone
+	deadline := time.Now().Add(5 * time.Second)
+	for len(e.get()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	want := []string{"stop", "served", "reader stopped", "TUN closed"}
+	if got := e.get(); !slices.Equal(got, want) {
+		t.Fatalf("shutdown ran %q, want %q", got, want)
+	}
+}
+
+func TestShutdownOnServerError(t *testing.T) {
+	checker := health.NewChecker()
+	checker.SetTUN(true)
+	checker.SetListening(true)
+	failed := errors.New("address in use")
+	stopped := false
+	err := serveUntilSignal("test", func() error { return failed },
+		func(context.Context) error { stopped = true; return nil }, checker)
+
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the server's error", err)
+	}
+	if stopped {
+		t.Fatal("stopped a server that had already failed")
+	}
+	if checker.Status().Listening {
+		t.Fatal("still reporting listening after the server failed")
+	}
+}
+
+func TestCloseTUNWithoutReader(t *testing.T) {
+	dev := tuntest.New("node0", 1500, 1)
+	closeTUN(dev, nil)
+	if _, err := dev.Read(make([]byte, 1500)); !errors.Is(err, tun.ErrClosed) {
+		t.Fatalf("read %v, want the TUN closed", err)
+	}
+}
@@ -0,0 +1,28 @@
+package bufpool
+
+import "sync"
+
+// Size fits any datagram or IP packet the tunnel handles
+const Size = 65536
+
+var pool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, Size)
+		return &buf
+	},
+}
+
+// Get returns a Size-byte buffer from the pool
+func Get() *[]byte {
+	return pool.Get().(*[]byte)
+}
+
+// Put returns a buffer obtained from Get to the pool.
+// The caller must not use the buffer afterwards.
+func Put(buf *[]byte) {
+	if buf == nil || cap(*buf) < Size {
+		return
+	}
+	*buf = (*buf)[:Size]
+	pool.Put(buf)
+}
@@ -0,0 +1,79 @@
+package bufpool_test
+
+import (
+	"testing"
+	"time"
+
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestPutRestoresLength(t *testing.T) {
+	buf := bufpool.Get()
+	if len(*buf) != bufpool.Size {
+		t.Fatalf("Get returned %d bytes, want %d", len(*buf), bufpool.Size)
+	}
+	*buf = (*buf)[:10]
+	bufpool.Put(buf)
+	if len(*buf) != bufpool.Size {
+		t.Fatalf("Put left the buffer at %d bytes", len(*buf))
+	}
+
+	// Foreign buffers too small to serve a packet are dropped
+	small := make([]byte, 10)
+	bufpool.Put(&small)
+	bufpool.Put(nil)
+}
+
+// BenchmarkSessionRoundTrip seals and opens a packet per iteration the way
+// the loops did before the pool, into fresh buffers, and the way they do now
+func BenchmarkSessionRoundTrip(b *testing.B) {
+	seed, err := msg.NewSessionSeed()
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 1300)
+	message := &msg.Msg{Timestamp: time.Now().Unix(), Data: data}
+
+	bench := func(b *testing.B, buffers func() (seal, open *[]byte, done func())) {
+		client, err := msg.NewSession(seed, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		node, err := msg.NewSession(seed, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		window := msg.NewReplayWindow()
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			seal, open, done := buffers()
+			rawMsg, err := client.EncryptMsg(message, *seal)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := node.DecryptBodyChecked(rawMsg, window, *open); err != nil {
+				b.Fatal(err)
+			}
+			done()
+		}
+	}
+
+	b.Run("alloc", func(b *testing.B) {
+		bench(b, func() (*[]byte, *[]byte, func()) {
+			seal, open := make([]byte, 0, len(data)+64), make([]byte, 0, len(data))
+			return &seal, &open, func() {}
+		})
+	})
+	b.Run("pool", func(b *testing.B) {
+		bench(b, func() (*[]byte, *[]byte, func()) {
+			seal, open := bufpool.Get(), bufpool.Get()
+			return seal, open, func() {
+				bufpool.Put(seal)
+				bufpool.Put(open)
+			}
+		})
+	})
+}
@@ -1,5 +1,10 @@
 package iouring
 
+import (
+	"context"
+	"net"
+)
+
 // Ring is the interface for async I/O operations
 type Ring interface {
 	// ReadAsync queues an async read operation
@@ -8,6 +13,11 @@ type Ring interface {
 	WriteAsync(fd int, buf []byte) (AsyncOp, error)
 	// RecvAsync queues an async recv operation (for sockets)
 	RecvAsync(fd int, buf []byte) (AsyncOp, error)
+	// RecvMsgAsync queues an async recvmsg; the sender is filled in once the op completes
+	RecvMsgAsync(fd int, buf []byte) (AsyncOp, *net.UDPAddr, error)
+	// RecvMsgBatch queues one recvmsg per buffer and submits them together.
+	// Each completion is sent to done tagged with the matching entry of slots.
+	RecvMsgBatch(fd int, bufs [][]byte, slots []int, done chan<- RecvCompletion) error
 	// SendAsync queues an async send operation (for sockets)
 	SendAsync(fd int, buf []byte) (AsyncOp, error)
 	// Submit submits all queued operations
@@ -20,14 +30,30 @@ type Ring interface {
 type AsyncOp interface {
 	// Wait waits for the operation to complete and returns bytes processed
 	Wait() (int, error)
+	// WaitContext waits like Wait, but gives up with ctx's error once ctx is
+	// done, cancelling the operation where the ring can. The buffer may
+	// still be written to until Done is closed.
+	WaitContext(ctx context.Context) (int, error)
 	// Done returns a channel that's closed when operation completes
 	Done() <-chan struct{}
 }
 
+// RecvCompletion is a finished receive queued with RecvMsgBatch
+type RecvCompletion struct {
+	Slot int          // Caller's tag for the buffer
+	N    int          // Bytes received
+	Addr *net.UDPAddr // Sender
+	Err  error
+}
+
 // Config for io_uring
 type Config struct {
 	Entries    uint32 // Queue depth (default 256)
 	BufferSize int    // Buffer size for operations
+	// Batch holds queued operations until Submit, so a batch costs one
+	// syscall. Otherwise each is submitted as it is queued, and Submit is a
+	// no-op.
+	Batch bool
 }
 
 // DefaultConfig returns default configuration
@@ -3,23 +3,40 @@
 package iouring
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"sync"
 	"syscall"
+	"unsafe"
 
 	"github.com/iceber/iouring-go"
+	iouring_syscall "github.com/iceber/iouring-go/syscall"
 )
 
+// resultsQueue buffers recvmsg results awaiting forwarding
+const resultsQueue = 1024
+
 type linuxRing struct {
-	ring *iouring.IOURing
-	mu   sync.Mutex
+	ring    *iouring.IOURing
+	mu      sync.Mutex
+	results chan iouring.Result // Batched recvmsg results, created on first use
+
+	// Batch mode: operations wait in pending until Submit, or until the
+	// submission queue's worth of entries has built up
+	batch      bool
+	entries    int
+	pending    []iouring.PrepRequest
+	pendingOps []*linuxAsyncOp
 }
 
 type linuxAsyncOp struct {
-	request iouring.Request
+	ring    *linuxRing
+	request iouring.Request // Set once submitted, under ring.mu
 	done    chan struct{}
 	n       int
 	err     error
+	onDone  func() // Runs after a successful completion, before done is closed
 }
 
 // New creates a new io_uring ring on Linux
@@ -33,7 +50,7 @@ func New(cfg Config) (Ring, error) {
 		return nil, fmt.Errorf("failed to create io_uring: %w", err)
 	}
 
-	return &linuxRing{ring: ring}, nil
+	return &linuxRing{ring: ring, batch: cfg.Batch, entries: int(cfg.Entries)}, nil
 }
 
 // IsSupported returns true on Linux with kernel >= 5.1
@@ -50,16 +67,12 @@ func (r *linuxRing) ReadAsync(fd int, buf []byte) (AsyncOp, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	op := &linuxAsyncOp{done: make(chan struct{})}
+	op := &linuxAsyncOp{ring: r, done: make(chan struct{})}
 
 	prep := iouring.Read(fd, buf)
-	request, err := r.ring.SubmitRequest(prep, nil)
-	if err != nil {
+	if err := r.queue(prep, op); err != nil {
 		return nil, err
 	}
-
-	op.request = request
-	go op.waitForCompletion()
 	return op, nil
 }
 
@@ -67,16 +80,12 @@ func (r *linuxRing) WriteAsync(fd int, buf []byte) (AsyncOp, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	op := &linuxAsyncOp{done: make(chan struct{})}
+	op := &linuxAsyncOp{ring: r, done: make(chan struct{})}
 
 	prep := iouring.Write(fd, buf)
-	request, err := r.ring.SubmitRequest(prep, nil)
-	if err != nil {
+	if err := r.queue(prep, op); err != nil {
 		return nil, err
 	}
-
-	op.request = request
-	go op.waitForCompletion()
 	return op, nil
 }
 
@@ -84,41 +93,202 @@ func (r *linuxRing) RecvAsync(fd int, buf []byte) (AsyncOp, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	op := &linuxAsyncOp{done: make(chan struct{})}
+	op := &linuxAsyncOp{ring: r, done: make(chan struct{})}
 
 	prep := iouring.Recv(fd, buf, 0)
-	request, err := r.ring.SubmitRequest(prep, nil)
-	if err != nil {
+	if err := r.queue(prep, op); err != nil {
 		return nil, err
 	}
-
-	op.request = request
-	go op.waitForCompletion()
 	return op, nil
 }
 
+// recvMsgOp is a queued recvmsg; the kernel writes the sender into rsa.
+// slot and done are only used by batched receives.
+type recvMsgOp struct {
+	hdr  syscall.Msghdr
+	iov  syscall.Iovec
+	rsa  syscall.RawSockaddrAny
+	slot int
+	done chan<- RecvCompletion
+}
+
+func (r *linuxRing) RecvMsgAsync(fd int, buf []byte) (AsyncOp, *net.UDPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg := &recvMsgOp{}
+	addr := &net.UDPAddr{}
+	op := &linuxAsyncOp{ring: r, done: make(chan struct{})}
+	op.onDone = func() { fillUDPAddr(addr, &msg.rsa) }
+
+	if err := r.queue(msg.prep(fd, buf), op); err != nil {
+		return nil, nil, err
+	}
+	return op, addr, nil
+}
+
+func (r *linuxRing) RecvMsgBatch(fd int, bufs [][]byte, slots []int, done chan<- RecvCompletion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Completions from every batch are forwarded by a single goroutine
+	if r.results == nil {
+		r.results = make(chan iouring.Result, resultsQueue)
+		go r.forwardRecvs()
+	}
+
+	preps := make([]iouring.PrepRequest, len(bufs))
+	for i, buf := range bufs {
+		op := &recvMsgOp{slot: slots[i], done: done}
+		preps[i] = op.prep(fd, buf).WithInfo(op)
+	}
+
+	// One submission for the whole batch
+	_, err := r.ring.SubmitRequests(preps, r.results)
+	return err
+}
+
+// forwardRecvs converts recvmsg results into completions for their batch's channel
+func (r *linuxRing) forwardRecvs() {
+	for result := range r.results {
+		op, ok := result.GetRequestInfo().(*recvMsgOp)
+		if !ok {
+			continue
+		}
+
+		c := RecvCompletion{Slot: op.slot}
+		c.N, c.Err = result.ReturnInt()
+		if c.Err == nil {
+			c.Addr = &net.UDPAddr{}
+			fillUDPAddr(c.Addr, &op.rsa)
+		}
+		op.done <- c
+	}
+}
+
+// prep builds an IORING_OP_RECVMSG request receiving into buf.
+// The op keeps the msghdr and sockaddr alive until the kernel is done with them.
+func (op *recvMsgOp) prep(fd int, buf []byte) iouring.PrepRequest {
+	op.iov.Base = &buf[0]
+	op.iov.SetLen(len(buf))
+	op.hdr.Name = (*byte)(unsafe.Pointer(&op.rsa))
+	op.hdr.Namelen = syscall.SizeofSockaddrAny
+	op.hdr.Iov = &op.iov
+	op.hdr.Iovlen = 1
+
+	return func(sqe iouring_syscall.SubmissionQueueEntry, userData *iouring.UserData) {
+		userData.Hold(op)
+		userData.SetRequestBuffer(buf, nil)
+		userData.SetResultResolver(resolveRecvMsg)
+		sqe.PrepOperation(iouring_syscall.IORING_OP_RECVMSG, int32(fd), uint64(uintptr(unsafe.Pointer(&op.hdr))), 1, 0)
+	}
+}
+
+// resolveRecvMsg turns the raw completion code into a byte count or errno
+func resolveRecvMsg(req iouring.Request) {
+	n, _ := req.GetRes()
+	if n < 0 {
+		req.SetResult(0, nil, syscall.Errno(-n))
+		return
+	}
+	req.SetResult(n, nil, nil)
+}
+
+// fillUDPAddr converts a kernel sockaddr into addr
+func fillUDPAddr(addr *net.UDPAddr, rsa *syscall.RawSockaddrAny) {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		addr.IP = net.IP(sa.Addr[:]).To16()
+		addr.Port = networkPort(&sa.Port)
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		addr.IP = append(net.IP(nil), sa.Addr[:]...)
+		addr.Port = networkPort(&sa.Port)
+	}
+}
+
+// networkPort reads a port stored in network byte order
+func networkPort(port *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(port))
+	return int(b[0])<<8 | int(b[1])
+}
+
 func (r *linuxRing) SendAsync(fd int, buf []byte) (AsyncOp, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	op := &linuxAsyncOp{done: make(chan struct{})}
+	op := &linuxAsyncOp{ring: r, done: make(chan struct{})}
 
 	prep := iouring.Send(fd, buf, 0)
-	request, err := r.ring.SubmitRequest(prep, nil)
-	if err != nil {
+	if err := r.queue(prep, op); err != nil {
 		return nil, err
 	}
-
-	op.request = request
-	go op.waitForCompletion()
 	return op, nil
 }
 
+// queue submits prep for op, or in batch mode holds it for the next Submit.
+// Must be called with mu held.
+func (r *linuxRing) queue(prep iouring.PrepRequest, op *linuxAsyncOp) error {
+	if !r.batch {
+		request, err := r.ring.SubmitRequest(prep, nil)
+		if err != nil {
+			return err
+		}
+		op.request = request
+		go op.waitForCompletion()
+		return nil
+	}
+
+	r.pending = append(r.pending, prep)
+	r.pendingOps = append(r.pendingOps, op)
+	if len(r.pending) >= r.entries {
+		return r.submitPending()
+	}
+	return nil
+}
+
+// Submit flushes operations queued in batch mode with a single io_uring_enter.
+// Without batch mode every operation is submitted as it is queued.
 func (r *linuxRing) Submit() error {
-	return nil // auto-submitted in our implementation
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.submitPending()
+}
+
+// submitPending submits the queued operations. If that fails, each of them
+// completes with the error. Must be called with mu held.
+func (r *linuxRing) submitPending() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	ops := r.pendingOps
+	set, err := r.ring.SubmitRequests(r.pending, nil)
+	clear(r.pending)
+	r.pending, r.pendingOps = r.pending[:0], nil
+
+	if err != nil {
+		for _, op := range ops {
+			op.err = err
+			close(op.done)
+		}
+		return err
+	}
+	for i, request := range set.Requests() {
+		ops[i].request = request
+		go ops[i].waitForCompletion()
+	}
+	return nil
 }
 
 func (r *linuxRing) Close() error {
+	r.mu.Lock()
+	for _, op := range r.pendingOps {
+		op.err = net.ErrClosed
+		close(op.done)
+	}
+	r.pending, r.pendingOps = nil, nil
+	r.mu.Unlock()
 	return r.ring.Close()
 }
 
@@ -135,6 +305,9 @@ func (op *linuxAsyncOp) waitForCompletion() {
 		return
 	}
 	op.n = n
+	if op.onDone != nil {
+		op.onDone()
+	}
 }
 
 func (op *linuxAsyncOp) Wait() (int, error) {
@@ -142,6 +315,42 @@ func (op *linuxAsyncOp) Wait() (int, error) {
 	return op.n, op.err
 }
 
+// WaitContext gives up once ctx is done, cancelling the operation: one still
+// queued for Submit is dropped, a submitted one gets an io_uring async
+// cancel so its completion, and the goroutine waiting for it, aren't left
+// hanging
+func (op *linuxAsyncOp) WaitContext(ctx context.Context) (int, error) {
+	select {
+	case <-op.done:
+		return op.n, op.err
+	case <-ctx.Done():
+	}
+	if op.ring != nil {
+		op.ring.cancel(op, ctx.Err())
+	}
+	return 0, ctx.Err()
+}
+
 func (op *linuxAsyncOp) Done() <-chan struct{} {
 	return op.done
 }
+
+// cancel drops op from the batch queue, completing it with err, or asks the
+// kernel to cancel it if it was submitted
+func (r *linuxRing) cancel(op *linuxAsyncOp, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, queued := range r.pendingOps {
+		if queued == op {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			r.pendingOps = append(r.pendingOps[:i], r.pendingOps[i+1:]...)
+			op.err = err
+			close(op.done)
+			return
+		}
+	}
+	if op.request != nil {
+		// Fails only if the op completed meanwhile
+		op.request.Cancel()
+	}
+}
@@ -0,0 +1,330 @@
+package iouring
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchBatch is how many writes each round queues before waiting on them
+const benchBatch = 32
+
+// BenchmarkWrite compares submitting each operation on its own with queueing
+// a round and submitting it once, on writes to /dev/null
+func BenchmarkWrite(b *testing.B) {
+	if !IsSupported() {
+		b.Skip("io_uring is not supported")
+	}
+	for _, batch := range []bool{false, true} {
+		name := "perop"
+		if batch {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer devNull.Close()
+
+			cfg := DefaultConfig()
+			cfg.Batch = batch
+			ring, err := New(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ring.Close()
+
+			fd := int(devNull.Fd())
+			buf := make([]byte, 64)
+			ops := make([]AsyncOp, 0, benchBatch)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for done := 0; done < b.N; done += benchBatch {
+				ops = ops[:0]
+				for i := 0; i < min(benchBatch, b.N-done); i++ {
+					op, err := ring.WriteAsync(fd, buf)
+					if err != nil {
+						b.Fatal(err)
+					}
+					ops = append(ops, op)
+				}
+				if err := ring.Submit(); err != nil {
+					b.Fatal(err)
+				}
+				for _, op := range ops {
+					if _, err := op.Wait(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// socketFD returns the descriptor behind conn
+func socketFD(t *testing.T, conn *net.UDPConn) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fd int
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestRecvMsgAsyncRecoversSender(t *testing.T) {
+	if !IsSupported() {
+		t.Skip("io_uring is not supported")
+	}
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			loopback := "127.0.0.1:0"
+			if network == "udp6" {
+				loopback = "[::1]:0"
+			}
+			laddr, err := net.ResolveUDPAddr(network, loopback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := net.ListenUDP(network, laddr)
+			if err != nil {
+				t.Skipf("no %s loopback: %v", network, err)
+			}
+			defer server.Close()
+
+			ring, err := New(DefaultConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ring.Close()
+
+			buf := make([]byte, 64)
+			op, from, err := ring.RecvMsgAsync(socketFD(t, server), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ring.Submit(); err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := net.DialUDP(network, nil, server.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			n, err := op.WaitContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := client.LocalAddr().(*net.UDPAddr)
+			if string(buf[:n]) != "hello" || !from.IP.Equal(want.IP) || from.Port != want.Port {
+				t.Fatalf("got %q from %v, want \"hello\" from %v", buf[:n], from, want)
+			}
+		})
+	}
+}
+
+// pipe returns both ends of a pipe, closed when the test ends
+func pipe(t *testing.T) (r, w *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	return r, w
+}
+
+// newRing returns a ring with entries slots, closed when the test ends
+func newRing(t *testing.T, batch bool, entries uint32) Ring {
+	t.Helper()
+	if !IsSupported() {
+		t.Skip("io_uring is not supported")
+	}
+	cfg := DefaultConfig()
+	cfg.Batch = batch
+	cfg.Entries = entries
+	ring, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ring.Close() })
+	return ring
+}
+
+// waitDone fails the test if op isn't done within a few seconds
+func waitDone(t *testing.T, op AsyncOp, what string) {
+	t.Helper()
+	select {
+	case <-op.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s never completed", what)
+	}
+}
+
+func TestBatchHoldsOperationsUntilSubmit(t *testing.T) {
+	ring := newRing(t, true, 256)
+	r, w := pipe(t)
+
+	var ops []AsyncOp
+	for _, b := range []string{"a", "b", "c"} {
+		op, err := ring.WriteAsync(int(w.Fd()), []byte(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i, op := range ops {
+		select {
+		case <-op.Done():
+			t.Fatalf("write %d completed before Submit", i)
+		default:
+		}
+	}
+
+	if err := ring.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	for i, op := range ops {
+		waitDone(t, op, "batched write")
+		if n, err := op.Wait(); n != 1 || err != nil {
+			t.Fatalf("write %d: got %d, %v", i, n, err)
+		}
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "abc" {
+		t.Fatalf("read %q, %v; want \"abc\" in queue order", buf, err)
+	}
+}
+
+func TestBatchSubmitsFullQueue(t *testing.T) {
+	ring := newRing(t, true, 4)
+	_, w := pipe(t)
+
+	var ops []AsyncOp
+	for range 4 {
+		op, err := ring.WriteAsync(int(w.Fd()), []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	// A queue's worth goes out without waiting for Submit
+	for _, op := range ops {
+		waitDone(t, op, "write filling the queue")
+	}
+}
+
+func TestUnbatchedSubmitsEachOperation(t *testing.T) {
+	ring := newRing(t, false, 256)
+	r, w := pipe(t)
+
+	op, err := ring.WriteAsync(int(w.Fd()), []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, op, "write without Submit")
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestCloseFailsQueuedOperations(t *testing.T) {
+	ring := newRing(t, true, 256)
+	_, w := pipe(t)
+	op, err := ring.WriteAsync(int(w.Fd()), []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.Close()
+	waitDone(t, op, "write queued at Close")
+	if _, err := op.Wait(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestWaitContextCancelsPendingRead(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		t.Run(map[bool]string{false: "perop", true: "batched"}[batch], func(t *testing.T) {
+			ring := newRing(t, batch, 256)
+			r, w := pipe(t)
+
+			// Nothing is ever written, so the read would wait forever
+			op, err := ring.ReadAsync(int(r.Fd()), make([]byte, 64))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ring.Submit(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			start := time.Now()
+			if _, err := op.WaitContext(ctx); !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want context.Canceled", err)
+			}
+			if waited := time.Since(start); waited > time.Second {
+				t.Fatalf("returned %v after the cancel", waited)
+			}
+			// The kernel cancels the read too, so it doesn't take later data
+			waitDone(t, op, "cancelled read")
+			if _, err := w.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(r, buf); err != nil || buf[0] != 'x' {
+				t.Fatalf("read %q, %v after the cancel", buf, err)
+			}
+		})
+	}
+}
+
+func TestWaitContextDropsQueuedOperation(t *testing.T) {
+	ring := newRing(t, true, 256)
+	r, w := pipe(t)
+	op, err := ring.WriteAsync(int(w.Fd()), []byte("dropped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := op.WaitContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, err := op.Wait(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait after the cancel: got %v, want context.Canceled", err)
+	}
+
+	// Submit no longer sends it
+	if err := ring.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "kept" {
+		t.Fatalf("read %q, %v; want only what was written after", buf, err)
+	}
+}
@@ -3,7 +3,9 @@
 package iouring
 
 import (
+	"context"
 	"errors"
+	"net"
 	"syscall"
 )
 
@@ -60,6 +62,48 @@ func (r *fallbackRing) RecvAsync(fd int, buf []byte) (AsyncOp, error) {
 	return op, nil
 }
 
+func (r *fallbackRing) RecvMsgAsync(fd int, buf []byte) (AsyncOp, *net.UDPAddr, error) {
+	op := &fallbackAsyncOp{done: make(chan struct{})}
+	addr := &net.UDPAddr{}
+	go func() {
+		defer close(op.done)
+		var from syscall.Sockaddr
+		op.n, from, op.err = syscall.Recvfrom(fd, buf, 0)
+		if op.err == nil {
+			fillFromSockaddr(addr, from)
+		}
+	}()
+	return op, addr, nil
+}
+
+func (r *fallbackRing) RecvMsgBatch(fd int, bufs [][]byte, slots []int, done chan<- RecvCompletion) error {
+	for i, buf := range bufs {
+		go func(slot int, buf []byte) {
+			c := RecvCompletion{Slot: slot}
+			var from syscall.Sockaddr
+			c.N, from, c.Err = syscall.Recvfrom(fd, buf, 0)
+			if c.Err == nil {
+				c.Addr = &net.UDPAddr{}
+				fillFromSockaddr(c.Addr, from)
+			}
+			done <- c
+		}(slots[i], buf)
+	}
+	return nil
+}
+
+// fillFromSockaddr converts a Recvfrom source address into addr
+func fillFromSockaddr(addr *net.UDPAddr, sa syscall.Sockaddr) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		addr.IP = net.IP(sa.Addr[:]).To16()
+		addr.Port = sa.Port
+	case *syscall.SockaddrInet6:
+		addr.IP = append(net.IP(nil), sa.Addr[:]...)
+		addr.Port = sa.Port
+	}
+}
+
 func (r *fallbackRing) SendAsync(fd int, buf []byte) (AsyncOp, error) {
 	op := &fallbackAsyncOp{done: make(chan struct{})}
 	go func() {
@@ -85,6 +129,17 @@ func (op *fallbackAsyncOp) Wait() (int, error) {
 	return op.n, op.err
 }
 
+// WaitContext gives up once ctx is done. The blocking syscall can't be
+// cancelled, so it runs on until it completes.
+func (op *fallbackAsyncOp) WaitContext(ctx context.Context) (int, error) {
+	select {
+	case <-op.done:
+		return op.n, op.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 func (op *fallbackAsyncOp) Done() <-chan struct{} {
 	return op.done
 }
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWaitContextCancelsPendingRead(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Closing the write end ends the blocked read once the test is done
+	defer w.Close()
+
+	op, err := NewFallback().ReadAsync(int(r.Fd()), make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := op.WaitContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("returned %v after the cancel", waited)
+	}
+}
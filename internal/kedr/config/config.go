@@ -1,12 +1,24 @@
 package config
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"seras-protocol/internal/kedr/discovery"
+	"seras-protocol/internal/transport/client/tcp"
 	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/client/v2ray"
 	"seras-protocol/internal/transport/client/wss"
+	"seras-protocol/internal/transport/obfs"
+	"seras-protocol/internal/tun"
+	"seras-protocol/pkg/helpers"
 	"seras-protocol/pkg/taiga/msg"
 )
 
@@ -16,19 +28,100 @@ type TransportConfig interface {
 }
 
 var ConnTypeMap = map[string]func() TransportConfig{
-	"wss": func() TransportConfig { return &wss.Config{} },
-	"udp": func() TransportConfig { return &udp.Config{} },
+	"wss":   func() TransportConfig { return &wss.Config{} },
+	"udp":   func() TransportConfig { return &udp.Config{} },
+	"v2ray": func() TransportConfig { return &v2ray.Config{} },
+	"tcp":   func() TransportConfig { return &tcp.Config{} },
 }
 
-type ConnConfig struct {
-	PrivateKey      msg.Key         // Client's private key
-	NodePublicKey   msg.Key         // Node's public key (for encryption)
-	Type            string          // Transport type (e.g., "wss")
-	LocalIP         string          // IP for TUN interface (e.g., "11.0.0.2")
-	NodeVPNIP       string          // Node's VPN IP (e.g., "11.0.0.1")
-	GatewayIP       string          // Gateway to route node traffic
+// Hop is an additional circuit node reached through the previous one
+type Hop struct {
+	PublicKey msg.Key // Hop's public key
+	Type      string  // Transport the previous node uses to reach it ("wss", "udp", "v2ray" or "tcp")
+	Endpoint  string  // WebSocket URL, UDP or TCP address, or VLESS share link of the hop
+}
+
+// Upstream is a candidate entry node the client may connect to
+type Upstream struct {
+	PublicKey       msg.Key         // Node's public key
+	Type            string          // Transport type ("wss", "udp", "v2ray" or "tcp")
+	Endpoint        string          // WebSocket URL, UDP or TCP address, or VLESS share link
 	RemoteHost      string          // Node public IP (to exclude from TUN routing)
-	TransportConfig TransportConfig // Transport-specific config
+	TransportConfig TransportConfig // Transport-specific config for this node
+}
+
+// Client modes
+const (
+	ModeTUN   = "tun"   // Capture IP traffic with a TUN device (needs root)
+	ModeProxy = "proxy" // Local SOCKS5 proxy carrying TCP streams, no TUN
+)
+
+// Datapaths for MODE=tun
+const (
+	DatapathTUN      = "tun"      // Kernel TUN device carrying all routed traffic
+	DatapathNetstack = "netstack" // Userspace TCP/IP stack behind a SOCKS5 proxy, no TUN or root
+)
+
+// DefaultProxyAddr is where the SOCKS5 proxy listens in proxy mode
+const DefaultProxyAddr = "127.0.0.1:1080"
+
+// maxTUNBatch bounds TUN_BATCH, the packets moved per batched TUN call
+const maxTUNBatch = 256
+
+// Node selection policies for choosing among upstreams
+const (
+	PolicyOrdered = "ordered" // First reachable node in list order
+	PolicyLatency = "latency" // Reachable node with the fastest handshake
+)
+
+type ConnConfig struct {
+	Mode             string          // ModeTUN or ModeProxy
+	Datapath         string          // DatapathTUN or DatapathNetstack (MODE=tun)
+	ProxyAddr        string          // SOCKS5 listen address (proxy mode and the netstack datapath)
+	PrivateKey       msg.Key         // Client's private key
+	NodePublicKey    msg.Key         // Node's public key (for encryption)
+	Type             string          // Transport type (e.g., "wss")
+	LocalIP          string          // IP for TUN interface (e.g., "11.0.0.2")
+	NodeVPNIP        string          // Node's VPN IP (e.g., "11.0.0.1")
+	GatewayIP        string          // Gateway to route node traffic
+	RemoteHost       string          // Node public IP (to exclude from TUN routing)
+	TransportConfig  TransportConfig // Transport-specific config
+	ReconnectEnabled bool            // Rebuild transport on failure
+	MaxRetries       int             // Max consecutive reconnect attempts (0 = unlimited)
+	Hops             []Hop           // Further circuit nodes after the first (multi-hop)
+	MTU              int             // TUN MTU (0 = default)
+	MaxMessageSize   int             // Largest transport message sent or received
+	TunName          string          // TUN interface name (empty = assigned by the kernel)
+	AllowedIPs       []netip.Prefix  // Prefixes routed through the tunnel (empty = all traffic)
+	ExcludeIPs       []netip.Prefix  // Prefixes routed via the gateway, bypassing the tunnel
+	Compression      msg.Compression // Payload compression for sent packets
+	CompressionDict  []byte          // Dictionary for deflate-dict (nil = built-in)
+	Padding          msg.Padding     // Payload padding for sent packets
+	StatsInterval    time.Duration   // Periodic stats log interval (0 = off)
+	StatsAddr        string          // Local HTTP address serving /stats (empty = off)
+	Upstreams        []Upstream      // Candidate entry nodes, the configured node first
+	NodePolicy       string          // How to pick among Upstreams
+	EnableIPv6       bool            // Route IPv6 traffic through the tunnel
+	LocalIP6         string          // IPv6 for TUN interface (empty = assigned by node)
+	HandshakeTimeout time.Duration   // How long to wait for the handshake ack
+	HandshakeRetries int             // Handshake attempts per node before moving on
+	DebugPcap        string          // Packet tap: pcap file path or "log" (empty = off)
+	SessionMode      bool            // Ask the entry node for ratcheted session keys
+	CipherSuites     []msg.Suite     // Cipher suites offered to the entry node, preferred first
+	RekeyPackets     uint64          // Session mode: rekey after this many sent packets
+	RekeyInterval    time.Duration   // Session mode: rekey after this long
+	TUNBatch         int             // Packets per TUN read/write batch (1 = unbatched)
+	DryRun           bool            // Print TUN host commands instead of running them, then exit
+	Keepalive        time.Duration   // Idle time before a keepalive is sent to the entry node (0 = off)
+	RoamInterval     time.Duration   // How often UDP checks whether the local network changed (0 = off)
+	TimestampSkew    time.Duration   // Node data stamped further from now is rejected (0 = not checked)
+
+	// Frame obfuscation against DPI; Obfuscator is nil when OBFS is off
+	Obfuscator *obfs.Obfuscator
+	ObfsJitter time.Duration // Random delay up to this before each obfuscated send
+
+	// Resolves node endpoints from DNS on each connect; nil when NODE_DISCOVERY is off
+	Discovery *discovery.Discovery
 }
 
 func ParseConfigFromEnv(connType string) (*ConnConfig, error) {
@@ -41,63 +134,659 @@ func ParseConfigFromEnv(connType string) (*ConnConfig, error) {
 		return nil, fmt.Errorf("failed to get transport config: %w", err)
 	}
 
-	// Parse private key
-	privKeyHex := os.Getenv("PRIVATE_KEY")
-	if privKeyHex == "" {
-		return nil, fmt.Errorf("PRIVATE_KEY is not set")
-	}
-	privKeyBytes, err := hex.DecodeString(privKeyHex)
-	if err != nil || len(privKeyBytes) != 32 {
-		return nil, fmt.Errorf("PRIVATE_KEY must be 32 bytes hex")
+	// Parse private key, preferring PRIVATE_KEY_FILE
+	privateKey, err := helpers.LoadPrivateKey("PRIVATE_KEY")
+	if err != nil {
+		return nil, err
 	}
-	var privateKey msg.Key
-	copy(privateKey[:], privKeyBytes)
+	privateKey.Clamp()
 
 	// Parse node public key
-	nodePubKeyHex := os.Getenv("NODE_PUBLIC_KEY")
-	if nodePubKeyHex == "" {
+	nodePubKeyEnv := os.Getenv("NODE_PUBLIC_KEY")
+	if nodePubKeyEnv == "" {
 		return nil, fmt.Errorf("NODE_PUBLIC_KEY is not set")
 	}
-	nodePubKeyBytes, err := hex.DecodeString(nodePubKeyHex)
-	if err != nil || len(nodePubKeyBytes) != 32 {
-		return nil, fmt.Errorf("NODE_PUBLIC_KEY must be 32 bytes hex")
+	nodePublicKey, err := msg.ParsePublicKey(nodePubKeyEnv)
+	if err != nil {
+		return nil, fmt.Errorf("NODE_PUBLIC_KEY: %w", err)
+	}
+
+	mode := ModeTUN
+	if env := os.Getenv("MODE"); env != "" {
+		if env != ModeTUN && env != ModeProxy {
+			return nil, fmt.Errorf("MODE must be %q or %q, got: %s", ModeTUN, ModeProxy, env)
+		}
+		mode = env
+	}
+
+	datapath := DatapathTUN
+	if env := os.Getenv("DATAPATH"); env != "" {
+		if env != DatapathTUN && env != DatapathNetstack {
+			return nil, fmt.Errorf("DATAPATH must be %q or %q, got: %s", DatapathTUN, DatapathNetstack, env)
+		}
+		datapath = env
 	}
-	var nodePublicKey msg.Key
-	copy(nodePublicKey[:], nodePubKeyBytes)
+	// Only a kernel TUN touches host routing
+	kernelTUN := mode == ModeTUN && datapath == DatapathTUN
 
-	// Network config
+	proxyAddr := DefaultProxyAddr
+	if env := os.Getenv("PROXY_ADDR"); env != "" {
+		proxyAddr = env
+	}
+
+	// Network config; proxy mode has no TUN, so none of it is needed
 	localIP := os.Getenv("LOCAL_IP")
-	if localIP == "" {
+	if localIP == "" && mode == ModeTUN {
 		return nil, fmt.Errorf("LOCAL_IP is not set")
 	}
 
 	nodeVPNIP := os.Getenv("NODE_VPN_IP")
-	if nodeVPNIP == "" {
+	if nodeVPNIP == "" && kernelTUN {
 		return nil, fmt.Errorf("NODE_VPN_IP is not set (node's TUN IP, e.g., 11.0.0.1)")
 	}
 
 	gatewayIP := os.Getenv("GATEWAY_IP")
-	if gatewayIP == "" {
+	if gatewayIP == "" && kernelTUN {
 		return nil, fmt.Errorf("GATEWAY_IP is not set")
 	}
 
+	nodeDiscovery, err := parseDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	// With discovery, the node's current address is looked up instead
 	remoteHost := os.Getenv("REMOTE_HOST")
-	if remoteHost == "" {
-		return nil, fmt.Errorf("REMOTE_HOST is not set")
+	if remoteHost == "" && kernelTUN {
+		if nodeDiscovery == nil {
+			return nil, fmt.Errorf("REMOTE_HOST is not set")
+		}
+		if remoteHost, err = discoverHost(nodeDiscovery, transportEndpoint(transportConfig)); err != nil {
+			return nil, fmt.Errorf("REMOTE_HOST is not set and %w", err)
+		}
 	}
 
-	return &ConnConfig{
-		PrivateKey:      privateKey,
-		NodePublicKey:   nodePublicKey,
+	// Reconnect config (optional)
+	reconnectEnabled := true
+	if env := os.Getenv("RECONNECT_ENABLED"); env != "" {
+		reconnectEnabled, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("RECONNECT_ENABLED must be a boolean, got: %s", env)
+		}
+	}
+
+	maxRetries := 0
+	if env := os.Getenv("RECONNECT_MAX_RETRIES"); env != "" {
+		maxRetries, err = strconv.Atoi(env)
+		if err != nil || maxRetries < 0 {
+			return nil, fmt.Errorf("RECONNECT_MAX_RETRIES must be a non-negative integer, got: %s", env)
+		}
+	}
+
+	hops, err := parseHops(os.Getenv("CIRCUIT_HOPS"))
+	if err != nil {
+		return nil, err
+	}
+
+	mtu := 0
+	if env := os.Getenv("MTU"); env != "" {
+		mtu, err = strconv.Atoi(env)
+		if err != nil || mtu < 576 || mtu > 65535 {
+			return nil, fmt.Errorf("MTU must be an integer between 576 and 65535, got: %s", env)
+		}
+	}
+
+	obfsEnabled := false
+	if env := os.Getenv("OBFS"); env != "" {
+		obfsEnabled, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("OBFS must be a boolean, got: %s", env)
+		}
+	}
+	var obfuscator *obfs.Obfuscator
+	if obfsEnabled {
+		obfsKey := os.Getenv("OBFS_KEY")
+		if obfsKey == "" {
+			return nil, fmt.Errorf("OBFS_KEY is not set (required with OBFS=true)")
+		}
+		if obfuscator, err = obfs.New(obfsKey); err != nil {
+			return nil, err
+		}
+	}
+
+	obfsJitter := time.Duration(0)
+	if env := os.Getenv("OBFS_JITTER"); env != "" {
+		obfsJitter, err = time.ParseDuration(env)
+		if err != nil || obfsJitter < 0 {
+			return nil, fmt.Errorf("OBFS_JITTER must be a non-negative duration, got: %s", env)
+		}
+	}
+
+	padding, err := msg.ParsePadding(os.Getenv("PADDING"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PADDING: %w", err)
+	}
+
+	// Outgoing frames carry one layer per circuit node
+	frameMTU := mtu
+	if frameMTU == 0 {
+		frameMTU = tun.DefaultMTU
+	}
+	maxMessageSize := msg.FrameLimit(frameMTU, 1+len(hops))
+	if padding != msg.PaddingNone {
+		maxMessageSize += msg.PaddingBucketSize
+	}
+	if obfuscator != nil {
+		maxMessageSize += obfs.Overhead
+	}
+	if env := os.Getenv("MAX_MESSAGE_SIZE"); env != "" {
+		maxMessageSize, err = strconv.Atoi(env)
+		if err != nil || maxMessageSize < 576 || maxMessageSize > msg.MaxMessageSize {
+			return nil, fmt.Errorf("MAX_MESSAGE_SIZE must be an integer between 576 and %d, got: %s", msg.MaxMessageSize, env)
+		}
+	}
+
+	compression, err := msg.ParseCompression(os.Getenv("COMPRESSION"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COMPRESSION: %w", err)
+	}
+
+	// Both ends must agree on the dictionary deflate-dict compresses against
+	var compressionDict []byte
+	if path := os.Getenv("COMPRESSION_DICT"); path != "" {
+		if compressionDict, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("COMPRESSION_DICT: %w", err)
+		}
+		if len(compressionDict) == 0 {
+			return nil, fmt.Errorf("COMPRESSION_DICT file %s is empty", path)
+		}
+	}
+
+	allowedIPs, err := parsePrefixes("ALLOWED_IPS")
+	if err != nil {
+		return nil, err
+	}
+
+	excludeIPs, err := parsePrefixes("EXCLUDE_IPS")
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range excludeIPs {
+		if !prefix.Addr().Is4() || prefix.Bits() == 0 {
+			return nil, fmt.Errorf("EXCLUDE_IPS entries must be IPv4 CIDRs narrower than /0, got: %s", prefix)
+		}
+	}
+
+	var statsInterval time.Duration
+	if env := os.Getenv("STATS_INTERVAL"); env != "" {
+		statsInterval, err = time.ParseDuration(env)
+		if err != nil || statsInterval < 0 {
+			return nil, fmt.Errorf("STATS_INTERVAL must be a duration, got: %s", env)
+		}
+	}
+
+	primary := Upstream{
+		PublicKey:       nodePublicKey,
 		Type:            connType,
-		LocalIP:         localIP,
-		NodeVPNIP:       nodeVPNIP,
-		GatewayIP:       gatewayIP,
+		Endpoint:        transportEndpoint(transportConfig),
 		RemoteHost:      remoteHost,
 		TransportConfig: transportConfig,
+	}
+	extra, err := parseNodes(os.Getenv("NODES"), primary, nodeDiscovery != nil)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := append([]Upstream{primary}, extra...)
+	for _, up := range upstreams {
+		setMaxMessageSize(up.TransportConfig, maxMessageSize)
+	}
+
+	// Streams need in-order delivery, which only the stream transports guarantee
+	if mode == ModeProxy {
+		for _, up := range upstreams {
+			if up.Type == "udp" {
+				return nil, fmt.Errorf("MODE=proxy requires wss, v2ray or tcp transports, node %s uses %s", up.Endpoint, up.Type)
+			}
+		}
+		for _, hop := range hops {
+			if hop.Type == "udp" {
+				return nil, fmt.Errorf("MODE=proxy requires wss, v2ray or tcp transports, hop %s uses %s", hop.Endpoint, hop.Type)
+			}
+		}
+	}
+
+	nodePolicy := PolicyOrdered
+	if env := os.Getenv("NODE_POLICY"); env != "" {
+		if env != PolicyOrdered && env != PolicyLatency {
+			return nil, fmt.Errorf("NODE_POLICY must be %q or %q, got: %s", PolicyOrdered, PolicyLatency, env)
+		}
+		nodePolicy = env
+	}
+
+	enableIPv6 := false
+	if env := os.Getenv("ENABLE_IPV6"); env != "" {
+		enableIPv6, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("ENABLE_IPV6 must be a boolean, got: %s", env)
+		}
+	}
+
+	handshakeTimeout := 10 * time.Second
+	if env := os.Getenv("HANDSHAKE_TIMEOUT"); env != "" {
+		handshakeTimeout, err = time.ParseDuration(env)
+		if err != nil || handshakeTimeout <= 0 {
+			return nil, fmt.Errorf("HANDSHAKE_TIMEOUT must be a positive duration, got: %s", env)
+		}
+	}
+
+	handshakeRetries := 3
+	if env := os.Getenv("HANDSHAKE_RETRIES"); env != "" {
+		handshakeRetries, err = strconv.Atoi(env)
+		if err != nil || handshakeRetries < 1 {
+			return nil, fmt.Errorf("HANDSHAKE_RETRIES must be a positive integer, got: %s", env)
+		}
+	}
+
+	sessionMode := false
+	if env := os.Getenv("SESSION_MODE"); env != "" {
+		sessionMode, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_MODE must be a boolean, got: %s", env)
+		}
+	}
+
+	cipherSuites, err := msg.ParseSuites(os.Getenv("CIPHER_SUITES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIPHER_SUITES: %w", err)
+	}
+
+	rekeyPackets := uint64(msg.DefaultRekeyPackets)
+	if env := os.Getenv("REKEY_PACKETS"); env != "" {
+		rekeyPackets, err = strconv.ParseUint(env, 10, 64)
+		if err != nil || rekeyPackets == 0 {
+			return nil, fmt.Errorf("REKEY_PACKETS must be a positive integer, got: %s", env)
+		}
+	}
+
+	rekeyInterval := msg.DefaultRekeyInterval
+	if env := os.Getenv("REKEY_INTERVAL"); env != "" {
+		rekeyInterval, err = time.ParseDuration(env)
+		if err != nil || rekeyInterval <= 0 {
+			return nil, fmt.Errorf("REKEY_INTERVAL must be a positive duration, got: %s", env)
+		}
+	}
+
+	tunBatch := 1
+	if env := os.Getenv("TUN_BATCH"); env != "" {
+		tunBatch, err = strconv.Atoi(env)
+		if err != nil || tunBatch < 1 || tunBatch > maxTUNBatch {
+			return nil, fmt.Errorf("TUN_BATCH must be an integer between 1 and %d, got: %s", maxTUNBatch, env)
+		}
+	}
+
+	keepalive := time.Duration(0)
+	if env := os.Getenv("KEEPALIVE_INTERVAL"); env != "" {
+		keepalive, err = time.ParseDuration(env)
+		if err != nil || keepalive < 0 {
+			return nil, fmt.Errorf("KEEPALIVE_INTERVAL must be a non-negative duration, got: %s", env)
+		}
+	}
+
+	roamInterval := 2 * time.Second
+	if env := os.Getenv("ROAM_CHECK_INTERVAL"); env != "" {
+		roamInterval, err = time.ParseDuration(env)
+		if err != nil || roamInterval < 0 {
+			return nil, fmt.Errorf("ROAM_CHECK_INTERVAL must be a non-negative duration, got: %s", env)
+		}
+	}
+
+	dryRun := false
+	if env := os.Getenv("DRY_RUN"); env != "" {
+		dryRun, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("DRY_RUN must be a boolean, got: %s", env)
+		}
+	}
+
+	// Timestamps need synced clocks, so checking them is opt-in
+	timestampSkew := time.Duration(0)
+	if env := os.Getenv("CHECK_TIMESTAMPS"); env != "" {
+		check, err := strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("CHECK_TIMESTAMPS must be a boolean, got: %s", env)
+		}
+		if check {
+			timestampSkew = msg.DefaultTimestampSkew
+			if env := os.Getenv("TIMESTAMP_SKEW"); env != "" {
+				timestampSkew, err = time.ParseDuration(env)
+				if err != nil || timestampSkew <= 0 {
+					return nil, fmt.Errorf("TIMESTAMP_SKEW must be a positive duration, got: %s", env)
+				}
+			}
+		}
+	}
+
+	return &ConnConfig{
+		Mode:             mode,
+		Datapath:         datapath,
+		ProxyAddr:        proxyAddr,
+		PrivateKey:       privateKey,
+		NodePublicKey:    nodePublicKey,
+		Type:             connType,
+		LocalIP:          localIP,
+		NodeVPNIP:        nodeVPNIP,
+		GatewayIP:        gatewayIP,
+		RemoteHost:       remoteHost,
+		TransportConfig:  transportConfig,
+		ReconnectEnabled: reconnectEnabled,
+		MaxRetries:       maxRetries,
+		Hops:             hops,
+		MTU:              mtu,
+		MaxMessageSize:   maxMessageSize,
+		TunName:          os.Getenv("TUN_NAME"),
+		AllowedIPs:       allowedIPs,
+		ExcludeIPs:       excludeIPs,
+		Compression:      compression,
+		CompressionDict:  compressionDict,
+		Padding:          padding,
+		StatsInterval:    statsInterval,
+		StatsAddr:        os.Getenv("STATS_ADDR"),
+		Upstreams:        upstreams,
+		NodePolicy:       nodePolicy,
+		EnableIPv6:       enableIPv6,
+		LocalIP6:         os.Getenv("LOCAL_IP6"),
+		HandshakeTimeout: handshakeTimeout,
+		HandshakeRetries: handshakeRetries,
+		DebugPcap:        os.Getenv("DEBUG_PCAP"),
+		SessionMode:      sessionMode,
+		CipherSuites:     cipherSuites,
+		RekeyPackets:     rekeyPackets,
+		RekeyInterval:    rekeyInterval,
+		TUNBatch:         tunBatch,
+		DryRun:           dryRun,
+		Keepalive:        keepalive,
+		RoamInterval:     roamInterval,
+		TimestampSkew:    timestampSkew,
+		Obfuscator:       obfuscator,
+		ObfsJitter:       obfsJitter,
+		Discovery:        nodeDiscovery,
 	}, nil
 }
 
+// parseNodes parses comma-separated fallback nodes in the form [<type>@]<endpoint>:<pubkey hex>.
+// The type defaults to the primary node's; transport settings are copied from it.
+// With discovery, endpoints that don't resolve yet are looked up again on connect.
+func parseNodes(env string, primary Upstream, discover bool) ([]Upstream, error) {
+	if env == "" {
+		return nil, nil
+	}
+
+	var nodes []Upstream
+	for _, entry := range strings.Split(env, ",") {
+		entry = strings.TrimSpace(entry)
+
+		connType := primary.Type
+		// A VLESS link has an @ of its own, after its scheme
+		if typ, rest, ok := strings.Cut(entry, "@"); ok && !strings.Contains(typ, "://") {
+			if _, valid := ConnTypeMap[typ]; !valid {
+				return nil, fmt.Errorf("NODES invalid connection type: %s", typ)
+			}
+			connType, entry = typ, rest
+		}
+
+		sep := strings.LastIndex(entry, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("NODES entry must be [<type>@]<endpoint>:<pubkey>, got: %s", entry)
+		}
+		endpoint, keyText := entry[:sep], entry[sep+1:]
+
+		publicKey, err := msg.ParsePublicKey(keyText)
+		if err != nil {
+			return nil, fmt.Errorf("NODES entry %s: %w", endpoint, err)
+		}
+
+		transportConfig, err := transportConfigFor(connType, endpoint, primary.TransportConfig)
+		if err != nil {
+			return nil, fmt.Errorf("NODES entry %s: %w", endpoint, err)
+		}
+		remoteHost, err := resolveHost(endpoint)
+		if err != nil && !discover {
+			return nil, fmt.Errorf("NODES entry %s: %w", endpoint, err)
+		}
+
+		node := Upstream{
+			Type:            connType,
+			Endpoint:        transportEndpoint(transportConfig),
+			RemoteHost:      remoteHost,
+			TransportConfig: transportConfig,
+			PublicKey:       publicKey,
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// transportConfigFor builds a transport config for endpoint, inheriting
+// settings (keepalive, pinning) from base when it has the same type
+func transportConfigFor(connType, endpoint string, base TransportConfig) (TransportConfig, error) {
+	switch connType {
+	case "wss":
+		cfg := &wss.Config{}
+		if b, ok := base.(*wss.Config); ok {
+			*cfg = *b
+		}
+		if !strings.HasPrefix(endpoint, "ws://") && !strings.HasPrefix(endpoint, "wss://") {
+			return nil, fmt.Errorf("wss endpoint must start with ws:// or wss://")
+		}
+		if !strings.HasSuffix(endpoint, "/ws") {
+			endpoint = strings.TrimSuffix(endpoint, "/") + "/ws"
+		}
+		cfg.Url = endpoint
+		return cfg, nil
+	case "udp":
+		cfg := &udp.Config{}
+		if b, ok := base.(*udp.Config); ok {
+			*cfg = *b
+		}
+		cfg.Addr = endpoint
+		return cfg, nil
+	case "v2ray":
+		cfg := &v2ray.Config{}
+		if b, ok := base.(*v2ray.Config); ok {
+			*cfg = *b
+		}
+		if !strings.HasPrefix(endpoint, "vless://") {
+			return nil, fmt.Errorf("v2ray endpoint must start with vless://")
+		}
+		cfg.Url = endpoint
+		return cfg, nil
+	case "tcp":
+		cfg := &tcp.Config{}
+		if b, ok := base.(*tcp.Config); ok {
+			*cfg = *b
+		}
+		cfg.Addr = endpoint
+		return cfg, nil
+	default:
+		return nil, fmt.Errorf("invalid connection type: %s", connType)
+	}
+}
+
+// transportEndpoint returns the address a transport config dials
+func transportEndpoint(cfg TransportConfig) string {
+	switch c := cfg.(type) {
+	case *wss.Config:
+		return c.Url
+	case *udp.Config:
+		return c.Addr
+	case *v2ray.Config:
+		return c.Url
+	case *tcp.Config:
+		return c.Addr
+	default:
+		return ""
+	}
+}
+
+// setMaxMessageSize applies the message size limit to a transport config
+func setMaxMessageSize(cfg TransportConfig, size int) {
+	switch c := cfg.(type) {
+	case *wss.Config:
+		c.MaxMessageSize = size
+	case *udp.Config:
+		c.MaxMessageSize = size
+	case *v2ray.Config:
+		c.MaxMessageSize = size
+	case *tcp.Config:
+		c.MaxMessageSize = size
+	}
+}
+
+// resolveHost returns the IPv4 address of the host in a URL or host:port endpoint
+func resolveHost(endpoint string) (string, error) {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(endpoint); err == nil {
+		host = h
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address for %s", host)
+}
+
+// parseDiscovery reads NODE_DISCOVERY and DNS_CACHE_TTL, returning nil when
+// discovery is off
+func parseDiscovery() (*discovery.Discovery, error) {
+	enabled := false
+	if env := os.Getenv("NODE_DISCOVERY"); env != "" {
+		var err error
+		enabled, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("NODE_DISCOVERY must be a boolean, got: %s", env)
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	ttl := discovery.DefaultCacheTTL
+	if env := os.Getenv("DNS_CACHE_TTL"); env != "" {
+		var err error
+		ttl, err = time.ParseDuration(env)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("DNS_CACHE_TTL must be a positive duration, got: %s", env)
+		}
+	}
+	return discovery.New(nil, ttl), nil
+}
+
+// discoverHost returns the first IPv4 address discovery finds for endpoint
+func discoverHost(d *discovery.Discovery, endpoint string) (string, error) {
+	hostport, err := discovery.HostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	targets, err := d.Resolve(ctx, hostport)
+	if err != nil {
+		return "", err
+	}
+	for _, target := range targets {
+		if target.Addr.Addr().Is4() {
+			return target.Addr.Addr().String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address for %s", hostport)
+}
+
+// parseHops parses comma-separated hops in the form <pubkey hex>@<type>@<endpoint>
+func parseHops(env string) ([]Hop, error) {
+	if env == "" {
+		return nil, nil
+	}
+
+	var hops []Hop
+	for _, entry := range strings.Split(env, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "@", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("CIRCUIT_HOPS entry must be <pubkey>@<type>@<endpoint>, got: %s", entry)
+		}
+
+		publicKey, err := msg.ParsePublicKey(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("CIRCUIT_HOPS: %w", err)
+		}
+		if _, ok := ConnTypeMap[parts[1]]; !ok {
+			return nil, fmt.Errorf("CIRCUIT_HOPS invalid connection type: %s", parts[1])
+		}
+
+		hop := Hop{PublicKey: publicKey}
+		hop.Type = parts[1]
+		hop.Endpoint = parts[2]
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// parsePrefixes parses comma-separated CIDRs from the named env var
+func parsePrefixes(key string) ([]netip.Prefix, error) {
+	env := os.Getenv(key)
+	if env == "" {
+		return nil, nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(env, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("%s entry must be a CIDR, got: %s", key, entry)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// LoadFile applies settings from a config file; env vars override file values
+func LoadFile(path string) error {
+	values, err := helpers.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	// A profile describes a single transport
+	set := 0
+	for _, key := range []string{"WS_URL", "UDP_ADDR", "V2RAY_URL", "TCP_ADDR"} {
+		if _, ok := values[key]; ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("config file %s: set only one of WS_URL, UDP_ADDR, V2RAY_URL and TCP_ADDR", path)
+	}
+
+	if v, ok := values["PRIVATE_KEY"]; ok {
+		if _, err := msg.ParsePrivateKey(v); err != nil {
+			return fmt.Errorf("config file %s: PRIVATE_KEY: %w", path, err)
+		}
+	}
+	if v, ok := values["NODE_PUBLIC_KEY"]; ok {
+		if _, err := msg.ParsePublicKey(v); err != nil {
+			return fmt.Errorf("config file %s: NODE_PUBLIC_KEY: %w", path, err)
+		}
+	}
+	return nil
+}
+
 func GetConnTypeFromEnv() (string, error) {
 	env := os.Getenv("CONN_TYPE")
 	if env == "" {
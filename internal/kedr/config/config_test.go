@@ -0,0 +1,304 @@
+package config
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// profileKeys are the settings these tests put in files or the environment
+var profileKeys = []string{
+	"CONN_TYPE", "MODE", "UDP_ADDR", "TCP_ADDR", "PRIVATE_KEY", "PRIVATE_KEY_FILE",
+	"NODE_PUBLIC_KEY", "MTU", "RECONNECT_MAX_RETRIES", "HANDSHAKE_TIMEOUT", "HANDSHAKE_RETRIES",
+	"COMPRESSION_DICT", "CHECK_TIMESTAMPS", "TIMESTAMP_SKEW",
+}
+
+// isolateEnv clears profileKeys until the test ends, so values a file
+// exports don't leak into other tests
+func isolateEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range profileKeys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+// writeProfile writes lines to a config file in a fresh directory
+func writeProfile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kedr.yaml")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// hexKeys returns a fresh key pair in hex
+func hexKeys(t *testing.T) (private, public string) {
+	t.Helper()
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(privateKey[:]), hex.EncodeToString(publicKey[:])
+}
+
+func TestLoadFileEnvOverridesFile(t *testing.T) {
+	isolateEnv(t)
+	privateKey, filePublic := hexKeys(t)
+	_, envPublic := hexKeys(t)
+
+	path := writeProfile(t,
+		"MODE: proxy",
+		"TCP_ADDR: 127.0.0.1:5000",
+		"PRIVATE_KEY: "+privateKey,
+		"NODE_PUBLIC_KEY: "+filePublic,
+		"MTU: 1300",
+		"RECONNECT_MAX_RETRIES: 3",
+	)
+	t.Setenv("NODE_PUBLIC_KEY", envPublic)
+	t.Setenv("MTU", "1400")
+
+	if err := LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfigFromEnv("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(cfg.NodePublicKey[:]); got != envPublic {
+		t.Errorf("NODE_PUBLIC_KEY from the file won over the env")
+	}
+	if cfg.MTU != 1400 {
+		t.Errorf("MTU = %d, want the env's 1400", cfg.MTU)
+	}
+	// Settings only the file has still apply
+	if cfg.MaxRetries != 3 || cfg.Mode != ModeProxy {
+		t.Errorf("file settings lost: retries %d, mode %q", cfg.MaxRetries, cfg.Mode)
+	}
+}
+
+func TestLoadFileRejectsBadProfiles(t *testing.T) {
+	privateKey, publicKey := hexKeys(t)
+	tests := []struct {
+		name  string
+		lines []string
+		want  string // Part of the error
+	}{
+		{"two transports", []string{"UDP_ADDR: 127.0.0.1:5000", "TCP_ADDR: 127.0.0.1:5001"}, "only one of"},
+		{"short private key", []string{"PRIVATE_KEY: " + privateKey[:62]}, "PRIVATE_KEY"},
+		{"private key not hex", []string{"PRIVATE_KEY: zz" + privateKey[2:]}, "PRIVATE_KEY"},
+		{"long public key", []string{"NODE_PUBLIC_KEY: " + publicKey + "00"}, "NODE_PUBLIC_KEY"},
+		{"low-order public key", []string{"NODE_PUBLIC_KEY: " + strings.Repeat("00", 32)}, "NODE_PUBLIC_KEY"},
+		{"unterminated quote", []string{"UDP_ADDR: \"127.0.0.1:5000"}, "parse config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateEnv(t)
+			path := writeProfile(t, tt.lines...)
+			err := LoadFile(path)
+			if err == nil {
+				t.Fatal("accepted")
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), path) {
+				t.Fatalf("error %q, want one naming %s and %q", err, path, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+			t.Fatal("loaded a missing file")
+		}
+	})
+}
+
+func TestParseNodes(t *testing.T) {
+	_, pub1 := hexKeys(t)
+	_, pub2 := hexKeys(t)
+	primary := Upstream{Type: "udp", TransportConfig: &udp.Config{Addr: "127.0.0.1:5000", NoMigration: true}}
+
+	nodes, err := parseNodes("127.0.0.1:5001:"+pub1+", tcp@127.0.0.1:5002:"+pub2, primary, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("parsed %d nodes, want 2", len(nodes))
+	}
+	if nodes[0].Type != "udp" || nodes[0].Endpoint != "127.0.0.1:5001" || hex.EncodeToString(nodes[0].PublicKey[:]) != pub1 {
+		t.Errorf("first node %+v", nodes[0])
+	}
+	// Untyped entries inherit the primary transport's settings
+	if cfg, ok := nodes[0].TransportConfig.(*udp.Config); !ok || !cfg.NoMigration {
+		t.Errorf("first node transport %+v, want the primary's udp settings", nodes[0].TransportConfig)
+	}
+	if nodes[1].Type != "tcp" || nodes[1].Endpoint != "127.0.0.1:5002" || nodes[1].RemoteHost != "127.0.0.1" {
+		t.Errorf("second node %+v", nodes[1])
+	}
+
+	for _, env := range []string{
+		"127.0.0.1:5001",                       // No key
+		"quic@127.0.0.1:5001:" + pub1,          // Unknown transport
+		"127.0.0.1:5001:" + pub1[:60],          // Short key
+		"wss@127.0.0.1:5001:" + pub1,           // Not a URL
+		"127.0.0.1:5001:" + pub1 + ",:" + pub2, // Empty endpoint
+	} {
+		if _, err := parseNodes(env, primary, false); err == nil {
+			t.Errorf("NODES=%s accepted", env)
+		}
+	}
+}
+
+func TestHandshakeSettingsFromEnv(t *testing.T) {
+	privateKey, publicKey := hexKeys(t)
+	base := func(t *testing.T) {
+		isolateEnv(t)
+		t.Setenv("MODE", "proxy")
+		t.Setenv("TCP_ADDR", "127.0.0.1:5000")
+		t.Setenv("PRIVATE_KEY", privateKey)
+		t.Setenv("NODE_PUBLIC_KEY", publicKey)
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		base(t)
+		t.Setenv("HANDSHAKE_TIMEOUT", "")
+		t.Setenv("HANDSHAKE_RETRIES", "")
+		cfg, err := ParseConfigFromEnv("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.HandshakeTimeout != 10*time.Second || cfg.HandshakeRetries != 3 {
+			t.Fatalf("timeout %v, retries %d; want 10s, 3", cfg.HandshakeTimeout, cfg.HandshakeRetries)
+		}
+	})
+	t.Run("set", func(t *testing.T) {
+		base(t)
+		t.Setenv("HANDSHAKE_TIMEOUT", "2500ms")
+		t.Setenv("HANDSHAKE_RETRIES", "5")
+		cfg, err := ParseConfigFromEnv("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.HandshakeTimeout != 2500*time.Millisecond || cfg.HandshakeRetries != 5 {
+			t.Fatalf("timeout %v, retries %d; want 2.5s, 5", cfg.HandshakeTimeout, cfg.HandshakeRetries)
+		}
+	})
+	for _, bad := range [][2]string{
+		{"HANDSHAKE_TIMEOUT", "0s"},
+		{"HANDSHAKE_TIMEOUT", "soon"},
+		{"HANDSHAKE_RETRIES", "0"},
+		{"HANDSHAKE_RETRIES", "-1"},
+	} {
+		t.Run(bad[0]+"="+bad[1], func(t *testing.T) {
+			base(t)
+			t.Setenv(bad[0], bad[1])
+			if _, err := ParseConfigFromEnv("tcp"); err == nil || !strings.Contains(err.Error(), bad[0]) {
+				t.Fatalf("got %v, want an error naming %s", err, bad[0])
+			}
+		})
+	}
+}
+
+func TestCompressionDictFromEnv(t *testing.T) {
+	privateKey, publicKey := hexKeys(t)
+	base := func(t *testing.T) {
+		isolateEnv(t)
+		t.Setenv("MODE", "proxy")
+		t.Setenv("TCP_ADDR", "127.0.0.1:5000")
+		t.Setenv("PRIVATE_KEY", privateKey)
+		t.Setenv("NODE_PUBLIC_KEY", publicKey)
+	}
+	dir := t.TempDir()
+	dictPath := filepath.Join(dir, "packets.dict")
+	if err := os.WriteFile(dictPath, []byte("header shapes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(dir, "empty.dict")
+	if err := os.WriteFile(emptyPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("built-in", func(t *testing.T) {
+		base(t)
+		cfg, err := ParseConfigFromEnv("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.CompressionDict != nil {
+			t.Fatalf("dictionary %q without COMPRESSION_DICT, want nil for the built-in one", cfg.CompressionDict)
+		}
+	})
+	t.Run("file", func(t *testing.T) {
+		base(t)
+		t.Setenv("COMPRESSION_DICT", dictPath)
+		cfg, err := ParseConfigFromEnv("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cfg.CompressionDict) != "header shapes" {
+			t.Fatalf("dictionary %q, want the file's contents", cfg.CompressionDict)
+		}
+	})
+	for name, path := range map[string]string{
+		"missing": filepath.Join(dir, "missing.dict"),
+		"empty":   emptyPath,
+	} {
+		t.Run(name, func(t *testing.T) {
+			base(t)
+			t.Setenv("COMPRESSION_DICT", path)
+			if _, err := ParseConfigFromEnv("tcp"); err == nil || !strings.Contains(err.Error(), "COMPRESSION_DICT") {
+				t.Fatalf("got %v, want an error naming COMPRESSION_DICT", err)
+			}
+		})
+	}
+}
+
+func TestTimestampSkewFromEnv(t *testing.T) {
+	privateKey, publicKey := hexKeys(t)
+	tests := []struct {
+		name  string
+		check string
+		skew  string
+		want  time.Duration
+		ok    bool
+	}{
+		{"unset", "", "", 0, true},
+		{"off", "false", "5s", 0, true},
+		{"default", "true", "", msg.DefaultTimestampSkew, true},
+		{"custom", "true", "5s", 5 * time.Second, true},
+		{"not a boolean", "sometimes", "", 0, false},
+		{"not a duration", "true", "soon", 0, false},
+		{"zero", "true", "0s", 0, false},
+		{"negative", "true", "-5s", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateEnv(t)
+			t.Setenv("MODE", "proxy")
+			t.Setenv("TCP_ADDR", "127.0.0.1:5000")
+			t.Setenv("PRIVATE_KEY", privateKey)
+			t.Setenv("NODE_PUBLIC_KEY", publicKey)
+			t.Setenv("CHECK_TIMESTAMPS", tt.check)
+			t.Setenv("TIMESTAMP_SKEW", tt.skew)
+			cfg, err := ParseConfigFromEnv("tcp")
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("parsed with skew %v, want an error", cfg.TimestampSkew)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.TimestampSkew != tt.want {
+				t.Fatalf("got skew %v, want %v", cfg.TimestampSkew, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Package discovery resolves node endpoints from DNS, so a node can change
+// address without every client being reconfigured. A host of the form
+// _service._proto.name is looked up as SRV records carrying host and port;
+// any other name is looked up as A/AAAA records.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long resolved targets are reused. Go's resolver
+// doesn't expose record TTLs, so a fixed lifetime stands in for them.
+const DefaultCacheTTL = 30 * time.Second
+
+// ErrNoTargets is returned when a name resolves to no usable address
+var ErrNoTargets = errors.New("no addresses found")
+
+// Resolver is the subset of *net.Resolver discovery needs
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Target is one address a node can be reached at
+type Target struct {
+	Host string         // Name to present for TLS and HTTP (the SRV target or configured host)
+	Addr netip.AddrPort // Address to dial
+}
+
+// cacheEntry holds the targets resolved for one endpoint
+type cacheEntry struct {
+	targets []Target
+	expires time.Time
+}
+
+// Discovery resolves endpoints, caching the results for a fixed TTL
+type Discovery struct {
+	resolver Resolver
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	cache    map[string]cacheEntry
+}
+
+// New creates a Discovery using resolver (nil = net.DefaultResolver) and
+// caching for ttl (0 = DefaultCacheTTL)
+func New(resolver Resolver, ttl time.Duration) *Discovery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Discovery{
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		cache:    make(map[string]cacheEntry),
+	}
+}
+
+// Resolve returns the targets for a host:port endpoint, in the order to try
+// them. SRV records supply their own ports and come in priority order, with
+// equal priorities shuffled by weight. When lookup fails, the last targets
+// found are returned if there are any, as the node most likely hasn't moved.
+func (d *Discovery) Resolve(ctx context.Context, hostport string) ([]Target, error) {
+	d.mu.Lock()
+	entry, cached := d.cache[hostport]
+	d.mu.Unlock()
+	if cached && d.now().Before(entry.expires) {
+		return entry.targets, nil
+	}
+
+	targets, err := d.lookup(ctx, hostport)
+	if err != nil {
+		if cached {
+			slog.Warn("Node lookup failed, using previous addresses", "endpoint", hostport, "error", err)
+			return entry.targets, nil
+		}
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.cache[hostport] = cacheEntry{targets: targets, expires: d.now().Add(d.ttl)}
+	d.mu.Unlock()
+	return targets, nil
+}
+
+func (d *Discovery) lookup(ctx context.Context, hostport string) ([]Target, error) {
+	host, portText, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// An SRV name needs no port
+		if !strings.HasPrefix(hostport, "_") {
+			return nil, err
+		}
+		host = hostport
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		port, err := parsePort(portText)
+		if err != nil {
+			return nil, err
+		}
+		return []Target{{Host: host, Addr: netip.AddrPortFrom(addr, port)}}, nil
+	}
+
+	// SRV names carry their own ports; the configured one is ignored
+	if strings.HasPrefix(host, "_") {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return nil, fmt.Errorf("lookup SRV %s: %w", host, err)
+		}
+		var targets []Target
+		for _, srv := range records {
+			name := strings.TrimSuffix(srv.Target, ".")
+			found, err := d.lookupHost(ctx, name, srv.Port)
+			if err != nil {
+				slog.Warn("Skipping SRV target", "target", name, "error", err)
+				continue
+			}
+			targets = append(targets, found...)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("lookup SRV %s: %w", host, ErrNoTargets)
+		}
+		return targets, nil
+	}
+
+	port, err := parsePort(portText)
+	if err != nil {
+		return nil, err
+	}
+	return d.lookupHost(ctx, host, port)
+}
+
+// lookupHost resolves host to targets on port, IPv4 first
+func (d *Discovery) lookupHost(ctx context.Context, host string, port uint16) ([]Target, error) {
+	addrs, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+
+	var v4, v6 []Target
+	for _, addr := range addrs {
+		target := Target{Host: host, Addr: netip.AddrPortFrom(addr.Unmap(), port)}
+		if target.Addr.Addr().Is4() {
+			v4 = append(v4, target)
+		} else {
+			v6 = append(v6, target)
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("lookup %s: %w", host, ErrNoTargets)
+	}
+	return append(v4, v6...), nil
+}
+
+// HostPort returns the host:port a WebSocket URL or UDP address connects to,
+// filling in the scheme's default port for URLs without one
+func HostPort(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parse %s: %w", endpoint, err)
+	}
+	switch {
+	case u.Port() != "":
+		return u.Host, nil
+	case u.Scheme == "ws":
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	default:
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("port must be between 1 and 65535, got: %s", s)
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockResolver answers from fixed records and counts lookups
+type mockResolver struct {
+	mu      sync.Mutex
+	srv     map[string][]*net.SRV
+	hosts   map[string][]netip.Addr
+	fail    bool // Fail every lookup
+	lookups int
+}
+
+func (r *mockResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	records, ok := r.srv[name]
+	if r.fail || !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (r *mockResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if r.fail || !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *mockResolver) setHosts(hosts map[string][]netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = hosts
+}
+
+func (r *mockResolver) setFail(fail bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = fail
+}
+
+// addrs parses a list of addresses
+func addrs(list ...string) []netip.Addr {
+	var out []netip.Addr
+	for _, s := range list {
+		out = append(out, netip.MustParseAddr(s))
+	}
+	return out
+}
+
+// dialed returns the addresses targets dial, in order
+func dialed(targets []Target) []string {
+	var out []string
+	for _, target := range targets {
+		out = append(out, target.Addr.String())
+	}
+	return out
+}
+
+func TestResolveHostRecords(t *testing.T) {
+	r := &mockResolver{hosts: map[string][]netip.Addr{
+		"node.example.test": addrs("2001:db8::1", "192.0.2.1", "::ffff:192.0.2.2", "192.0.2.3"),
+	}}
+	targets, err := New(r, 0).Resolve(context.Background(), "node.example.test:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1:8443", "192.0.2.2:8443", "192.0.2.3:8443", "[2001:db8::1]:8443"}
+	if got := dialed(targets); !slices.Equal(got, want) {
+		t.Fatalf("resolved %v, want %v", got, want)
+	}
+	for _, target := range targets {
+		if target.Host != "node.example.test" {
+			t.Fatalf("target host %q, want the configured name", target.Host)
+		}
+	}
+}
+
+func TestResolveSRVRecords(t *testing.T) {
+	r := &mockResolver{
+		srv: map[string][]*net.SRV{"_seras._udp.example.test": {
+			{Target: "a.example.test.", Port: 4000, Priority: 10},
+			{Target: "gone.example.test.", Port: 4001, Priority: 10},
+			{Target: "b.example.test.", Port: 5000, Priority: 20},
+		}},
+		hosts: map[string][]netip.Addr{
+			"a.example.test": addrs("192.0.2.1", "192.0.2.2"),
+			"b.example.test": addrs("198.51.100.7"),
+		},
+	}
+	d := New(r, 0)
+	// SRV names carry their own port, so a configured one is ignored
+	for _, endpoint := range []string{"_seras._udp.example.test", "_seras._udp.example.test:443"} {
+		targets, err := d.lookup(context.Background(), endpoint)
+		if err != nil {
+			t.Fatalf("%s: %v", endpoint, err)
+		}
+		want := []string{"192.0.2.1:4000", "192.0.2.2:4000", "198.51.100.7:5000"}
+		if got := dialed(targets); !slices.Equal(got, want) {
+			t.Fatalf("%s: resolved %v, want %v", endpoint, got, want)
+		}
+		if targets[0].Host != "a.example.test" || targets[2].Host != "b.example.test" {
+			t.Fatalf("%s: target hosts %q and %q, want the SRV targets", endpoint, targets[0].Host, targets[2].Host)
+		}
+	}
+
+	// No target resolving is an error
+	r.setHosts(nil)
+	if _, err := d.Resolve(context.Background(), "_seras._udp.example.test"); !errors.Is(err, ErrNoTargets) {
+		t.Fatalf("got %v, want ErrNoTargets", err)
+	}
+}
+
+func TestResolveCachesUntilTTL(t *testing.T) {
+	r := &mockResolver{hosts: map[string][]netip.Addr{"node.example.test": addrs("192.0.2.1")}}
+	d := New(r, time.Minute)
+	now := time.Unix(1_000_000, 0)
+	d.now = func() time.Time { return now }
+	resolve := func() []string {
+		t.Helper()
+		targets, err := d.Resolve(context.Background(), "node.example.test:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dialed(targets)
+	}
+
+	resolve()
+	r.setHosts(map[string][]netip.Addr{"node.example.test": addrs("192.0.2.9")})
+	now = now.Add(59 * time.Second)
+	if got := resolve(); !slices.Equal(got, []string{"192.0.2.1:443"}) || r.lookups != 1 {
+		t.Fatalf("within the TTL: resolved %v in %d lookups, want the cached address", got, r.lookups)
+	}
+
+	// Once expired, the node's move is picked up
+	now = now.Add(2 * time.Second)
+	if got := resolve(); !slices.Equal(got, []string{"192.0.2.9:443"}) {
+		t.Fatalf("after the TTL: resolved %v, want the new address", got)
+	}
+
+	// A failed lookup falls back to the last answer
+	r.setFail(true)
+	now = now.Add(2 * time.Minute)
+	if got := resolve(); !slices.Equal(got, []string{"192.0.2.9:443"}) {
+		t.Fatalf("lookup failing: resolved %v, want the previous address", got)
+	}
+	if _, err := d.Resolve(context.Background(), "other.example.test:443"); err == nil {
+		t.Fatal("resolved a name that never had an answer")
+	}
+}
+
+func TestResolveLiteralsAndErrors(t *testing.T) {
+	r := &mockResolver{hosts: map[string][]netip.Addr{"node.example.test": nil}}
+	d := New(r, 0)
+	targets, err := d.Resolve(context.Background(), "[2001:db8::5]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dialed(targets); !slices.Equal(got, []string{"[2001:db8::5]:443"}) || r.lookups != 0 {
+		t.Fatalf("literal resolved to %v in %d lookups", got, r.lookups)
+	}
+
+	for _, endpoint := range []string{"node.example.test", "node.example.test:0", "node.example.test:http", "192.0.2.1:70000"} {
+		if _, err := d.Resolve(context.Background(), endpoint); err == nil {
+			t.Errorf("resolved %q", endpoint)
+		}
+	}
+	if _, err := d.Resolve(context.Background(), "node.example.test:443"); !errors.Is(err, ErrNoTargets) {
+		t.Fatalf("name without records: got %v, want ErrNoTargets", err)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	tests := map[string]string{
+		"wss://node.example.test/ws":      "node.example.test:443",
+		"ws://node.example.test/ws":       "node.example.test:80",
+		"wss://node.example.test:8443/ws": "node.example.test:8443",
+		"wss://[2001:db8::1]/ws":          "[2001:db8::1]:443",
+		"node.example.test:9000":          "node.example.test:9000",
+		"_seras._udp.example.test":        "_seras._udp.example.test",
+	}
+	for endpoint, want := range tests {
+		if got, err := HostPort(endpoint); err != nil || got != want {
+			t.Errorf("HostPort(%q) = %q, %v; want %q", endpoint, got, err, want)
+		}
+	}
+}
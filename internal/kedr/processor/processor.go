@@ -2,29 +2,48 @@ package processor
 
 import (
 	"fmt"
+	"seras-protocol/internal/tap"
 	"seras-protocol/internal/tun"
 	"seras-protocol/pkg/taiga/msg"
 )
 
 type Processor struct {
-	tun *tun.TUN
+	tun tun.Device
+	tap *tap.Tap
 }
 
-func NewProcessor(t *tun.TUN) *Processor {
+func NewProcessor(t tun.Device) *Processor {
 	return &Processor{tun: t}
 }
 
+// SetTap records decrypted packets before they are written to TUN
+func (p *Processor) SetTap(t *tap.Tap) {
+	p.tap = t
+}
+
 func (p *Processor) Process(data *msg.CookedMsg) error {
-	if data.Body.NextHop == nil {
-		// Final destination - write to TUN
-		n, err := p.tun.Write(data.Body.Data)
-		if err != nil {
-			return fmt.Errorf("failed to write to TUN: %w", err)
-		}
-		if n != len(data.Body.Data) {
-			return fmt.Errorf("incomplete write: %d/%d bytes", n, len(data.Body.Data))
-		}
+	if err := p.Prepare(data); err != nil {
+		return err
+	}
+
+	n, err := p.tun.Write(data.Body.Data)
+	if err != nil {
+		return fmt.Errorf("failed to write to TUN: %w", err)
+	}
+	if n != len(data.Body.Data) {
+		return fmt.Errorf("incomplete write: %d/%d bytes", n, len(data.Body.Data))
 	}
-	// TODO: handle multi-hop routing when NextHop != nil
+	return nil
+}
+
+// Prepare checks that a message is for the TUN and taps it, without writing
+// it; Process does both. Batched writers call it before queueing the packet.
+func (p *Processor) Prepare(data *msg.CookedMsg) error {
+	// Circuit nodes re-encrypt return traffic hop by hop, so the client is always the final destination
+	if data.Body.NextHop != nil {
+		return fmt.Errorf("unexpected next hop %s in message to client", data.Body.NextHop.Endpoint)
+	}
+
+	p.tap.Capture(tap.Inbound, data.Body.Data)
 	return nil
 }
@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"seras-protocol/internal/tun"
+	"seras-protocol/internal/tun/tuntest"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// cooked returns a decrypted message carrying packet
+func cooked(packet []byte, next *msg.NextHop) *msg.CookedMsg {
+	return &msg.CookedMsg{
+		Header: &msg.Header{Version: msg.Version2, Type: msg.TypeData},
+		Body:   &msg.Msg{NextHop: next, Data: packet},
+	}
+}
+
+func TestProcessWritesPacket(t *testing.T) {
+	dev := tuntest.New("client0", 1500, 1)
+	p := NewProcessor(dev)
+	packet := []byte{0x45, 0, 0, 20, 1, 2, 3}
+	if err := p.Process(cooked(packet, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-dev.Written; !bytes.Equal(got, packet) {
+		t.Fatalf("wrote %x, want %x", got, packet)
+	}
+}
+
+func TestProcessRejectsNextHop(t *testing.T) {
+	dev := tuntest.New("client0", 1500, 1)
+	p := NewProcessor(dev)
+	next := &msg.NextHop{Protocol: msg.Udp, Endpoint: "203.0.113.10:443"}
+	if err := p.Process(cooked([]byte{0x45}, next)); err == nil {
+		t.Fatal("wrote a message addressed to another hop")
+	}
+	if len(dev.Written) != 0 {
+		t.Fatal("message for another hop reached the TUN")
+	}
+}
+
+func TestProcessClosedDevice(t *testing.T) {
+	dev := tuntest.New("client0", 1500, 0)
+	dev.Close()
+	if err := NewProcessor(dev).Process(cooked([]byte{0x45}, nil)); !errors.Is(err, tun.ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// handshakeTimeout bounds the SOCKS negotiation of a new client
+const handshakeTimeout = 10 * time.Second
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion     = 5
+	methodNoAuth     = 0x00
+	methodNoAccept   = 0xFF
+	cmdConnect       = 0x01
+	atypIPv4         = 0x01
+	atypDomain       = 0x03
+	atypIPv6         = 0x04
+	replySucceeded   = 0x00
+	replyHostUnreach = 0x04
+	replyCmdUnsupp   = 0x07
+	replyAtypUnsupp  = 0x08
+)
+
+// Dialer opens TCP streams through the tunnel
+type Dialer interface {
+	DialStream(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+}
+
+// Server is a local SOCKS5 proxy forwarding CONNECT requests through a Dialer.
+// Only unauthenticated CONNECT is supported, so it should listen on loopback.
+type Server struct {
+	addr   string
+	dialer Dialer
+}
+
+// NewServer creates a SOCKS5 proxy listening on addr
+func NewServer(addr string, dialer Dialer) *Server {
+	return &Server{addr: addr, dialer: dialer}
+}
+
+// Serve accepts proxy clients until ctx is cancelled
+func (s *Server) Serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	slog.Info("SOCKS5 proxy listening", "addr", ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// handle negotiates one SOCKS5 client and relays its connection
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	addr, err := negotiate(conn)
+	if err != nil {
+		slog.Debug("SOCKS negotiation failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	stream, err := s.dialer.DialStream(ctx, addr)
+	if err != nil {
+		slog.Debug("Proxy connect failed", "addr", addr, "error", err)
+		writeReply(conn, replyHostUnreach)
+		return
+	}
+	defer stream.Close()
+
+	if err := writeReply(conn, replySucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Close both sides as soon as either direction ends
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, stream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// negotiate runs the method selection and request phases and returns the
+// requested "host:port"
+func negotiate(conn net.Conn) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(methodNoAccept)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == methodNoAccept {
+		return "", errors.New("client offered no supported auth method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	if req[1] != cmdConnect {
+		writeReply(conn, replyCmdUnsupp)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeReply(conn, replyAtypUnsupp)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply sends a reply with an empty IPv4 bound address
+func writeReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
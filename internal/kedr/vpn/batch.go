@@ -0,0 +1,93 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/tun"
+)
+
+// coalesceQueue is how many received packets queue for a multi-packet TUN
+// when TUN_BATCH doesn't ask for more
+const coalesceQueue = 64
+
+// batchDevice returns the TUN to batch I/O through, or nil to move one
+// packet per syscall: batching is off, or the device has no io_uring
+func (c *Client) batchDevice() tun.BatchDevice {
+	if c.batch <= 1 || c.tun == nil {
+		return nil
+	}
+	dev, ok := c.tun.(tun.BatchDevice)
+	if !ok || !dev.HasIOURing() {
+		return nil
+	}
+	return dev
+}
+
+// multiPacket reports whether the TUN packs several packets into each read
+// and write
+func (c *Client) multiPacket() bool {
+	dev, ok := c.tun.(tun.MultiPacketDevice)
+	return ok && dev.MultiPacket()
+}
+
+// packetWriter returns how writeLoop hands queued packets to the TUN, and
+// how many may queue, or nil when receiveLoop should write each itself
+func (c *Client) packetWriter() (func(packets [][]byte) (int, error), int) {
+	if dev := c.batchDevice(); dev != nil {
+		return dev.WriteBatch, c.batch
+	}
+	if !c.multiPacket() {
+		return nil, 0
+	}
+
+	buf := make([]byte, 0, bufpool.Size)
+	write := func(packets [][]byte) (int, error) {
+		written := 0
+		for written < len(packets) {
+			var n int
+			buf, n = tun.CoalescePackets(buf[:0], packets[written:], bufpool.Size)
+			if _, err := c.tun.Write(buf); err != nil {
+				return written, err
+			}
+			written += n
+		}
+		return written, nil
+	}
+	return write, max(c.batch, coalesceQueue)
+}
+
+// writeLoop writes received packets to the TUN, taking as many as are
+// queued per write
+func (c *Client) writeLoop(ctx context.Context, write func(packets [][]byte) (int, error), writes <-chan []byte) {
+	packets := make([][]byte, 0, cap(writes))
+	for {
+		select {
+		case packet := <-writes:
+			packets = append(packets, packet)
+		case <-ctx.Done():
+			return
+		}
+
+	drain:
+		for len(packets) < cap(writes) {
+			select {
+			case packet := <-writes:
+				packets = append(packets, packet)
+			default:
+				break drain
+			}
+		}
+
+		if n, err := write(packets); err != nil {
+			if errors.Is(err, tun.ErrClosed) {
+				return
+			}
+			slog.Error("failed to write to TUN", "error", err, "written", n, "of", len(packets))
+		}
+		clear(packets)
+		packets = packets[:0]
+	}
+}
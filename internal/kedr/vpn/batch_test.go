@@ -0,0 +1,164 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"seras-protocol/internal/tun/tuntest"
+)
+
+// countingDevice is a batching client TUN that counts its wakeups, each of
+// which stands for a syscall on a real device
+type countingDevice struct {
+	*testDevice
+	reads, writes atomic.Int64
+}
+
+// newCountingDevice returns a device with room to queue a full batch, or
+// one moving a packet per call when batch is false
+func newCountingDevice(tb testing.TB, batch bool) *countingDevice {
+	d := &countingDevice{testDevice: &testDevice{Device: tuntest.New("client0", 1500, 256), assigned: make(chan netip.Addr, 16)}}
+	d.SetBatch(batch)
+	tb.Cleanup(func() { d.Close() })
+	return d
+}
+
+func (d *countingDevice) Read(buf []byte) (int, error) {
+	d.reads.Add(1)
+	return d.testDevice.Read(buf)
+}
+
+func (d *countingDevice) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	d.reads.Add(1)
+	return d.testDevice.ReadBatch(bufs, sizes)
+}
+
+func (d *countingDevice) Write(buf []byte) (int, error) {
+	d.writes.Add(1)
+	return d.testDevice.Write(buf)
+}
+
+func (d *countingDevice) WriteBatch(packets [][]byte) (int, error) {
+	d.writes.Add(1)
+	return d.testDevice.WriteBatch(packets)
+}
+
+// batchedClient connects a client with TUN_BATCH batch to a fresh node. It
+// uses session keys, so per-packet key agreement doesn't drown out the TUN.
+func batchedClient(tb testing.TB, subnet string, batch int) (*testNode, *countingDevice, netip.Addr) {
+	node := startNode(tb, "loopback", subnet)
+	dev := newCountingDevice(tb, batch > 1)
+	cfg := testConfig(tb, node.upstream())
+	cfg.TUNBatch = batch
+	cfg.SessionMode = true
+	runClient(tb, NewClient(cfg, dev))
+	return node, dev, dev.waitAssigned(tb)
+}
+
+func TestBatchedTUNKeepsOrder(t *testing.T) {
+	node, dev, clientIP := batchedClient(t, "10.86.0.0/24", 8)
+
+	// Queue more than a batch before the client wakes, in both directions
+	var out, in [][]byte
+	for i := range 20 {
+		out = append(out, udpPacket(clientIP, remoteAddr, uint16(i)))
+		in = append(in, udpPacket(remoteAddr, clientIP, uint16(100+i)))
+	}
+	for _, packet := range out {
+		dev.Inject(packet)
+	}
+	for i, want := range out {
+		if got := node.readTUN(t); !bytes.Equal(got, want) {
+			t.Fatalf("node TUN packet %d: got %x, want %x", i, got, want)
+		}
+	}
+	for _, packet := range in {
+		node.dev.Inject(packet)
+	}
+	for i, want := range in {
+		if got := readWritten(t, dev.Device); !bytes.Equal(got, want) {
+			t.Fatalf("client TUN packet %d: got %x, want %x", i, got, want)
+		}
+	}
+	if reads := dev.reads.Load(); reads > int64(len(out)) {
+		t.Fatalf("%d TUN reads for %d packets", reads, len(out))
+	}
+}
+
+// BenchmarkTUNBatch compares moving one packet per TUN call with batching.
+// The fake device's calls cost nothing, so reads/packet and writes/packet
+// show the syscalls batching saves on a real one.
+func BenchmarkTUNBatch(b *testing.B) {
+	for i, batch := range []int{1, 32} {
+		b.Run(fmt.Sprintf("send/batch=%d", batch), func(b *testing.B) {
+			node, dev, clientIP := batchedClient(b, fmt.Sprintf("10.87.%d.0/24", i), batch)
+			packet := udpPacket(clientIP, remoteAddr, 1)
+			reads := dev.reads.Load()
+			b.SetBytes(int64(len(packet)))
+			b.ResetTimer()
+
+			go func() {
+				for range b.N {
+					dev.Inject(packet)
+				}
+			}()
+			for range b.N {
+				node.readTUN(b)
+			}
+			b.ReportMetric(float64(dev.reads.Load()-reads)/float64(b.N), "reads/packet")
+		})
+
+		b.Run(fmt.Sprintf("receive/batch=%d", batch), func(b *testing.B) {
+			node, dev, clientIP := batchedClient(b, fmt.Sprintf("10.88.%d.0/24", i), batch)
+			packet := udpPacket(remoteAddr, clientIP, 1)
+			writes := dev.writes.Load()
+			b.SetBytes(int64(len(packet)))
+			b.ResetTimer()
+
+			go func() {
+				for range b.N {
+					node.dev.Inject(packet)
+				}
+			}()
+			for range b.N {
+				readWritten(b, dev.Device)
+			}
+			b.ReportMetric(float64(dev.writes.Load()-writes)/float64(b.N), "writes/packet")
+		})
+	}
+}
+
+func TestMultiPacketTUN(t *testing.T) {
+	node := startNode(t, "loopback", "10.89.0.0/24")
+	dev := newTestDevice(t)
+	dev.SetMultiPacket(true)
+	runClient(t, NewClient(testConfig(t, node.upstream()), dev))
+	clientIP := dev.waitAssigned(t)
+
+	// Back-to-back packets in a read reach the node one by one, and packets
+	// coalesced into a write split back out
+	var out, in [][]byte
+	for i := range 3 {
+		out = append(out, udpPacket(clientIP, remoteAddr, uint16(i)))
+		in = append(in, udpPacket(remoteAddr, clientIP, uint16(100+i)))
+	}
+	for _, packet := range out {
+		dev.Inject(packet)
+	}
+	for _, packet := range in {
+		node.dev.Inject(packet)
+	}
+	for i, want := range out {
+		if got := node.readTUN(t); !bytes.Equal(got, want) {
+			t.Fatalf("node TUN packet %d: got %x, want %x", i, got, want)
+		}
+	}
+	for i, want := range in {
+		if got := readWritten(t, dev.Device); !bytes.Equal(got, want) {
+			t.Fatalf("client TUN packet %d: got %x, want %x", i, got, want)
+		}
+	}
+}
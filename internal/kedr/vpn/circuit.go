@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// wrap onion-encrypts an IP packet for the circuit.
+// The innermost layer is sealed for the exit node; each outer layer is sealed
+// for the previous node and names the next one in NextHop.
+// The outermost ciphertext is written into dst, using the session keys when
+// session mode was negotiated with the entry node. flags are set on the
+// innermost layer, the one the exit node acts on.
+func (c *Client) wrap(flags uint32, packet, dst []byte) (*msg.RawMsg, error) {
+	last := len(c.circuit.Nodes) - 1
+
+	layerDst := dst
+	if last > 0 {
+		layerDst = nil
+	}
+	rawMsg, err := c.seal(last, &msg.Msg{
+		Flags:     flags,
+		Timestamp: time.Now().Unix(),
+		Data:      packet,
+	}, layerDst)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := last - 1; i >= 0; i-- {
+		inner, err := binary.Marshal(rawMsg)
+		if err != nil {
+			return nil, fmt.Errorf("marshal layer %d: %w", i+1, err)
+		}
+
+		layerDst = nil
+		if i == 0 {
+			layerDst = dst
+		}
+
+		next := c.circuit.Nodes[i+1]
+		rawMsg, err = c.seal(i, &msg.Msg{
+			Timestamp: time.Now().Unix(),
+			NextHop: &msg.NextHop{
+				PublicKey: next.PublicKey,
+				Protocol:  next.Protocol,
+				Endpoint:  next.Endpoint,
+			},
+			Data: inner,
+		}, layerDst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rawMsg, nil
+}
+
+// seal encrypts one onion layer for circuit node i
+func (c *Client) seal(i int, m *msg.Msg, dst []byte) (*msg.RawMsg, error) {
+	if i == 0 && c.session != nil {
+		return c.session.EncryptMsg(m, dst)
+	}
+	return c.encoders[i].EncryptMsg(m, dst)
+}
@@ -0,0 +1,75 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// remoteAddr stands in for a host on the internet (TEST-NET-2)
+var remoteAddr = netip.MustParseAddr("198.51.100.1")
+
+func TestCircuitThroughTwoNodes(t *testing.T) {
+	entry := startNode(t, "loopback", "10.78.0.0/24")
+	exit := startNode(t, "udp", "10.79.0.0/24")
+
+	dev := newTestDevice(t)
+	cfg := testConfig(t, entry.upstream())
+	cfg.Hops = append(cfg.Hops, exit.hop())
+	runClient(t, NewClient(cfg, dev))
+	clientIP := dev.waitAssigned(t)
+
+	// Outbound: the packet leaves at the exit node, from the address the exit
+	// leased the entry's relay link
+	dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+	out := exit.readTUN(t)
+	hdr, err := netpkt.Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayIP := hdr.Src
+	if !netip.MustParsePrefix("10.79.0.0/24").Contains(relayIP) {
+		t.Fatalf("exit wrote source %s, want a lease from the exit's pool", relayIP)
+	}
+	if hdr.Dst != remoteAddr || binary.BigEndian.Uint16(out[4:]) != 1 {
+		t.Fatalf("exit wrote packet to %s, want the client's packet to %s", hdr.Dst, remoteAddr)
+	}
+	if err := netpkt.Verify(out); err != nil {
+		t.Fatalf("translated packet: %v", err)
+	}
+	if got := entry.handler.Relays(); got != 1 {
+		t.Fatalf("entry has %d relay links, want 1", got)
+	}
+
+	// A second packet reuses the link
+	dev.Inject(udpPacket(clientIP, remoteAddr, 2))
+	if hdr, err = netpkt.Parse(exit.readTUN(t)); err != nil || hdr.Src != relayIP {
+		t.Fatalf("second packet left from %s (%v), want %s", hdr.Src, err, relayIP)
+	}
+	if got := entry.handler.Relays(); got != 1 {
+		t.Fatalf("entry has %d relay links after reuse, want 1", got)
+	}
+
+	// Return: a reply to the relay's lease comes back to the client's address
+	exit.dev.Inject(udpPacket(remoteAddr, relayIP, 10))
+	reply := readWritten(t, dev.Device)
+	if hdr, err = netpkt.Parse(reply); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Src != remoteAddr || hdr.Dst != clientIP {
+		t.Fatalf("client got %s -> %s, want %s -> %s", hdr.Src, hdr.Dst, remoteAddr, clientIP)
+	}
+	if id := binary.BigEndian.Uint16(reply[4:]); id != 10 {
+		t.Fatalf("client got packet %d, want 10", id)
+	}
+
+	// Nothing left the circuit early at the entry node
+	select {
+	case packet := <-entry.dev.Written:
+		t.Fatalf("entry wrote %d bytes to its TUN", len(packet))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
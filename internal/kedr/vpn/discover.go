@@ -0,0 +1,90 @@
+package vpn
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/discovery"
+	"seras-protocol/internal/transport/client/tcp"
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/client/v2ray"
+	"seras-protocol/internal/transport/client/wss"
+)
+
+// SetHostRouter sets how addresses found by node discovery are kept off the
+// tunnel (in TUN mode, a host route via the original gateway)
+func (c *Client) SetHostRouter(route func(ip string) error) {
+	c.hostRouter = route
+}
+
+// transportConfigs returns the configs to try, in order, for upstream up:
+// one per address discovery resolves its endpoint to, or its own config when
+// discovery is off. Resolving again on each connect picks up node moves.
+func (c *Client) transportConfigs(ctx context.Context, up config.Upstream) ([]config.TransportConfig, error) {
+	if c.discovery == nil {
+		return []config.TransportConfig{up.TransportConfig}, nil
+	}
+
+	hostport, err := discovery.HostPort(up.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := c.discovery.Resolve(ctx, hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]config.TransportConfig, 0, len(targets))
+	for _, target := range targets {
+		// Host routes are IPv4 only, as AddHostRoute is
+		if target.Addr.Addr().Is4() {
+			c.routeHost(target.Addr.Addr().String())
+		}
+
+		switch base := up.TransportConfig.(type) {
+		case *wss.Config:
+			cfg := *base
+			// An SRV target replaces the URL host so TLS checks its name
+			if u, err := url.Parse(base.Url); err == nil && u.Hostname() != target.Host {
+				u.Host = net.JoinHostPort(target.Host, strconv.Itoa(int(target.Addr.Port())))
+				cfg.Url = u.String()
+			}
+			cfg.DialAddr = target.Addr.String()
+			configs = append(configs, &cfg)
+		case *udp.Config:
+			cfg := *base
+			cfg.Addr = target.Addr.String()
+			configs = append(configs, &cfg)
+		case *v2ray.Config:
+			cfg := *base
+			cfg.DialAddr = target.Addr.String()
+			configs = append(configs, &cfg)
+		case *tcp.Config:
+			cfg := *base
+			cfg.Addr = target.Addr.String()
+			configs = append(configs, &cfg)
+		}
+	}
+	return configs, nil
+}
+
+// routeHost keeps ip off the tunnel, once per address
+func (c *Client) routeHost(ip string) {
+	if c.hostRouter == nil {
+		return
+	}
+	c.routedMu.Lock()
+	defer c.routedMu.Unlock()
+	if c.routed[ip] {
+		return
+	}
+	if err := c.hostRouter(ip); err != nil {
+		slog.Warn("Failed to route discovered node address", "ip", ip, "error", err)
+		return
+	}
+	c.routed[ip] = true
+}
@@ -0,0 +1,238 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// HandshakeState is how far a handshake with the entry node has got
+type HandshakeState int32
+
+const (
+	HandshakeNone        HandshakeState = iota // No handshake attempted yet
+	HandshakeInit                              // Building and sealing the handshake
+	HandshakeSent                              // Handshake being written to the transport
+	HandshakeAwaitingAck                       // Handshake sent, waiting for the node's ack
+	HandshakeEstablished                       // Ack verified; the session is up
+	HandshakeFailed                            // Gave up; the transport must be rebuilt
+)
+
+var handshakeStateNames = [...]string{"none", "init", "sent", "awaiting_ack", "established", "failed"}
+
+func (s HandshakeState) String() string {
+	if s < 0 || int(s) >= len(handshakeStateNames) {
+		return fmt.Sprintf("HandshakeState(%d)", int32(s))
+	}
+	return handshakeStateNames[s]
+}
+
+// MarshalText reports the state by name in stats JSON
+func (s HandshakeState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// terminal reports whether the machine stops in s
+func (s HandshakeState) terminal() bool {
+	return s == HandshakeEstablished || s == HandshakeFailed
+}
+
+// handshakeMachine drives one handshake attempt over a transport:
+// Init → Sent → AwaitingAck → Established, or Failed from any of them.
+// Each step does one state's work and moves on, so new stages such as
+// version negotiation or mutual auth slot in as states of their own.
+type handshakeMachine struct {
+	state     HandshakeState
+	decoder   *msg.Decoder
+	encoder   *msg.Encoder
+	transport client.Client
+	hello     *msg.Handshake
+	sent      *msg.RawMsg // Sealed hello, whose header the ack is bound to
+	data      []byte      // Marshalled hello
+	ack       *msg.HandshakeAck
+	err       error
+	// onTransition is called on every state change
+	onTransition func(from, to HandshakeState)
+}
+
+func newHandshakeMachine(transport client.Client, encoder *msg.Encoder, decoder *msg.Decoder, hello *msg.Handshake) *handshakeMachine {
+	return &handshakeMachine{
+		decoder:   decoder,
+		encoder:   encoder,
+		transport: transport,
+		hello:     hello,
+	}
+}
+
+func (m *handshakeMachine) to(next HandshakeState) {
+	prev := m.state
+	m.state = next
+	if m.onTransition != nil {
+		m.onTransition(prev, next)
+	}
+}
+
+// fail moves to Failed, keeping the first error
+func (m *handshakeMachine) fail(err error) {
+	if m.err == nil {
+		m.err = err
+	}
+	m.to(HandshakeFailed)
+}
+
+// run steps the machine until it stops, returning the verified ack
+func (m *handshakeMachine) run() (*msg.HandshakeAck, error) {
+	if m.state == HandshakeNone {
+		m.to(HandshakeInit)
+	}
+	for !m.state.terminal() {
+		m.step()
+	}
+	return m.ack, m.err
+}
+
+// step does the current state's work and transitions
+func (m *handshakeMachine) step() {
+	switch m.state {
+	case HandshakeInit:
+		if err := m.seal(); err != nil {
+			m.fail(err)
+			return
+		}
+		m.to(HandshakeSent)
+	case HandshakeSent:
+		if err := m.transport.Send(m.data); err != nil {
+			m.fail(fmt.Errorf("send handshake: %w", err))
+			return
+		}
+		m.to(HandshakeAwaitingAck)
+	case HandshakeAwaitingAck:
+		ack, err := m.receiveAck()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.ack = ack
+		m.to(HandshakeEstablished)
+	default:
+		m.fail(fmt.Errorf("handshake stepped in state %s", m.state))
+	}
+}
+
+// seal encrypts the hello for the entry node and marshals it
+func (m *handshakeMachine) seal() error {
+	rawMsg, err := m.encoder.EncryptHandshake(m.hello, m.decoder.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("encrypt handshake: %w", err)
+	}
+	data, err := binary.Marshal(rawMsg)
+	if err != nil {
+		return fmt.Errorf("marshal handshake: %w", err)
+	}
+	m.sent, m.data = rawMsg, data
+	return nil
+}
+
+// receiveAck waits for the ack, checks the node produced it and accepted us,
+// and pins the protocol version it picked
+func (m *handshakeMachine) receiveAck() (*msg.HandshakeAck, error) {
+	ackData, err := m.transport.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("receive ack: %w", err)
+	}
+
+	ackRaw, err := msg.Decode(ackData)
+	if err != nil {
+		return nil, fmt.Errorf("decode ack: %w", err)
+	}
+	if ackRaw.Header.Type != msg.TypeHandshakeAck {
+		return nil, fmt.Errorf("expected handshake ack, got type %d", ackRaw.Header.Type)
+	}
+
+	ack, err := m.decoder.DecryptHandshakeAck(ackRaw)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt ack: %w", err)
+	}
+
+	// Don't trust the ack, even a rejection, unless the node key produced it
+	if err := m.decoder.VerifyHandshakeAck(m.sent.Header, m.encoder.NodePublicKey, ack); err != nil {
+		return nil, fmt.Errorf("verify ack: %w", err)
+	}
+	if !ack.Success {
+		return nil, fmt.Errorf("handshake rejected: %s", ack.Message)
+	}
+
+	// Record the version and suite the session speaks; an older node selects none
+	if ack.Version, err = ack.PinVersion(m.sent.Header, m.hello.Versions); err != nil {
+		return nil, err
+	}
+	if ack.Suite, err = ack.PinSuite(m.hello.Suites); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// timedOut fails the machine with ErrHandshakeTimeout once run has returned
+// after the transport was torn down under it
+func (m *handshakeMachine) timedOut() {
+	m.err = ErrHandshakeTimeout
+	if m.state != HandshakeFailed {
+		m.to(HandshakeFailed)
+	}
+}
+
+// retryable reports whether a failed attempt is worth repeating on a fresh
+// transport; only a node that never answered might answer next time
+func (m *handshakeMachine) retryable() bool {
+	return m.state == HandshakeFailed && errors.Is(m.err, ErrHandshakeTimeout)
+}
+
+// newHandshake builds a machine for one attempt, reporting its state in Stats
+func (c *Client) newHandshake(transport client.Client, encoder *msg.Encoder) *handshakeMachine {
+	hello := &msg.Handshake{
+		ClientPublicKey: c.clientPubKey,
+		Session:         c.sessionMode,
+		Timestamp:       time.Now().Unix(),
+		Versions:        msg.SupportedVersions,
+		Suites:          c.suites,
+	}
+	m := newHandshakeMachine(transport, encoder, c.decoder, hello)
+	m.onTransition = func(from, to HandshakeState) {
+		c.stats.handshakeState.Store(int32(to))
+		slog.Debug("Handshake state", "from", from, "to", to)
+	}
+	return m
+}
+
+// runHandshake runs m, giving up after the handshake timeout. On timeout the
+// transport is disconnected to unblock it and must be rebuilt.
+func (c *Client) runHandshake(ctx context.Context, m *handshakeMachine) (*msg.HandshakeAck, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.handshakeTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.run()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return m.ack, m.err
+	case <-ctx.Done():
+		// Unblock the pending Send/Receive
+		m.transport.Disconnect()
+		<-done
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			m.timedOut()
+			return nil, m.err
+		}
+		return nil, ctx.Err()
+	}
+}
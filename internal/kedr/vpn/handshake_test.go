@@ -0,0 +1,424 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// silentTransport accepts sends and never receives anything, as a WSS
+// connection to a node that has stopped answering does
+type silentTransport struct {
+	sendErr error // Returned by every send, as a broken connection would
+	sent    atomic.Int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSilentTransport() *silentTransport {
+	return &silentTransport{closed: make(chan struct{})}
+}
+
+func (s *silentTransport) Disconnect() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *silentTransport) Send(data []byte) error {
+	return s.SendContext(context.Background(), data)
+}
+
+func (s *silentTransport) Receive() ([]byte, error) {
+	return s.ReceiveContext(context.Background())
+}
+
+func (s *silentTransport) SendContext(ctx context.Context, data []byte) error {
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.sent.Add(1)
+	return nil
+}
+
+func (s *silentTransport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case <-s.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// offlineNode returns a node with a valid key and no server behind it
+func offlineNode(t *testing.T) *testNode {
+	t.Helper()
+	_, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testNode{publicKey: publicKey, transport: "loopback", endpoint: t.Name()}
+}
+
+// handshakeClient returns a client for node that is never run, for driving
+// handshakes by hand
+func handshakeClient(t *testing.T, node *testNode, retries int) *Client {
+	t.Helper()
+	cfg := testConfig(t, node.upstream())
+	cfg.HandshakeTimeout = 50 * time.Millisecond
+	cfg.HandshakeRetries = retries
+	return NewClient(cfg, newTestDevice(t))
+}
+
+func TestHandshakeTimesOutOnSilentNode(t *testing.T) {
+	c := handshakeClient(t, offlineNode(t), 1)
+	transport := newSilentTransport()
+	m := c.newHandshake(transport, c.upstreamEncs[0])
+
+	start := time.Now()
+	_, err := c.runHandshake(context.Background(), m)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("got %v, want ErrHandshakeTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > testTimeout/2 {
+		t.Fatalf("gave up after %v, want about the 50ms timeout", elapsed)
+	}
+	if transport.sent.Load() != 1 {
+		t.Fatalf("sent %d handshakes, want 1", transport.sent.Load())
+	}
+	select {
+	case <-transport.closed:
+	default:
+		t.Fatal("timed-out transport left connected")
+	}
+	if !m.retryable() || c.Stats().HandshakeState != HandshakeFailed {
+		t.Fatalf("state %s, retryable %v; want a retryable failure", m.state, m.retryable())
+	}
+}
+
+func TestHandshakeFailsFastOnBrokenTransport(t *testing.T) {
+	c := handshakeClient(t, offlineNode(t), 3)
+	transport := newSilentTransport()
+	transport.sendErr = errors.New("broken pipe")
+	m := c.newHandshake(transport, c.upstreamEncs[0])
+
+	_, err := c.runHandshake(context.Background(), m)
+	if err == nil || errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("got %v, want the send error", err)
+	}
+	// A dead transport is rebuilt by reconnecting, not retried in place
+	if m.retryable() {
+		t.Fatal("send failure marked retryable")
+	}
+}
+
+func TestHandshakeStopsOnCancel(t *testing.T) {
+	c := handshakeClient(t, offlineNode(t), 1)
+	c.handshakeTimeout = testTimeout
+	m := c.newHandshake(newSilentTransport(), c.upstreamEncs[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c.runHandshake(ctx, m); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestHandshakeRetriesOnFreshTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		ok      bool
+	}{
+		{"answered on the second try", 2, true},
+		{"out of retries", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := startNode(t, "loopback", "10.84.0.0/24")
+			node.ignore.Store(1) // The first handshake goes unanswered
+			c := handshakeClient(t, node, tt.retries)
+			cand, err := c.dialTransport(context.Background(), 0, node.upstream().TransportConfig)
+			if got := node.received.Load(); got != int32(tt.retries) {
+				t.Fatalf("node got %d handshakes, want %d", got, tt.retries)
+			}
+			if !tt.ok {
+				if !errors.Is(err, ErrHandshakeTimeout) {
+					t.Fatalf("got %v, want ErrHandshakeTimeout", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cand.transport.Disconnect()
+			if cand.ack.AssignedIP == "" {
+				t.Fatal("ack without an address")
+			}
+		})
+	}
+}
+
+// forgingTransport answers every handshake with an ack that accepts the
+// client, confirmed with key instead of the node's, as a man in the middle
+// that knows the client's public key could
+type forgingTransport struct {
+	*silentTransport
+	t         *testing.T
+	key       msg.Key // Forger's private key
+	clientKey msg.Key
+	acks      chan []byte
+}
+
+func (f *forgingTransport) Send(data []byte) error {
+	rawHs, err := msg.Decode(data)
+	if err != nil {
+		f.t.Error(err)
+		return err
+	}
+	ack := &msg.HandshakeAck{Success: true, Message: "ok", AssignedIP: "10.85.0.2"}
+	if err := msg.NewDecoder(f.key).ConfirmHandshake(rawHs.Header, f.clientKey, ack); err != nil {
+		f.t.Error(err)
+		return err
+	}
+	rawAck, err := msg.NewEncoder(f.clientKey).EncryptHandshakeAck(ack)
+	if err != nil {
+		f.t.Error(err)
+		return err
+	}
+	ackData, err := kbinary.Marshal(rawAck)
+	if err != nil {
+		f.t.Error(err)
+		return err
+	}
+	f.acks <- ackData
+	return nil
+}
+
+func (f *forgingTransport) SendContext(ctx context.Context, data []byte) error {
+	return f.Send(data)
+}
+
+func (f *forgingTransport) Receive() ([]byte, error) {
+	return f.ReceiveContext(context.Background())
+}
+
+func (f *forgingTransport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-f.acks:
+		return data, nil
+	case <-f.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestHandshakeRejectsAckFromWrongNodeKey(t *testing.T) {
+	c := handshakeClient(t, offlineNode(t), 1)
+	c.handshakeTimeout = testTimeout
+	forger, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &forgingTransport{
+		silentTransport: newSilentTransport(),
+		t:               t,
+		key:             forger,
+		clientKey:       c.clientPubKey,
+		acks:            make(chan []byte, 1),
+	}
+	m := c.newHandshake(transport, c.upstreamEncs[0])
+
+	ack, err := c.runHandshake(context.Background(), m)
+	if !errors.Is(err, msg.ErrNodeNotConfirmed) {
+		t.Fatalf("got %+v, %v; want ErrNodeNotConfirmed", ack, err)
+	}
+	if m.retryable() || c.Stats().HandshakeState != HandshakeFailed {
+		t.Fatalf("state %s, retryable %v; want a final failure", m.state, m.retryable())
+	}
+}
+
+// replyTransport answers each handshake with what reply builds from it; a
+// nil reply closes the transport instead
+type replyTransport struct {
+	*silentTransport
+	reply   func(data []byte) []byte
+	replies chan []byte
+}
+
+func newReplyTransport(reply func(data []byte) []byte) *replyTransport {
+	return &replyTransport{silentTransport: newSilentTransport(), reply: reply, replies: make(chan []byte, 1)}
+}
+
+func (r *replyTransport) Send(data []byte) error {
+	if err := r.silentTransport.Send(data); err != nil {
+		return err
+	}
+	if reply := r.reply(data); reply != nil {
+		r.replies <- reply
+	} else {
+		r.Disconnect()
+	}
+	return nil
+}
+
+func (r *replyTransport) Receive() ([]byte, error) {
+	select {
+	case data := <-r.replies:
+		return data, nil
+	case <-r.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// signedAck returns ack as node answers the handshake in data, confirmed
+// with nodeKey and sealed for clientKey
+func signedAck(t *testing.T, data []byte, nodeKey, clientKey msg.Key, ack *msg.HandshakeAck) []byte {
+	t.Helper()
+	rawHs, err := msg.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.NewDecoder(nodeKey).ConfirmHandshake(rawHs.Header, clientKey, ack); err != nil {
+		t.Fatal(err)
+	}
+	rawAck, err := msg.NewEncoder(clientKey).EncryptHandshakeAck(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ackData, err := kbinary.Marshal(rawAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ackData
+}
+
+func TestHandshakeTransitions(t *testing.T) {
+	nodeKey, nodePublic, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &testNode{publicKey: nodePublic, transport: "loopback", endpoint: t.Name()}
+	failed := []HandshakeState{HandshakeInit, HandshakeSent, HandshakeAwaitingAck, HandshakeFailed}
+
+	tests := []struct {
+		name    string
+		reply   func(t *testing.T, c *Client, data []byte) []byte
+		sendErr error
+		badKey  bool // Seal for a node key no handshake can be sealed to
+		want    []HandshakeState
+		wantErr string
+	}{
+		{"established", func(t *testing.T, c *Client, data []byte) []byte {
+			return signedAck(t, data, nodeKey, c.clientPubKey, &msg.HandshakeAck{Success: true, AssignedIP: "10.85.0.2"})
+		}, nil, false, []HandshakeState{HandshakeInit, HandshakeSent, HandshakeAwaitingAck, HandshakeEstablished}, ""},
+		{"rejected by the node", func(t *testing.T, c *Client, data []byte) []byte {
+			return signedAck(t, data, nodeKey, c.clientPubKey, &msg.HandshakeAck{Message: "not allowed"})
+		}, nil, false, failed, "handshake rejected: not allowed"},
+		{"answered with the handshake", func(t *testing.T, c *Client, data []byte) []byte {
+			return data
+		}, nil, false, failed, "expected handshake ack"},
+		{"answered with garbage", func(t *testing.T, c *Client, data []byte) []byte {
+			return []byte("garbage")
+		}, nil, false, failed, "decode ack"},
+		{"closed before the ack", func(t *testing.T, c *Client, data []byte) []byte {
+			return nil
+		}, nil, false, failed, "receive ack"},
+		{"send fails", nil, errors.New("broken pipe"), false,
+			[]HandshakeState{HandshakeInit, HandshakeSent, HandshakeFailed}, "send handshake"},
+		{"seal fails", nil, nil, true,
+			[]HandshakeState{HandshakeInit, HandshakeFailed}, "encrypt handshake"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := handshakeClient(t, node, 1)
+			c.handshakeTimeout = testTimeout
+			transport := newReplyTransport(func(data []byte) []byte {
+				return tt.reply(t, c, data)
+			})
+			transport.sendErr = tt.sendErr
+			encoder := c.upstreamEncs[0]
+			if tt.badKey {
+				encoder = msg.NewEncoder(msg.Key{})
+			}
+
+			m := c.newHandshake(transport, encoder)
+			var got []HandshakeState
+			report := m.onTransition
+			m.onTransition = func(from, to HandshakeState) {
+				if len(got) > 0 && got[len(got)-1] != from || len(got) == 0 && from != HandshakeNone {
+					t.Errorf("moved from %s, but the machine was in %v", from, got)
+				}
+				got = append(got, to)
+				report(from, to)
+			}
+			if c.Stats().HandshakeState != HandshakeNone {
+				t.Fatalf("state %s before any handshake", c.Stats().HandshakeState)
+			}
+
+			ack, err := c.runHandshake(context.Background(), m)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("went through %v, want %v", got, tt.want)
+			}
+			if c.Stats().HandshakeState != tt.want[len(tt.want)-1] {
+				t.Fatalf("Stats() reports %s, want %s", c.Stats().HandshakeState, tt.want[len(tt.want)-1])
+			}
+			if tt.wantErr == "" {
+				if err != nil || ack == nil || ack.AssignedIP != "10.85.0.2" {
+					t.Fatalf("got %+v, %v; want the ack", ack, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+			// Only a node that never answered is worth another try
+			if m.retryable() {
+				t.Fatal("failure marked retryable")
+			}
+		})
+	}
+}
+
+func TestHandshakeMachineStopsInTerminalStates(t *testing.T) {
+	c := handshakeClient(t, offlineNode(t), 1)
+	m := c.newHandshake(newSilentTransport(), c.upstreamEncs[0])
+	m.state = HandshakeEstablished
+	m.step()
+	if m.state != HandshakeFailed || m.err == nil {
+		t.Fatalf("stepping an established machine left it %s, %v", m.state, m.err)
+	}
+
+	// A timeout after the machine failed on its own keeps it failed once
+	transitions := 0
+	m.onTransition = func(from, to HandshakeState) { transitions++ }
+	m.timedOut()
+	if !errors.Is(m.err, ErrHandshakeTimeout) || transitions != 0 || !m.retryable() {
+		t.Fatalf("timed out as %v with %d transitions, retryable %v", m.err, transitions, m.retryable())
+	}
+}
+
+func TestHandshakeStateNames(t *testing.T) {
+	tests := map[HandshakeState]string{
+		HandshakeNone:        "none",
+		HandshakeAwaitingAck: "awaiting_ack",
+		HandshakeFailed:      "failed",
+		HandshakeState(42):   "HandshakeState(42)",
+	}
+	for state, want := range tests {
+		text, err := state.MarshalText()
+		if err != nil || string(text) != want || state.String() != want {
+			t.Errorf("state %d named %q, %q, want %q", int32(state), text, state.String(), want)
+		}
+	}
+}
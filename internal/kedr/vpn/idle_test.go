@@ -0,0 +1,122 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// timingOutTransport times out a set number of receives, as an idle UDP
+// socket does, then fails them as a closed one does
+type timingOutTransport struct {
+	*silentTransport
+	timeouts int32
+	receives atomic.Int32
+}
+
+func (s *timingOutTransport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	if s.receives.Add(1) <= s.timeouts {
+		return nil, fmt.Errorf("%w (%s)", udp.ErrReadTimeout, time.Millisecond)
+	}
+	return nil, fmt.Errorf("failed to read UDP: %w", net.ErrClosed)
+}
+
+func TestReceiveLoopReadTimeouts(t *testing.T) {
+	tests := []struct {
+		name         string
+		keepalive    time.Duration
+		wantReceives int32
+		wantErr      error
+	}{
+		{"keepalive rides them out", time.Second, 4, net.ErrClosed},
+		{"no keepalive ends the session", 0, 1, udp.ErrReadTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(testConfig(t), newTestDevice(t))
+			c.keepalive = tt.keepalive
+			transport := &timingOutTransport{silentTransport: newSilentTransport(), timeouts: 3}
+			errChan := make(chan error, 1)
+
+			done := make(chan struct{})
+			go func() {
+				c.receiveLoop(context.Background(), transport, msg.NewReplayWindow(), nil, errChan)
+				close(done)
+			}()
+			select {
+			case err := <-errChan:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("session ended with %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("receive loop never ended the session")
+			}
+			<-done
+			if n := transport.receives.Load(); n != tt.wantReceives {
+				t.Fatalf("received %d times, want %d", n, tt.wantReceives)
+			}
+		})
+	}
+}
+
+func TestIdleUDPTunnel(t *testing.T) {
+	const readTimeout = 50 * time.Millisecond
+	tests := []struct {
+		name      string
+		keepalive time.Duration
+		rebuilt   bool
+	}{
+		{"keepalive", readTimeout / 3, false},
+		{"no keepalive", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := startNode(t, "udp", "10.80.0.0/24")
+			up := node.upstream()
+			up.TransportConfig = &udp.Config{Addr: node.endpoint, ReadTimeout: readTimeout}
+			dev := newTestDevice(t)
+			cfg := testConfig(t, up)
+			cfg.Keepalive = tt.keepalive
+			cfg.ReconnectEnabled = true
+			c := NewClient(cfg, dev)
+			runClient(t, c)
+			clientIP := dev.waitAssigned(t)
+
+			// The node sends nothing while the client idles through several
+			// read timeouts. A rebuild waits out the reconnect backoff.
+			wait := 10 * readTimeout
+			if tt.rebuilt {
+				wait = testTimeout
+			}
+			select {
+			case <-dev.assigned:
+				if !tt.rebuilt {
+					t.Fatal("idle session rebuilt despite keepalives")
+				}
+			case <-time.After(wait):
+				if tt.rebuilt {
+					t.Fatal("idle session kept without keepalives")
+				}
+			}
+			if tt.rebuilt {
+				return
+			}
+			if s := c.Stats(); s.Reconnects != 0 || s.KeepalivesSent == 0 {
+				t.Fatalf("%d reconnects and %d keepalives while idle; want none and some", s.Reconnects, s.KeepalivesSent)
+			}
+
+			// The session still carries traffic both ways
+			dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+			node.readTUN(t)
+			node.dev.Inject(udpPacket(remoteAddr, clientIP, 2))
+			readWritten(t, dev.Device)
+		})
+	}
+}
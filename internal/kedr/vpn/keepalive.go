@@ -0,0 +1,66 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// keepaliveLoop sends the entry node a keepalive whenever nothing was sent
+// for the keepalive interval, so NAT and firewall mappings along a UDP path
+// stay open while the tunnel is idle. Traffic postpones it.
+func (c *Client) keepaliveLoop(ctx context.Context, transport client.Client, errChan chan<- error) {
+	timer := time.NewTimer(c.keepalive)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, c.stats.lastSend.Load()))
+		if idle < c.keepalive {
+			timer.Reset(c.keepalive - idle)
+			continue
+		}
+		if err := c.sendKeepalive(transport); err != nil {
+			errChan <- err
+			return
+		}
+		timer.Reset(c.keepalive)
+	}
+}
+
+// sendKeepalive sends an empty message flagged FlagKeepalive, sealed for the
+// entry node alone since only the first hop's mapping needs refreshing
+func (c *Client) sendKeepalive(transport client.Client) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := c.rekeyIfDue(transport); err != nil {
+		return fmt.Errorf("rekey error: %w", err)
+	}
+	rawMsg, err := c.seal(0, &msg.Msg{Flags: msg.FlagKeepalive, Timestamp: time.Now().Unix()}, nil)
+	if err != nil {
+		slog.Error("failed to encrypt keepalive", "error", err)
+		return nil
+	}
+	data, err := binary.Marshal(rawMsg)
+	if err != nil {
+		slog.Error("failed to marshal keepalive", "error", err)
+		return nil
+	}
+	if err := transport.Send(data); err != nil {
+		return fmt.Errorf("transport send error: %w", err)
+	}
+	c.stats.lastSend.Store(time.Now().UnixNano())
+	c.stats.keepalives.Add(1)
+	return nil
+}
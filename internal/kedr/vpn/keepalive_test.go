@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepalivesOnlyWhileIdle(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	node := startNode(t, "loopback", "10.80.0.0/24")
+	dev := newTestDevice(t)
+	cfg := testConfig(t, node.upstream())
+	cfg.Keepalive = interval
+	c := NewClient(cfg, dev)
+	runClient(t, c)
+	clientIP := dev.waitAssigned(t)
+
+	// Idle: a keepalive per interval reaches the node, which drops it
+	idle := waitStats(t, c, func(s Stats) bool { return s.KeepalivesSent >= 3 })
+	if idle.PacketsSent != 0 {
+		t.Fatalf("keepalives counted as packets: %+v", idle)
+	}
+	select {
+	case packet := <-node.dev.Written:
+		t.Fatalf("node wrote a keepalive to its TUN: %x", packet)
+	case <-time.After(interval):
+	}
+	// Each one arrived, after the handshake
+	deadline := time.Now().Add(testTimeout)
+	for node.received.Load() < 1+int32(idle.KeepalivesSent) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node got %d messages for a handshake and %d keepalives", node.received.Load(), idle.KeepalivesSent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Active: traffic more often than the interval keeps the keepalives
+	// back, counting from once the first packet is through, since a
+	// keepalive may have been on its way as the traffic began
+	var before uint64
+	for i := range 30 {
+		dev.Inject(udpPacket(clientIP, remoteAddr, uint16(i)))
+		node.readTUN(t)
+		if i == 0 {
+			before = c.Stats().KeepalivesSent
+		}
+		time.Sleep(interval / 5)
+	}
+	if sent := c.Stats().KeepalivesSent - before; sent != 0 {
+		t.Fatalf("%d keepalives sent during traffic", sent)
+	}
+
+	// They resume once traffic stops
+	waitStats(t, c, func(s Stats) bool { return s.KeepalivesSent > before })
+}
+
+func TestKeepaliveDisabled(t *testing.T) {
+	node := startNode(t, "loopback", "10.80.0.0/24")
+	dev := newTestDevice(t)
+	c := NewClient(testConfig(t, node.upstream()), dev)
+	runClient(t, c)
+	dev.waitAssigned(t)
+
+	time.Sleep(200 * time.Millisecond)
+	if s := c.Stats(); s.KeepalivesSent != 0 {
+		t.Fatalf("%d keepalives sent with Keepalive 0", s.KeepalivesSent)
+	}
+}
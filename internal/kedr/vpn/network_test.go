@@ -0,0 +1,120 @@
+package vpn
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"seras-protocol/internal/tun"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// networkDevice is a test device whose MTU and DNS servers can be set,
+// counting how often they are
+type networkDevice struct {
+	*testDevice
+	mu      sync.Mutex
+	mtu     int
+	dns     []string
+	mtuSets int
+	dnsSets int
+}
+
+func newNetworkDevice(t testing.TB, mtu int, dns ...string) *networkDevice {
+	return &networkDevice{testDevice: newTestDevice(t), mtu: mtu, dns: dns}
+}
+
+func (d *networkDevice) MTU() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mtu
+}
+
+func (d *networkDevice) SetMTU(mtu int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mtu = mtu
+	d.mtuSets++
+	return nil
+}
+
+func (d *networkDevice) DNS() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.dns)
+}
+
+func (d *networkDevice) SetDNS(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dns = slices.Clone(servers)
+	d.dnsSets++
+	return nil
+}
+
+func TestNodeNetworkOverridesLocal(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtu     int
+		dns     []string
+		wantMTU int
+		wantDNS []string
+	}{
+		{"both pushed", 1280, []string{"9.9.9.9", "149.112.112.112"}, 1280, []string{"9.9.9.9", "149.112.112.112"}},
+		{"MTU only", 1280, nil, 1280, []string{"1.1.1.1"}},
+		{"DNS only", 0, []string{"9.9.9.9"}, 1200, []string{"9.9.9.9"}},
+		{"nothing pushed", 0, nil, 1200, []string{"1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := startNode(t, "loopback", "10.80.0.0/24")
+			node.handler.SetClientNetwork(tt.mtu, tt.dns)
+			dev := newNetworkDevice(t, 1200, "1.1.1.1")
+			runClient(t, NewClient(testConfig(t, node.upstream()), dev))
+			clientIP := dev.waitAssigned(t)
+			// The send loop starts once connect has applied the ack
+			dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+			node.readTUN(t)
+
+			if got := dev.MTU(); got != tt.wantMTU {
+				t.Errorf("MTU %d, want %d", got, tt.wantMTU)
+			}
+			if got := dev.DNS(); !slices.Equal(got, tt.wantDNS) {
+				t.Errorf("DNS %v, want %v", got, tt.wantDNS)
+			}
+			// Local settings the node leaves alone are never rewritten
+			dev.mu.Lock()
+			defer dev.mu.Unlock()
+			if tt.mtu == 0 && dev.mtuSets != 0 {
+				t.Errorf("MTU set %d times with none pushed", dev.mtuSets)
+			}
+			if len(tt.dns) == 0 && dev.dnsSets != 0 {
+				t.Errorf("DNS set %d times with none pushed", dev.dnsSets)
+			}
+		})
+	}
+}
+
+func TestApplyNetworkAcrossNodes(t *testing.T) {
+	dev := newNetworkDevice(t, 1200, "1.1.1.1")
+	c := NewClient(testConfig(t), dev)
+
+	// A node's recommendation above the frame limit is capped to it
+	c.applyNetwork(&msg.HandshakeAck{MTU: tun.DefaultMTU + 200, DNS: []string{"9.9.9.9"}})
+	if got := dev.MTU(); got != tun.DefaultMTU {
+		t.Fatalf("MTU %d, want the %d frame limit", got, tun.DefaultMTU)
+	}
+	if got := dev.DNS(); !slices.Equal(got, []string{"9.9.9.9"}) {
+		t.Fatalf("DNS %v, want the node's", got)
+	}
+
+	// Reconnecting to a node that recommends nothing brings the local
+	// settings back rather than keeping the last node's
+	c.applyNetwork(&msg.HandshakeAck{})
+	if got := dev.MTU(); got != 1200 {
+		t.Fatalf("MTU %d after a node recommending none, want the local 1200", got)
+	}
+	if got := dev.DNS(); !slices.Equal(got, []string{"1.1.1.1"}) {
+		t.Fatalf("DNS %v after a node recommending none, want the local servers", got)
+	}
+}
@@ -0,0 +1,53 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// backoffDelay returns an exponential delay with jitter for the given attempt (starting at 1)
+func backoffDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectBaseDelay<<(attempt-1), reconnectMaxDelay)
+	}
+	// Jitter in [delay/2, delay) so clients don't reconnect in lockstep
+	return delay/2 + rand.N(delay/2)
+}
+
+// backoff releases the failed transport and waits before the next connect attempt.
+// The TUN device and its routes are left untouched.
+func (c *Client) backoff(ctx context.Context, attempt *int, cause error) error {
+	// Unblock and release the failed transport
+	c.sendMu.Lock()
+	if c.transport != nil {
+		if err := c.transport.Disconnect(); err != nil {
+			slog.Debug("Failed to disconnect transport", "error", err)
+		}
+		c.transport = nil
+	}
+	c.sendMu.Unlock()
+
+	*attempt++
+	if c.MaxRetries > 0 && *attempt > c.MaxRetries {
+		return fmt.Errorf("giving up after %d reconnect attempts: %w", c.MaxRetries, cause)
+	}
+
+	delay := backoffDelay(*attempt)
+	slog.Warn("Connection lost, reconnecting", "error", cause, "attempt", *attempt, "delay", delay)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
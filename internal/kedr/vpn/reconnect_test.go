@@ -0,0 +1,123 @@
+package vpn
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/tun"
+)
+
+func TestBackoffDelayRange(t *testing.T) {
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, reconnectBaseDelay},
+		{2, 2 * reconnectBaseDelay},
+		{3, 4 * reconnectBaseDelay},
+		{7, reconnectMaxDelay}, // 500ms << 6 passes the cap
+		{16, reconnectMaxDelay},
+		{100, reconnectMaxDelay}, // Must not overflow the shift
+	}
+	for _, tt := range tests {
+		for range 100 {
+			d := backoffDelay(tt.attempt)
+			if d < tt.ceiling/2 || d >= tt.ceiling {
+				t.Fatalf("backoffDelay(%d) = %v, want in [%v, %v)", tt.attempt, d, tt.ceiling/2, tt.ceiling)
+			}
+		}
+	}
+}
+
+func TestRunReconnectsAfterFailedConnects(t *testing.T) {
+	const failures = 2
+	n := startNode(t, "loopback", "10.78.0.0/24")
+	// The node ignores the first handshakes, so they time out
+	n.ignore.Store(failures)
+
+	dev := newTestDevice(t)
+	cfg := testConfig(t, n.upstream())
+	cfg.ReconnectEnabled = true
+	c := NewClient(cfg, dev)
+	runErr := runClient(t, c)
+
+	select {
+	case <-dev.assigned:
+	case err := <-runErr:
+		t.Fatalf("Run returned before connecting: %v", err)
+	case <-time.After(testTimeout):
+		t.Fatal("client never connected")
+	}
+	if got := n.received.Load(); got != failures+1 {
+		t.Fatalf("node got %d handshakes, want %d", got, failures+1)
+	}
+	if s := c.Stats(); s.HandshakeTime.IsZero() {
+		t.Fatal("no handshake time recorded")
+	}
+}
+
+func TestRunGivesUpAfterMaxRetries(t *testing.T) {
+	n := startNode(t, "loopback", "10.78.0.0/24")
+	n.ignore.Store(1 << 30)
+
+	cfg := testConfig(t, n.upstream())
+	cfg.ReconnectEnabled = true
+	cfg.MaxRetries = 2
+	runErr := runClient(t, NewClient(cfg, newTestDevice(t)))
+
+	select {
+	case err := <-runErr:
+		if err == nil || !strings.Contains(err.Error(), "giving up after 2 reconnect attempts") {
+			t.Fatalf("Run returned %v, want giving up", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("client kept retrying")
+	}
+	// The first connect and each retry handshake once
+	if got := n.received.Load(); got != 3 {
+		t.Fatalf("node got %d handshakes, want 3", got)
+	}
+}
+
+func TestRunWithoutReconnectReturnsFirstError(t *testing.T) {
+	// No server is listening under this name, so the dial fails
+	n := &testNode{transport: "loopback", endpoint: t.Name()}
+	runErr := runClient(t, NewClient(testConfig(t, n.upstream()), newTestDevice(t)))
+
+	select {
+	case err := <-runErr:
+		if err == nil || !strings.Contains(err.Error(), "no upstream reachable") {
+			t.Fatalf("Run returned %v, want no upstream reachable", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("client retried with reconnect disabled")
+	}
+}
+
+func TestRunStopsWhenTUNCloses(t *testing.T) {
+	n := startNode(t, "loopback", "10.78.0.0/24")
+	dev := newTestDevice(t)
+	cfg := testConfig(t, n.upstream())
+	cfg.ReconnectEnabled = true
+	c := NewClient(cfg, dev)
+	runErr := runClient(t, c)
+	dev.waitAssigned(t)
+
+	dev.Close()
+	select {
+	case err := <-runErr:
+		if !errors.Is(err, tun.ErrClosed) {
+			t.Fatalf("Run returned %v, want ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Run kept going after the TUN closed")
+	}
+	if got := n.received.Load(); got != 1 {
+		t.Fatalf("node got %d handshakes, want 1", got)
+	}
+	if s := c.Stats(); s.Reconnects != 0 {
+		t.Fatalf("%d reconnects after the TUN closed", s.Reconnects)
+	}
+}
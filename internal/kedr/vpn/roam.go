@@ -0,0 +1,58 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"seras-protocol/internal/transport/client"
+)
+
+// roamerOf returns the roaming transport beneath any wrappers, or nil when
+// the transport can't roam
+func roamerOf(transport client.Client) client.Roamer {
+	for transport != nil {
+		if roamer, ok := transport.(client.Roamer); ok {
+			return roamer
+		}
+		wrapper, ok := transport.(interface{ Unwrap() client.Client })
+		if !ok {
+			return nil
+		}
+		transport = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// roamLoop watches for the host's route to the entry node moving to another
+// local address, as when Wi-Fi drops to mobile data, and rebinds the
+// transport so traffic resumes without a new handshake. A failed rebind ends
+// the session and leaves recovery to a reconnect.
+func (c *Client) roamLoop(ctx context.Context, transport client.Client, roamer client.Roamer, errChan chan<- error) {
+	ticker := time.NewTicker(c.roamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !roamer.Stale() {
+			continue
+		}
+		slog.Info("Local network changed, rebinding transport")
+		if err := roamer.Rebind(); err != nil {
+			errChan <- fmt.Errorf("rebind error: %w", err)
+			return
+		}
+		c.stats.rebinds.Add(1)
+		// Show the node our new address now, so its replies stop going to the old one
+		if err := c.sendKeepalive(transport); err != nil {
+			errChan <- err
+			return
+		}
+	}
+}
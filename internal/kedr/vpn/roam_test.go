@@ -0,0 +1,124 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/obfs"
+)
+
+// fakeRoamer reports a network change when told to and counts rebinds
+type fakeRoamer struct {
+	stale     atomic.Bool
+	rebinds   atomic.Int32
+	rebindErr error
+}
+
+func (r *fakeRoamer) Stale() bool {
+	return r.stale.Load()
+}
+
+func (r *fakeRoamer) Rebind() error {
+	if r.rebindErr != nil {
+		return r.rebindErr
+	}
+	r.rebinds.Add(1)
+	r.stale.Store(false)
+	return nil
+}
+
+// roamerTransport is a silent transport that can roam
+type roamerTransport struct {
+	*silentTransport
+	*fakeRoamer
+}
+
+func TestRoamerOfUnwrapsTransports(t *testing.T) {
+	roamer := &roamerTransport{newSilentTransport(), &fakeRoamer{}}
+	if roamerOf(roamer) == nil {
+		t.Fatal("roaming transport not found")
+	}
+	if roamerOf(obfs.NewClient(roamer, nil, 0)) == nil {
+		t.Fatal("roaming transport not found beneath obfuscation")
+	}
+	if roamerOf(newSilentTransport()) != nil {
+		t.Fatal("found a roamer in a transport that can't roam")
+	}
+}
+
+func TestRoamLoopRebindsAndResumes(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	node := startNode(t, "loopback", "10.80.0.0/24")
+	dev := newTestDevice(t)
+	c := NewClient(testConfig(t, node.upstream()), dev)
+	c.roamInterval = interval
+	runClient(t, c)
+	clientIP := dev.waitAssigned(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	roamer := &fakeRoamer{}
+	errChan := make(chan error, 1)
+	go c.roamLoop(ctx, c.transport, roamer, errChan)
+
+	// Nothing happens while the network stays put
+	time.Sleep(5 * interval)
+	if roamer.rebinds.Load() != 0 {
+		t.Fatal("rebound without a network change")
+	}
+
+	// A change is followed by one rebind and a keepalive showing the node
+	// the new address
+	received := node.received.Load()
+	roamer.stale.Store(true)
+	waitStats(t, c, func(s Stats) bool { return s.Rebinds == 1 && s.KeepalivesSent == 1 })
+	deadline := time.Now().Add(testTimeout)
+	for node.received.Load() == received {
+		if time.Now().After(deadline) {
+			t.Fatal("no keepalive reached the node after rebinding")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := roamer.rebinds.Load(); n != 1 {
+		t.Fatalf("rebound %d times for one change", n)
+	}
+
+	// Traffic carries on in the same session
+	dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+	node.readTUN(t)
+	select {
+	case err := <-errChan:
+		t.Fatalf("roam loop failed: %v", err)
+	default:
+	}
+}
+
+func TestRoamLoopEndsSessionOnFailedRebind(t *testing.T) {
+	c := NewClient(testConfig(t), newTestDevice(t))
+	c.roamInterval = time.Millisecond
+	roamer := &fakeRoamer{rebindErr: errors.New("network is unreachable")}
+	roamer.stale.Store(true)
+	errChan := make(chan error, 1)
+
+	done := make(chan struct{})
+	go func() {
+		c.roamLoop(context.Background(), newSilentTransport(), roamer, errChan)
+		close(done)
+	}()
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), "network is unreachable") {
+			t.Fatalf("got %v, want the rebind error", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("failed rebind never reported")
+	}
+	<-done
+	if c.Stats().Rebinds != 0 {
+		t.Fatal("failed rebind counted")
+	}
+}
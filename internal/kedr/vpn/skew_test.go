@@ -0,0 +1,81 @@
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// queuedTransport delivers queued messages, then stays silent
+type queuedTransport struct {
+	*silentTransport
+	queue chan []byte
+}
+
+func (q *queuedTransport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-q.queue:
+		return data, nil
+	default:
+		return q.silentTransport.ReceiveContext(ctx)
+	}
+}
+
+func TestReceiveLoopTimestampSkew(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TimestampSkew = msg.DefaultTimestampSkew
+	c := NewClient(cfg, newTestDevice(t))
+	clientPublic, err := msg.PublicKeyFromPrivate(cfg.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node stamps each packet; only the last is inside the window
+	encoder := msg.NewEncoder(clientPublic)
+	transport := &queuedTransport{silentTransport: newSilentTransport(), queue: make(chan []byte, 3)}
+	for id, offset := range []time.Duration{-2 * cfg.TimestampSkew, 2 * cfg.TimestampSkew, cfg.TimestampSkew / 2} {
+		message := &msg.Msg{Timestamp: time.Now().Add(offset).Unix(), Data: udpPacket(remoteAddr, remoteAddr, uint16(id))}
+		rawMsg, err := encoder.EncryptMsg(message, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := kbinary.Marshal(rawMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport.queue <- data
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writes := make(chan []byte, 3)
+	done := make(chan struct{})
+	go func() {
+		c.receiveLoop(ctx, transport, msg.NewReplayWindow(), writes, make(chan error, 1))
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case packet := <-writes:
+		if id := binary.BigEndian.Uint16(packet[4:]); id != 2 {
+			t.Fatalf("wrote packet %d, want 2", id)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("packet inside the window never written")
+	}
+	select {
+	case packet := <-writes:
+		t.Fatalf("extra packet written: %x", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := c.Stats(); s.SkewRejected != 2 || s.PacketsReceived != 1 {
+		t.Fatalf("%d skew rejections and %d packets received, want 2 and 1", s.SkewRejected, s.PacketsReceived)
+	}
+}
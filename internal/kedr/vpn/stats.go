@@ -0,0 +1,104 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// Stats is a snapshot of client traffic counters
+type Stats struct {
+	BytesSent       uint64         `json:"bytes_sent"`
+	BytesReceived   uint64         `json:"bytes_received"`
+	PacketsSent     uint64         `json:"packets_sent"`
+	PacketsReceived uint64         `json:"packets_received"`
+	HandshakeTime   time.Time      `json:"handshake_time"`  // Last successful handshake
+	HandshakeState  HandshakeState `json:"handshake_state"` // State of the latest handshake attempt
+	Reconnects      uint64         `json:"reconnects"`
+	KeepalivesSent  uint64         `json:"keepalives_sent"`
+	Rebinds         uint64         `json:"rebinds"`       // Transport moves to a new local address
+	SkewRejected    uint64         `json:"skew_rejected"` // Messages outside the allowed clock skew
+	Uptime          string         `json:"uptime"`        // Time since the last handshake
+	// Order packets from the node arrived in since the last handshake
+	Reorder msg.ReorderStats `json:"reorder"`
+}
+
+// counters are updated atomically from the send/receive loops
+type counters struct {
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+	handshakeTime   atomic.Int64 // Unix nanoseconds
+	handshakeState  atomic.Int32 // HandshakeState of the latest attempt
+	reconnects      atomic.Uint64
+	keepalives      atomic.Uint64
+	rebinds         atomic.Uint64
+	skewRejected    atomic.Uint64
+	lastSend        atomic.Int64                     // Unix nanoseconds of the last message sent
+	window          atomic.Pointer[msg.ReplayWindow] // Replay window of the current session
+}
+
+// Stats returns current traffic counters
+func (c *Client) Stats() Stats {
+	stats := Stats{
+		BytesSent:       c.stats.bytesSent.Load(),
+		BytesReceived:   c.stats.bytesReceived.Load(),
+		PacketsSent:     c.stats.packetsSent.Load(),
+		PacketsReceived: c.stats.packetsReceived.Load(),
+		Reconnects:      c.stats.reconnects.Load(),
+		HandshakeState:  HandshakeState(c.stats.handshakeState.Load()),
+		KeepalivesSent:  c.stats.keepalives.Load(),
+		Rebinds:         c.stats.rebinds.Load(),
+		SkewRejected:    c.stats.skewRejected.Load(),
+	}
+	if window := c.stats.window.Load(); window != nil {
+		stats.Reorder = window.Stats()
+	}
+	if ts := c.stats.handshakeTime.Load(); ts != 0 {
+		stats.HandshakeTime = time.Unix(0, ts)
+		stats.Uptime = time.Since(stats.HandshakeTime).Round(time.Second).String()
+	}
+	return stats
+}
+
+// LogStats prints a stats summary every interval until ctx is done
+func (c *Client) LogStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := c.Stats()
+			slog.Info("Stats",
+				"sent", s.BytesSent,
+				"received", s.BytesReceived,
+				"packetsSent", s.PacketsSent,
+				"packetsReceived", s.PacketsReceived,
+				"reconnects", s.Reconnects,
+				"reordered", s.Reorder.Reordered,
+				"duplicates", s.Reorder.Duplicates,
+				"gaps", s.Reorder.Gaps,
+				"uptime", s.Uptime)
+		}
+	}
+}
+
+// ServeStats exposes Stats as JSON on http://addr/stats
+func (c *Client) ServeStats(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Stats())
+	})
+	slog.Info("Stats endpoint listening", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,64 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+)
+
+// waitStats polls c.Stats until done accepts it
+func waitStats(t *testing.T, c *Client, done func(Stats) bool) Stats {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		s := c.Stats()
+		if done(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats never settled: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatsCountTraffic(t *testing.T) {
+	node := startNode(t, "loopback", "10.80.0.0/24")
+	dev := newTestDevice(t)
+	c := NewClient(testConfig(t, node.upstream()), dev)
+	runClient(t, c)
+	clientIP := dev.waitAssigned(t)
+
+	s := c.Stats()
+	if s.HandshakeTime.IsZero() || s.Uptime == "" {
+		t.Fatalf("handshake not recorded: %+v", s)
+	}
+	if s.PacketsSent != 0 || s.PacketsReceived != 0 || s.BytesSent != 0 || s.BytesReceived != 0 {
+		t.Fatalf("handshake counted as traffic: %+v", s)
+	}
+
+	const sent, received = 5, 3
+	var sentBytes, receivedBytes uint64
+	for i := range sent {
+		packet := udpPacket(clientIP, remoteAddr, uint16(i))
+		sentBytes += uint64(len(packet))
+		dev.Inject(packet)
+		node.readTUN(t)
+	}
+	for i := range received {
+		packet := udpPacket(remoteAddr, clientIP, uint16(100+i))
+		receivedBytes += uint64(len(packet))
+		node.dev.Inject(packet)
+		readWritten(t, dev.Device)
+	}
+
+	s = waitStats(t, c, func(s Stats) bool {
+		return s.PacketsSent == sent && s.PacketsReceived == received
+	})
+	if s.BytesSent != sentBytes || s.BytesReceived != receivedBytes {
+		t.Fatalf("counted %d bytes sent, %d received; want %d, %d",
+			s.BytesSent, s.BytesReceived, sentBytes, receivedBytes)
+	}
+	if s.Reconnects != 0 {
+		t.Fatalf("%d reconnects on a healthy tunnel", s.Reconnects)
+	}
+}
@@ -0,0 +1,217 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// streamOpenTimeout bounds how long the exit node may take to dial a stream
+const streamOpenTimeout = 15 * time.Second
+
+// streamBacklog is how many received chunks a stream buffers before the
+// receive loop blocks on it
+const streamBacklog = 256
+
+// ErrNotConnected is returned when a stream is opened with no node session
+var ErrNotConnected = errors.New("not connected to a node")
+
+// stream is a TCP connection the exit node originated for the local proxy
+type stream struct {
+	id        uint32
+	client    *Client
+	opened    chan string // Open result: empty on success, else the node's reason
+	reads     chan []byte
+	pending   []byte // Unread rest of the last chunk
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialStream asks the exit node to open a TCP connection to addr ("host:port")
+// and returns it once the node has connected
+func (c *Client) DialStream(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	st := &stream{
+		id:     c.nextStream.Add(1),
+		client: c,
+		opened: make(chan string, 1),
+		reads:  make(chan []byte, streamBacklog),
+		done:   make(chan struct{}),
+	}
+
+	c.streamMu.Lock()
+	c.streams[st.id] = st
+	c.streamMu.Unlock()
+
+	if err := c.sendStream(&msg.StreamFrame{ID: st.id, Op: msg.StreamOpen, Data: []byte(addr)}); err != nil {
+		c.dropStream(st)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, streamOpenTimeout)
+	defer cancel()
+
+	select {
+	case reason := <-st.opened:
+		if reason != "" {
+			c.dropStream(st)
+			return nil, fmt.Errorf("node could not open %s: %s", addr, reason)
+		}
+		return st, nil
+	case <-st.done:
+		return nil, fmt.Errorf("stream to %s closed while opening", addr)
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		select {
+		case data := <-s.reads:
+			s.pending = data
+		case <-s.done:
+			// Deliver what arrived before the close
+			select {
+			case data := <-s.reads:
+				s.pending = data
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-s.done:
+			return written, io.ErrClosedPipe
+		default:
+		}
+
+		chunk := p[:min(len(p), msg.StreamChunkSize)]
+		if err := s.client.sendStream(&msg.StreamFrame{ID: s.id, Op: msg.StreamData, Data: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the stream and tells the node to close its connection
+func (s *stream) Close() error {
+	if !s.client.dropStream(s) {
+		return nil
+	}
+	return s.client.sendStream(&msg.StreamFrame{ID: s.id, Op: msg.StreamClose})
+}
+
+// dropStream unregisters a stream and ends it locally.
+// It reports whether the stream was still registered.
+func (c *Client) dropStream(s *stream) bool {
+	c.streamMu.Lock()
+	registered := c.streams[s.id] == s
+	if registered {
+		delete(c.streams, s.id)
+	}
+	c.streamMu.Unlock()
+
+	s.closeOnce.Do(func() { close(s.done) })
+	return registered
+}
+
+// handleStream delivers a stream frame from the exit node
+func (c *Client) handleStream(data []byte) {
+	frame, err := msg.UnmarshalStreamFrame(data)
+	if err != nil {
+		slog.Warn("dropping malformed stream frame", "error", err)
+		return
+	}
+
+	c.streamMu.Lock()
+	st, ok := c.streams[frame.ID]
+	c.streamMu.Unlock()
+	if !ok {
+		return
+	}
+
+	switch frame.Op {
+	case msg.StreamOpen:
+		select {
+		case st.opened <- "":
+		default:
+		}
+	case msg.StreamData:
+		select {
+		case st.reads <- frame.Data:
+		case <-st.done:
+		}
+	case msg.StreamClose:
+		select {
+		case st.opened <- string(frame.Data):
+		default:
+		}
+		c.dropStream(st)
+	}
+}
+
+// closeStreams ends every open stream, e.g. when the node session is lost
+func (c *Client) closeStreams() {
+	c.streamMu.Lock()
+	streams := make([]*stream, 0, len(c.streams))
+	for _, st := range c.streams {
+		streams = append(streams, st)
+	}
+	c.streamMu.Unlock()
+
+	for _, st := range streams {
+		c.dropStream(st)
+	}
+}
+
+// sendStream wraps a stream frame for the circuit and sends it to the entry node
+func (c *Client) sendStream(frame *msg.StreamFrame) error {
+	data, err := msg.MarshalStreamFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.transport == nil {
+		return ErrNotConnected
+	}
+	if err := c.rekeyIfDue(c.transport); err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+
+	rawMsg, err := c.wrap(msg.FlagStream, data, nil)
+	if err != nil {
+		return fmt.Errorf("encrypt stream frame: %w", err)
+	}
+	out, err := binary.Marshal(rawMsg)
+	if err != nil {
+		return fmt.Errorf("marshal stream frame: %w", err)
+	}
+	if err := c.transport.Send(out); err != nil {
+		return err
+	}
+	c.stats.lastSend.Store(time.Now().UnixNano())
+	c.stats.packetsSent.Add(1)
+	c.stats.bytesSent.Add(uint64(len(frame.Data)))
+	return nil
+}
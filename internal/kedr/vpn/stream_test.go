@@ -0,0 +1,108 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/proxy"
+)
+
+// hostIP returns an IPv4 address of this machine that isn't loopback, since
+// the node refuses to proxy streams to its own loopback services
+func hostIP(t *testing.T) net.IP {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP
+		}
+	}
+	t.Skip("no non-loopback IPv4 address to serve from")
+	return nil
+}
+
+// startProxy runs a SOCKS5 proxy dialing through c until the test ends and
+// returns an HTTP client that uses it
+func startProxy(t *testing.T, c *Client) *http.Client {
+	t.Helper()
+	addr := freeAddr(t, "tcp")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- proxy.NewServer(addr, c).Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy never listened: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	proxyURL := &url.URL{Scheme: "socks5", Host: addr}
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: testTimeout}
+}
+
+func TestProxyHTTPGet(t *testing.T) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(hostIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	web.Listener.Close()
+	web.Listener = ln
+	web.Start()
+	defer web.Close()
+
+	node := startNode(t, "loopback", "10.81.0.0/24")
+	cfg := testConfig(t, node.upstream())
+	cfg.Mode = config.ModeProxy
+	c := NewClient(cfg, nil)
+	runClient(t, c)
+	waitStats(t, c, func(s Stats) bool { return !s.HandshakeTime.IsZero() })
+	client := startProxy(t, c)
+
+	resp, err := client.Get(web.URL + "/through/the/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello from /through/the/tunnel"; string(body) != want {
+		t.Fatalf("got %q, want %q", body, want)
+	}
+
+	// The node won't reach its own loopback services for a client
+	local := httptest.NewServer(http.NotFoundHandler())
+	defer local.Close()
+	if resp, err := client.Get(local.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("proxied a request to the node's loopback")
+	}
+}
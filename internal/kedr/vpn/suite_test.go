@@ -0,0 +1,67 @@
+package vpn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestCipherSuiteNegotiated(t *testing.T) {
+	chacha, aes := msg.SuiteChaCha20Poly1305, msg.SuiteAES256GCM
+	tests := []struct {
+		name    string
+		offered []msg.Suite
+		allowed []msg.Suite
+		session bool
+		want    msg.Suite
+		ok      bool
+	}{
+		{"AES-GCM", []msg.Suite{aes}, msg.SupportedSuites, false, aes, true},
+		{"AES-GCM session", []msg.Suite{aes}, msg.SupportedSuites, true, aes, true},
+		{"node's preference wins", []msg.Suite{chacha, aes}, []msg.Suite{aes, chacha}, true, aes, true},
+		{"none offered", nil, msg.SupportedSuites, false, chacha, true},
+		{"no overlap", []msg.Suite{aes}, []msg.Suite{chacha}, false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := startNode(t, "loopback", "10.80.0.0/24")
+			node.handler.SetCipherSuites(tt.allowed)
+			dev := newTestDevice(t)
+			cfg := testConfig(t, node.upstream())
+			cfg.CipherSuites = tt.offered
+			cfg.SessionMode = tt.session
+			c := NewClient(cfg, dev)
+			runErr := runClient(t, c)
+
+			if !tt.ok {
+				select {
+				case err := <-runErr:
+					if err == nil || !strings.Contains(err.Error(), msg.ErrNoCommonSuite.Error()) {
+						t.Fatalf("Run returned %v, want the node's rejection for no common suite", err)
+					}
+				case <-time.After(testTimeout):
+					t.Fatal("connected without a common cipher suite")
+				}
+				return
+			}
+			clientIP := dev.waitAssigned(t)
+
+			out := udpPacket(clientIP, remoteAddr, 1)
+			dev.Inject(out)
+			if got := node.readTUN(t); !bytes.Equal(got, out) {
+				t.Fatalf("node TUN got %x, want %x", got, out)
+			}
+			in := udpPacket(remoteAddr, clientIP, 2)
+			node.dev.Inject(in)
+			if got := readWritten(t, dev.Device); !bytes.Equal(got, in) {
+				t.Fatalf("client TUN got %x, want %x", got, in)
+			}
+			if c.decoder.Suite != tt.want || (c.session != nil) != tt.session {
+				t.Fatalf("speaking %s with session %v, want %s with session %v", c.decoder.Suite, c.session != nil, tt.want, tt.session)
+			}
+		})
+	}
+}
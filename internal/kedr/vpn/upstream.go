@@ -0,0 +1,244 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/internal/transport/obfs"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// candidate is an upstream that completed the handshake
+type candidate struct {
+	index     int
+	transport client.Client
+	ack       *msg.HandshakeAck
+	rtt       time.Duration
+}
+
+// connect picks an upstream according to the node policy, handshakes with it
+// and makes it the circuit's entry node
+func (c *Client) connect(ctx context.Context) error {
+	var (
+		chosen *candidate
+		errs   []error
+	)
+
+	for i := range c.upstreams {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+
+		cand, err := c.dialUpstream(ctx, i)
+		if err != nil {
+			slog.Warn("Upstream unavailable", "endpoint", c.upstreams[i].Endpoint, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", c.upstreams[i].Endpoint, err))
+			continue
+		}
+
+		if c.nodePolicy != config.PolicyLatency {
+			chosen = cand
+			break
+		}
+
+		// Latency policy probes every upstream and keeps the fastest
+		slog.Debug("Upstream probed", "endpoint", c.upstreams[i].Endpoint, "rtt", cand.rtt)
+		if chosen == nil || cand.rtt < chosen.rtt {
+			if chosen != nil {
+				chosen.transport.Disconnect()
+			}
+			chosen = cand
+		} else {
+			cand.transport.Disconnect()
+		}
+	}
+
+	if chosen == nil {
+		return fmt.Errorf("no upstream reachable: %w", errors.Join(errs...))
+	}
+
+	// Use session keys if the node granted them; otherwise stay on per-message ECDH
+	up := c.upstreams[chosen.index]
+	var session *msg.Session
+	if chosen.ack.SessionSeed != (msg.Key{}) {
+		var err error
+		if session, err = msg.NewSessionWithSuite(chosen.ack.SessionSeed, true, chosen.ack.Version, chosen.ack.Suite); err != nil {
+			chosen.transport.Disconnect()
+			return fmt.Errorf("start session: %w", err)
+		}
+		session.Compression = c.upstreamEncs[chosen.index].Compression
+		session.Padding = c.upstreamEncs[chosen.index].Padding
+		session.PadSize = c.upstreamEncs[chosen.index].PadSize
+		session.RekeyPackets = c.rekeyPackets
+		session.RekeyInterval = c.rekeyInterval
+		session.TimestampSkew = c.decoder.TimestampSkew
+	} else if c.sessionMode {
+		slog.Warn("Node did not grant session mode, using per-message keys", "endpoint", up.Endpoint)
+	}
+
+	// Proxy streams may be sending; switch circuit and keys under sendMu
+	c.sendMu.Lock()
+	c.transport = chosen.transport
+	c.encoders[0] = c.upstreamEncs[chosen.index]
+	c.encoders[0].Version = chosen.ack.Version
+	c.encoders[0].Suite = chosen.ack.Suite
+	c.decoder.Version = chosen.ack.Version
+	c.decoder.Suite = chosen.ack.Suite
+	c.circuit.Nodes[0] = &Node{
+		PublicKey: up.PublicKey,
+		Protocol:  msg.Protocol(up.Type),
+		Endpoint:  up.Endpoint,
+	}
+	c.session = session
+	c.sendMu.Unlock()
+
+	// Switch TUN to the addresses leased by the node
+	if c.tun != nil {
+		if err := c.applyAssignedIPs(chosen.ack); err != nil {
+			return err
+		}
+		c.applyNetwork(chosen.ack)
+	}
+
+	slog.Info("Handshake complete", "endpoint", up.Endpoint, "rtt", chosen.rtt, "version", chosen.ack.Version)
+	c.stats.handshakeTime.Store(time.Now().UnixNano())
+	return nil
+}
+
+// applyAssignedIPs sets the TUN addresses the node leased in its ack
+func (c *Client) applyAssignedIPs(ack *msg.HandshakeAck) error {
+	if ack.AssignedIP != "" {
+		if err := c.tun.SetLocalIP(ack.AssignedIP); err != nil {
+			return fmt.Errorf("apply assigned IP %s: %w", ack.AssignedIP, err)
+		}
+		slog.Info("VPN address assigned", "ip", ack.AssignedIP)
+	}
+	if ack.AssignedIP6 != "" && c.ipv6 {
+		if err := c.tun.SetLocalIP6(ack.AssignedIP6); err != nil {
+			return fmt.Errorf("apply assigned IPv6 %s: %w", ack.AssignedIP6, err)
+		}
+		slog.Info("VPN IPv6 address assigned", "ip6", ack.AssignedIP6)
+	}
+	return nil
+}
+
+// applyNetwork sets the TUN MTU and DNS servers the node recommends in its
+// ack, or restores the local ones when it recommends none. Failures are
+// logged and leave the tunnel up with the previous settings.
+func (c *Client) applyNetwork(ack *msg.HandshakeAck) {
+	dev, ok := c.tun.(NetworkDevice)
+	if !ok {
+		if ack.MTU != 0 || len(ack.DNS) > 0 {
+			slog.Warn("Device can't apply node network settings", "mtu", ack.MTU, "dns", ack.DNS)
+		}
+		return
+	}
+
+	mtu := c.localMTU
+	if ack.MTU != 0 {
+		mtu = int(ack.MTU)
+		if mtu > c.maxMTU {
+			slog.Warn("Node MTU exceeds the local frame limit, capping", "mtu", mtu, "max", c.maxMTU)
+			mtu = c.maxMTU
+		}
+	}
+	if mtu != dev.MTU() {
+		if err := dev.SetMTU(mtu); err != nil {
+			slog.Warn("Failed to set MTU", "mtu", mtu, "error", err)
+		} else {
+			slog.Info("TUN MTU set", "mtu", mtu, "fromNode", ack.MTU != 0)
+		}
+	}
+
+	dns := c.localDNS
+	if len(ack.DNS) > 0 {
+		dns = ack.DNS
+	}
+	if len(dns) > 0 && !slices.Equal(dns, dev.DNS()) {
+		if err := dev.SetDNS(dns); err != nil {
+			slog.Warn("Failed to set DNS servers", "dns", dns, "error", err)
+		} else {
+			slog.Info("DNS servers set", "dns", dns, "fromNode", len(ack.DNS) > 0)
+		}
+	}
+}
+
+// dialUpstream opens a transport to upstream i and completes the handshake,
+// trying each address node discovery finds for it in turn
+func (c *Client) dialUpstream(ctx context.Context, i int) (*candidate, error) {
+	configs, err := c.transportConfigs(ctx, c.upstreams[i])
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+
+	var errs []error
+	for _, cfg := range configs {
+		cand, err := c.dialTransport(ctx, i, cfg)
+		if err == nil {
+			return cand, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialTransport opens a transport to upstream i with cfg and completes the handshake.
+// Timed-out handshakes are retried on a fresh transport up to handshakeRetries times.
+func (c *Client) dialTransport(ctx context.Context, i int, cfg config.TransportConfig) (*candidate, error) {
+	up := c.upstreams[i]
+	attempts := max(c.handshakeRetries, 1)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		start := time.Now()
+
+		factory := &client.Factory{}
+		transport, dialErr := factory.NewClient(up.Type, cfg)
+		if dialErr != nil {
+			return nil, fmt.Errorf("connect: %w", dialErr)
+		}
+		if c.obfuscator != nil {
+			transport = obfs.NewClient(transport, c.obfuscator, c.obfsJitter)
+		}
+
+		m := c.newHandshake(transport, c.upstreamEncs[i])
+		var ack *msg.HandshakeAck
+		ack, err = c.runHandshake(ctx, m)
+		if err == nil {
+			return &candidate{
+				index:     i,
+				transport: transport,
+				ack:       ack,
+				rtt:       time.Since(start),
+			}, nil
+		}
+		transport.Disconnect()
+
+		if !m.retryable() {
+			break
+		}
+		slog.Warn("Handshake timed out", "endpoint", up.Endpoint, "attempt", attempt, "of", attempts)
+	}
+	return nil, fmt.Errorf("handshake failed: %w", err)
+}
+
+// ProbeUpstream completes a handshake with upstream i and disconnects again,
+// returning how long the handshake took. It installs nothing locally.
+func (c *Client) ProbeUpstream(ctx context.Context, i int) (time.Duration, error) {
+	chosen, err := c.dialUpstream(ctx, i)
+	if err != nil {
+		return 0, err
+	}
+	chosen.transport.Disconnect()
+	return chosen.rtt, nil
+}
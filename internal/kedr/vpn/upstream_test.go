@@ -0,0 +1,126 @@
+package vpn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/discovery"
+	"seras-protocol/internal/transport/client/tcp"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// refusingUpstream returns an upstream on a TCP port nothing listens on
+func refusingUpstream(t *testing.T) config.Upstream {
+	t.Helper()
+	_, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freeAddr(t, "tcp")
+	return config.Upstream{PublicKey: publicKey, Type: "tcp", Endpoint: addr, TransportConfig: &tcp.Config{Addr: addr}}
+}
+
+func TestConnectFailsOverToNextUpstream(t *testing.T) {
+	for _, policy := range []string{config.PolicyOrdered, config.PolicyLatency} {
+		t.Run(policy, func(t *testing.T) {
+			node := startNode(t, "loopback", "10.81.0.0/24")
+			dev := newTestDevice(t)
+			cfg := testConfig(t, refusingUpstream(t), node.upstream())
+			cfg.NodePolicy = policy
+			runClient(t, NewClient(cfg, dev))
+			clientIP := dev.waitAssigned(t)
+
+			dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+			node.readTUN(t)
+		})
+	}
+}
+
+func TestConnectSkipsSilentUpstream(t *testing.T) {
+	silent := startNode(t, "loopback", "10.82.0.0/24")
+	silent.ignore.Store(1 << 20)
+	node := startNode(t, "loopback", "10.83.0.0/24")
+
+	dev := newTestDevice(t)
+	runClient(t, NewClient(testConfig(t, silent.upstream(), node.upstream()), dev))
+	if ip := dev.waitAssigned(t); !netip.MustParsePrefix("10.83.0.0/24").Contains(ip) {
+		t.Fatalf("client got %s, want a lease from the answering node", ip)
+	}
+	if silent.received.Load() == 0 {
+		t.Fatal("client never tried the first upstream")
+	}
+}
+
+// srvResolver answers one SRV name with a record per port, all on 127.0.0.1
+type srvResolver struct {
+	name  string
+	ports []uint16
+}
+
+func (r srvResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if name != r.name {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	var records []*net.SRV
+	for i, port := range r.ports {
+		records = append(records, &net.SRV{Target: "node.example.test.", Port: port, Priority: uint16(i)})
+	}
+	return name, records, nil
+}
+
+func (r srvResolver) LookupNetIP(context.Context, string, string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+}
+
+// port returns the port of a host:port address
+func port(t *testing.T, addr string) uint16 {
+	t.Helper()
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(n)
+}
+
+func TestConnectTriesEachDiscoveredAddress(t *testing.T) {
+	node := startNode(t, "tcp", "10.84.0.0/24")
+	resolver := srvResolver{
+		name:  "_seras._tcp.example.test",
+		ports: []uint16{port(t, freeAddr(t, "tcp")), port(t, node.endpoint)},
+	}
+	up := node.upstream()
+	up.Endpoint = resolver.name
+	up.TransportConfig = &tcp.Config{Addr: resolver.name}
+
+	dev := newTestDevice(t)
+	cfg := testConfig(t, up)
+	cfg.Discovery = discovery.New(resolver, 0)
+	c := NewClient(cfg, dev)
+	var mu sync.Mutex
+	var routed []string
+	c.SetHostRouter(func(ip string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		routed = append(routed, ip)
+		return nil
+	})
+	runClient(t, c)
+	clientIP := dev.waitAssigned(t)
+
+	dev.Inject(udpPacket(clientIP, remoteAddr, 1))
+	node.readTUN(t)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(routed) != 1 || routed[0] != "127.0.0.1" {
+		t.Fatalf("routed %v, want the discovered address once", routed)
+	}
+}
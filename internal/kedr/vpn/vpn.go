@@ -2,14 +2,23 @@ package vpn
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kelindar/binary"
+	"seras-protocol/internal/bufpool"
 	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/discovery"
 	"seras-protocol/internal/kedr/processor"
+	"seras-protocol/internal/tap"
 	"seras-protocol/internal/transport/client"
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/obfs"
 	"seras-protocol/internal/tun"
 	"seras-protocol/pkg/taiga/msg"
 )
@@ -21,124 +30,269 @@ type Node struct {
 	Endpoint  string
 }
 
-// Circuit is a chain of nodes (currently supports 1, designed for multiple)
+// Circuit is a chain of nodes; the first is the entry node, the last is the exit
 type Circuit struct {
 	Nodes []*Node
 }
 
+// ErrHandshakeTimeout is returned when the node does not answer the handshake in time
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// Device is the client's packet device; it also takes the addresses the node leases
+type Device interface {
+	tun.Device
+	SetLocalIP(ip string) error
+	SetLocalIP6(ip string) error
+}
+
+// NetworkDevice is a Device whose MTU and DNS servers can follow the values
+// a node recommends in its handshake ack
+type NetworkDevice interface {
+	Device
+	SetMTU(mtu int) error
+	DNS() []string
+	SetDNS(servers []string) error
+}
+
 // Client is the VPN client that handles TUN <-> WebSocket communication
 type Client struct {
-	tun           *tun.TUN
-	transport     client.Client
-	encoder       *msg.Encoder
-	decoder       *msg.Decoder
-	processor     *processor.Processor
-	circuit       *Circuit
-	clientPubKey  msg.Key
-}
-
-// NewClient creates a new VPN client
-func NewClient(cfg *config.ConnConfig, t *tun.TUN, transport client.Client) *Client {
-	// Create circuit with single node (for now)
-	circuit := &Circuit{
-		Nodes: []*Node{{
-			PublicKey: cfg.NodePublicKey,
-			Protocol:  msg.Protocol(cfg.Type),
-			Endpoint:  cfg.RemoteHost,
-		}},
+	// ReconnectEnabled rebuilds the transport after it fails instead of returning
+	ReconnectEnabled bool
+	// MaxRetries limits consecutive reconnect attempts (0 means unlimited)
+	MaxRetries int
+
+	tun          Device // nil in proxy mode
+	transport    client.Client
+	upstreams    []config.Upstream // Candidate entry nodes
+	upstreamEncs []*msg.Encoder    // One per upstream
+	nodePolicy   string            // How to pick among upstreams
+	ipv6         bool              // Apply IPv6 addresses assigned by the node
+	encoders     []*msg.Encoder    // One per circuit node, entry first
+	decoder      *msg.Decoder
+	processor    *processor.Processor
+	circuit      *Circuit
+	clientPubKey msg.Key
+	stats        counters
+	tap          *tap.Tap
+
+	// Session mode with the entry node; session is nil when it was not negotiated
+	sessionMode   bool
+	rekeyPackets  uint64
+	rekeyInterval time.Duration
+	session       *msg.Session
+
+	// Cipher suites offered to the entry node, preferred first
+	suites []msg.Suite
+
+	// Handshake attempts per upstream and how long each waits for the ack
+	handshakeTimeout time.Duration
+	handshakeRetries int
+
+	// Resolves upstream endpoints on each connect; nil when discovery is off
+	discovery  *discovery.Discovery
+	hostRouter func(ip string) error // Keeps discovered addresses off the tunnel
+	routed     map[string]bool       // Addresses hostRouter already handled
+	routedMu   sync.Mutex
+
+	// Packets moved per TUN wakeup; above 1, a FastTUN with io_uring batches
+	batch int
+
+	// Frame obfuscation wrapped around every transport; nil when disabled
+	obfuscator *obfs.Obfuscator
+	obfsJitter time.Duration
+
+	// Proxy mode carries TCP streams from the local proxy instead of TUN packets
+	proxyMode  bool
+	streams    map[uint32]*stream
+	streamMu   sync.Mutex
+	nextStream atomic.Uint32
+	// Serializes sends and guards transport and keys against reconnects
+	sendMu sync.Mutex
+
+	// Idle time after which a keepalive is sent; 0 disables keepalives
+	keepalive time.Duration
+	// How often a roaming transport checks for a local network change; 0 disables it
+	roamInterval time.Duration
+
+	// Device settings from local config, used when the node recommends none.
+	// maxMTU is the MTU frame limits were sized for, capping recommended ones.
+	localMTU int
+	localDNS []string
+	maxMTU   int
+}
+
+// NewClient creates a new VPN client; Run connects to one of the configured upstreams.
+// In proxy mode t is nil and traffic comes from DialStream instead.
+func NewClient(cfg *config.ConnConfig, t Device) *Client {
+	// Entry node is filled in by connect; the rest of the circuit is fixed
+	circuit := &Circuit{Nodes: []*Node{{}}}
+	for _, hop := range cfg.Hops {
+		circuit.Nodes = append(circuit.Nodes, &Node{
+			PublicKey: hop.PublicKey,
+			Protocol:  msg.Protocol(hop.Type),
+			Endpoint:  hop.Endpoint,
+		})
 	}
 
-	// Derive client public key from private key
-	clientPubKey, _ := msg.PublicKeyFromPrivate(cfg.PrivateKey)
+	// PaddingMax pads packets to the TUN MTU
+	padSize := cfg.MTU
+	if padSize == 0 {
+		padSize = tun.DefaultMTU
+	}
 
-	return &Client{
-		tun:          t,
-		transport:    transport,
-		encoder:      msg.NewEncoder(cfg.NodePublicKey),
-		decoder:      msg.NewDecoder(cfg.PrivateKey),
-		processor:    processor.NewProcessor(t),
-		circuit:      circuit,
-		clientPubKey: clientPubKey,
+	encoders := make([]*msg.Encoder, len(circuit.Nodes))
+	for i, node := range circuit.Nodes[1:] {
+		encoders[i+1] = msg.NewEncoder(node.PublicKey)
+		encoders[i+1].Compression = cfg.Compression
+		encoders[i+1].Padding, encoders[i+1].PadSize = cfg.Padding, padSize
 	}
-}
 
-// Run starts both send and receive loops
-func (c *Client) Run(ctx context.Context) error {
-	// Perform handshake first
-	if err := c.handshake(); err != nil {
-		return fmt.Errorf("handshake failed: %w", err)
+	upstreamEncs := make([]*msg.Encoder, len(cfg.Upstreams))
+	for i, up := range cfg.Upstreams {
+		upstreamEncs[i] = msg.NewEncoder(up.PublicKey)
+		upstreamEncs[i].Compression = cfg.Compression
+		upstreamEncs[i].Padding, upstreamEncs[i].PadSize = cfg.Padding, padSize
 	}
-	slog.Info("Handshake complete")
 
-	errChan := make(chan error, 2)
+	var localMTU int
+	var localDNS []string
+	if dev, ok := t.(NetworkDevice); ok {
+		localMTU = dev.MTU()
+		localDNS = slices.Clone(dev.DNS())
+	}
 
-	go c.sendLoop(ctx, errChan)
-	go c.receiveLoop(ctx, errChan)
+	decoder := msg.NewDecoder(cfg.PrivateKey)
+	decoder.TimestampSkew = cfg.TimestampSkew
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errChan:
-		return err
+	// Derive client public key from private key
+	clientPubKey, _ := msg.PublicKeyFromPrivate(cfg.PrivateKey)
+
+	return &Client{
+		ReconnectEnabled: cfg.ReconnectEnabled,
+		MaxRetries:       cfg.MaxRetries,
+		tun:              t,
+		upstreams:        cfg.Upstreams,
+		upstreamEncs:     upstreamEncs,
+		nodePolicy:       cfg.NodePolicy,
+		ipv6:             cfg.EnableIPv6,
+		handshakeTimeout: cfg.HandshakeTimeout,
+		handshakeRetries: cfg.HandshakeRetries,
+		sessionMode:      cfg.SessionMode,
+		suites:           cfg.CipherSuites,
+		rekeyPackets:     cfg.RekeyPackets,
+		rekeyInterval:    cfg.RekeyInterval,
+		encoders:         encoders,
+		decoder:          decoder,
+		processor:        processor.NewProcessor(t),
+		circuit:          circuit,
+		clientPubKey:     clientPubKey,
+		proxyMode:        cfg.Mode == config.ModeProxy,
+		streams:          make(map[uint32]*stream),
+		obfuscator:       cfg.Obfuscator,
+		obfsJitter:       cfg.ObfsJitter,
+		batch:            cfg.TUNBatch,
+		keepalive:        cfg.Keepalive,
+		roamInterval:     cfg.RoamInterval,
+		discovery:        cfg.Discovery,
+		routed:           make(map[string]bool),
+		localMTU:         localMTU,
+		localDNS:         localDNS,
+		maxMTU:           padSize,
 	}
 }
 
-// handshake sends client public key to node and waits for ack
-func (c *Client) handshake() error {
-	// Create handshake message with our public key
-	hs := &msg.Handshake{
-		ClientPublicKey: c.clientPubKey,
-	}
+// Run connects to an upstream and pumps packets, reconnecting on failure if enabled
+func (c *Client) Run(ctx context.Context) error {
+	attempt := 0
+	connected := false
+	for {
+		err := c.connect(ctx)
+		if err == nil {
+			if connected {
+				c.stats.reconnects.Add(1)
+			}
+			connected = true
+			attempt = 0
+			err = c.runSession(ctx)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A new session can't help once the TUN is gone
+		if !c.ReconnectEnabled || errors.Is(err, tun.ErrClosed) {
+			return err
+		}
 
-	// Encrypt handshake for node
-	rawMsg, err := c.encoder.EncryptHandshake(hs)
-	if err != nil {
-		return fmt.Errorf("encrypt handshake: %w", err)
+		if err := c.backoff(ctx, &attempt, err); err != nil {
+			return err
+		}
 	}
+}
 
-	// Marshal and send
-	data, err := binary.Marshal(rawMsg)
-	if err != nil {
-		return fmt.Errorf("marshal handshake: %w", err)
-	}
+// runSession pumps packets over the connected transport until it fails
+func (c *Client) runSession(ctx context.Context) error {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if err := c.transport.Send(data); err != nil {
-		return fmt.Errorf("send handshake: %w", err)
-	}
+	// Streams do not survive the node session
+	defer c.closeStreams()
 
-	// Wait for ack
-	ackData, err := c.transport.Receive()
-	if err != nil {
-		return fmt.Errorf("receive ack: %w", err)
-	}
+	// Node starts a fresh encoder per handshake, so its counters restart
+	replay := msg.NewReplayWindow()
+	c.stats.window.Store(replay)
+	errChan := make(chan error, 4)
 
-	// Unmarshal ack
-	ackRaw := &msg.RawMsg{}
-	if err := binary.Unmarshal(ackData, ackRaw); err != nil {
-		return fmt.Errorf("unmarshal ack: %w", err)
+	// A batching or multi-packet TUN takes received packets from a writer goroutine
+	var writes chan []byte
+	if write, queue := c.packetWriter(); write != nil {
+		writes = make(chan []byte, queue)
+		go c.writeLoop(sessionCtx, write, writes)
 	}
 
-	// Check message type
-	if ackRaw.Header.Type != msg.TypeHandshakeAck {
-		return fmt.Errorf("expected handshake ack, got type %d", ackRaw.Header.Type)
+	if !c.proxyMode {
+		go c.sendLoop(sessionCtx, c.transport, errChan)
 	}
-
-	// Decrypt ack
-	ack, err := c.decoder.DecryptHandshakeAck(ackRaw)
-	if err != nil {
-		return fmt.Errorf("decrypt ack: %w", err)
+	if c.keepalive > 0 {
+		c.stats.lastSend.Store(time.Now().UnixNano())
+		go c.keepaliveLoop(sessionCtx, c.transport, errChan)
 	}
-
-	if !ack.Success {
-		return fmt.Errorf("handshake rejected: %s", ack.Message)
+	if roamer := roamerOf(c.transport); roamer != nil && c.roamInterval > 0 {
+		go c.roamLoop(sessionCtx, c.transport, roamer, errChan)
 	}
+	go c.receiveLoop(sessionCtx, c.transport, replay, writes, errChan)
 
-	return nil
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errChan:
+		return err
+	}
 }
 
-// sendLoop reads from TUN, encrypts and sends via WebSocket
-func (c *Client) sendLoop(ctx context.Context, errChan chan<- error) {
-	buf := make([]byte, 1500) // MTU size buffer
+// sendLoop reads from TUN, encrypts and sends via WebSocket. With a batching
+// device it takes several packets per wakeup and sends them back to back; a
+// multi-packet read is split into one message per packet.
+func (c *Client) sendLoop(ctx context.Context, transport client.Client, errChan chan<- error) {
+	sealBuf := bufpool.Get()
+	defer bufpool.Put(sealBuf)
+
+	dev := c.batchDevice()
+	batch := 1
+	if dev != nil {
+		batch = c.batch
+	}
+	// A multi-packet TUN can fill a read with back-to-back packets
+	multiPacket := c.multiPacket()
+	readSize := c.tun.MTU()
+	if multiPacket {
+		readSize = bufpool.Size
+	}
+	bufs := make([][]byte, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, readSize)
+	}
+	sizes := make([]int, batch)
+	var packets [][]byte
 
 	for {
 		select {
@@ -147,50 +301,90 @@ func (c *Client) sendLoop(ctx context.Context, errChan chan<- error) {
 		default:
 		}
 
-		n, err := c.tun.Read(buf)
+		var n int
+		var err error
+		if dev != nil {
+			n, err = dev.ReadBatch(bufs, sizes)
+		} else {
+			sizes[0], err = c.tun.Read(bufs[0])
+			n = 1
+		}
 		if err != nil {
 			slog.Error("failed to read from TUN", "error", err)
 			errChan <- fmt.Errorf("TUN read error: %w", err)
 			return
 		}
 
-		if n == 0 {
-			continue
+		// Session may have ended while blocked on TUN
+		if ctx.Err() != nil {
+			return
 		}
 
-		// Create message with IP packet data
-		message := &msg.Msg{
-			Flags:     0,
-			Timestamp: time.Now().Unix(),
-			NextHop:   nil, // Direct to node (single hop for now)
-			Data:      buf[:n],
+		packets = packets[:0]
+		for i := range n {
+			if !multiPacket {
+				packets = append(packets, bufs[i][:sizes[i]])
+				continue
+			}
+			// Packets before a malformed one are still sent
+			if packets, err = tun.SplitPackets(bufs[i][:sizes[i]], packets); err != nil {
+				slog.Error("failed to split TUN read", "error", err)
+			}
 		}
-
-		// Encrypt message
-		rawMsg, err := c.encoder.EncryptMsg(message)
-		if err != nil {
-			slog.Error("failed to encrypt message", "error", err)
-			continue
+		for _, packet := range packets {
+			if err := c.sendPacket(transport, packet, *sealBuf); err != nil {
+				errChan <- err
+				return
+			}
 		}
+	}
+}
 
-		// Marshal to wire format
-		data, err := binary.Marshal(rawMsg)
-		if err != nil {
-			slog.Error("failed to marshal message", "error", err)
-			continue
-		}
+// sendPacket encrypts one TUN packet and sends it. Only errors that end the
+// session are returned; a packet that fails to encrypt is logged and dropped.
+func (c *Client) sendPacket(transport client.Client, packet, sealBuf []byte) error {
+	c.tap.Capture(tap.Outbound, packet)
 
-		// Send via transport
-		if err := c.transport.Send(data); err != nil {
-			slog.Error("failed to send message", "error", err)
-			errChan <- fmt.Errorf("transport send error: %w", err)
-			return
-		}
+	// Keepalives may be sending too
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := c.rekeyIfDue(transport); err != nil {
+		slog.Error("failed to rekey session", "error", err)
+		return fmt.Errorf("rekey error: %w", err)
 	}
+
+	// Encrypt IP packet in one layer per circuit node
+	rawMsg, err := c.wrap(0, packet, sealBuf)
+	if err != nil {
+		slog.Error("failed to encrypt message", "error", err)
+		return nil
+	}
+
+	// Marshal to wire format
+	data, err := binary.Marshal(rawMsg)
+	if err != nil {
+		slog.Error("failed to marshal message", "error", err)
+		return nil
+	}
+
+	// Send via transport
+	if err := transport.Send(data); err != nil {
+		slog.Error("failed to send message", "error", err)
+		return fmt.Errorf("transport send error: %w", err)
+	}
+	c.stats.lastSend.Store(time.Now().UnixNano())
+	c.stats.packetsSent.Add(1)
+	c.stats.bytesSent.Add(uint64(len(packet)))
+	return nil
 }
 
-// receiveLoop receives from WebSocket, decrypts and writes to TUN
-func (c *Client) receiveLoop(ctx context.Context, errChan chan<- error) {
+// receiveLoop receives, decrypts and writes packets to the TUN, or queues
+// them on writes when a batching or coalescing writer is running
+func (c *Client) receiveLoop(ctx context.Context, transport client.Client, replay *msg.ReplayWindow, writes chan<- []byte, errChan chan<- error) {
+	openBuf := bufpool.Get()
+	defer bufpool.Put(openBuf)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -198,39 +392,131 @@ func (c *Client) receiveLoop(ctx context.Context, errChan chan<- error) {
 		default:
 		}
 
-		data, err := c.transport.Receive()
+		data, err := transport.ReceiveContext(ctx)
 		if err != nil {
+			// Canceled sessions end quietly; runSession already returned
+			if ctx.Err() != nil {
+				return
+			}
+			// Silence from the node is normal while idle; keepalives hold the
+			// path open, so only a tunnel without them is rebuilt
+			if errors.Is(err, udp.ErrReadTimeout) && c.keepalive > 0 {
+				slog.Debug("no traffic from node, still waiting", "error", err)
+				continue
+			}
 			slog.Error("failed to receive message", "error", err)
 			errChan <- fmt.Errorf("transport receive error: %w", err)
 			return
 		}
 
-		// Unmarshal wire format
-		rawMsg := &msg.RawMsg{}
-		if err := binary.Unmarshal(data, rawMsg); err != nil {
-			slog.Error("failed to unmarshal message", "error", err)
+		// Decode wire format, rejecting oversized or malformed messages
+		rawMsg, err := msg.Decode(data)
+		if err != nil {
+			slog.Warn("rejecting malformed message", "error", err)
+			continue
+		}
+
+		if rawMsg.Header.Type == msg.TypeRekey {
+			if c.session == nil {
+				slog.Warn("rekey outside session mode, ignoring")
+			} else if err := c.session.HandleRekey(rawMsg, replay); err != nil {
+				slog.Error("failed to process rekey", "error", err)
+			}
 			continue
 		}
 
-		// Decrypt message
-		cookedMsg, err := c.decoder.DecryptBody(rawMsg)
+		// Decrypt message, rejecting replays
+		cookedMsg, err := c.decrypt(rawMsg, replay, *openBuf)
+		if errors.Is(err, msg.ErrStaleMsg) {
+			c.rejectSkewed()
+			continue
+		}
 		if err != nil {
 			slog.Error("failed to decrypt message", "error", err)
 			continue
 		}
 
+		if cookedMsg.Body.Flags&msg.FlagStream != 0 {
+			c.handleStream(cookedMsg.Body.Data)
+			c.stats.packetsReceived.Add(1)
+			c.stats.bytesReceived.Add(uint64(len(cookedMsg.Body.Data)))
+			continue
+		}
+		if c.proxyMode {
+			slog.Warn("dropping packet in proxy mode")
+			continue
+		}
+
 		// Process (write to TUN)
-		if err := c.processor.Process(cookedMsg); err != nil {
+		if writes != nil {
+			if err := c.processor.Prepare(cookedMsg); err != nil {
+				slog.Error("failed to process message", "error", err)
+				continue
+			}
+			// Data lives in openBuf, which the next message overwrites
+			select {
+			case writes <- append([]byte(nil), cookedMsg.Body.Data...):
+			case <-ctx.Done():
+				return
+			}
+		} else if err := c.processor.Process(cookedMsg); err != nil {
 			slog.Error("failed to process message", "error", err)
 			continue
 		}
+		c.stats.packetsReceived.Add(1)
+		c.stats.bytesReceived.Add(uint64(len(cookedMsg.Body.Data)))
+	}
+}
+
+// rekeyIfDue ratchets the session key when the policy says so and announces it to the node
+func (c *Client) rekeyIfDue(transport client.Client) error {
+	if c.session == nil || !c.session.RekeyDue() {
+		return nil
+	}
+
+	rekey, err := c.session.Rekey()
+	if err != nil {
+		return err
+	}
+	data, err := binary.Marshal(rekey)
+	if err != nil {
+		return fmt.Errorf("marshal rekey: %w", err)
 	}
+	return transport.Send(data)
+}
+
+// rejectSkewed counts a message rejected for its timestamp. Many of them mean
+// this machine's clock or the node's has drifted, so the warning says so.
+// Logged on powers of two so a drifting clock doesn't flood the log.
+func (c *Client) rejectSkewed() {
+	if n := c.stats.skewRejected.Add(1); n&(n-1) == 0 {
+		slog.Warn("rejecting messages outside the allowed clock skew; check clocks are synced", "rejected", n, "skew", c.decoder.TimestampSkew)
+	}
+}
+
+// decrypt opens a message from the entry node with the session or static keys
+func (c *Client) decrypt(rawMsg *msg.RawMsg, replay *msg.ReplayWindow, dst []byte) (*msg.CookedMsg, error) {
+	if c.session == nil {
+		return c.decoder.DecryptBodyChecked(rawMsg, replay, dst)
+	}
+	return c.session.DecryptBodyChecked(rawMsg, replay, dst)
+}
+
+// SetTap records plaintext packets in both directions for debugging
+func (c *Client) SetTap(t *tap.Tap) {
+	c.tap = t
+	c.processor.SetTap(t)
 }
 
 // Close closes all resources
 func (c *Client) Close() error {
-	if err := c.transport.Disconnect(); err != nil {
-		return fmt.Errorf("failed to disconnect transport: %w", err)
+	if c.transport != nil {
+		if err := c.transport.Disconnect(); err != nil {
+			return fmt.Errorf("failed to disconnect transport: %w", err)
+		}
+	}
+	if c.tun == nil {
+		return nil
 	}
 	return c.tun.Close()
 }
@@ -0,0 +1,291 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/netpkt"
+	"seras-protocol/internal/node/handler"
+	"seras-protocol/internal/transport/client/tcp"
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/loopback"
+	"seras-protocol/internal/transport/server"
+	tcpserver "seras-protocol/internal/transport/server/tcp"
+	udpserver "seras-protocol/internal/transport/server/udp"
+	"seras-protocol/internal/tun/tuntest"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 10 * time.Second
+
+// testNode is a node handler behind a server on one of the in-process
+// transports, with an in-memory TUN
+type testNode struct {
+	handler   *handler.Handler
+	dev       *tuntest.Device
+	publicKey msg.Key
+	transport string // "loopback", "udp" or "tcp"
+	endpoint  string // Loopback server name or socket address clients dial
+	// Messages to drop before the handler sees any, as a node that is down would
+	ignore   atomic.Int32
+	received atomic.Int32 // Messages that reached the server, dropped or not
+}
+
+// startNode runs a node leasing from subnet over transport until the test ends
+func startNode(t testing.TB, transport, subnet string) *testNode {
+	t.Helper()
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := netip.MustParsePrefix(subnet)
+	pool, err := handler.NewIPPool(subnet, prefix.Addr().Next().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{dev: tuntest.New("node0", 1500, 16), publicKey: publicKey, transport: transport}
+	n.handler = handler.NewHandler(n.dev, privateKey, pool)
+
+	handle := func(conn handler.Connection, data []byte) {
+		n.received.Add(1)
+		if n.ignore.Add(-1) >= 0 {
+			return
+		}
+		n.handler.HandleMessage(conn, data)
+	}
+	var s server.Server
+	listening := make(chan struct{})
+	switch transport {
+	case "loopback":
+		n.endpoint = t.Name() + "/" + subnet
+		ls := loopback.NewServer(n.endpoint, func(conn *loopback.Connection, data []byte) { handle(conn, data) })
+		ls.SetOnDisconnect(func(conn *loopback.Connection) { n.handler.RemoveConnection(conn) })
+		ls.SetOnListening(func() { close(listening) })
+		s = ls
+	case "udp":
+		n.endpoint = freeAddr(t, "udp")
+		us := udpserver.NewServer(n.endpoint, func(conn *udpserver.Connection, data []byte) { handle(conn, data) })
+		us.SetOnDisconnect(func(conn *udpserver.Connection) { n.handler.RemoveConnection(conn) })
+		us.SetOnListening(func() { close(listening) })
+		s = us
+	case "tcp":
+		n.endpoint = freeAddr(t, "tcp")
+		ts := tcpserver.NewServer(n.endpoint, func(conn *tcpserver.Connection, data []byte) { handle(conn, data) })
+		ts.SetOnDisconnect(func(conn *tcpserver.Connection) { n.handler.RemoveConnection(conn) })
+		ts.SetOnListening(func() { close(listening) })
+		s = ts
+	default:
+		t.Fatalf("unknown transport %q", transport)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Start() }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		t.Fatalf("start %s server: %v", transport, err)
+	}
+
+	ctx, stopReader := context.WithCancel(context.Background())
+	readerDone := make(chan struct{})
+	go func() {
+		n.handler.StartTUNReader(ctx)
+		close(readerDone)
+	}()
+
+	t.Cleanup(func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Stop(stopCtx)
+		stopReader()
+		n.dev.Close()
+		<-readerDone
+	})
+	return n
+}
+
+// freeAddr returns a loopback address with a port free a moment ago
+func freeAddr(t testing.TB, network string) string {
+	t.Helper()
+	var addr net.Addr
+	switch network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		addr = conn.LocalAddr()
+	default:
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		addr = ln.Addr()
+	}
+	return addr.String()
+}
+
+// upstream returns the config entry clients use to reach the node
+func (n *testNode) upstream() config.Upstream {
+	up := config.Upstream{PublicKey: n.publicKey, Type: n.transport, Endpoint: n.endpoint}
+	switch n.transport {
+	case "loopback":
+		up.TransportConfig = &loopback.Config{Name: n.endpoint}
+	case "udp":
+		up.TransportConfig = &udp.Config{Addr: n.endpoint}
+	case "tcp":
+		up.TransportConfig = &tcp.Config{Addr: n.endpoint}
+	}
+	return up
+}
+
+// hop returns the config entry that routes a circuit through the node
+func (n *testNode) hop() config.Hop {
+	return config.Hop{PublicKey: n.publicKey, Type: n.transport, Endpoint: n.endpoint}
+}
+
+// readTUN returns the next packet the handler writes to the TUN
+func (n *testNode) readTUN(t testing.TB) []byte {
+	t.Helper()
+	return readWritten(t, n.dev)
+}
+
+// testDevice is an in-memory client TUN that reports the addresses it is given
+type testDevice struct {
+	*tuntest.Device
+	assigned chan netip.Addr
+}
+
+// newTestDevice returns a device that closes when the test ends
+func newTestDevice(t testing.TB) *testDevice {
+	d := &testDevice{Device: tuntest.New("client0", 1500, 16), assigned: make(chan netip.Addr, 16)}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func (d *testDevice) SetLocalIP(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	d.assigned <- addr
+	return nil
+}
+
+func (d *testDevice) SetLocalIP6(string) error {
+	return nil
+}
+
+// waitAssigned returns the next address the client applies from a handshake ack
+func (d *testDevice) waitAssigned(t testing.TB) netip.Addr {
+	t.Helper()
+	select {
+	case addr := <-d.assigned:
+		return addr
+	case <-time.After(testTimeout):
+		t.Fatal("client never completed a handshake")
+		return netip.Addr{}
+	}
+}
+
+// udpPacket builds an IPv4/UDP packet carrying id as its IP identification
+func udpPacket(src, dst netip.Addr, id uint16) []byte {
+	packet := make([]byte, 20+8+4)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:], id)
+	packet[8] = 64
+	packet[9] = 17
+	s, d := src.As4(), dst.As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 9)
+	binary.BigEndian.PutUint16(packet[24:], uint16(len(packet)-20))
+	copy(packet[28:], "ping")
+	netpkt.Fix(packet)
+	return packet
+}
+
+// readWritten returns the next packet written to dev
+func readWritten(t testing.TB, dev *tuntest.Device) []byte {
+	t.Helper()
+	select {
+	case packet := <-dev.Written:
+		return packet
+	case <-time.After(testTimeout):
+		t.Fatalf("no packet written to %s", dev.Name())
+		return nil
+	}
+}
+
+// testConfig returns a client config for upstreams with short handshake waits
+func testConfig(t testing.TB, upstreams ...config.Upstream) *config.ConnConfig {
+	t.Helper()
+	privateKey, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config.ConnConfig{
+		PrivateKey:       privateKey,
+		Upstreams:        upstreams,
+		HandshakeTimeout: 200 * time.Millisecond,
+		HandshakeRetries: 1,
+		TUNBatch:         1,
+	}
+}
+
+// runClient starts c.Run and returns a channel that yields its result, then
+// closes; the client is stopped when the test ends
+func runClient(t testing.TB, c *Client) <-chan error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- c.Run(ctx)
+		close(runErr)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-runErr:
+		case <-time.After(testTimeout):
+			t.Error("client did not stop")
+		}
+	})
+	return runErr
+}
+
+func TestPacketsCrossTheTunnel(t *testing.T) {
+	for _, transport := range []string{"loopback", "udp", "tcp"} {
+		t.Run(transport, func(t *testing.T) {
+			node := startNode(t, transport, "10.80.0.0/24")
+			dev := newTestDevice(t)
+			runClient(t, NewClient(testConfig(t, node.upstream()), dev))
+			clientIP := dev.waitAssigned(t)
+
+			for i := range 3 {
+				out := udpPacket(clientIP, remoteAddr, uint16(i))
+				dev.Inject(out)
+				if got := node.readTUN(t); !bytes.Equal(got, out) {
+					t.Fatalf("node TUN got %x, want %x", got, out)
+				}
+
+				in := udpPacket(remoteAddr, clientIP, uint16(100+i))
+				node.dev.Inject(in)
+				if got := readWritten(t, dev.Device); !bytes.Equal(got, in) {
+					t.Fatalf("client TUN got %x, want %x", got, in)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Package logging configures the global slog logger from the environment, so
+// every binary honors the same LOG_LEVEL and LOG_FORMAT
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ParseLevel parses "debug", "info", "warn" or "error" (any case)
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got: %s", s)
+	}
+}
+
+// New creates a logger writing records at level or above to w as text or JSON
+func New(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT must be text or json, got: %s", format)
+	}
+}
+
+// Setup installs the default logger described by LOG_LEVEL (default info) and
+// LOG_FORMAT (default text), writing to stderr. Call it once env files are loaded.
+func Setup() error {
+	level := slog.LevelInfo
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		var err error
+		if level, err = ParseLevel(s); err != nil {
+			return err
+		}
+	}
+
+	format := os.Getenv("LOG_FORMAT")
+	if format == "" {
+		format = FormatText
+	}
+	logger, err := New(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
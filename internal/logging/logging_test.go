@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// logAll writes one record at each level and returns the messages that came out
+func logAll(t *testing.T, level slog.Level, format string) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := New(&buf, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	var got []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if format == FormatJSON {
+			var record struct{ Msg string }
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("not JSON: %q", line)
+			}
+			got = append(got, record.Msg)
+			continue
+		}
+		_, msg, ok := strings.Cut(line, "msg=")
+		if !ok {
+			t.Fatalf("not a text record: %q", line)
+		}
+		got = append(got, strings.Fields(msg)[0])
+	}
+	return got
+}
+
+func TestLevelFilters(t *testing.T) {
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"debug", "info", "warn", "error"}},
+		{"info", []string{"info", "warn", "error"}},
+		{"WARN", []string{"warn", "error"}},
+		{"error", []string{"error"}},
+	}
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{FormatText, FormatJSON} {
+			if got := logAll(t, level, format); !slices.Equal(got, tt.want) {
+				t.Errorf("level %s, %s: logged %q, want %q", tt.level, format, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("accepted LOG_LEVEL=verbose")
+	}
+	if _, err := New(&bytes.Buffer{}, slog.LevelInfo, "xml"); err == nil {
+		t.Error("accepted LOG_FORMAT=xml")
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	ctx := context.Background()
+
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "")
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) || !slog.Default().Enabled(ctx, slog.LevelInfo) {
+		t.Fatal("default level is not info")
+	}
+
+	t.Setenv("LOG_LEVEL", "error")
+	t.Setenv("LOG_FORMAT", "json")
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelWarn) || !slog.Default().Enabled(ctx, slog.LevelError) {
+		t.Fatal("LOG_LEVEL=error not applied")
+	}
+	if _, ok := slog.Default().Handler().(*slog.JSONHandler); !ok {
+		t.Fatalf("LOG_FORMAT=json gave a %T", slog.Default().Handler())
+	}
+
+	// A bad setting leaves the logger as it was
+	before := slog.Default()
+	t.Setenv("LOG_LEVEL", "loud")
+	if err := Setup(); err == nil {
+		t.Fatal("accepted LOG_LEVEL=loud")
+	}
+	if slog.Default() != before {
+		t.Fatal("replaced the logger despite the error")
+	}
+}
@@ -0,0 +1,221 @@
+package netpkt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// Reference packets, their checksums computed by an independent
+// implementation of RFC 1071
+var references = []struct {
+	name   string
+	packet string
+	sumAt  int // Offset of the transport checksum
+}{
+	// DNS query for example.com from 192.168.1.10 to 8.8.8.8
+	{"IPv4 UDP", "450000391c46400040114cacc0a8010a08080808cf8400350025e2ecabcd010000010000000000" +
+		"00076578616d706c6503636f6d0000010001", 20 + 6},
+	// SYN to 93.184.216.34:80 with MSS, SACK, timestamp and window scale
+	{"IPv4 TCP", "4500003c5d3a400040069da50a0000025db8d822c73800506b8b456700000000a002faf0604f00" +
+		"00020405b40402080a001234560000000001030307", 20 + 16},
+	// SYN-ACK from [2001:db8::1]:443
+	{"IPv6 TCP", "600000000020063920010db8000000000000000000000001fd00000900000000000000000000" +
+		"000201bbc738123456786b8b45688012fe8863310000020405a00101040201030309", 40 + 16},
+	// Odd-length payload, so the sum pads a final byte
+	{"IPv6 UDP", "6000000000191140fd00000900000000000000000000000220010db80000000000000000000000" +
+		"539c4001bb00194d0d7365726173206f6464207061796c6f6164", 40 + 6},
+}
+
+// reference decodes a reference packet
+func reference(tb testing.TB, packet string) []byte {
+	tb.Helper()
+	data, err := hex.DecodeString(packet)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestIPv4HeaderChecksumKnownValue(t *testing.T) {
+	// The worked example from the IPv4 header checksum article on Wikipedia
+	header := reference(t, "450000730000400040110000c0a80001c0a800c7")
+	if got := IPv4HeaderChecksum(header); got != 0xb861 {
+		t.Fatalf("got %#04x, want 0xb861", got)
+	}
+	binary.BigEndian.PutUint16(header[10:], 0xb861)
+	if Checksum(header) != 0 {
+		t.Fatal("header with its checksum doesn't sum to zero")
+	}
+}
+
+func TestVerifyReferencePackets(t *testing.T) {
+	for _, ref := range references {
+		if err := Verify(reference(t, ref.packet)); err != nil {
+			t.Errorf("%s: %v", ref.name, err)
+		}
+	}
+}
+
+func TestFixReproducesReferencePackets(t *testing.T) {
+	for _, ref := range references {
+		want := reference(t, ref.packet)
+		packet := bytes.Clone(want)
+		if packet[0]>>4 == 4 {
+			binary.BigEndian.PutUint16(packet[10:], 0)
+		}
+		binary.BigEndian.PutUint16(packet[ref.sumAt:], 0xdead)
+		if err := Fix(packet); err != nil {
+			t.Fatalf("%s: %v", ref.name, err)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("%s: fixed to %x\nwant %x", ref.name, packet, want)
+		}
+	}
+}
+
+func TestVerifyCorruptedPackets(t *testing.T) {
+	for _, ref := range references {
+		corruptions := map[string]int{
+			"payload":            len(ref.packet)/2 - 1,
+			"transport checksum": ref.sumAt,
+			"source address":     12,
+		}
+		if ref.packet[0] == '4' {
+			corruptions["IPv4 header checksum"] = 10
+		} else {
+			corruptions["source address"] = 8
+		}
+		for what, at := range corruptions {
+			packet := reference(t, ref.packet)
+			packet[at] ^= 0x10
+			err := Verify(packet)
+			if !errors.Is(err, ErrBadChecksum) {
+				t.Errorf("%s with corrupted %s: got %v, want ErrBadChecksum", ref.name, what, err)
+			}
+			if what == "IPv4 header checksum" && !strings.Contains(err.Error(), "IPv4 header") {
+				t.Errorf("%s: error %q doesn't blame the IPv4 header", ref.name, err)
+			}
+		}
+	}
+}
+
+func TestUDPZeroChecksum(t *testing.T) {
+	// Over IPv4, zero means the sender computed none
+	packet := reference(t, references[0].packet)
+	binary.BigEndian.PutUint16(packet[references[0].sumAt:], 0)
+	if err := Verify(packet); err != nil {
+		t.Fatalf("IPv4 UDP without a checksum: %v", err)
+	}
+	// IPv6 requires one
+	packet = reference(t, references[3].packet)
+	binary.BigEndian.PutUint16(packet[references[3].sumAt:], 0)
+	if err := Verify(packet); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("IPv6 UDP without a checksum: got %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestIncrementalUpdatesMatchFix(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, ref := range references {
+		for range 200 {
+			packet := reference(t, ref.packet)
+			h, err := Parse(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var a16 [16]byte
+			rng.Read(a16[:])
+			addr := netip.AddrFrom16(a16)
+			if h.Version == 4 {
+				addr = netip.AddrFrom4([4]byte(a16[:4]))
+			}
+			if rng.Intn(2) == 0 {
+				err = h.SetSrc(packet, addr)
+			} else {
+				err = h.SetDst(packet, addr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A port, or for TCP the odd-aligned middle of the sequence number
+			offsets := []int{0, 2}
+			if h.Proto == ProtoTCP {
+				offsets = append(offsets, 5)
+			}
+			at := offsets[rng.Intn(len(offsets))]
+			if err := h.SetTransport16(packet, at, uint16(rng.Uint32())); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Verify(packet); err != nil {
+				t.Fatalf("%s after rewriting: %v", ref.name, err)
+			}
+			fixed := bytes.Clone(packet)
+			if err := Fix(fixed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fixed, packet) {
+				t.Fatalf("%s: incremental update %x\ndiffers from Fix %x", ref.name, packet, fixed)
+			}
+		}
+	}
+}
+
+func TestSetAddrRejectsOtherFamily(t *testing.T) {
+	packet := reference(t, references[0].packet)
+	h, err := Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetSrc(packet, netip.MustParseAddr("2001:db8::1")); err == nil {
+		t.Fatal("wrote an IPv6 address into an IPv4 packet")
+	}
+	// Mapped addresses are IPv4
+	if err := h.SetDst(packet, netip.MustParseAddr("::ffff:1.1.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumsWithoutTransport(t *testing.T) {
+	// ICMP echo: only the IPv4 header checksum is ours to keep
+	icmp := reference(t, "4500001c000100004001000008080808c0a8010a0800f7ff00000000")
+	if err := Fix(icmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(icmp); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint16(icmp[22:]); got != 0xf7ff {
+		t.Fatalf("Fix rewrote the ICMP checksum to %#04x", got)
+	}
+
+	// A later fragment carries no transport header to check
+	later := ipv6Packet(44, []byte{ProtoUDP, 0, 0x05, 0xa8, 0, 0, 0, 7}, "hello")
+	want := bytes.Clone(later)
+	if err := Fix(later); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(later, want) {
+		t.Fatal("Fix changed a later fragment")
+	}
+	if err := Verify(later); err != nil {
+		t.Fatal(err)
+	}
+	h, err := Parse(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetTransport16(later, 0, 1); !errors.Is(err, ErrNoTransport) {
+		t.Fatalf("port of a later fragment: got %v, want ErrNoTransport", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Package netpkt parses IP packet headers and keeps their IP, TCP and UDP
+// checksums correct when packets are rewritten.
+package netpkt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Upper-layer protocol numbers
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
+
+// Offsets of the checksum field in each header
+const (
+	ipv4SumOffset = 10
+	tcpSumOffset  = 16
+	udpSumOffset  = 6
+)
+
+var (
+	// ErrMalformed is returned for packets whose headers don't fit or parse
+	ErrMalformed = errors.New("netpkt: malformed packet")
+	// ErrBadChecksum is returned by Verify for a checksum that doesn't match
+	ErrBadChecksum = errors.New("netpkt: bad checksum")
+	// ErrNoTransport is returned when a packet has no TCP or UDP header to
+	// checksum: another protocol, or a fragment whose checksum covers others
+	ErrNoTransport = errors.New("netpkt: no checksummable transport header")
+)
+
+// Header describes the IP header of a packet
+type Header struct {
+	Version  int        // 4 or 6
+	Src, Dst netip.Addr // Source and destination addresses
+	Proto    uint8      // Upper-layer protocol, past any IPv6 extension headers
+	Len      int        // IP header bytes, extensions included; the transport header follows
+	Total    int        // Packet bytes the IP header claims, headers included
+
+	// Fragmentation; the transport header is only in the fragment at offset 0
+	FragmentOffset int  // Byte offset of this fragment's data
+	MoreFragments  bool // More fragments follow this one
+
+	// TCP or UDP ports, when HasPorts
+	SrcPort, DstPort uint16
+	HasPorts         bool
+}
+
+// Fragmented reports whether the packet is part of a fragmented datagram,
+// whose transport checksum covers data in other fragments
+func (h Header) Fragmented() bool {
+	return h.FragmentOffset != 0 || h.MoreFragments
+}
+
+// Parse reads the IP header of an IPv4 or IPv6 packet, and the ports of a
+// TCP or UDP one. It doesn't allocate unless the packet is malformed.
+func Parse(packet []byte) (Header, error) {
+	if len(packet) == 0 {
+		return Header{}, fmt.Errorf("%w: empty", ErrMalformed)
+	}
+	var h Header
+	var err error
+	switch packet[0] >> 4 {
+	case 4:
+		h, err = parseIPv4(packet)
+	case 6:
+		h, err = parseIPv6(packet)
+	default:
+		return Header{}, fmt.Errorf("%w: IP version %d", ErrMalformed, packet[0]>>4)
+	}
+	if err != nil {
+		return Header{}, err
+	}
+
+	// Ports lead both TCP and UDP headers, in fragments at offset 0
+	if (h.Proto == ProtoTCP || h.Proto == ProtoUDP) && h.FragmentOffset == 0 && h.Total >= h.Len+4 {
+		h.SrcPort = binary.BigEndian.Uint16(packet[h.Len:])
+		h.DstPort = binary.BigEndian.Uint16(packet[h.Len+2:])
+		h.HasPorts = true
+	}
+	return h, nil
+}
+
+func parseIPv4(packet []byte) (Header, error) {
+	if len(packet) < 20 {
+		return Header{}, fmt.Errorf("%w: %d-byte IPv4 header", ErrMalformed, len(packet))
+	}
+	h := Header{
+		Version: 4,
+		Src:     netip.AddrFrom4([4]byte(packet[12:16])),
+		Dst:     netip.AddrFrom4([4]byte(packet[16:20])),
+		Proto:   packet[9],
+		Len:     int(packet[0]&0x0f) * 4,
+		Total:   int(binary.BigEndian.Uint16(packet[2:4])),
+	}
+	if h.Len < 20 || h.Len > h.Total || h.Total > len(packet) {
+		return Header{}, fmt.Errorf("%w: IPv4 header length %d, total length %d, %d bytes",
+			ErrMalformed, h.Len, h.Total, len(packet))
+	}
+	frag := binary.BigEndian.Uint16(packet[6:8])
+	h.FragmentOffset = int(frag&0x1fff) * 8
+	h.MoreFragments = frag&0x2000 != 0
+	return h, nil
+}
+
+func parseIPv6(packet []byte) (Header, error) {
+	if len(packet) < 40 {
+		return Header{}, fmt.Errorf("%w: %d-byte IPv6 header", ErrMalformed, len(packet))
+	}
+	h := Header{
+		Version: 6,
+		Src:     netip.AddrFrom16([16]byte(packet[8:24])),
+		Dst:     netip.AddrFrom16([16]byte(packet[24:40])),
+		Proto:   packet[6],
+		Len:     40,
+		Total:   40 + int(binary.BigEndian.Uint16(packet[4:6])),
+	}
+	if h.Total > len(packet) {
+		return Header{}, fmt.Errorf("%w: IPv6 total length %d, %d bytes", ErrMalformed, h.Total, len(packet))
+	}
+	// Walk extension headers to the upper-layer protocol
+	for {
+		switch h.Proto {
+		case 0, 43, 60: // Hop-by-hop, routing, destination options
+			if h.Total < h.Len+2 {
+				return Header{}, fmt.Errorf("%w: truncated IPv6 extension header", ErrMalformed)
+			}
+			h.Proto, h.Len = packet[h.Len], h.Len+(int(packet[h.Len+1])+1)*8
+		case 44: // Fragment
+			if h.Total < h.Len+8 {
+				return Header{}, fmt.Errorf("%w: truncated IPv6 fragment header", ErrMalformed)
+			}
+			frag := binary.BigEndian.Uint16(packet[h.Len+2 : h.Len+4])
+			h.FragmentOffset = int(frag &^ 7)
+			h.MoreFragments = frag&1 != 0
+			h.Proto, h.Len = packet[h.Len], h.Len+8
+		default:
+			if h.Len > h.Total {
+				return Header{}, fmt.Errorf("%w: IPv6 extension headers overrun the packet", ErrMalformed)
+			}
+			return h, nil
+		}
+	}
+}
+
+// sum adds data to a one's complement sum as big-endian 16-bit words,
+// padding an odd final byte with zero
+func sum(data []byte, acc uint32) uint32 {
+	for len(data) >= 2 {
+		acc += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		acc += uint32(data[0]) << 8
+	}
+	return acc
+}
+
+// fold reduces a one's complement sum to 16 bits and complements it
+func fold(acc uint32) uint16 {
+	for acc > 0xffff {
+		acc = (acc & 0xffff) + (acc >> 16)
+	}
+	return ^uint16(acc)
+}
+
+// Checksum returns the internet checksum (RFC 1071) of data
+func Checksum(data []byte) uint16 {
+	return fold(sum(data, 0))
+}
+
+// IPv4HeaderChecksum returns the checksum an IPv4 header should carry
+func IPv4HeaderChecksum(header []byte) uint16 {
+	acc := sum(header[:ipv4SumOffset], 0)
+	return fold(sum(header[ipv4SumOffset+2:], acc))
+}
+
+// TransportChecksum returns the checksum the TCP or UDP header of packet
+// should carry, covering the pseudo-header and the segment
+func (h Header) TransportChecksum(packet []byte) (uint16, error) {
+	sumAt, err := h.transportSumOffset()
+	if err != nil {
+		return 0, err
+	}
+	segment := packet[h.Len:h.Total]
+	if len(segment) < sumAt+2 {
+		return 0, fmt.Errorf("%w: %d-byte transport header", ErrMalformed, len(segment))
+	}
+
+	acc := h.pseudoHeaderSum(len(segment))
+	acc = sum(segment[:sumAt], acc)
+	acc = sum(segment[sumAt+2:], acc)
+	checksum := fold(acc)
+	if checksum == 0 && h.Proto == ProtoUDP {
+		// Zero means "no checksum" in UDP, so the result is sent as all ones
+		checksum = 0xffff
+	}
+	return checksum, nil
+}
+
+// transportSumOffset returns where the checksum sits in the transport header
+func (h Header) transportSumOffset() (int, error) {
+	if h.Fragmented() {
+		return 0, fmt.Errorf("%w: fragment", ErrNoTransport)
+	}
+	switch h.Proto {
+	case ProtoTCP:
+		return tcpSumOffset, nil
+	case ProtoUDP:
+		return udpSumOffset, nil
+	}
+	return 0, fmt.Errorf("%w: protocol %d", ErrNoTransport, h.Proto)
+}
+
+func (h Header) pseudoHeaderSum(length int) uint32 {
+	src, dst := h.Src.AsSlice(), h.Dst.AsSlice()
+	acc := sum(dst, sum(src, 0))
+	return acc + uint32(h.Proto) + uint32(length>>16) + uint32(length&0xffff)
+}
+
+// Fix recomputes the IPv4 header checksum and the TCP or UDP checksum of
+// packet in place. Transport checksums of other protocols and fragments
+// are left alone.
+func Fix(packet []byte) error {
+	h, err := Parse(packet)
+	if err != nil {
+		return err
+	}
+	if h.Version == 4 {
+		binary.BigEndian.PutUint16(packet[ipv4SumOffset:], IPv4HeaderChecksum(packet[:h.Len]))
+	}
+	checksum, err := h.TransportChecksum(packet)
+	if errors.Is(err, ErrNoTransport) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sumAt, _ := h.transportSumOffset()
+	binary.BigEndian.PutUint16(packet[h.Len+sumAt:], checksum)
+	return nil
+}
+
+// Verify checks the IPv4 header checksum and the TCP or UDP checksum of
+// packet, returning ErrBadChecksum for the first that doesn't match. A UDP
+// checksum of zero over IPv4 means none was computed and passes.
+func Verify(packet []byte) error {
+	h, err := Parse(packet)
+	if err != nil {
+		return err
+	}
+	if h.Version == 4 && Checksum(packet[:h.Len]) != 0 {
+		return fmt.Errorf("%w: IPv4 header", ErrBadChecksum)
+	}
+	checksum, err := h.TransportChecksum(packet)
+	if errors.Is(err, ErrNoTransport) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sumAt, _ := h.transportSumOffset()
+	got := binary.BigEndian.Uint16(packet[h.Len+sumAt:])
+	if got == 0 && h.Proto == ProtoUDP && h.Version == 4 {
+		return nil
+	}
+	if got != checksum {
+		return fmt.Errorf("%w: %s header has %#04x, want %#04x", ErrBadChecksum, protoName(h.Proto), got, checksum)
+	}
+	return nil
+}
+
+func protoName(proto uint8) string {
+	if proto == ProtoTCP {
+		return "TCP"
+	}
+	return "UDP"
+}
@@ -0,0 +1,280 @@
+package netpkt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+var (
+	src4 = netip.MustParseAddr("10.77.0.2")
+	dst4 = netip.MustParseAddr("192.0.2.80")
+	src6 = netip.MustParseAddr("fd00:9::2")
+	dst6 = netip.MustParseAddr("2001:db8::1")
+)
+
+// ipv6Packet builds an IPv6 packet with the given extension headers (each
+// already carrying its next header byte) in front of a UDP header and payload
+func ipv6Packet(next uint8, extensions []byte, payload string) []byte {
+	packet := make([]byte, 40, 40+len(extensions)+8+len(payload))
+	packet[0] = 0x60
+	packet[6] = next
+	packet[7] = 64
+	s, d := src6.As16(), dst6.As16()
+	copy(packet[8:24], s[:])
+	copy(packet[24:40], d[:])
+	packet = append(packet, extensions...)
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	packet = append(append(packet, udp...), payload...)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+	return packet
+}
+
+// ipv4Packet builds an IPv4 packet carrying options in its header, padded to
+// whole words, in front of a TCP header and payload
+func ipv4Packet(options []byte, payload string) []byte {
+	hlen := 20 + (len(options)+3)/4*4
+	packet := make([]byte, hlen, hlen+20+len(payload))
+	packet[0] = 0x40 | byte(hlen/4)
+	packet[8] = 64
+	packet[9] = ProtoTCP
+	s, d := src4.As4(), dst4.As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	copy(packet[20:], options)
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 51000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = 5 << 4
+	packet = append(append(packet, tcp...), payload...)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	return packet
+}
+
+func TestParseIPv4(t *testing.T) {
+	// Record route with room for two addresses, then end of options
+	recordRoute := []byte{7, 11, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	// Router alert, padded with no-ops to a word
+	routerAlert := []byte{148, 4, 0, 0}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   Header
+	}{
+		{"plain", ipv4Packet(nil, "hello"), Header{Len: 20, Total: 45, HasPorts: true}},
+		{"record route", ipv4Packet(recordRoute, "hello"), Header{Len: 32, Total: 57, HasPorts: true}},
+		{"router alert", ipv4Packet(routerAlert, ""), Header{Len: 24, Total: 44, HasPorts: true}},
+		{"most options", ipv4Packet(make([]byte, 40), "x"), Header{Len: 60, Total: 81, HasPorts: true}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.packet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := tt.want
+		want.Version, want.Src, want.Dst, want.Proto = 4, src4, dst4, ProtoTCP
+		want.SrcPort, want.DstPort = 51000, 443
+		if got != want {
+			t.Errorf("%s: got %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+
+	// Fragments past the first carry no ports
+	later := ipv4Packet(recordRoute, "hello")
+	binary.BigEndian.PutUint16(later[6:], 185) // Offset 1480, last
+	h, err := Parse(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.HasPorts || h.FragmentOffset != 1480 || h.MoreFragments || !h.Fragmented() {
+		t.Fatalf("later fragment parsed as %+v", h)
+	}
+}
+
+func TestParseIPv4Malformed(t *testing.T) {
+	plain := ipv4Packet(nil, "hello")
+
+	shortIHL := ipv4Packet(nil, "hello")
+	shortIHL[0] = 0x44
+
+	// Options claimed past the total length
+	longIHL := ipv4Packet(nil, "")
+	longIHL[0] = 0x4f
+
+	overlong := ipv4Packet(nil, "hello")
+	binary.BigEndian.PutUint16(overlong[2:], 100)
+
+	for name, packet := range map[string][]byte{
+		"empty":             {},
+		"short header":      plain[:19],
+		"header under 20":   shortIHL,
+		"options past end":  longIHL,
+		"total past end":    overlong,
+		"options truncated": ipv4Packet(make([]byte, 8), "")[:24],
+		"unknown version":   append([]byte{0x50}, plain[1:]...),
+	} {
+		if h, err := Parse(packet); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: got %+v, %v; want ErrMalformed", name, h, err)
+		}
+	}
+}
+
+func TestParseTruncationsAndGarbage(t *testing.T) {
+	valid := [][]byte{
+		ipv4Packet([]byte{7, 7, 4, 0, 0, 0, 0}, "hello"),
+		ipv6Packet(0, []byte{ProtoUDP, 0, 1, 4, 0, 0, 0, 0}, "hello"),
+		ipv6Packet(44, []byte{ProtoUDP, 0, 0, 1, 0, 0, 0, 7}, "hello"),
+	}
+	// Cut short, a packet is malformed however far it got
+	for _, packet := range valid {
+		for i := range len(packet) {
+			if _, err := Parse(packet[:i]); !errors.Is(err, ErrMalformed) {
+				t.Errorf("packet cut to %d of %d bytes: got %v, want ErrMalformed", i, len(packet), err)
+			}
+		}
+	}
+
+	// Random bytes and flipped bits either parse or fail cleanly
+	rng := rand.New(rand.NewSource(1))
+	for range 20000 {
+		var packet []byte
+		if rng.Intn(2) == 0 {
+			packet = make([]byte, rng.Intn(128))
+			rng.Read(packet)
+			if len(packet) > 0 {
+				packet[0] = packet[0]&0x0f | byte(4+rng.Intn(2)*2)<<4
+			}
+		} else {
+			packet = append([]byte(nil), valid[rng.Intn(len(valid))]...)
+			for range 1 + rng.Intn(4) {
+				packet[rng.Intn(len(packet))] ^= byte(1 + rng.Intn(255))
+			}
+		}
+		h, err := Parse(packet)
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("parsing %x: got %v, want ErrMalformed", packet, err)
+			}
+			continue
+		}
+		if h.Len > h.Total || h.Total > len(packet) || (h.HasPorts && h.Len+4 > h.Total) {
+			t.Fatalf("parsed %x as %+v, past its end", packet, h)
+		}
+	}
+}
+
+func TestParseDoesNotAllocate(t *testing.T) {
+	for _, packet := range [][]byte{
+		ipv4Packet([]byte{148, 4, 0, 0}, "hello"),
+		ipv6Packet(43, []byte{ProtoUDP, 0, 0, 0, 0, 0, 0, 0}, "hello"),
+	} {
+		var err error
+		allocs := testing.AllocsPerRun(100, func() { _, err = Parse(packet) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocs != 0 {
+			t.Errorf("Parse of an IPv%d packet allocated %.0f times", packet[0]>>4, allocs)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(ipv4Packet([]byte{7, 7, 4, 0, 0, 0, 0}, "hello"))
+	f.Add(ipv6Packet(0, []byte{ProtoUDP, 0, 1, 4, 0, 0, 0, 0}, "hello"))
+	f.Add(ipv6Packet(44, []byte{ProtoUDP, 0, 0x05, 0xa8, 0, 0, 0, 7}, "hello"))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		h, err := Parse(packet)
+		if err != nil {
+			return
+		}
+		if h.Len > h.Total || h.Total > len(packet) {
+			t.Fatalf("parsed %+v from %d bytes", h, len(packet))
+		}
+		Verify(packet)
+		Fix(packet)
+	})
+}
+
+func TestParseIPv6(t *testing.T) {
+	hopByHop := []byte{ProtoUDP, 0, 1, 4, 0, 0, 0, 0}
+	// Routing header, then destination options padded to 16 bytes
+	chained := []byte{60, 0, 0, 0, 0, 0, 0, 0, ProtoUDP, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	firstFragment := []byte{ProtoUDP, 0, 0, 1, 0, 0, 0, 7}
+	laterFragment := []byte{ProtoUDP, 0, 0x05, 0xa8, 0, 0, 0, 7} // Offset 1448, last
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   Header
+	}{
+		{"plain", ipv6Packet(ProtoUDP, nil, "hello"), Header{Len: 40, Total: 53, HasPorts: true}},
+		{"hop-by-hop", ipv6Packet(0, hopByHop, "hello"), Header{Len: 48, Total: 61, HasPorts: true}},
+		{"chained", ipv6Packet(43, chained, "hello"), Header{Len: 64, Total: 77, HasPorts: true}},
+		{"first fragment", ipv6Packet(44, firstFragment, "hello"),
+			Header{Len: 48, Total: 61, MoreFragments: true, HasPorts: true}},
+		{"later fragment", ipv6Packet(44, laterFragment, "hello"),
+			Header{Len: 48, Total: 61, FragmentOffset: 1448}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.packet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := tt.want
+		want.Version, want.Src, want.Dst, want.Proto = 6, src6, dst6, ProtoUDP
+		if want.HasPorts {
+			want.SrcPort, want.DstPort = 40000, 53
+		}
+		if got != want {
+			t.Errorf("%s: got %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestParseIPv6Malformed(t *testing.T) {
+	plain := ipv6Packet(ProtoUDP, nil, "hello")
+
+	overlong := ipv6Packet(ProtoUDP, nil, "hello")
+	binary.BigEndian.PutUint16(overlong[4:], 100)
+
+	// The hop-by-hop header claims 24 bytes when the packet has 16 left
+	overrun := ipv6Packet(0, []byte{ProtoUDP, 2, 0, 0, 0, 0, 0, 0}, "")
+	truncatedFragment := ipv6Packet(44, nil, "")[:40]
+	binary.BigEndian.PutUint16(truncatedFragment[4:], 0)
+
+	for name, packet := range map[string][]byte{
+		"short header":       plain[:39],
+		"payload past end":   overlong,
+		"extension overrun":  overrun,
+		"truncated fragment": truncatedFragment,
+	} {
+		if h, err := Parse(packet); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: got %+v, %v; want ErrMalformed", name, h, err)
+		}
+	}
+}
+
+func TestIPv6ChecksumRoundTrip(t *testing.T) {
+	packet := ipv6Packet(0, []byte{ProtoUDP, 0, 1, 4, 0, 0, 0, 0}, "hello")
+	if err := Fix(packet); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(packet); err != nil {
+		t.Fatal(err)
+	}
+	packet[len(packet)-1] ^= 0xff
+	if err := Verify(packet); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("corrupted payload: got %v, want ErrBadChecksum", err)
+	}
+}
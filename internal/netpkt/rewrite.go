@@ -0,0 +1,129 @@
+package netpkt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net/netip"
+)
+
+// UpdateChecksum adjusts the checksum stored in field for one 16-bit word of
+// the covered data changing from old to new (RFC 1624)
+func UpdateChecksum(field []byte, old, new uint16) {
+	acc := uint32(^binary.BigEndian.Uint16(field)) + uint32(^old) + uint32(new)
+	binary.BigEndian.PutUint16(field, fold(acc))
+}
+
+// updateChecksumBytes adjusts the checksum stored in field for an aligned,
+// even-length run of the covered data changing from old to new
+func updateChecksumBytes(field, old, new []byte) {
+	acc := uint32(^binary.BigEndian.Uint16(field))
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:])) + uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	binary.BigEndian.PutUint16(field, fold(acc))
+}
+
+// transportSum returns the TCP or UDP checksum field of packet, or nil when
+// the packet carries none: another protocol, a fragment past the first, or
+// an IPv4 UDP datagram sent without one
+func (h Header) transportSum(packet []byte) []byte {
+	if h.FragmentOffset != 0 {
+		return nil
+	}
+	var at int
+	switch h.Proto {
+	case ProtoTCP:
+		at = h.Len + tcpSumOffset
+	case ProtoUDP:
+		at = h.Len + udpSumOffset
+	default:
+		return nil
+	}
+	if h.Total < at+2 {
+		return nil
+	}
+	field := packet[at : at+2]
+	if h.Proto == ProtoUDP && h.Version == 4 && binary.BigEndian.Uint16(field) == 0 {
+		return nil
+	}
+	return field
+}
+
+// fixUDPZero keeps an updated UDP checksum from reading as "no checksum"
+func (h Header) fixUDPZero(field []byte) {
+	if h.Proto == ProtoUDP && binary.BigEndian.Uint16(field) == 0 {
+		binary.BigEndian.PutUint16(field, 0xffff)
+	}
+}
+
+// SetTransport16 writes v at offset at of the TCP or UDP header, updating
+// the transport checksum. Fragments past the first are refused, having no
+// transport header.
+func (h Header) SetTransport16(packet []byte, at int, v uint16) error {
+	if h.FragmentOffset != 0 || (h.Proto != ProtoTCP && h.Proto != ProtoUDP) {
+		return fmt.Errorf("%w: protocol %d, fragment offset %d", ErrNoTransport, h.Proto, h.FragmentOffset)
+	}
+	if h.Total < h.Len+at+2 {
+		return fmt.Errorf("%w: offset %d past the transport header", ErrMalformed, at)
+	}
+	word := packet[h.Len+at : h.Len+at+2]
+	old := binary.BigEndian.Uint16(word)
+	binary.BigEndian.PutUint16(word, v)
+
+	field := h.transportSum(packet)
+	if field == nil {
+		return nil
+	}
+	if at%2 == 1 {
+		// The value straddles two checksummed words, so it counts byte-swapped
+		old, v = bits.ReverseBytes16(old), bits.ReverseBytes16(v)
+	}
+	UpdateChecksum(field, old, v)
+	h.fixUDPZero(field)
+	return nil
+}
+
+// SetSrc rewrites the source address of packet to addr, which must be of
+// the same family, updating the IPv4 header and transport checksums
+func (h *Header) SetSrc(packet []byte, addr netip.Addr) error {
+	if err := h.setAddr(packet, h.Src, addr, 12, 8); err != nil {
+		return err
+	}
+	h.Src = addr
+	return nil
+}
+
+// SetDst rewrites the destination address of packet to addr, which must be
+// of the same family, updating the IPv4 header and transport checksums
+func (h *Header) SetDst(packet []byte, addr netip.Addr) error {
+	if err := h.setAddr(packet, h.Dst, addr, 16, 24); err != nil {
+		return err
+	}
+	h.Dst = addr
+	return nil
+}
+
+// setAddr replaces old at offset at4 (IPv4) or at6 (IPv6) with addr
+func (h Header) setAddr(packet []byte, old, addr netip.Addr, at4, at6 int) error {
+	at := at6
+	if h.Version == 4 {
+		at = at4
+	}
+	addr = addr.Unmap()
+	if (h.Version == 4) != addr.Is4() {
+		return fmt.Errorf("netpkt: IPv%d packet given address %s", h.Version, addr)
+	}
+	oldBytes, newBytes := old.AsSlice(), addr.AsSlice()
+	copy(packet[at:], newBytes)
+
+	if h.Version == 4 {
+		updateChecksumBytes(packet[ipv4SumOffset:ipv4SumOffset+2], oldBytes, newBytes)
+	}
+	// Addresses are in the pseudo-header the transport checksum covers
+	if field := h.transportSum(packet); field != nil {
+		updateChecksumBytes(field, oldBytes, newBytes)
+		h.fixUDPZero(field)
+	}
+	return nil
+}
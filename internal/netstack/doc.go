@@ -0,0 +1,20 @@
+// Package netstack provides a userspace TCP/IP stack (gVisor's netstack) in
+// place of a kernel TUN device, for hosts where one can't be created. The
+// client's packet pipeline runs over it unchanged, and local applications
+// reach the tunnel through a SOCKS5 proxy dialing through the stack.
+//
+// gVisor is a large dependency, so the stack is only built with the netstack
+// tag, after adding the module from its Go branch:
+//
+//	go get gvisor.dev/gvisor@go
+//	go build -tags netstack ./cmd/kedr
+//	go test -tags netstack ./internal/netstack
+package netstack
+
+import "errors"
+
+// DefaultDNS answers name lookups made through the stack
+const DefaultDNS = "1.1.1.1:53"
+
+// ErrUnavailable is returned by New in builds without the netstack tag
+var ErrUnavailable = errors.New("netstack: not built in (rebuild with -tags netstack)")
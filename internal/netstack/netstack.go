@@ -0,0 +1,227 @@
+//go:build netstack
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"seras-protocol/internal/tun"
+)
+
+// nicID is the stack's only interface
+const nicID = 1
+
+// queueSize is how many outbound packets the stack buffers for Read
+const queueSize = 1024
+
+// Stack is a userspace TCP/IP stack standing in for a TUN device. Streams
+// opened with DialStream leave it as IP packets through Read, and packets
+// given to Write are delivered to them.
+type Stack struct {
+	stack    *stack.Stack
+	ep       *channel.Endpoint
+	mtu      int
+	resolver *net.Resolver
+
+	ctx    context.Context // Cancelled by Close to unblock Read
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	local4 tcpip.Address // Current IPv4 address; zero when unset
+	local6 tcpip.Address // Current IPv6 address; zero when unset
+}
+
+var _ tun.Device = (*Stack)(nil)
+
+// New creates a stack addressed localIP. A zero mtu selects tun.DefaultMTU.
+func New(localIP string, mtu int) (*Stack, error) {
+	if mtu <= 0 {
+		mtu = tun.DefaultMTU
+	}
+
+	s := &Stack{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+			HandleLocal:        true,
+		}),
+		ep:  channel.New(queueSize, uint32(mtu), ""),
+		mtu: mtu,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	// Names resolve through the tunnel, so lookups don't leak to the local network
+	s.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return s.dial(ctx, "udp", DefaultDNS)
+		},
+	}
+
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, fmt.Errorf("enable TCP SACK: %s", err)
+	}
+	if err := s.stack.CreateNIC(nicID, s.ep); err != nil {
+		return nil, fmt.Errorf("create netstack NIC: %s", err)
+	}
+	s.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+	if err := s.SetLocalIP(localIP); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read returns the next packet the stack sends
+func (s *Stack) Read(buf []byte) (int, error) {
+	pkt := s.ep.ReadContext(s.ctx)
+	if pkt == nil {
+		return 0, fmt.Errorf("%w: netstack", tun.ErrClosed)
+	}
+	defer pkt.DecRef()
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(buf, view.AsSlice()), nil
+}
+
+// Write delivers a packet to the stack
+func (s *Stack) Write(packet []byte) (int, error) {
+	if s.ctx.Err() != nil {
+		return 0, fmt.Errorf("%w: netstack", tun.ErrClosed)
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch {
+	case len(packet) > 0 && packet[0]>>4 == 4:
+		proto = header.IPv4ProtocolNumber
+	case len(packet) > 0 && packet[0]>>4 == 6:
+		proto = header.IPv6ProtocolNumber
+	default:
+		return 0, fmt.Errorf("netstack: not an IP packet")
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	defer pkt.DecRef()
+	s.ep.InjectInbound(proto, pkt)
+	return len(packet), nil
+}
+
+func (s *Stack) Close() error {
+	s.cancel()
+	s.ep.Close()
+	s.stack.Close()
+	return nil
+}
+
+func (s *Stack) Name() string {
+	return "netstack"
+}
+
+func (s *Stack) MTU() int {
+	return s.mtu
+}
+
+// SetLocalIP replaces the stack's IPv4 address
+func (s *Stack) SetLocalIP(ip string) error {
+	return s.setAddr(ip, false)
+}
+
+// SetLocalIP6 replaces the stack's IPv6 address
+func (s *Stack) SetLocalIP6(ip string) error {
+	return s.setAddr(ip, true)
+}
+
+func (s *Stack) setAddr(ip string, v6 bool) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is6() != v6 {
+		return fmt.Errorf("invalid netstack address: %s", ip)
+	}
+	proto, current := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber), &s.local4
+	if v6 {
+		proto, current = ipv6.ProtocolNumber, &s.local6
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := tcpip.AddrFromSlice(addr.AsSlice())
+	if *current == next {
+		return nil
+	}
+	if err := s.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          proto,
+		AddressWithPrefix: next.WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("add netstack address %s: %s", ip, err)
+	}
+	if current.Len() > 0 {
+		s.stack.RemoveAddress(nicID, *current)
+	}
+	*current = next
+	return nil
+}
+
+// DialStream opens a TCP connection to "host:port" through the stack,
+// resolving host through the tunnel. It makes Stack a proxy.Dialer.
+func (s *Stack) DialStream(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	return s.dial(ctx, "tcp", addr)
+}
+
+// dial connects over TCP or UDP to "host:port" through the stack
+func (s *Stack) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, err := s.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+		ip = ips[0]
+	}
+
+	ip = ip.Unmap()
+	proto := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	if ip.Is6() {
+		proto = ipv6.ProtocolNumber
+	}
+	remote := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip.AsSlice()), Port: uint16(port)}
+	if network == "udp" {
+		conn, err := gonet.DialUDP(s.stack, nil, &remote, proto)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	conn, err := gonet.DialContextTCP(ctx, s.stack, remote, proto)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,52 @@
+//go:build !netstack
+
+package netstack
+
+import (
+	"context"
+	"io"
+
+	"seras-protocol/internal/tun"
+)
+
+// Stack is unavailable in this build
+type Stack struct{}
+
+var _ tun.Device = (*Stack)(nil)
+
+// New returns ErrUnavailable; see the package docs to build the stack in
+func New(localIP string, mtu int) (*Stack, error) {
+	return nil, ErrUnavailable
+}
+
+func (s *Stack) Read(buf []byte) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func (s *Stack) Write(packet []byte) (int, error) {
+	return 0, ErrUnavailable
+}
+
+func (s *Stack) Close() error {
+	return nil
+}
+
+func (s *Stack) Name() string {
+	return "netstack"
+}
+
+func (s *Stack) MTU() int {
+	return 0
+}
+
+func (s *Stack) SetLocalIP(ip string) error {
+	return ErrUnavailable
+}
+
+func (s *Stack) SetLocalIP6(ip string) error {
+	return ErrUnavailable
+}
+
+func (s *Stack) DialStream(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,19 @@
+//go:build !netstack
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUnavailableWithoutTag(t *testing.T) {
+	if _, err := New("10.80.0.2", 0); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("New: got %v, want ErrUnavailable", err)
+	}
+	var s Stack
+	if _, err := s.DialStream(context.Background(), "10.80.0.1:80"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("DialStream: got %v, want ErrUnavailable", err)
+	}
+}
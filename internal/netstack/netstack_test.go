@@ -0,0 +1,182 @@
+//go:build netstack
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"seras-protocol/internal/kedr/config"
+	"seras-protocol/internal/kedr/vpn"
+	"seras-protocol/internal/node/handler"
+	"seras-protocol/internal/transport/loopback"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 10 * time.Second
+
+// startNode runs a node on the loopback transport named name until the test
+// ends. Its TUN is a stack addressed 10.80.0.1, leasing the rest of
+// 10.80.0.0/24 to clients.
+func startNode(t *testing.T, name string) (*Stack, msg.Key) {
+	t.Helper()
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := New("10.80.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := handler.NewIPPool("10.80.0.0/24", "10.80.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler.NewHandler(dev, privateKey, pool)
+
+	server := loopback.NewServer(name, func(conn *loopback.Connection, data []byte) { h.HandleMessage(conn, data) })
+	server.SetOnDisconnect(func(conn *loopback.Connection) { h.RemoveConnection(conn) })
+	listening := make(chan struct{})
+	server.SetOnListening(func() { close(listening) })
+	go server.Start()
+	<-listening
+
+	ctx, stopReader := context.WithCancel(context.Background())
+	readerDone := make(chan struct{})
+	go func() {
+		h.StartTUNReader(ctx)
+		close(readerDone)
+	}()
+	t.Cleanup(func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		server.Stop(stopCtx)
+		stopReader()
+		dev.Close()
+		<-readerDone
+	})
+	return dev, publicKey
+}
+
+// localAddr returns the stack's current IPv4 address
+func (s *Stack) localAddr() tcpip.Address {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.local4
+}
+
+// echo sends back whatever connections to port on s send, until the test ends
+func echo(t *testing.T, s *Stack, port uint16) {
+	t.Helper()
+	ln, err := gonet.ListenTCP(s.stack, tcpip.FullAddress{NIC: nicID, Addr: s.localAddr(), Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// waitLeased waits for the client to replace its placeholder address with
+// the one the node leased it
+func waitLeased(t *testing.T, s *Stack, placeholder tcpip.Address) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for s.localAddr() == placeholder {
+		if time.Now().After(deadline) {
+			t.Fatal("client never completed a handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPStreamThroughNode(t *testing.T) {
+	name := t.Name()
+	nodeStack, nodePublic := startNode(t, name)
+	echo(t, nodeStack, 7000)
+
+	// The node's lease replaces this address once the handshake completes
+	stack, err := New("10.80.0.254", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stack.Close()
+	placeholder := stack.localAddr()
+
+	clientPrivate, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ConnConfig{
+		PrivateKey: clientPrivate,
+		Upstreams: []config.Upstream{{
+			PublicKey:       nodePublic,
+			Type:            "loopback",
+			Endpoint:        name,
+			TransportConfig: &loopback.Config{Name: name},
+		}},
+		HandshakeTimeout: time.Second,
+		HandshakeRetries: 3,
+		TUNBatch:         1,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- vpn.NewClient(cfg, stack).Run(ctx) }()
+	defer func() {
+		cancel()
+		select {
+		case <-runErr:
+		case <-time.After(testTimeout):
+			t.Error("client did not stop")
+		}
+	}()
+	waitLeased(t, stack, placeholder)
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, testTimeout)
+	defer dialCancel()
+	stream, err := stack.DialStream(dialCtx, "10.80.0.1:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := stream.(net.Conn)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	// Enough to take many segments and window updates each way
+	sent := make([]byte, 1<<20)
+	rand.Read(sent)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(sent)
+		writeErr <- err
+	}()
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read the echo: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write the stream: %v", err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("echoed stream differs from what was sent")
+	}
+}
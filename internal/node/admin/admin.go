@@ -0,0 +1,93 @@
+// Package admin serves node introspection over HTTP on a local Unix socket.
+// Only the socket's owner may connect, so there is no other authentication.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"seras-protocol/internal/node/handler"
+)
+
+// fetchTimeout bounds a client query
+const fetchTimeout = 5 * time.Second
+
+// Source provides what the admin socket reports
+type Source interface {
+	ClientTable() []handler.ClientInfo
+}
+
+// Serve answers GET /clients with the connection table as JSON on the Unix
+// socket at path, replacing a socket left by a previous run
+func Serve(path string, src Source) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if err := os.Chmod(path, 0o600); err != nil {
+		return fmt.Errorf("restrict admin socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(src.ClientTable())
+	})
+	slog.Info("Admin socket listening", "path", path)
+	return http.Serve(ln, mux)
+}
+
+// removeStaleSocket deletes a leftover socket at path, refusing to touch
+// anything else
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("admin socket path %s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// FetchClients queries the node listening on the admin socket at path
+func FetchClients(path string) ([]handler.ClientInfo, error) {
+	client := &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	// The host is ignored; every request goes to the socket
+	resp, err := client.Get("http://node/clients")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin socket: %s", resp.Status)
+	}
+
+	var clients []handler.ClientInfo
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return nil, fmt.Errorf("decode client table: %w", err)
+	}
+	return clients, nil
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/node/handler"
+)
+
+// table is a fixed connection table
+type table []handler.ClientInfo
+
+func (t table) ClientTable() []handler.ClientInfo { return t }
+
+// serve runs Serve for src on a socket in a fresh directory and returns its
+// path once it accepts queries
+func serve(t *testing.T, src Source) string {
+	t.Helper()
+	// Kept short: Unix socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sock")
+
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(path, src) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := FetchClients(path); err == nil {
+			return path
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("Serve: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("admin socket never answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFetchClients(t *testing.T) {
+	want := table{
+		{Key: "0011223344556677", IP: "10.0.0.2", IP6: "fd00::2", Connected: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), BytesIn: 1, BytesOut: 2},
+		{Key: "8899aabbccddeeff", IP: "10.0.0.3", Connected: time.Date(2026, 1, 2, 3, 5, 0, 0, time.UTC)},
+	}
+	path := serve(t, want)
+
+	got, err := FetchClients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(got, want, func(a, b handler.ClientInfo) bool {
+		return a.Key == b.Key && a.IP == b.IP && a.IP6 == b.IP6 && a.Connected.Equal(b.Connected) &&
+			a.BytesIn == b.BytesIn && a.BytesOut == b.BytesOut
+	}) {
+		t.Fatalf("fetched %+v, want %+v", got, want)
+	}
+
+	// No clients is an empty table, not an error
+	empty, err := FetchClients(serve(t, table{}))
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("got %v, %v; want an empty table", empty, err)
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	path := serve(t, table{})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket mode %o, want 600", perm)
+	}
+}
+
+func TestServeReplacesOnlyStaleSockets(t *testing.T) {
+	// A socket left by a previous run is replaced
+	path := serve(t, table{})
+	if _, err := FetchClients(path); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(path, table{{Key: "replacement"}}) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, err := FetchClients(path); err == nil && len(got) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new server never took over the socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Anything else is left alone
+	file := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(file, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Serve(file, table{}); err == nil {
+		t.Fatal("served over a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Fatalf("file now %q, %v", data, err)
+	}
+}
+
+func TestFetchClientsNoNode(t *testing.T) {
+	if _, err := FetchClients(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("fetched from a socket nothing listens on")
+	}
+}
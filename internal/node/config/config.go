@@ -1,52 +1,119 @@
 package config
 
 import (
-	"encoding/hex"
 	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"seras-protocol/internal/node/handler"
+	"seras-protocol/internal/transport/obfs"
+	"seras-protocol/internal/transport/server/udp"
+	"seras-protocol/internal/transport/server/wss"
+	"seras-protocol/internal/transport/v2ray"
+	"seras-protocol/internal/tun"
+	"seras-protocol/pkg/helpers"
 	"seras-protocol/pkg/taiga/msg"
 )
 
+// defaultCircuitLayers is how deep a circuit the default MAX_MESSAGE_SIZE admits
+const defaultCircuitLayers = 4
+
 type NodeConfig struct {
-	PrivateKey    msg.Key // Node's private key for decryption
-	PublicKey     msg.Key // Node's public key (derived or provided)
-	TransportType string  // Transport type: "wss" or "udp"
-	ListenAddr    string  // Listen address (e.g., ":8080")
-	TunIP         string  // IP for node's TUN interface (e.g., "11.0.0.1")
-	VPNSubnet     string  // VPN subnet for clients (e.g., "11.0.0.0/24")
+	PrivateKey      msg.Key         // Node's private key for decryption
+	PublicKey       msg.Key         // Node's public key (derived or provided)
+	TransportType   string          // Transport type: "wss", "udp", "v2ray" or "tcp"
+	ListenAddr      string          // Listen address (e.g., ":8080")
+	TunIP           string          // IP for node's TUN interface (e.g., "11.0.0.1")
+	VPNSubnet       string          // VPN subnet for clients (e.g., "11.0.0.0/24")
+	PingInterval    time.Duration   // WSS keepalive ping interval
+	PongTimeout     time.Duration   // WSS client is dropped if no pong within this
+	SendPolicy      wss.SendPolicy  // WSS: what to do when a client's send buffer is full
+	SendTimeout     time.Duration   // WSS: how long block waits, or close tolerates overflow
+	MTU             int             // TUN MTU (0 = default)
+	MaxMessageSize  int             // Largest transport message accepted or sent
+	TunName         string          // TUN interface name (empty = assigned by the kernel)
+	EgressIface     string          // Interface client traffic is NATed out of (empty = default route's)
+	CipherSuites    []msg.Suite     // Cipher suites clients may use, preferred first
+	Compression     msg.Compression // Payload compression for responses
+	CompressionDict []byte          // Dictionary for deflate-dict (nil = built-in)
+	Padding         msg.Padding     // Payload padding for responses
+	UDPWorkers      int             // UDP message handling workers (0 = NumCPU)
+	UDPQueueSize    int             // Pending packets per UDP worker (0 = default)
+	UDPIdleTimeout  time.Duration   // Silent UDP clients are dropped after this
+	UDPIOURing      bool            // Receive UDP through io_uring (Linux, falls back if unsupported)
+	UDPRing         udp.FastConfig  // io_uring ring entries and receives in flight
+	TLSCert         string          // WSS/V2Ray certificate file (enables TLS with TLSKey)
+	TLSKey          string          // WSS private key file
+	EnableIPv6      bool            // Lease IPv6 addresses and NAT IPv6 traffic
+	TunIP6          string          // IPv6 for node's TUN interface (e.g., "fd00:5e7a::1")
+	VPNSubnet6      string          // IPv6 VPN subnet for clients (e.g., "fd00:5e7a::/64")
+	AllowedClients  []msg.Key       // Client keys permitted to connect
+	AllowedFile     string          // File of permitted client keys, reloaded on SIGHUP
+	DebugPcap       string          // Packet tap: pcap file path or "log" (empty = off)
+	ClientPPS       int             // Packets/sec each client may send (0 = unlimited)
+	ClientBPS       int             // Bytes/sec each client may send (0 = unlimited)
+	GlobalPPS       int             // Packets/sec all clients together may send (0 = unlimited)
+	GlobalBPS       int             // Bytes/sec all clients together may send (0 = unlimited)
+	MaxClients      int             // Clients connected at once; more are refused (0 = unlimited)
+	V2RayID         v2ray.UUID      // UUID VLESS clients must present (TRANSPORT_TYPE=v2ray)
+	HealthAddr      string          // HTTP address serving /healthz and /readyz (empty = off)
+	AdminSocket     string          // Unix socket for node -list (empty = off)
+	DryRun          bool            // Print TUN host commands instead of running them, then exit
+	MSSClamp        bool            // Lower TCP SYN MSS options to fit the TUN MTU
+	RelayIdle       time.Duration   // Links to next hops are closed after this without traffic
+	TimestampSkew   time.Duration   // Client data stamped further from now is rejected (0 = not checked)
+	ClientMTU       int             // TUN MTU recommended to clients (0 = theirs)
+	ClientDNS       []string        // Resolvers recommended to clients (empty = theirs)
+
+	// Masks frames to clients and next hops; nil when OBFS is off
+	Obfuscator *obfs.Obfuscator
+
+	// Destinations client packets and next hops may not reach; includes the
+	// cloud metadata endpoint unless EGRESS_ALLOW_METADATA is set
+	EgressDeny      []netip.Prefix
+	EgressDenyPorts []handler.PortRule
 }
 
 func ParseNodeConfigFromEnv() (*NodeConfig, error) {
-	// Parse private key
-	privKeyHex := os.Getenv("NODE_PRIVATE_KEY")
-	if privKeyHex == "" {
-		return nil, fmt.Errorf("NODE_PRIVATE_KEY is not set")
-	}
-	privKeyBytes, err := hex.DecodeString(privKeyHex)
-	if err != nil || len(privKeyBytes) != 32 {
-		return nil, fmt.Errorf("NODE_PRIVATE_KEY must be 32 bytes hex")
+	// Parse private key, preferring NODE_PRIVATE_KEY_FILE
+	privateKey, err := helpers.LoadPrivateKey("NODE_PRIVATE_KEY")
+	if err != nil {
+		return nil, err
 	}
-	var privateKey msg.Key
-	copy(privateKey[:], privKeyBytes)
+	privateKey.Clamp()
 
 	// Parse public key (optional)
 	var publicKey msg.Key
-	pubKeyHex := os.Getenv("NODE_PUBLIC_KEY")
-	if pubKeyHex != "" {
-		pubKeyBytes, err := hex.DecodeString(pubKeyHex)
-		if err != nil || len(pubKeyBytes) != 32 {
-			return nil, fmt.Errorf("NODE_PUBLIC_KEY must be 32 bytes hex")
+	if env := os.Getenv("NODE_PUBLIC_KEY"); env != "" {
+		publicKey, err = msg.ParsePublicKey(env)
+		if err != nil {
+			return nil, fmt.Errorf("NODE_PUBLIC_KEY: %w", err)
 		}
-		copy(publicKey[:], pubKeyBytes)
 	}
 
 	transportType := os.Getenv("TRANSPORT_TYPE")
 	if transportType == "" {
 		transportType = "wss" // default
 	}
-	if transportType != "wss" && transportType != "udp" {
-		return nil, fmt.Errorf("TRANSPORT_TYPE must be 'wss' or 'udp', got: %s", transportType)
+	switch transportType {
+	case "wss", "udp", "v2ray", "tcp":
+	default:
+		return nil, fmt.Errorf("TRANSPORT_TYPE must be 'wss', 'udp', 'v2ray' or 'tcp', got: %s", transportType)
+	}
+
+	// VLESS clients authenticate with a UUID before any handshake
+	var v2rayID v2ray.UUID
+	if transportType == "v2ray" {
+		env := os.Getenv("V2RAY_ID")
+		if env == "" {
+			return nil, fmt.Errorf("V2RAY_ID is not set (required with TRANSPORT_TYPE=v2ray)")
+		}
+		if v2rayID, err = v2ray.ParseUUID(env); err != nil {
+			return nil, fmt.Errorf("V2RAY_ID must be a UUID, got: %s", env)
+		}
 	}
 
 	listenAddr := os.Getenv("LISTEN_ADDR")
@@ -64,12 +131,400 @@ func ParseNodeConfigFromEnv() (*NodeConfig, error) {
 		return nil, fmt.Errorf("VPN_SUBNET is not set (e.g., 11.0.0.0/24)")
 	}
 
+	pingInterval, err := parseDurationEnv("WS_PING_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	pongTimeout, err := parseDurationEnv("WS_PONG_TIMEOUT", 45*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	sendPolicy := wss.SendDrop
+	if env := os.Getenv("WS_SEND_POLICY"); env != "" {
+		sendPolicy, err = wss.ParseSendPolicy(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WS_SEND_POLICY: %w", err)
+		}
+	}
+
+	sendTimeout, err := parseDurationEnv("WS_SEND_TIMEOUT", wss.DefaultSendTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	mtu := 0
+	if env := os.Getenv("MTU"); env != "" {
+		mtu, err = strconv.Atoi(env)
+		if err != nil || mtu < 576 || mtu > 65535 {
+			return nil, fmt.Errorf("MTU must be an integer between 576 and 65535, got: %s", env)
+		}
+	}
+
+	obfsEnabled := false
+	if env := os.Getenv("OBFS"); env != "" {
+		obfsEnabled, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("OBFS must be a boolean, got: %s", env)
+		}
+	}
+	var obfuscator *obfs.Obfuscator
+	if obfsEnabled {
+		obfsKey := os.Getenv("OBFS_KEY")
+		if obfsKey == "" {
+			return nil, fmt.Errorf("OBFS_KEY is not set (required with OBFS=true)")
+		}
+		if obfuscator, err = obfs.New(obfsKey); err != nil {
+			return nil, err
+		}
+	}
+
+	padding, err := msg.ParsePadding(os.Getenv("PADDING"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PADDING: %w", err)
+	}
+
+	frameMTU := mtu
+	if frameMTU == 0 {
+		frameMTU = tun.DefaultMTU
+	}
+	maxMessageSize := msg.FrameLimit(frameMTU, defaultCircuitLayers)
+	if padding != msg.PaddingNone {
+		maxMessageSize += msg.PaddingBucketSize
+	}
+	if obfuscator != nil {
+		maxMessageSize += obfs.Overhead
+	}
+	if env := os.Getenv("MAX_MESSAGE_SIZE"); env != "" {
+		maxMessageSize, err = strconv.Atoi(env)
+		if err != nil || maxMessageSize < 576 || maxMessageSize > msg.MaxMessageSize {
+			return nil, fmt.Errorf("MAX_MESSAGE_SIZE must be an integer between 576 and %d, got: %s", msg.MaxMessageSize, env)
+		}
+	}
+
+	// Clients can't use a larger MTU than the node's frame limit allows
+	clientMTU := 0
+	if env := os.Getenv("CLIENT_MTU"); env != "" {
+		clientMTU, err = strconv.Atoi(env)
+		if err != nil || clientMTU < 576 || clientMTU > frameMTU {
+			return nil, fmt.Errorf("CLIENT_MTU must be an integer between 576 and the node MTU (%d), got: %s", frameMTU, env)
+		}
+	}
+
+	var clientDNS []string
+	if env := os.Getenv("CLIENT_DNS"); env != "" {
+		for i, entry := range strings.Split(env, ",") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, fmt.Errorf("CLIENT_DNS entry %d must be an IP address, got: %s", i+1, entry)
+			}
+			clientDNS = append(clientDNS, addr.String())
+		}
+	}
+
+	cipherSuites, err := msg.ParseSuites(os.Getenv("CIPHER_SUITES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIPHER_SUITES: %w", err)
+	}
+
+	compression, err := msg.ParseCompression(os.Getenv("COMPRESSION"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COMPRESSION: %w", err)
+	}
+
+	// Both ends must agree on the dictionary deflate-dict compresses against
+	var compressionDict []byte
+	if path := os.Getenv("COMPRESSION_DICT"); path != "" {
+		if compressionDict, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("COMPRESSION_DICT: %w", err)
+		}
+		if len(compressionDict) == 0 {
+			return nil, fmt.Errorf("COMPRESSION_DICT file %s is empty", path)
+		}
+	}
+
+	udpWorkers, err := parseIntEnv("UDP_WORKERS")
+	if err != nil {
+		return nil, err
+	}
+
+	udpQueueSize, err := parseIntEnv("UDP_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	udpIdleTimeout, err := parseDurationEnv("UDP_IDLE_TIMEOUT", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	relayIdle, err := parseDurationEnv("RELAY_IDLE_TIMEOUT", 2*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	udpIOURing := false
+	if env := os.Getenv("UDP_IO_URING"); env != "" {
+		udpIOURing, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("UDP_IO_URING must be a boolean, got: %s", env)
+		}
+	}
+
+	ringEntries, err := parseIntEnv("UDP_RING_ENTRIES")
+	if err != nil {
+		return nil, err
+	}
+	ringDepth, err := parseIntEnv("UDP_RING_DEPTH")
+	if err != nil {
+		return nil, err
+	}
+	udpRing := udp.FastConfig{Entries: ringEntries, Depth: ringDepth}
+	if err := udpRing.Validate(); err != nil {
+		return nil, fmt.Errorf("UDP_RING_ENTRIES/UDP_RING_DEPTH: %w", err)
+	}
+
+	tlsCert := os.Getenv("TLS_CERT")
+	tlsKey := os.Getenv("TLS_KEY")
+	if (tlsCert == "") != (tlsKey == "") {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+
+	enableIPv6 := false
+	if env := os.Getenv("ENABLE_IPV6"); env != "" {
+		enableIPv6, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("ENABLE_IPV6 must be a boolean, got: %s", env)
+		}
+	}
+
+	tunIP6 := os.Getenv("TUN_IP6")
+	if tunIP6 == "" {
+		tunIP6 = "fd00:5e7a::1"
+	}
+	vpnSubnet6 := os.Getenv("VPN_SUBNET6")
+	if vpnSubnet6 == "" {
+		vpnSubnet6 = "fd00:5e7a::/64"
+	}
+
+	clientPPS, err := parseIntEnv("RATE_LIMIT_PPS")
+	if err != nil {
+		return nil, err
+	}
+	clientBPS, err := parseIntEnv("RATE_LIMIT_BPS")
+	if err != nil {
+		return nil, err
+	}
+	globalPPS, err := parseIntEnv("GLOBAL_RATE_LIMIT_PPS")
+	if err != nil {
+		return nil, err
+	}
+	globalBPS, err := parseIntEnv("GLOBAL_RATE_LIMIT_BPS")
+	if err != nil {
+		return nil, err
+	}
+	maxClients, err := parseIntEnv("MAX_CLIENTS")
+	if err != nil {
+		return nil, err
+	}
+
+	var allowedClients []msg.Key
+	if env := os.Getenv("ALLOWED_CLIENTS"); env != "" {
+		for i, entry := range strings.Split(env, ",") {
+			key, err := msg.ParsePublicKey(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, fmt.Errorf("ALLOWED_CLIENTS entry %d: %w", i+1, err)
+			}
+			allowedClients = append(allowedClients, key)
+		}
+	}
+
+	egressDeny, egressDenyPorts, err := parseEgressACL()
+	if err != nil {
+		return nil, err
+	}
+
+	egressIface := os.Getenv("EGRESS_IFACE")
+	if egressIface != "" {
+		if _, err := tun.EgressInterface(egressIface); err != nil {
+			return nil, fmt.Errorf("EGRESS_IFACE: %w", err)
+		}
+	}
+
+	dryRun := false
+	if env := os.Getenv("DRY_RUN"); env != "" {
+		dryRun, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("DRY_RUN must be a boolean, got: %s", env)
+		}
+	}
+
+	mssClamp := true
+	if env := os.Getenv("MSS_CLAMP"); env != "" {
+		mssClamp, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("MSS_CLAMP must be a boolean, got: %s", env)
+		}
+	}
+
+	// Timestamps need synced clocks, so checking them is opt-in
+	var timestampSkew time.Duration
+	if env := os.Getenv("CHECK_TIMESTAMPS"); env != "" {
+		check, err := strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("CHECK_TIMESTAMPS must be a boolean, got: %s", env)
+		}
+		if check {
+			if timestampSkew, err = parseDurationEnv("TIMESTAMP_SKEW", msg.DefaultTimestampSkew); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return &NodeConfig{
-		PrivateKey:    privateKey,
-		PublicKey:     publicKey,
-		TransportType: transportType,
-		ListenAddr:    listenAddr,
-		TunIP:         tunIP,
-		VPNSubnet:     vpnSubnet,
+		PrivateKey:      privateKey,
+		PublicKey:       publicKey,
+		TransportType:   transportType,
+		ListenAddr:      listenAddr,
+		TunIP:           tunIP,
+		VPNSubnet:       vpnSubnet,
+		PingInterval:    pingInterval,
+		PongTimeout:     pongTimeout,
+		SendPolicy:      sendPolicy,
+		SendTimeout:     sendTimeout,
+		MTU:             mtu,
+		MaxMessageSize:  maxMessageSize,
+		TunName:         os.Getenv("TUN_NAME"),
+		EgressIface:     egressIface,
+		CipherSuites:    cipherSuites,
+		Compression:     compression,
+		CompressionDict: compressionDict,
+		Padding:         padding,
+		UDPWorkers:      udpWorkers,
+		UDPQueueSize:    udpQueueSize,
+		UDPIdleTimeout:  udpIdleTimeout,
+		UDPIOURing:      udpIOURing,
+		UDPRing:         udpRing,
+		TLSCert:         tlsCert,
+		TLSKey:          tlsKey,
+		EnableIPv6:      enableIPv6,
+		TunIP6:          tunIP6,
+		VPNSubnet6:      vpnSubnet6,
+		AllowedClients:  allowedClients,
+		AllowedFile:     os.Getenv("ALLOWED_CLIENTS_FILE"),
+		DebugPcap:       os.Getenv("DEBUG_PCAP"),
+		ClientPPS:       clientPPS,
+		ClientBPS:       clientBPS,
+		GlobalPPS:       globalPPS,
+		GlobalBPS:       globalBPS,
+		MaxClients:      maxClients,
+		V2RayID:         v2rayID,
+		HealthAddr:      os.Getenv("HEALTH_ADDR"),
+		AdminSocket:     os.Getenv("ADMIN_SOCKET"),
+		DryRun:          dryRun,
+		MSSClamp:        mssClamp,
+		RelayIdle:       relayIdle,
+		TimestampSkew:   timestampSkew,
+		ClientMTU:       clientMTU,
+		ClientDNS:       clientDNS,
+		Obfuscator:      obfuscator,
+
+		EgressDeny:      egressDeny,
+		EgressDenyPorts: egressDenyPorts,
 	}, nil
 }
+
+// parseEgressACL reads EGRESS_DENY (CIDRs, bare IPs or "private") and
+// EGRESS_DENY_PORTS ("port", "tcp/port" or "udp/port"), comma-separated
+func parseEgressACL() ([]netip.Prefix, []handler.PortRule, error) {
+	allowMetadata := false
+	if env := os.Getenv("EGRESS_ALLOW_METADATA"); env != "" {
+		var err error
+		allowMetadata, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("EGRESS_ALLOW_METADATA must be a boolean, got: %s", env)
+		}
+	}
+
+	var prefixes []netip.Prefix
+	if !allowMetadata {
+		prefixes = append(prefixes, handler.MetadataPrefixes...)
+	}
+	if env := os.Getenv("EGRESS_DENY"); env != "" {
+		for i, entry := range strings.Split(env, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "private" {
+				prefixes = append(prefixes, handler.PrivatePrefixes...)
+				continue
+			}
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(entry)
+				if addrErr != nil {
+					return nil, nil, fmt.Errorf("EGRESS_DENY entry %d must be a CIDR, an IP or \"private\", got: %s", i+1, entry)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+
+	var ports []handler.PortRule
+	if env := os.Getenv("EGRESS_DENY_PORTS"); env != "" {
+		for i, entry := range strings.Split(env, ",") {
+			rule, err := handler.ParsePortRule(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, nil, fmt.Errorf("EGRESS_DENY_PORTS entry %d: %w", i+1, err)
+			}
+			ports = append(ports, rule)
+		}
+	}
+	return prefixes, ports, nil
+}
+
+// parseIntEnv reads a non-negative integer from env, returning 0 if unset
+func parseIntEnv(name string) (int, error) {
+	env := os.Getenv(name)
+	if env == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got: %s", name, env)
+	}
+	return n, nil
+}
+
+// LoadFile applies settings from a config file; env vars override file values
+func LoadFile(path string) error {
+	values, err := helpers.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	if v, ok := values["NODE_PRIVATE_KEY"]; ok {
+		if _, err := msg.ParsePrivateKey(v); err != nil {
+			return fmt.Errorf("config file %s: NODE_PRIVATE_KEY: %w", path, err)
+		}
+	}
+	if v, ok := values["NODE_PUBLIC_KEY"]; ok {
+		if _, err := msg.ParsePublicKey(v); err != nil {
+			return fmt.Errorf("config file %s: NODE_PUBLIC_KEY: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// parseDurationEnv reads a positive duration from env, falling back to def if unset
+func parseDurationEnv(name string, def time.Duration) (time.Duration, error) {
+	env := os.Getenv(name)
+	if env == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, got: %s", name, env)
+	}
+	return d, nil
+}
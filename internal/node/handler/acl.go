@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// IP protocol numbers the ACL can match ports for
+const (
+	protoTCP = netpkt.ProtoTCP
+	protoUDP = netpkt.ProtoUDP
+)
+
+// MetadataPrefixes are the cloud instance metadata endpoints (AWS, GCP, Azure
+// and others on IPv4, AWS on IPv6), denied by default so clients can't read
+// the node's credentials
+var MetadataPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("169.254.169.254/32"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+}
+
+// PrivatePrefixes are the RFC 1918 and unique local networks, for operators
+// who don't want clients reaching the node's LAN
+var PrivatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// PortRule matches a destination port over TCP, UDP or both
+type PortRule struct {
+	Proto uint8 // protoTCP, protoUDP or 0 for both
+	Port  uint16
+}
+
+// ParsePortRule parses "port", "tcp/port" or "udp/port"
+func ParsePortRule(s string) (PortRule, error) {
+	var rule PortRule
+	proto, port, found := strings.Cut(s, "/")
+	if !found {
+		port = proto
+	} else {
+		switch strings.ToLower(proto) {
+		case "tcp":
+			rule.Proto = protoTCP
+		case "udp":
+			rule.Proto = protoUDP
+		default:
+			return PortRule{}, fmt.Errorf("port rule protocol must be tcp or udp, got: %s", proto)
+		}
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return PortRule{}, fmt.Errorf("port must be between 1 and 65535, got: %s", port)
+	}
+	rule.Port = uint16(n)
+	return rule, nil
+}
+
+// ACL denies client packets by destination before they reach the TUN
+type ACL struct {
+	prefixes []netip.Prefix // Denied destination networks
+	ports    []PortRule     // Denied destination ports, on any address
+}
+
+// NewACL creates an ACL denying the given destinations (nil when both are empty)
+func NewACL(prefixes []netip.Prefix, ports []PortRule) *ACL {
+	if len(prefixes) == 0 && len(ports) == 0 {
+		return nil
+	}
+	return &ACL{prefixes: prefixes, ports: ports}
+}
+
+// Denies reports whether packet is headed somewhere the ACL forbids.
+// Packets too malformed to tell are denied; a nil ACL denies nothing.
+func (a *ACL) Denies(packet []byte) bool {
+	if a == nil {
+		return false
+	}
+	hdr, err := netpkt.Parse(packet)
+	if err != nil {
+		return true
+	}
+	return a.deniesAddr(hdr.Dst.Unmap(), hdr.Proto, hdr.DstPort, hdr.HasPorts)
+}
+
+func (a *ACL) deniesAddr(dst netip.Addr, proto uint8, port uint16, hasPort bool) bool {
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(dst) {
+			return true
+		}
+	}
+	if !hasPort {
+		return false
+	}
+	for _, rule := range a.ports {
+		if rule.Port == port && (rule.Proto == 0 || rule.Proto == proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetACL filters client packets by destination (nil allows everything).
+// Must be called before clients connect.
+func (h *Handler) SetACL(acl *ACL) {
+	h.acl = acl
+}
+
+// ACLDropped returns how many packets were dropped by the ACL
+func (h *Handler) ACLDropped() uint64 {
+	return h.aclDropped.Load()
+}
+
+// permit applies the ACL to a packet from a client, counting drops
+func (h *Handler) permit(packet []byte) bool {
+	if !h.acl.Denies(packet) {
+		return true
+	}
+	if n := h.aclDropped.Add(1); n&(n-1) == 0 {
+		hdr, _ := netpkt.Parse(packet)
+		slog.Warn("Dropping packets denied by ACL", "dropped", n, "dst", hdr.Dst)
+	}
+	return false
+}
+
+// refuseDenied keeps proxy streams from local services and ACL-denied
+// destinations, the same ones packets are dropped for
+func (h *Handler) refuseDenied(network, address string, c syscall.RawConn) error {
+	if err := refuseLocal(network, address, c); err != nil {
+		return err
+	}
+	if h.acl == nil {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if h.acl.deniesAddr(addrPort.Addr().Unmap(), protoTCP, addrPort.Port(), true) {
+		h.aclDropped.Add(1)
+		return errors.New("destination denied by ACL")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// packetTo builds a TCP or UDP packet from 10.77.0.2 (fd77::2 for IPv6
+// destinations) to dst
+func packetTo(proto uint8, dst netip.AddrPort) []byte {
+	transport := make([]byte, 20) // A TCP header; UDP uses the first 8 bytes
+	binary.BigEndian.PutUint16(transport[0:], 40000)
+	binary.BigEndian.PutUint16(transport[2:], dst.Port())
+	if proto == protoUDP {
+		transport = transport[:8]
+		binary.BigEndian.PutUint16(transport[4:], 8)
+	} else {
+		transport[12] = 5 << 4
+	}
+
+	var packet []byte
+	if dst.Addr().Is4() {
+		packet = make([]byte, 20, 20+len(transport))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(transport)))
+		packet[8] = 64
+		packet[9] = proto
+		src, d := netip.MustParseAddr("10.77.0.2").As4(), dst.Addr().As4()
+		copy(packet[12:], src[:])
+		copy(packet[16:], d[:])
+	} else {
+		packet = make([]byte, 40, 40+len(transport))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(transport)))
+		packet[6] = proto
+		packet[7] = 64
+		src, d := netip.MustParseAddr("fd77::2").As16(), dst.Addr().As16()
+		copy(packet[8:], src[:])
+		copy(packet[24:], d[:])
+	}
+	packet = append(packet, transport...)
+	netpkt.Fix(packet)
+	return packet
+}
+
+func TestParsePortRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortRule
+		ok   bool
+	}{
+		{"22", PortRule{Port: 22}, true},
+		{"tcp/25", PortRule{Proto: protoTCP, Port: 25}, true},
+		{"UDP/53", PortRule{Proto: protoUDP, Port: 53}, true},
+		{"65535", PortRule{Port: 65535}, true},
+		{"0", PortRule{}, false},
+		{"65536", PortRule{}, false},
+		{"icmp/1", PortRule{}, false},
+		{"tcp/", PortRule{}, false},
+		{"ssh", PortRule{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRule(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParsePortRule(%q) = %+v, %v; want %+v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestACLDenies(t *testing.T) {
+	acl := NewACL(
+		append([]netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}, MetadataPrefixes...),
+		[]PortRule{{Proto: protoTCP, Port: 25}, {Port: 445}},
+	)
+	tests := []struct {
+		name   string
+		packet []byte
+		denied bool
+	}{
+		{"metadata endpoint", packetTo(protoTCP, netip.MustParseAddrPort("169.254.169.254:80")), true},
+		{"IPv6 metadata endpoint", packetTo(protoTCP, netip.MustParseAddrPort("[fd00:ec2::254]:80")), true},
+		{"denied network over UDP", packetTo(protoUDP, netip.MustParseAddrPort("192.168.1.1:53")), true},
+		{"other link-local address", packetTo(protoTCP, netip.MustParseAddrPort("169.254.169.253:80")), false},
+		{"public web", packetTo(protoTCP, netip.MustParseAddrPort("198.51.100.1:443")), false},
+		{"TCP-only port over TCP", packetTo(protoTCP, netip.MustParseAddrPort("198.51.100.1:25")), true},
+		{"TCP-only port over UDP", packetTo(protoUDP, netip.MustParseAddrPort("198.51.100.1:25")), false},
+		{"any-protocol port over UDP", packetTo(protoUDP, netip.MustParseAddrPort("198.51.100.1:445")), true},
+		{"any-protocol port over IPv6", packetTo(protoTCP, netip.MustParseAddrPort("[2001:db8::1]:445")), true},
+		{"IPv6 web", packetTo(protoTCP, netip.MustParseAddrPort("[2001:db8::1]:443")), false},
+		{"truncated", packetTo(protoTCP, netip.MustParseAddrPort("198.51.100.1:443"))[:10], true},
+	}
+	for _, tt := range tests {
+		if got := acl.Denies(tt.packet); got != tt.denied {
+			t.Errorf("%s: denied %v, want %v", tt.name, got, tt.denied)
+		}
+	}
+
+	if NewACL(nil, nil) != nil {
+		t.Fatal("empty ACL not nil")
+	}
+	var none *ACL
+	if none.Denies(packetTo(protoTCP, netip.MustParseAddrPort("169.254.169.254:80"))) {
+		t.Fatal("nil ACL denied a packet")
+	}
+}
+
+func TestACLDropsClientPackets(t *testing.T) {
+	n := startUDPNode(t)
+	n.handler.SetACL(NewACL(MetadataPrefixes, []PortRule{{Port: 25}}))
+	c := n.connect(t)
+
+	c.sendPacket(t, packetTo(protoTCP, netip.MustParseAddrPort("169.254.169.254:80")))
+	c.sendPacket(t, packetTo(protoUDP, netip.MustParseAddrPort("198.51.100.1:25")))
+	allowed := packetTo(protoTCP, netip.MustParseAddrPort("198.51.100.1:443"))
+	c.sendPacket(t, allowed)
+
+	// Only the allowed packet, sent last, reaches the TUN
+	hdr, err := netpkt.Parse(n.readTUN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Dst != netip.MustParseAddr("198.51.100.1") || hdr.DstPort != 443 {
+		t.Fatalf("TUN got a packet to %s:%d", hdr.Dst, hdr.DstPort)
+	}
+	select {
+	case packet := <-n.dev.Written:
+		t.Fatalf("extra packet on the TUN: %x", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := n.handler.ACLDropped(); got != 2 {
+		t.Fatalf("counted %d drops, want 2", got)
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// Allowlist holds the client public keys permitted to handshake.
+// Keys come from config plus an optional file that can be reloaded at runtime.
+type Allowlist struct {
+	static []msg.Key // From ALLOWED_CLIENTS, fixed for the process lifetime
+	file   string    // One hex key per line, '#' starts a comment
+	keys   map[msg.Key]bool
+	mu     sync.RWMutex
+}
+
+// NewAllowlist creates an allowlist from static keys and an optional key file
+func NewAllowlist(static []msg.Key, file string) (*Allowlist, error) {
+	a := &Allowlist{static: static, file: file}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the key file. On error the current set is kept.
+func (a *Allowlist) Reload() error {
+	keys := make(map[msg.Key]bool, len(a.static))
+	for _, k := range a.static {
+		keys[k] = true
+	}
+
+	if a.file != "" {
+		fileKeys, err := readKeyFile(a.file)
+		if err != nil {
+			return err
+		}
+		for _, k := range fileKeys {
+			keys[k] = true
+		}
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+// Allowed reports whether key may handshake
+func (a *Allowlist) Allowed(key msg.Key) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.keys[key]
+}
+
+// Len returns the number of allowed keys
+func (a *Allowlist) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.keys)
+}
+
+// readKeyFile parses one hex public key per line, skipping blanks and comments
+func readKeyFile(path string) ([]msg.Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open allowlist: %w", err)
+	}
+	defer f.Close()
+
+	var keys []msg.Key
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, err := msg.ParsePublicKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist %s line %d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read allowlist: %w", err)
+	}
+	return keys, nil
+}
+
+// SetAllowlist restricts handshakes to the listed client keys (nil allows all)
+func (h *Handler) SetAllowlist(a *Allowlist) {
+	h.allowlist = a
+}
+
+// ReloadAllowlist re-reads the allowlist and drops sessions of revoked clients
+func (h *Handler) ReloadAllowlist() error {
+	if h.allowlist == nil {
+		return nil
+	}
+	if err := h.allowlist.Reload(); err != nil {
+		return err
+	}
+
+	var revoked []Connection
+	h.mu.RLock()
+	for conn, sess := range h.sessions {
+		if !h.allowlist.Allowed(sess.publicKey) {
+			revoked = append(revoked, conn)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, conn := range revoked {
+		h.RemoveConnection(conn)
+	}
+	slog.Info("Allowlist reloaded", "keys", h.allowlist.Len(), "revoked", len(revoked))
+	return nil
+}
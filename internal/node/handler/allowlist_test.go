@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// writeAllowlist writes lines to an allowlist file in a fresh directory
+func writeAllowlist(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "allowed_clients")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAllowlistFile(t *testing.T) {
+	_, static := keyPair(t)
+	_, listed := keyPair(t)
+	_, other := keyPair(t)
+	path := writeAllowlist(t,
+		"# team laptops",
+		"",
+		"  "+hex.EncodeToString(listed[:])+"  # alice",
+	)
+
+	a, err := NewAllowlist([]msg.Key{static}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Allowed(static) || !a.Allowed(listed) || a.Allowed(other) || a.Len() != 2 {
+		t.Fatalf("allowed: static %v, listed %v, other %v (%d keys)", a.Allowed(static), a.Allowed(listed), a.Allowed(other), a.Len())
+	}
+
+	// A malformed entry fails the reload and keeps the current set
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(other[:])+"\nnot-a-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = a.Reload()
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Reload = %v, want an error naming line 2", err)
+	}
+	if !a.Allowed(listed) || a.Allowed(other) {
+		t.Fatal("failed reload changed the allowed keys")
+	}
+
+	for name, lines := range map[string][]string{
+		"short key":     {hex.EncodeToString(other[:31])},
+		"low-order key": {strings.Repeat("00", 32)},
+	} {
+		if _, err := NewAllowlist(nil, writeAllowlist(t, lines...)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := NewAllowlist(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file: accepted")
+	}
+}
+
+func TestHandshakeAllowlist(t *testing.T) {
+	h := newTestHandler(t)
+	allowedPrivate, allowedPublic := keyPair(t)
+	deniedPrivate, _ := keyPair(t)
+	a, err := NewAllowlist([]msg.Key{allowedPublic}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAllowlist(a)
+
+	if ack := handshake(t, h, &fakeConn{}, allowedPrivate); ack == nil || !ack.Success {
+		t.Fatalf("allowed client: ack %+v", ack)
+	}
+
+	ack := handshake(t, h, &fakeConn{}, deniedPrivate)
+	if ack == nil || ack.Success || ack.Message != "client not authorized" {
+		t.Fatalf("denied client: ack %+v, want not authorized", ack)
+	}
+	if h.Clients() != 1 {
+		t.Fatalf("%d clients, want only the allowed one", h.Clients())
+	}
+
+	// Claiming a listed key without its private key fails the proof
+	forger := &fakeConn{}
+	_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: allowedPublic}, deniedPrivate)
+	h.HandleMessage(forger, data)
+	if len(forger.messages()) != 0 || h.Clients() != 1 {
+		t.Fatalf("forged handshake answered %d times, %d clients", len(forger.messages()), h.Clients())
+	}
+}
+
+func TestReloadAllowlistRevokesSessions(t *testing.T) {
+	h := newTestHandler(t)
+	alicePrivate, alice := keyPair(t)
+	bobPrivate, bob := keyPair(t)
+	path := writeAllowlist(t, hex.EncodeToString(alice[:]), hex.EncodeToString(bob[:]))
+	a, err := NewAllowlist(nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAllowlist(a)
+
+	for _, private := range []msg.Key{alicePrivate, bobPrivate} {
+		if ack := handshake(t, h, &fakeConn{}, private); ack == nil || !ack.Success {
+			t.Fatalf("handshake: ack %+v", ack)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(alice[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReloadAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Clients() != 1 || a.Allowed(bob) {
+		t.Fatalf("%d clients after revoking bob, want 1", h.Clients())
+	}
+	if ack := handshake(t, h, &fakeConn{}, bobPrivate); ack == nil || ack.Success {
+		t.Fatalf("revoked client: ack %+v", ack)
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"encoding/hex"
+	"slices"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// ClientInfo describes a connected client for operators
+type ClientInfo struct {
+	Key       string    `json:"key"` // Public key prefix (hex)
+	IP        string    `json:"ip"`
+	IP6       string    `json:"ip6,omitempty"`
+	Connected time.Time `json:"connected"`
+	BytesIn   uint64    `json:"bytes_in"`
+	BytesOut  uint64    `json:"bytes_out"`
+	// Order the client's packets arrived in
+	Reorder msg.ReorderStats `json:"reorder"`
+}
+
+// clientKeyPrefix is how many key bytes ClientInfo shows, enough to tell
+// clients apart without printing whole keys
+const clientKeyPrefix = 8
+
+// ClientTable returns the connected clients, longest connected first
+func (h *Handler) ClientTable() []ClientInfo {
+	h.mu.RLock()
+	clients := make([]ClientInfo, 0, len(h.sessions))
+	for _, sess := range h.sessions {
+		info := ClientInfo{
+			Key:       hex.EncodeToString(sess.publicKey[:clientKeyPrefix]),
+			IP:        sess.ip.String(),
+			Connected: sess.since,
+			BytesIn:   sess.bytesIn.Load(),
+			BytesOut:  sess.bytesOut.Load(),
+			Reorder:   sess.window.Stats(),
+		}
+		if sess.ip6.IsValid() {
+			info.IP6 = sess.ip6.String()
+		}
+		clients = append(clients, info)
+	}
+	h.mu.RUnlock()
+
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return a.Connected.Compare(b.Connected)
+	})
+	return clients
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestClientTable(t *testing.T) {
+	h := newTestHandler(t)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	newer := h.addSession(&fakeConn{}, netip.MustParseAddr("10.77.0.3"))
+	newer.since = start.Add(time.Minute)
+	older := h.addSession(&fakeConn{}, netip.MustParseAddr("10.77.0.2"))
+	older.since = start
+	older.ip6 = netip.MustParseAddr("fd77::2")
+	older.bytesIn.Store(1500)
+	older.bytesOut.Store(3000)
+	for _, counter := range []uint64{1, 3, 2, 3, 6} {
+		older.window.Accept(counter)
+	}
+
+	table := h.ClientTable()
+	if len(table) != 2 {
+		t.Fatalf("%d clients in the table, want 2", len(table))
+	}
+	if table[0].IP != "10.77.0.2" || table[1].IP != "10.77.0.3" {
+		t.Fatalf("table lists %s then %s, want the longest connected first", table[0].IP, table[1].IP)
+	}
+	got := table[0]
+	if want := "0a4d0002" + strings.Repeat("00", clientKeyPrefix-4); got.Key != want {
+		t.Fatalf("key %q, want the %d byte prefix %q", got.Key, clientKeyPrefix, want)
+	}
+	if got.IP6 != "fd77::2" || table[1].IP6 != "" {
+		t.Fatalf("IPv6 addresses %q and %q", got.IP6, table[1].IP6)
+	}
+	if got.BytesIn != 1500 || got.BytesOut != 3000 || !got.Connected.Equal(start) {
+		t.Fatalf("got %+v", got)
+	}
+	if want := (msg.ReorderStats{Reordered: 1, Duplicates: 1, Gaps: 2}); got.Reorder != want {
+		t.Fatalf("reorder stats %+v, want %+v", got.Reorder, want)
+	}
+}
+
+func TestClientTableJSON(t *testing.T) {
+	h := newTestHandler(t)
+	sess := h.addSession(&fakeConn{}, netip.MustParseAddr("10.77.0.2"))
+	sess.since = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	sess.bytesIn.Store(7)
+
+	data, err := json.Marshal(h.ClientTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range fields[0] {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	// ip6 is left out for a client without one
+	if want := []string{"bytes_in", "bytes_out", "connected", "ip", "key", "reorder"}; !slices.Equal(keys, want) {
+		t.Fatalf("fields %q, want %q", keys, want)
+	}
+	if got := string(fields[0]["connected"]); got != `"2026-01-02T03:04:05Z"` {
+		t.Fatalf("connected encoded as %s, want RFC 3339", got)
+	}
+
+	var decoded []ClientInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if want := h.ClientTable(); !slices.EqualFunc(decoded, want, func(a, b ClientInfo) bool {
+		return a.Key == b.Key && a.IP == b.IP && a.Connected.Equal(b.Connected) &&
+			a.BytesIn == b.BytesIn && a.Reorder == b.Reorder
+	}) {
+		t.Fatalf("decoded %+v, want %+v", decoded, want)
+	}
+}
@@ -1,46 +1,185 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"log/slog"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kelindar/binary"
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/tap"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/internal/transport/obfs"
+	"seras-protocol/internal/transport/server"
 	"seras-protocol/internal/tun"
 	"seras-protocol/pkg/taiga/msg"
 )
 
-// Connection interface for transport-agnostic handling
-type Connection interface {
-	Send(data []byte) error
+// tunErrorBackoff is how long the TUN reader waits after a failed read
+const tunErrorBackoff = 10 * time.Millisecond
+
+// Connection is a client connection of any transport. Sessions and return
+// routes are keyed on it, so a transport must hand the handler the same value
+// for every message from one client, as the WSS server (per socket) and UDP
+// server (per connection ID, or address for untagged clients) do.
+type Connection = server.Connection
+
+// session holds per-client state established by the handshake
+type session struct {
+	publicKey msg.Key
+	encoder   *msg.Encoder      // Encrypts responses to this client
+	decoder   *msg.Decoder      // Opens per-message ECDH data in the negotiated version
+	keys      *msg.Session      // Session-mode keys; nil when the client uses per-message ECDH
+	window    *msg.ReplayWindow // Tracks incoming data nonces
+	ip        netip.Addr        // Address assigned from the pool
+	ip6       netip.Addr        // IPv6 address assigned from the v6 pool, if enabled
+	relay     bool              // The client is a node relaying one circuit
+	circuit   netip.Addr        // Source the relayed circuit sends from; guarded by h.mu
+	circuit6  netip.Addr        // IPv6 source the relayed circuit sends from; guarded by h.mu
+	limiter   *rateLimiter      // Caps traffic from this client; nil when unlimited
+	since     time.Time         // When the handshake completed
+	bytesIn   atomic.Uint64     // Payload bytes received from the client
+	bytesOut  atomic.Uint64     // Payload bytes sent to the client from the TUN
 }
 
 // Handler processes packets between clients and TUN interface
 type Handler struct {
-	tun        *tun.TUN
+	tun        tun.Device
 	decoder    *msg.Decoder
 	privateKey msg.Key
-	// Map connection to its encoder (for responses)
-	connEncoders map[Connection]*msg.Encoder
-	mu           sync.RWMutex
+	publicKey  msg.Key // Vouches for this node's relay links to next hops
+	pool       *IPPool
+	pool6      *IPPool    // IPv6 addresses; nil when IPv6 is disabled
+	allowlist  *Allowlist // Permitted client keys; nil allows any client
+	tap        *tap.Tap   // Debug capture of plaintext packets
+	// Recently accepted handshakes, to reject replays
+	handshakes *handshakeCache
+	// Compression and padding applied to responses
+	compression msg.Compression
+	padding     msg.Padding
+	padSize     int
+	// Cipher suites clients may use, preferred first
+	suites []msg.Suite
+	// Bound on client clock drift; 0 when data timestamps aren't checked
+	timestampSkew time.Duration
+	skewRejected  atomic.Uint64
+	// Map connection to its session (for responses)
+	sessions map[Connection]*session
+	// Map assigned IP to its connection (for routing TUN packets)
+	routes map[netip.Addr]Connection
+	mu     sync.RWMutex
+	// Upstream links to next hops for multi-hop circuits, dialed on first use
+	// and closed after relayIdle without traffic
+	relays        map[relayKey]*relayLink
+	relayMu       sync.Mutex
+	relayIdle     time.Duration
+	relaySweeping bool // An idle sweep is running; guarded by relayMu
+	dialRelay     func(ctx context.Context, hop *msg.NextHop, identity msg.Key) (client.Client, error)
+	// TCP connections originated for proxy-mode clients
+	streams  map[streamKey]*proxyStream
+	streamMu sync.Mutex
+	// Rate limits on traffic from clients
+	clientLimit   RateLimit
+	globalLimiter *rateLimiter
+	rateLimited   atomic.Uint64
+	// Egress filter on client packets; nil allows everything
+	acl        *ACL
+	aclDropped atomic.Uint64
+	// Packets from source addresses their client was not leased
+	spoofDropped atomic.Uint64
+	// Obfuscates links to next hops; nil when disabled
+	obfuscator *obfs.Obfuscator
+	// Tunnel MTU that TCP SYN MSS options are clamped to; 0 when off
+	clampMTU int
+	// Network settings recommended to clients in handshake acks
+	clientMTU int
+	clientDNS []string
 }
 
 // NewHandler creates a new packet handler
-func NewHandler(t *tun.TUN, privateKey msg.Key) *Handler {
-	return &Handler{
-		tun:          t,
-		decoder:      msg.NewDecoder(privateKey),
-		privateKey:   privateKey,
-		connEncoders: make(map[Connection]*msg.Encoder),
+func NewHandler(t tun.Device, privateKey msg.Key, pool *IPPool) *Handler {
+	publicKey, _ := msg.PublicKeyFromPrivate(privateKey)
+
+	h := &Handler{
+		tun:        t,
+		decoder:    msg.NewDecoder(privateKey),
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		pool:       pool,
+		handshakes: newHandshakeCache(time.Now),
+		suites:     msg.SupportedSuites,
+		sessions:   make(map[Connection]*session),
+		routes:     make(map[netip.Addr]Connection),
+		relays:     make(map[relayKey]*relayLink),
+		relayIdle:  DefaultRelayIdleTimeout,
+		streams:    make(map[streamKey]*proxyStream),
 	}
+	h.dialRelay = h.dialHop
+	return h
+}
+
+// SetCompression sets payload compression for responses to clients
+func (h *Handler) SetCompression(c msg.Compression) {
+	h.compression = c
+}
+
+// SetCipherSuites limits clients to the given cipher suites, preferring
+// earlier ones when a client offers several. A client offering none of them
+// is rejected. Must be called before clients connect.
+func (h *Handler) SetCipherSuites(suites []msg.Suite) {
+	h.suites = suites
+}
+
+// SetTimestampSkew rejects data from clients, and responses from next hops,
+// stamped further than skew from the node's clock (0 = not checked).
+// Must be called before clients connect.
+func (h *Handler) SetTimestampSkew(skew time.Duration) {
+	h.timestampSkew = skew
+}
+
+// SkewRejected returns how many packets were rejected for their timestamps
+func (h *Handler) SkewRejected() uint64 {
+	return h.skewRejected.Load()
+}
+
+// SetPadding pads responses to clients; size is the length PaddingMax pads to
+func (h *Handler) SetPadding(p msg.Padding, size int) {
+	h.padding = p
+	h.padSize = size
+}
+
+// SetClientNetwork recommends a TUN MTU and resolvers to clients in each
+// handshake ack. Zero and empty leave clients with their own settings.
+func (h *Handler) SetClientNetwork(mtu int, dns []string) {
+	h.clientMTU = mtu
+	h.clientDNS = dns
+}
+
+// SetIPv6Pool enables IPv6 by leasing each client an address from pool
+func (h *Handler) SetIPv6Pool(pool *IPPool) {
+	h.pool6 = pool
+}
+
+// SetObfuscator obfuscates frames on links to next hops, which must share the key
+func (h *Handler) SetObfuscator(o *obfs.Obfuscator) {
+	h.obfuscator = o
+}
+
+// SetTap records plaintext packets in both directions for debugging
+func (h *Handler) SetTap(t *tap.Tap) {
+	h.tap = t
 }
 
 // HandleMessage processes incoming encrypted message from client
 func (h *Handler) HandleMessage(conn Connection, data []byte) {
-	// Unmarshal wire format
-	rawMsg := &msg.RawMsg{}
-	if err := binary.Unmarshal(data, rawMsg); err != nil {
-		slog.Error("Failed to unmarshal message", "error", err)
+	// Decode wire format, rejecting oversized or malformed messages
+	rawMsg, err := msg.Decode(data)
+	if err != nil {
+		slog.Warn("Rejecting malformed message", "error", err)
 		return
 	}
 
@@ -48,10 +187,12 @@ func (h *Handler) HandleMessage(conn Connection, data []byte) {
 	switch rawMsg.Header.Type {
 	case msg.TypeHandshake:
 		h.handleHandshake(conn, rawMsg)
-	case msg.TypeData:
+	case msg.TypeData, msg.TypeSessionData:
 		h.handleData(conn, rawMsg)
+	case msg.TypeRekey:
+		h.handleRekey(conn, rawMsg)
 	default:
-		slog.Warn("Unknown message type", "type", rawMsg.Header.Type)
+		slog.Warn("Unexpected message type", "type", rawMsg.Header.Type)
 	}
 }
 
@@ -61,35 +202,211 @@ func (h *Handler) handleHandshake(conn Connection, rawMsg *msg.RawMsg) {
 	hs, err := h.decoder.DecryptHandshake(rawMsg)
 	if err != nil {
 		slog.Error("Failed to decrypt handshake", "error", err)
-		h.sendHandshakeAck(conn, nil, false, "decrypt error")
+		h.sendHandshakeAck(conn, rawMsg.Header, nil, &msg.HandshakeAck{Message: "decrypt error"})
+		return
+	}
+
+	// A replay gets no ack, so it learns nothing
+	if err := h.handshakes.accept(conn, rawMsg.Header.Nonce, hs.Timestamp); err != nil {
+		slog.Warn("Rejecting handshake", "pubkey", hs.ClientPublicKey[:8], "error", err)
+		return
+	}
+
+	// Settle the protocol version and cipher suite the session speaks
+	version, err := msg.NegotiateVersion(hs.OfferedVersions(rawMsg.Header), msg.SupportedVersions)
+	if err != nil {
+		slog.Warn("Rejecting client", "pubkey", hs.ClientPublicKey[:8], "error", err)
+		h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{Message: err.Error()})
+		return
+	}
+	suite, err := msg.NegotiateSuite(hs.OfferedSuites(), h.suites)
+	if err != nil {
+		slog.Warn("Rejecting client", "pubkey", hs.ClientPublicKey[:8], "error", err)
+		h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{Message: err.Error()})
+		return
+	}
+
+	// Only listed clients may connect. A relay link's own key is fresh, so
+	// the node relaying it is the one that must be listed.
+	if prover := hs.Prover(); h.allowlist != nil && !h.allowlist.Allowed(prover) {
+		slog.Warn("Rejecting unauthorized client", "pubkey", prover[:8])
+		h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{Message: "client not authorized"})
 		return
 	}
 
-	// Store encoder for this client's public key
+	// Lease an address for this client's public key
+	ip, err := h.pool.Allocate(hs.ClientPublicKey)
+	if err != nil {
+		slog.Warn("Rejecting client", "pubkey", hs.ClientPublicKey[:8], "error", err)
+		h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{Message: err.Error()})
+		return
+	}
+
+	var ip6 netip.Addr
+	if h.pool6 != nil {
+		ip6, err = h.pool6.Allocate(hs.ClientPublicKey)
+		if err != nil {
+			slog.Warn("Rejecting client", "pubkey", hs.ClientPublicKey[:8], "error", err)
+			h.pool.Release(hs.ClientPublicKey)
+			h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{Message: err.Error()})
+			return
+		}
+	}
+
+	// Session mode replaces per-message ECDH with ratcheted symmetric keys
+	var seed msg.Key
+	var keys *msg.Session
+	if hs.Session {
+		if seed, err = msg.NewSessionSeed(); err == nil {
+			keys, err = msg.NewSessionWithSuite(seed, false, version, suite)
+		}
+		if err != nil {
+			slog.Warn("Session mode unavailable, using per-message keys", "pubkey", hs.ClientPublicKey[:8], "error", err)
+			seed, keys = msg.Key{}, nil
+		} else {
+			keys.Compression = h.compression
+			keys.Padding, keys.PadSize = h.padding, h.padSize
+			keys.TimestampSkew = h.timestampSkew
+		}
+	}
+
+	// Store session, dropping any older connection of the same client.
+	// A transport marks a connection closed before RemoveConnection takes
+	// the lock, so a client gone mid-handshake is caught here or removed
+	// there, and never leaves a session behind.
 	h.mu.Lock()
-	h.connEncoders[conn] = msg.NewEncoder(hs.ClientPublicKey)
+	if server.Closed(conn) {
+		// The leases stay with a session the client holds on another connection
+		if !h.hasSession(hs.ClientPublicKey) {
+			h.releaseAddrs(&session{publicKey: hs.ClientPublicKey, ip: ip, ip6: ip6})
+		}
+		h.mu.Unlock()
+		slog.Info("Client left during handshake", "pubkey", hs.ClientPublicKey[:8])
+		return
+	}
+	// Relay links were dialed for the session they served, and another client
+	// taking over conn inherits none of the last one's state
+	prev, replaced := h.sessions[conn]
+	departed := replaced && prev.publicKey != hs.ClientPublicKey
+	if departed {
+		h.releaseAddrs(prev)
+	}
+	var evicted []Connection
+	for oldConn, old := range h.sessions {
+		if oldConn != conn && old.publicKey == hs.ClientPublicKey {
+			evicted = append(evicted, oldConn)
+		}
+	}
+	encoder := msg.NewEncoder(hs.ClientPublicKey)
+	encoder.Version = version
+	encoder.Suite = suite
+	encoder.Compression = h.compression
+	encoder.Padding, encoder.PadSize = h.padding, h.padSize
+	h.sessions[conn] = &session{
+		publicKey: hs.ClientPublicKey,
+		encoder:   encoder,
+		decoder:   &msg.Decoder{PrivateKey: h.privateKey, Version: version, Suite: suite, TimestampSkew: h.timestampSkew},
+		keys:      keys,
+		window:    msg.NewReplayWindow(),
+		ip:        ip,
+		ip6:       ip6,
+		relay:     hs.Relay != msg.Key{},
+		limiter:   newRateLimiter(h.clientLimit, time.Now),
+		since:     time.Now(),
+	}
+	h.routes[ip] = conn
+	assignedIP6 := ""
+	if ip6.IsValid() {
+		h.routes[ip6] = conn
+		assignedIP6 = ip6.String()
+	}
+	// The leases now route to conn, so dropping the old sessions keeps them
+	for _, oldConn := range evicted {
+		h.dropSession(oldConn)
+	}
 	h.mu.Unlock()
 
-	slog.Info("Client registered", "pubkey", hs.ClientPublicKey[:8])
+	if replaced {
+		h.closeRelays(conn)
+	}
+	if departed {
+		h.closeStreams(conn)
+	}
+	for _, oldConn := range evicted {
+		h.closeRelays(oldConn)
+		h.closeStreams(oldConn)
+	}
+
+	slog.Info("Client registered", "pubkey", hs.ClientPublicKey[:8], "ip", ip, "ip6", assignedIP6, "session", keys != nil, "version", version, "suite", suite)
 
 	// Send ack
-	h.sendHandshakeAck(conn, &hs.ClientPublicKey, true, "ok")
+	h.sendHandshakeAck(conn, rawMsg.Header, &hs.ClientPublicKey, &msg.HandshakeAck{
+		Success:     true,
+		Message:     "ok",
+		AssignedIP:  ip.String(),
+		AssignedIP6: assignedIP6,
+		SessionSeed: seed,
+		Version:     version,
+		Suite:       suite,
+		MTU:         uint32(h.clientMTU),
+		DNS:         h.clientDNS,
+	})
 }
 
-// sendHandshakeAck sends handshake acknowledgment to client
-func (h *Handler) sendHandshakeAck(conn Connection, clientPubKey *msg.Key, success bool, message string) {
-	ack := &msg.HandshakeAck{
-		Success: success,
-		Message: message,
+// dropSession removes conn's session and the routes it owns. Its leases are
+// released unless another connection of the same client now holds them.
+// Must be called with h.mu held; the caller closes conn's relays and streams.
+func (h *Handler) dropSession(conn Connection) {
+	sess, ok := h.sessions[conn]
+	if !ok {
+		return
 	}
+	delete(h.sessions, conn)
+	if h.routes[sess.ip] == conn {
+		h.releaseAddrs(sess)
+	}
+}
+
+// releaseAddrs drops the session's routes and returns its leases to the pools.
+// Must be called with h.mu held.
+func (h *Handler) releaseAddrs(sess *session) {
+	delete(h.routes, sess.ip)
+	h.pool.Release(sess.publicKey)
+	if sess.ip6.IsValid() {
+		delete(h.routes, sess.ip6)
+		h.pool6.Release(sess.publicKey)
+	}
+}
 
+// hasSession reports whether any connection holds a session for key.
+// Must be called with h.mu held.
+func (h *Handler) hasSession(key msg.Key) bool {
+	for _, sess := range h.sessions {
+		if sess.publicKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sendHandshakeAck sends handshake acknowledgment to client, confirmed for
+// the handshake sent under hsHeader
+func (h *Handler) sendHandshakeAck(conn Connection, hsHeader *msg.Header, clientPubKey *msg.Key, ack *msg.HandshakeAck) {
 	// If we don't have client's public key, we can't send encrypted ack
 	if clientPubKey == nil {
 		slog.Error("Cannot send ack - no client public key")
 		return
 	}
 
+	// Lets the client check the ack came from the holder of our private key
+	if err := h.decoder.ConfirmHandshake(hsHeader, *clientPubKey, ack); err != nil {
+		slog.Error("Failed to confirm ack", "error", err)
+		return
+	}
+
+	// Answer in the handshake's version, which the client can read
 	encoder := msg.NewEncoder(*clientPubKey)
+	encoder.Version = hsHeader.Version
 	rawMsg, err := encoder.EncryptHandshakeAck(ack)
 	if err != nil {
 		slog.Error("Failed to encrypt ack", "error", err)
@@ -109,27 +426,72 @@ func (h *Handler) sendHandshakeAck(conn Connection, clientPubKey *msg.Key, succe
 func (h *Handler) handleData(conn Connection, rawMsg *msg.RawMsg) {
 	// Check if client has completed handshake
 	h.mu.RLock()
-	_, hasEncoder := h.connEncoders[conn]
+	sess, registered := h.sessions[conn]
 	h.mu.RUnlock()
 
-	if !hasEncoder {
+	if !registered {
 		slog.Warn("Data from unregistered client, ignoring")
 		return
 	}
 
-	// Decrypt message
-	cookedMsg, err := h.decoder.DecryptBody(rawMsg)
+	// Decrypt message, rejecting replays
+	openBuf := bufpool.Get()
+	cookedMsg, err := sess.decrypt(rawMsg, *openBuf)
+	bufpool.Put(openBuf)
+	if errors.Is(err, msg.ErrStaleMsg) {
+		h.rejectSkewed(sess)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to decrypt message", "error", err)
 		return
 	}
+	// Authentic and not a replay, so a UDP client may have moved here.
+	// Handshakes don't count: the handshake cache lets the same connection
+	// resend one, so a copy could be replayed from another address.
+	server.Verified(conn)
+
+	// A keepalive has done its job by arriving
+	if cookedMsg.Body.Flags&msg.FlagKeepalive != 0 {
+		return
+	}
+
+	// Drop what exceeds the client's or the node's rate limit
+	if !h.admit(sess, len(cookedMsg.Body.Data)) {
+		return
+	}
+	sess.bytesIn.Add(uint64(len(cookedMsg.Body.Data)))
 
 	// Check if this is final destination or needs forwarding
-	if cookedMsg.Body.NextHop != nil {
-		slog.Warn("Multi-hop routing not implemented yet")
+	if nextHop := cookedMsg.Body.NextHop; nextHop != nil {
+		if err := h.forward(conn, nextHop, cookedMsg.Body.Data); err != nil {
+			slog.Error("Failed to forward to next hop", "endpoint", nextHop.Endpoint, "error", err)
+		}
 		return
 	}
 
+	// Proxy-mode clients send TCP streams instead of IP packets
+	if cookedMsg.Body.Flags&msg.FlagStream != 0 {
+		h.handleStream(conn, sess, cookedMsg.Body.Data)
+		return
+	}
+
+	// Drop packets to destinations the operator denies
+	if !h.permit(cookedMsg.Body.Data) {
+		return
+	}
+
+	// Only leased sources reach the TUN; a circuit's is translated to one
+	if !h.claimSource(sess, cookedMsg.Body.Data) {
+		return
+	}
+
+	if h.clampMTU != 0 {
+		clampMSS(cookedMsg.Body.Data, h.clampMTU)
+	}
+
+	h.tap.Capture(tap.Inbound, cookedMsg.Body.Data)
+
 	// Final destination - write IP packet to TUN
 	n, err := h.tun.Write(cookedMsg.Body.Data)
 	if err != nil {
@@ -141,20 +503,101 @@ func (h *Handler) handleData(conn Connection, rawMsg *msg.RawMsg) {
 	}
 }
 
-// StartTUNReader reads from TUN and sends to connected clients
-func (h *Handler) StartTUNReader() {
-	buf := make([]byte, 1500)
+// handleRekey advances the client's session key
+func (h *Handler) handleRekey(conn Connection, rawMsg *msg.RawMsg) {
+	h.mu.RLock()
+	sess, registered := h.sessions[conn]
+	h.mu.RUnlock()
 
-	for {
+	if !registered || sess.keys == nil {
+		slog.Warn("Rekey outside session mode, ignoring")
+		return
+	}
+
+	if err := sess.keys.HandleRekey(rawMsg, sess.window); err != nil {
+		slog.Error("Failed to process rekey", "error", err)
+	}
+}
+
+// rejectSkewed counts a packet rejected for its timestamp. Many of them mean
+// a client's clock has drifted rather than an attack, so the warning says so.
+// Logged on powers of two so a drifting client doesn't flood the log.
+func (h *Handler) rejectSkewed(sess *session) {
+	if n := h.skewRejected.Add(1); n&(n-1) == 0 {
+		slog.Warn("Rejecting packets outside the allowed clock skew; check clocks are synced", "rejected", n, "skew", h.timestampSkew, "pubkey", sess.publicKey[:8])
+	}
+}
+
+// decrypt opens a data message from the client, rejecting replays.
+// Session-mode clients must use their session keys.
+func (s *session) decrypt(rawMsg *msg.RawMsg, dst []byte) (*msg.CookedMsg, error) {
+	if s.keys == nil {
+		return s.decoder.DecryptBodyChecked(rawMsg, s.window, dst)
+	}
+	return s.keys.DecryptBodyChecked(rawMsg, s.window, dst)
+}
+
+// encrypt seals a message for the client. In session mode a due rekey is
+// announced on conn before the message is sealed with the new key.
+func (s *session) encrypt(conn Connection, message *msg.Msg, dst []byte) (*msg.RawMsg, error) {
+	if s.keys == nil {
+		return s.encoder.EncryptMsg(message, dst)
+	}
+
+	if s.keys.RekeyDue() {
+		rekey, err := s.keys.Rekey()
+		if err != nil {
+			return nil, err
+		}
+		data, err := binary.Marshal(rekey)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Send(data); err != nil {
+			return nil, err
+		}
+	}
+	return s.keys.EncryptMsg(message, dst)
+}
+
+// StartTUNReader reads from TUN and sends to connected clients until ctx is
+// cancelled or the TUN is closed. A blocked read only returns once the TUN
+// is closed, so callers stop the reader by cancelling ctx, then closing it.
+func (h *Handler) StartTUNReader(ctx context.Context) {
+	buf := make([]byte, h.tun.MTU())
+	sealBuf := bufpool.Get()
+	defer bufpool.Put(sealBuf)
+
+	for ctx.Err() == nil {
 		n, err := h.tun.Read(buf)
+		if errors.Is(err, tun.ErrClosed) {
+			slog.Info("TUN closed, stopping reader")
+			return
+		}
 		if err != nil {
 			slog.Error("Failed to read from TUN", "error", err)
+			// Don't spin on a device that keeps failing
+			select {
+			case <-ctx.Done():
+			case <-time.After(tunErrorBackoff):
+			}
 			continue
 		}
 
-		if n == 0 {
+		// Only the client owning the destination address gets the packet
+		conn, sess, ok := h.routeFor(buf[:n])
+		if !ok {
 			continue
 		}
+		if sess.relay && !h.restoreCircuit(sess, buf[:n]) {
+			continue
+		}
+
+		if h.clampMTU != 0 {
+			clampMSS(buf[:n], h.clampMTU)
+		}
+
+		h.tap.Capture(tap.Outbound, buf[:n])
 
 		// Create response message
 		message := &msg.Msg{
@@ -164,31 +607,38 @@ func (h *Handler) StartTUNReader() {
 			Data:      buf[:n],
 		}
 
-		// Send to all registered clients with their specific encoders
-		h.mu.RLock()
-		for conn, encoder := range h.connEncoders {
-			rawMsg, err := encoder.EncryptMsg(message)
-			if err != nil {
-				slog.Error("Failed to encrypt response", "error", err)
-				continue
-			}
+		rawMsg, err := sess.encrypt(conn, message, *sealBuf)
+		if err != nil {
+			slog.Error("Failed to encrypt response", "error", err)
+			continue
+		}
 
-			data, err := binary.Marshal(rawMsg)
-			if err != nil {
-				slog.Error("Failed to marshal response", "error", err)
-				continue
-			}
+		data, err := binary.Marshal(rawMsg)
+		if err != nil {
+			slog.Error("Failed to marshal response", "error", err)
+			continue
+		}
 
-			conn.Send(data)
+		if err := conn.Send(data); err == nil {
+			sess.bytesOut.Add(uint64(n))
 		}
-		h.mu.RUnlock()
 	}
 }
 
-// RemoveConnection removes encoder for disconnected client
+// Clients returns the number of connected clients
+func (h *Handler) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.sessions)
+}
+
+// RemoveConnection removes session for disconnected client and frees its IP
 func (h *Handler) RemoveConnection(conn Connection) {
 	h.mu.Lock()
-	delete(h.connEncoders, conn)
+	h.dropSession(conn)
 	h.mu.Unlock()
+
+	h.closeRelays(conn)
+	h.closeStreams(conn)
 	slog.Info("Client disconnected")
 }
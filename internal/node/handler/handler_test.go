@@ -0,0 +1,750 @@
+package handler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/internal/netpkt"
+	udpclient "seras-protocol/internal/transport/client/udp"
+	wssclient "seras-protocol/internal/transport/client/wss"
+	udpserver "seras-protocol/internal/transport/server/udp"
+	wssserver "seras-protocol/internal/transport/server/wss"
+	"seras-protocol/internal/tun"
+	"seras-protocol/internal/tun/tuntest"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// testTimeout bounds every wait for a packet
+const testTimeout = 5 * time.Second
+
+// remoteAddr stands in for a host on the internet (TEST-NET-2)
+var remoteAddr = netip.MustParseAddr("198.51.100.1")
+
+// testNode is a handler behind a UDP server on loopback, with an in-memory TUN
+type testNode struct {
+	handler   *Handler
+	dev       *tuntest.Device
+	publicKey msg.Key
+	addr      string
+	wsURL     string // Set by startWSS
+}
+
+func startUDPNode(t *testing.T) *testNode {
+	t.Helper()
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewIPPool("10.77.0.0/24", "10.77.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{dev: tuntest.New("node0", 1500, 16), publicKey: publicKey}
+	n.handler = NewHandler(n.dev, privateKey, pool)
+
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.addr = sock.LocalAddr().String()
+	sock.Close()
+
+	s := udpserver.NewServer(n.addr, func(conn *udpserver.Connection, data []byte) {
+		n.handler.HandleMessage(conn, data)
+	})
+	s.SetOnDisconnect(func(conn *udpserver.Connection) { n.handler.RemoveConnection(conn) })
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Start() }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		t.Fatalf("start UDP server: %v", err)
+	}
+
+	ctx, stopReader := context.WithCancel(context.Background())
+	readerDone := make(chan struct{})
+	go func() {
+		n.handler.StartTUNReader(ctx)
+		close(readerDone)
+	}()
+
+	t.Cleanup(func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Stop(stopCtx)
+		stopReader()
+		n.dev.Close()
+		<-readerDone
+	})
+	return n
+}
+
+// startWSS serves the node's handler over WebSocket too, as a node
+// listening on both transports does
+func (n *testNode) startWSS(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := wssserver.NewServer(addr, func(conn *wssserver.Connection, data []byte) {
+		n.handler.HandleMessage(conn, data)
+	})
+	s.SetOnDisconnect(func(conn *wssserver.Connection) { n.handler.RemoveConnection(conn) })
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Start() }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		t.Fatalf("start WSS server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Stop(ctx)
+	})
+	n.wsURL = "ws://" + addr + "/ws"
+}
+
+// clientTransport is the client end of either transport a testNode serves
+type clientTransport interface {
+	Send(data []byte) error
+	Receive() ([]byte, error)
+	ReceiveContext(ctx context.Context) ([]byte, error)
+	Disconnect() error
+}
+
+// testClient speaks the protocol to a testNode over its own connection
+type testClient struct {
+	transport  clientTransport
+	privateKey msg.Key
+	decoder    *msg.Decoder
+	encoder    *msg.Encoder
+	ip         netip.Addr
+}
+
+// connect handshakes with the node over UDP and returns the client with its
+// leased address
+func (n *testNode) connect(t *testing.T) *testClient {
+	t.Helper()
+	transport, err := udpclient.NewTransport(&udpclient.Config{Addr: n.addr, ReadTimeout: testTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.join(t, transport)
+}
+
+// connectWS is connect over the node's WebSocket server
+func (n *testNode) connectWS(t *testing.T) *testClient {
+	t.Helper()
+	transport, err := wssclient.NewTransport(&wssclient.Config{Url: n.wsURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.join(t, transport)
+}
+
+// join handshakes with the node over transport
+func (n *testNode) join(t *testing.T, transport clientTransport) *testClient {
+	t.Helper()
+	t.Cleanup(func() { transport.Disconnect() })
+	privateKey, publicKey, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoder := msg.NewEncoder(n.publicKey)
+	hs := &msg.Handshake{ClientPublicKey: publicKey, Timestamp: time.Now().Unix()}
+	rawHs, err := encoder.EncryptHandshake(hs, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{transport: transport, privateKey: privateKey, decoder: msg.NewDecoder(privateKey), encoder: encoder}
+	c.send(t, rawHs)
+
+	rawAck := c.receive(t)
+	ack, err := c.decoder.DecryptHandshakeAck(rawAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decoder.VerifyHandshakeAck(rawHs.Header, n.publicKey, ack); err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Success {
+		t.Fatalf("handshake rejected: %s", ack.Message)
+	}
+	c.decoder.Version, c.decoder.Suite = ack.Version, ack.Suite
+	c.encoder.Version, c.encoder.Suite = ack.Version, ack.Suite
+	if c.ip, err = netip.ParseAddr(ack.AssignedIP); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *testClient) send(t *testing.T, rawMsg *msg.RawMsg) {
+	t.Helper()
+	data, err := kbinary.Marshal(rawMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.transport.Send(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) receive(t *testing.T) *msg.RawMsg {
+	t.Helper()
+	data, err := c.transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawMsg, err := msg.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawMsg
+}
+
+// sendPacket tunnels an IP packet to the node
+func (c *testClient) sendPacket(t *testing.T, packet []byte) {
+	t.Helper()
+	rawMsg, err := c.encoder.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: packet}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send(t, rawMsg)
+}
+
+// receivePacket returns the next IP packet the node tunnels back
+func (c *testClient) receivePacket(t *testing.T) []byte {
+	t.Helper()
+	cooked, err := c.decoder.DecryptBody(c.receive(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cooked.Body.Data
+}
+
+// udpPacket builds an IPv4/UDP packet carrying id as its IP identification
+func udpPacket(src, dst netip.Addr, id uint16) []byte {
+	packet := make([]byte, 20+8+4)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:], id)
+	packet[8] = 64
+	packet[9] = 17
+	s, d := src.As4(), dst.As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 9)
+	binary.BigEndian.PutUint16(packet[24:], uint16(len(packet)-20))
+	copy(packet[28:], "ping")
+	netpkt.Fix(packet)
+	return packet
+}
+
+// udp6Packet builds an IPv6/UDP packet carrying id as its flow label
+func udp6Packet(src, dst netip.Addr, id uint16) []byte {
+	packet := make([]byte, 40+8+4)
+	binary.BigEndian.PutUint32(packet[0:], 6<<28|uint32(id))
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+	packet[6] = 17
+	packet[7] = 64
+	s, d := src.As16(), dst.As16()
+	copy(packet[8:24], s[:])
+	copy(packet[24:40], d[:])
+	binary.BigEndian.PutUint16(packet[40:], 40000)
+	binary.BigEndian.PutUint16(packet[42:], 9)
+	binary.BigEndian.PutUint16(packet[44:], uint16(len(packet)-40))
+	copy(packet[48:], "ping")
+	netpkt.Fix(packet)
+	return packet
+}
+
+// readTUN returns the next packet the handler writes to the TUN
+func (n *testNode) readTUN(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case packet := <-n.dev.Written:
+		return packet
+	case <-time.After(testTimeout):
+		t.Fatal("no packet written to TUN")
+		return nil
+	}
+}
+
+func TestUDPClientsReceiveOnlyTheirOwnPackets(t *testing.T) {
+	n := startUDPNode(t)
+	alice := n.connect(t)
+	bob := n.connect(t)
+	if alice.ip == bob.ip {
+		t.Fatalf("both clients leased %s", alice.ip)
+	}
+
+	// Each client's packet reaches the TUN from its own address
+	for _, c := range []*testClient{alice, bob} {
+		c.sendPacket(t, udpPacket(c.ip, remoteAddr, 1))
+		hdr, err := netpkt.Parse(n.readTUN(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Src != c.ip {
+			t.Fatalf("TUN got source %s, want %s", hdr.Src, c.ip)
+		}
+	}
+
+	// Interleaved replies go back only to the client they are addressed to
+	n.dev.Inject(udpPacket(remoteAddr, alice.ip, 10))
+	n.dev.Inject(udpPacket(remoteAddr, bob.ip, 20))
+	n.dev.Inject(udpPacket(remoteAddr, alice.ip, 11))
+	n.dev.Inject(udpPacket(remoteAddr, bob.ip, 21))
+
+	for _, tc := range []struct {
+		client *testClient
+		ids    []uint16
+	}{
+		{alice, []uint16{10, 11}},
+		{bob, []uint16{20, 21}},
+	} {
+		for _, want := range tc.ids {
+			packet := tc.client.receivePacket(t)
+			hdr, err := netpkt.Parse(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Dst != tc.client.ip {
+				t.Fatalf("client %s got packet for %s", tc.client.ip, hdr.Dst)
+			}
+			if id := binary.BigEndian.Uint16(packet[4:]); id != want {
+				t.Fatalf("client %s got packet %d, want %d", tc.client.ip, id, want)
+			}
+		}
+	}
+
+	// Nothing else is queued for either client
+	for _, c := range []*testClient{alice, bob} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := c.transport.ReceiveContext(ctx)
+		cancel()
+		if err == nil {
+			t.Fatalf("client %s got an extra message", c.ip)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("client %s: %v", c.ip, err)
+		}
+	}
+}
+
+func TestClientsOnBothTransports(t *testing.T) {
+	n := startUDPNode(t)
+	n.startWSS(t)
+	overUDP := n.connect(t)
+	overWS := n.connectWS(t)
+	if overUDP.ip == overWS.ip {
+		t.Fatalf("both clients leased %s", overUDP.ip)
+	}
+	if got := n.handler.Clients(); got != 2 {
+		t.Fatalf("handler has %d clients, want 2", got)
+	}
+
+	for i, c := range []*testClient{overUDP, overWS} {
+		c.sendPacket(t, udpPacket(c.ip, remoteAddr, uint16(i)))
+		hdr, err := netpkt.Parse(n.readTUN(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Src != c.ip {
+			t.Fatalf("TUN got source %s, want %s", hdr.Src, c.ip)
+		}
+	}
+
+	// Replies find each client whichever transport it came in on
+	n.dev.Inject(udpPacket(remoteAddr, overWS.ip, 20))
+	n.dev.Inject(udpPacket(remoteAddr, overUDP.ip, 10))
+	for _, tc := range []struct {
+		client *testClient
+		id     uint16
+	}{
+		{overUDP, 10},
+		{overWS, 20},
+	} {
+		packet := tc.client.receivePacket(t)
+		if id := binary.BigEndian.Uint16(packet[4:]); id != tc.id {
+			t.Fatalf("client %s got packet %d, want %d", tc.client.ip, id, tc.id)
+		}
+	}
+
+	// Disconnecting from the WebSocket server frees only that client
+	overWS.transport.Disconnect()
+	deadline := time.Now().Add(testTimeout)
+	for n.handler.Clients() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("handler has %d clients after a disconnect, want 1", n.handler.Clients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.dev.Inject(udpPacket(remoteAddr, overUDP.ip, 11))
+	if id := binary.BigEndian.Uint16(overUDP.receivePacket(t)[4:]); id != 11 {
+		t.Fatalf("UDP client got packet %d after the disconnect, want 11", id)
+	}
+}
+
+// fakeConn is a client connection that records what the handler sends it
+type fakeConn struct {
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (c *fakeConn) Send(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+// newTestHandler returns a handler on an in-memory TUN leasing from 10.77.0.0/24
+func newTestHandler(tb testing.TB) *Handler {
+	tb.Helper()
+	privateKey, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pool, err := NewIPPool("10.77.0.0/24", "10.77.0.1")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewHandler(tuntest.New("node0", 1500, 16), privateKey, pool)
+}
+
+// addSession registers a session for conn leased ip, as a handshake would
+func (h *Handler) addSession(conn Connection, ip netip.Addr) *session {
+	var key msg.Key
+	copy(key[:], ip.AsSlice())
+	sess := &session{publicKey: key, ip: ip, window: msg.NewReplayWindow()}
+	h.mu.Lock()
+	h.sessions[conn] = sess
+	h.routes[ip] = conn
+	h.mu.Unlock()
+	return sess
+}
+
+// messages returns what the handler sent on c so far
+func (c *fakeConn) messages() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.sent...)
+}
+
+// keyPair returns a fresh client key pair
+func keyPair(tb testing.TB) (private, public msg.Key) {
+	tb.Helper()
+	private, public, err := msg.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return private, public
+}
+
+// sealHandshake seals hs for h, proven with prover's private key, and
+// marshals it for HandleMessage
+func sealHandshake(tb testing.TB, h *Handler, hs *msg.Handshake, prover msg.Key) (*msg.RawMsg, []byte) {
+	tb.Helper()
+	nodePublic, err := msg.PublicKeyFromPrivate(h.privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if hs.Timestamp == 0 {
+		hs.Timestamp = time.Now().Unix()
+	}
+	rawMsg, err := msg.NewEncoder(nodePublic).EncryptHandshake(hs, prover)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data, err := kbinary.Marshal(rawMsg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return rawMsg, data
+}
+
+// handshake sends conn's handshake from the client holding private and
+// returns the ack, or nil when the handler didn't answer
+func handshake(t *testing.T, h *Handler, conn *fakeConn, private msg.Key) *msg.HandshakeAck {
+	t.Helper()
+	public, err := msg.PublicKeyFromPrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+	return handleHandshake(t, h, conn, data, private)
+}
+
+// handleHandshake hands the handler a sealed handshake and opens its ack
+// with private, or returns nil when the handler didn't answer
+func handleHandshake(t *testing.T, h *Handler, conn *fakeConn, data []byte, private msg.Key) *msg.HandshakeAck {
+	t.Helper()
+	before := len(conn.messages())
+	h.HandleMessage(conn, data)
+	sent := conn.messages()
+	if len(sent) == before {
+		return nil
+	}
+	rawAck, err := msg.Decode(sent[len(sent)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := msg.NewDecoder(private).DecryptHandshakeAck(rawAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ack
+}
+
+func TestRepliesFollowStaticKeyAcrossEphemerals(t *testing.T) {
+	n := startUDPNode(t)
+	c := n.connect(t)
+	public, err := msg.PublicKeyFromPrivate(c.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every data message carries a fresh ephemeral key
+	var ephemerals []msg.Key
+	for id := range uint16(3) {
+		rawMsg, err := c.encoder.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: udpPacket(c.ip, remoteAddr, id)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ephemerals = append(ephemerals, rawMsg.Header.EphemeralKey)
+		c.send(t, rawMsg)
+		n.readTUN(t)
+	}
+	if ephemerals[0] == ephemerals[1] || ephemerals[1] == ephemerals[2] {
+		t.Fatal("client reused an ephemeral key")
+	}
+
+	n.handler.mu.RLock()
+	for _, sess := range n.handler.sessions {
+		if sess.encoder.NodePublicKey != public {
+			t.Errorf("replies sealed to %x, want the client's static key", sess.encoder.NodePublicKey[:8])
+		}
+	}
+	n.handler.mu.RUnlock()
+
+	// The reply opens with the client's static key alone
+	n.dev.Inject(udpPacket(remoteAddr, c.ip, 10))
+	reply := c.receivePacket(t)
+	if id := binary.BigEndian.Uint16(reply[4:]); id != 10 {
+		t.Fatalf("client got packet %d, want 10", id)
+	}
+}
+
+// failingDevice is an in-memory TUN whose reads fail until it is closed
+type failingDevice struct {
+	*tuntest.Device
+	reads  atomic.Int32
+	closed atomic.Bool
+}
+
+func (d *failingDevice) Read(buf []byte) (int, error) {
+	d.reads.Add(1)
+	if d.closed.Load() {
+		return 0, tun.ErrClosed
+	}
+	return 0, errors.New("input/output error")
+}
+
+func (d *failingDevice) Close() error {
+	d.closed.Store(true)
+	return d.Device.Close()
+}
+
+func TestTUNReaderStopsOnClose(t *testing.T) {
+	dev := &failingDevice{Device: tuntest.New("node0", 1500, 16)}
+	h := newTestHandler(t)
+	h.tun = dev
+	done := make(chan struct{})
+	go func() {
+		h.StartTUNReader(context.Background())
+		close(done)
+	}()
+
+	// Failures back off rather than spin
+	time.Sleep(100 * time.Millisecond)
+	if reads := dev.reads.Load(); reads > 15 {
+		t.Fatalf("%d failed reads in 100ms", reads)
+	}
+
+	dev.Close()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("reader still running after the TUN closed")
+	}
+}
+
+// runReader starts h's TUN reader and returns a channel closed when it returns
+func runReader(h *Handler, ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		h.StartTUNReader(ctx)
+		close(done)
+	}()
+	return done
+}
+
+// waitStopped fails the test unless done closes within a second
+func waitStopped(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader still running a second after it was stopped")
+	}
+}
+
+func TestTUNReaderStopsOnCancel(t *testing.T) {
+	t.Run("failing reads", func(t *testing.T) {
+		h := newTestHandler(t)
+		h.tun = &failingDevice{Device: tuntest.New("node0", 1500, 16)}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := runReader(h, ctx)
+		time.Sleep(30 * time.Millisecond)
+		cancel() // Interrupts the backoff; the device stays open
+		waitStopped(t, done)
+	})
+
+	t.Run("between packets", func(t *testing.T) {
+		dev := tuntest.New("node0", 1500, 16)
+		h := newTestHandler(t)
+		h.tun = dev
+		ctx, cancel := context.WithCancel(context.Background())
+		done := runReader(h, ctx)
+		cancel()
+		// A packet for nobody completes the read in progress
+		dev.Inject(udpPacket(remoteAddr, netip.MustParseAddr("10.77.0.9"), 1))
+		waitStopped(t, done)
+		dev.Close()
+	})
+
+	t.Run("blocked read", func(t *testing.T) {
+		dev := tuntest.New("node0", 1500, 16)
+		h := newTestHandler(t)
+		h.tun = dev
+		ctx, cancel := context.WithCancel(context.Background())
+		done := runReader(h, ctx)
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		dev.Close() // As the node does after cancelling
+		waitStopped(t, done)
+	})
+}
+
+func TestUDPClientKeepsSessionAcrossAddressChange(t *testing.T) {
+	n := startUDPNode(t)
+	c := n.connect(t)
+	transport := c.transport.(*udpclient.Transport)
+	c.sendPacket(t, udpPacket(c.ip, remoteAddr, 1))
+	n.readTUN(t)
+
+	// Switching networks mid-session: the same client from a new port
+	before := transport.LocalAddr().String()
+	if err := transport.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	if after := transport.LocalAddr().String(); after == before {
+		t.Fatalf("rebind kept address %s", before)
+	}
+
+	c.sendPacket(t, udpPacket(c.ip, remoteAddr, 2))
+	hdr, err := netpkt.Parse(n.readTUN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Src != c.ip {
+		t.Fatalf("TUN got source %s after the move, want %s", hdr.Src, c.ip)
+	}
+
+	// Replies follow the client to its new address, on the same lease
+	n.dev.Inject(udpPacket(remoteAddr, c.ip, 3))
+	if hdr, err := netpkt.Parse(c.receivePacket(t)); err != nil || hdr.Dst != c.ip {
+		t.Fatalf("reply after the move: %+v, %v", hdr, err)
+	}
+	if n.handler.Clients() != 1 {
+		t.Fatalf("%d clients after the move, want 1", n.handler.Clients())
+	}
+}
+
+func TestHandshakeNegotiatesVersion(t *testing.T) {
+	future := msg.Version("taiga_v9")
+	tests := []struct {
+		name    string
+		offered []msg.Version
+		want    msg.Version // Empty when the client is turned away
+	}{
+		{"matching", []msg.Version{msg.Version2}, msg.Version2},
+		{"partial overlap", []msg.Version{future, msg.Version2}, msg.Version2},
+		{"none listed", nil, msg.Version2},
+		{"no overlap", []msg.Version{future, msg.Version1}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			private, public := keyPair(t)
+			_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public, Versions: tt.offered, Session: true}, private)
+			ack := handleHandshake(t, h, &fakeConn{}, data, private)
+			if ack == nil {
+				t.Fatal("no ack")
+			}
+
+			if tt.want == "" {
+				if ack.Success || !strings.Contains(ack.Message, msg.ErrNoCommonVersion.Error()) {
+					t.Fatalf("ack %+v, want a rejection naming the missing common version", ack)
+				}
+				if h.Clients() != 0 {
+					t.Fatalf("%d clients registered without a common version", h.Clients())
+				}
+				return
+			}
+			if !ack.Success || ack.Version != tt.want {
+				t.Fatalf("ack %+v, want success in %q", ack, tt.want)
+			}
+			// The session the ack hands out speaks that version
+			keys, err := msg.NewSessionWithVersion(ack.SessionSeed, true, ack.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet := udpPacket(netip.MustParseAddr(ack.AssignedIP), netip.MustParseAddr("10.77.0.1"), 1)
+			rawMsg, err := keys.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: packet}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.mu.Lock()
+			var sess *session
+			for _, s := range h.sessions {
+				sess = s
+			}
+			h.mu.Unlock()
+			if _, err := sess.keys.DecryptBodyChecked(rawMsg, msg.NewReplayWindow(), nil); err != nil {
+				t.Fatalf("node can't open the client's session message: %v", err)
+			}
+		})
+	}
+}
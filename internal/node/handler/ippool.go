@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+var ErrPoolExhausted = errors.New("no free addresses in VPN subnet")
+
+// IPPool hands out VPN addresses to clients, keyed by their public key
+type IPPool struct {
+	prefix   netip.Prefix
+	reserved netip.Addr // node's own TUN address
+	leases   map[msg.Key]netip.Addr
+	used     map[netip.Addr]bool
+	mu       sync.Mutex
+}
+
+// NewIPPool creates a pool over subnet (e.g., "11.0.0.0/24") excluding reservedIP
+func NewIPPool(subnet, reservedIP string) (*IPPool, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VPN subnet %q: %w", subnet, err)
+	}
+	reserved, err := netip.ParseAddr(reservedIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUN IP %q: %w", reservedIP, err)
+	}
+
+	return &IPPool{
+		prefix:   prefix.Masked(),
+		reserved: reserved,
+		leases:   make(map[msg.Key]netip.Addr),
+		used:     make(map[netip.Addr]bool),
+	}, nil
+}
+
+// Allocate returns the address leased to key, assigning a free one if needed
+func (p *IPPool) Allocate(key msg.Key) (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if addr, ok := p.leases[key]; ok {
+		return addr, nil
+	}
+
+	// Skip the network address; the last address is broadcast
+	for addr := p.prefix.Addr().Next(); p.prefix.Contains(addr.Next()); addr = addr.Next() {
+		if addr == p.reserved || p.used[addr] {
+			continue
+		}
+		p.leases[key] = addr
+		p.used[addr] = true
+		return addr, nil
+	}
+
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+// Release returns the address leased to key back to the pool
+func (p *IPPool) Release(key msg.Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if addr, ok := p.leases[key]; ok {
+		delete(p.used, addr)
+		delete(p.leases, key)
+	}
+}
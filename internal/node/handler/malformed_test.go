@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// headerSeeds returns a wire message for every pairing of known and unknown
+// versions and types, each with a body that opens under no key
+func headerSeeds(tb testing.TB) [][]byte {
+	tb.Helper()
+	var seeds [][]byte
+	for _, v := range []msg.Version{msg.Version1, msg.Version2, "taiga_v9", ""} {
+		for typ := msg.Type(0); typ <= msg.TypeRekey+1; typ++ {
+			data, err := kbinary.Marshal(&msg.RawMsg{
+				Header: &msg.Header{Version: v, Type: typ},
+				Body:   []byte("not a sealed message"),
+			})
+			if err != nil {
+				tb.Fatal(err)
+			}
+			seeds = append(seeds, data)
+		}
+	}
+	data, err := kbinary.Marshal(&msg.RawMsg{Body: []byte("no header")})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return append(seeds, data)
+}
+
+// fuzzTarget returns a handler with a client connected on conn, so data
+// messages get as far as decryption, and the client's handshake
+func fuzzTarget(tb testing.TB) (h *Handler, conn *fakeConn, hs []byte) {
+	tb.Helper()
+	h = newTestHandler(tb)
+	conn = &fakeConn{}
+	private, public := keyPair(tb)
+	_, hs = sealHandshake(tb, h, &msg.Handshake{ClientPublicKey: public}, private)
+	h.HandleMessage(conn, hs)
+	if h.Clients() != 1 {
+		tb.Fatal("handshake failed")
+	}
+	return h, conn, hs
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	h, conn, hs := fuzzTarget(f)
+	f.Add(hs)
+	f.Add(hs[:len(hs)/2])
+	f.Add([]byte{})
+	for _, seed := range headerSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h.HandleMessage(conn, data)
+		h.HandleMessage(&fakeConn{}, data)
+	})
+}
+
+func TestHandleMessageSurvivesGarbage(t *testing.T) {
+	h, conn, hs := fuzzTarget(t)
+	valid := append(headerSeeds(t), hs)
+	answered := len(conn.messages())
+
+	rng := rand.New(rand.NewSource(1))
+	for range 5000 {
+		var data []byte
+		if rng.Intn(2) == 0 {
+			// Random bytes of any length
+			data = make([]byte, rng.Intn(512))
+			rng.Read(data)
+		} else {
+			// A well-formed message, truncated and with bytes flipped
+			seed := valid[rng.Intn(len(valid))]
+			data = append([]byte(nil), seed[:rng.Intn(len(seed)+1)]...)
+			for range rng.Intn(4) {
+				if len(data) > 0 {
+					data[rng.Intn(len(data))] ^= byte(1 + rng.Intn(255))
+				}
+			}
+			if bytes.Equal(data, seed) {
+				continue // Left intact, so not garbage
+			}
+		}
+		h.HandleMessage(conn, data)
+	}
+
+	// The client session is untouched and nothing answered the garbage
+	if h.Clients() != 1 {
+		t.Fatalf("%d clients after garbage, want the one session", h.Clients())
+	}
+	if sent := len(conn.messages()) - answered; sent != 0 {
+		t.Fatalf("answered garbage %d times", sent)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/binary"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// TCP header bits MSS clamping looks at
+const (
+	tcpFlagSYN = 0x02
+	tcpOptEnd  = 0
+	tcpOptNOP  = 1
+	tcpOptMSS  = 2
+)
+
+// IP and TCP header bytes each segment carries besides its payload
+const (
+	mssOverhead4 = 20 + 20
+	mssOverhead6 = 40 + 20
+)
+
+// SetMSSClamp lowers the MSS that TCP SYNs advertise, in both directions, so
+// segments fit a tunnel of the given MTU without relying on path MTU
+// discovery (0 disables). Must be called before clients connect.
+func (h *Handler) SetMSSClamp(mtu int) {
+	h.clampMTU = mtu
+}
+
+// clampMSS lowers the MSS option of a TCP SYN to what fits in mtu, updating
+// the checksum, and reports whether it changed the packet
+func clampMSS(packet []byte, mtu int) bool {
+	h, err := netpkt.Parse(packet)
+	if err != nil || h.Proto != netpkt.ProtoTCP || h.FragmentOffset != 0 {
+		return false
+	}
+	limit := mtu - mssOverhead4
+	if h.Version == 6 {
+		limit = mtu - mssOverhead6
+	}
+
+	tcp := packet[h.Len:h.Total]
+	if limit <= 0 || len(tcp) < 20 || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	headerLen := int(tcp[12]>>4) * 4
+	if headerLen < 20 || len(tcp) < headerLen {
+		return false
+	}
+
+	for i := 20; i < headerLen; {
+		switch tcp[i] {
+		case tcpOptEnd:
+			return false
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= headerLen || tcp[i+1] < 2 || i+int(tcp[i+1]) > headerLen {
+			return false
+		}
+		if tcp[i] == tcpOptMSS && tcp[i+1] == 4 {
+			if int(binary.BigEndian.Uint16(tcp[i+2:i+4])) <= limit {
+				return false
+			}
+			return h.SetTransport16(packet, i+2, uint16(limit)) == nil
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// Common SYN options: MSS 1460, window scale 7, SACK permitted
+var (
+	optMSS1460 = []byte{tcpOptMSS, 4, 0x05, 0xb4}
+	optWScale  = []byte{tcpOptNOP, 3, 3, 7}
+	optSACK    = []byte{tcpOptNOP, tcpOptNOP, 4, 2}
+)
+
+// tcpSegment builds a TCP segment from src to dst with flags and options
+// (padded to a multiple of four), with correct checksums
+func tcpSegment(src, dst netip.Addr, flags byte, options ...[]byte) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], 0x01020304)
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	for _, opt := range options {
+		tcp = append(tcp, opt...)
+	}
+	for len(tcp)%4 != 0 {
+		tcp = append(tcp, tcpOptEnd)
+	}
+	tcp[12] = byte(len(tcp)/4) << 4
+
+	var packet []byte
+	if src.Is4() {
+		packet = make([]byte, 20)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[6] = 0x40 // Don't fragment
+		packet[8] = 64
+		packet[9] = protoTCP
+		s, d := src.As4(), dst.As4()
+		copy(packet[12:], s[:])
+		copy(packet[16:], d[:])
+	} else {
+		packet = make([]byte, 40)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = protoTCP
+		packet[7] = 64
+		s, d := src.As16(), dst.As16()
+		copy(packet[8:], s[:])
+		copy(packet[24:], d[:])
+	}
+	packet = append(packet, tcp...)
+	netpkt.Fix(packet)
+	return packet
+}
+
+// mssOf returns the MSS option of a TCP packet, or 0 without one
+func mssOf(t *testing.T, packet []byte) int {
+	t.Helper()
+	h, err := netpkt.Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := packet[h.Len:]
+	for i := 20; i < int(tcp[12]>>4)*4; {
+		switch tcp[i] {
+		case tcpOptEnd:
+			return 0
+		case tcpOptNOP:
+			i++
+			continue
+		case tcpOptMSS:
+			return int(binary.BigEndian.Uint16(tcp[i+2:]))
+		}
+		i += int(tcp[i+1])
+	}
+	return 0
+}
+
+var (
+	client4, server4 = netip.MustParseAddr("10.77.0.2"), netip.MustParseAddr("198.51.100.1")
+	client6, server6 = netip.MustParseAddr("fd77::2"), netip.MustParseAddr("2001:db8::1")
+)
+
+func TestClampMSSRewritesSYN(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"IPv4 SYN", tcpSegment(client4, server4, tcpFlagSYN, optMSS1460, optSACK, optWScale), 1260},
+		{"IPv4 SYN-ACK", tcpSegment(server4, client4, tcpFlagSYN|0x10, optMSS1460), 1260},
+		{"IPv6 SYN", tcpSegment(client6, server6, tcpFlagSYN, optMSS1460, optWScale), 1240},
+		// A lone NOP puts the MSS value at an odd offset into the segment
+		{"MSS after a NOP", tcpSegment(client4, server4, tcpFlagSYN, []byte{tcpOptNOP}, optMSS1460), 1260},
+		{"MSS after SACK and window scale", tcpSegment(client6, server6, tcpFlagSYN, optSACK, optWScale, optMSS1460), 1240},
+	}
+	for _, tt := range tests {
+		if !clampMSS(tt.packet, 1300) {
+			t.Errorf("%s: not clamped", tt.name)
+			continue
+		}
+		if got := mssOf(t, tt.packet); got != tt.want {
+			t.Errorf("%s: MSS %d, want %d", tt.name, got, tt.want)
+		}
+		if err := netpkt.Verify(tt.packet); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestClampMSSLeavesOtherPackets(t *testing.T) {
+	corrupt := tcpSegment(client4, server4, tcpFlagSYN, []byte{tcpOptMSS, 9, 0x05, 0xb4})
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"MSS already small", tcpSegment(client4, server4, tcpFlagSYN, []byte{tcpOptMSS, 4, 0x04, 0x00})},
+		{"MSS exactly at the limit", tcpSegment(client4, server4, tcpFlagSYN, []byte{tcpOptMSS, 4, 0x04, 0xec})},
+		{"no SYN", tcpSegment(client4, server4, 0x10, optMSS1460)},
+		{"no MSS option", tcpSegment(client4, server4, tcpFlagSYN, optSACK, optWScale)},
+		{"MSS after end of options", tcpSegment(client4, server4, tcpFlagSYN, []byte{tcpOptEnd, 0, 0, 0}, optMSS1460)},
+		{"option overruns the header", corrupt},
+		{"zero-length option", tcpSegment(client4, server4, tcpFlagSYN, []byte{3, 0, 0, 0}, optMSS1460)},
+		{"UDP", packetTo(protoUDP, netip.MustParseAddrPort("198.51.100.1:443"))},
+		{"truncated", tcpSegment(client4, server4, tcpFlagSYN, optMSS1460)[:30]},
+	}
+	for _, tt := range tests {
+		before := bytes.Clone(tt.packet)
+		if clampMSS(tt.packet, 1300) || !bytes.Equal(tt.packet, before) {
+			t.Errorf("%s: packet changed", tt.name)
+		}
+	}
+
+	// A non-first fragment has no TCP header to read
+	fragment := tcpSegment(client4, server4, tcpFlagSYN, optMSS1460)
+	binary.BigEndian.PutUint16(fragment[6:], 1) // Offset 8
+	if clampMSS(fragment, 1300) {
+		t.Error("clamped a fragment")
+	}
+	if clampMSS(tcpSegment(client4, server4, tcpFlagSYN, optMSS1460), 40) {
+		t.Error("clamped to an MTU with no room for data")
+	}
+}
+
+func TestMSSClampBothDirections(t *testing.T) {
+	n := startUDPNode(t)
+	n.handler.SetMSSClamp(1300)
+	c := n.connect(t)
+
+	// Client SYN on its way to the TUN
+	c.sendPacket(t, tcpSegment(c.ip, server4, tcpFlagSYN, optMSS1460, optSACK))
+	syn := n.readTUN(t)
+	if got := mssOf(t, syn); got != 1260 {
+		t.Fatalf("SYN into the TUN has MSS %d, want 1260", got)
+	}
+	if err := netpkt.Verify(syn); err != nil {
+		t.Fatal(err)
+	}
+
+	// SYN-ACK from the TUN on its way to the client
+	n.dev.Inject(tcpSegment(server4, c.ip, tcpFlagSYN|0x10, optMSS1460))
+	synAck := c.receivePacket(t)
+	if got := mssOf(t, synAck); got != 1260 {
+		t.Fatalf("SYN-ACK to the client has MSS %d, want 1260", got)
+	}
+	if err := netpkt.Verify(synAck); err != nil {
+		t.Fatal(err)
+	}
+}
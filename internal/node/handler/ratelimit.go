@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RateLimit caps traffic as packets and bytes per second (0 = unlimited).
+// Bursts of up to one second's worth are allowed.
+type RateLimit struct {
+	PacketsPerSec int
+	BytesPerSec   int
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: now}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// rateLimiter applies packet and byte buckets together, so a packet is only
+// charged to either when both admit it
+type rateLimiter struct {
+	mu      sync.Mutex
+	packets *tokenBucket // nil when packets are unlimited
+	bytes   *tokenBucket // nil when bytes are unlimited
+	now     func() time.Time
+}
+
+// newRateLimiter returns nil if limit sets no cap
+func newRateLimiter(limit RateLimit, now func() time.Time) *rateLimiter {
+	if limit.PacketsPerSec <= 0 && limit.BytesPerSec <= 0 {
+		return nil
+	}
+	l := &rateLimiter{now: now}
+	start := now()
+	if limit.PacketsPerSec > 0 {
+		l.packets = newTokenBucket(limit.PacketsPerSec, start)
+	}
+	if limit.BytesPerSec > 0 {
+		l.bytes = newTokenBucket(limit.BytesPerSec, start)
+	}
+	return l
+}
+
+// allow reports whether a packet of size bytes is within the limit and
+// charges it if so. A nil limiter allows everything.
+func (l *rateLimiter) allow(size int) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.packets != nil {
+		l.packets.refill(now)
+		if l.packets.tokens < 1 {
+			return false
+		}
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		// A packet larger than the whole burst could never pass; admit it on a full bucket
+		if l.bytes.tokens < min(float64(size), l.bytes.burst) {
+			return false
+		}
+	}
+
+	if l.packets != nil {
+		l.packets.tokens--
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= float64(size)
+	}
+	return true
+}
+
+// SetRateLimit caps traffic each client may send into the TUN, and all
+// clients together. Must be called before clients connect.
+func (h *Handler) SetRateLimit(perClient, global RateLimit) {
+	h.clientLimit = perClient
+	h.globalLimiter = newRateLimiter(global, time.Now)
+}
+
+// RateLimited returns how many packets were dropped for exceeding a rate limit
+func (h *Handler) RateLimited() uint64 {
+	return h.rateLimited.Load()
+}
+
+// admit applies the client's and the global rate limits to a packet
+func (h *Handler) admit(sess *session, size int) bool {
+	if sess.limiter.allow(size) && h.globalLimiter.allow(size) {
+		return true
+	}
+	if n := h.rateLimited.Add(1); n&(n-1) == 0 {
+		// Log on powers of two so a flood doesn't flood the log too
+		slog.Warn("Dropping packets over rate limit", "dropped", n)
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that moves only when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+// admitted returns how many of n packets of size bytes l lets through
+func admitted(l *rateLimiter, n, size int) int {
+	passed := 0
+	for range n {
+		if l.allow(size) {
+			passed++
+		}
+	}
+	return passed
+}
+
+func TestPacketBucket(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(RateLimit{PacketsPerSec: 10}, clock.Now)
+
+	// A burst is capped at one second's worth
+	if got := admitted(l, 25, 100); got != 10 {
+		t.Fatalf("burst admitted %d packets, want 10", got)
+	}
+
+	// Tokens come back at the configured rate
+	clock.Advance(300 * time.Millisecond)
+	if got := admitted(l, 10, 100); got != 3 {
+		t.Fatalf("admitted %d packets after 300ms, want 3", got)
+	}
+	clock.Advance(50 * time.Millisecond)
+	if got := admitted(l, 10, 100); got != 0 {
+		t.Fatalf("admitted %d packets on half a token", got)
+	}
+	clock.Advance(50 * time.Millisecond)
+	if got := admitted(l, 10, 100); got != 1 {
+		t.Fatalf("admitted %d packets once the half tokens added up, want 1", got)
+	}
+
+	// An idle client doesn't save up more than the burst
+	clock.Advance(time.Minute)
+	if got := admitted(l, 25, 100); got != 10 {
+		t.Fatalf("admitted %d packets after idling, want 10", got)
+	}
+}
+
+func TestByteBucket(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(RateLimit{BytesPerSec: 1000}, clock.Now)
+
+	if !l.allow(600) || l.allow(600) || !l.allow(400) {
+		t.Fatal("1000 byte burst not split as 600, then 400")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if !l.allow(500) || l.allow(1) {
+		t.Fatal("half a second did not refill exactly 500 bytes")
+	}
+
+	// A packet bigger than the burst passes on a full bucket and empties it
+	clock.Advance(time.Second)
+	if !l.allow(1500) {
+		t.Fatal("packet larger than the burst never admitted")
+	}
+	clock.Advance(400 * time.Millisecond)
+	if l.allow(1) {
+		t.Fatal("admitted a packet while still paying off the oversized one")
+	}
+	clock.Advance(200 * time.Millisecond)
+	if !l.allow(1) {
+		t.Fatal("500 byte overdraft not paid off after 600ms")
+	}
+}
+
+func TestBucketsChargeTogether(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(RateLimit{PacketsPerSec: 5, BytesPerSec: 1000}, clock.Now)
+
+	// Bytes run out first; the refused packets cost no packet tokens
+	if got := admitted(l, 5, 400); got != 2 {
+		t.Fatalf("admitted %d 400 byte packets, want 2", got)
+	}
+	if got := admitted(l, 5, 10); got != 3 {
+		t.Fatalf("admitted %d small packets, want the 3 packet tokens left", got)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	if l := newRateLimiter(RateLimit{}, time.Now); l != nil {
+		t.Fatal("limiter built for an unlimited RateLimit")
+	}
+	var l *rateLimiter
+	if got := admitted(l, 1000, 1500); got != 1000 {
+		t.Fatalf("nil limiter admitted %d of 1000", got)
+	}
+}
+
+func TestAdmitAppliesClientAndGlobalLimits(t *testing.T) {
+	clock := newFakeClock()
+	h := &Handler{globalLimiter: newRateLimiter(RateLimit{PacketsPerSec: 8}, clock.Now)}
+	a := &session{limiter: newRateLimiter(RateLimit{PacketsPerSec: 5}, clock.Now)}
+	b := &session{limiter: newRateLimiter(RateLimit{PacketsPerSec: 5}, clock.Now)}
+
+	passed := 0
+	for range 10 {
+		for _, sess := range []*session{a, b} {
+			if h.admit(sess, 100) {
+				passed++
+			}
+		}
+	}
+	if passed != 8 {
+		t.Fatalf("admitted %d packets, want the global 8", passed)
+	}
+	if got := h.RateLimited(); got != 12 {
+		t.Fatalf("counted %d drops, want 12", got)
+	}
+
+	// Each client is held to its own share too
+	clock.Advance(time.Second)
+	if got := admitted(a.limiter, 10, 100); got != 5 {
+		t.Fatalf("client admitted %d packets, want 5", got)
+	}
+}
@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/internal/transport/client/tcp"
+	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/client/v2ray"
+	"seras-protocol/internal/transport/client/wss"
+	"seras-protocol/internal/transport/obfs"
+	vless "seras-protocol/internal/transport/v2ray"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// DefaultRelayIdleTimeout is how long a link to a next hop may carry nothing
+// before it is closed
+const DefaultRelayIdleTimeout = 2 * time.Minute
+
+// relayDialTimeout bounds resolving a next hop and handshaking with it
+const relayDialTimeout = 10 * time.Second
+
+// relayKey identifies an upstream link opened on behalf of one client
+// connection. Links aren't shared between connections, since the next hop's
+// responses are returned to whichever connection the link belongs to.
+type relayKey struct {
+	conn Connection
+	hop  msg.NextHop // A different key or protocol at the same endpoint is another link
+}
+
+// relayLink is this node's session with the next hop of a client's circuit.
+// It is registered before it is dialed, so packets for a hop being dialed
+// wait for that dial instead of starting another.
+type relayLink struct {
+	ready     chan struct{} // Closed once the dial finished
+	transport client.Client // Set under relayMu when the dial succeeds; nil while dialing
+	decoder   *msg.Decoder  // Opens the hop's responses with the link's own key; set with transport
+	err       error         // Why the dial failed; read after ready
+	lastUsed  atomic.Int64  // Unix nanoseconds of the last message either way
+}
+
+func (l *relayLink) touch() {
+	l.lastUsed.Store(time.Now().UnixNano())
+}
+
+// SetRelayIdleTimeout sets how long a link to a next hop may carry nothing
+// before it is closed; the next packet for the hop dials it again.
+// Must be called before clients connect.
+func (h *Handler) SetRelayIdleTimeout(ttl time.Duration) {
+	if ttl > 0 {
+		h.relayIdle = ttl
+	}
+}
+
+// Relays returns how many links to next hops are open
+func (h *Handler) Relays() int {
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+	return len(h.relays)
+}
+
+// forward sends an inner onion layer to the next hop, dialing it on first use
+// and reusing the link for the connection's later packets to the same hop
+func (h *Handler) forward(conn Connection, hop *msg.NextHop, inner []byte) error {
+	key := relayKey{conn: conn, hop: *hop}
+
+	h.relayMu.Lock()
+	link, ok := h.relays[key]
+	if !ok {
+		link = &relayLink{ready: make(chan struct{})}
+		link.touch()
+		h.relays[key] = link
+	}
+	h.relayMu.Unlock()
+
+	// Dialed outside relayMu, so a slow hop only holds up packets bound for it
+	if !ok {
+		h.openRelay(key, link)
+	}
+	<-link.ready
+	if link.err != nil {
+		return fmt.Errorf("dial next hop %s: %w", hop.Endpoint, link.err)
+	}
+	link.touch()
+	return link.transport.Send(inner)
+}
+
+// openRelay dials a registered link and starts returning its responses. A
+// link dropped while it was dialing is disconnected once the dial finishes.
+func (h *Handler) openRelay(key relayKey, link *relayLink) {
+	// Each link is its own client to the hop, so the hop gives every circuit
+	// through this node a session and address of its own
+	var transport client.Client
+	identity, _, err := msg.GenerateKeyPair()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), relayDialTimeout)
+		transport, err = h.dialRelay(ctx, &key.hop, identity)
+		cancel()
+	}
+
+	h.relayMu.Lock()
+	switch {
+	case err != nil:
+		if h.relays[key] == link {
+			delete(h.relays, key)
+		}
+	case h.relays[key] != link:
+		err = errors.New("relay link closed while dialing")
+	default:
+		link.transport, link.decoder = transport, msg.NewDecoder(identity)
+		link.decoder.TimestampSkew = h.timestampSkew
+		if !h.relaySweeping {
+			h.relaySweeping = true
+			go h.sweepRelays()
+		}
+	}
+	link.err = err
+	h.relayMu.Unlock()
+	close(link.ready)
+
+	if err != nil {
+		if transport != nil {
+			transport.Disconnect()
+		}
+		return
+	}
+	go h.relayReturn(key, link)
+	slog.Info("Relay link established", "endpoint", key.hop.Endpoint, "pubkey", key.hop.PublicKey[:8])
+}
+
+// sweepRelays closes links idle for longer than the relay idle timeout. It
+// runs while any link is open; forward starts it again for the next one.
+func (h *Handler) sweepRelays() {
+	ticker := time.NewTicker(h.relayIdle / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := time.Now().Add(-h.relayIdle).UnixNano()
+
+		var idle []*relayLink
+		h.relayMu.Lock()
+		for key, link := range h.relays {
+			if link.transport != nil && link.lastUsed.Load() < deadline {
+				idle = append(idle, link)
+				delete(h.relays, key)
+				slog.Info("Closing idle relay link", "endpoint", key.hop.Endpoint, "pubkey", key.hop.PublicKey[:8])
+			}
+		}
+		done := len(h.relays) == 0
+		if done {
+			h.relaySweeping = false
+		}
+		h.relayMu.Unlock()
+
+		// Disconnecting ends each link's relayReturn
+		for _, link := range idle {
+			link.transport.Disconnect()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// dialHop connects to the next hop and registers identity with it as a client
+func (h *Handler) dialHop(ctx context.Context, hop *msg.NextHop, identity msg.Key) (client.Client, error) {
+	addr, err := h.hopAddr(ctx, hop)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checked address is dialed, so a second lookup can't swap in another
+	var transportConfig client.Config
+	switch hop.Protocol {
+	case msg.Wss:
+		transportConfig = &wss.Config{Url: hop.Endpoint, DialAddr: addr}
+	case msg.Udp:
+		transportConfig = &udp.Config{Addr: addr}
+	case msg.V2Ray:
+		transportConfig = &v2ray.Config{Url: hop.Endpoint, DialAddr: addr}
+	case msg.Tcp:
+		transportConfig = &tcp.Config{Addr: addr}
+	default:
+		return nil, fmt.Errorf("unsupported next hop protocol: %s", hop.Protocol)
+	}
+
+	factory := &client.Factory{}
+	transport, err := factory.NewClient(string(hop.Protocol), transportConfig)
+	if err != nil {
+		return nil, err
+	}
+	if h.obfuscator != nil {
+		transport = obfs.NewClient(transport, h.obfuscator, 0)
+	}
+
+	if err := h.relayHandshake(ctx, transport, hop.PublicKey, identity); err != nil {
+		transport.Disconnect()
+		return nil, err
+	}
+	return transport, nil
+}
+
+// hopAddr resolves the next hop's endpoint to the address to dial. Addresses
+// the ACL denies are skipped, so a circuit can't reach what packets can't.
+func (h *Handler) hopAddr(ctx context.Context, hop *msg.NextHop) (string, error) {
+	hostPort, proto := hop.Endpoint, uint8(protoTCP)
+	switch hop.Protocol {
+	case msg.Udp:
+		proto = protoUDP
+	case msg.Tcp:
+	case msg.Wss:
+		u, err := url.Parse(hop.Endpoint)
+		if err != nil {
+			return "", fmt.Errorf("invalid next hop URL: %w", err)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+			if u.Scheme == "ws" {
+				port = "80"
+			}
+		}
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	case msg.V2Ray:
+		ep, err := vless.ParseURL(hop.Endpoint)
+		if err != nil {
+			return "", err
+		}
+		hostPort = ep.Addr
+	default:
+		return "", fmt.Errorf("unsupported next hop protocol: %s", hop.Protocol)
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", fmt.Errorf("invalid next hop endpoint: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid next hop port: %s", portStr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if h.acl == nil || !h.acl.deniesAddr(addr, proto, uint16(port), true) {
+			return netip.AddrPortFrom(addr, uint16(port)).String(), nil
+		}
+	}
+	h.aclDropped.Add(1)
+	return "", errors.New("next hop denied by ACL")
+}
+
+// relayHandshake performs the client side of the handshake as identity, which
+// the node's own key vouches for, giving up once ctx is done
+func (h *Handler) relayHandshake(ctx context.Context, transport client.Client, nodePublicKey, identity msg.Key) error {
+	publicKey, err := msg.PublicKeyFromPrivate(identity)
+	if err != nil {
+		return err
+	}
+	decoder := msg.NewDecoder(identity)
+
+	// Relay links speak the decoder's version, and the default cipher suite
+	// it opens their responses with
+	offered := []msg.Version{decoder.Version}
+	rawMsg, err := msg.NewEncoder(nodePublicKey).EncryptHandshake(&msg.Handshake{
+		ClientPublicKey: publicKey,
+		Timestamp:       time.Now().Unix(),
+		Versions:        offered,
+		Relay:           h.publicKey,
+	}, h.privateKey)
+	if err != nil {
+		return fmt.Errorf("encrypt handshake: %w", err)
+	}
+	data, err := binary.Marshal(rawMsg)
+	if err != nil {
+		return fmt.Errorf("marshal handshake: %w", err)
+	}
+	if err := transport.SendContext(ctx, data); err != nil {
+		return fmt.Errorf("send handshake: %w", err)
+	}
+
+	ackData, err := transport.ReceiveContext(ctx)
+	if err != nil {
+		return fmt.Errorf("receive ack: %w", err)
+	}
+	ackRaw, err := msg.Decode(ackData)
+	if err != nil {
+		return fmt.Errorf("decode ack: %w", err)
+	}
+	if ackRaw.Header.Type != msg.TypeHandshakeAck {
+		return fmt.Errorf("expected handshake ack, got type %d", ackRaw.Header.Type)
+	}
+	ack, err := decoder.DecryptHandshakeAck(ackRaw)
+	if err != nil {
+		return fmt.Errorf("decrypt ack: %w", err)
+	}
+	if err := decoder.VerifyHandshakeAck(rawMsg.Header, nodePublicKey, ack); err != nil {
+		return fmt.Errorf("verify ack: %w", err)
+	}
+	if !ack.Success {
+		return fmt.Errorf("handshake rejected: %s", ack.Message)
+	}
+	if _, err := ack.PinVersion(rawMsg.Header, offered); err != nil {
+		return err
+	}
+	if _, err := ack.PinSuite(nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// relayReturn re-encrypts traffic coming back from the next hop for the originating client
+func (h *Handler) relayReturn(key relayKey, link *relayLink) {
+	defer h.closeRelay(key, link)
+
+	window := msg.NewReplayWindow()
+	openBuf := bufpool.Get()
+	defer bufpool.Put(openBuf)
+	sealBuf := bufpool.Get()
+	defer bufpool.Put(sealBuf)
+
+	for {
+		data, err := link.transport.Receive()
+		if err != nil {
+			slog.Warn("Relay link closed", "endpoint", key.hop.Endpoint, "error", err)
+			return
+		}
+		link.touch()
+
+		rawMsg, err := msg.Decode(data)
+		if err != nil {
+			slog.Warn("Rejecting malformed relayed message", "error", err)
+			continue
+		}
+
+		cookedMsg, err := link.decoder.DecryptBodyChecked(rawMsg, window, *openBuf)
+		if err != nil {
+			slog.Error("Failed to decrypt relayed message", "error", err)
+			continue
+		}
+
+		// Sealed for the client's current session, as a re-handshake may have
+		// replaced the one the link was dialed for
+		h.mu.RLock()
+		sess, ok := h.sessions[key.conn]
+		h.mu.RUnlock()
+		if !ok {
+			return
+		}
+
+		// Stream frames from an exit node stay stream frames
+		reply, err := sess.encrypt(key.conn, &msg.Msg{
+			Flags:     cookedMsg.Body.Flags & msg.FlagStream,
+			Timestamp: time.Now().Unix(),
+			Data:      cookedMsg.Body.Data,
+		}, *sealBuf)
+		if err != nil {
+			slog.Error("Failed to encrypt relayed response", "error", err)
+			continue
+		}
+
+		out, err := binary.Marshal(reply)
+		if err != nil {
+			slog.Error("Failed to marshal relayed response", "error", err)
+			continue
+		}
+
+		if err := key.conn.Send(out); err != nil {
+			slog.Warn("Failed to send relayed response", "error", err)
+		}
+	}
+}
+
+// closeRelay drops a relay link if it is still the registered one
+func (h *Handler) closeRelay(key relayKey, link *relayLink) {
+	h.relayMu.Lock()
+	if h.relays[key] == link {
+		delete(h.relays, key)
+	}
+	h.relayMu.Unlock()
+	link.transport.Disconnect()
+}
+
+// closeRelays drops all relay links opened for a client connection
+func (h *Handler) closeRelays(conn Connection) {
+	h.relayMu.Lock()
+	var links []*relayLink
+	for key, link := range h.relays {
+		if key.conn == conn {
+			// A link still dialing is disconnected by its dial
+			if link.transport != nil {
+				links = append(links, link)
+			}
+			delete(h.relays, key)
+		}
+	}
+	h.relayMu.Unlock()
+
+	for _, link := range links {
+		link.transport.Disconnect()
+	}
+}
@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/internal/transport/client"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// relayTransport is a link to a fake next hop. It records what is forwarded
+// and delivers the replies pushed to it until disconnected.
+type relayTransport struct {
+	identity msg.Key // The link's own key, which the hop's replies are sealed for
+
+	mu      sync.Mutex
+	sent    [][]byte
+	replies chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (r *relayTransport) Disconnect() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+func (r *relayTransport) Send(data []byte) error {
+	return r.SendContext(context.Background(), data)
+}
+
+func (r *relayTransport) SendContext(ctx context.Context, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, data)
+	return nil
+}
+
+func (r *relayTransport) Receive() ([]byte, error) {
+	return r.ReceiveContext(context.Background())
+}
+
+func (r *relayTransport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-r.replies:
+		return data, nil
+	case <-r.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *relayTransport) forwarded() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sent)
+}
+
+func (r *relayTransport) disconnected() bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// relayDialer stands in for dialing next hops, counting the dials. Dials
+// fail with err when it is set.
+type relayDialer struct {
+	slow string // Endpoint whose dials wait for gate to close
+	gate chan struct{}
+	err  error
+
+	mu    sync.Mutex
+	links []*relayTransport
+}
+
+func (d *relayDialer) dial(ctx context.Context, hop *msg.NextHop, identity msg.Key) (client.Client, error) {
+	if hop.Endpoint == d.slow {
+		<-d.gate
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	link := &relayTransport{identity: identity, replies: make(chan []byte, 4), closed: make(chan struct{})}
+	d.links = append(d.links, link)
+	return link, nil
+}
+
+func (d *relayDialer) dialed() []*relayTransport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*relayTransport(nil), d.links...)
+}
+
+// newRelayHandler returns a test handler whose next hops are dialed by d
+func newRelayHandler(t *testing.T, d *relayDialer) *Handler {
+	t.Helper()
+	h := newTestHandler(t)
+	h.dialRelay = d.dial
+	return h
+}
+
+// testHop returns a next hop at endpoint with a fresh key
+func testHop(t *testing.T, protocol msg.Protocol, endpoint string) *msg.NextHop {
+	t.Helper()
+	_, public := keyPair(t)
+	return &msg.NextHop{PublicKey: public, Protocol: protocol, Endpoint: endpoint}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForwardReusesLink(t *testing.T) {
+	d := &relayDialer{}
+	h := newRelayHandler(t, d)
+	conn := &fakeConn{}
+	hop := testHop(t, msg.Udp, "192.0.2.10:5000")
+
+	for range 2 {
+		if err := h.forward(conn, hop, []byte("onion")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := d.dialed()
+	if len(links) != 1 || links[0].forwarded() != 2 {
+		t.Fatalf("%d dials for two forwards to one hop, want one link carrying both", len(links))
+	}
+
+	// Another node at the same address, another protocol there, or another
+	// client's connection each get a link of their own
+	others := []struct {
+		conn Connection
+		hop  *msg.NextHop
+	}{
+		{conn, testHop(t, msg.Udp, hop.Endpoint)},
+		{conn, &msg.NextHop{PublicKey: hop.PublicKey, Protocol: msg.Tcp, Endpoint: hop.Endpoint}},
+		{&fakeConn{}, hop},
+	}
+	for _, other := range others {
+		if err := h.forward(other.conn, other.hop, []byte("onion")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(d.dialed()); n != 4 {
+		t.Fatalf("%d dials, want 4", n)
+	}
+	if n := h.Relays(); n != 4 {
+		t.Fatalf("%d relay links open, want 4", n)
+	}
+
+	// A client leaving closes only its own links
+	h.RemoveConnection(conn)
+	if n := h.Relays(); n != 1 {
+		t.Fatalf("%d relay links open after the client left, want the other client's 1", n)
+	}
+	for i, link := range d.dialed() {
+		if want := i < 3; link.disconnected() != want {
+			t.Fatalf("link %d disconnected %v, want %v", i, link.disconnected(), want)
+		}
+	}
+}
+
+func TestForwardDialsOnceConcurrently(t *testing.T) {
+	d := &relayDialer{slow: "192.0.2.10:5000", gate: make(chan struct{})}
+	h := newRelayHandler(t, d)
+	conn := &fakeConn{}
+	hop := testHop(t, msg.Udp, d.slow)
+
+	const forwards = 8
+	errs := make(chan error, forwards)
+	for range forwards {
+		go func() { errs <- h.forward(conn, hop, []byte("onion")) }()
+	}
+	waitFor(t, "the dial to start", func() bool { return h.Relays() == 1 })
+
+	// The slow dial holds up only the packets bound for its hop
+	if err := h.forward(conn, testHop(t, msg.Udp, "192.0.2.11:5000"), []byte("onion")); err != nil {
+		t.Fatal(err)
+	}
+	close(d.gate)
+	for range forwards {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := d.dialed()
+	if len(links) != 2 {
+		t.Fatalf("%d dials, want one per hop", len(links))
+	}
+	// The other hop's dial finished first
+	if n := links[1].forwarded(); n != forwards {
+		t.Fatalf("%d packets forwarded on the slow link, want %d", n, forwards)
+	}
+}
+
+func TestFailedDialRedials(t *testing.T) {
+	d := &relayDialer{err: errors.New("connection refused")}
+	h := newRelayHandler(t, d)
+	conn := &fakeConn{}
+	hop := testHop(t, msg.Udp, "192.0.2.10:5000")
+
+	if err := h.forward(conn, hop, []byte("onion")); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("got %v, want the dial's error", err)
+	}
+	if n := h.Relays(); n != 0 {
+		t.Fatalf("%d relay links kept after a failed dial", n)
+	}
+
+	d.mu.Lock()
+	d.err = nil
+	d.mu.Unlock()
+	if err := h.forward(conn, hop, []byte("onion")); err != nil {
+		t.Fatalf("forward after the hop came back: %v", err)
+	}
+	if links := d.dialed(); len(links) != 1 || links[0].forwarded() != 1 {
+		t.Fatal("hop not dialed again after a failed dial")
+	}
+}
+
+func TestIdleRelayClosed(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	d := &relayDialer{}
+	h := newRelayHandler(t, d)
+	h.SetRelayIdleTimeout(idle)
+	conn := &fakeConn{}
+	busy := testHop(t, msg.Udp, "192.0.2.10:5000")
+	quiet := testHop(t, msg.Udp, "192.0.2.11:5000")
+
+	if err := h.forward(conn, quiet, []byte("onion")); err != nil {
+		t.Fatal(err)
+	}
+	// A link carrying traffic outlives several idle timeouts
+	for range 20 {
+		if err := h.forward(conn, busy, []byte("onion")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(idle / 10)
+	}
+	links := d.dialed()
+	if len(links) != 2 || links[1].disconnected() {
+		t.Fatalf("busy link redialed or closed: %d dials", len(links))
+	}
+	if !links[0].disconnected() {
+		t.Fatal("idle link left open")
+	}
+
+	// Once both are idle the sweep closes the other too, and the next packet
+	// for the hop dials it again
+	waitFor(t, "the idle links to close", func() bool { return h.Relays() == 0 })
+	if !links[1].disconnected() {
+		t.Fatal("idle link dropped without disconnecting it")
+	}
+	if err := h.forward(conn, quiet, []byte("onion")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.dialed()); n != 3 {
+		t.Fatalf("%d dials after the idle close, want a redial", n)
+	}
+	if n := h.Relays(); n != 1 {
+		t.Fatalf("%d relay links open after the redial, want 1", n)
+	}
+}
+
+func TestRelayRepliesReachClient(t *testing.T) {
+	d := &relayDialer{}
+	h := newRelayHandler(t, d)
+	private, _ := keyPair(t)
+	conn := &fakeConn{}
+	ack := handshake(t, h, conn, private)
+	if ack == nil || !ack.Success {
+		t.Fatalf("handshake: got %+v", ack)
+	}
+	acked := len(conn.messages())
+
+	if err := h.forward(conn, testHop(t, msg.Udp, "192.0.2.10:5000"), []byte("onion")); err != nil {
+		t.Fatal(err)
+	}
+	link := d.dialed()[0]
+
+	// The hop answers the link's key; the client gets it under its own
+	linkPublic, err := msg.PublicKeyFromPrivate(link.identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawReply, err := msg.NewEncoder(linkPublic).EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: []byte("reply")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := kbinary.Marshal(rawReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.replies <- data
+	waitFor(t, "the relayed reply", func() bool { return len(conn.messages()) > acked })
+
+	rawMsg, err := msg.Decode(conn.messages()[acked])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := msg.NewDecoder(private)
+	decoder.Version, decoder.Suite = ack.Version, ack.Suite
+	cooked, err := decoder.DecryptBody(rawMsg, nil)
+	if err != nil {
+		t.Fatalf("client can't open the relayed reply: %v", err)
+	}
+	if string(cooked.Body.Data) != "reply" {
+		t.Fatalf("client got %q, want reply", cooked.Body.Data)
+	}
+
+	// The link goes with the client
+	h.RemoveConnection(conn)
+	if !link.disconnected() || h.Relays() != 0 {
+		t.Fatal("relay link left open after the client left")
+	}
+}
+
+func TestHopAddrDeniedByACL(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetACL(NewACL(MetadataPrefixes, []PortRule{{Port: 25}}))
+	tests := []struct {
+		hop  msg.NextHop
+		want string // Empty when denied
+	}{
+		{msg.NextHop{Protocol: msg.Udp, Endpoint: "192.0.2.10:5000"}, "192.0.2.10:5000"},
+		{msg.NextHop{Protocol: msg.Wss, Endpoint: "wss://192.0.2.10/ws"}, "192.0.2.10:443"},
+		{msg.NextHop{Protocol: msg.Wss, Endpoint: "ws://192.0.2.10/ws"}, "192.0.2.10:80"},
+		{msg.NextHop{Protocol: msg.Tcp, Endpoint: "169.254.169.254:80"}, ""},
+		{msg.NextHop{Protocol: msg.Tcp, Endpoint: "192.0.2.10:25"}, ""},
+	}
+	var denied uint64
+	for _, tt := range tests {
+		got, err := h.hopAddr(context.Background(), &tt.hop)
+		if tt.want == "" {
+			denied++
+			if err == nil {
+				t.Errorf("%s %s: dialing %s, want it denied", tt.hop.Protocol, tt.hop.Endpoint, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %s: got %q, %v; want %q", tt.hop.Protocol, tt.hop.Endpoint, got, err, tt.want)
+		}
+	}
+	if got := h.ACLDropped(); got != denied {
+		t.Fatalf("counted %d ACL drops, want %d", got, denied)
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// maxSeenHandshakes caps how many handshakes are remembered at once
+const maxSeenHandshakes = 65536
+
+var (
+	ErrReplayedHandshake = errors.New("handshake replayed")
+	ErrHandshakeFlood    = errors.New("too many recent handshakes")
+)
+
+// seenHandshake is the connection that first presented a handshake nonce
+type seenHandshake struct {
+	conn    Connection
+	expires time.Time
+}
+
+// handshakeCache remembers the nonces of accepted handshakes for as long as
+// their timestamps pass msg.MaxClockSkew, so a captured handshake can't be
+// replayed to register another connection. Older ones are already rejected as
+// stale by DecryptHandshake.
+type handshakeCache struct {
+	mu   sync.Mutex
+	seen map[msg.Nonce]seenHandshake
+	now  func() time.Time
+}
+
+func newHandshakeCache(now func() time.Time) *handshakeCache {
+	return &handshakeCache{seen: make(map[msg.Nonce]seenHandshake), now: now}
+}
+
+// accept records a handshake from conn. The same handshake seen again on its
+// own connection is a duplicate delivery and is allowed; from any other
+// connection it is a replay.
+func (c *handshakeCache) accept(conn Connection, nonce msg.Nonce, timestamp int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if prev, ok := c.seen[nonce]; ok && now.Before(prev.expires) {
+		if prev.conn != conn {
+			return ErrReplayedHandshake
+		}
+		return nil
+	}
+
+	if len(c.seen) >= maxSeenHandshakes {
+		c.expire(now)
+		if len(c.seen) >= maxSeenHandshakes {
+			return ErrHandshakeFlood
+		}
+	}
+	c.seen[nonce] = seenHandshake{
+		conn:    conn,
+		expires: time.Unix(timestamp, 0).Add(msg.MaxClockSkew),
+	}
+	return nil
+}
+
+// expire forgets handshakes too old to pass the timestamp check
+func (c *handshakeCache) expire(now time.Time) {
+	for nonce, hs := range c.seen {
+		if !now.Before(hs.expires) {
+			delete(c.seen, nonce)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestHandshakeReplayRejected(t *testing.T) {
+	h := newTestHandler(t)
+	private, public := keyPair(t)
+	_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+
+	first := &fakeConn{}
+	if ack := handleHandshake(t, h, first, data, private); ack == nil || !ack.Success {
+		t.Fatalf("first handshake: got %+v", ack)
+	}
+
+	// The same bytes from anywhere else get no answer and no lease
+	attacker := &fakeConn{}
+	if ack := handleHandshake(t, h, attacker, data, private); ack != nil {
+		t.Fatalf("replayed handshake answered: %+v", ack)
+	}
+	if h.Clients() != 1 {
+		t.Fatalf("%d clients after a replay, want 1", h.Clients())
+	}
+
+	// Redelivered on its own connection it is answered again
+	if ack := handleHandshake(t, h, first, data, private); ack == nil || !ack.Success {
+		t.Fatalf("duplicate on the same connection: got %+v", ack)
+	}
+
+	// A fresh handshake from the same client on a new connection is fine
+	if ack := handshake(t, h, &fakeConn{}, private); ack == nil || !ack.Success {
+		t.Fatalf("fresh handshake: got %+v", ack)
+	}
+}
+
+func TestStaleHandshakeRejected(t *testing.T) {
+	h := newTestHandler(t)
+	private, public := keyPair(t)
+	for _, skew := range []time.Duration{-2 * msg.MaxClockSkew, 2 * msg.MaxClockSkew} {
+		hs := &msg.Handshake{ClientPublicKey: public, Timestamp: time.Now().Add(skew).Unix()}
+		_, data := sealHandshake(t, h, hs, private)
+		if ack := handleHandshake(t, h, &fakeConn{}, data, private); ack != nil {
+			t.Fatalf("handshake %v off answered: %+v", skew, ack)
+		}
+	}
+	if h.Clients() != 0 {
+		t.Fatalf("%d clients after stale handshakes", h.Clients())
+	}
+}
+
+func TestHandshakeCache(t *testing.T) {
+	clock := newFakeClock()
+	c := newHandshakeCache(clock.Now)
+	conn, other := &fakeConn{}, &fakeConn{}
+	nonce := msg.Nonce{1}
+	sent := clock.Now().Unix()
+
+	if err := c.accept(conn, nonce, sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.accept(other, nonce, sent); !errors.Is(err, ErrReplayedHandshake) {
+		t.Fatalf("got %v, want ErrReplayedHandshake", err)
+	}
+	if err := c.accept(conn, nonce, sent); err != nil {
+		t.Fatalf("same connection: %v", err)
+	}
+
+	// Remembered until its timestamp would fail the freshness check anyway
+	clock.Advance(msg.MaxClockSkew - time.Second)
+	if err := c.accept(other, nonce, sent); !errors.Is(err, ErrReplayedHandshake) {
+		t.Fatalf("just inside the window: got %v, want ErrReplayedHandshake", err)
+	}
+	clock.Advance(time.Second)
+	if err := c.accept(other, nonce, sent); err != nil {
+		t.Fatalf("after the window: %v", err)
+	}
+}
+
+func TestHandshakeCacheFlood(t *testing.T) {
+	clock := newFakeClock()
+	c := newHandshakeCache(clock.Now)
+	sent := clock.Now().Unix()
+	nonce := func(i int) msg.Nonce {
+		var n msg.Nonce
+		n[0], n[1], n[2] = byte(i), byte(i>>8), byte(i>>16)
+		return n
+	}
+	for i := range maxSeenHandshakes {
+		if err := c.accept(&fakeConn{}, nonce(i), sent); err != nil {
+			t.Fatalf("handshake %d: %v", i, err)
+		}
+	}
+	if err := c.accept(&fakeConn{}, nonce(maxSeenHandshakes), sent); !errors.Is(err, ErrHandshakeFlood) {
+		t.Fatalf("got %v, want ErrHandshakeFlood", err)
+	}
+
+	// Room again once the remembered ones expire
+	clock.Advance(msg.MaxClockSkew)
+	if err := c.accept(&fakeConn{}, nonce(maxSeenHandshakes), clock.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.seen) != 1 {
+		t.Fatalf("%d handshakes remembered after expiry, want 1", len(c.seen))
+	}
+}
+
+func TestDataTimestampSkew(t *testing.T) {
+	n := startUDPNode(t)
+	n.handler.SetTimestampSkew(msg.DefaultTimestampSkew)
+	c := n.connect(t)
+
+	sendAt := func(offset time.Duration, id uint16) {
+		message := &msg.Msg{Timestamp: time.Now().Add(offset).Unix(), Data: udpPacket(c.ip, remoteAddr, id)}
+		rawMsg, err := c.encoder.EncryptMsg(message, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(t, rawMsg)
+	}
+	sendAt(-2*msg.DefaultTimestampSkew, 1)
+	sendAt(2*msg.DefaultTimestampSkew, 2)
+	sendAt(msg.DefaultTimestampSkew/2, 3)
+
+	// Only the packet inside the window, sent last, reaches the TUN
+	if id := binary.BigEndian.Uint16(n.readTUN(t)[4:]); id != 3 {
+		t.Fatalf("TUN got packet %d, want 3", id)
+	}
+	select {
+	case packet := <-n.dev.Written:
+		t.Fatalf("extra packet on the TUN: %x", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := n.handler.SkewRejected(); got != 2 {
+		t.Fatalf("counted %d skew rejections, want 2", got)
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"log/slog"
+
+	"seras-protocol/internal/netpkt"
+)
+
+// claimSource checks the source of a client's packet before it reaches the
+// TUN. A client may only send from the addresses it was leased. A relay link
+// carries one client's circuit, whose source is another node's lease, so that
+// source is translated to the link's own lease here and replies are
+// translated back by restoreCircuit.
+func (h *Handler) claimSource(sess *session, packet []byte) bool {
+	hdr, err := netpkt.Parse(packet)
+	if err != nil {
+		return false
+	}
+	lease, circuit := sess.ip, &sess.circuit
+	if hdr.Version == 6 {
+		lease, circuit = sess.ip6, &sess.circuit6
+	}
+	if !lease.IsValid() {
+		h.dropSpoofed(sess, hdr)
+		return false
+	}
+	if !sess.relay {
+		if hdr.Src != lease {
+			h.dropSpoofed(sess, hdr)
+			return false
+		}
+		return true
+	}
+
+	// The first source a circuit sends from is the one its replies go to
+	h.mu.RLock()
+	pinned := *circuit
+	h.mu.RUnlock()
+	if !pinned.IsValid() {
+		h.mu.Lock()
+		if !circuit.IsValid() {
+			*circuit = hdr.Src
+			slog.Info("Translating circuit source address", "ip", hdr.Src, "to", lease)
+		}
+		pinned = *circuit
+		h.mu.Unlock()
+	}
+	if hdr.Src != pinned {
+		h.dropSpoofed(sess, hdr)
+		return false
+	}
+	return hdr.SetSrc(packet, lease) == nil
+}
+
+// restoreCircuit translates the destination of a reply to a relay link back
+// to the circuit source claimSource replaced
+func (h *Handler) restoreCircuit(sess *session, packet []byte) bool {
+	hdr, err := netpkt.Parse(packet)
+	if err != nil {
+		return false
+	}
+
+	h.mu.RLock()
+	circuit := sess.circuit
+	if hdr.Version == 6 {
+		circuit = sess.circuit6
+	}
+	h.mu.RUnlock()
+
+	if !circuit.IsValid() {
+		return false
+	}
+	return hdr.SetDst(packet, circuit) == nil
+}
+
+// dropSpoofed counts a packet from an address the client may not use,
+// logging on powers of two so a flood doesn't flood the log
+func (h *Handler) dropSpoofed(sess *session, hdr netpkt.Header) {
+	if n := h.spoofDropped.Add(1); n&(n-1) == 0 {
+		slog.Warn("Dropping packets from unleased source addresses", "dropped", n, "src", hdr.Src, "lease", sess.ip)
+	}
+}
+
+// routeFor selects the connection and session owning the packet's destination
+func (h *Handler) routeFor(packet []byte) (Connection, *session, bool) {
+	hdr, err := netpkt.Parse(packet)
+	if err != nil {
+		slog.Debug("Dropping malformed packet from TUN", "len", len(packet), "error", err)
+		return nil, nil, false
+	}
+	dst := hdr.Dst
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	conn, ok := h.routes[dst]
+	if !ok {
+		slog.Debug("Dropping packet to unknown destination", "dst", dst)
+		return nil, nil, false
+	}
+	sess, ok := h.sessions[conn]
+	if !ok {
+		slog.Debug("Dropping packet to unregistered connection", "dst", dst)
+		return nil, nil, false
+	}
+	return conn, sess, true
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"seras-protocol/internal/netpkt"
+)
+
+func TestRouteForSelectsDestinationOwner(t *testing.T) {
+	h := newTestHandler(t)
+	alice, bob := &fakeConn{}, &fakeConn{}
+	aliceIP, bobIP := netip.MustParseAddr("10.77.0.2"), netip.MustParseAddr("10.77.0.3")
+	h.addSession(alice, aliceIP)
+	h.addSession(bob, bobIP)
+
+	withOptions := udpPacket(remoteAddr, bobIP, 1)
+	// Grow the header by one word of options (four NOPs)
+	withOptions = append(withOptions[:20:20], append([]byte{1, 1, 1, 1}, withOptions[20:]...)...)
+	withOptions[0] = 0x46
+	withOptions[3] += 4
+	netpkt.Fix(withOptions)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   Connection
+	}{
+		{"to alice", udpPacket(remoteAddr, aliceIP, 1), alice},
+		{"to bob", udpPacket(remoteAddr, bobIP, 1), bob},
+		{"with options", withOptions, bob},
+		{"unleased destination", udpPacket(remoteAddr, netip.MustParseAddr("10.77.0.9"), 1), nil},
+		{"from a client", udpPacket(aliceIP, remoteAddr, 1), nil},
+		{"truncated", udpPacket(remoteAddr, aliceIP, 1)[:12], nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		conn, sess, ok := h.routeFor(tt.packet)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("%s: routed to %v", tt.name, conn)
+			}
+			continue
+		}
+		if !ok || conn != tt.want {
+			t.Errorf("%s: routed to %v, want %v", tt.name, conn, tt.want)
+			continue
+		}
+		if sess != h.sessions[tt.want] {
+			t.Errorf("%s: returned another connection's session", tt.name)
+		}
+	}
+}
+
+func TestRouteForIPv6(t *testing.T) {
+	h := newTestHandler(t)
+	alice := &fakeConn{}
+	aliceIP6 := netip.MustParseAddr("fd00:77::2")
+	remote6 := netip.MustParseAddr("2001:db8::1")
+	sess := h.addSession(alice, netip.MustParseAddr("10.77.0.2"))
+	h.mu.Lock()
+	sess.ip6 = aliceIP6
+	h.routes[aliceIP6] = alice
+	h.mu.Unlock()
+
+	// A hop-by-hop options header between the fixed header and UDP
+	withExtension := udp6Packet(remote6, aliceIP6, 1)
+	withExtension = append(withExtension[:40:40], append([]byte{17, 0, 1, 4, 0, 0, 0, 0}, withExtension[40:]...)...)
+	withExtension[6] = 0
+	binary.BigEndian.PutUint16(withExtension[4:], uint16(len(withExtension)-40))
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"to alice", udp6Packet(remote6, aliceIP6, 1), true},
+		{"with extension header", withExtension, true},
+		{"unleased destination", udp6Packet(remote6, netip.MustParseAddr("fd00:77::9"), 1), false},
+		{"from the client", udp6Packet(aliceIP6, remote6, 1), false},
+		// Long enough for an IPv4 header but not the 40-byte IPv6 one
+		{"truncated", udp6Packet(remote6, aliceIP6, 1)[:39], false},
+	}
+	for _, tt := range tests {
+		conn, got, ok := h.routeFor(tt.packet)
+		if ok != tt.want {
+			t.Errorf("%s: routed %v, want %v", tt.name, ok, tt.want)
+			continue
+		}
+		if ok && (conn != alice || got != sess) {
+			t.Errorf("%s: routed to another connection", tt.name)
+		}
+	}
+}
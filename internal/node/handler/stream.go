@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// streamDialTimeout bounds how long opening a proxied TCP connection may take
+const streamDialTimeout = 10 * time.Second
+
+// maxStreams bounds concurrent streams per client connection
+const maxStreams = 256
+
+// streamQueue is how many frames may wait for a stream's connection before
+// the client's receive path blocks
+const streamQueue = 64
+
+// streamKey identifies a proxied stream by the client connection it belongs to
+type streamKey struct {
+	conn Connection
+	id   uint32
+}
+
+// proxyStream is a TCP connection the node originates for a proxy-mode client
+type proxyStream struct {
+	writes    chan []byte   // Payload to write once dialed
+	done      chan struct{} // Closed when the stream ends
+	closeOnce sync.Once
+}
+
+func (s *proxyStream) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// handleStream applies a stream frame from a proxy-mode client
+func (h *Handler) handleStream(conn Connection, sess *session, data []byte) {
+	frame, err := msg.UnmarshalStreamFrame(data)
+	if err != nil {
+		slog.Warn("Dropping malformed stream frame", "error", err)
+		return
+	}
+	key := streamKey{conn: conn, id: frame.ID}
+
+	h.streamMu.Lock()
+	stream, ok := h.streams[key]
+	if frame.Op == msg.StreamOpen && !ok {
+		if h.countStreams(conn) >= maxStreams {
+			h.streamMu.Unlock()
+			slog.Warn("Too many streams, refusing", "id", frame.ID)
+			h.sendStream(key, sess, &msg.StreamFrame{ID: frame.ID, Op: msg.StreamClose, Data: []byte("too many streams")})
+			return
+		}
+		stream = &proxyStream{
+			writes: make(chan []byte, streamQueue),
+			done:   make(chan struct{}),
+		}
+		h.streams[key] = stream
+	}
+	h.streamMu.Unlock()
+
+	switch {
+	case frame.Op == msg.StreamOpen && ok:
+		slog.Warn("Stream already open", "id", frame.ID)
+	case frame.Op == msg.StreamOpen:
+		go h.runStream(key, stream, sess, string(frame.Data))
+	case !ok:
+		// Data racing a close; the client already knows the stream ended
+	case frame.Op == msg.StreamData:
+		select {
+		case stream.writes <- frame.Data:
+		case <-stream.done:
+		}
+	case frame.Op == msg.StreamClose:
+		stream.close()
+	}
+}
+
+// runStream dials addr and pumps the connection in both directions until
+// either side closes it
+func (h *Handler) runStream(key streamKey, stream *proxyStream, sess *session, addr string) {
+	var reason string
+	defer func() { h.dropStream(key, stream, reason) }()
+
+	dialer := net.Dialer{Timeout: streamDialTimeout, Control: h.refuseDenied}
+	tcp, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		slog.Debug("Stream dial failed", "addr", addr, "error", err)
+		reason = err.Error()
+		return
+	}
+	defer tcp.Close()
+
+	if err := h.sendStream(key, sess, &msg.StreamFrame{ID: key.id, Op: msg.StreamOpen}); err != nil {
+		slog.Warn("Failed to acknowledge stream", "error", err)
+		return
+	}
+	slog.Debug("Stream opened", "id", key.id, "addr", addr)
+
+	// Remote -> client
+	go func() {
+		defer stream.close()
+		buf := make([]byte, msg.StreamChunkSize)
+		for {
+			n, err := tcp.Read(buf)
+			if n > 0 {
+				frame := &msg.StreamFrame{ID: key.id, Op: msg.StreamData, Data: buf[:n]}
+				if err := h.sendStream(key, sess, frame); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Client -> remote
+	for {
+		select {
+		case data := <-stream.writes:
+			if _, err := tcp.Write(data); err != nil {
+				stream.close()
+				return
+			}
+		case <-stream.done:
+			return
+		}
+	}
+}
+
+// dropStream forgets a stream and tells the client it ended
+func (h *Handler) dropStream(key streamKey, stream *proxyStream, reason string) {
+	stream.close()
+
+	h.streamMu.Lock()
+	registered := h.streams[key] == stream
+	if registered {
+		delete(h.streams, key)
+	}
+	h.streamMu.Unlock()
+
+	if registered {
+		h.mu.RLock()
+		sess, ok := h.sessions[key.conn]
+		h.mu.RUnlock()
+		if ok {
+			h.sendStream(key, sess, &msg.StreamFrame{ID: key.id, Op: msg.StreamClose, Data: []byte(reason)})
+		}
+	}
+}
+
+// countStreams returns how many streams conn has open. Must be called with streamMu held.
+func (h *Handler) countStreams(conn Connection) int {
+	n := 0
+	for key := range h.streams {
+		if key.conn == conn {
+			n++
+		}
+	}
+	return n
+}
+
+// closeStreams ends every stream opened by a client connection
+func (h *Handler) closeStreams(conn Connection) {
+	h.streamMu.Lock()
+	for key, stream := range h.streams {
+		if key.conn == conn {
+			delete(h.streams, key)
+			stream.close()
+		}
+	}
+	h.streamMu.Unlock()
+}
+
+// sendStream seals a stream frame for the client that owns the stream
+func (h *Handler) sendStream(key streamKey, sess *session, frame *msg.StreamFrame) error {
+	data, err := msg.MarshalStreamFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	rawMsg, err := sess.encrypt(key.conn, &msg.Msg{
+		Flags:     msg.FlagStream,
+		Timestamp: time.Now().Unix(),
+		Data:      data,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("encrypt stream frame: %w", err)
+	}
+
+	out, err := binary.Marshal(rawMsg)
+	if err != nil {
+		return fmt.Errorf("marshal stream frame: %w", err)
+	}
+	return key.conn.Send(out)
+}
+
+// refuseLocal keeps proxy streams from reaching services on the node itself
+func refuseLocal(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return errors.New("destination not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"seras-protocol/internal/tun/tuntest"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// closingConn is a fakeConn its transport can close, as the socket servers'
+// connections are
+type closingConn struct {
+	fakeConn
+	closed atomic.Bool
+}
+
+func (c *closingConn) Closed() bool {
+	return c.closed.Load()
+}
+
+// disconnect closes c and tells h, in the order a transport does
+func (c *closingConn) disconnect(h *Handler) {
+	c.closed.Store(true)
+	h.RemoveConnection(c)
+}
+
+// leases returns how many addresses h's pool has handed out
+func (h *Handler) leases() int {
+	h.pool.mu.Lock()
+	defer h.pool.mu.Unlock()
+	return len(h.pool.leases)
+}
+
+// routeCount returns how many addresses route to a connection
+func (h *Handler) routeCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.routes)
+}
+
+func TestHandshakeOnClosedConnection(t *testing.T) {
+	h := newTestHandler(t)
+	private, public := keyPair(t)
+
+	// A client gone mid-handshake gets no session and keeps no lease
+	gone := &closingConn{}
+	gone.closed.Store(true)
+	_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+	h.HandleMessage(gone, data)
+	if h.Clients() != 0 || h.leases() != 0 || h.routeCount() != 0 {
+		t.Fatalf("%d sessions, %d leases, %d routes after a handshake on a closed connection; want none",
+			h.Clients(), h.leases(), h.routeCount())
+	}
+	if n := len(gone.messages()); n != 0 {
+		t.Fatalf("acked a closed connection %d times", n)
+	}
+
+	// One that's still connected elsewhere keeps that session's lease
+	live := &closingConn{}
+	_, data = sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+	h.HandleMessage(live, data)
+	if h.Clients() != 1 || len(live.messages()) != 1 {
+		t.Fatal("handshake on a live connection failed")
+	}
+	ip := h.sessions[live].ip
+
+	_, data = sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+	h.HandleMessage(gone, data)
+	if h.Clients() != 1 || h.leases() != 1 {
+		t.Fatalf("%d sessions, %d leases; want the live connection's one", h.Clients(), h.leases())
+	}
+	if conn, _, ok := h.routeFor(udpPacket(remoteAddr, ip, 1)); !ok || conn != live {
+		t.Fatal("live connection lost its route to a handshake on a closed one")
+	}
+
+	live.disconnect(h)
+	if h.Clients() != 0 || h.leases() != 0 || h.routeCount() != 0 {
+		t.Fatalf("%d sessions, %d leases, %d routes after the last disconnect; want none",
+			h.Clients(), h.leases(), h.routeCount())
+	}
+}
+
+func TestConcurrentConnectDisconnect(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	const clients, rounds = 16, 20
+	h := newTestHandler(t)
+	dev := h.tun.(*tuntest.Device)
+	ctx, stop := context.WithCancel(context.Background())
+	readerDone := make(chan struct{})
+	go func() {
+		h.StartTUNReader(ctx)
+		close(readerDone)
+	}()
+	defer func() {
+		stop()
+		dev.Close()
+		<-readerDone
+	}()
+
+	// Traffic to every address clients can lease, routed while they churn
+	streaming := make(chan struct{})
+	var traffic sync.WaitGroup
+	traffic.Add(1)
+	go func() {
+		defer traffic.Done()
+		addr := netip.MustParseAddr("10.77.0.2")
+		for id := uint16(0); ; id++ {
+			select {
+			case <-streaming:
+				return
+			default:
+			}
+			dev.Inject(udpPacket(remoteAddr, addr, id))
+			if addr = addr.Next(); addr == netip.MustParseAddr("10.77.0.34") {
+				addr = netip.MustParseAddr("10.77.0.2")
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(i)))
+			private, public := keyPair(t)
+			var prev *closingConn
+			for range rounds {
+				conn := &closingConn{}
+				_, data := sealHandshake(t, h, &msg.Handshake{ClientPublicKey: public}, private)
+
+				// The transport drops the connection while its handshake runs
+				dropped := rng.Intn(2) == 0
+				var raced sync.WaitGroup
+				raced.Add(2)
+				go func() {
+					defer raced.Done()
+					h.HandleMessage(conn, data)
+				}()
+				go func() {
+					defer raced.Done()
+					if dropped {
+						conn.disconnect(h)
+					}
+				}()
+				raced.Wait()
+
+				// A connection the client replaced goes away late, after
+				// the new one evicted its session. Transports report each
+				// disconnect once, so a dropped one isn't reported again.
+				if prev != nil {
+					prev.disconnect(h)
+				}
+				prev = conn
+				if dropped {
+					prev = nil
+				}
+			}
+			if prev != nil {
+				prev.disconnect(h)
+			}
+		}()
+	}
+	wg.Wait()
+	close(streaming)
+	traffic.Wait()
+
+	if h.Clients() != 0 || h.leases() != 0 || h.routeCount() != 0 {
+		t.Fatalf("%d sessions, %d leases, %d routes left after every client left; want none",
+			h.Clients(), h.leases(), h.routeCount())
+	}
+}
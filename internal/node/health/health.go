@@ -0,0 +1,111 @@
+// Package health reports node liveness and readiness over HTTP for load
+// balancers and uptime monitors
+package health
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// Status is a snapshot of what the node has brought up
+type Status struct {
+	TUN       bool `json:"tun"`       // TUN interface created
+	Listening bool `json:"listening"` // Transport server accepting clients
+	Clients   int  `json:"clients"`   // Connected clients
+	// Connections refused for exceeding MAX_CLIENTS
+	Rejected uint64 `json:"rejected"`
+}
+
+// Ready reports whether the node can serve clients
+func (s Status) Ready() bool {
+	return s.TUN && s.Listening
+}
+
+// Checker tracks node status as startup and shutdown progress
+type Checker struct {
+	mu        sync.Mutex
+	tun       bool
+	listening bool
+	clients   func() int    // nil until the handler exists
+	rejected  func() uint64 // nil until the server exists
+}
+
+// NewChecker creates a checker that is not yet ready
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// SetTUN records whether the TUN interface is up
+func (c *Checker) SetTUN(up bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tun = up
+}
+
+// SetListening records whether the transport server is accepting clients
+func (c *Checker) SetListening(listening bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listening = listening
+}
+
+// SetClients sets how connected clients are counted
+func (c *Checker) SetClients(count func() int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clients = count
+}
+
+// SetRejected sets how connections refused at the client limit are counted
+func (c *Checker) SetRejected(count func() uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected = count
+}
+
+// Status returns the current status
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := Status{TUN: c.tun, Listening: c.listening}
+	if c.clients != nil {
+		status.Clients = c.clients()
+	}
+	if c.rejected != nil {
+		status.Rejected = c.rejected()
+	}
+	return status
+}
+
+// Handler serves /healthz, which answers 200 while the process runs, and
+// /readyz, which answers 503 until the TUN is up and the server listens.
+// Both return the Status as JSON.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, c.Status(), http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := c.Status()
+		code := http.StatusOK
+		if !status.Ready() {
+			code = http.StatusServiceUnavailable
+		}
+		writeStatus(w, status, code)
+	})
+	return mux
+}
+
+// Serve exposes the health endpoints on http://addr
+func (c *Checker) Serve(addr string) error {
+	slog.Info("Health endpoint listening", "addr", addr)
+	return http.ListenAndServe(addr, c.Handler())
+}
+
+func writeStatus(w http.ResponseWriter, status Status, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/loopback"
+)
+
+// get fetches path and returns the status code and reported status
+func get(t *testing.T, url, path string) (int, Status) {
+	t.Helper()
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s: Content-Type %q", path, ct)
+	}
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return resp.StatusCode, status
+}
+
+// wantReady checks /readyz answers code and /healthz stays up regardless
+func wantReady(t *testing.T, url string, code int) Status {
+	t.Helper()
+	got, status := get(t, url, "/readyz")
+	if got != code {
+		t.Fatalf("/readyz = %d with %+v, want %d", got, status, code)
+	}
+	if got, _ := get(t, url, "/healthz"); got != http.StatusOK {
+		t.Fatalf("/healthz = %d, want 200", got)
+	}
+	return status
+}
+
+func TestReadyTransition(t *testing.T) {
+	checker := NewChecker()
+	web := httptest.NewServer(checker.Handler())
+	defer web.Close()
+
+	// Served from the start, before anything is up
+	if status := wantReady(t, web.URL, http.StatusServiceUnavailable); status != (Status{}) {
+		t.Fatalf("got %+v before startup, want nothing up", status)
+	}
+
+	checker.SetTUN(true)
+	wantReady(t, web.URL, http.StatusServiceUnavailable)
+
+	// The server reports listening the way the node wires it up
+	var clients atomic.Int32
+	s := loopback.NewServer(t.Name(), func(conn *loopback.Connection, data []byte) { clients.Add(1) })
+	s.SetOnListening(func() { checker.SetListening(true) })
+	checker.SetClients(func() int { return int(clients.Load()) })
+	checker.SetRejected(func() uint64 { return 2 })
+	wantReady(t, web.URL, http.StatusServiceUnavailable)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Start() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !checker.Status().Listening {
+		if time.Now().After(deadline) {
+			t.Fatal("server never reported listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client, err := loopback.Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if err := client.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for clients.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if status := wantReady(t, web.URL, http.StatusOK); status != (Status{TUN: true, Listening: true, Clients: 1, Rejected: 2}) {
+		t.Fatalf("got %+v once up", status)
+	}
+
+	// Shutdown turns readiness off first, so balancers drain the node
+	checker.SetListening(false)
+	wantReady(t, web.URL, http.StatusServiceUnavailable)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+	checker.SetTUN(false)
+	wantReady(t, web.URL, http.StatusServiceUnavailable)
+}
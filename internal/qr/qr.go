@@ -0,0 +1,447 @@
+// Package qr encodes short byte strings as QR codes (byte mode, error
+// correction level L, versions 1-10, up to 271 bytes) for display in a
+// terminal. It exists to show keys and endpoints to mobile clients and
+// makes no attempt to cover the rest of the standard.
+package qr
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrTooLong is returned for data beyond what version 10 can hold
+var ErrTooLong = errors.New("qr: data too long")
+
+// block layout for error correction level L, indexed by version
+type layout struct {
+	ecLen  int   // EC codewords per block
+	blocks []int // Data codewords in each block
+	align  []int // Alignment pattern centers
+}
+
+var layouts = [...]layout{
+	1:  {7, []int{19}, nil},
+	2:  {10, []int{34}, []int{6, 18}},
+	3:  {15, []int{55}, []int{6, 22}},
+	4:  {20, []int{80}, []int{6, 26}},
+	5:  {26, []int{108}, []int{6, 30}},
+	6:  {18, []int{68, 68}, []int{6, 34}},
+	7:  {20, []int{78, 78}, []int{6, 22, 38}},
+	8:  {24, []int{97, 97}, []int{6, 24, 42}},
+	9:  {30, []int{116, 116}, []int{6, 26, 46}},
+	10: {18, []int{68, 68, 69, 69}, []int{6, 28, 50}},
+}
+
+// Code is an encoded QR symbol; Dark(x, y) reports module colors
+type Code struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // Finder, timing, alignment and format areas
+}
+
+// Encode builds the smallest QR code holding data
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v < len(layouts); v++ {
+		if capacityBits(v) >= headerBits(v)+8*len(data) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	c := newCode(version)
+	c.drawCodewords(codewords(version, data))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // Undo
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// Size returns the width of the symbol in modules, excluding the quiet zone
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark reports whether the module at column x, row y is dark
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.size || y >= c.size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// Terminal renders the code with half-block characters, two rows per line,
+// surrounded by the standard quiet zone. Light modules are drawn filled, so
+// it scans on terminals with a dark background.
+func (c *Code) Terminal() string {
+	const quiet = 4
+	var sb strings.Builder
+	for y := -quiet; y < c.size+quiet; y += 2 {
+		for x := -quiet; x < c.size+quiet; x++ {
+			top, bottom := !c.Dark(x, y), !c.Dark(x, y+1)
+			if y+1 >= c.size+quiet {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func headerBits(version int) int {
+	if version < 10 {
+		return 4 + 8
+	}
+	return 4 + 16
+}
+
+func capacityBits(version int) int {
+	n := 0
+	for _, b := range layouts[version].blocks {
+		n += b
+	}
+	return 8 * n
+}
+
+// codewords returns the interleaved data and EC codewords for data in byte mode
+func codewords(version int, data []byte) []byte {
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(data), headerBits(version)-4)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := capacityBits(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	stream := bits.bytes()
+
+	l := layouts[version]
+	divisor := rsDivisor(l.ecLen)
+	var blocks, ecs [][]byte
+	for _, n := range l.blocks {
+		blocks = append(blocks, stream[:n])
+		ecs = append(ecs, rsRemainder(stream[:n], divisor))
+		stream = stream[n:]
+	}
+
+	var out []byte
+	for i := 0; i < l.blocks[len(l.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < l.ecLen; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>i)&1 != 0)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func newCode(version int) *Code {
+	size := 17 + 4*version
+	c := &Code{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	for _, p := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x >= 0 && y >= 0 && x < size && y < size {
+					d := max(abs(dx), abs(dy))
+					c.setFunction(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	align := layouts[version].align
+	last := len(align) - 1
+	for i, ax := range align {
+		for j, ay := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // Overlaps a finder
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.setFunction(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	c.drawFormat(0) // Reserve the area; redrawn once the mask is chosen
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			c.setFunction(a, b, (bits>>i)&1 != 0)
+			c.setFunction(b, a, (bits>>i)&1 != 0)
+		}
+	}
+	return c
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFormat writes both copies of the format information for level L
+func (c *Code) drawFormat(mask int) {
+	data := 1<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.size-15+i, bit(i))
+	}
+	c.setFunction(8, c.size-8, true)
+}
+
+// drawCodewords fills the data area in the standard zigzag order
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert // Upward column
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.modules[y][x] = (data[i/8]>>(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask toggles data modules selected by mask; applying it twice undoes it
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan, per the standard's four rules
+func (c *Code) penalty() int {
+	score := 0
+	finder := []bool{true, false, true, true, true, false, true}
+	line := func(get func(i int) bool) {
+		// Rule 1: runs of five or more same-colored modules
+		run := 1
+		for i := 1; i < c.size; i++ {
+			if get(i) == get(i-1) {
+				run++
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+			} else {
+				run = 1
+			}
+		}
+		// Rule 3: finder-like patterns with four light modules on one side
+		for i := 0; i+7 <= c.size; i++ {
+			match := true
+			for k, want := range finder {
+				if get(i+k) != want {
+					match = false
+					break
+				}
+			}
+			if match && (lightRun(get, i-4, i, c.size) || lightRun(get, i+7, i+11, c.size)) {
+				score += 40
+			}
+		}
+	}
+	for y := 0; y < c.size; y++ {
+		line(func(i int) bool { return c.modules[y][i] })
+	}
+	for x := 0; x < c.size; x++ {
+		line(func(i int) bool { return c.modules[i][x] })
+	}
+
+	// Rule 2: 2x2 blocks of one color
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.size && y+1 < c.size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: deviation from half dark
+	total := c.size * c.size
+	score += 10 * (abs(dark*20-total*10) / total)
+	return score
+}
+
+// lightRun reports whether modules from..to-1 are light, treating the
+// outside of the symbol as light
+func lightRun(get func(i int) bool, from, to, size int) bool {
+	for i := from; i < to; i++ {
+		if i >= 0 && i < size && get(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
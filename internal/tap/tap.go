@@ -0,0 +1,188 @@
+package tap
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction tells whether a packet is leaving through or arriving from the tunnel
+type Direction string
+
+const (
+	Outbound Direction = "out" // Before encryption
+	Inbound  Direction = "in"  // After decryption
+)
+
+// ModeLog logs packet summaries instead of writing a capture file
+const ModeLog = "log"
+
+// hexPreview is how many packet bytes a log summary shows
+const hexPreview = 32
+
+// pcap file format constants (LINKTYPE_RAW carries bare IPv4/IPv6 packets)
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	linkTypeRaw  = 101
+	pcapHdrSize  = 24
+	pcapRecSize  = 16
+	pcapVerMajor = 2
+	pcapVerMinor = 4
+)
+
+// Tap records plaintext tunnel packets for debugging.
+// A nil or disabled Tap costs one atomic load per packet.
+type Tap struct {
+	enabled atomic.Bool
+	file    *os.File // nil in log mode
+	mu      sync.Mutex
+}
+
+// Open creates a tap for target: ModeLog logs summaries, anything else is a
+// pcap file path. An empty target returns nil (disabled).
+func Open(target string) (*Tap, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	t := &Tap{}
+	if target != ModeLog {
+		f, err := os.Create(target)
+		if err != nil {
+			return nil, fmt.Errorf("create pcap file: %w", err)
+		}
+		if err := writeFileHeader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.file = f
+	}
+	t.enabled.Store(true)
+	return t, nil
+}
+
+// Capture records packet if the tap is enabled
+func (t *Tap) Capture(dir Direction, packet []byte) {
+	if t == nil || !t.enabled.Load() {
+		return
+	}
+
+	if t.file == nil {
+		slog.Info("Packet", "dir", dir, "len", len(packet), "flow", summary(packet),
+			"hex", hex.EncodeToString(packet[:min(len(packet), hexPreview)]))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := writeRecord(t.file, time.Now(), packet); err != nil {
+		slog.Warn("Packet tap write failed, disabling", "error", err)
+		t.enabled.Store(false)
+	}
+}
+
+// Close stops capturing and closes the pcap file
+func (t *Tap) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.enabled.Store(false)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+func writeFileHeader(f *os.File) error {
+	hdr := make([]byte, pcapHdrSize)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVerMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVerMinor)
+	// Bytes 8-15: timezone offset and timestamp accuracy, both zero
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	if _, err := f.Write(hdr); err != nil {
+		return fmt.Errorf("write pcap header: %w", err)
+	}
+	return nil
+}
+
+func writeRecord(f *os.File, ts time.Time, packet []byte) error {
+	capLen := min(len(packet), pcapSnapLen)
+
+	rec := make([]byte, pcapRecSize+capLen)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(capLen))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(packet)))
+	copy(rec[pcapRecSize:], packet[:capLen])
+
+	_, err := f.Write(rec)
+	return err
+}
+
+// summary formats the packet's 5-tuple, e.g. "tcp 11.0.0.2:51000 -> 1.1.1.1:443"
+func summary(packet []byte) string {
+	if len(packet) == 0 {
+		return "empty"
+	}
+
+	var (
+		src, dst netip.Addr
+		proto    byte
+		payload  []byte
+	)
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return "short ipv4"
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return "bad ipv4 header"
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		proto = packet[9]
+		payload = packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return "short ipv6"
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		proto = packet[6] // Extension headers are not followed
+		payload = packet[40:]
+	default:
+		return fmt.Sprintf("unknown version %d", packet[0]>>4)
+	}
+
+	name := fmt.Sprintf("proto %d", proto)
+	switch proto {
+	case 1, 58:
+		name = "icmp"
+	case 6:
+		name = "tcp"
+	case 17:
+		name = "udp"
+	}
+
+	// TCP and UDP put the ports first
+	if (proto == 6 || proto == 17) && len(payload) >= 4 {
+		srcPort := binary.BigEndian.Uint16(payload[0:2])
+		dstPort := binary.BigEndian.Uint16(payload[2:4])
+		return fmt.Sprintf("%s %s -> %s",
+			name, netip.AddrPortFrom(src, srcPort), netip.AddrPortFrom(dst, dstPort))
+	}
+	return fmt.Sprintf("%s %s -> %s", name, src, dst)
+}
@@ -0,0 +1,167 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// packet builds an IP packet of version v carrying proto with ports 1000 -> 53
+func packet(v int, proto byte, size int) []byte {
+	if v == 4 {
+		p := make([]byte, max(size, 24))
+		p[0], p[9] = 0x45, proto
+		copy(p[12:16], []byte{10, 9, 0, 2})
+		copy(p[16:20], []byte{192, 0, 2, 1})
+		binary.BigEndian.PutUint16(p[20:], 1000)
+		binary.BigEndian.PutUint16(p[22:], 53)
+		return p
+	}
+	p := make([]byte, max(size, 44))
+	p[0], p[6] = 0x60, proto
+	p[8], p[9], p[23] = 0xfd, 0x00, 2
+	p[24], p[25], p[26], p[27], p[39] = 0x20, 0x01, 0x0d, 0xb8, 1
+	binary.BigEndian.PutUint16(p[40:], 1000)
+	binary.BigEndian.PutUint16(p[42:], 53)
+	return p
+}
+
+// record is one packet read back from a capture
+type record struct {
+	ts      time.Time
+	data    []byte
+	origLen int
+}
+
+// readPcap parses a classic little-endian pcap file of raw IP packets
+func readPcap(t *testing.T, path string) []record {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+
+	var hdr struct {
+		Magic        uint32
+		Major, Minor uint16
+		Zone, Sigs   uint32
+		SnapLen      uint32
+		LinkType     uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		t.Fatalf("read file header: %v", err)
+	}
+	if hdr.Magic != 0xa1b2c3d4 || hdr.Major != 2 || hdr.Minor != 4 || hdr.SnapLen != 65535 || hdr.LinkType != 101 {
+		t.Fatalf("file header %+v, want pcap 2.4, snaplen 65535, LINKTYPE_RAW", hdr)
+	}
+
+	var records []record
+	for {
+		var rec struct{ Sec, Usec, CapLen, OrigLen uint32 }
+		if err := binary.Read(r, binary.LittleEndian, &rec); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatalf("record %d header: %v", len(records), err)
+		}
+		if rec.Usec >= 1e6 || rec.CapLen > hdr.SnapLen || rec.CapLen > rec.OrigLen {
+			t.Fatalf("record %d header %+v", len(records), rec)
+		}
+		body := make([]byte, rec.CapLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatalf("record %d body: %v", len(records), err)
+		}
+		records = append(records, record{
+			ts:      time.Unix(int64(rec.Sec), int64(rec.Usec)*1000),
+			data:    body,
+			origLen: int(rec.OrigLen),
+		})
+	}
+}
+
+func TestPcapCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.pcap")
+	tap, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Truncate(time.Second)
+	packets := [][]byte{packet(4, 17, 60), packet(4, 6, 1500), packet(6, 17, 100)}
+	for i, p := range packets {
+		dir := Outbound
+		if i%2 == 1 {
+			dir = Inbound
+		}
+		tap.Capture(dir, p)
+	}
+	// Larger than the snap length: truncated, with its real length kept
+	jumbo := packet(6, 17, 70000)
+	tap.Capture(Outbound, jumbo)
+	if err := tap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A closed tap records nothing more
+	tap.Capture(Outbound, packets[0])
+
+	records := readPcap(t, path)
+	if len(records) != len(packets)+1 {
+		t.Fatalf("capture has %d records, want %d", len(records), len(packets)+1)
+	}
+	for i, p := range packets {
+		rec := records[i]
+		if !bytes.Equal(rec.data, p) || rec.origLen != len(p) {
+			t.Errorf("record %d: %d of %d bytes, want the %d-byte packet", i, len(rec.data), rec.origLen, len(p))
+		}
+		if rec.ts.Before(start) || rec.ts.After(time.Now()) {
+			t.Errorf("record %d timestamp %v", i, rec.ts)
+		}
+	}
+	last := records[len(packets)]
+	if len(last.data) != 65535 || last.origLen != len(jumbo) || !bytes.Equal(last.data, jumbo[:65535]) {
+		t.Errorf("jumbo record: %d of %d bytes", len(last.data), last.origLen)
+	}
+}
+
+func TestDisabledTap(t *testing.T) {
+	tap, err := Open("")
+	if err != nil || tap != nil {
+		t.Fatalf("Open(\"\") = %v, %v; want a nil tap", tap, err)
+	}
+	// A nil tap is usable and does nothing
+	tap.Capture(Outbound, packet(4, 17, 60))
+	if err := tap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing", "tunnel.pcap")); err == nil {
+		t.Fatal("opened a capture in a missing directory")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   string
+	}{
+		{packet(4, 17, 28), "udp 10.9.0.2:1000 -> 192.0.2.1:53"},
+		{packet(4, 6, 40), "tcp 10.9.0.2:1000 -> 192.0.2.1:53"},
+		{packet(4, 1, 28), "icmp 10.9.0.2 -> 192.0.2.1"},
+		{packet(6, 17, 48), "udp [fd00::2]:1000 -> [2001:db8::1]:53"},
+		{packet(6, 47, 48), "proto 47 fd00::2 -> 2001:db8::1"},
+		{nil, "empty"},
+		{packet(4, 17, 28)[:19], "short ipv4"},
+		{[]byte{0x44, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "bad ipv4 header"},
+		{packet(6, 17, 48)[:39], "short ipv6"},
+		{[]byte{0x50}, "unknown version 5"},
+	}
+	for _, tt := range tests {
+		if got := summary(tt.packet); got != tt.want {
+			t.Errorf("summary = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -1,16 +1,34 @@
 package client
 
 import (
+	"context"
 	"fmt"
 
+	"seras-protocol/internal/transport/client/tcp"
 	"seras-protocol/internal/transport/client/udp"
+	"seras-protocol/internal/transport/client/v2ray"
 	"seras-protocol/internal/transport/client/wss"
+	"seras-protocol/internal/transport/loopback"
 )
 
 type Client interface {
 	Disconnect() error
 	Send(data []byte) error
 	Receive() ([]byte, error)
+	// SendContext and ReceiveContext return ctx.Err() as soon as ctx is done,
+	// interrupting a blocked call. The transport may be unusable afterwards.
+	SendContext(ctx context.Context, data []byte) error
+	ReceiveContext(ctx context.Context) ([]byte, error)
+}
+
+// Roamer is a client transport that can follow the host to a new network
+// without ending its session on the node
+type Roamer interface {
+	// Stale reports whether the local address in use is no longer the one
+	// the node is reached from
+	Stale() bool
+	// Rebind moves the transport to the current local address
+	Rebind() error
 }
 
 type Config interface {
@@ -33,6 +51,24 @@ func (f *Factory) NewClient(connType string, transportConfig Config) (Client, er
 			return nil, fmt.Errorf("invalid udp config type")
 		}
 		return udp.NewTransport(udpConfig)
+	case "v2ray":
+		v2rayConfig, ok := transportConfig.(*v2ray.Config)
+		if !ok {
+			return nil, fmt.Errorf("invalid v2ray config type")
+		}
+		return v2ray.NewTransport(v2rayConfig)
+	case "tcp":
+		tcpConfig, ok := transportConfig.(*tcp.Config)
+		if !ok {
+			return nil, fmt.Errorf("invalid tcp config type")
+		}
+		return tcp.NewTransport(tcpConfig)
+	case "loopback":
+		loopbackConfig, ok := transportConfig.(*loopback.Config)
+		if !ok {
+			return nil, fmt.Errorf("invalid loopback config type")
+		}
+		return loopback.NewTransport(loopbackConfig)
 	default:
 		return nil, fmt.Errorf("unsupported transport type: %s", connType)
 	}
@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"seras-protocol/internal/transport/frag"
+)
+
+// DialTimeout bounds connecting to the node
+const DialTimeout = 10 * time.Second
+
+type Config struct {
+	Addr           string // Node address, host:port
+	MaxMessageSize int    // Largest message sent or received (0 = unlimited)
+}
+
+func (c *Config) GetFromEnv() error {
+	c.Addr = os.Getenv("TCP_ADDR")
+	if c.Addr == "" {
+		return fmt.Errorf("TCP_ADDR is not set")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("TCP_ADDR must be host:port, got: %s", c.Addr)
+	}
+	slog.Info("TCP address configured", "addr", c.Addr)
+	return nil
+}
+
+// Transport carries messages over a plain TCP stream, each one
+// length-prefixed, for networks that block UDP and WebSocket upgrades
+type Transport struct {
+	conn    net.Conn
+	reader  *bufio.Reader // Never read concurrently, as Receive isn't
+	writeMu sync.Mutex    // Keeps frames from interleaving
+	maxSize int
+}
+
+func NewTransport(config *Config) (*Transport, error) {
+	slog.Info("Connecting to TCP server", "addr", config.Addr)
+	conn, err := net.DialTimeout("tcp", config.Addr, DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	slog.Info("TCP connected", "local", conn.LocalAddr(), "remote", conn.RemoteAddr())
+
+	return &Transport{conn: conn, reader: bufio.NewReader(conn), maxSize: config.MaxMessageSize}, nil
+}
+
+func (t *Transport) Disconnect() error {
+	slog.Info("Disconnecting TCP")
+	return t.conn.Close()
+}
+
+// Send writes one message. A partly written frame leaves the stream out of
+// step, so the connection is closed after a failed write, failing a pending
+// Receive too.
+func (t *Transport) Send(data []byte) error {
+	if t.maxSize > 0 && len(data) > t.maxSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), t.maxSize)
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := frag.WriteFrame(t.conn, data); err != nil {
+		t.conn.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// SendContext sends data, failing the write once ctx is done
+func (t *Transport) SendContext(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := t.Send(data); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Transport) Receive() ([]byte, error) {
+	return t.ReceiveContext(context.Background())
+}
+
+// ReceiveContext reads the next message, failing the read once ctx is done.
+// The stream cannot be read from after a failed read.
+func (t *Transport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	data, err := frag.ReadFrame(t.reader, t.maxSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	return data, nil
+}
@@ -1,15 +1,47 @@
 package udp
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"seras-protocol/internal/transport/frag"
 )
 
+// ErrRejected is returned by Receive when the node refuses the connection,
+// e.g. because it is serving as many clients as it allows. Rejections are
+// unauthenticated, so one is only honoured until the first message arrives;
+// a node that answered us has already accepted the connection.
+var ErrRejected = errors.New("rejected by node")
+
+// ErrReadTimeout is returned by Receive when nothing arrived within the read
+// timeout. The socket is still usable; an idle tunnel sees it routinely.
+var ErrReadTimeout = errors.New("no datagram within read timeout")
+
+// DefaultReadTimeout is how long Receive waits for a datagram when the
+// config sets no timeout
+const DefaultReadTimeout = 30 * time.Second
+
+// ErrNoMigration is returned by Rebind when datagrams carry no connection ID,
+// so the node could not tell the new address belongs to the same session
+var ErrNoMigration = errors.New("rebind needs connection migration")
+
 type Config struct {
-	Addr string
+	Addr           string
+	MaxMessageSize int  // Largest message sent or reassembled (0 = unlimited)
+	NoMigration    bool // Leave datagrams untagged, for nodes that predate connection IDs
+	// How long Receive waits for a datagram before returning ErrReadTimeout
+	// (0 = DefaultReadTimeout)
+	ReadTimeout time.Duration
 }
 
 func (c *Config) GetFromEnv() error {
@@ -17,13 +49,37 @@ func (c *Config) GetFromEnv() error {
 	if c.Addr == "" {
 		return fmt.Errorf("UDP_ADDR is not set")
 	}
+	if env := os.Getenv("UDP_MIGRATION"); env != "" {
+		migrate, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("UDP_MIGRATION must be a boolean, got: %s", env)
+		}
+		c.NoMigration = !migrate
+	}
+	if env := os.Getenv("UDP_READ_TIMEOUT"); env != "" {
+		timeout, err := time.ParseDuration(env)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("UDP_READ_TIMEOUT must be a positive duration, got: %s", env)
+		}
+		c.ReadTimeout = timeout
+	}
 	slog.Info("UDP address configured", "addr", c.Addr)
 	return nil
 }
 
 type Transport struct {
-	conn       *net.UDPConn
-	serverAddr *net.UDPAddr
+	conn        atomic.Pointer[net.UDPConn] // Replaced by Rebind
+	rebindMu    sync.Mutex                  // Orders Rebind against Disconnect
+	closed      bool                        // Set by Disconnect, guarded by rebindMu
+	migrate     bool
+	serverAddr  *net.UDPAddr
+	fragmenter  *frag.Fragmenter
+	reassembler *frag.Reassembler
+	readBuf     []byte // Reused by Receive, which is never called concurrently
+	answered    bool   // A whole message arrived, so rejections are forged; owned by Receive
+	maxSize     int
+	readTimeout time.Duration
+	deadlineMu  sync.Mutex // Orders deadline updates against cancellation
 }
 
 func NewTransport(config *Config) (*Transport, error) {
@@ -40,25 +96,176 @@ func NewTransport(config *Config) (*Transport, error) {
 	}
 
 	slog.Info("UDP connected", "local", conn.LocalAddr(), "remote", serverAddr)
-	return &Transport{conn: conn, serverAddr: serverAddr}, nil
+	t := &Transport{
+		serverAddr:  serverAddr,
+		fragmenter:  frag.NewFragmenter(frag.DefaultChunkSize),
+		reassembler: frag.NewReassembler(frag.DefaultTimeout),
+		readBuf:     make([]byte, 65535),
+		maxSize:     config.MaxMessageSize,
+		readTimeout: config.ReadTimeout,
+		migrate:     !config.NoMigration,
+	}
+	if t.readTimeout <= 0 {
+		t.readTimeout = DefaultReadTimeout
+	}
+	t.conn.Store(conn)
+	t.reassembler.SetMaxSize(t.maxSize)
+
+	// A random connection ID lets the node keep our session when our
+	// address changes, e.g. on a NAT rebinding or network switch
+	if !config.NoMigration {
+		var id [frag.ConnIDSize]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to generate connection ID: %w", err)
+		}
+		t.fragmenter.SetConnID(binary.BigEndian.Uint64(id[:]) | 1)
+	}
+	return t, nil
 }
 
 func (t *Transport) Disconnect() error {
 	slog.Info("Disconnecting UDP")
-	return t.conn.Close()
+	t.rebindMu.Lock()
+	defer t.rebindMu.Unlock()
+	t.closed = true
+	return t.conn.Load().Close()
+}
+
+// LocalAddr returns the address datagrams are currently sent from
+func (t *Transport) LocalAddr() net.Addr {
+	return t.conn.Load().LocalAddr()
+}
+
+// Stale reports whether the OS now routes to the node from a different local
+// address than the socket is bound to, as after switching networks. It is
+// false while there is no route at all, since rebinding can't help then.
+func (t *Transport) Stale() bool {
+	probe, err := net.DialUDP("udp", nil, t.serverAddr)
+	if err != nil {
+		return false
+	}
+	defer probe.Close()
+	current := t.conn.Load().LocalAddr().(*net.UDPAddr)
+	return !probe.LocalAddr().(*net.UDPAddr).IP.Equal(current.IP)
+}
+
+// Rebind moves the transport to a new socket dialed from the current route to
+// the node. The connection ID is kept, so the node migrates the session to
+// the new address on the next datagram; fragments of a message caught in the
+// switch are lost. A pending Receive carries on on the new socket.
+func (t *Transport) Rebind() error {
+	if !t.migrate {
+		return ErrNoMigration
+	}
+	conn, err := net.DialUDP("udp", nil, t.serverAddr)
+	if err != nil {
+		return fmt.Errorf("failed to dial UDP: %w", err)
+	}
+
+	t.rebindMu.Lock()
+	defer t.rebindMu.Unlock()
+	if t.closed {
+		conn.Close()
+		return net.ErrClosed
+	}
+	old := t.conn.Swap(conn)
+	old.Close()
+	slog.Info("UDP rebound", "old", old.LocalAddr(), "local", conn.LocalAddr(), "remote", t.serverAddr)
+	return nil
 }
 
 func (t *Transport) Send(data []byte) error {
-	_, err := t.conn.Write(data)
-	return err
+	if t.maxSize > 0 && len(data) > t.maxSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), t.maxSize)
+	}
+	chunks, err := t.fragmenter.Split(data)
+	if err != nil {
+		return err
+	}
+	conn := t.conn.Load()
+	for _, chunk := range chunks {
+		if _, err := conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendContext sends data unless ctx is already done; UDP writes don't block
+func (t *Transport) SendContext(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.Send(data)
 }
 
 func (t *Transport) Receive() ([]byte, error) {
-	buf := make([]byte, 65535)
-	t.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	n, err := t.conn.Read(buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read UDP: %w", err)
+	return t.ReceiveContext(context.Background())
+}
+
+// ReceiveContext reads the next whole message, failing the read once ctx is
+// done. Every datagram restarts the read timeout; when it runs out the error
+// wraps ErrReadTimeout and the transport can be read again.
+func (t *Transport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		t.deadlineMu.Lock()
+		defer t.deadlineMu.Unlock()
+		t.conn.Load().SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		// Checked under the lock so a cancellation can't be overwritten
+		t.deadlineMu.Lock()
+		if err := ctx.Err(); err != nil {
+			t.deadlineMu.Unlock()
+			return nil, err
+		}
+		conn := t.conn.Load()
+		conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+		t.deadlineMu.Unlock()
+
+		n, err := conn.Read(t.readBuf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// Rebind closed the socket under us; read from its replacement
+			if t.conn.Load() != conn {
+				continue
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, fmt.Errorf("%w (%s)", ErrReadTimeout, t.readTimeout)
+			}
+			return nil, fmt.Errorf("failed to read UDP: %w", err)
+		}
+
+		if t.maxSize > 0 && n-frag.HeaderSize > t.maxSize {
+			slog.Warn("Dropping oversized UDP datagram", "size", n, "limit", t.maxSize)
+			continue
+		}
+
+		if reason, ok := frag.Rejection(t.readBuf[:n]); ok {
+			if t.answered {
+				slog.Debug("Ignoring UDP rejection after the node answered", "reason", reason)
+				continue
+			}
+			return nil, fmt.Errorf("%w: %s", ErrRejected, reason)
+		}
+
+		// Copy only what arrived; the caller and reassembler keep the result
+		datagram := make([]byte, n)
+		copy(datagram, t.readBuf[:n])
+
+		message, err := t.reassembler.Add(datagram)
+		if err != nil {
+			slog.Warn("Dropping malformed UDP datagram", "error", err)
+			continue
+		}
+		if message != nil {
+			t.answered = true
+			return message, nil
+		}
 	}
-	return buf[:n], nil
 }
@@ -0,0 +1,315 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/frag"
+)
+
+// listen opens a node-side socket on loopback
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+	node, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// connect returns a transport to node
+func connect(t *testing.T, node *net.UDPConn, config Config) *Transport {
+	t.Helper()
+	config.Addr = node.LocalAddr().String()
+	transport, err := NewTransport(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Disconnect() })
+	return transport
+}
+
+// reply sends data from node to the transport in one datagram
+func reply(t *testing.T, node *net.UDPConn, transport *Transport, data []byte) {
+	t.Helper()
+	chunks, err := frag.NewFragmenter(len(data) + 1).Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.WriteToUDP(chunks[0], transport.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOversizedMessages(t *testing.T) {
+	node := listen(t)
+	transport := connect(t, node, Config{MaxMessageSize: 100, ReadTimeout: 5 * time.Second})
+
+	if err := transport.Send(make([]byte, 101)); err == nil {
+		t.Fatal("sent a message over the limit")
+	}
+	if err := transport.Send(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	node.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := node.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := n - frag.HeaderSize - frag.ConnIDSize; payload != 100 {
+		t.Fatalf("node got a %d byte message, want the 100 byte one", payload)
+	}
+
+	// The oversized reply is skipped, the next one delivered
+	reply(t, node, transport, bytes.Repeat([]byte{1}, 101))
+	reply(t, node, transport, bytes.Repeat([]byte{2}, 100))
+	got, err := transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte{2}, 100)) {
+		t.Fatalf("received %d bytes of %d, want the 100 byte reply", len(got), got[0])
+	}
+}
+
+func TestReceiveContextCancel(t *testing.T) {
+	node := listen(t)
+	transport := connect(t, node, Config{ReadTimeout: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() {
+		_, err := transport.ReceiveContext(ctx)
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-received:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive still blocked after cancel")
+	}
+
+	if _, err := transport.ReceiveContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("already canceled: got %v, want context.Canceled", err)
+	}
+	if err := transport.SendContext(ctx, []byte{1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("send on a canceled context: got %v, want context.Canceled", err)
+	}
+
+	// The socket outlives the canceled read
+	reply(t, node, transport, []byte("after"))
+	got, err := transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "after" {
+		t.Fatalf("received %q, want after", got)
+	}
+}
+
+func TestRejection(t *testing.T) {
+	node := listen(t)
+	transport := connect(t, node, Config{ReadTimeout: 5 * time.Second})
+	reject := func() {
+		t.Helper()
+		if _, err := node.WriteToUDP(frag.RejectFrame("server full"), transport.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before the node has answered, a rejection ends the connection attempt
+	reject()
+	if _, err := transport.Receive(); !errors.Is(err, ErrRejected) {
+		t.Fatalf("got %v, want ErrRejected", err)
+	}
+
+	// Once it has, rejections are forgeries and skipped
+	reply(t, node, transport, []byte("welcome"))
+	if got, err := transport.Receive(); err != nil || string(got) != "welcome" {
+		t.Fatalf("received %q, %v; want welcome", got, err)
+	}
+	reject()
+	reply(t, node, transport, []byte("data"))
+	if got, err := transport.Receive(); err != nil || string(got) != "data" {
+		t.Fatalf("received %q, %v; want the data past the rejection", got, err)
+	}
+}
+
+// readFrom returns the next message node receives, its sender and the
+// connection ID it carries
+func readFrom(t *testing.T, node *net.UDPConn) (string, *net.UDPAddr, uint64) {
+	t.Helper()
+	buf := make([]byte, 2048)
+	node.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := node.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, id := frag.StripConnID(buf[:n])
+	return string(chunk[frag.HeaderSize:]), from, id
+}
+
+func TestRebindResumesSession(t *testing.T) {
+	node := listen(t)
+	transport := connect(t, node, Config{ReadTimeout: 5 * time.Second})
+
+	// Move the socket to another local address, as a network switch would;
+	// the route to the node still leaves from 127.0.0.1
+	moved, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, node.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	transport.conn.Swap(moved).Close()
+	if err := transport.Send([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	_, oldAddr, oldID := readFrom(t, node)
+	if !transport.Stale() {
+		t.Fatal("socket on another address than the route's not reported stale")
+	}
+
+	// A receive pending across the rebind carries on on the new socket
+	received := make(chan []byte, 1)
+	go func() {
+		data, err := transport.Receive()
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := transport.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Stale() {
+		t.Fatal("still stale after rebinding")
+	}
+
+	if err := transport.Send([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	message, newAddr, newID := readFrom(t, node)
+	if message != "after" {
+		t.Fatalf("node got %q, want after", message)
+	}
+	if newAddr.String() == oldAddr.String() || !newAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("sent from %s after rebinding, was %s", newAddr, oldAddr)
+	}
+	if newID != oldID {
+		t.Fatalf("connection ID changed from %#x to %#x, so the node can't migrate the session", oldID, newID)
+	}
+
+	reply(t, node, transport, []byte("resumed"))
+	select {
+	case data := <-received:
+		if string(data) != "resumed" {
+			t.Fatalf("received %q, want resumed", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending receive never got the reply to the new address")
+	}
+}
+
+func TestRebindRefused(t *testing.T) {
+	node := listen(t)
+	fixed := connect(t, node, Config{NoMigration: true})
+	if err := fixed.Rebind(); !errors.Is(err, ErrNoMigration) {
+		t.Fatalf("without migration: got %v, want ErrNoMigration", err)
+	}
+
+	closed := connect(t, node, Config{})
+	closed.Disconnect()
+	if err := closed.Rebind(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("after Disconnect: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	node := listen(t)
+	transport := connect(t, node, Config{ReadTimeout: timeout})
+
+	// Silence runs out the timeout without spoiling the socket
+	start := time.Now()
+	if _, err := transport.Receive(); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("got %v, want ErrReadTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("timed out after %v, want at least %v", elapsed, timeout)
+	}
+	reply(t, node, transport, []byte("after"))
+	if got, err := transport.Receive(); err != nil || string(got) != "after" {
+		t.Fatalf("received %q, %v after a timeout; want after", got, err)
+	}
+
+	// Each datagram restarts the timeout, so a steady trickle outlasts it
+	chunks, err := frag.NewFragmenter(frag.DefaultChunkSize).Split([]byte("trickle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range 5 {
+			time.Sleep(timeout / 2)
+			node.WriteToUDP(chunks[0], transport.LocalAddr().(*net.UDPAddr))
+		}
+	}()
+	for i := range 5 {
+		if got, err := transport.Receive(); err != nil || string(got) != "trickle" {
+			t.Fatalf("message %d: received %q, %v; want trickle", i+1, got, err)
+		}
+	}
+
+	// A dead socket is a real error, not a timeout
+	transport.Disconnect()
+	_, err = transport.Receive()
+	if err == nil || errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("after Disconnect: got %v, want a socket error", err)
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("after Disconnect: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"5s", 5 * time.Second, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"0s", 0, true},
+		{"-1s", 0, true},
+		{"30", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("UDP_ADDR", "192.0.2.1:8443")
+		t.Setenv("UDP_READ_TIMEOUT", tt.env)
+		var config Config
+		err := config.GetFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("UDP_READ_TIMEOUT=%q: got error %v, want error %v", tt.env, err, tt.wantErr)
+			continue
+		}
+		if err == nil && config.ReadTimeout != tt.want {
+			t.Errorf("UDP_READ_TIMEOUT=%q: got %v, want %v", tt.env, config.ReadTimeout, tt.want)
+		}
+	}
+
+	// An unset timeout falls back to the default
+	node := listen(t)
+	if transport := connect(t, node, Config{}); transport.readTimeout != DefaultReadTimeout {
+		t.Fatalf("read timeout %v, want the default %v", transport.readTimeout, DefaultReadTimeout)
+	}
+}
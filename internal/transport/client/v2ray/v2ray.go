@@ -0,0 +1,158 @@
+package v2ray
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"seras-protocol/internal/transport/frag"
+	"seras-protocol/internal/transport/v2ray"
+)
+
+// DialTimeout bounds connecting and exchanging the VLESS headers
+const DialTimeout = 10 * time.Second
+
+type Config struct {
+	Url            string // VLESS share link: vless://<uuid>@<host>:<port>[?security=tls&sni=<name>]
+	Dest           string // Destination requested in the VLESS header (empty = the URL's host:port)
+	MaxMessageSize int    // Largest message sent or received (0 = unlimited)
+	DialAddr       string // Address to connect to instead of the URL's host (optional)
+}
+
+func (c *Config) GetFromEnv() error {
+	c.Url = os.Getenv("V2RAY_URL")
+	if c.Url == "" {
+		return fmt.Errorf("V2RAY_URL is not set")
+	}
+	ep, err := v2ray.ParseURL(c.Url)
+	if err != nil {
+		return fmt.Errorf("V2RAY_URL %w", err)
+	}
+	c.Dest = os.Getenv("V2RAY_DEST")
+	if c.Dest != "" {
+		if _, _, err := net.SplitHostPort(c.Dest); err != nil {
+			return fmt.Errorf("V2RAY_DEST must be host:port, got: %s", c.Dest)
+		}
+	}
+	slog.Info("V2Ray endpoint configured", "addr", ep.Addr, "tls", ep.TLS, "dest", c.Dest)
+	return nil
+}
+
+type Transport struct {
+	conn    net.Conn
+	reader  *bufio.Reader // Never read concurrently, as Receive isn't
+	writeMu sync.Mutex    // Keeps frames from interleaving
+	maxSize int
+}
+
+// NewTransport connects to the VLESS server and exchanges headers; after that
+// each message is one length-prefixed frame on the stream
+func NewTransport(config *Config) (*Transport, error) {
+	ep, err := v2ray.ParseURL(config.Url)
+	if err != nil {
+		return nil, err
+	}
+	dest := config.Dest
+	if dest == "" {
+		dest = ep.Addr
+	}
+	addr := ep.Addr
+	if config.DialAddr != "" {
+		addr = config.DialAddr
+	}
+
+	slog.Info("Connecting to V2Ray", "addr", addr, "tls", ep.TLS)
+	conn, err := net.DialTimeout("tcp", addr, DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	if ep.TLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: ep.ServerName})
+	}
+
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	reader := bufio.NewReader(conn)
+	if err := v2ray.WriteRequest(conn, ep.ID, dest); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if err := v2ray.ReadResponse(reader); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("V2Ray connected")
+
+	return &Transport{conn: conn, reader: reader, maxSize: config.MaxMessageSize}, nil
+}
+
+func (t *Transport) Disconnect() error {
+	slog.Info("Disconnecting V2Ray")
+	return t.conn.Close()
+}
+
+// Send writes one message. A partly written frame leaves the stream out of
+// step, so the connection is closed after a failed write, failing a pending
+// Receive too.
+func (t *Transport) Send(data []byte) error {
+	if t.maxSize > 0 && len(data) > t.maxSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), t.maxSize)
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := frag.WriteFrame(t.conn, data); err != nil {
+		t.conn.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// SendContext sends data, failing the write once ctx is done
+func (t *Transport) SendContext(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := t.Send(data); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Transport) Receive() ([]byte, error) {
+	return t.ReceiveContext(context.Background())
+}
+
+// ReceiveContext reads the next message, failing the read once ctx is done.
+// The stream cannot be read from after a failed read.
+func (t *Transport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	data, err := frag.ReadFrame(t.reader, t.maxSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	return data, nil
+}
@@ -1,16 +1,35 @@
 package wss
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"os"
 )
 
+const (
+	DefaultPingInterval = 15 * time.Second
+	DefaultPongTimeout  = 45 * time.Second
+)
+
 type Config struct {
-	Url string
+	Url            string
+	PingInterval   time.Duration // How often to ping the node
+	PongTimeout    time.Duration // Connection is dead if no pong within this
+	Pin            []byte        // SHA-256 of the node's leaf certificate (optional)
+	MaxMessageSize int           // Largest message sent or received (0 = unlimited)
+	DialAddr       string        // Address to connect to instead of the URL's host (optional)
 }
 
 func (c *Config) GetFromEnv() error {
@@ -29,18 +48,86 @@ func (c *Config) GetFromEnv() error {
 		c.Url = strings.TrimSuffix(c.Url, "/") + "/ws"
 	}
 
-	slog.Info("WebSocket URL configured", "url", c.Url)
+	c.PingInterval = DefaultPingInterval
+	if env := os.Getenv("WS_PING_INTERVAL"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("WS_PING_INTERVAL must be a positive duration, got: %s", env)
+		}
+		c.PingInterval = d
+	}
+
+	c.PongTimeout = DefaultPongTimeout
+	if env := os.Getenv("WS_PONG_TIMEOUT"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("WS_PONG_TIMEOUT must be a positive duration, got: %s", env)
+		}
+		c.PongTimeout = d
+	}
+
+	if env := os.Getenv("WS_PIN"); env != "" {
+		pin, err := hex.DecodeString(strings.ReplaceAll(env, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return fmt.Errorf("WS_PIN must be a SHA-256 certificate fingerprint in hex, got: %s", env)
+		}
+		c.Pin = pin
+	}
+
+	slog.Info("WebSocket URL configured", "url", c.Url, "pinned", c.Pin != nil)
 	return nil
 }
 
+// dialer returns a WebSocket dialer, pinning the node certificate and
+// overriding the dialed address if configured
+func (c *Config) dialer() *websocket.Dialer {
+	if c.Pin == nil && c.DialAddr == "" {
+		return websocket.DefaultDialer
+	}
+
+	dialer := *websocket.DefaultDialer
+	if c.DialAddr != "" {
+		// The URL still names the host for TLS and the Host header
+		dialer.NetDialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, c.DialAddr)
+		}
+	}
+	if c.Pin == nil {
+		return &dialer
+	}
+	dialer.TLSClientConfig = &tls.Config{
+		// The pin replaces CA validation so self-signed node certificates work
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("node presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], c.Pin) {
+				return fmt.Errorf("node certificate fingerprint %s does not match WS_PIN", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		},
+	}
+	return &dialer
+}
+
 type Transport struct {
-	conn *websocket.Conn
+	conn      *websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	maxSize   int
+
+	// Set once a context cancels a read, so pongs stop extending the deadline
+	interrupted bool
+	deadlineMu  sync.Mutex
 }
 
 func NewTransport(config *Config) (*Transport, error) {
 	slog.Info("Connecting to WebSocket", "url", config.Url)
 
-	conn, resp, err := websocket.DefaultDialer.Dial(config.Url, nil)
+	conn, resp, err := config.dialer().Dial(config.Url, nil)
 	if err != nil {
 		if resp != nil {
 			slog.Error("WebSocket dial failed", "status", resp.Status, "statusCode", resp.StatusCode)
@@ -49,21 +136,115 @@ func NewTransport(config *Config) (*Transport, error) {
 		return nil, fmt.Errorf("failed to connect: %v", err)
 	}
 	slog.Info("WebSocket connected")
-	return &Transport{conn}, nil
+
+	t := &Transport{conn: conn, done: make(chan struct{}), maxSize: config.MaxMessageSize}
+	if t.maxSize > 0 {
+		conn.SetReadLimit(int64(t.maxSize))
+	}
+	t.startKeepalive(config.PingInterval, config.PongTimeout)
+	return t, nil
+}
+
+// startKeepalive pings the node periodically; Receive fails if pongs stop arriving
+func (t *Transport) startKeepalive(pingInterval, pongTimeout time.Duration) {
+	if pingInterval <= 0 {
+		pingInterval = DefaultPingInterval
+	}
+	if pongTimeout <= 0 {
+		pongTimeout = DefaultPongTimeout
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	t.conn.SetPongHandler(func(string) error {
+		t.deadlineMu.Lock()
+		defer t.deadlineMu.Unlock()
+		if t.interrupted {
+			return nil
+		}
+		return t.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				if err := t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+					slog.Error("WebSocket ping failed", "error", err)
+					t.conn.Close()
+					return
+				}
+			}
+		}
+	}()
 }
 
 func (t *Transport) Disconnect() error {
 	slog.Info("Disconnecting WebSocket")
+	t.closeOnce.Do(func() { close(t.done) })
 	return t.conn.Close()
 }
 
+// Send writes one message. A WebSocket connection can't be written to after a
+// failed write, so the connection is closed then, failing a pending Receive
+// too; the caller's reconnect loop sees the error either way.
 func (t *Transport) Send(data []byte) error {
-	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+	if t.maxSize > 0 && len(data) > t.maxSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), t.maxSize)
+	}
+	if err := t.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.conn.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// SendContext sends data, failing the write once ctx is done
+func (t *Transport) SendContext(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := t.Send(data); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
 }
 
 func (t *Transport) Receive() ([]byte, error) {
+	return t.ReceiveContext(context.Background())
+}
+
+// ReceiveContext reads the next message, failing the read once ctx is done.
+// A WebSocket connection cannot be read from after a failed read.
+func (t *Transport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		t.deadlineMu.Lock()
+		defer t.deadlineMu.Unlock()
+		t.interrupted = true
+		t.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
 	tp, data, err := t.conn.ReadMessage()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, fmt.Errorf("failed to read message: %v", err)
 	}
 	if tp != websocket.BinaryMessage {
@@ -0,0 +1,247 @@
+package wss
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	wssserver "seras-protocol/internal/transport/server/wss"
+)
+
+// selfSigned writes a self-signed certificate for 127.0.0.1 and its key to
+// dir and returns their paths and the certificate's SHA-256
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string, fingerprint [32]byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "seras test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, sha256.Sum256(der)
+}
+
+// startTLSServer runs an echoing wss server with a self-signed certificate
+// and returns its URL and the certificate's fingerprint
+func startTLSServer(t *testing.T) (string, [32]byte) {
+	t.Helper()
+	certFile, keyFile, fingerprint := selfSigned(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := wssserver.NewServer(addr, func(conn *wssserver.Connection, data []byte) {
+		conn.Send(data)
+	})
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.StartTLS(certFile, keyFile) }()
+	select {
+	case <-listening:
+	case err := <-serveErr:
+		t.Fatalf("start TLS server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Stop(ctx)
+	})
+	return "wss://" + addr + "/ws", fingerprint
+}
+
+func TestPinnedConnection(t *testing.T) {
+	url, fingerprint := startTLSServer(t)
+
+	transport, err := NewTransport(&Config{Url: url, Pin: fingerprint[:]})
+	if err != nil {
+		t.Fatalf("dial with the right pin: %v", err)
+	}
+	defer transport.Disconnect()
+	if err := transport.Send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("got %q back, want ping", reply)
+	}
+}
+
+func TestPinRejectsWrongCertificate(t *testing.T) {
+	url, fingerprint := startTLSServer(t)
+
+	wrong := fingerprint
+	wrong[0] ^= 0xff
+	_, err := NewTransport(&Config{Url: url, Pin: wrong[:]})
+	if err == nil {
+		t.Fatal("connected to a node whose certificate doesn't match the pin")
+	}
+	if !strings.Contains(err.Error(), "does not match WS_PIN") {
+		t.Fatalf("got %v, want a pin mismatch", err)
+	}
+}
+
+func TestUnpinnedRejectsSelfSigned(t *testing.T) {
+	url, _ := startTLSServer(t)
+	if _, err := NewTransport(&Config{Url: url}); err == nil {
+		t.Fatal("connected to a self-signed node without a pin")
+	}
+}
+
+func TestGetFromEnvParsesPin(t *testing.T) {
+	sum := sha256.Sum256([]byte("cert"))
+	hexPin := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(hexPin); i += 2 {
+		colons = append(colons, strings.ToUpper(hexPin[i:i+2]))
+	}
+
+	tests := []struct {
+		pin     string
+		wantErr bool
+	}{
+		{"", false},
+		{hexPin, false},
+		{strings.Join(colons, ":"), false}, // As openssl prints it
+		{hexPin[:62], true},
+		{"zz" + hexPin[2:], true},
+	}
+	for _, tt := range tests {
+		t.Setenv("WS_URL", "wss://node.example.com")
+		t.Setenv("WS_PIN", tt.pin)
+		var c Config
+		err := c.GetFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("WS_PIN=%q: error %v, want error %v", tt.pin, err, tt.wantErr)
+		}
+		if err == nil && tt.pin != "" && string(c.Pin) != string(sum[:]) {
+			t.Fatalf("WS_PIN=%q parsed as %x", tt.pin, c.Pin)
+		}
+	}
+}
+
+func TestSendRefusesOversized(t *testing.T) {
+	url, fingerprint := startTLSServer(t)
+	transport, err := NewTransport(&Config{Url: url, Pin: fingerprint[:], MaxMessageSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	if err := transport.Send(make([]byte, 101)); err == nil {
+		t.Fatal("sent a message over the limit")
+	}
+	if err := transport.Send(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := transport.Receive(); err != nil || len(reply) != 100 {
+		t.Fatalf("got %d bytes, %v; want the 100 byte echo", len(reply), err)
+	}
+}
+
+func TestReceiveContextCancel(t *testing.T) {
+	url, fingerprint := startTLSServer(t)
+	transport, err := NewTransport(&Config{Url: url, Pin: fingerprint[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	// The echo server sends nothing unprompted, so the read blocks
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() {
+		_, err := transport.ReceiveContext(ctx)
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-received:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive still blocked after cancel")
+	}
+
+	if err := transport.SendContext(ctx, []byte("ping")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("send on a canceled context: got %v, want context.Canceled", err)
+	}
+}
+
+func TestWriteErrorFailsReceive(t *testing.T) {
+	url, fingerprint := startTLSServer(t)
+	transport, err := NewTransport(&Config{Url: url, Pin: fingerprint[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := transport.Receive()
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	transport.conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := transport.Send([]byte("lost")); err == nil {
+		t.Fatal("write past its deadline succeeded")
+	}
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Fatal("receive succeeded after a failed write")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive still blocked a second after a failed write")
+	}
+	if err := transport.Send([]byte("again")); err == nil {
+		t.Fatal("sent on a connection whose write failed")
+	}
+}
@@ -0,0 +1,226 @@
+package frag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HeaderSize is the per-datagram framing overhead: message id, chunk index, chunk count
+	HeaderSize = 8
+	// DefaultChunkSize keeps framed datagrams below common path MTUs
+	DefaultChunkSize = 1200
+	// DefaultTimeout is how long an incomplete message is kept
+	DefaultTimeout = 5 * time.Second
+	// ConnIDSize is the trailer holding the sender's connection ID, on
+	// datagrams from a fragmenter given one
+	ConnIDSize = 8
+	// maxPending bounds incomplete messages held per sender
+	maxPending = 64
+	// flagConnID in the chunk count marks a datagram ending in a connection ID
+	flagConnID = 0x8000
+)
+
+// Fragmenter splits outgoing messages into framed chunks
+type Fragmenter struct {
+	chunkSize int
+	connID    uint64 // Appended to every datagram when nonzero
+	nextID    atomic.Uint32
+}
+
+// NewFragmenter creates a fragmenter emitting at most chunkSize payload bytes per datagram
+func NewFragmenter(chunkSize int) *Fragmenter {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &Fragmenter{chunkSize: chunkSize}
+}
+
+// SetConnID tags every datagram with id, so the receiver can follow the
+// sender across address changes (0 = untagged). Must be called before Split.
+func (f *Fragmenter) SetConnID(id uint64) {
+	f.connID = id
+}
+
+// Split frames data into one or more datagrams sharing a fresh message id
+func (f *Fragmenter) Split(data []byte) ([][]byte, error) {
+	count := (len(data) + f.chunkSize - 1) / f.chunkSize
+	if count == 0 {
+		count = 1
+	}
+	maxCount, trailer, flags := 0xFFFF, 0, uint16(0)
+	if f.connID != 0 {
+		maxCount, trailer, flags = flagConnID-1, ConnIDSize, flagConnID
+	}
+	if count > maxCount {
+		return nil, fmt.Errorf("message of %d bytes needs too many chunks", len(data))
+	}
+
+	id := f.nextID.Add(1)
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		payload := data[i*f.chunkSize : min((i+1)*f.chunkSize, len(data))]
+		chunk := make([]byte, HeaderSize+len(payload)+trailer)
+		binary.BigEndian.PutUint32(chunk[0:4], id)
+		binary.BigEndian.PutUint16(chunk[4:6], uint16(i))
+		binary.BigEndian.PutUint16(chunk[6:8], uint16(count)|flags)
+		copy(chunk[HeaderSize:], payload)
+		if trailer > 0 {
+			binary.BigEndian.PutUint64(chunk[len(chunk)-ConnIDSize:], f.connID)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// StripConnID removes a datagram's connection ID trailer, returning the
+// plain datagram and the ID (0 if it had none). The datagram is modified
+// in place.
+func StripConnID(datagram []byte) ([]byte, uint64) {
+	if len(datagram) < HeaderSize+ConnIDSize {
+		return datagram, 0
+	}
+	count := binary.BigEndian.Uint16(datagram[6:8])
+	if count&flagConnID == 0 {
+		return datagram, 0
+	}
+	end := len(datagram) - ConnIDSize
+	binary.BigEndian.PutUint16(datagram[6:8], count&^flagConnID)
+	return datagram[:end], binary.BigEndian.Uint64(datagram[end:])
+}
+
+// RejectFrame builds the datagram a server answers a client it refuses with.
+// Its chunk count of zero never occurs in data, so clients that predate it
+// drop it as malformed.
+func RejectFrame(reason string) []byte {
+	frame := make([]byte, HeaderSize+len(reason))
+	copy(frame[HeaderSize:], reason)
+	return frame
+}
+
+// Rejection reports whether datagram is a RejectFrame, returning its reason
+func Rejection(datagram []byte) (string, bool) {
+	if len(datagram) < HeaderSize || binary.BigEndian.Uint64(datagram[:HeaderSize]) != 0 {
+		return "", false
+	}
+	return string(datagram[HeaderSize:]), true
+}
+
+// Unfragmented reports whether a framed datagram carries a whole message
+func Unfragmented(datagram []byte) bool {
+	return len(datagram) >= HeaderSize && binary.BigEndian.Uint16(datagram[6:8]) == 1
+}
+
+// partial is a message still missing chunks
+type partial struct {
+	chunks   [][]byte
+	received int
+	size     int // Payload bytes received so far
+	started  time.Time
+}
+
+// Reassembler rebuilds messages from one sender's chunks, in any order
+type Reassembler struct {
+	timeout time.Duration
+	maxSize int // Largest message accepted (0 = unlimited)
+	pending map[uint32]*partial
+	mu      sync.Mutex
+}
+
+// NewReassembler creates a reassembler discarding incomplete messages after timeout
+func NewReassembler(timeout time.Duration) *Reassembler {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Reassembler{
+		timeout: timeout,
+		pending: make(map[uint32]*partial),
+	}
+}
+
+// SetMaxSize drops messages larger than maxSize bytes; chunks of an oversized
+// message are discarded as soon as the bound is crossed. Zero means unlimited.
+func (r *Reassembler) SetMaxSize(maxSize int) {
+	r.mu.Lock()
+	r.maxSize = maxSize
+	r.mu.Unlock()
+}
+
+// Add consumes a datagram and returns the full message once all its chunks arrived.
+// It returns nil while the message is incomplete.
+func (r *Reassembler) Add(datagram []byte) ([]byte, error) {
+	if len(datagram) < HeaderSize {
+		return nil, fmt.Errorf("datagram too short: %d bytes", len(datagram))
+	}
+	id := binary.BigEndian.Uint32(datagram[0:4])
+	index := int(binary.BigEndian.Uint16(datagram[4:6]))
+	count := int(binary.BigEndian.Uint16(datagram[6:8]))
+	payload := datagram[HeaderSize:]
+
+	if count == 0 || index >= count {
+		return nil, fmt.Errorf("invalid chunk %d/%d", index, count)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Every chunk carries at least one byte, so count alone can rule a message out
+	if r.maxSize > 0 && (len(payload) > r.maxSize || count > r.maxSize) {
+		return nil, fmt.Errorf("message %d exceeds %d bytes", id, r.maxSize)
+	}
+
+	// Unfragmented messages skip bookkeeping
+	if count == 1 {
+		return payload, nil
+	}
+
+	now := time.Now()
+	r.expire(now)
+
+	p, ok := r.pending[id]
+	if !ok {
+		if len(r.pending) >= maxPending {
+			return nil, fmt.Errorf("too many incomplete messages")
+		}
+		p = &partial{chunks: make([][]byte, count), started: now}
+		r.pending[id] = p
+	}
+	if len(p.chunks) != count {
+		delete(r.pending, id)
+		return nil, fmt.Errorf("chunk count mismatch for message %d", id)
+	}
+	if p.chunks[index] != nil {
+		return nil, nil // Duplicate chunk
+	}
+
+	if r.maxSize > 0 && p.size+len(payload) > r.maxSize {
+		delete(r.pending, id)
+		return nil, fmt.Errorf("message %d exceeds %d bytes", id, r.maxSize)
+	}
+
+	p.chunks[index] = payload
+	p.received++
+	p.size += len(payload)
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, id)
+	data := make([]byte, 0, p.size)
+	for _, chunk := range p.chunks {
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// expire drops incomplete messages older than the timeout
+func (r *Reassembler) expire(now time.Time) {
+	for id, p := range r.pending {
+		if now.Sub(p.started) > r.timeout {
+			delete(r.pending, id)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package frag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// message returns size bytes that differ from chunk to chunk
+func message(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// split frames data into chunks of chunkSize payload bytes
+func split(t *testing.T, f *Fragmenter, data []byte) [][]byte {
+	t.Helper()
+	chunks, err := f.Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+// feed adds chunks in order, expecting only the last to complete the message
+func feed(t *testing.T, r *Reassembler, chunks [][]byte) []byte {
+	t.Helper()
+	for i, chunk := range chunks {
+		got, err := r.Add(chunk)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if i < len(chunks)-1 && got != nil {
+			t.Fatalf("message completed after %d of %d chunks", i+1, len(chunks))
+		}
+		if i == len(chunks)-1 {
+			return got
+		}
+	}
+	return nil
+}
+
+func TestReassembleAnyOrder(t *testing.T) {
+	orders := map[string]func(chunks [][]byte){
+		"in order": func([][]byte) {},
+		"reversed": func(chunks [][]byte) {
+			for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+				chunks[i], chunks[j] = chunks[j], chunks[i]
+			}
+		},
+		"shuffled": func(chunks [][]byte) {
+			rng := rand.New(rand.NewPCG(5, 6))
+			rng.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+		},
+	}
+	for name, reorder := range orders {
+		for _, size := range []int{0, 1, 100, 101, 5000} {
+			f := NewFragmenter(100)
+			data := message(size)
+			chunks := split(t, f, data)
+			if want := max(1, (size+99)/100); len(chunks) != want {
+				t.Fatalf("%d bytes split into %d chunks, want %d", size, len(chunks), want)
+			}
+			reorder(chunks)
+
+			got := feed(t, NewReassembler(time.Second), chunks)
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, %d bytes: reassembled %d bytes that differ", name, size, len(got))
+			}
+		}
+	}
+}
+
+func TestReassembleInterleavedMessages(t *testing.T) {
+	f := NewFragmenter(10)
+	a, b := message(35), bytes.Repeat([]byte{0xab}, 25)
+	chunksA, chunksB := split(t, f, a), split(t, f, b)
+	r := NewReassembler(time.Second)
+
+	var done [][]byte
+	for i := range max(len(chunksA), len(chunksB)) {
+		for _, chunks := range [][][]byte{chunksB, chunksA} {
+			if i >= len(chunks) {
+				continue
+			}
+			got, err := r.Add(chunks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != nil {
+				done = append(done, got)
+			}
+		}
+	}
+	if len(done) != 2 || !bytes.Equal(done[0], b) || !bytes.Equal(done[1], a) {
+		t.Fatalf("reassembled %d messages, want both intact", len(done))
+	}
+}
+
+func TestReassembleIgnoresDuplicateChunks(t *testing.T) {
+	data := message(30)
+	chunks := split(t, NewFragmenter(10), data)
+	r := NewReassembler(time.Second)
+
+	for _, chunk := range [][]byte{chunks[0], chunks[0], chunks[1], chunks[1]} {
+		if got, err := r.Add(chunk); err != nil || got != nil {
+			t.Fatalf("duplicate chunk: got %d bytes, %v", len(got), err)
+		}
+	}
+	got, err := r.Add(chunks[2])
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reassembled %d bytes (%v), want the message", len(got), err)
+	}
+	// A copy arriving after completion starts over and never completes
+	if got, err := r.Add(chunks[1]); err != nil || got != nil {
+		t.Fatalf("late duplicate: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReassembleDiscardsLostChunkMessages(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	f := NewFragmenter(10)
+	r := NewReassembler(timeout)
+
+	// The middle chunk of the first message is lost
+	lost := split(t, f, message(30))
+	feed(t, r, [][]byte{lost[0], lost[2]})
+	if len(r.pending) != 1 {
+		t.Fatalf("%d messages pending, want 1", len(r.pending))
+	}
+
+	time.Sleep(2 * timeout)
+
+	// The next message completes, and adding it expires the stale one
+	data := message(25)
+	if got := feed(t, r, split(t, f, data)); !bytes.Equal(got, data) {
+		t.Fatal("message after a lost chunk did not reassemble")
+	}
+	if len(r.pending) != 0 {
+		t.Fatalf("%d messages pending after the timeout, want 0", len(r.pending))
+	}
+
+	// The missing chunk turning up late can't complete the discarded message
+	if got, err := r.Add(lost[1]); err != nil || got != nil {
+		t.Fatalf("late chunk: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReassembleBoundsPendingMessages(t *testing.T) {
+	f := NewFragmenter(10)
+	r := NewReassembler(time.Minute)
+	for i := range maxPending {
+		if _, err := r.Add(split(t, f, message(20))[0]); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if _, err := r.Add(split(t, f, message(20))[0]); err == nil {
+		t.Fatal("accepted more incomplete messages than maxPending")
+	}
+	// Whole messages need no bookkeeping, so they still get through
+	if got, err := r.Add(split(t, f, message(5))[0]); err != nil || len(got) != 5 {
+		t.Fatalf("unfragmented message: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReassembleRejectsMalformedChunks(t *testing.T) {
+	chunk := func(id uint32, index, count uint16) []byte {
+		b := make([]byte, HeaderSize+4)
+		binary.BigEndian.PutUint32(b[0:], id)
+		binary.BigEndian.PutUint16(b[4:], index)
+		binary.BigEndian.PutUint16(b[6:], count)
+		return b
+	}
+	r := NewReassembler(time.Second)
+	for name, datagram := range map[string][]byte{
+		"short":          make([]byte, HeaderSize-1),
+		"zero count":     chunk(1, 0, 0),
+		"index past end": chunk(1, 3, 3),
+	} {
+		if _, err := r.Add(datagram); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// Chunks of one message disagreeing on its length drop it
+	if _, err := r.Add(chunk(2, 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(chunk(2, 1, 4)); err == nil {
+		t.Fatal("accepted a chunk count mismatch")
+	}
+	if len(r.pending) != 0 {
+		t.Fatal("mismatched message left pending")
+	}
+}
+
+func TestReassembleMaxSize(t *testing.T) {
+	f := NewFragmenter(10)
+	r := NewReassembler(time.Second)
+	r.SetMaxSize(25)
+
+	chunks := split(t, f, message(30))
+	var err error
+	for _, chunk := range chunks {
+		if _, err = r.Add(chunk); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Fatal("reassembled a message over the size limit")
+	}
+	if len(r.pending) != 0 {
+		t.Fatal("oversized message left pending")
+	}
+
+	data := message(25)
+	if got := feed(t, r, split(t, f, data)); !bytes.Equal(got, data) {
+		t.Fatal("message at the size limit did not reassemble")
+	}
+}
+
+func TestConnIDTrailer(t *testing.T) {
+	f := NewFragmenter(10)
+	f.SetConnID(0xfeedface)
+	data := message(25)
+	r := NewReassembler(time.Second)
+
+	var got []byte
+	for _, chunk := range split(t, f, data) {
+		plain, id := StripConnID(chunk)
+		if id != 0xfeedface {
+			t.Fatalf("connection ID %#x, want 0xfeedface", id)
+		}
+		var err error
+		if got, err = r.Add(plain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("tagged message did not reassemble")
+	}
+
+	untagged := split(t, NewFragmenter(10), data)[0]
+	if plain, id := StripConnID(untagged); id != 0 || len(plain) != len(untagged) {
+		t.Fatal("untagged datagram lost its tail")
+	}
+}
+
+func TestRejectFrame(t *testing.T) {
+	reason, ok := Rejection(RejectFrame("server full"))
+	if !ok || reason != "server full" {
+		t.Fatalf("Rejection = %q, %v; want server full", reason, ok)
+	}
+	if _, ok := Rejection(split(t, NewFragmenter(10), message(5))[0]); ok {
+		t.Fatal("data chunk read as a rejection")
+	}
+	if _, err := NewReassembler(time.Second).Add(RejectFrame("full")); err == nil {
+		t.Fatal("reassembler accepted a reject frame as data")
+	}
+}
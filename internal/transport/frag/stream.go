@@ -0,0 +1,39 @@
+package frag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// LengthSize is the per-message overhead of stream framing: a 4-byte
+// big-endian length ahead of each message, which is all a reliable stream
+// needs to keep messages apart
+const LengthSize = 4
+
+// WriteFrame writes one length-prefixed message in a single write
+func WriteFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, LengthSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[LengthSize:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one length-prefixed message, refusing ones over maxSize
+// (0 = unlimited) before buffering them
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var length [LengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if maxSize > 0 && size > uint32(maxSize) {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d", size, maxSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
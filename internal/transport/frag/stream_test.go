@@ -0,0 +1,71 @@
+package frag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 1400, 65535, 200000}
+	var stream bytes.Buffer
+	want := 0
+	for _, size := range sizes {
+		if err := WriteFrame(&stream, message(size)); err != nil {
+			t.Fatal(err)
+		}
+		want += LengthSize + size
+	}
+	if stream.Len() != want {
+		t.Fatalf("wrote %d bytes, want %d", stream.Len(), want)
+	}
+
+	// Messages written back to back come apart again
+	for _, size := range sizes {
+		got, err := ReadFrame(&stream, 0)
+		if err != nil {
+			t.Fatalf("read %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, message(size)) {
+			t.Fatalf("read %d bytes, want the %d byte message", len(got), size)
+		}
+	}
+	if _, err := ReadFrame(&stream, 0); err != io.EOF {
+		t.Fatalf("at the end of the stream: got %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameRejects(t *testing.T) {
+	frame := func(length uint32, body []byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, length), body...)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		want    error // nil for any error
+	}{
+		{"over the limit", frame(101, make([]byte, 101)), 100, nil},
+		{"claims 4GB", frame(1<<32-1, nil), 1 << 20, nil},
+		{"length cut short", []byte{0, 0}, 0, io.ErrUnexpectedEOF},
+		{"body cut short", frame(10, make([]byte, 9)), 0, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		got, err := ReadFrame(bytes.NewReader(tt.data), tt.maxSize)
+		if err == nil {
+			t.Errorf("%s: read %d bytes, want an error", tt.name, len(got))
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A message exactly at the limit is fine
+	got, err := ReadFrame(bytes.NewReader(frame(100, make([]byte, 100))), 100)
+	if err != nil || len(got) != 100 {
+		t.Fatalf("message at the limit: read %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,258 @@
+// Package loopback is an in-process transport: clients dial a server by name
+// and messages move over channels, so the full client and node message flow
+// can run without sockets
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// DefaultName is the server name used when none is configured
+	DefaultName = "default"
+	// queueSize is how many messages each direction buffers before Send blocks
+	queueSize = 256
+)
+
+// ErrClosed is returned when sending or receiving on a closed link
+var ErrClosed = errors.New("loopback: connection closed")
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Server)
+)
+
+type Config struct {
+	Name string // Server to connect to
+}
+
+func (c *Config) GetFromEnv() error {
+	c.Name = os.Getenv("LOOPBACK_NAME")
+	if c.Name == "" {
+		c.Name = DefaultName
+	}
+	return nil
+}
+
+// link is one client's pair of message queues
+type link struct {
+	toServer  chan []byte
+	toClient  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// send queues a copy of data, so callers may reuse their buffer
+func (l *link) send(ctx context.Context, queue chan<- []byte, data []byte) error {
+	select {
+	case <-l.closed:
+		return ErrClosed
+	default:
+	}
+	select {
+	case queue <- append([]byte(nil), data...):
+		return nil
+	case <-l.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Connection is the server's end of a loopback link
+type Connection struct {
+	link *link
+}
+
+// Send queues data for the client
+func (c *Connection) Send(data []byte) error {
+	return c.link.send(context.Background(), c.link.toClient, data)
+}
+
+// Closed reports whether the link has closed
+func (c *Connection) Closed() bool {
+	select {
+	case <-c.link.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Server hands messages from loopback clients to a callback, one goroutine
+// per client as the socket servers do
+type Server struct {
+	name         string
+	onMessage    func(conn *Connection, data []byte)
+	onDisconnect func(conn *Connection)
+	onListening  func()
+	connections  map[*Connection]bool
+	mu           sync.Mutex
+	pumps        sync.WaitGroup // Running per-client message pumps
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+// NewServer creates a loopback server that clients reach as name
+func NewServer(name string, onMessage func(conn *Connection, data []byte)) *Server {
+	return &Server{
+		name:        name,
+		onMessage:   onMessage,
+		connections: make(map[*Connection]bool),
+		stop:        make(chan struct{}),
+	}
+}
+
+// SetOnDisconnect sets callback for client disconnection
+func (s *Server) SetOnDisconnect(callback func(conn *Connection)) {
+	s.onDisconnect = callback
+}
+
+// SetOnListening sets a callback run once clients can dial the server
+func (s *Server) SetOnListening(callback func()) {
+	s.onListening = callback
+}
+
+// Start registers the server under its name and blocks until Stop
+func (s *Server) Start() error {
+	registryMu.Lock()
+	if _, taken := registry[s.name]; taken {
+		registryMu.Unlock()
+		return fmt.Errorf("loopback: server %q already running", s.name)
+	}
+	registry[s.name] = s
+	registryMu.Unlock()
+
+	if s.onListening != nil {
+		s.onListening()
+	}
+	<-s.stop
+	return nil
+}
+
+// Stop unregisters the server and disconnects every client, waiting for
+// their disconnect callbacks until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	registryMu.Lock()
+	if registry[s.name] == s {
+		delete(registry, s.name)
+	}
+	registryMu.Unlock()
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	s.mu.Lock()
+	for conn := range s.connections {
+		conn.link.close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// accept registers a new client link and starts delivering its messages
+func (s *Server) accept() *link {
+	l := &link{
+		toServer: make(chan []byte, queueSize),
+		toClient: make(chan []byte, queueSize),
+		closed:   make(chan struct{}),
+	}
+	conn := &Connection{link: l}
+
+	s.mu.Lock()
+	s.connections[conn] = true
+	s.mu.Unlock()
+
+	s.pumps.Add(1)
+	go s.pump(conn)
+	return l
+}
+
+// pump delivers a client's messages until its link closes
+func (s *Server) pump(conn *Connection) {
+	defer s.pumps.Done()
+	for {
+		select {
+		case data := <-conn.link.toServer:
+			if s.onMessage != nil {
+				s.onMessage(conn, data)
+			}
+		case <-conn.link.closed:
+			s.mu.Lock()
+			delete(s.connections, conn)
+			s.mu.Unlock()
+			if s.onDisconnect != nil {
+				s.onDisconnect(conn)
+			}
+			return
+		}
+	}
+}
+
+// Transport is the client's end of a loopback link
+type Transport struct {
+	link *link
+}
+
+// NewTransport connects to the loopback server named in config
+func NewTransport(config *Config) (*Transport, error) {
+	return Dial(config.Name)
+}
+
+// Dial connects to the running loopback server called name
+func Dial(name string) (*Transport, error) {
+	registryMu.Lock()
+	s, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("loopback: no server named %q", name)
+	}
+	return &Transport{link: s.accept()}, nil
+}
+
+func (t *Transport) Disconnect() error {
+	t.link.close()
+	return nil
+}
+
+func (t *Transport) Send(data []byte) error {
+	return t.SendContext(context.Background(), data)
+}
+
+// SendContext queues data for the server, giving up once ctx is done
+func (t *Transport) SendContext(ctx context.Context, data []byte) error {
+	return t.link.send(ctx, t.link.toServer, data)
+}
+
+func (t *Transport) Receive() ([]byte, error) {
+	return t.ReceiveContext(context.Background())
+}
+
+// ReceiveContext returns the next message from the server
+func (t *Transport) ReceiveContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-t.link.toClient:
+		return data, nil
+	case <-t.link.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,134 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 5 * time.Second
+
+// startEcho runs a server named after the test that echoes every message and
+// reports disconnects
+func startEcho(t *testing.T) (s *Server, disconnected <-chan *Connection) {
+	t.Helper()
+	gone := make(chan *Connection, 16)
+	s = NewServer(t.Name(), func(conn *Connection, data []byte) {
+		conn.Send(data)
+	})
+	s.SetOnDisconnect(func(conn *Connection) { gone <- conn })
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	go s.Start()
+	<-listening
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Stop(ctx)
+	})
+	return s, gone
+}
+
+func TestRoundTrip(t *testing.T) {
+	startEcho(t)
+	transport, err := Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	buf := []byte("ping")
+	if err := transport.Send(buf); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, "XXXX") // Send keeps its own copy
+	got, err := transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("got %q back, want ping", got)
+	}
+}
+
+func TestDialUnknownServer(t *testing.T) {
+	if _, err := Dial(t.Name()); err == nil {
+		t.Fatal("dialed a server that isn't running")
+	}
+}
+
+func TestNameTaken(t *testing.T) {
+	startEcho(t)
+	if err := NewServer(t.Name(), nil).Start(); err == nil {
+		t.Fatal("started two servers under one name")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	_, disconnected := startEcho(t)
+	transport, err := Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.Disconnect()
+
+	select {
+	case conn := <-disconnected:
+		if !conn.Closed() {
+			t.Fatal("disconnected connection not closed")
+		}
+		if err := conn.Send([]byte("late")); !errors.Is(err, ErrClosed) {
+			t.Fatalf("send to a gone client: got %v, want ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("server never saw the disconnect")
+	}
+	if _, err := transport.Receive(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("receive after disconnect: got %v, want ErrClosed", err)
+	}
+	if err := transport.Send([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("send after disconnect: got %v, want ErrClosed", err)
+	}
+}
+
+func TestStopDisconnectsClients(t *testing.T) {
+	s, disconnected := startEcho(t)
+	transport, err := Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-disconnected:
+	default:
+		t.Fatal("Stop returned before the disconnect callback ran")
+	}
+	if _, err := transport.Receive(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("receive after Stop: got %v, want ErrClosed", err)
+	}
+	if _, err := Dial(t.Name()); err == nil {
+		t.Fatal("dialed a stopped server")
+	}
+}
+
+func TestReceiveContextCancel(t *testing.T) {
+	startEcho(t)
+	transport, err := Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := transport.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,75 @@
+package obfs
+
+import (
+	"context"
+	"log/slog"
+	mrand "math/rand/v2"
+	"time"
+
+	"seras-protocol/internal/transport/client"
+)
+
+// Client obfuscates the frames of any client transport
+type Client struct {
+	inner  client.Client
+	obfs   *Obfuscator
+	jitter time.Duration
+}
+
+// NewClient wraps inner so everything it sends and receives is obfuscated.
+// Each send is delayed by a random duration below jitter (0 = no delay).
+func NewClient(inner client.Client, o *Obfuscator, jitter time.Duration) *Client {
+	return &Client{inner: inner, obfs: o, jitter: jitter}
+}
+
+// Unwrap returns the transport being obfuscated
+func (c *Client) Unwrap() client.Client {
+	return c.inner
+}
+
+func (c *Client) Disconnect() error {
+	return c.inner.Disconnect()
+}
+
+func (c *Client) Send(data []byte) error {
+	return c.SendContext(context.Background(), data)
+}
+
+// SendContext obfuscates and sends data; ctx also cuts the jitter delay short
+func (c *Client) SendContext(ctx context.Context, data []byte) error {
+	frame, err := c.obfs.Wrap(data)
+	if err != nil {
+		return err
+	}
+	if c.jitter > 0 {
+		timer := time.NewTimer(mrand.N(c.jitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return c.inner.SendContext(ctx, frame)
+}
+
+func (c *Client) Receive() ([]byte, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+// ReceiveContext returns the next frame that unmasks cleanly, dropping others
+// so injected garbage cannot end the connection
+func (c *Client) ReceiveContext(ctx context.Context) ([]byte, error) {
+	for {
+		frame, err := c.inner.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := c.obfs.Unwrap(frame)
+		if err != nil {
+			slog.Warn("Dropping undecodable obfuscated frame", "size", len(frame))
+			continue
+		}
+		return data, nil
+	}
+}
@@ -0,0 +1,191 @@
+package obfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/internal/transport/loopback"
+	"seras-protocol/internal/transport/server"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// newObfuscator returns an obfuscator for key
+func newObfuscator(t *testing.T, key string) *Obfuscator {
+	t.Helper()
+	o, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// wireMessage returns an encoded message whose header bytes are the same
+// every time, as a fingerprint would look for
+func wireMessage(t *testing.T) []byte {
+	t.Helper()
+	data, err := kbinary.Marshal(&msg.RawMsg{
+		Header: &msg.Header{Version: msg.Version2, Type: msg.TypeData},
+		Body:   bytes.Repeat([]byte{0xAA}, 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWrapRoundTrip(t *testing.T) {
+	o := newObfuscator(t, "secret")
+	for _, size := range []int{0, 1, 15, 16, 17, 1300, 65535} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		frame, err := o.Wrap(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) < len(data)+ivSize+lenSize || len(frame) > len(data)+Overhead {
+			t.Fatalf("%d bytes wrapped into %d", size, len(frame))
+		}
+		got, err := o.Unwrap(frame)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes came back different", size)
+		}
+	}
+
+	frame, err := o.Wrap(wireMessage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newObfuscator(t, "other").Unwrap(frame); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("wrong key: got %v, want ErrMalformed", err)
+	}
+	if _, err := o.Unwrap(frame[:ivSize+lenSize-1]); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("short frame: got %v, want ErrMalformed", err)
+	}
+	if _, err := New(""); err == nil {
+		t.Fatal("accepted an empty key")
+	}
+}
+
+func TestFramesHaveNoConstantBytes(t *testing.T) {
+	o := newObfuscator(t, "secret")
+	data := wireMessage(t)
+
+	const n = 256
+	frames := make([][]byte, n)
+	sizes := make(map[int]bool)
+	for i := range frames {
+		frame, err := o.Wrap(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = frame
+		sizes[len(frame)] = true
+	}
+	if len(sizes) < 2 {
+		t.Fatalf("%d frames of the same message all %d bytes long", n, len(frames[0]))
+	}
+
+	// No byte position holds the same value in every frame, the header included
+	for pos := range len(data) + ivSize + lenSize {
+		constant := true
+		for _, frame := range frames[1:] {
+			if frame[pos] != frames[0][pos] {
+				constant = false
+				break
+			}
+		}
+		if constant {
+			t.Fatalf("byte %d is %#x in all %d frames", pos, frames[0][pos], n)
+		}
+	}
+}
+
+func TestClientServerRoundTrip(t *testing.T) {
+	o := newObfuscator(t, "secret")
+
+	var mu sync.Mutex
+	var captured [][]byte // Frames as the server's transport saw them
+	var replied server.Connection
+	disconnected := make(chan server.Connection, 1)
+	s := NewServer(o,
+		func(conn server.Connection, data []byte) {
+			mu.Lock()
+			replied = conn
+			mu.Unlock()
+			conn.Send(append([]byte("echo: "), data...))
+		},
+		func(conn server.Connection) { disconnected <- conn })
+
+	name := t.Name()
+	ls := loopback.NewServer(name, func(conn *loopback.Connection, frame []byte) {
+		mu.Lock()
+		captured = append(captured, append([]byte(nil), frame...))
+		mu.Unlock()
+		s.HandleMessage(conn, frame)
+	})
+	ls.SetOnDisconnect(func(conn *loopback.Connection) { s.RemoveConnection(conn) })
+	listening := make(chan struct{})
+	ls.SetOnListening(func() { close(listening) })
+	go ls.Start()
+	<-listening
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ls.Stop(ctx)
+	})
+
+	inner, err := loopback.Dial(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(inner, o, time.Millisecond)
+
+	data := wireMessage(t)
+	if err := c.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("echo: "), data...); !bytes.Equal(reply, want) {
+		t.Fatalf("got %q, want %q", reply, want)
+	}
+
+	mu.Lock()
+	if bytes.Contains(captured[0], data[:8]) {
+		t.Fatal("message header visible on the wire")
+	}
+	mu.Unlock()
+
+	// Garbage is dropped on both sides without ending the connection
+	if err := inner.Send([]byte("not obfuscated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := c.Receive(); err != nil || string(reply) != "echo: still here" {
+		t.Fatalf("got %q, %v after garbage", reply, err)
+	}
+
+	// The disconnect names the same connection the messages came from
+	c.Disconnect()
+	select {
+	case conn := <-disconnected:
+		mu.Lock()
+		defer mu.Unlock()
+		if conn != replied {
+			t.Fatal("disconnect reported a different connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no disconnect")
+	}
+}
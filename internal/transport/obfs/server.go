@@ -0,0 +1,55 @@
+package obfs
+
+import (
+	"log/slog"
+
+	"seras-protocol/internal/transport/server"
+)
+
+// conn obfuscates replies to one client. It is a comparable value, so
+// wrapping the same connection twice yields equal map keys.
+type conn struct {
+	server.Connection
+	obfs *Obfuscator
+}
+
+func (c conn) Send(data []byte) error {
+	frame, err := c.obfs.Wrap(data)
+	if err != nil {
+		return err
+	}
+	return c.Connection.Send(frame)
+}
+
+// Verified passes authentication on to a connection that can migrate
+func (c conn) Verified() {
+	server.Verified(c.Connection)
+}
+
+// Server decorates a server's callbacks: frames are unmasked before
+// onMessage sees them, and replies sent through its connection are masked
+type Server struct {
+	obfs         *Obfuscator
+	onMessage    func(conn server.Connection, data []byte)
+	onDisconnect func(conn server.Connection)
+}
+
+// NewServer wraps the callbacks a server would otherwise call directly
+func NewServer(o *Obfuscator, onMessage func(conn server.Connection, data []byte), onDisconnect func(conn server.Connection)) *Server {
+	return &Server{obfs: o, onMessage: onMessage, onDisconnect: onDisconnect}
+}
+
+// HandleMessage unmasks a frame and passes it on
+func (s *Server) HandleMessage(c server.Connection, frame []byte) {
+	data, err := s.obfs.Unwrap(frame)
+	if err != nil {
+		slog.Warn("Dropping undecodable obfuscated frame", "size", len(frame))
+		return
+	}
+	s.onMessage(conn{Connection: c, obfs: s.obfs}, data)
+}
+
+// RemoveConnection reports a disconnect under the same wrapped connection
+func (s *Server) RemoveConnection(c server.Connection) {
+	s.onDisconnect(conn{Connection: c, obfs: s.obfs})
+}
@@ -1,12 +1,51 @@
 package server
 
-// Connection is the interface that both WSS and UDP connections implement
+import "context"
+
+// Connection is the interface that both WSS and UDP connections implement.
+// Each client is one comparable value (a pointer) for as long as it is
+// connected, so connections can key maps.
 type Connection interface {
 	Send(data []byte) error
 }
 
-// Server is the interface that both WSS and UDP servers implement
+// Migrator is a Connection that can follow its client to a new address, as
+// UDP connections carrying a connection ID do
+type Migrator interface {
+	Connection
+	// Verified tells the transport the message being handled authenticated,
+	// so its source address can be trusted. Must be called from the message
+	// callback.
+	Verified()
+}
+
+// Verified calls conn.Verified if conn is a Migrator
+func Verified(conn Connection) {
+	if m, ok := conn.(Migrator); ok {
+		m.Verified()
+	}
+}
+
+// Closer is a Connection that can tell when its client has gone. A message
+// handled while its transport disconnects the client can still be running
+// after onDisconnect, so state it would create must check Closed first.
+type Closer interface {
+	Connection
+	// Closed reports whether the client is gone. It is true before the
+	// transport calls onDisconnect and stays true.
+	Closed() bool
+}
+
+// Closed reports whether conn is a Closer whose client has gone
+func Closed(conn Connection) bool {
+	c, ok := conn.(Closer)
+	return ok && c.Closed()
+}
+
+// Server is the interface that both WSS and UDP servers implement. Each
+// takes its message and disconnect callbacks on its own connection type;
+// adapt them to Connection to share one handler.
 type Server interface {
 	Start() error
-	SetOnDisconnect(callback func(conn Connection))
+	Stop(ctx context.Context) error
 }
@@ -0,0 +1,243 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"seras-protocol/internal/transport/frag"
+	"seras-protocol/internal/transport/server"
+)
+
+var (
+	_ server.Server     = (*Server)(nil)
+	_ server.Connection = (*Connection)(nil)
+	_ server.Closer     = (*Connection)(nil)
+)
+
+// Connection is one client's TCP stream
+type Connection struct {
+	conn    net.Conn
+	server  *Server
+	writeMu sync.Mutex // Keeps frames from interleaving
+	closed  atomic.Bool
+}
+
+// Addr returns the client's address
+func (c *Connection) Addr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Send writes one message to the client. A partly written frame leaves the
+// stream out of step, so the connection is closed after a failed write,
+// which ends its reader and disconnects the client.
+func (c *Connection) Send(data []byte) error {
+	if max := c.server.maxSize; max > 0 && len(data) > max {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), max)
+	}
+	if c.closed.Load() {
+		return fmt.Errorf("connection closed")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := frag.WriteFrame(c.conn, data); err != nil {
+		c.close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// Closed reports whether the stream has ended or a write failed
+func (c *Connection) Closed() bool {
+	return c.closed.Load()
+}
+
+func (c *Connection) close() {
+	c.closed.Store(true)
+	c.conn.Close()
+}
+
+// Server accepts plain TCP streams of length-prefixed messages, a fallback
+// for networks that block UDP and WebSocket upgrades
+type Server struct {
+	addr         string
+	connections  map[*Connection]bool
+	mu           sync.RWMutex
+	onMessage    func(conn *Connection, data []byte)
+	onDisconnect func(conn *Connection)
+	onListening  func()
+	maxSize      int // Largest message accepted or sent (0 = unlimited)
+	maxClients   int // Connections served at once (0 = unlimited)
+	rejected     atomic.Uint64
+	listener     net.Listener
+	handlers     sync.WaitGroup // Running connection handlers
+	stopping     atomic.Bool
+}
+
+// NewServer creates a new TCP server
+func NewServer(addr string, onMessage func(conn *Connection, data []byte)) *Server {
+	return &Server{
+		addr:        addr,
+		connections: make(map[*Connection]bool),
+		onMessage:   onMessage,
+	}
+}
+
+// SetOnDisconnect sets callback for client disconnection
+func (s *Server) SetOnDisconnect(callback func(conn *Connection)) {
+	s.onDisconnect = callback
+}
+
+// SetOnListening sets a callback run once the listener accepts connections
+func (s *Server) SetOnListening(callback func()) {
+	s.onListening = callback
+}
+
+// SetMaxMessageSize bounds messages; a client sending a larger one is
+// disconnected before it is buffered, and Send refuses them.
+// Must be called before Start.
+func (s *Server) SetMaxMessageSize(size int) {
+	if size > 0 {
+		s.maxSize = size
+	}
+}
+
+// SetMaxClients caps how many clients are served at once (0 = unlimited).
+// A connection past the cap is closed as soon as it is accepted.
+// Must be called before Start.
+func (s *Server) SetMaxClients(n int) {
+	s.maxClients = n
+}
+
+// Rejected returns how many connections were refused at the cap
+func (s *Server) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+// Start accepts connections until Stop is called
+func (s *Server) Start() error {
+	slog.Info("TCP server starting", "addr", s.addr)
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	if s.onListening != nil {
+		s.onListening()
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.stopping.Load() {
+				return nil
+			}
+			return err
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Stop stops accepting connections, closes every client and waits for their
+// handlers to finish. Streams have no close message, so pending sends are
+// whatever already reached the socket.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.RLock()
+	s.stopping.Store(true)
+	ln := s.listener
+	conns := make([]*Connection, 0, len(s.connections))
+	for conn := range s.connections {
+		conns = append(conns, conn)
+	}
+	s.mu.RUnlock()
+	if ln == nil {
+		return nil
+	}
+
+	ln.Close()
+	for _, conn := range conns {
+		conn.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleConn reads the client's messages until the stream ends
+func (s *Server) handleConn(nc net.Conn) {
+	defer nc.Close()
+
+	conn := &Connection{conn: nc, server: s}
+	s.mu.Lock()
+	if s.stopping.Load() {
+		s.mu.Unlock()
+		return
+	}
+	if s.maxClients > 0 && len(s.connections) >= s.maxClients {
+		s.mu.Unlock()
+		s.reject(nc)
+		return
+	}
+	s.connections[conn] = true
+	s.mu.Unlock()
+	slog.Info("Client connected", "remote", nc.RemoteAddr().String())
+
+	reader := bufio.NewReader(nc)
+	for {
+		data, err := frag.ReadFrame(reader, s.maxSize)
+		if err != nil {
+			if !conn.closed.Load() && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("Read error", "error", err)
+			}
+			break
+		}
+		if s.onMessage != nil {
+			s.onMessage(conn, data)
+		}
+	}
+
+	conn.closed.Store(true)
+	s.remove(conn)
+	slog.Info("Client disconnected", "remote", nc.RemoteAddr().String())
+}
+
+// remove drops a connection and notifies onDisconnect
+func (s *Server) remove(conn *Connection) {
+	if s.onDisconnect != nil {
+		s.onDisconnect(conn)
+	}
+	s.mu.Lock()
+	delete(s.connections, conn)
+	s.mu.Unlock()
+}
+
+// reject counts a connection refused at the cap, which handleConn then closes.
+// Rejections are logged on powers of two so a flood doesn't flood the log.
+func (s *Server) reject(nc net.Conn) {
+	if n := s.rejected.Add(1); n&(n-1) == 0 {
+		slog.Warn("Rejecting TCP clients over the limit", "rejected", n, "limit", s.maxClients, "remote", nc.RemoteAddr().String())
+	}
+}
@@ -0,0 +1,215 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	client "seras-protocol/internal/transport/client/tcp"
+)
+
+// startEcho runs a server that echoes every message back until the test
+// ends, and returns the address clients dial
+func startEcho(t *testing.T, configure func(s *Server)) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := NewServer(addr, func(conn *Connection, data []byte) {
+		conn.Send(data)
+	})
+	if configure != nil {
+		configure(s)
+	}
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	select {
+	case <-listening:
+	case err := <-errc:
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Stop(ctx); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Start returned %v", err)
+		}
+	})
+	return s, addr
+}
+
+// dial connects a client transport to addr
+func dial(t *testing.T, addr string) *client.Transport {
+	t.Helper()
+	transport, err := client.NewTransport(&client.Config{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Disconnect() })
+	return transport
+}
+
+// clients returns how many connections the server holds
+func (s *Server) clients() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.connections)
+}
+
+// waitClients waits for the server to hold n connections
+func waitClients(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("server holds %d connections, want %d", s.clients(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	disconnected := make(chan *Connection, 1)
+	s, addr := startEcho(t, func(s *Server) {
+		s.SetOnDisconnect(func(conn *Connection) { disconnected <- conn })
+	})
+	transport := dial(t, addr)
+
+	for _, size := range []int{1, 100, 1400, 65535, 200000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		if err := transport.Send(data); err != nil {
+			t.Fatalf("send %d bytes: %v", size, err)
+		}
+		got, err := transport.Receive()
+		if err != nil {
+			t.Fatalf("receive %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("echo of %d bytes came back as %d", size, len(got))
+		}
+	}
+	waitClients(t, s, 1)
+
+	// Disconnecting frees the client's slot and closes its connection
+	transport.Disconnect()
+	select {
+	case conn := <-disconnected:
+		if !conn.Closed() {
+			t.Fatal("disconnected connection not reported closed")
+		}
+		if err := conn.Send([]byte("late")); err == nil {
+			t.Fatal("sent to a disconnected client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect never reported")
+	}
+	waitClients(t, s, 0)
+}
+
+func TestReceiveContextCancel(t *testing.T) {
+	_, addr := startEcho(t, nil)
+	transport := dial(t, addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() {
+		_, err := transport.ReceiveContext(ctx)
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-received:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive still blocked after cancel")
+	}
+	if err := transport.SendContext(ctx, []byte{1}); err != context.Canceled {
+		t.Fatalf("send on a canceled context: got %v, want context.Canceled", err)
+	}
+}
+
+func TestOversizedMessageDisconnects(t *testing.T) {
+	s, addr := startEcho(t, func(s *Server) { s.SetMaxMessageSize(1024) })
+	transport := dial(t, addr)
+
+	if err := transport.Send(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	// The client has no limit of its own, so only the server refuses this
+	if err := transport.Send(make([]byte, 1025)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Receive(); err == nil {
+		t.Fatal("received an echo of a message over the limit")
+	}
+	waitClients(t, s, 0)
+}
+
+func TestMaxClients(t *testing.T) {
+	s, addr := startEcho(t, func(s *Server) { s.SetMaxClients(2) })
+	first := dial(t, addr)
+	dial(t, addr)
+	waitClients(t, s, 2)
+
+	// The third is closed as soon as it is accepted
+	extra := dial(t, addr)
+	extra.Send([]byte("hello"))
+	if _, err := extra.Receive(); err == nil {
+		t.Fatal("third client served past the limit")
+	}
+	if n := s.clients(); n != 2 {
+		t.Fatalf("server holds %d connections, want 2", n)
+	}
+	if n := s.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d, want 1", n)
+	}
+
+	// A client leaving frees its slot
+	first.Disconnect()
+	waitClients(t, s, 1)
+	again := dial(t, addr)
+	if err := again.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := again.Receive(); err != nil || string(got) != "hello" {
+		t.Fatalf("received %q, %v after a slot freed; want hello", got, err)
+	}
+}
+
+func TestStopClosesClients(t *testing.T) {
+	s, addr := startEcho(t, nil)
+	transport := dial(t, addr)
+	waitClients(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if _, err := transport.Receive(); err == nil {
+		t.Fatal("client read a message after Stop")
+	}
+	if n := s.clients(); n != 0 {
+		t.Fatalf("server holds %d connections after Stop", n)
+	}
+	if _, err := client.NewTransport(&client.Config{Addr: addr}); err == nil {
+		t.Fatal("connected after Stop")
+	}
+}
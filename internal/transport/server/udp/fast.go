@@ -0,0 +1,42 @@
+package udp
+
+import "fmt"
+
+const (
+	// DefaultRingEntries is the io_uring submission queue size
+	DefaultRingEntries = 512
+	// DefaultRingDepth is how many receives the fast server keeps in flight
+	DefaultRingDepth = 64
+	// MaxRingEntries is the largest ring the fast server will create
+	MaxRingEntries = 4096
+)
+
+// FastConfig tunes the io_uring receive path. Handling is spread over the
+// server's workers (SetWorkers, NumCPU by default).
+type FastConfig struct {
+	Entries int // Submission queue entries (0 = DefaultRingEntries)
+	Depth   int // Receives kept in flight, each with a 64 KiB buffer (0 = DefaultRingDepth)
+}
+
+// Validate checks the configured sizes
+func (c FastConfig) Validate() error {
+	_, err := c.withDefaults()
+	return err
+}
+
+// withDefaults fills unset fields and checks the result
+func (c FastConfig) withDefaults() (FastConfig, error) {
+	if c.Entries == 0 {
+		c.Entries = DefaultRingEntries
+	}
+	if c.Depth == 0 {
+		c.Depth = min(DefaultRingDepth, c.Entries)
+	}
+	if c.Entries < 1 || c.Entries > MaxRingEntries {
+		return c, fmt.Errorf("ring entries must be between 1 and %d, got: %d", MaxRingEntries, c.Entries)
+	}
+	if c.Depth < 1 || c.Depth > c.Entries {
+		return c, fmt.Errorf("ring depth must be between 1 and the ring entries (%d), got: %d", c.Entries, c.Depth)
+	}
+	return c, nil
+}
@@ -0,0 +1,36 @@
+package udp
+
+import "testing"
+
+func TestFastConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg  FastConfig
+		want FastConfig // Zero when invalid
+	}{
+		{FastConfig{}, FastConfig{DefaultRingEntries, DefaultRingDepth}},
+		{FastConfig{Entries: 32}, FastConfig{32, 32}},
+		{FastConfig{Entries: 1024, Depth: 128}, FastConfig{1024, 128}},
+		{FastConfig{Depth: DefaultRingEntries}, FastConfig{DefaultRingEntries, DefaultRingEntries}},
+		{FastConfig{Entries: MaxRingEntries}, FastConfig{MaxRingEntries, DefaultRingDepth}},
+		{FastConfig{Entries: MaxRingEntries + 1}, FastConfig{}},
+		{FastConfig{Entries: -1}, FastConfig{}},
+		{FastConfig{Depth: -1}, FastConfig{}},
+		{FastConfig{Entries: 16, Depth: 17}, FastConfig{}},
+	}
+	for _, tt := range tests {
+		got, err := tt.cfg.withDefaults()
+		if tt.want == (FastConfig{}) {
+			if err == nil || tt.cfg.Validate() == nil {
+				t.Errorf("%+v: accepted", tt.cfg)
+			}
+			continue
+		}
+		if err != nil || tt.cfg.Validate() != nil {
+			t.Errorf("%+v: %v", tt.cfg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%+v: got %+v, want %+v", tt.cfg, got, tt.want)
+		}
+	}
+}
@@ -1,31 +1,111 @@
 package udp
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/transport/frag"
+	"seras-protocol/internal/transport/server"
+)
+
+// DefaultIdleTimeout is how long a client may stay silent before it is removed
+const DefaultIdleTimeout = 60 * time.Second
+
+var (
+	_ server.Server   = (*Server)(nil)
+	_ server.Migrator = (*Connection)(nil)
+	_ server.Closer   = (*Connection)(nil)
 )
 
-// Connection represents a UDP client identified by address
+// Connection represents a UDP client, identified by its connection ID when
+// it sends one and by address otherwise
 type Connection struct {
-	addr   *net.UDPAddr
-	server *Server
+	key         string                      // Key in Server.connections
+	addr        atomic.Pointer[net.UDPAddr] // Where replies go
+	from        *net.UDPAddr                // Source of the message being handled; owned by its worker
+	server      *Server
+	lastSeen    atomic.Int64      // Unix nanoseconds of creation or the last authenticated message
+	removed     atomic.Bool       // Set under Server.mu once dropped from connections
+	reassembler *frag.Reassembler // Chunks from the connection's current address
+	strays      *frag.Reassembler // Chunks from other addresses, until one is verified
+}
+
+// Addr returns the client's current address
+func (c *Connection) Addr() *net.UDPAddr {
+	return c.addr.Load()
+}
+
+// Closed reports whether the connection was removed. A datagram still queued
+// for it is handled afterwards, and a new datagram from the client opens a
+// new connection under the same key.
+func (c *Connection) Closed() bool {
+	return c.removed.Load()
 }
 
-// Send sends data to this client
+// Verified moves the connection to the address the message being handled
+// came from, once the handler has authenticated that message. Until then a
+// datagram carrying a known connection ID from elsewhere changes nothing, so
+// the ID alone can't redirect a client's traffic or keep it from timing out.
+// Must be called from the message callback.
+func (c *Connection) Verified() {
+	c.lastSeen.Store(c.server.now().UnixNano())
+	from := c.from
+	if from == nil {
+		return
+	}
+	prev := c.addr.Load()
+	if prev.IP.Equal(from.IP) && prev.Port == from.Port {
+		return
+	}
+	c.addr.Store(from)
+	slog.Info("UDP client migrated", "from", prev.String(), "to", from.String())
+}
+
+// Send sends data to this client, fragmenting it if needed
 func (c *Connection) Send(data []byte) error {
-	_, err := c.server.conn.WriteToUDP(data, c.addr)
-	return err
+	if max := c.server.maxSize; max > 0 && len(data) > max {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), max)
+	}
+	chunks, err := c.server.fragmenter.Split(data)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := c.server.conn.WriteToUDP(chunk, c.addr.Load()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Server is a UDP server for node
 type Server struct {
 	addr         string
 	conn         *net.UDPConn
-	connections  map[string]*Connection // key is addr.String()
+	connections  map[string]*Connection // Keyed by connection ID, or addr.String() for untagged clients
 	mu           sync.RWMutex
 	onMessage    func(conn *Connection, data []byte)
 	onDisconnect func(conn *Connection)
+	onListening  func()
+	workers      int // Number of message handling workers
+	queueSize    int // Pending packets per worker before the read loop blocks
+	idleTimeout  time.Duration
+	maxSize      int              // Largest message accepted or sent (0 = unlimited)
+	maxClients   int              // Connections tracked at once (0 = unlimited)
+	rejected     atomic.Uint64    // Datagrams from new clients refused at maxClients
+	now          func() time.Time // Clock, replaceable for tests
+	fragmenter   *frag.Fragmenter
+	stop         chan struct{} // Closed by Stop
+	stopOnce     sync.Once
+	done         chan struct{} // Closed once Start has shut down
 }
 
 // NewServer creates a new UDP server
@@ -34,6 +114,51 @@ func NewServer(addr string, onMessage func(conn *Connection, data []byte)) *Serv
 		addr:        addr,
 		connections: make(map[string]*Connection),
 		onMessage:   onMessage,
+		workers:     runtime.NumCPU(),
+		queueSize:   DefaultQueueSize,
+		idleTimeout: DefaultIdleTimeout,
+		now:         time.Now,
+		fragmenter:  frag.NewFragmenter(frag.DefaultChunkSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// SetIdleTimeout sets how long a silent client is kept before onDisconnect fires
+func (s *Server) SetIdleTimeout(ttl time.Duration) {
+	if ttl > 0 {
+		s.idleTimeout = ttl
+	}
+}
+
+// SetMaxMessageSize bounds reassembled messages; larger ones are dropped
+// without being buffered, and Send refuses them. Must be called before Start.
+func (s *Server) SetMaxMessageSize(size int) {
+	if size > 0 {
+		s.maxSize = size
+	}
+}
+
+// SetMaxClients caps how many clients are tracked at once (0 = unlimited).
+// A datagram from a new client past the cap is answered with a rejection
+// frame and no state is kept for it. Must be called before Start.
+func (s *Server) SetMaxClients(n int) {
+	s.maxClients = n
+}
+
+// Rejected returns how many datagrams from new clients were refused at the cap
+func (s *Server) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+// SetWorkers sets the worker pool size and per-worker queue length.
+// Must be called before Start.
+func (s *Server) SetWorkers(workers, queueSize int) {
+	if workers > 0 {
+		s.workers = workers
+	}
+	if queueSize > 0 {
+		s.queueSize = queueSize
 	}
 }
 
@@ -42,8 +167,26 @@ func (s *Server) SetOnDisconnect(callback func(conn *Connection)) {
 	s.onDisconnect = callback
 }
 
+// SetOnListening sets a callback run once the socket is open
+func (s *Server) SetOnListening(callback func()) {
+	s.onListening = callback
+}
+
 // Start starts the UDP server
 func (s *Server) Start() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	if s.onListening != nil {
+		s.onListening()
+	}
+
+	slog.Info("UDP server starting", "addr", s.addr, "workers", s.workers)
+	return s.serve(s.readLoop)
+}
+
+// listen opens the server socket
+func (s *Server) listen() error {
 	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
 	if err != nil {
 		return err
@@ -54,59 +197,254 @@ func (s *Server) Start() error {
 		return err
 	}
 	s.conn = conn
+	return nil
+}
 
-	slog.Info("UDP server starting", "addr", s.addr)
+// serve runs the worker pool and idle sweeper around a receive loop.
+// Once receive returns, queued packets are handled, every client is
+// disconnected and the socket is closed.
+func (s *Server) serve(receive func(pool *workerPool) error) error {
+	defer close(s.done)
+
+	pool := newWorkerPool(s.workers, s.queueSize, func(conn *Connection, data []byte) {
+		if s.onMessage != nil {
+			s.onMessage(conn, data)
+		}
+	})
+
+	go s.sweepLoop()
+
+	err := receive(pool)
+
+	// Drain before closing the socket so replies to queued packets still go out
+	pool.close()
+	s.disconnectAll()
+	s.conn.Close()
+	return err
+}
+
+// Stop stops reading, waits for queued packets to be handled and
+// disconnects all clients. Start returns once this completes.
+// If ctx expires first the socket is closed immediately.
+func (s *Server) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	if s.conn == nil {
+		return nil
+	}
+
+	// Unblock a pending read
+	s.conn.SetReadDeadline(time.Now())
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.conn.Close()
+		return ctx.Err()
+	}
+}
+
+// stopping reports whether Stop has been called
+func (s *Server) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
 
+// readLoop receives datagrams with blocking reads
+func (s *Server) readLoop(pool *workerPool) error {
 	buf := make([]byte, 65535)
 	for {
-		n, clientAddr, err := conn.ReadFromUDP(buf)
+		n, clientAddr, err := s.conn.ReadFromUDP(buf)
 		if err != nil {
+			if s.stopping() {
+				return nil
+			}
 			slog.Error("UDP read error", "error", err)
 			continue
 		}
+		s.handleDatagram(pool, clientAddr, buf[:n])
+	}
+}
 
-		// Get or create connection for this client
-		addrKey := clientAddr.String()
-		s.mu.Lock()
-		clientConn, exists := s.connections[addrKey]
-		if !exists {
-			clientConn = &Connection{
-				addr:   clientAddr,
-				server: s,
-			}
-			s.connections[addrKey] = clientConn
-			slog.Info("New UDP client", "addr", addrKey)
-		}
-		s.mu.Unlock()
+// handleDatagram registers the sender and hands the datagram to the worker pool.
+// datagram is copied, so the caller may reuse its buffer.
+func (s *Server) handleDatagram(pool *workerPool, clientAddr *net.UDPAddr, datagram []byte) {
+	addrKey := clientAddr.String()
 
-		// Copy data and dispatch
-		data := make([]byte, n)
-		copy(data, buf[:n])
+	// Tagged clients keep their connection when their address changes
+	datagram, connID := frag.StripConnID(datagram)
+	if s.maxSize > 0 && len(datagram)-frag.HeaderSize > s.maxSize {
+		slog.Warn("Dropping oversized UDP datagram", "addr", addrKey, "size", len(datagram), "limit", s.maxSize)
+		return
+	}
+	key := addrKey
+	if connID != 0 {
+		key = "id:" + strconv.FormatUint(connID, 16)
+	}
 
-		if s.onMessage != nil {
-			go s.onMessage(clientConn, data)
+	// Get or create connection for this client
+	s.mu.Lock()
+	clientConn, exists := s.connections[key]
+	if !exists && s.maxClients > 0 && len(s.connections) >= s.maxClients {
+		s.mu.Unlock()
+		s.reject(clientAddr)
+		return
+	}
+	if !exists {
+		clientConn = &Connection{
+			key:         key,
+			server:      s,
+			reassembler: frag.NewReassembler(frag.DefaultTimeout),
+			strays:      frag.NewReassembler(frag.DefaultTimeout),
 		}
+		clientConn.addr.Store(clientAddr)
+		clientConn.reassembler.SetMaxSize(s.maxSize)
+		clientConn.strays.SetMaxSize(s.maxSize)
+		clientConn.lastSeen.Store(s.now().UnixNano())
+		s.connections[key] = clientConn
+		slog.Info("New UDP client", "addr", addrKey)
+	}
+	s.mu.Unlock()
+
+	// Whole messages are handed off in pooled storage
+	if frag.Unfragmented(datagram) {
+		pooled := bufpool.Get()
+		data := (*pooled)[:len(datagram)]
+		copy(data, datagram)
+		pool.dispatch(key, clientConn, clientAddr, data[frag.HeaderSize:], pooled)
+		return
 	}
+
+	// Chunks are kept by the reassembler, so they need their own copy
+	data := make([]byte, len(datagram))
+	copy(data, datagram)
+
+	// Anyone can send a known connection ID, so chunks from elsewhere can't
+	// disturb the messages the client is sending from its own address
+	reassembler := clientConn.reassembler
+	if current := clientConn.Addr(); !current.IP.Equal(clientAddr.IP) || current.Port != clientAddr.Port {
+		reassembler = clientConn.strays
+	}
+	message, err := reassembler.Add(data)
+	if err != nil {
+		slog.Warn("Dropping malformed UDP datagram", "addr", addrKey, "error", err)
+		return
+	}
+	if message == nil {
+		return
+	}
+
+	pool.dispatch(key, clientConn, clientAddr, message, nil)
 }
 
-// RemoveConnection removes a client connection
+// reject answers a client refused at the cap, logging on powers of two so a
+// flood of them doesn't flood the log
+func (s *Server) reject(addr *net.UDPAddr) {
+	if n := s.rejected.Add(1); n&(n-1) == 0 {
+		slog.Warn("Rejecting UDP clients over the limit", "rejected", n, "limit", s.maxClients, "addr", addr.String())
+	}
+	s.conn.WriteToUDP(frag.RejectFrame("server full"), addr)
+}
+
+// RemoveConnection removes a client connection. A connection already
+// removed, by the idle sweep or an earlier call, is left alone, so neither a
+// newer connection under its key nor onDisconnect is touched twice.
 func (s *Server) RemoveConnection(conn *Connection) {
 	s.mu.Lock()
-	delete(s.connections, conn.addr.String())
+	removed := s.drop(conn)
 	s.mu.Unlock()
+	if !removed {
+		return
+	}
 
 	if s.onDisconnect != nil {
 		s.onDisconnect(conn)
 	}
-	slog.Info("UDP client removed", "addr", conn.addr.String())
+	slog.Info("UDP client removed", "addr", conn.Addr().String())
+}
+
+// drop deletes conn from connections if it is still there and marks it
+// closed, reporting whether it did. Must be called with s.mu held.
+func (s *Server) drop(conn *Connection) bool {
+	if s.connections[conn.key] != conn {
+		return false
+	}
+	delete(s.connections, conn.key)
+	conn.removed.Store(true)
+	return true
 }
 
-// Broadcast sends data to all connected clients
+// sweepLoop periodically removes idle clients
+func (s *Server) sweepLoop() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepIdle()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweepIdle removes clients that sent nothing authenticated for longer than
+// the idle timeout. Holding mu keeps it consistent with the read loop, which
+// creates connections under the same lock.
+func (s *Server) sweepIdle() {
+	deadline := s.now().Add(-s.idleTimeout).UnixNano()
+
+	var idle []*Connection
+	s.mu.Lock()
+	for _, conn := range s.connections {
+		if conn.lastSeen.Load() < deadline {
+			s.drop(conn)
+			idle = append(idle, conn)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, conn := range idle {
+		if s.onDisconnect != nil {
+			s.onDisconnect(conn)
+		}
+		slog.Info("UDP client timed out", "addr", conn.Addr().String())
+	}
+}
+
+// disconnectAll removes every client, notifying onDisconnect
+func (s *Server) disconnectAll() {
+	s.mu.Lock()
+	conns := make([]*Connection, 0, len(s.connections))
+	for _, conn := range s.connections {
+		s.drop(conn)
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		if s.onDisconnect != nil {
+			s.onDisconnect(conn)
+		}
+	}
+}
+
+// Broadcast sends data to the clients connected when it is called. Sends run
+// outside the lock, so clients can come and go meanwhile.
 func (s *Server) Broadcast(data []byte) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-
+	conns := make([]*Connection, 0, len(s.connections))
 	for _, conn := range s.connections {
+		conns = append(conns, conn)
+	}
+	s.mu.RUnlock()
+
+	for _, conn := range conns {
 		conn.Send(data)
 	}
 }
@@ -3,138 +3,141 @@
 package udp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net"
-	"sync"
 	"syscall"
 
 	"seras-protocol/internal/iouring"
 )
 
-// FastServer is a UDP server with io_uring acceleration
+// FastServer is a UDP server with io_uring acceleration.
+// It shares connection tracking, fragmentation and workers with Server
+// and only replaces the receive loop.
 type FastServer struct {
-	addr         string
-	conn         *net.UDPConn
-	fd           int
-	ring         iouring.Ring
-	connections  map[string]*Connection
-	mu           sync.RWMutex
-	onMessage    func(conn *Connection, data []byte)
-	onDisconnect func(conn *Connection)
+	*Server
+	fd    int
+	ring  iouring.Ring
+	depth int
 }
 
 // NewFastServer creates a new io_uring accelerated UDP server
-func NewFastServer(addr string, onMessage func(conn *Connection, data []byte)) (*FastServer, error) {
+func NewFastServer(addr string, onMessage func(conn *Connection, data []byte), cfg FastConfig) (*FastServer, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	if !iouring.IsSupported() {
 		return nil, fmt.Errorf("io_uring not supported")
 	}
 
-	ring, err := iouring.New(iouring.Config{Entries: 512})
+	ring, err := iouring.New(iouring.Config{Entries: uint32(cfg.Entries)})
 	if err != nil {
 		return nil, err
 	}
 
 	return &FastServer{
-		addr:        addr,
-		ring:        ring,
-		connections: make(map[string]*Connection),
-		onMessage:   onMessage,
+		Server: NewServer(addr, onMessage),
+		ring:   ring,
+		depth:  cfg.Depth,
 	}, nil
 }
 
-// SetOnDisconnect sets callback for client disconnection
-func (s *FastServer) SetOnDisconnect(callback func(conn *Connection)) {
-	s.onDisconnect = callback
-}
-
 // Start starts the io_uring accelerated UDP server
 func (s *FastServer) Start() error {
-	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
-	if err != nil {
+	if err := s.listen(); err != nil {
 		return err
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	// Use the socket's own descriptor; io_uring handles readiness itself
+	raw, err := s.conn.SyscallConn()
 	if err != nil {
 		return err
 	}
-	s.conn = conn
-
-	// Get raw file descriptor
-	file, err := conn.File()
-	if err != nil {
+	if err := raw.Control(func(fd uintptr) { s.fd = int(fd) }); err != nil {
 		return err
 	}
-	s.fd = int(file.Fd())
-
-	// Set socket to non-blocking for io_uring
-	syscall.SetNonblock(s.fd, true)
-
-	slog.Info("Fast UDP server starting with io_uring", "addr", s.addr)
-
-	// Run multiple parallel receivers
-	numReceivers := 4
-	var wg sync.WaitGroup
-	wg.Add(numReceivers)
-
-	for i := 0; i < numReceivers; i++ {
-		go func() {
-			defer wg.Done()
-			s.receiveLoop()
-		}()
+	if s.onListening != nil {
+		s.onListening()
 	}
 
-	wg.Wait()
-	return nil
+	slog.Info("Fast UDP server starting with io_uring", "addr", s.addr, "depth", s.depth, "workers", s.workers)
+	return s.serve(s.ringLoop)
 }
 
-func (s *FastServer) receiveLoop() {
-	buf := make([]byte, 65535)
+// ringLoop keeps depth receives in flight, one per buffer. It blocks for
+// a completion, reaps every other completion already queued, and resubmits
+// the reaped buffers as one batch.
+func (s *FastServer) ringLoop(pool *workerPool) error {
+	bufs := make([][]byte, s.depth)
+	slots := make([]int, s.depth)
+	for i := range bufs {
+		bufs[i] = make([]byte, 65535)
+		slots[i] = i
+	}
+
+	done := make(chan iouring.RecvCompletion, s.depth)
+	if err := s.ring.RecvMsgBatch(s.fd, bufs, slots, done); err != nil {
+		return fmt.Errorf("io_uring submit: %w", err)
+	}
 
+	batch := make([][]byte, 0, s.depth)
+	reaped := make([]int, 0, s.depth)
 	for {
-		// Use io_uring async recv
-		op, err := s.ring.RecvAsync(s.fd, buf)
-		if err != nil {
-			slog.Error("io_uring recv error", "error", err)
-			continue
+		var c iouring.RecvCompletion
+		select {
+		case c = <-done:
+		case <-s.stop:
+			return nil
 		}
 
-		n, err := op.Wait()
-		if err != nil {
-			if err != syscall.EAGAIN && err != syscall.EWOULDBLOCK {
-				slog.Error("UDP read error", "error", err)
+		batch, reaped = batch[:0], reaped[:0]
+		for more := true; more; {
+			s.complete(pool, bufs[c.Slot], c)
+			batch = append(batch, bufs[c.Slot])
+			reaped = append(reaped, c.Slot)
+
+			select {
+			case c = <-done:
+			default:
+				more = false
 			}
-			continue
 		}
 
-		if n == 0 {
-			continue
+		if err := s.ring.RecvMsgBatch(s.fd, batch, reaped, done); err != nil {
+			if s.stopping() {
+				return nil
+			}
+			return fmt.Errorf("io_uring submit: %w", err)
 		}
+	}
+}
 
-		// For UDP with io_uring we need to get the source address differently
-		// Since recvfrom with io_uring is complex, fall back to standard read
-		// but use the async submission for better batching
-		data := make([]byte, n)
-		copy(data, buf[:n])
-
-		// Note: io_uring recvmsg would give us the source address
-		// For now, dispatch without address tracking
-		if s.onMessage != nil {
-			go s.onMessage(nil, data)
-		}
+// complete hands a finished receive to the shared datagram path
+func (s *FastServer) complete(pool *workerPool, buf []byte, c iouring.RecvCompletion) {
+	// With many receives in flight, a datagram can wake several of them
+	// and only one gets it; the rest come back empty and are resubmitted
+	if errors.Is(c.Err, syscall.EAGAIN) {
+		return
 	}
+	if c.Err != nil {
+		slog.Error("UDP read error", "error", c.Err)
+		return
+	}
+	if c.N == 0 || c.Addr == nil {
+		return
+	}
+	s.handleDatagram(pool, c.Addr, buf[:c.N])
 }
 
-// Stop stops the server
-func (s *FastServer) Stop() error {
+// Stop stops the server like Server.Stop and then releases the ring
+func (s *FastServer) Stop(ctx context.Context) error {
+	err := s.Server.Stop(ctx)
 	if s.ring != nil {
 		s.ring.Close()
 	}
-	if s.conn != nil {
-		return s.conn.Close()
-	}
-	return nil
+	return err
 }
 
 // IsFastSupported returns true if io_uring is available
@@ -0,0 +1,167 @@
+//go:build linux
+
+package udp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/frag"
+)
+
+// benchWindow is how many datagrams a receive benchmark keeps unhandled at
+// once, well under what the socket buffers, so the kernel drops none
+const benchWindow = 128
+
+// newFastServer returns an io_uring server, skipping where there is none
+func newFastServer(tb testing.TB, onMessage func(conn *Connection, data []byte), cfg FastConfig) *FastServer {
+	tb.Helper()
+	if !IsFastSupported() {
+		tb.Skip("io_uring is not supported")
+	}
+	s, err := NewFastServer("127.0.0.1:0", onMessage, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// BenchmarkReceive floods a server from a few clients with small datagrams
+// and counts the messages handed to the handler, for the io_uring server
+// and the standard one it replaces
+func BenchmarkReceive(b *testing.B) {
+	b.Run("standard", func(b *testing.B) {
+		benchReceive(b, func(onMessage func(*Connection, []byte)) *net.UDPAddr {
+			s := NewServer("127.0.0.1:0", onMessage)
+			addr, _ := startServer(b, s, s.Start)
+			return addr
+		})
+	})
+	b.Run("io_uring", func(b *testing.B) {
+		benchReceive(b, func(onMessage func(*Connection, []byte)) *net.UDPAddr {
+			s := newFastServer(b, onMessage, FastConfig{})
+			addr, _ := startServer(b, s.Server, s.Start)
+			return addr
+		})
+	})
+}
+
+// BenchmarkFastReceivers is BenchmarkReceive for the io_uring server over
+// worker counts and receives in flight, to tune UDP_WORKERS and
+// UDP_RING_DEPTH for a host
+func BenchmarkFastReceivers(b *testing.B) {
+	workers := []int{1, 2, 4, runtime.NumCPU()}
+	for _, w := range slices.Compact(slices.Sorted(slices.Values(workers))) {
+		for _, depth := range []int{8, DefaultRingDepth, 256} {
+			b.Run(fmt.Sprintf("workers=%d/depth=%d", w, depth), func(b *testing.B) {
+				benchReceive(b, func(onMessage func(*Connection, []byte)) *net.UDPAddr {
+					s := newFastServer(b, onMessage, FastConfig{Depth: depth})
+					s.SetWorkers(w, 0)
+					addr, _ := startServer(b, s.Server, s.Start)
+					return addr
+				})
+			})
+		}
+	}
+}
+
+// benchReceive runs the receive benchmark against the server start returns
+// the address of
+func benchReceive(b *testing.B, start func(onMessage func(*Connection, []byte)) *net.UDPAddr) {
+	const clients = 4
+	var handled atomic.Int64
+	progress := make(chan struct{}, 1)
+	addr := start(func(conn *Connection, data []byte) {
+		handled.Add(1)
+		select {
+		case progress <- struct{}{}:
+		default:
+		}
+	})
+
+	conns := make([]*net.UDPConn, clients)
+	for i := range conns {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	payload := datagram(b, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	var sent int64
+	for handled.Load() < int64(b.N) {
+		if sent < int64(b.N) && sent-handled.Load() < benchWindow {
+			if _, err := conns[sent%clients].Write(payload); err != nil {
+				b.Fatal(err)
+			}
+			sent++
+			continue
+		}
+		select {
+		case <-progress:
+		case <-time.After(50 * time.Millisecond):
+			// Nothing moved, so the rest of the window was lost
+			sent = handled.Load()
+		}
+	}
+}
+
+func TestFastServerRepliesToSender(t *testing.T) {
+	s := newFastServer(t, func(conn *Connection, data []byte) {
+		conn.Send(append([]byte("reply to "), data...))
+	}, FastConfig{})
+	addr, _ := startServer(t, s.Server, s.Start)
+
+	peers := make([]*net.UDPConn, 3)
+	for i := range peers {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		peers[i] = conn
+	}
+	for i, peer := range peers {
+		if _, err := peer.Write(datagram(t, fmt.Sprintf("peer %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 65535)
+	for i, peer := range peers {
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("peer %d: %v", i, err)
+		}
+		reply, err := frag.NewReassembler(frag.DefaultTimeout).Add(buf[:n])
+		if err != nil {
+			t.Fatalf("peer %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("reply to peer %d", i); string(reply) != want {
+			t.Errorf("peer %d got %q, want %q", i, reply, want)
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.connections) != len(peers) {
+		t.Fatalf("%d connections, want one per peer", len(s.connections))
+	}
+	for _, peer := range peers {
+		local := peer.LocalAddr().(*net.UDPAddr)
+		if conn := s.connections[local.String()]; conn == nil || conn.Addr().Port != local.Port {
+			t.Errorf("no connection for %v", local)
+		}
+	}
+}
@@ -4,27 +4,22 @@ package udp
 
 import "fmt"
 
-// FastServer is not available on non-Linux
-type FastServer struct{}
+// FastServer is not available on non-Linux. It embeds Server only so it
+// offers the same setters.
+type FastServer struct {
+	*Server
+}
 
 // NewFastServer returns error on non-Linux
-func NewFastServer(addr string, onMessage func(conn *Connection, data []byte)) (*FastServer, error) {
+func NewFastServer(addr string, onMessage func(conn *Connection, data []byte), cfg FastConfig) (*FastServer, error) {
 	return nil, fmt.Errorf("io_uring is only available on Linux")
 }
 
-// SetOnDisconnect is a no-op
-func (s *FastServer) SetOnDisconnect(callback func(conn *Connection)) {}
-
 // Start returns error
 func (s *FastServer) Start() error {
 	return fmt.Errorf("io_uring is only available on Linux")
 }
 
-// Stop is a no-op
-func (s *FastServer) Stop() error {
-	return nil
-}
-
 // IsFastSupported returns false on non-Linux
 func IsFastSupported() bool {
 	return false
@@ -0,0 +1,542 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/transport/frag"
+)
+
+// fakeClock is a clock that moves only when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// testServer is a Server without a socket, fed datagrams directly
+type testServer struct {
+	*Server
+	pool    *workerPool
+	clock   *fakeClock
+	handled chan struct{} // Signaled after each message is handled
+
+	disconnectMu sync.Mutex
+	disconnected []*Connection
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{
+		Server:  NewServer("127.0.0.1:0", nil),
+		clock:   &fakeClock{now: time.Unix(1700000000, 0)},
+		handled: make(chan struct{}, 1),
+	}
+	s.now = s.clock.Now
+	s.SetOnDisconnect(func(conn *Connection) {
+		s.disconnectMu.Lock()
+		s.disconnected = append(s.disconnected, conn)
+		s.disconnectMu.Unlock()
+	})
+	s.pool = newWorkerPool(1, 16, func(conn *Connection, data []byte) {
+		// Messages saying so pass authentication
+		if string(data) == "verified" {
+			conn.Verified()
+		}
+		s.handled <- struct{}{}
+	})
+	t.Cleanup(s.pool.close)
+	return s
+}
+
+// startServer runs start, the Start of a server built around s, and stops
+// the server when the test ends. It returns the address the server listens
+// on and a channel that yields what Start returned.
+func startServer(tb testing.TB, s *Server, start func() error) (*net.UDPAddr, <-chan error) {
+	tb.Helper()
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	errc := make(chan error, 1)
+	go func() {
+		errc <- start()
+		close(errc)
+	}()
+
+	select {
+	case <-listening:
+	case err := <-errc:
+		tb.Fatalf("Start: %v", err)
+	}
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Stop(ctx); err != nil {
+			tb.Errorf("Stop: %v", err)
+		}
+		<-errc
+	})
+	return s.conn.LocalAddr().(*net.UDPAddr), errc
+}
+
+// datagram returns message in one chunk, as a client sends it
+func datagram(tb testing.TB, message string) []byte {
+	tb.Helper()
+	chunks, err := frag.NewFragmenter(frag.DefaultChunkSize).Split([]byte(message))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return chunks[0]
+}
+
+// receive handles message from addr and returns its connection
+func (s *testServer) receive(t *testing.T, addr, message string) *Connection {
+	t.Helper()
+	udpAddr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+	s.handleDatagram(s.pool, udpAddr, datagram(t, message))
+	<-s.handled
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conn := s.connections[udpAddr.String()]
+	if conn == nil {
+		t.Fatalf("no connection for %s", addr)
+	}
+	return conn
+}
+
+// disconnects returns the connections onDisconnect was called for so far
+func (s *testServer) disconnects() []*Connection {
+	s.disconnectMu.Lock()
+	defer s.disconnectMu.Unlock()
+	return append([]*Connection(nil), s.disconnected...)
+}
+
+func TestSweepRemovesIdleClients(t *testing.T) {
+	s := newTestServer(t)
+	s.SetIdleTimeout(time.Minute)
+
+	quiet := s.receive(t, "192.0.2.1:40000", "hello")
+	active := s.receive(t, "192.0.2.2:40000", "hello")
+
+	s.clock.Advance(40 * time.Second)
+	// Authenticated traffic keeps a client; a bare datagram does not
+	if again := s.receive(t, "192.0.2.2:40000", "verified"); again != active {
+		t.Fatal("known client got a new connection")
+	}
+	if again := s.receive(t, "192.0.2.1:40000", "hello"); again != quiet {
+		t.Fatal("known client got a new connection")
+	}
+
+	s.clock.Advance(21 * time.Second)
+	s.sweepIdle()
+	if got := s.disconnects(); len(got) != 1 || got[0] != quiet {
+		t.Fatalf("disconnected %d clients, want only the quiet one", len(got))
+	}
+	if !quiet.Closed() || active.Closed() {
+		t.Fatalf("closed: quiet %v, active %v; want true, false", quiet.Closed(), active.Closed())
+	}
+
+	// Removing a swept client again doesn't notify twice
+	s.RemoveConnection(quiet)
+	if got := len(s.disconnects()); got != 1 {
+		t.Fatalf("onDisconnect called %d times, want 1", got)
+	}
+
+	// A swept client that comes back starts a new connection
+	if back := s.receive(t, "192.0.2.1:40000", "hello"); back == quiet || back.Closed() {
+		t.Fatal("returning client reused its swept connection")
+	}
+
+	s.clock.Advance(time.Minute + time.Second)
+	s.sweepIdle()
+	if got := s.disconnects(); len(got) != 3 {
+		t.Fatalf("disconnected %d clients after everyone went quiet, want 3", len(got))
+	}
+}
+
+func TestSweepKeepsClientsWithinTimeout(t *testing.T) {
+	s := newTestServer(t)
+	conn := s.receive(t, "192.0.2.1:40000", "hello")
+
+	// DefaultIdleTimeout applies when none is set
+	s.clock.Advance(DefaultIdleTimeout)
+	s.sweepIdle()
+	if conn.Closed() || len(s.disconnects()) != 0 {
+		t.Fatal("client removed at exactly the idle timeout")
+	}
+
+	s.clock.Advance(time.Nanosecond)
+	s.sweepIdle()
+	if !conn.Closed() {
+		t.Fatal("client kept past the idle timeout")
+	}
+}
+
+func TestSweepRacesReadLoop(t *testing.T) {
+	s := newTestServer(t)
+	s.SetIdleTimeout(time.Second)
+
+	pool := newWorkerPool(1, 16, func(*Connection, []byte) {})
+	defer pool.close()
+	addr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:40000"))
+	data := datagram(t, "hello")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 500 {
+			s.handleDatagram(pool, addr, data)
+			s.clock.Advance(100 * time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 500 {
+			s.sweepIdle()
+		}
+	}()
+	wg.Wait()
+
+	// Every connection the sweep dropped was reported exactly once
+	seen := make(map[*Connection]bool)
+	for _, conn := range s.disconnects() {
+		if seen[conn] {
+			t.Fatal("connection disconnected twice")
+		}
+		if !conn.Closed() {
+			t.Fatal("disconnected connection not marked closed")
+		}
+		seen[conn] = true
+	}
+}
+
+func TestStartReturnsAfterStop(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil)
+	var disconnected sync.WaitGroup
+	disconnected.Add(1)
+	s.SetOnDisconnect(func(conn *Connection) { disconnected.Done() })
+	addr, errc := startServer(t, s, s.Start)
+
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(datagram(t, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Start returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start still running after Stop")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stopping took %v", elapsed)
+	}
+	disconnected.Wait()
+	if s.clients() != 0 {
+		t.Fatalf("%d clients left after Stop", s.clients())
+	}
+
+	// Stopping again is harmless
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("second Stop: %v", err)
+	}
+}
+
+// clients returns how many connections the server tracks
+func (s *Server) clients() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.connections)
+}
+
+func TestOversizedMessagesDropped(t *testing.T) {
+	s := newTestServer(t)
+	s.SetMaxMessageSize(100)
+	addr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:4000"))
+
+	// One byte over, whole or in chunks, never reaches a worker
+	s.handleDatagram(s.pool, addr, datagram(t, strings.Repeat("x", 101)))
+	if s.clients() != 0 {
+		t.Fatal("oversized datagram created a connection")
+	}
+	chunks, err := frag.NewFragmenter(40).Split(make([]byte, 101))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		s.handleDatagram(s.pool, addr, chunk)
+	}
+	select {
+	case <-s.handled:
+		t.Fatal("oversized message was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn := s.receive(t, addr.String(), strings.Repeat("x", 100))
+	if err := conn.Send(make([]byte, 101)); err == nil {
+		t.Fatal("sent a message over the limit")
+	}
+}
+
+// receiveTagged handles message from addr tagged with connection ID id and
+// returns its connection
+func (s *testServer) receiveTagged(t *testing.T, addr string, id uint64, message string) *Connection {
+	t.Helper()
+	f := frag.NewFragmenter(frag.DefaultChunkSize)
+	f.SetConnID(id)
+	chunks, err := f.Split([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handleDatagram(s.pool, net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr)), chunks[0])
+	<-s.handled
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conn := s.connections["id:"+strconv.FormatUint(id, 16)]
+	if conn == nil {
+		t.Fatalf("no connection for ID %#x", id)
+	}
+	return conn
+}
+
+func TestConnectionMigratesOnVerifiedMessage(t *testing.T) {
+	s := newTestServer(t)
+	const id = 0xc0ffee01
+	wifi, cellular := "192.0.2.1:4000", "198.51.100.7:61000"
+
+	conn := s.receiveTagged(t, wifi, id, "verified")
+	if got := conn.Addr().String(); got != wifi {
+		t.Fatalf("connection at %s, want %s", got, wifi)
+	}
+
+	// The new address shares the connection but only takes it over once a
+	// message from there authenticates
+	if moved := s.receiveTagged(t, cellular, id, "forged"); moved != conn {
+		t.Fatal("address change started a new connection")
+	}
+	if got := conn.Addr().String(); got != wifi {
+		t.Fatalf("unverified message moved the connection to %s", got)
+	}
+	s.receiveTagged(t, cellular, id, "verified")
+	if got := conn.Addr().String(); got != cellular {
+		t.Fatalf("connection at %s after a verified message, want %s", got, cellular)
+	}
+	if s.clients() != 1 {
+		t.Fatalf("%d connections, want the one migrated", s.clients())
+	}
+
+	// Untagged clients are still told apart by address
+	s.receive(t, wifi, "verified")
+	if s.clients() != 2 {
+		t.Fatalf("%d connections after an untagged client, want 2", s.clients())
+	}
+	s.RemoveConnection(conn)
+	if s.clients() != 1 {
+		t.Fatal("removing a migrated connection left it registered")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	conns := make(chan *Connection, 4)
+	s := NewServer("127.0.0.1:0", func(conn *Connection, data []byte) {
+		conns <- conn
+		conn.Send(data)
+	})
+	s.SetMaxClients(2)
+	addr, _ := startServer(t, s, s.Start)
+
+	// send sends a message from a fresh client socket and returns its answer
+	send := func() []byte {
+		t.Helper()
+		client, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		if _, err := client.Write(datagram(t, "hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2048)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	for i := range 2 {
+		if reason, ok := frag.Rejection(send()); ok {
+			t.Fatalf("client %d rejected: %s", i+1, reason)
+		}
+	}
+	first := <-conns
+	<-conns
+
+	// The third is answered with a rejection and nothing is kept for it
+	if _, ok := frag.Rejection(send()); !ok {
+		t.Fatal("third client served past the limit")
+	}
+	if n := s.clients(); n != 2 {
+		t.Fatalf("server tracks %d connections, want 2", n)
+	}
+	if n := s.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d, want 1", n)
+	}
+
+	// A client leaving frees its slot
+	s.RemoveConnection(first)
+	if reason, ok := frag.Rejection(send()); ok {
+		t.Fatalf("client rejected after a slot freed: %s", reason)
+	}
+	if n := s.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d after a slot freed, want 1", n)
+	}
+}
+
+func TestStaleRemoveKeepsNewerConnection(t *testing.T) {
+	s := newTestServer(t)
+	old := s.receive(t, "192.0.2.1:40000", "hello")
+	s.clock.Advance(DefaultIdleTimeout + time.Second)
+	s.sweepIdle()
+
+	// The client comes back under the same key before the handler, still
+	// busy with a message queued for the old connection, removes it
+	current := s.receive(t, "192.0.2.1:40000", "hello")
+	s.RemoveConnection(old)
+	if s.clients() != 1 || current.Closed() {
+		t.Fatal("removing a swept connection dropped the one that replaced it")
+	}
+	if got := s.disconnects(); len(got) != 1 || got[0] != old {
+		t.Fatalf("onDisconnect called for %d connections, want only the swept one", len(got))
+	}
+
+	s.RemoveConnection(current)
+	if got := s.disconnects(); len(got) != 2 || got[1] != current {
+		t.Fatal("removing the current connection didn't report it")
+	}
+}
+
+func TestBroadcastRacesConnections(t *testing.T) {
+	var mu sync.Mutex
+	disconnects := make(map[*Connection]int)
+	s := NewServer("127.0.0.1:0", func(*Connection, []byte) {})
+	s.SetOnDisconnect(func(conn *Connection) {
+		mu.Lock()
+		disconnects[conn]++
+		mu.Unlock()
+	})
+	addr, _ := startServer(t, s, s.Start)
+
+	// Clients keep sending, so connections come back as fast as they go
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		client, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := datagram(t, "hello")
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				client.Write(data)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Broadcast([]byte("news"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.mu.RLock()
+			conns := make([]*Connection, 0, len(s.connections))
+			for _, conn := range s.connections {
+				conns = append(conns, conn)
+			}
+			s.mu.RUnlock()
+			// Each connection is removed twice, as a handler and the
+			// sweep both might
+			for _, conn := range conns {
+				s.RemoveConnection(conn)
+				s.RemoveConnection(conn)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(disconnects) == 0 {
+		t.Fatal("no connection was ever removed")
+	}
+	for conn, n := range disconnects {
+		if n != 1 {
+			t.Fatalf("onDisconnect called %d times for one connection", n)
+		}
+		if !conn.Closed() {
+			t.Fatal("removed connection not marked closed")
+		}
+	}
+}
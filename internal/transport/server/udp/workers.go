@@ -0,0 +1,64 @@
+package udp
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+
+	"seras-protocol/internal/bufpool"
+)
+
+const (
+	DefaultQueueSize = 1024
+)
+
+// packet is a datagram waiting to be handled
+type packet struct {
+	conn *Connection
+	from *net.UDPAddr // Address the datagram came from
+	data []byte
+	buf  *[]byte // Pooled storage behind data, released after handling
+}
+
+// workerPool dispatches packets to a fixed set of workers.
+// A client always maps to the same worker, so its packets stay in arrival order.
+type workerPool struct {
+	queues []chan packet
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers, queueSize int, handle func(conn *Connection, data []byte)) *workerPool {
+	p := &workerPool{queues: make([]chan packet, workers)}
+	for i := range p.queues {
+		queue := make(chan packet, queueSize)
+		p.queues[i] = queue
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for pkt := range queue {
+				// A client's packets all go through this worker, so from is never shared
+				pkt.conn.from = pkt.from
+				handle(pkt.conn, pkt.data)
+				bufpool.Put(pkt.buf)
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues a packet for its client's worker.
+// It blocks when that worker is full, pushing backpressure onto the read loop.
+// buf, if not nil, is returned to bufpool once the packet is handled.
+func (p *workerPool) dispatch(key string, conn *Connection, from *net.UDPAddr, data []byte, buf *[]byte) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- packet{conn: conn, from: from, data: data, buf: buf}
+}
+
+// close stops all workers and waits for their queues to drain
+func (p *workerPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
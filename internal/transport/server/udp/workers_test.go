@@ -0,0 +1,96 @@
+package udp
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"seras-protocol/internal/bufpool"
+)
+
+// benchClients is how many clients a dispatch benchmark floods from
+const benchClients = 64
+
+// BenchmarkDispatch floods small datagrams from many clients through the
+// worker pool, and through the goroutine per datagram the server started
+// before it for comparison
+func BenchmarkDispatch(b *testing.B) {
+	datagram := make([]byte, 64)
+	conns := make([]*Connection, benchClients)
+	for i := range conns {
+		conns[i] = &Connection{key: fmt.Sprintf("192.0.2.%d:40000", i)}
+	}
+
+	var handled sync.WaitGroup
+	handle := func(conn *Connection, data []byte) {
+		// Stands in for decoding: touch every byte
+		var sum byte
+		for _, c := range data {
+			sum += c
+		}
+		_ = sum
+		handled.Done()
+	}
+
+	b.Run("goroutine", func(b *testing.B) {
+		b.ReportAllocs()
+		handled.Add(b.N)
+		for i := 0; i < b.N; i++ {
+			data := make([]byte, len(datagram))
+			copy(data, datagram)
+			go handle(conns[i%benchClients], data)
+		}
+		handled.Wait()
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool := newWorkerPool(runtime.NumCPU(), DefaultQueueSize, handle)
+		defer pool.close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		handled.Add(b.N)
+		for i := 0; i < b.N; i++ {
+			conn := conns[i%benchClients]
+			pooled := bufpool.Get()
+			data := (*pooled)[:len(datagram)]
+			copy(data, datagram)
+			pool.dispatch(conn.key, conn, nil, data, pooled)
+		}
+		handled.Wait()
+	})
+}
+
+func TestWorkerPoolKeepsClientOrder(t *testing.T) {
+	const perClient = 500
+	conns := make([]*Connection, 8)
+	for i := range conns {
+		conns[i] = &Connection{key: fmt.Sprintf("192.0.2.%d:40000", i)}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[*Connection][]byte)
+	pool := newWorkerPool(4, 2, func(conn *Connection, data []byte) {
+		mu.Lock()
+		seen[conn] = append(seen[conn], data[0])
+		mu.Unlock()
+	})
+	for seq := range perClient {
+		for _, conn := range conns {
+			pool.dispatch(conn.key, conn, nil, []byte{byte(seq)}, nil)
+		}
+	}
+	pool.close()
+
+	for i, conn := range conns {
+		got := seen[conn]
+		if len(got) != perClient {
+			t.Fatalf("client %d: handled %d packets, want %d", i, len(got), perClient)
+		}
+		for seq, b := range got {
+			if b != byte(seq) {
+				t.Fatalf("client %d: packet %d handled in position %d", i, b, seq)
+			}
+		}
+	}
+}
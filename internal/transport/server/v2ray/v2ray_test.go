@@ -0,0 +1,132 @@
+package v2ray
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	client "seras-protocol/internal/transport/client/v2ray"
+	"seras-protocol/internal/transport/v2ray"
+)
+
+var testID = v2ray.UUID{0x9f, 0x1c, 0x2a, 0x64, 0x0b, 0x3e, 0x4d, 0x5f, 0x8a, 0x71, 0x2c, 0x90, 0xde, 0x4b, 0x13, 0x07}
+
+// startEcho runs a server that echoes every message back until the test
+// ends, and returns the share link clients dial it with
+func startEcho(t *testing.T, maxSize int) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := NewServer(addr, testID, func(conn *Connection, data []byte) {
+		conn.Send(data)
+	})
+	s.SetMaxMessageSize(maxSize)
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	select {
+	case <-listening:
+	case err := <-errc:
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Stop(ctx); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+		<-errc
+	})
+	return s, "vless://" + testID.String() + "@" + addr
+}
+
+// clients returns how many connections the server holds
+func (s *Server) clients() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.connections)
+}
+
+func TestRoundTrip(t *testing.T) {
+	s, url := startEcho(t, 0)
+	transport, err := client.NewTransport(&client.Config{Url: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	for _, size := range []int{1, 100, 1400, 65535, 200000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		if err := transport.Send(data); err != nil {
+			t.Fatalf("send %d bytes: %v", size, err)
+		}
+		got, err := transport.Receive()
+		if err != nil {
+			t.Fatalf("receive %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("echo of %d bytes came back as %d", size, len(got))
+		}
+	}
+	if n := s.clients(); n != 1 {
+		t.Fatalf("server holds %d connections, want 1", n)
+	}
+
+	// Disconnecting frees the client's slot
+	transport.Disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server kept the disconnected client")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnknownIDRefused(t *testing.T) {
+	s, url := startEcho(t, 0)
+	other := testID
+	other[0] ^= 0xff
+	url = "vless://" + other.String() + url[len("vless://")+len(testID.String()):]
+
+	if _, err := client.NewTransport(&client.Config{Url: url}); err == nil {
+		t.Fatal("connected with an unknown id")
+	}
+	if n := s.clients(); n != 0 {
+		t.Fatalf("server holds %d connections for an unknown id", n)
+	}
+}
+
+func TestOversizedMessageDisconnects(t *testing.T) {
+	s, url := startEcho(t, 1024)
+	transport, err := client.NewTransport(&client.Config{Url: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Disconnect()
+
+	if err := transport.Send(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	// The client has no limit of its own, so only the server refuses this
+	if err := transport.Send(make([]byte, 1025)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Receive(); err == nil {
+		t.Fatal("received an echo of a message over the limit")
+	}
+	if n := s.clients(); n != 0 {
+		t.Fatalf("server holds %d connections after an oversized message", n)
+	}
+}
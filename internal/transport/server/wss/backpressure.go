@@ -0,0 +1,139 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// SendPolicy decides what Send does when a client's send buffer is full
+type SendPolicy int
+
+const (
+	// SendDrop drops the new message
+	SendDrop SendPolicy = iota
+	// SendBlock waits up to the send timeout for room, then drops
+	SendBlock
+	// SendDropOldest discards the oldest queued message to make room
+	SendDropOldest
+	// SendClose drops, and disconnects a client whose buffer stays full for
+	// the send timeout
+	SendClose
+)
+
+// DefaultSendTimeout bounds blocking sends and sustained overflow
+const DefaultSendTimeout = 100 * time.Millisecond
+
+// sendBufferSize is how many messages are queued per client
+const sendBufferSize = 256
+
+// ErrSendBufferFull is returned when a message is dropped for a full buffer
+var ErrSendBufferFull = errors.New("send buffer full")
+
+// ParseSendPolicy parses "drop", "block", "drop-oldest" or "close"
+func ParseSendPolicy(s string) (SendPolicy, error) {
+	switch s {
+	case "drop":
+		return SendDrop, nil
+	case "block":
+		return SendBlock, nil
+	case "drop-oldest":
+		return SendDropOldest, nil
+	case "close":
+		return SendClose, nil
+	default:
+		return SendDrop, fmt.Errorf("send policy must be drop, block, drop-oldest or close, got: %s", s)
+	}
+}
+
+func (p SendPolicy) String() string {
+	switch p {
+	case SendBlock:
+		return "block"
+	case SendDropOldest:
+		return "drop-oldest"
+	case SendClose:
+		return "close"
+	default:
+		return "drop"
+	}
+}
+
+// SetSendPolicy sets how sends to a client with a full buffer are handled.
+// timeout applies to SendBlock and SendClose (0 = DefaultSendTimeout).
+// Must be called before Start.
+func (s *Server) SetSendPolicy(policy SendPolicy, timeout time.Duration) {
+	s.sendPolicy = policy
+	if timeout > 0 {
+		s.sendTimeout = timeout
+	}
+}
+
+// Dropped returns how many messages to clients were dropped for full buffers
+func (s *Server) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// drop counts a dropped message, logging on powers of two so a slow client
+// doesn't flood the log
+func (s *Server) drop() {
+	if n := s.dropped.Add(1); n&(n-1) == 0 {
+		slog.Warn("Dropping messages to slow WebSocket clients", "dropped", n, "policy", s.sendPolicy)
+	}
+}
+
+// enqueue queues data for writePump according to the server's send policy
+func (c *Connection) enqueue(data []byte) error {
+	select {
+	case c.sendCh <- data:
+		c.overflowSince.Store(0)
+		return nil
+	case <-c.done:
+		return fmt.Errorf("connection closed")
+	default:
+	}
+
+	s := c.server
+	switch s.sendPolicy {
+	case SendBlock:
+		timer := time.NewTimer(s.sendTimeout)
+		defer timer.Stop()
+		select {
+		case c.sendCh <- data:
+			return nil
+		case <-c.done:
+			return fmt.Errorf("connection closed")
+		case <-timer.C:
+		}
+
+	case SendDropOldest:
+		for {
+			// Another sender or writePump may empty the slot first; retry
+			select {
+			case <-c.sendCh:
+				s.drop()
+			default:
+			}
+			select {
+			case c.sendCh <- data:
+				return nil
+			case <-c.done:
+				return fmt.Errorf("connection closed")
+			default:
+			}
+		}
+
+	case SendClose:
+		now := time.Now().UnixNano()
+		c.overflowSince.CompareAndSwap(0, now)
+		if time.Duration(now-c.overflowSince.Load()) >= s.sendTimeout {
+			slog.Warn("Disconnecting WebSocket client with a full send buffer", "after", s.sendTimeout)
+			// Unblocks both pumps so the handler cleans the connection up
+			c.conn.Close()
+		}
+	}
+
+	s.drop()
+	return ErrSendBufferFull
+}
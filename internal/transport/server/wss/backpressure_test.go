@@ -0,0 +1,190 @@
+package wss
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stalledConn returns a connection on a server with the given policy whose
+// writePump never runs, so its two-slot buffer stays full once filled
+func stalledConn(t *testing.T, policy SendPolicy, timeout time.Duration) *Connection {
+	t.Helper()
+	s := NewServer("", nil)
+	s.SetSendPolicy(policy, timeout)
+
+	accepted := make(chan *websocket.Conn, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- ws
+	}))
+	t.Cleanup(hs.Close)
+	dial(t, "ws"+strings.TrimPrefix(hs.URL, "http"))
+	ws := <-accepted
+	t.Cleanup(func() { ws.Close() })
+
+	return &Connection{
+		conn:   ws,
+		server: s,
+		sendCh: make(chan []byte, 2),
+		done:   make(chan struct{}),
+		quit:   make(chan struct{}),
+	}
+}
+
+// socketClosed reports whether c's socket has been closed
+func socketClosed(c *Connection) bool {
+	return errors.Is(c.conn.UnderlyingConn().SetDeadline(time.Time{}), net.ErrClosed)
+}
+
+// queued returns the first byte of each message in c's buffer, emptying it
+func queued(c *Connection) []byte {
+	var ids []byte
+	for {
+		select {
+		case data := <-c.sendCh:
+			ids = append(ids, data[0])
+		default:
+			return ids
+		}
+	}
+}
+
+// fill queues messages 1 and 2
+func fill(t *testing.T, c *Connection) {
+	t.Helper()
+	for id := byte(1); id <= 2; id++ {
+		if err := c.Send([]byte{id}); err != nil {
+			t.Fatalf("message %d: %v", id, err)
+		}
+	}
+}
+
+func TestSendDrop(t *testing.T) {
+	c := stalledConn(t, SendDrop, 0)
+	fill(t, c)
+	if err := c.Send([]byte{3}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if got := queued(c); string(got) != "\x01\x02" {
+		t.Fatalf("queued %v, want [1 2]", got)
+	}
+	if got := c.server.Dropped(); got != 1 {
+		t.Fatalf("counted %d drops, want 1", got)
+	}
+}
+
+func TestSendBlock(t *testing.T) {
+	c := stalledConn(t, SendBlock, 50*time.Millisecond)
+	fill(t, c)
+
+	// Times out while the buffer stays full
+	start := time.Now()
+	if err := c.Send([]byte{3}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("gave up after %v, want the 50ms timeout", waited)
+	}
+
+	// Goes through once the writer frees a slot in time
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c.sendCh
+	}()
+	if err := c.Send([]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(c); string(got) != "\x02\x04" {
+		t.Fatalf("queued %v, want [2 4]", got)
+	}
+	if got := c.server.Dropped(); got != 1 {
+		t.Fatalf("counted %d drops, want 1", got)
+	}
+
+	// A client that goes away doesn't leave the sender waiting
+	fill(t, c)
+	close(c.done)
+	if err := c.Send([]byte{5}); err == nil || errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want connection closed", err)
+	}
+}
+
+func TestSendDropOldest(t *testing.T) {
+	c := stalledConn(t, SendDropOldest, 0)
+	fill(t, c)
+	for id := byte(3); id <= 5; id++ {
+		if err := c.Send([]byte{id}); err != nil {
+			t.Fatalf("message %d: %v", id, err)
+		}
+	}
+	if got := queued(c); string(got) != "\x04\x05" {
+		t.Fatalf("queued %v, want the newest [4 5]", got)
+	}
+	if got := c.server.Dropped(); got != 3 {
+		t.Fatalf("counted %d drops, want 3", got)
+	}
+}
+
+func TestSendClose(t *testing.T) {
+	c := stalledConn(t, SendClose, 50*time.Millisecond)
+	fill(t, c)
+
+	// A brief overflow only drops
+	if err := c.Send([]byte{3}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if socketClosed(c) {
+		t.Fatal("closed after a brief overflow")
+	}
+
+	// Room again resets the clock
+	<-c.sendCh
+	time.Sleep(60 * time.Millisecond)
+	if err := c.Send([]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]byte{5}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if err := c.Send([]byte{6}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if socketClosed(c) {
+		t.Fatal("closed after a fresh overflow")
+	}
+
+	// Sustained overflow disconnects the client
+	time.Sleep(60 * time.Millisecond)
+	if err := c.Send([]byte{7}); !errors.Is(err, ErrSendBufferFull) {
+		t.Fatalf("got %v, want ErrSendBufferFull", err)
+	}
+	if !socketClosed(c) {
+		t.Fatal("client still connected after sustained overflow")
+	}
+	if got := c.server.Dropped(); got != 4 {
+		t.Fatalf("counted %d drops, want 4", got)
+	}
+}
+
+func TestParseSendPolicy(t *testing.T) {
+	for _, p := range []SendPolicy{SendDrop, SendBlock, SendDropOldest, SendClose} {
+		got, err := ParseSendPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParseSendPolicy(%q) = %v, %v", p, got, err)
+		}
+	}
+	if _, err := ParseSendPolicy("wait"); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
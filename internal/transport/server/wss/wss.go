@@ -1,14 +1,30 @@
 package wss
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"seras-protocol/internal/transport/server"
 )
 
+const (
+	DefaultPingInterval = 15 * time.Second
+	DefaultPongTimeout  = 45 * time.Second
+)
+
+// closeTryAgainLater is the registered close code (1013) for a server that is
+// overloaded, which gorilla/websocket doesn't name
+const closeTryAgainLater = 1013
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1500,
 	WriteBufferSize: 1500,
@@ -17,12 +33,25 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+var (
+	_ server.Server     = (*Server)(nil)
+	_ server.Connection = (*Connection)(nil)
+	_ server.Closer     = (*Connection)(nil)
+)
+
 // Connection represents a single WebSocket client connection
 type Connection struct {
-	conn   *websocket.Conn
-	sendCh chan []byte
-	mu     sync.Mutex
-	closed bool
+	conn     *websocket.Conn
+	server   *Server
+	sendCh   chan []byte
+	mu       sync.Mutex
+	closed   bool
+	done     chan struct{} // Closed once the client is gone
+	quit     chan struct{} // Closed to make writePump flush and send a close frame
+	quitOnce sync.Once
+	maxSize  int // Largest message sent (0 = unlimited)
+	// Unix nanoseconds since the send buffer has been full (0 = not full)
+	overflowSince atomic.Int64
 }
 
 // Server is a WebSocket server for node
@@ -32,14 +61,29 @@ type Server struct {
 	mu           sync.RWMutex
 	onMessage    func(conn *Connection, data []byte)
 	onDisconnect func(conn *Connection)
+	onListening  func()
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	maxSize      int // Largest message accepted or sent (0 = unlimited)
+	maxClients   int // Connections served at once (0 = unlimited)
+	rejected     atomic.Uint64
+	httpServer   *http.Server
+	handlers     sync.WaitGroup // Running WebSocket handlers
+	// What Send does when a client's buffer is full, and drops so far
+	sendPolicy  SendPolicy
+	sendTimeout time.Duration
+	dropped     atomic.Uint64
 }
 
 // NewServer creates a new WebSocket server
 func NewServer(addr string, onMessage func(conn *Connection, data []byte)) *Server {
 	return &Server{
-		addr:        addr,
-		connections: make(map[*Connection]bool),
-		onMessage:   onMessage,
+		addr:         addr,
+		connections:  make(map[*Connection]bool),
+		onMessage:    onMessage,
+		pingInterval: DefaultPingInterval,
+		pongTimeout:  DefaultPongTimeout,
+		sendTimeout:  DefaultSendTimeout,
 	}
 }
 
@@ -48,14 +92,130 @@ func (s *Server) SetOnDisconnect(callback func(conn *Connection)) {
 	s.onDisconnect = callback
 }
 
+// SetOnListening sets a callback run once the listener accepts connections
+func (s *Server) SetOnListening(callback func()) {
+	s.onListening = callback
+}
+
+// SetKeepalive sets how often clients are pinged and how long to wait for a pong
+func (s *Server) SetKeepalive(pingInterval, pongTimeout time.Duration) {
+	s.pingInterval = pingInterval
+	s.pongTimeout = pongTimeout
+}
+
+// SetMaxMessageSize bounds WebSocket messages; a client sending a larger one
+// is disconnected before it is buffered, and Send refuses them.
+// Must be called before Start.
+func (s *Server) SetMaxMessageSize(size int) {
+	if size > 0 {
+		s.maxSize = size
+	}
+}
+
+// SetMaxClients caps how many clients are served at once (0 = unlimited).
+// A connection past the cap is closed with a "try again later" close frame.
+// Must be called before Start.
+func (s *Server) SetMaxClients(n int) {
+	s.maxClients = n
+}
+
+// Rejected returns how many connections were refused at the cap
+func (s *Server) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
 // Start starts the WebSocket server
 func (s *Server) Start() error {
-	http.HandleFunc("/ws", s.handleWebSocket)
 	slog.Info("WebSocket server starting", "addr", s.addr)
-	return http.ListenAndServe(s.addr, nil)
+	return s.serve(func(srv *http.Server, ln net.Listener) error {
+		return srv.Serve(ln)
+	})
+}
+
+// StartTLS starts the WebSocket server over TLS (wss://)
+func (s *Server) StartTLS(certFile, keyFile string) error {
+	slog.Info("WebSocket TLS server starting", "addr", s.addr, "cert", certFile)
+	// Load the certificate up front so a bad one fails before we report listening
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.serve(func(srv *http.Server, ln net.Listener) error {
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return srv.ServeTLS(ln, "", "")
+	})
+}
+
+// serve runs the HTTP server until Stop is called
+func (s *Server) serve(run func(srv *http.Server, ln net.Listener) error) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	srv := &http.Server{Addr: s.addr, Handler: mux}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.httpServer = srv
+	s.mu.Unlock()
+
+	if s.onListening != nil {
+		s.onListening()
+	}
+	if err := run(srv, ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Stop stops accepting connections, flushes pending sends and closes every
+// client with a close frame, then waits for their handlers to finish.
+// If ctx expires first the remaining connections are closed immediately.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.RLock()
+	srv := s.httpServer
+	s.mu.RUnlock()
+	if srv == nil {
+		return nil
+	}
+
+	// Upgraded connections are hijacked, so Shutdown only stops the listener
+	err := srv.Shutdown(ctx)
+
+	s.mu.RLock()
+	conns := make([]*Connection, 0, len(s.connections))
+	for conn := range s.connections {
+		conns = append(conns, conn)
+	}
+	s.mu.RUnlock()
+
+	for _, conn := range conns {
+		conn.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, conn := range conns {
+			conn.conn.Close()
+		}
+		return ctx.Err()
+	}
+	return err
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("Failed to upgrade connection", "error", err)
@@ -63,18 +223,36 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn := &Connection{
-		conn:   ws,
-		sendCh: make(chan []byte, 256),
+		conn:    ws,
+		server:  s,
+		sendCh:  make(chan []byte, sendBufferSize),
+		done:    make(chan struct{}),
+		quit:    make(chan struct{}),
+		maxSize: s.maxSize,
+	}
+	if s.maxSize > 0 {
+		ws.SetReadLimit(int64(s.maxSize))
 	}
 
 	s.mu.Lock()
+	if s.maxClients > 0 && len(s.connections) >= s.maxClients {
+		s.mu.Unlock()
+		s.reject(ws)
+		return
+	}
 	s.connections[conn] = true
 	s.mu.Unlock()
 
 	slog.Info("Client connected", "remote", r.RemoteAddr)
 
+	// Drop the client if no pong arrives in time
+	ws.SetReadDeadline(time.Now().Add(s.pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(s.pongTimeout))
+	})
+
 	// Start writer goroutine
-	go conn.writePump()
+	go conn.writePump(s.pingInterval)
 
 	// Read messages in current goroutine
 	conn.readPump(s)
@@ -93,16 +271,31 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	delete(s.connections, conn)
 	s.mu.Unlock()
 
-	close(conn.sendCh)
+	// Stops writePump; sendCh stays open so a racing Send cannot panic
+	close(conn.done)
 	ws.Close()
 	slog.Info("Client disconnected", "remote", r.RemoteAddr)
 }
 
+// reject closes a connection refused at the cap, telling the client why.
+// Rejections are logged on powers of two so a flood doesn't flood the log.
+func (s *Server) reject(ws *websocket.Conn) {
+	if n := s.rejected.Add(1); n&(n-1) == 0 {
+		slog.Warn("Rejecting WebSocket clients over the limit", "rejected", n, "limit", s.maxClients, "remote", ws.RemoteAddr().String())
+	}
+	ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeTryAgainLater, "server full"),
+		time.Now().Add(time.Second))
+	ws.Close()
+}
+
 func (c *Connection) readPump(s *Server) {
 	for {
 		msgType, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				slog.Warn("Dropping client sending oversized message", "limit", s.maxSize)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				slog.Error("Read error", "error", err)
 			}
 			return
@@ -118,20 +311,79 @@ func (c *Connection) readPump(s *Server) {
 	}
 }
 
-func (c *Connection) writePump() {
-	for data := range c.sendCh {
-		c.mu.Lock()
-		err := c.conn.WriteMessage(websocket.BinaryMessage, data)
-		c.mu.Unlock()
-		if err != nil {
-			slog.Error("Write error", "error", err)
+func (c *Connection) writePump(pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-c.sendCh:
+			c.mu.Lock()
+			err := c.conn.WriteMessage(websocket.BinaryMessage, data)
+			c.mu.Unlock()
+			if err != nil {
+				slog.Error("Write error", "error", err)
+				c.abort()
+				return
+			}
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+				slog.Error("Ping error", "error", err)
+				c.abort()
+				return
+			}
+		case <-c.quit:
+			c.flush()
+			// readPump exits once the client answers or the socket closes
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(pingInterval))
+			return
+		}
+	}
+}
+
+// flush writes whatever is still queued in sendCh
+func (c *Connection) flush() {
+	for {
+		select {
+		case data := <-c.sendCh:
+			c.mu.Lock()
+			err := c.conn.WriteMessage(websocket.BinaryMessage, data)
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		default:
 			return
 		}
 	}
 }
 
-// Send sends data to the client
+// abort tears the connection down after a failed write: Send fails from now
+// on, and closing the socket ends readPump, so the handler runs onDisconnect
+// and drops the connection without waiting for a read to fail on its own
+func (c *Connection) abort() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+// shutdown asks writePump to flush pending sends and close the connection
+func (c *Connection) shutdown() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// Send queues data for the client; a full buffer is handled per the
+// server's SendPolicy
 func (c *Connection) Send(data []byte) error {
+	if c.maxSize > 0 && len(data) > c.maxSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(data), c.maxSize)
+	}
+
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -139,20 +391,28 @@ func (c *Connection) Send(data []byte) error {
 	}
 	c.mu.Unlock()
 
-	select {
-	case c.sendCh <- data:
-		return nil
-	default:
-		return fmt.Errorf("send buffer full")
-	}
+	return c.enqueue(data)
 }
 
-// Broadcast sends data to all connected clients
+// Closed reports whether the connection is gone or going: its reader has
+// stopped, or a write failed
+func (c *Connection) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Broadcast sends data to the clients connected when it is called. Sends run
+// outside the lock, since a full buffer can block under SendBlock.
 func (s *Server) Broadcast(data []byte) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-
+	conns := make([]*Connection, 0, len(s.connections))
 	for conn := range s.connections {
+		conns = append(conns, conn)
+	}
+	s.mu.RUnlock()
+
+	for _, conn := range conns {
 		conn.Send(data)
 	}
 }
@@ -0,0 +1,378 @@
+package wss
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// freeAddr returns a loopback address nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startServer starts s and stops it when the test ends. It returns the
+// server's WebSocket URL and a channel that yields what Start returned.
+func startServer(t *testing.T, s *Server) (string, <-chan error) {
+	t.Helper()
+	listening := make(chan struct{})
+	s.SetOnListening(func() { close(listening) })
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Start()
+		close(errc)
+	}()
+
+	select {
+	case <-listening:
+	case err := <-errc:
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Stop(ctx)
+		<-errc
+	})
+	return "ws://" + s.addr + "/ws", errc
+}
+
+// dial connects a client to url
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// clients returns how many connections the server holds
+func (s *Server) clients() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.connections)
+}
+
+func TestStopFlushesAndClosesClients(t *testing.T) {
+	conns := make(chan *Connection, 1)
+	s := NewServer(freeAddr(t), func(conn *Connection, data []byte) { conns <- conn })
+	disconnected := make(chan struct{})
+	s.SetOnDisconnect(func(conn *Connection) { close(disconnected) })
+	url, errc := startServer(t, s)
+
+	ws := dial(t, url)
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+
+	// Sends queued before Stop still reach the client
+	for _, m := range []string{"one", "two"} {
+		if err := conn.Send([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- s.Stop(ctx)
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"one", "two"} {
+		_, data, err := ws.ReadMessage()
+		if err != nil || string(data) != want {
+			t.Fatalf("got %q, %v; want %q", data, err, want)
+		}
+	}
+	// Reading the close frame answers it, which lets the handler finish
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("got %v, want a going-away close frame", err)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Start returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start still running after Stop")
+	}
+	<-disconnected
+	if conn.Send([]byte("late")) == nil {
+		t.Fatal("Send succeeded after Stop")
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("connected after Stop")
+	}
+}
+
+func TestStopClosesUnresponsiveClients(t *testing.T) {
+	s := NewServer(freeAddr(t), nil)
+	url, errc := startServer(t, s)
+
+	// A client that never reads never answers the close frame
+	dial(t, url)
+	for s.clients() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop = %v, want the context's deadline", err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Start returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start still running after Stop")
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	s := NewServer(freeAddr(t), nil)
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop = %v", err)
+	}
+}
+
+func TestOversizedMessageDisconnects(t *testing.T) {
+	conns := make(chan *Connection, 1)
+	s := NewServer(freeAddr(t), func(conn *Connection, data []byte) { conns <- conn })
+	s.SetMaxMessageSize(1024)
+	disconnected := make(chan struct{})
+	s.SetOnDisconnect(func(conn *Connection) { close(disconnected) })
+	url, _ := startServer(t, s)
+
+	ws := dial(t, url)
+	if err := ws.WriteMessage(websocket.BinaryMessage, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+	if err := conn.Send(make([]byte, 1025)); err == nil {
+		t.Fatal("sent a message over the limit")
+	}
+
+	// A frame header claiming 64MB, masked as a client's must be, and none
+	// of the payload: the server has to give up on the header alone
+	header := []byte{0x82, 0x80 | 127}
+	header = binary.BigEndian.AppendUint64(header, 64<<20)
+	header = append(header, 1, 2, 3, 4)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ws.UnderlyingConn().Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("got %v, want a message-too-big close frame", err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client still connected after an oversized frame")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes rejecting the frame", n)
+	}
+	if len(conns) != 0 {
+		t.Fatal("oversized message reached the handler")
+	}
+}
+
+func TestWriteErrorTearsDown(t *testing.T) {
+	conns := make(chan *Connection, 1)
+	s := NewServer(freeAddr(t), func(conn *Connection, data []byte) { conns <- conn })
+	disconnected := make(chan struct{})
+	s.SetOnDisconnect(func(conn *Connection) { close(disconnected) })
+	url, _ := startServer(t, s)
+
+	ws := dial(t, url)
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+
+	// The client keeps reading, so only the server's side of the write fails
+	conn.mu.Lock()
+	conn.conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	conn.mu.Unlock()
+	if err := conn.Send([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("client still connected a second after a failed write")
+	}
+
+	if n := s.clients(); n != 0 {
+		t.Fatalf("server holds %d connections after a failed write", n)
+	}
+	if !conn.Closed() {
+		t.Fatal("connection not reported closed")
+	}
+	if err := conn.Send([]byte("again")); err == nil {
+		t.Fatal("sent on a connection whose write failed")
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("client read a message after the server's write failed")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	conns := make(chan *Connection, 4)
+	s := NewServer(freeAddr(t), func(conn *Connection, data []byte) { conns <- conn })
+	s.SetMaxClients(2)
+	url, _ := startServer(t, s)
+
+	// connect dials a client and waits for the server to serve it
+	connect := func() *websocket.Conn {
+		t.Helper()
+		ws := dial(t, url)
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-conns:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server never handled the client's message")
+		}
+		return ws
+	}
+	first := connect()
+	connect()
+
+	// The third is told to try again later and never registered
+	extra := dial(t, url)
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := extra.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeTryAgainLater {
+		t.Fatalf("got %v, want a try-again-later close frame", err)
+	}
+	if n := s.clients(); n != 2 {
+		t.Fatalf("server holds %d connections, want 2", n)
+	}
+	if n := s.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d, want 1", n)
+	}
+
+	// A client leaving frees its slot
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("server kept the closed client's slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	connect()
+	if n := s.Rejected(); n != 1 {
+		t.Fatalf("Rejected() = %d after a slot freed, want 1", n)
+	}
+}
+
+func TestBroadcastRacesConnections(t *testing.T) {
+	var mu sync.Mutex
+	disconnects := make(map[*Connection]int)
+	s := NewServer(freeAddr(t), nil)
+	s.SetSendPolicy(SendBlock, 10*time.Millisecond)
+	s.SetOnDisconnect(func(conn *Connection) {
+		mu.Lock()
+		disconnects[conn]++
+		mu.Unlock()
+	})
+	url, _ := startServer(t, s)
+
+	// Clients connect, take a message or two and leave, over and over
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ws.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				ws.ReadMessage()
+				ws.Close()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Broadcast([]byte("news"))
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server holds %d connections after every client left", s.clients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(disconnects) == 0 {
+		t.Fatal("no client ever disconnected")
+	}
+	for conn, n := range disconnects {
+		if n != 1 {
+			t.Fatalf("onDisconnect called %d times for one connection", n)
+		}
+		if !conn.Closed() {
+			t.Fatal("disconnected connection not reported closed")
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package v2ray implements the VLESS framing shared by the v2ray client and
+// server transports. A connection opens with a VLESS request header carrying
+// the client's UUID and the destination, the server answers with a VLESS
+// response header, and from then on messages are length-prefixed as by
+// frag.WriteFrame.
+package v2ray
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Scheme is the URL scheme of VLESS share links
+	Scheme = "vless"
+	// version is the only VLESS version defined
+	version = 0
+	// commandTCP asks the server for a stream to the destination
+	commandTCP = 1
+)
+
+// VLESS address types
+const (
+	addrIPv4   = 1
+	addrDomain = 2
+	addrIPv6   = 3
+)
+
+// ErrUnknownID is returned by ReadRequest when the client's UUID isn't the server's
+var ErrUnknownID = errors.New("v2ray: unknown client id")
+
+// UUID identifies a VLESS client
+type UUID [16]byte
+
+// ParseUUID parses the canonical 8-4-4-4-12 hex form
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return id, fmt.Errorf("invalid UUID: %s", s)
+	}
+	if _, err := hex.Decode(id[:], []byte(strings.Join(parts, ""))); err != nil {
+		return id, fmt.Errorf("invalid UUID: %s", s)
+	}
+	return id, nil
+}
+
+func (id UUID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// Endpoint is a parsed VLESS share link, vless://<uuid>@<host>:<port>, with
+// security=tls and sni=<name> as the query options this transport reads
+type Endpoint struct {
+	ID         UUID
+	Addr       string // host:port
+	TLS        bool
+	ServerName string // TLS server name (empty = the host)
+}
+
+// ParseURL parses a VLESS share link
+func ParseURL(raw string) (*Endpoint, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != Scheme || u.User == nil || u.Port() == "" {
+		return nil, fmt.Errorf("must be vless://<uuid>@<host>:<port>, got: %s", raw)
+	}
+	id, err := ParseUUID(u.User.Username())
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &Endpoint{ID: id, Addr: u.Host, ServerName: u.Query().Get("sni")}
+	switch security := u.Query().Get("security"); security {
+	case "", "none":
+	case "tls":
+		ep.TLS = true
+	default:
+		return nil, fmt.Errorf("unsupported security %q (want tls or none)", security)
+	}
+	if ep.ServerName == "" {
+		ep.ServerName = u.Hostname()
+	}
+	return ep, nil
+}
+
+// WriteRequest writes the request header asking for a TCP stream to dest (host:port)
+func WriteRequest(w io.Writer, id UUID, dest string) error {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return fmt.Errorf("invalid destination %q: %w", dest, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid destination port %q", portStr)
+	}
+
+	header := make([]byte, 0, 1+len(id)+1+1+2+1+1+len(host))
+	header = append(header, version)
+	header = append(header, id[:]...)
+	header = append(header, 0) // No addons
+	header = append(header, commandTCP)
+	header = binary.BigEndian.AppendUint16(header, uint16(port))
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is4() {
+		header = append(header, addrIPv4)
+		header = append(header, addr.AsSlice()...)
+	} else if err == nil {
+		header = append(header, addrIPv6)
+		header = append(header, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("destination host too long: %d bytes", len(host))
+		}
+		header = append(header, addrDomain, byte(len(host)))
+		header = append(header, host...)
+	}
+
+	_, err = w.Write(header)
+	return err
+}
+
+// ReadRequest reads a request header, checking it carries id, and returns the
+// requested destination
+func ReadRequest(r io.Reader, id UUID) (string, error) {
+	// Version, UUID and addons length
+	var head [1 + 16 + 1]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", fmt.Errorf("read request: %w", err)
+	}
+	if head[0] != version {
+		return "", fmt.Errorf("unsupported VLESS version %d", head[0])
+	}
+	if UUID(head[1:17]) != id {
+		return "", ErrUnknownID
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(head[17])); err != nil {
+		return "", fmt.Errorf("read request addons: %w", err)
+	}
+
+	// Command, port and address type
+	var cmd [1 + 2 + 1]byte
+	if _, err := io.ReadFull(r, cmd[:]); err != nil {
+		return "", fmt.Errorf("read request: %w", err)
+	}
+	if cmd[0] != commandTCP {
+		return "", fmt.Errorf("unsupported VLESS command %d", cmd[0])
+	}
+	port := binary.BigEndian.Uint16(cmd[1:3])
+
+	var host string
+	switch cmd[3] {
+	case addrIPv4, addrIPv6:
+		size := 4
+		if cmd[3] == addrIPv6 {
+			size = 16
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", fmt.Errorf("read request address: %w", err)
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case addrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", fmt.Errorf("read request address: %w", err)
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", fmt.Errorf("read request address: %w", err)
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported VLESS address type %d", cmd[3])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// WriteResponse writes the response header accepting a request
+func WriteResponse(w io.Writer) error {
+	_, err := w.Write([]byte{version, 0})
+	return err
+}
+
+// ReadResponse reads the response header, skipping any addons
+func ReadResponse(r io.Reader) error {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if head[0] != version {
+		return fmt.Errorf("unsupported VLESS version %d", head[0])
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(head[1])); err != nil {
+		return fmt.Errorf("read response addons: %w", err)
+	}
+	return nil
+}
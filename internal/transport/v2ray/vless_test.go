@@ -0,0 +1,155 @@
+package v2ray
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var testID = UUID{0x9f, 0x1c, 0x2a, 0x64, 0x0b, 0x3e, 0x4d, 0x5f, 0x8a, 0x71, 0x2c, 0x90, 0xde, 0x4b, 0x13, 0x07}
+
+func TestUUIDRoundTrip(t *testing.T) {
+	s := testID.String()
+	if s != "9f1c2a64-0b3e-4d5f-8a71-2c90de4b1307" {
+		t.Fatalf("String() = %s", s)
+	}
+	id, err := ParseUUID(s)
+	if err != nil || id != testID {
+		t.Fatalf("ParseUUID(%s) = %v, %v", s, id, err)
+	}
+	for _, bad := range []string{
+		"",
+		"9f1c2a640b3e4d5f8a712c90de4b1307",
+		"9f1c2a64-0b3e-4d5f-8a71-2c90de4b130",
+		"9f1c2a64-0b3e-4d5f-8a71-2c90de4b130z",
+		"9f1c2a6-40b3e-4d5f-8a71-2c90de4b1307",
+	} {
+		if _, err := ParseUUID(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	id := testID.String()
+	tests := []struct {
+		url  string
+		want Endpoint
+	}{
+		{"vless://" + id + "@node.example:443", Endpoint{testID, "node.example:443", false, "node.example"}},
+		{"vless://" + id + "@node.example:443?security=tls", Endpoint{testID, "node.example:443", true, "node.example"}},
+		{"vless://" + id + "@203.0.113.10:8443?security=tls&sni=cdn.example", Endpoint{testID, "203.0.113.10:8443", true, "cdn.example"}},
+		{"vless://" + id + "@[2001:db8::1]:443?security=none", Endpoint{testID, "[2001:db8::1]:443", false, "2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		ep, err := ParseURL(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if *ep != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.url, *ep, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"vmess://" + id + "@node.example:443",
+		"vless://node.example:443",
+		"vless://" + id + "@node.example",
+		"vless://not-a-uuid@node.example:443",
+		"vless://" + id + "@node.example:443?security=reality",
+	} {
+		if _, err := ParseURL(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, dest := range []string{"203.0.113.10:443", "[2001:db8::1]:8443", "node.example:80"} {
+		var buf bytes.Buffer
+		if err := WriteRequest(&buf, testID, dest); err != nil {
+			t.Fatalf("%s: %v", dest, err)
+		}
+		header := buf.Bytes()
+		got, err := ReadRequest(bytes.NewReader(header), testID)
+		if err != nil {
+			t.Fatalf("%s: %v", dest, err)
+		}
+		if got != dest {
+			t.Errorf("read destination %s, want %s", got, dest)
+		}
+
+		// Every truncation fails rather than returning a destination
+		for i := range len(header) {
+			if _, err := ReadRequest(bytes.NewReader(header[:i]), testID); err == nil {
+				t.Errorf("%s: read a request cut to %d of %d bytes", dest, i, len(header))
+			}
+		}
+	}
+
+	if err := WriteRequest(&bytes.Buffer{}, testID, "no-port"); err == nil {
+		t.Error("wrote a request without a port")
+	}
+}
+
+func TestReadRequestChecksHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRequest(&buf, testID, "203.0.113.10:443"); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	other := testID
+	other[15] ^= 1
+	if _, err := ReadRequest(bytes.NewReader(valid), other); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("got %v, want ErrUnknownID", err)
+	}
+
+	// Offsets past the version, UUID and addons length
+	const cmd, addrType = 18, 21
+	tests := map[string]func(h []byte){
+		"version":      func(h []byte) { h[0] = 1 },
+		"command":      func(h []byte) { h[cmd] = 2 },
+		"address type": func(h []byte) { h[addrType] = 9 },
+	}
+	for name, corrupt := range tests {
+		h := bytes.Clone(valid)
+		corrupt(h)
+		if _, err := ReadRequest(bytes.NewReader(h), testID); err == nil {
+			t.Errorf("accepted a request with a bad %s", name)
+		}
+	}
+
+	// Addons are skipped
+	h := append(bytes.Clone(valid[:17]), 3, 'a', 'b', 'c')
+	h = append(h, valid[18:]...)
+	if dest, err := ReadRequest(bytes.NewReader(h), testID); err != nil || dest != "203.0.113.10:443" {
+		t.Fatalf("with addons: got %s, %v", dest, err)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteResponse(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("rest")
+	if err := ReadResponse(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "rest" {
+		t.Fatalf("response read into the stream: %q left", buf.String())
+	}
+
+	// Addons are skipped, a truncated or unknown response fails
+	withAddons := bytes.NewReader([]byte{0, 2, 'x', 'y', 'z'})
+	if err := ReadResponse(withAddons); err != nil || withAddons.Len() != 1 {
+		t.Fatalf("with addons: %v, %d bytes left", err, withAddons.Len())
+	}
+	for _, bad := range [][]byte{{}, {0}, {0, 2, 'x'}, {1, 0}} {
+		if err := ReadResponse(bytes.NewReader(bad)); err == nil {
+			t.Errorf("read response %x", bad)
+		}
+	}
+}
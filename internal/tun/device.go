@@ -0,0 +1,49 @@
+package tun
+
+// Device is a packet device such as a TUN interface. Consumers take a Device
+// rather than a *TUN so they can run against an in-memory one.
+type Device interface {
+	// Read reads one packet. It must not return an empty one, and once the
+	// device is closed it returns an error wrapping ErrClosed.
+	Read(buf []byte) (int, error)
+	Write(buf []byte) (int, error)
+	Close() error
+	Name() string
+	MTU() int
+}
+
+var _ Device = (*TUN)(nil)
+
+// BatchDevice is a Device that can move several packets per wakeup, as
+// FastTUN does with io_uring
+type BatchDevice interface {
+	Device
+	// ReadBatch blocks until a packet arrives, then returns it along with any
+	// others already read, up to len(bufs). Packet i is bufs[i][:sizes[i]].
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+	// WriteBatch writes every packet, returning how many were written
+	WriteBatch(packets [][]byte) (int, error)
+	// HasIOURing reports whether batches save syscalls; without io_uring the
+	// batch calls move one packet per syscall
+	HasIOURing() bool
+}
+
+// readOne is ReadBatch for devices that read one packet per syscall
+func readOne(d Device, bufs [][]byte, sizes []int) (int, error) {
+	n, err := d.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+// writeEach is WriteBatch for devices that write one packet per syscall
+func writeEach(d Device, packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if _, err := d.Write(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,83 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// EgressInterface returns the interface the node NATs client traffic out of:
+// name when set, after checking it exists, or else the default route's
+func EgressInterface(name string) (string, error) {
+	return host{}.egressInterface(name)
+}
+
+func (h host) egressInterface(name string) (string, error) {
+	if name == "" {
+		return h.defaultRouteInterface()
+	}
+	if _, err := net.InterfaceByName(name); err != nil {
+		return "", fmt.Errorf("egress interface %q: %w", name, err)
+	}
+	return name, nil
+}
+
+// defaultRouteInterface asks the routing table which interface the default
+// route leaves through
+func (h host) defaultRouteInterface() (string, error) {
+	args := []string{"ip", "route", "show", "default"}
+	if goos == "darwin" {
+		args = []string{"route", "-n", "get", "default"}
+	}
+	out, err := h.query(args...)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w (%s)", args, err, string(out))
+	}
+	iface := parseRouteInterface(string(out))
+	if iface == "" {
+		return "", fmt.Errorf("no default route found; set EGRESS_IFACE")
+	}
+	return iface, nil
+}
+
+// parseRouteInterface extracts the interface from `ip route` output
+// ("default via 10.0.0.1 dev eth0 ...") or `route -n get` output
+// ("interface: en0"), taking the first route listed
+func parseRouteInterface(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if (field == "dev" || field == "interface:") && i+1 < len(fields) {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// masqueradeRule returns the iptables POSTROUTING rule NATing subnet out of
+// iface. An empty iface matches any interface, as rules from before the
+// egress interface was configurable did.
+func masqueradeRule(subnet, iface string) []string {
+	rule := []string{"POSTROUTING", "-s", subnet}
+	if iface != "" {
+		rule = append(rule, "-o", iface)
+	}
+	return append(rule, "-j", "MASQUERADE")
+}
+
+// pfNatRules returns the pf ruleset NATing the VPN subnets out of iface;
+// subnet6 is left out when empty
+func pfNatRules(iface, subnet, subnet6 string) string {
+	rules := fmt.Sprintf("nat on %s from %s to any -> (%s)\n", iface, subnet, iface)
+	if subnet6 != "" {
+		rules += fmt.Sprintf("nat on %s inet6 from %s to any -> (%s)\n", iface, subnet6, iface)
+	}
+	return rules
+}
+
+// natArgs returns the argv running cmd ("iptables" or "ip6tables") on the
+// nat table with op ("-A", "-C" or "-D") and rule
+func natArgs(cmd, op string, rule []string) []string {
+	return append([]string{cmd, "-t", "nat", op}, rule...)
+}
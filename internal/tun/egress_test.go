@@ -0,0 +1,133 @@
+package tun
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// nodeHost answers a node setup's lookups: the default route leaves through
+// defaultIface and no NAT rules exist yet
+func nodeHost(defaultIface string) func(cmd Command) ([]byte, error) {
+	route := defaultRouteVia(defaultIface)
+	return func(cmd Command) ([]byte, error) {
+		if out, err := route(cmd); out != nil {
+			return out, err
+		}
+		return missingNATRules(cmd)
+	}
+}
+
+func TestParseRouteInterface(t *testing.T) {
+	tests := map[string]string{
+		"default via 192.0.2.1 dev eth0 proto dhcp metric 100\n":                               "eth0",
+		"default via 192.0.2.1 dev wlan0\ndefault via 198.51.100.1 dev eth1 metric 600\n":      "wlan0",
+		"default dev ppp0 scope link\n":                                                        "ppp0",
+		"   route to: default\ndestination: default\n  gateway: 192.0.2.1\n  interface: en1\n": "en1",
+		"":                        "",
+		"default via 192.0.2.1\n": "",
+	}
+	for out, want := range tests {
+		if got := parseRouteInterface(out); got != want {
+			t.Errorf("parseRouteInterface(%q) = %q, want %q", out, got, want)
+		}
+	}
+}
+
+func TestNATRuleStrings(t *testing.T) {
+	if got, want := strings.Join(natArgs("iptables", "-A", masqueradeRule("10.9.0.0/24", "eth1")), " "),
+		"iptables -t nat -A POSTROUTING -s 10.9.0.0/24 -o eth1 -j MASQUERADE"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Rules from before EGRESS_IFACE match any interface
+	if got, want := strings.Join(masqueradeRule("10.9.0.0/24", ""), " "), "POSTROUTING -s 10.9.0.0/24 -j MASQUERADE"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := pfNatRules("en3", "10.9.0.0/24", ""), "nat on en3 from 10.9.0.0/24 to any -> (en3)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	want := "nat on en3 from 10.9.0.0/24 to any -> (en3)\nnat on en3 inet6 from fd00:9::/64 to any -> (en3)\n"
+	if got := pfNatRules("en3", "10.9.0.0/24", "fd00:9::/64"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNodeNATEgressInterface(t *testing.T) {
+	skipUnlessLinux(t) // The explicit interface is Linux's loopback
+	tests := []struct {
+		name     string
+		explicit string // EGRESS_IFACE
+		want     string
+	}{
+		{"explicit", "lo", "lo"},
+		{"auto-detected", "", "eth7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/linux", func(t *testing.T) {
+			r := newRecorder()
+			r.respond = nodeHost("eth7")
+			tun := newTestTUN(r, 0)
+			tun.isNode, tun.egressIface = true, tt.explicit
+			if err := tun.setupNodeLinux(); err != nil {
+				t.Fatal(err)
+			}
+			rule := "iptables -t nat -A POSTROUTING -s 10.9.0.0/24 -o " + tt.want + " -j MASQUERADE"
+			if !slices.Contains(r.changes(), rule) {
+				t.Fatalf("setup ran %q, want %q", r.changes(), rule)
+			}
+			if tun.egressIface != tt.want {
+				t.Fatalf("recorded egress %q, want %q", tun.egressIface, tt.want)
+			}
+		})
+
+		t.Run(tt.name+"/darwin", func(t *testing.T) {
+			r := newRecorder()
+			r.respond = nodeHost("eth7")
+			tun := newTestTUN(r, 0)
+			tun.isNode, tun.egressIface = true, tt.explicit
+			if err := tun.setupNodeDarwin(); err != nil {
+				t.Fatal(err)
+			}
+			want := "nat on " + tt.want + " from 10.9.0.0/24 to any -> (" + tt.want + ")\n"
+			if got := pfInput(r); got != want {
+				t.Fatalf("loaded pf rules %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEgressInterfaceMustExist(t *testing.T) {
+	r := newRecorder()
+	r.respond = nodeHost("eth7")
+	tun := newTestTUN(r, 0)
+	tun.isNode, tun.egressIface = true, "nosuch0"
+	if err := tun.setupNodeLinux(); err == nil || !strings.Contains(err.Error(), "nosuch0") {
+		t.Fatalf("got %v, want an error naming the missing interface", err)
+	}
+	if slices.ContainsFunc(r.changes(), func(c string) bool { return strings.Contains(c, "MASQUERADE") }) {
+		t.Fatalf("installed NAT for a missing interface: %q", r.changes())
+	}
+
+	// With no default route there is nothing to detect
+	r = newRecorder()
+	r.respond = missingNATRules
+	tun = newTestTUN(r, 0)
+	tun.isNode = true
+	if err := tun.setupNodeLinux(); err == nil || !strings.Contains(err.Error(), "EGRESS_IFACE") {
+		t.Fatalf("got %v, want a hint to set EGRESS_IFACE", err)
+	}
+}
+
+// pfInput returns the ruleset the last pf anchor load fed pfctl
+func pfInput(r *recorder) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rules string
+	for _, cmd := range r.cmds {
+		if len(cmd.Args) > 1 && cmd.Args[0] == "pfctl" && cmd.Args[1] == "-a" && slices.Contains(cmd.Args, "-f") {
+			rules = cmd.Stdin
+		}
+	}
+	return rules
+}
@@ -0,0 +1,75 @@
+package tun
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pfAnchor is the pf anchor holding one node's NAT rules. The stock macOS
+// pf.conf evaluates every anchor under com.apple/, so loading the anchor
+// takes effect without touching the host's main ruleset.
+func pfAnchor(name string) string {
+	return "com.apple/seras." + name
+}
+
+// addNATRule installs an iptables or ip6tables nat rule unless it is already
+// present. Only rules this call added are recorded, so cleanup leaves rules
+// the host had before alone.
+func (t *TUN) addNATRule(cmd string, rule []string) error {
+	if _, err := t.query(natArgs(cmd, "-C", rule)...); err == nil {
+		return nil
+	}
+	if out, err := t.run(natArgs(cmd, "-A", rule)...); err != nil {
+		return fmt.Errorf("%s: %w (%s)", cmd, err, string(out))
+	}
+	t.natRules = append(t.natRules, append([]string{cmd}, rule...))
+	return nil
+}
+
+// loadPfNat replaces the node's pf anchor with rules and makes sure pf is
+// enabled. Enabling takes a reference (pfctl -E) so cleanup can release it
+// without disabling a firewall someone else turned on.
+func (t *TUN) loadPfNat(rules string) error {
+	load := Command{Args: []string{"pfctl", "-a", pfAnchor(t.name), "-f", "-"}, Stdin: rules}
+	if out, err := t.runCommand(load); err != nil {
+		return fmt.Errorf("pfctl load anchor: %w (%s)", err, string(out))
+	}
+	t.pfAnchor = pfAnchor(t.name)
+
+	if t.pfToken != "" {
+		return nil
+	}
+	out, err := t.run("pfctl", "-E")
+	if err != nil {
+		return fmt.Errorf("pfctl enable: %w (%s)", err, string(out))
+	}
+	t.pfToken = parsePfToken(string(out))
+	return nil
+}
+
+// parsePfToken extracts the enable reference from pfctl -E output
+// ("Token : 1234567890")
+func parsePfToken(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if key, value, found := strings.Cut(line, ":"); found && strings.TrimSpace(key) == "Token" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// undoFirewall removes the NAT rules and pf anchor recorded in the state and
+// releases its pf enable reference
+func (st *State) undoFirewall() {
+	for _, rule := range st.NATRules {
+		if len(rule) > 1 {
+			st.run(natArgs(rule[0], "-D", rule[1:])...)
+		}
+	}
+	if st.PfAnchor != "" {
+		st.run("pfctl", "-a", st.PfAnchor, "-F", "all")
+	}
+	if st.PfToken != "" {
+		st.run("pfctl", "-X", st.PfToken)
+	}
+}
@@ -0,0 +1,143 @@
+package tun
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// netfilter models the host's iptables and ip6tables nat tables, answering
+// -C, -A and -D; other commands get the default route via eth0
+type netfilter struct {
+	mu    sync.Mutex
+	rules []string // Program and rule, as "iptables POSTROUTING -s ..."
+}
+
+func (n *netfilter) respond(cmd Command) ([]byte, error) {
+	args := cmd.Args
+	if len(args) < 5 || (args[0] != "iptables" && args[0] != "ip6tables") || args[1] != "-t" || args[2] != "nat" {
+		return defaultRouteVia("eth0")(cmd)
+	}
+	rule := args[0] + " " + strings.Join(args[4:], " ")
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	i := slices.Index(n.rules, rule)
+	switch args[3] {
+	case "-A":
+		n.rules = append(n.rules, rule)
+		return nil, nil
+	case "-C":
+		if i >= 0 {
+			return nil, nil
+		}
+	case "-D":
+		if i >= 0 {
+			n.rules = slices.Delete(n.rules, i, i+1)
+			return nil, nil
+		}
+	}
+	return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), errors.New("exit status 1")
+}
+
+func (n *netfilter) list() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.rules)
+}
+
+// firewallTUN returns a node TUN whose firewall changes go to nf
+func firewallTUN(nf *netfilter) (*TUN, *recorder) {
+	r := newRecorder()
+	r.respond = nf.respond
+	tun := newTestTUN(r, 0)
+	tun.isNode, tun.firewall, tun.egressIface = true, true, "eth0"
+	return tun, r
+}
+
+const (
+	ourRule   = "iptables POSTROUTING -s 10.9.0.0/24 -o eth0 -j MASQUERADE"
+	ourRule6  = "ip6tables POSTROUTING -s fd00:9::/64 -o eth0 -j MASQUERADE"
+	hostRule  = "iptables POSTROUTING -s 192.168.0.0/16 -o eth0 -j MASQUERADE"
+	hostRule6 = "ip6tables POSTROUTING -s fd00:1::/64 -o eth0 -j MASQUERADE"
+)
+
+func TestNodeSetupTwiceAddsRulesOnce(t *testing.T) {
+	skipUnlessLinux(t)
+	nf := &netfilter{}
+	tun, _ := firewallTUN(nf)
+	for range 2 {
+		if err := tun.setupNodeLinux(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tun.SetupNodeIPv6("fd00:9::1", "fd00:9::/64"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := nf.list(), []string{ourRule, ourRule6}; !slices.Equal(got, want) {
+		t.Fatalf("rules after two setups %q, want %q", got, want)
+	}
+	if len(tun.natRules) != 2 {
+		t.Fatalf("recorded %d NAT rules, want 2", len(tun.natRules))
+	}
+}
+
+func TestNodeCleanupKeepsHostRules(t *testing.T) {
+	skipUnlessLinux(t)
+	tests := []struct {
+		name     string
+		existing []string
+	}{
+		{"other rules", []string{hostRule, hostRule6}},
+		// Someone else's identical rule isn't ours to remove
+		{"same rule already present", []string{hostRule, ourRule}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nf := &netfilter{rules: slices.Clone(tt.existing)}
+			tun, _ := firewallTUN(nf)
+			if err := tun.setupNodeLinux(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tun.SetupNodeIPv6("fd00:9::1", "fd00:9::/64"); err != nil {
+				t.Fatal(err)
+			}
+
+			tun.state().undo()
+			if got := nf.list(); !slices.Equal(got, tt.existing) {
+				t.Fatalf("rules after cleanup %q, want the host's %q", got, tt.existing)
+			}
+		})
+	}
+}
+
+func TestPfCleanupKeepsHostFirewall(t *testing.T) {
+	r := newRecorder()
+	r.respond = func(cmd Command) ([]byte, error) {
+		if cmd.String() == "pfctl -E" {
+			return []byte("pf enabled\nToken : 4242\n"), nil
+		}
+		return nil, nil
+	}
+	tun := newTestTUN(r, 0)
+	tun.isNode, tun.firewall = true, true
+
+	// Reloading replaces the anchor and keeps the one enable reference
+	for range 2 {
+		if err := tun.loadPfNat(pfNatRules("en0", tun.subnet, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := slices.Index(r.changes(), "pfctl -E"); n < 0 || slices.Contains(r.changes()[n+1:], "pfctl -E") {
+		t.Fatalf("setup ran %q, want pf enabled once", r.changes())
+	}
+
+	r.cmds = nil
+	tun.state().undoFirewall()
+	want := []string{"pfctl -a com.apple/seras.seras0 -F all", "pfctl -X 4242"}
+	if got := r.changes(); !slices.Equal(got, want) {
+		t.Fatalf("cleanup ran %q, want only %q", got, want)
+	}
+}
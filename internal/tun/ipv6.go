@@ -0,0 +1,152 @@
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SetupIPv6 sends the client's IPv6 traffic through the tunnel with ::/1 and 8000::/1
+// routes, or only the IPv6 allowed IPs in split-tunnel mode.
+// localIP6 may be empty when the node assigns the address at handshake.
+func (t *TUN) SetupIPv6(localIP6 string) error {
+	if localIP6 != "" {
+		args := []string{"ip", "-6", "addr", "add", localIP6 + "/64", "dev", t.name}
+		if goos == "darwin" {
+			args = []string{"ifconfig", t.name, "inet6", localIP6, "prefixlen", "64"}
+		}
+		if err := t.runCmds([][]string{args}); err != nil {
+			return err
+		}
+	}
+
+	if err := t.addTunnelRoutes(true); err != nil {
+		return err
+	}
+
+	t.ipv6 = true
+	t.localIP6 = localIP6
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+	return nil
+}
+
+// SetLocalIP6 replaces the client's TUN IPv6 address (e.g., with one leased by the node)
+func (t *TUN) SetLocalIP6(ip string) error {
+	if ip == t.localIP6 {
+		return nil
+	}
+
+	var cmds [][]string
+	if goos == "darwin" {
+		if t.localIP6 != "" {
+			cmds = append(cmds, []string{"ifconfig", t.name, "inet6", t.localIP6, "delete"})
+		}
+		cmds = append(cmds, []string{"ifconfig", t.name, "inet6", ip, "prefixlen", "64"})
+	} else {
+		if t.localIP6 != "" {
+			cmds = append(cmds, []string{"ip", "-6", "addr", "del", t.localIP6 + "/64", "dev", t.name})
+		}
+		cmds = append(cmds, []string{"ip", "-6", "addr", "add", ip + "/64", "dev", t.name})
+	}
+
+	if err := t.runCmds(cmds); err != nil {
+		return err
+	}
+	t.localIP6 = ip
+	return nil
+}
+
+// SetupNodeIPv6 assigns the node's IPv6 address, routes subnet6 through the
+// TUN and masquerades it with ip6tables (pf on macOS)
+func (t *TUN) SetupNodeIPv6(localIP6, subnet6 string) error {
+	prefix, err := netip.ParsePrefix(subnet6)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 subnet %q: %w", subnet6, err)
+	}
+	bits := strconv.Itoa(prefix.Bits())
+
+	if goos == "darwin" {
+		cmds := [][]string{
+			{"ifconfig", t.name, "inet6", localIP6, "prefixlen", bits},
+			{"route", "add", "-inet6", "-net", subnet6, "-interface", t.name},
+		}
+		if err := t.runCmds(cmds); err != nil {
+			return err
+		}
+		if err := t.setSysctl("net.inet6.ip6.forwarding", "1"); err != nil {
+			return fmt.Errorf("enable ipv6 forwarding: %w", err)
+		}
+		// Loading replaces the anchor, so reload the IPv4 rule alongside
+		if err := t.loadPfNat(pfNatRules(t.egressIface, t.subnet, subnet6)); err != nil {
+			fmt.Printf("Warning: IPv6 NAT setup failed: %v\n", err)
+		}
+	} else {
+		cmds := [][]string{
+			{"ip", "-6", "addr", "add", localIP6 + "/" + bits, "dev", t.name},
+			{"ip", "-6", "route", "add", subnet6, "dev", t.name},
+		}
+		if err := t.runCmds(cmds); err != nil {
+			return err
+		}
+		if err := t.setSysctl("net.ipv6.conf.all.forwarding", "1"); err != nil {
+			return fmt.Errorf("enable ipv6 forwarding: %w", err)
+		}
+		if err := t.addNATRule("ip6tables", masqueradeRule(subnet6, t.egressIface)); err != nil {
+			return fmt.Errorf("setup ipv6 nat: %w", err)
+		}
+	}
+
+	t.ipv6 = true
+	t.localIP6 = localIP6
+	t.subnet6 = subnet6
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+	return nil
+}
+
+// undoIPv6 removes the IPv6 routes and NAT rules recorded in the state
+func (st *State) undoIPv6() {
+	if !st.IPv6 {
+		return
+	}
+	if !st.IsNode {
+		// Client routes are listed in st.Routes; older state files lack them
+		if len(st.Routes) > 0 {
+			return
+		}
+		if goos == "darwin" {
+			st.run("route", "delete", "-inet6", "-net", "::/1")
+			st.run("route", "delete", "-inet6", "-net", "8000::/1")
+		} else {
+			st.run("ip", "-6", "route", "del", "::/1", "dev", st.Name)
+			st.run("ip", "-6", "route", "del", "8000::/1", "dev", st.Name)
+		}
+		return
+	}
+
+	if goos == "linux" {
+		// Newer state lists the NAT rules it added; see undoFirewall
+		if !st.Firewall {
+			st.run(natArgs("ip6tables", "-D", masqueradeRule(st.Subnet6, st.EgressIface))...)
+		}
+		st.run("ip", "-6", "route", "del", st.Subnet6, "dev", st.Name)
+	} else if goos == "darwin" {
+		st.run("route", "delete", "-inet6", "-net", st.Subnet6)
+	}
+}
+
+// runCmds runs commands in order, ignoring "File exists" from repeated setup
+func (h host) runCmds(cmds [][]string) error {
+	for _, args := range cmds {
+		if out, err := h.run(args...); err != nil {
+			if !strings.Contains(string(out), "File exists") {
+				return fmt.Errorf("%v: %w (%s)", args, err, string(out))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// skipUnlessLinux skips tests of commands only Linux runs
+func skipUnlessLinux(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("checks Linux commands")
+	}
+}
+
+// missingNATRules answers iptables rule checks as if the host has no rules
+func missingNATRules(cmd Command) ([]byte, error) {
+	if slices.Contains(cmd.Args, "-C") {
+		return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestTunnelRoutesByFamily(t *testing.T) {
+	tun := newTestTUN(newRecorder(), 0)
+	if got := tun.tunnelRoutes(true); !slices.Equal(got, defaultRoutes6) {
+		t.Fatalf("full-tunnel v6 routes %v, want ::/1 and 8000::/1", got)
+	}
+
+	tun.allowedIPs = []netip.Prefix{
+		netip.MustParsePrefix("10.20.0.0/16"),
+		netip.MustParsePrefix("fd00:20::/48"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if got := tun.tunnelRoutes(true); len(got) != 2 || got[0].String() != "fd00:20::/48" || got[1].String() != "2001:db8::/32" {
+		t.Fatalf("split-tunnel v6 routes %v, want only the v6 allowed IPs", got)
+	}
+	if got := tun.tunnelRoutes(false); len(got) != 1 || got[0].String() != "10.20.0.0/16" {
+		t.Fatalf("split-tunnel v4 routes %v, want only the v4 allowed IP", got)
+	}
+}
+
+func TestSetupIPv6(t *testing.T) {
+	skipUnlessLinux(t)
+	r := newRecorder()
+	tun := newTestTUN(r, 0)
+
+	if err := tun.SetupIPv6("fd00:9::2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip -6 addr add fd00:9::2/64 dev seras0",
+		"ip -6 route add ::/1 dev seras0",
+		"ip -6 route add 8000::/1 dev seras0",
+	}
+	if got := r.changes(); !slices.Equal(got, want) {
+		t.Fatalf("SetupIPv6 ran %q\nwant %q", got, want)
+	}
+	if !slices.Equal(tun.routes, defaultRoutes6) {
+		t.Fatalf("recorded routes %v, want the ones added", tun.routes)
+	}
+
+	// A lease from the node replaces the configured address
+	if err := tun.SetLocalIP6("fd00:9::7"); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "ip -6 addr del fd00:9::2/64 dev seras0", "ip -6 addr add fd00:9::7/64 dev seras0")
+	if got := r.changes(); !slices.Equal(got, want) {
+		t.Fatalf("SetLocalIP6 ran %q\nwant %q", got[3:], want[3:])
+	}
+}
+
+func TestSetupNodeIPv6(t *testing.T) {
+	skipUnlessLinux(t)
+	r := newRecorder()
+	r.respond = missingNATRules
+	tun := newTestTUN(r, 0)
+	tun.isNode = true
+	tun.egressIface = "eth0"
+
+	if err := tun.SetupNodeIPv6("fd00:9::1", "fd00:9::/64"); err != nil {
+		t.Fatal(err)
+	}
+	got := r.changes()
+	for _, want := range []string{
+		"ip -6 addr add fd00:9::1/64 dev seras0",
+		"ip -6 route add fd00:9::/64 dev seras0",
+		"sysctl -w net.ipv6.conf.all.forwarding=1",
+		"ip6tables -t nat -A POSTROUTING -s fd00:9::/64 -o eth0 -j MASQUERADE",
+	} {
+		if !slices.Contains(got, want) {
+			t.Errorf("SetupNodeIPv6 ran %q, missing %q", got, want)
+		}
+	}
+
+	if len(tun.natRules) != 1 || tun.natRules[0][0] != "ip6tables" {
+		t.Errorf("recorded NAT rules %q, want the ip6tables one", tun.natRules)
+	}
+
+	if err := tun.SetupNodeIPv6("fd00:9::1", "fd00:9::/129"); err == nil {
+		t.Error("accepted an invalid subnet")
+	}
+}
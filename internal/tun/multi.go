@@ -0,0 +1,74 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrBadPacketLength is returned when a multi-packet buffer holds a packet
+// whose length field doesn't fit the bytes left
+var ErrBadPacketLength = errors.New("tun: bad packet length")
+
+// MultiPacketDevice is a Device that may pack several IP packets into one
+// buffer, as interfaces with segmentation offload do. Reads can return
+// back-to-back packets, and writes can carry them.
+type MultiPacketDevice interface {
+	Device
+	// MultiPacket reports whether the device currently packs packets; when
+	// false, reads and writes hold exactly one
+	MultiPacket() bool
+}
+
+// SplitPackets appends each IP packet in buf to packets, walking the IPv4
+// total length and IPv6 payload length fields. The packets alias buf.
+func SplitPackets(buf []byte, packets [][]byte) ([][]byte, error) {
+	for len(buf) > 0 {
+		n, err := packetLength(buf)
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, buf[:n])
+		buf = buf[n:]
+	}
+	return packets, nil
+}
+
+// packetLength returns the length of the IP packet at the start of buf
+func packetLength(buf []byte) (int, error) {
+	var n int
+	switch buf[0] >> 4 {
+	case 4:
+		if len(buf) < 20 {
+			return 0, fmt.Errorf("%w: %d-byte IPv4 header", ErrBadPacketLength, len(buf))
+		}
+		n = int(binary.BigEndian.Uint16(buf[2:4]))
+		if n < 20 {
+			return 0, fmt.Errorf("%w: IPv4 total length %d", ErrBadPacketLength, n)
+		}
+	case 6:
+		if len(buf) < 40 {
+			return 0, fmt.Errorf("%w: %d-byte IPv6 header", ErrBadPacketLength, len(buf))
+		}
+		n = 40 + int(binary.BigEndian.Uint16(buf[4:6]))
+	default:
+		return 0, fmt.Errorf("%w: IP version %d", ErrBadPacketLength, buf[0]>>4)
+	}
+	if n > len(buf) {
+		return 0, fmt.Errorf("%w: %d bytes, %d left", ErrBadPacketLength, n, len(buf))
+	}
+	return n, nil
+}
+
+// CoalescePackets appends packets to dst back to back while they fit in
+// limit bytes, returning the result and how many packets it holds. At least
+// one packet is always taken.
+func CoalescePackets(dst []byte, packets [][]byte, limit int) ([]byte, int) {
+	for i, packet := range packets {
+		if i > 0 && len(dst)+len(packet) > limit {
+			return dst, i
+		}
+		dst = append(dst, packet...)
+	}
+	return dst, len(packets)
+}
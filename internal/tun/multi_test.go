@@ -0,0 +1,120 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// ipv4Packet returns an IPv4 packet of size bytes whose payload is filled
+// with tag
+func ipv4Packet(size int, tag byte) []byte {
+	packet := bytes.Repeat([]byte{tag}, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(size))
+	return packet
+}
+
+// ipv6Packet returns an IPv6 packet with a payload of payload bytes
+func ipv6Packet(payload int, tag byte) []byte {
+	packet := bytes.Repeat([]byte{tag}, 40+payload)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(payload))
+	return packet
+}
+
+func TestSplitThreePackets(t *testing.T) {
+	want := [][]byte{ipv4Packet(60, 1), ipv4Packet(20, 2), ipv4Packet(1500, 3)}
+	buf := bytes.Join(want, nil)
+
+	got, err := SplitPackets(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("split into %d packets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d: got %d bytes tagged %d, want %d tagged %d",
+				i, len(got[i]), got[i][len(got[i])-1], len(want[i]), want[i][len(want[i])-1])
+		}
+	}
+
+	// Appends to what is passed in
+	if got, _ = SplitPackets(buf, [][]byte{{0}}); len(got) != 4 {
+		t.Fatalf("appended %d packets to one, want 4", len(got))
+	}
+}
+
+func TestSplitMixedFamilies(t *testing.T) {
+	want := [][]byte{ipv6Packet(8, 1), ipv4Packet(28, 2), ipv6Packet(0, 3)}
+	got, err := SplitPackets(bytes.Join(want, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("split into %d packets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d: got %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSplitRejectsBadLengths(t *testing.T) {
+	good := ipv4Packet(40, 1)
+	short := ipv4Packet(40, 2)
+	binary.BigEndian.PutUint16(short[2:], 19)
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"length past the end", ipv4Packet(40, 2)[:30]},
+		{"length under the header", short},
+		{"truncated IPv4 header", good[:12]},
+		{"truncated IPv6 header", ipv6Packet(0, 2)[:39]},
+		{"IPv6 payload past the end", ipv6Packet(100, 2)[:60]},
+		{"unknown version", []byte{0x50, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		packets, err := SplitPackets(append(append([]byte(nil), good...), tt.tail...), nil)
+		if !errors.Is(err, ErrBadPacketLength) {
+			t.Errorf("%s: got %v, want ErrBadPacketLength", tt.name, err)
+		}
+		// The packets before the bad one are kept
+		if len(packets) != 1 || !bytes.Equal(packets[0], good) {
+			t.Errorf("%s: kept %d packets, want the good one", tt.name, len(packets))
+		}
+	}
+}
+
+func TestCoalescePackets(t *testing.T) {
+	packets := [][]byte{ipv4Packet(100, 1), ipv4Packet(100, 2), ipv4Packet(100, 3)}
+
+	buf, n := CoalescePackets(nil, packets, 250)
+	if n != 2 || !bytes.Equal(buf, bytes.Join(packets[:2], nil)) {
+		t.Fatalf("took %d packets in %d bytes, want the first 2", n, len(buf))
+	}
+	buf, n = CoalescePackets(buf[:0], packets, 300)
+	if n != 3 || len(buf) != 300 {
+		t.Fatalf("took %d packets in %d bytes, want all 3", n, len(buf))
+	}
+	// One packet is taken even over the limit
+	if _, n = CoalescePackets(nil, packets, 50); n != 1 {
+		t.Fatalf("took %d packets over the limit, want 1", n)
+	}
+
+	// What is coalesced splits back into the same packets
+	split, err := SplitPackets(buf, nil)
+	if err != nil || len(split) != 3 {
+		t.Fatalf("split coalesced buffer into %d packets: %v", len(split), err)
+	}
+	for i := range packets {
+		if !bytes.Equal(split[i], packets[i]) {
+			t.Fatalf("packet %d changed across coalesce and split", i)
+		}
+	}
+}
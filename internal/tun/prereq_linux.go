@@ -0,0 +1,94 @@
+//go:build linux
+
+package tun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Character device numbers of /dev/net/tun
+const (
+	tunMajor = 10
+	tunMinor = 200
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in a capability mask
+const capNetAdmin = 12
+
+// Paths checked for the node's prerequisites, replaceable for tests
+var (
+	tunDevicePath  = "/dev/net/tun"
+	procStatusPath = "/proc/self/status"
+)
+
+// mknod creates device nodes, replaceable for tests
+var mknod = syscall.Mknod
+
+// checkPrerequisites makes sure a TUN can be created: the clone device must
+// exist (it is created when missing and we may) and the process must hold
+// NET_ADMIN. Containers commonly lack both.
+func checkPrerequisites() error {
+	if _, err := os.Stat(tunDevicePath); errors.Is(err, fs.ErrNotExist) {
+		if err := makeTUNDevice(tunDevicePath); err != nil {
+			return fmt.Errorf("%w: %s is missing and could not be created: %v", ErrTUNUnavailable, tunDevicePath, err)
+		}
+		fmt.Printf("Created missing TUN device %s\n", tunDevicePath)
+	}
+
+	hasCap, err := hasNetAdmin(procStatusPath)
+	if err != nil {
+		// Can't tell; let device creation report what goes wrong
+		return nil
+	}
+	if !hasCap {
+		return fmt.Errorf("%w: process lacks the NET_ADMIN capability", ErrTUNUnavailable)
+	}
+	return nil
+}
+
+// makeTUNDevice creates the TUN clone device node at path
+func makeTUNDevice(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	dev := tunMajor<<8 | tunMinor
+	if err := mknod(path, syscall.S_IFCHR|0666, dev); err != nil {
+		return fmt.Errorf("mknod: %w", err)
+	}
+	return nil
+}
+
+// hasNetAdmin reports whether the effective capabilities listed in a
+// /proc/<pid>/status file include CAP_NET_ADMIN
+func hasNetAdmin(statusPath string) (bool, error) {
+	f, err := os.Open(statusPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("parse CapEff: %w", err)
+		}
+		return caps&(1<<capNetAdmin) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("no CapEff in %s", statusPath)
+}
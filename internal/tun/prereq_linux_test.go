@@ -0,0 +1,123 @@
+//go:build linux
+
+package tun
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// stubPrerequisites points the checks at tunPath and a status file holding
+// CapEff capEff (none when empty), restoring the real paths after the test
+func stubPrerequisites(t *testing.T, tunPath, capEff string) {
+	t.Helper()
+	dir := t.TempDir()
+	status := filepath.Join(dir, "status")
+	content := "Name:\tnode\n"
+	if capEff != "" {
+		content += "CapEff:\t" + capEff + "\n"
+	}
+	if err := os.WriteFile(status, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldTUN, oldStatus := tunDevicePath, procStatusPath
+	tunDevicePath, procStatusPath = tunPath, status
+	t.Cleanup(func() { tunDevicePath, procStatusPath = oldTUN, oldStatus })
+}
+
+// presentDevice returns a file standing in for an existing /dev/net/tun
+func presentDevice(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tun")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// stubMknod makes creating a device node run create instead
+func stubMknod(t *testing.T, create func(path string) error) {
+	t.Helper()
+	old := mknod
+	mknod = func(path string, mode uint32, dev int) error {
+		if mode&syscall.S_IFCHR == 0 || dev != tunMajor<<8|tunMinor {
+			t.Errorf("mknod %s with mode %o, device %#x", path, mode, dev)
+		}
+		return create(path)
+	}
+	t.Cleanup(func() { mknod = old })
+}
+
+func TestPrerequisitesDeviceMissing(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "net", "tun")
+	stubPrerequisites(t, missing, "0000003fffffffff")
+	stubMknod(t, func(string) error { return syscall.EPERM })
+
+	err := checkPrerequisites()
+	if !errors.Is(err, ErrTUNUnavailable) {
+		t.Fatalf("got %v, want ErrTUNUnavailable", err)
+	}
+	for _, want := range []string{missing, "--cap-add=NET_ADMIN", "--device /dev/net/tun"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestPrerequisitesCreatesMissingDevice(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "net", "tun")
+	stubPrerequisites(t, missing, "0000003fffffffff")
+	stubMknod(t, func(path string) error { return os.WriteFile(path, nil, 0666) })
+
+	if err := checkPrerequisites(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); err != nil {
+		t.Fatalf("device not created: %v", err)
+	}
+}
+
+func TestPrerequisitesNetAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		capEff string
+		ok     bool
+	}{
+		{"full capabilities", "000001ffffffffff", true},
+		{"NET_ADMIN only", "0000000000001000", true},
+		{"default container set", "00000000a80425fb", false},
+		{"none", "0000000000000000", false},
+		{"unreadable status", "", true}, // Left for device creation to report
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubPrerequisites(t, presentDevice(t), tt.capEff)
+			err := checkPrerequisites()
+			if tt.ok && err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+			if !tt.ok && (!errors.Is(err, ErrTUNUnavailable) || !strings.Contains(err.Error(), "NET_ADMIN capability")) {
+				t.Fatalf("got %v, want ErrTUNUnavailable for NET_ADMIN", err)
+			}
+		})
+	}
+}
+
+func TestHasNetAdminParseErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "status")
+	if err := os.WriteFile(bad, []byte("CapEff:\tnot-hex\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hasNetAdmin(bad); err == nil {
+		t.Fatal("parsed a malformed CapEff")
+	}
+	if _, err := hasNetAdmin(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("read a missing status file")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tun
+
+// checkPrerequisites has nothing to check off Linux, where TUN devices
+// come from the OS's own driver
+func checkPrerequisites() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// read is one result a scriptedDev returns
+type read struct {
+	n   int
+	err error
+}
+
+// scriptedDev returns its reads in turn, then repeats the last one
+type scriptedDev struct {
+	mu    sync.Mutex
+	reads []read
+	calls int
+}
+
+func (d *scriptedDev) Read(buf []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.reads[min(d.calls, len(d.reads)-1)]
+	d.calls++
+	return r.n, r.err
+}
+
+func (d *scriptedDev) Write(buf []byte) (int, error) { return len(buf), nil }
+func (d *scriptedDev) Close() error                  { return nil }
+
+func (d *scriptedDev) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+// scriptedTUN returns a TUN reading from dev
+func scriptedTUN(dev *scriptedDev) *TUN {
+	return &TUN{dev: &water.Interface{ReadWriteCloser: dev}, name: "seras0", mtu: DefaultMTU}
+}
+
+// zeros returns n empty reads followed by last
+func zeros(n int, last read) []read {
+	reads := make([]read, n, n+1)
+	return append(reads, last)
+}
+
+func TestReadSkipsEmptyReads(t *testing.T) {
+	transient := errors.New("resource temporarily unavailable")
+	tests := []struct {
+		name      string
+		reads     []read
+		wantN     int
+		wantErr   error
+		wantClose bool
+	}{
+		{"packet after empty reads", zeros(3, read{n: 60}), 60, nil, false},
+		{"EOF after empty reads", zeros(3, read{err: io.EOF}), 0, nil, true},
+		{"closed file", zeros(1, read{err: os.ErrClosed}), 0, nil, true},
+		{"transient error", []read{{err: transient}}, 0, transient, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &scriptedDev{reads: tt.reads}
+			start := time.Now()
+			n, err := scriptedTUN(dev).Read(make([]byte, DefaultMTU))
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("Read took %v", elapsed)
+			}
+			if n != tt.wantN {
+				t.Fatalf("read %d bytes, want %d", n, tt.wantN)
+			}
+			if errors.Is(err, ErrClosed) != tt.wantClose {
+				t.Fatalf("got %v, want ErrClosed %v", err, tt.wantClose)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if dev.count() != len(tt.reads) {
+				t.Fatalf("read the device %d times, want %d", dev.count(), len(tt.reads))
+			}
+		})
+	}
+}
+
+func TestReadBacksOffAndStopsOnClose(t *testing.T) {
+	// A wedged device that only ever reads nothing
+	dev := &scriptedDev{reads: []read{{}}}
+	tun := scriptedTUN(dev)
+	done := make(chan error, 1)
+	go func() {
+		_, err := tun.Read(make([]byte, DefaultMTU))
+		done <- err
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	// 1+2+4+...+64ms, then 100ms apiece: about ten reads, not a spin
+	if calls := dev.count(); calls > 20 {
+		t.Fatalf("%d reads in 300ms", calls)
+	}
+
+	tun.closed.Store(true)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still looping after Close")
+	}
+}
@@ -0,0 +1,125 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Full-tunnel routes; two halves outrank the default route without replacing it
+var (
+	defaultRoutes  = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1")}
+	defaultRoutes6 = []netip.Prefix{netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1")}
+)
+
+// tunnelRoutes returns the client routes to send through the TUN for one
+// address family: the allowed IPs if any were configured, else the full-tunnel pair
+func (t *TUN) tunnelRoutes(ipv6 bool) []netip.Prefix {
+	if len(t.allowedIPs) == 0 {
+		if ipv6 {
+			return defaultRoutes6
+		}
+		return defaultRoutes
+	}
+
+	var routes []netip.Prefix
+	for _, p := range t.allowedIPs {
+		if p.Addr().Is6() == ipv6 {
+			routes = append(routes, p)
+		}
+	}
+	return routes
+}
+
+// routeCmd builds the command adding (or deleting) a client route through the TUN
+func routeCmd(add bool, prefix netip.Prefix, name, peerIP string) []string {
+	if goos == "darwin" {
+		op := "delete"
+		if add {
+			op = "add"
+		}
+		if prefix.Addr().Is6() {
+			return []string{"route", op, "-inet6", "-net", prefix.String(), "-interface", name}
+		}
+		if !add {
+			return []string{"route", op, "-net", prefix.String()}
+		}
+		return []string{"route", op, "-net", prefix.String(), peerIP}
+	}
+
+	op := "del"
+	if add {
+		op = "add"
+	}
+	if prefix.Addr().Is6() {
+		return []string{"ip", "-6", "route", op, prefix.String(), "dev", name}
+	}
+	return []string{"ip", "route", op, prefix.String(), "dev", name}
+}
+
+// collapsePrefixes masks host bits, drops duplicates and prefixes covered by
+// a broader one, and splits a default route into the full-tunnel pair so it
+// does not collide with the host's own default route
+func collapsePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var expanded []netip.Prefix
+	for _, p := range prefixes {
+		p = p.Masked()
+		switch {
+		case p.Bits() == 0 && p.Addr().Is4():
+			expanded = append(expanded, defaultRoutes...)
+		case p.Bits() == 0:
+			expanded = append(expanded, defaultRoutes6...)
+		default:
+			expanded = append(expanded, p)
+		}
+	}
+
+	// Broadest first, so anything a kept prefix covers comes after it
+	slices.SortFunc(expanded, func(a, b netip.Prefix) int {
+		if a.Bits() != b.Bits() {
+			return a.Bits() - b.Bits()
+		}
+		return a.Addr().Compare(b.Addr())
+	})
+
+	var kept []netip.Prefix
+	for _, p := range expanded {
+		covered := slices.ContainsFunc(kept, func(k netip.Prefix) bool {
+			return k.Contains(p.Addr())
+		})
+		if !covered {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// LANPrefix returns the subnet of the local interface the gateway is reached on
+func LANPrefix(gateway string) (netip.Prefix, error) {
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid gateway %q: %w", gateway, err)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("list interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		bits, _ := ipNet.Mask.Size()
+		prefix := netip.PrefixFrom(ip.Unmap(), bits).Masked()
+		if prefix.Contains(gw) {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("no local interface on the gateway %s subnet", gateway)
+}
@@ -0,0 +1,278 @@
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// prefixes parses a comma-separated CIDR list
+func prefixes(t *testing.T, list string) []netip.Prefix {
+	t.Helper()
+	var ps []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		if s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// routeChanges returns the route commands in changes, leaving out the node's
+// host route that every client setup adds
+func routeChanges(changes []string) []string {
+	var routes []string
+	for _, c := range changes {
+		if strings.Contains(c, " route ") && !strings.Contains(c, "203.0.113.10") {
+			routes = append(routes, c)
+		}
+	}
+	return routes
+}
+
+func TestCollapsePrefixes(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/16,10.1.0.0/16", "10.1.0.0/16"},
+		{"10.1.0.0/16,10.0.0.0/8,192.168.1.0/24", "10.0.0.0/8,192.168.1.0/24"},
+		{"192.168.1.0/24,172.16.0.0/12,192.168.1.128/25", "172.16.0.0/12,192.168.1.0/24"},
+		{"0.0.0.0/0,10.0.0.0/8", "0.0.0.0/1,128.0.0.0/1"},
+		{"fd00::/8,fd00:1::/32,10.0.0.0/8", "10.0.0.0/8,fd00::/8"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := collapsePrefixes(prefixes(t, tt.in))
+		if want := prefixes(t, tt.want); !slices.Equal(got, want) {
+			t.Errorf("collapsePrefixes(%s) = %v, want %v", tt.in, got, want)
+		}
+	}
+}
+
+func TestSplitTunnelRouteCommands(t *testing.T) {
+	skipUnlessLinux(t)
+	tests := []struct {
+		name    string
+		allowed string
+		want    []string
+	}{
+		{"full tunnel", "", []string{
+			"ip route add 0.0.0.0/1 dev seras0",
+			"ip route add 128.0.0.0/1 dev seras0",
+		}},
+		{"one subnet", "10.0.0.0/8", []string{
+			"ip route add 10.0.0.0/8 dev seras0",
+		}},
+		{"overlapping and duplicate", "10.20.0.0/16,10.0.0.0/8,192.168.5.0/24,192.168.5.9/24", []string{
+			"ip route add 10.0.0.0/8 dev seras0",
+			"ip route add 192.168.5.0/24 dev seras0",
+		}},
+		{"IPv6 left for SetupIPv6", "172.16.0.0/12,fd00::/8", []string{
+			"ip route add 172.16.0.0/12 dev seras0",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder()
+			tun := newTestTUN(r, 0)
+			tun.allowedIPs = collapsePrefixes(prefixes(t, tt.allowed))
+			if err := tun.setupClient(tun.gateway, tun.nodeIP); err != nil {
+				t.Fatal(err)
+			}
+			if got := routeChanges(r.changes()); !slices.Equal(got, tt.want) {
+				t.Fatalf("setup ran %q\nwant %q", got, tt.want)
+			}
+
+			// Close removes exactly what setup added
+			r.cmds = nil
+			tun.state().undo()
+			var want []string
+			for _, add := range tt.want {
+				want = append(want, strings.Replace(add, " add ", " del ", 1))
+			}
+			if got := routeChanges(r.changes()); !slices.Equal(got, want) {
+				t.Fatalf("undo ran %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUndoKeepsPreexistingTunnelRoute(t *testing.T) {
+	skipUnlessLinux(t)
+	r := newRecorder()
+	r.respond = func(cmd Command) ([]byte, error) {
+		if cmd.String() == "ip -4 route show exact 10.0.0.0/8" {
+			return []byte("10.0.0.0/8 dev wg0 scope link\n"), nil
+		}
+		return nil, nil
+	}
+	tun := newTestTUN(r, 0)
+	tun.allowedIPs = prefixes(t, "10.0.0.0/8,192.168.5.0/24")
+	if err := tun.setupClient(tun.gateway, tun.nodeIP); err != nil {
+		t.Fatal(err)
+	}
+
+	r.cmds = nil
+	tun.state().undo()
+	if got, want := routeChanges(r.changes()), []string{"ip route del 192.168.5.0/24 dev seras0"}; !slices.Equal(got, want) {
+		t.Fatalf("undo ran %q\nwant %q", got, want)
+	}
+}
+
+// route is an installed route as the tests model the routing table
+type route struct {
+	prefix netip.Prefix
+	via    string // Gateway, or the device for routes through the tunnel
+}
+
+// installedRoutes rebuilds the IPv4 routing table from the route commands
+// in changes, starting from the host's default route
+func installedRoutes(t *testing.T, changes []string) []route {
+	t.Helper()
+	table := []route{{netip.MustParsePrefix("0.0.0.0/0"), "192.0.2.1"}}
+	for _, c := range changes {
+		f := strings.Fields(c)
+		if len(f) < 6 || f[0] != "ip" || f[1] != "route" || f[2] != "add" {
+			continue
+		}
+		p, err := netip.ParsePrefix(f[3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		table = append(table, route{p, f[5]})
+	}
+	return table
+}
+
+// lookup picks the route for addr the way the kernel does, longest prefix first
+func lookup(table []route, addr string) string {
+	a := netip.MustParseAddr(addr)
+	best := route{prefix: netip.PrefixFrom(a, 0), via: "none"}
+	found := false
+	for _, r := range table {
+		if r.prefix.Contains(a) && (!found || r.prefix.Bits() > best.prefix.Bits()) {
+			best, found = r, true
+		}
+	}
+	return best.via
+}
+
+func TestExcludeRoutesTakePrecedence(t *testing.T) {
+	skipUnlessLinux(t)
+	tests := []struct {
+		name    string
+		allowed string
+		exclude string
+		via     map[string]string // Address to where its traffic goes
+	}{
+		{"full tunnel", "", "192.168.1.0/24,10.0.0.0/8", map[string]string{
+			"192.168.1.20": "192.0.2.1",
+			"10.200.0.1":   "192.0.2.1",
+			"192.168.2.20": "seras0",
+			"8.8.8.8":      "seras0",
+			"203.0.113.10": "192.0.2.1", // The node itself
+		}},
+		{"exclusion inside an allowed subnet", "10.0.0.0/8", "10.5.0.0/16", map[string]string{
+			"10.5.1.1": "192.0.2.1",
+			"10.6.1.1": "seras0",
+			"8.8.8.8":  "192.0.2.1",
+		}},
+		// A narrower tunnel route still wins where it overlaps; setup warns about it
+		{"allowed subnet inside an exclusion", "10.5.1.0/24", "10.5.0.0/16", map[string]string{
+			"10.5.1.1": "seras0",
+			"10.5.2.1": "192.0.2.1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder()
+			tun := newTestTUN(r, 0)
+			tun.allowedIPs = collapsePrefixes(prefixes(t, tt.allowed))
+			if err := tun.setupClient(tun.gateway, tun.nodeIP); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range prefixes(t, tt.exclude) {
+				if err := tun.AddExcludeRoute(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			table := installedRoutes(t, r.changes())
+			for addr, want := range tt.via {
+				if got := lookup(table, addr); got != want {
+					t.Errorf("%s goes via %s, want %s", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExcludeRouteCleanup(t *testing.T) {
+	skipUnlessLinux(t)
+	r := newRecorder()
+	r.respond = func(cmd Command) ([]byte, error) {
+		// The directly connected LAN already has a route
+		if cmd.String() == "ip route add 192.168.1.0/24 via 192.0.2.1" {
+			return []byte("RTNETLINK answers: File exists"), errors.New("exit status 2")
+		}
+		return nil, nil
+	}
+	tun := newTestTUN(r, 0)
+	if err := tun.setupClient(tun.gateway, tun.nodeIP); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range prefixes(t, "10.1.2.3/16,192.168.1.0/24,172.16.0.0/12") {
+		if err := tun.AddExcludeRoute(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tun.AddExcludeRoute(netip.MustParsePrefix("fd00::/8")); err == nil {
+		t.Fatal("excluded an IPv6 prefix")
+	}
+	if want := prefixes(t, "10.1.0.0/16,172.16.0.0/12"); !slices.Equal(tun.excludeRoutes, want) {
+		t.Fatalf("recorded exclusions %v, want %v", tun.excludeRoutes, want)
+	}
+
+	r.cmds = nil
+	tun.state().undo()
+	var removed []string
+	for _, c := range r.changes() {
+		if strings.Contains(c, " via ") {
+			removed = append(removed, c)
+		}
+	}
+	want := []string{
+		"ip route del 10.1.0.0/16 via 192.0.2.1",
+		"ip route del 172.16.0.0/12 via 192.0.2.1",
+	}
+	if !slices.Equal(removed, want) {
+		t.Fatalf("undo removed %q\nwant %q", removed, want)
+	}
+	if !slices.Contains(r.changes(), "ip route del 203.0.113.10/32") {
+		t.Fatalf("undo ran %q, leaving the node route", r.changes())
+	}
+}
+
+func TestLANPrefix(t *testing.T) {
+	lan, err := LANPrefix("127.0.0.1")
+	if err != nil {
+		t.Skipf("no loopback address: %v", err)
+	}
+	if !lan.Contains(netip.MustParseAddr("127.0.0.1")) || lan.Bits() == 0 {
+		t.Fatalf("LANPrefix(127.0.0.1) = %v", lan)
+	}
+	if _, err := LANPrefix("not-an-ip"); err == nil {
+		t.Fatal("accepted an invalid gateway")
+	}
+	if _, err := LANPrefix("198.51.100.1"); err == nil {
+		t.Fatal("found a local subnet for an unreachable gateway")
+	}
+}
@@ -0,0 +1,148 @@
+package tun
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Command is one program TUN setup or cleanup shells out to
+type Command struct {
+	Args     []string // Program and arguments
+	Stdin    string   // Fed to the program's standard input, if not empty
+	ReadOnly bool     // Only inspects the host (routes, settings, existing rules)
+}
+
+func (c Command) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Runner makes the host changes a TUN needs: the commands (ip, iptables,
+// route, pfctl, sysctl, ...) and the files (resolv.conf, state) it writes.
+// Replacing it previews or records them.
+type Runner interface {
+	// Run runs cmd and returns its combined output
+	Run(cmd Command) ([]byte, error)
+	// WriteFile replaces the file at path, creating its directory if needed
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+	// Remove deletes the file at path
+	Remove(path string) error
+}
+
+// ExecRunner changes the host for real
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd Command) ([]byte, error) {
+	c := exec.Command(cmd.Args[0], cmd.Args[1:]...)
+	if cmd.Stdin != "" {
+		c.Stdin = strings.NewReader(cmd.Stdin)
+	}
+	return c.CombinedOutput()
+}
+
+func (ExecRunner) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+func (ExecRunner) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// DryRunner writes each command and file write that would change the host to
+// Out instead of making it, and reports success. Read-only commands still
+// run, so setup sees the real routing table and settings.
+type DryRunner struct {
+	Out io.Writer
+}
+
+func (r DryRunner) Run(cmd Command) ([]byte, error) {
+	if cmd.ReadOnly {
+		return ExecRunner{}.Run(cmd)
+	}
+	fmt.Fprintf(r.Out, "[dry run] %s\n", cmd)
+	if cmd.Stdin != "" {
+		fmt.Fprintf(r.Out, "[dry run]   with input: %q\n", cmd.Stdin)
+	}
+	return nil, nil
+}
+
+func (r DryRunner) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	fmt.Fprintf(r.Out, "[dry run] write %s (%d bytes, mode %v)\n", path, len(data), perm)
+	return nil
+}
+
+func (r DryRunner) Remove(path string) error {
+	fmt.Fprintf(r.Out, "[dry run] remove %s\n", path)
+	return nil
+}
+
+// goos picks between the Linux and macOS commands, replaceable for tests
+var goos = runtime.GOOS
+
+var (
+	runnerMu sync.RWMutex
+	runner   Runner = ExecRunner{}
+)
+
+// SetRunner replaces how host commands are run (nil restores ExecRunner).
+// Must be called before any TUN is created.
+func SetRunner(r Runner) {
+	if r == nil {
+		r = ExecRunner{}
+	}
+	runnerMu.Lock()
+	runner = r
+	runnerMu.Unlock()
+}
+
+func currentRunner() Runner {
+	runnerMu.RLock()
+	defer runnerMu.RUnlock()
+	return runner
+}
+
+// host makes host changes through a Runner. TUN and State embed it; the zero
+// value uses the package runner, and tests set runner to record commands.
+type host struct {
+	runner Runner
+}
+
+func (h host) currentRunner() Runner {
+	if h.runner != nil {
+		return h.runner
+	}
+	return currentRunner()
+}
+
+func (h host) runCommand(cmd Command) ([]byte, error) {
+	return h.currentRunner().Run(cmd)
+}
+
+// run runs a command that changes the host
+func (h host) run(args ...string) ([]byte, error) {
+	return h.runCommand(Command{Args: args})
+}
+
+// query runs a command that only inspects the host
+func (h host) query(args ...string) ([]byte, error) {
+	return h.runCommand(Command{Args: args, ReadOnly: true})
+}
+
+// writeFile writes a file through the runner
+func (h host) writeFile(path string, data []byte, perm fs.FileMode) error {
+	return h.currentRunner().WriteFile(path, data, perm)
+}
+
+// removeFile deletes a file through the runner
+func (h host) removeFile(path string) error {
+	return h.currentRunner().Remove(path)
+}
@@ -0,0 +1,139 @@
+package tun
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// dryHost is a DryRunner whose read-only commands lookup answers, so dry
+// runs don't depend on the test host's routes and rules
+type dryHost struct {
+	DryRunner
+	lookup func(cmd Command) ([]byte, error)
+}
+
+func (h dryHost) Run(cmd Command) ([]byte, error) {
+	if cmd.ReadOnly {
+		return h.lookup(cmd)
+	}
+	return h.DryRunner.Run(cmd)
+}
+
+// useDryRun makes package host changes a dry run printing to the returned
+// buffer until the test ends
+func useDryRun(t *testing.T, lookup func(cmd Command) ([]byte, error)) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	SetRunner(dryHost{DryRunner{Out: &out}, lookup})
+	t.Cleanup(func() { SetRunner(nil) })
+	return &out
+}
+
+func TestDryRunnerPrintsInsteadOfRunning(t *testing.T) {
+	var out bytes.Buffer
+	r := DryRunner{Out: &out}
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Run(Command{Args: []string{"ip", "link", "set", "seras0", "up"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Run(Command{Args: []string{"pfctl", "-f", "-"}, Stdin: "nat on en0\n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[dry run] ip link set seras0 up\n" +
+		"[dry run] pfctl -f -\n" +
+		"[dry run]   with input: \"nat on en0\\n\"\n" +
+		"[dry run] write " + filepath.Join(dir, "resolv.conf") + " (19 bytes, mode -rw-r--r--)\n" +
+		"[dry run] remove " + existing + "\n"
+	if got := out.String(); got != want {
+		t.Fatalf("printed\n%s\nwant\n%s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "resolv.conf")); err == nil {
+		t.Fatal("dry run wrote a file")
+	}
+	if _, err := os.Stat(existing); err != nil {
+		t.Fatalf("dry run removed a file: %v", err)
+	}
+
+	// Read-only commands still run, so setup sees the real host
+	got, err := r.Run(Command{Args: []string{"echo", "routes"}, ReadOnly: true})
+	if err != nil || string(got) != "routes\n" {
+		t.Fatalf("read-only command returned %q, %v", got, err)
+	}
+	if strings.Contains(out.String(), "echo") {
+		t.Fatal("read-only command printed as a change")
+	}
+}
+
+func TestDryRunSetupSequences(t *testing.T) {
+	skipUnlessLinux(t)
+	lookup := func(cmd Command) ([]byte, error) {
+		if cmd.String() == "sysctl -n net.ipv4.ip_forward" {
+			return []byte("0\n"), nil
+		}
+		if out, err := defaultRouteVia("eth0")(cmd); out != nil {
+			return out, err
+		}
+		return missingNATRules(cmd)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(tun *TUN) error
+		want  []string
+	}{
+		{"client", func(tun *TUN) error { return tun.setupClient(tun.gateway, tun.nodeIP) }, []string{
+			// State is saved before the first change, so a crash can be undone
+			"write " + statePath("seras0") + " (mode -rw-------)",
+			"ip addr add 10.9.0.2/24 dev seras0",
+			"ip link set seras0 mtu 1300",
+			"ip link set seras0 up",
+			"ip route add 203.0.113.10/32 via 192.0.2.1",
+			"ip route add 0.0.0.0/1 dev seras0",
+			"ip route add 128.0.0.0/1 dev seras0",
+		}},
+		{"node", func(tun *TUN) error {
+			tun.isNode, tun.firewall = true, true
+			return tun.setupNode()
+		}, []string{
+			"ip addr add 10.9.0.2/24 dev seras0",
+			"ip link set seras0 mtu 1300",
+			"ip link set seras0 up",
+			"ip route replace 10.9.0.0/24 dev seras0",
+			"sysctl -w net.ipv4.ip_forward=1",
+			"iptables -t nat -A POSTROUTING -s 10.9.0.0/24 -o eth0 -j MASQUERADE",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := useDryRun(t, lookup)
+			if err := tt.setup(newTestTUN(nil, 0)); err != nil {
+				t.Fatal(err)
+			}
+			var want strings.Builder
+			for _, line := range tt.want {
+				want.WriteString("[dry run] " + line + "\n")
+			}
+			// State file sizes vary with its fields
+			got := regexp.MustCompile(`\(\d+ bytes, `).ReplaceAllString(out.String(), "(")
+			if got != want.String() {
+				t.Fatalf("printed\n%s\nwant\n%s", got, want.String())
+			}
+		})
+	}
+}
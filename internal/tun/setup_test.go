@@ -0,0 +1,97 @@
+package tun
+
+import (
+	"slices"
+	"testing"
+)
+
+// useGOOS makes setup pick os's commands until the test ends
+func useGOOS(t *testing.T, os string) {
+	t.Helper()
+	old := goos
+	goos = os
+	t.Cleanup(func() { goos = old })
+}
+
+// commands returns every command run, read-only or not, with "?" marking
+// lookups and pf input appended after "<<"
+func (r *recorder) commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cmds []string
+	for _, cmd := range r.cmds {
+		s := cmd.String()
+		if cmd.ReadOnly {
+			s = "? " + s
+		}
+		if cmd.Stdin != "" {
+			s += " << " + cmd.Stdin
+		}
+		cmds = append(cmds, s)
+	}
+	return cmds
+}
+
+func TestSetupCommandSequences(t *testing.T) {
+	tests := []struct {
+		name  string
+		os    string
+		node  bool
+		setup func(tun *TUN) error
+		want  []string
+	}{
+		{"setupClientLinux", "linux", false, func(tun *TUN) error { return tun.setupClientLinux(tun.gateway, tun.nodeIP) }, []string{
+			"ip addr add 10.9.0.2/24 dev seras0",
+			"ip link set seras0 mtu 1300",
+			"ip link set seras0 up",
+			"ip route add 203.0.113.10/32 via 192.0.2.1",
+			"ip route add 0.0.0.0/1 dev seras0",
+			"ip route add 128.0.0.0/1 dev seras0",
+		}},
+		{"setupClientDarwin", "darwin", false, func(tun *TUN) error { return tun.setupClientDarwin(tun.gateway, tun.nodeIP) }, []string{
+			"ifconfig seras0 inet 10.9.0.2 10.9.0.1 up",
+			"ifconfig seras0 mtu 1300",
+			"route add -host 203.0.113.10 192.0.2.1",
+			"route add -net 0.0.0.0/1 10.9.0.1",
+			"route add -net 128.0.0.0/1 10.9.0.1",
+		}},
+		{"setupNodeLinux", "linux", true, (*TUN).setupNodeLinux, []string{
+			"ip addr add 10.9.0.1/24 dev seras0",
+			"ip link set seras0 mtu 1300",
+			"ip link set seras0 up",
+			"ip route replace 10.9.0.0/24 dev seras0",
+			"? sysctl -n net.ipv4.ip_forward",
+			"sysctl -w net.ipv4.ip_forward=1",
+			"? ip route show default",
+			"? iptables -t nat -C POSTROUTING -s 10.9.0.0/24 -o eth0 -j MASQUERADE",
+			"iptables -t nat -A POSTROUTING -s 10.9.0.0/24 -o eth0 -j MASQUERADE",
+		}},
+		{"setupNodeDarwin", "darwin", true, (*TUN).setupNodeDarwin, []string{
+			"ifconfig seras0 inet 10.9.0.1 10.9.0.2 up",
+			"ifconfig seras0 mtu 1300",
+			"route add -net 10.9.0.0/24 -interface seras0",
+			"? sysctl -n net.inet.ip.forwarding",
+			"sysctl -w net.inet.ip.forwarding=1",
+			"? route -n get default",
+			"pfctl -a com.apple/seras.seras0 -f - << nat on eth0 from 10.9.0.0/24 to any -> (eth0)\n",
+			"pfctl -E",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGOOS(t, tt.os)
+			r := newRecorder()
+			r.respond = nodeHost("eth0")
+			tun := newTestTUN(r, 0)
+			if tt.node {
+				tun.isNode, tun.firewall, tun.localIP = true, true, "10.9.0.1"
+			}
+			if err := tt.setup(tun); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.commands(); !slices.Equal(got, tt.want) {
+				t.Fatalf("ran %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// RouteSnapshot is the part of the client's IPv4 routing table setup touches,
+// as it was before setup changed it. Undo leaves routes that were already
+// there in place and puts the default route back if it changed or vanished.
+type RouteSnapshot struct {
+	DefaultGateway string         `json:"default_gateway,omitempty"`
+	DefaultIface   string         `json:"default_iface,omitempty"`
+	HasDefault     bool           `json:"has_default,omitempty"`
+	Existing       []netip.Prefix `json:"existing,omitempty"` // Routes setup would add that were already present
+}
+
+// routeEntry is one route as reported by ip route or route get
+type routeEntry struct {
+	prefix  netip.Prefix
+	gateway string
+	iface   string
+}
+
+var defaultRoute = netip.MustParsePrefix("0.0.0.0/0")
+
+// snapshotRoutes records the default route and which of prefixes already have
+// a route. Query failures leave the snapshot partial, never fail setup.
+func (h host) snapshotRoutes(prefixes []netip.Prefix) *RouteSnapshot {
+	snap := &RouteSnapshot{}
+	if def, ok := h.lookupRoute(defaultRoute); ok {
+		snap.HasDefault = true
+		snap.DefaultGateway = def.gateway
+		snap.DefaultIface = def.iface
+	}
+	for _, prefix := range prefixes {
+		if _, ok := h.lookupRoute(prefix); ok {
+			snap.Existing = append(snap.Existing, prefix)
+		}
+	}
+	return snap
+}
+
+// existed reports whether prefix had a route before setup; false for state
+// files written before snapshots were recorded
+func (s *RouteSnapshot) existed(prefix netip.Prefix) bool {
+	return s != nil && slices.Contains(s.Existing, prefix)
+}
+
+// lookupRoute returns the route installed for exactly prefix, if any
+func (h host) lookupRoute(prefix netip.Prefix) (routeEntry, bool) {
+	if goos == "darwin" {
+		args := []string{"route", "-n", "get", "-net", prefix.String()}
+		if prefix == defaultRoute {
+			args = []string{"route", "-n", "get", "default"}
+		} else if prefix.IsSingleIP() {
+			args = []string{"route", "-n", "get", "-host", prefix.Addr().String()}
+		}
+		out, err := h.query(args...)
+		if err != nil {
+			return routeEntry{}, false
+		}
+		// route get answers with the best match, which may be a broader route
+		route, ok := parseRouteGetDarwin(string(out))
+		return route, ok && route.prefix == prefix
+	}
+
+	out, err := h.query("ip", "-4", "route", "show", "exact", prefix.String())
+	if err != nil {
+		return routeEntry{}, false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if route, ok := parseRouteLinux(line); ok && route.prefix == prefix {
+			return route, true
+		}
+	}
+	return routeEntry{}, false
+}
+
+// parseRouteLinux parses one line of ip route output, e.g.
+// "default via 192.168.1.1 dev wlan0 proto dhcp metric 600"
+func parseRouteLinux(line string) (routeEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return routeEntry{}, false
+	}
+
+	var route routeEntry
+	switch dest := fields[0]; {
+	case dest == "default":
+		route.prefix = defaultRoute
+	case strings.Contains(dest, "/"):
+		prefix, err := netip.ParsePrefix(dest)
+		if err != nil {
+			return routeEntry{}, false
+		}
+		route.prefix = prefix
+	default:
+		addr, err := netip.ParseAddr(dest)
+		if err != nil {
+			return routeEntry{}, false
+		}
+		route.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	for i := 1; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			route.gateway = fields[i+1]
+		case "dev":
+			route.iface = fields[i+1]
+		}
+	}
+	return route, true
+}
+
+// parseRouteGetDarwin parses the output of route -n get, whose lines look like
+// "destination: default", "mask: 255.0.0.0", "gateway: 192.168.1.1" and
+// "interface: en0". A route without a mask is a host route.
+func parseRouteGetDarwin(out string) (routeEntry, bool) {
+	var route routeEntry
+	var dest, mask string
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "destination":
+			dest = value
+		case "mask":
+			mask = value
+		case "gateway":
+			route.gateway = value
+		case "interface":
+			route.iface = value
+		}
+	}
+
+	if dest == "default" {
+		route.prefix = defaultRoute
+		return route, true
+	}
+	addr, err := netip.ParseAddr(dest)
+	if err != nil || !addr.Is4() {
+		return routeEntry{}, false
+	}
+	bits := 32
+	if mask != "" {
+		m, err := netip.ParseAddr(mask)
+		if err != nil || !m.Is4() {
+			return routeEntry{}, false
+		}
+		bits = maskBits(m.As4())
+		if bits < 0 {
+			return routeEntry{}, false
+		}
+	}
+	route.prefix = netip.PrefixFrom(addr, bits).Masked()
+	return route, true
+}
+
+// maskBits returns the prefix length of a contiguous netmask, or -1
+func maskBits(mask [4]byte) int {
+	v := uint32(mask[0])<<24 | uint32(mask[1])<<16 | uint32(mask[2])<<8 | uint32(mask[3])
+	bits := 0
+	for v&(1<<31) != 0 {
+		bits++
+		v <<= 1
+	}
+	if v != 0 {
+		return -1
+	}
+	return bits
+}
+
+// restoreDefaultRouteCmd builds the command putting the snapshot's default
+// route back, given the current one (ok false when there is none). It returns
+// nil when nothing needs restoring.
+func (s *RouteSnapshot) restoreDefaultRouteCmd(current routeEntry, ok bool) []string {
+	if s == nil || !s.HasDefault || s.DefaultGateway == "" && s.DefaultIface == "" {
+		return nil
+	}
+	if ok && current.gateway == s.DefaultGateway && current.iface == s.DefaultIface {
+		return nil
+	}
+
+	if goos == "darwin" {
+		op := "add"
+		if ok {
+			op = "change"
+		}
+		if s.DefaultGateway == "" {
+			return []string{"route", op, "default", "-interface", s.DefaultIface}
+		}
+		return []string{"route", op, "default", s.DefaultGateway}
+	}
+
+	args := []string{"ip", "route", "replace", "default"}
+	if s.DefaultGateway != "" {
+		args = append(args, "via", s.DefaultGateway)
+	}
+	if s.DefaultIface != "" {
+		args = append(args, "dev", s.DefaultIface)
+	}
+	return args
+}
+
+// restoreDefaultRoute puts the snapshot's default route back if it changed or
+// vanished while the tunnel was up
+func (st *State) restoreDefaultRoute() {
+	current, ok := st.lookupRoute(defaultRoute)
+	args := st.Snapshot.restoreDefaultRouteCmd(current, ok)
+	if args == nil {
+		return
+	}
+	if out, err := st.run(args...); err != nil {
+		fmt.Printf("Warning: failed to restore default route: %v (%s)\n", err, string(out))
+		return
+	}
+	fmt.Printf("Default route restored: %s\n", strings.Join(args, " "))
+}
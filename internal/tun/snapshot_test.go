@@ -0,0 +1,205 @@
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// routeTable answers route lookups from a fixed set of outputs, failing the
+// ones it has no answer for as route get does for a missing route
+type routeTable map[string]string
+
+func (rt routeTable) respond(cmd Command) ([]byte, error) {
+	if out, ok := rt[cmd.String()]; ok {
+		return []byte(out), nil
+	}
+	if cmd.ReadOnly {
+		return nil, errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestParseRouteLinux(t *testing.T) {
+	tests := []struct {
+		line string
+		want routeEntry
+		ok   bool
+	}{
+		{"default via 192.168.1.1 dev wlan0 proto dhcp metric 600",
+			routeEntry{defaultRoute, "192.168.1.1", "wlan0"}, true},
+		{"10.0.0.0/8 dev wg0 scope link",
+			routeEntry{netip.MustParsePrefix("10.0.0.0/8"), "", "wg0"}, true},
+		{"203.0.113.10 via 192.0.2.1 dev eth0",
+			routeEntry{netip.MustParsePrefix("203.0.113.10/32"), "192.0.2.1", "eth0"}, true},
+		{"default dev ppp0 scope link",
+			routeEntry{defaultRoute, "", "ppp0"}, true},
+		{"", routeEntry{}, false},
+		{"blackhole-ish nonsense", routeEntry{}, false},
+		{"10.0.0.0/99 dev wg0", routeEntry{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRouteLinux(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseRouteLinux(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseRouteGetDarwin(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want routeEntry
+		ok   bool
+	}{
+		{"default", "   route to: default\ndestination: default\n       mask: default\n    gateway: 192.168.1.1\n  interface: en0\n",
+			routeEntry{defaultRoute, "192.168.1.1", "en0"}, true},
+		{"network", "   route to: 10.1.2.3\ndestination: 10.0.0.0\n       mask: 255.0.0.0\n  interface: utun3\n",
+			routeEntry{netip.MustParsePrefix("10.0.0.0/8"), "", "utun3"}, true},
+		{"host", "   route to: 203.0.113.10\ndestination: 203.0.113.10\n    gateway: 192.0.2.1\n  interface: en0\n",
+			routeEntry{netip.MustParsePrefix("203.0.113.10/32"), "192.0.2.1", "en0"}, true},
+		{"non-contiguous mask", "destination: 10.0.0.0\n       mask: 255.0.255.0\n", routeEntry{}, false},
+		{"IPv6 destination", "destination: fd00::\n", routeEntry{}, false},
+		{"no destination", "  interface: en0\n", routeEntry{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRouteGetDarwin(tt.out)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: got %+v, %v; want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMaskBits(t *testing.T) {
+	tests := map[[4]byte]int{
+		{0, 0, 0, 0}:         0,
+		{255, 0, 0, 0}:       8,
+		{255, 255, 255, 128}: 25,
+		{255, 255, 255, 255}: 32,
+		{255, 0, 255, 0}:     -1,
+		{0, 0, 0, 1}:         -1,
+	}
+	for mask, want := range tests {
+		if got := maskBits(mask); got != want {
+			t.Errorf("maskBits(%v) = %d, want %d", mask, got, want)
+		}
+	}
+}
+
+func TestRestoreDefaultRouteCmd(t *testing.T) {
+	snap := &RouteSnapshot{DefaultGateway: "192.0.2.1", DefaultIface: "eth0", HasDefault: true}
+	unchanged := routeEntry{defaultRoute, "192.0.2.1", "eth0"}
+	moved := routeEntry{defaultRoute, "", "ppp0"}
+	tests := []struct {
+		name    string
+		os      string
+		snap    *RouteSnapshot
+		current routeEntry
+		ok      bool
+		want    string
+	}{
+		{"linux unchanged", "linux", snap, unchanged, true, ""},
+		{"linux changed", "linux", snap, moved, true, "ip route replace default via 192.0.2.1 dev eth0"},
+		{"linux vanished", "linux", snap, routeEntry{}, false, "ip route replace default via 192.0.2.1 dev eth0"},
+		{"linux interface only", "linux", &RouteSnapshot{DefaultIface: "ppp0", HasDefault: true}, routeEntry{}, false, "ip route replace default dev ppp0"},
+		{"darwin unchanged", "darwin", snap, unchanged, true, ""},
+		{"darwin changed", "darwin", snap, moved, true, "route change default 192.0.2.1"},
+		{"darwin vanished", "darwin", snap, routeEntry{}, false, "route add default 192.0.2.1"},
+		{"darwin interface only", "darwin", &RouteSnapshot{DefaultIface: "utun2", HasDefault: true}, moved, true, "route change default -interface utun2"},
+		{"no default before setup", "linux", &RouteSnapshot{}, moved, true, ""},
+		{"no snapshot", "linux", nil, routeEntry{}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGOOS(t, tt.os)
+			if got := strings.Join(tt.snap.restoreDefaultRouteCmd(tt.current, tt.ok), " "); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestoredAfterCrash(t *testing.T) {
+	tests := []struct {
+		os     string
+		before routeTable // Lookups as setup sees them
+		after  routeTable // Lookups as cleanup sees them
+		want   []string   // Route changes cleanup makes
+	}{
+		{"linux",
+			routeTable{
+				"ip -4 route show exact 0.0.0.0/0": "default via 192.0.2.1 dev eth0 proto dhcp\n",
+				"ip -4 route show exact 0.0.0.0/1": "0.0.0.0/1 dev wg0 scope link\n",
+			},
+			routeTable{
+				"ip -4 route show exact 0.0.0.0/0": "default dev ppp0 scope link\n",
+			},
+			[]string{
+				"ip route del 128.0.0.0/1 dev seras0",
+				"ip route del 203.0.113.10/32",
+				"ip route replace default via 192.0.2.1 dev eth0",
+			}},
+		{"darwin",
+			routeTable{
+				"route -n get default":            "destination: default\n    gateway: 192.0.2.1\n  interface: en0\n",
+				"route -n get -host 203.0.113.10": "destination: 203.0.113.10\n    gateway: 192.0.2.254\n  interface: en0\n",
+				"route -n get -net 0.0.0.0/1":     "destination: default\n    gateway: 192.0.2.1\n  interface: en0\n",
+				"route -n get -net 128.0.0.0/1":   "destination: default\n    gateway: 192.0.2.1\n  interface: en0\n",
+			},
+			routeTable{},
+			[]string{
+				"route delete -net 0.0.0.0/1",
+				"route delete -net 128.0.0.0/1",
+				"route add default 192.0.2.1",
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.os, func(t *testing.T) {
+			useGOOS(t, tt.os)
+			r := useTestHost(t)
+			r.respond = tt.before.respond
+
+			tun := newTestTUN(nil, 0)
+			if err := tun.setupClient(tun.gateway, tun.nodeIP); err != nil {
+				t.Fatal(err)
+			}
+			if err := tun.state().save(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The snapshot survives the state file
+			st, err := LoadState(tun.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(st.Snapshot, tun.snapshot) {
+				t.Fatalf("loaded snapshot %+v, want %+v", st.Snapshot, tun.snapshot)
+			}
+			if !st.Snapshot.HasDefault || st.Snapshot.DefaultGateway != "192.0.2.1" {
+				t.Fatalf("snapshot %+v missed the default route", st.Snapshot)
+			}
+
+			// The process dies and the routes change under it before cleanup
+			r.mu.Lock()
+			r.cmds = nil
+			r.respond = tt.after.respond
+			r.mu.Unlock()
+			if err := Cleanup(tun.name); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range r.changes() {
+				if strings.HasPrefix(c, "ip route") || strings.HasPrefix(c, "route ") {
+					got = append(got, c)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("cleanup ran %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
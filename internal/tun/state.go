@@ -0,0 +1,224 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// StateDir holds one state file per interface with host changes still installed
+var StateDir = "/var/run/seras"
+
+// State records what setup installed so it can be undone without the live device
+type State struct {
+	Name           string         `json:"name"`
+	PID            int            `json:"pid,omitempty"` // Process that owns the interface; 0 in older state files
+	IsNode         bool           `json:"is_node"`
+	Subnet         string         `json:"subnet,omitempty"` // Node: NATed VPN subnet
+	IPv6           bool           `json:"ipv6,omitempty"`
+	Subnet6        string         `json:"subnet6,omitempty"`        // Node: NATed IPv6 VPN subnet
+	NodeIP         string         `json:"node_ip,omitempty"`        // Client: node host route
+	Gateway        string         `json:"gateway,omitempty"`        // Client: original gateway for excluded routes
+	BypassIPs      []string       `json:"bypass_ips,omitempty"`     // Client: extra node host routes
+	Routes         []netip.Prefix `json:"routes,omitempty"`         // Client: tunnel routes through the interface
+	ExcludeRoutes  []netip.Prefix `json:"exclude_routes,omitempty"` // Client: prefixes routed via the gateway
+	Snapshot       *RouteSnapshot `json:"snapshot,omitempty"`       // Client: routing table before setup
+	NetworkService string         `json:"network_service,omitempty"`
+	OriginalDNS    []string       `json:"original_dns,omitempty"`
+	UsedResolved   bool           `json:"used_resolved,omitempty"`
+	ResolvReplaced bool           `json:"resolv_replaced,omitempty"`
+
+	// Node: kernel parameters setup changed, with the values to restore
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// Node: interface the NAT rules match; empty in older state files
+	EgressIface string `json:"egress_iface,omitempty"`
+	// Node: firewall changes to undo. Firewall is false in state files from
+	// before they were tracked, whose rules are removed by subnet instead.
+	Firewall bool       `json:"firewall,omitempty"`
+	NATRules [][]string `json:"nat_rules,omitempty"` // iptables/ip6tables rules added, command first
+	PfAnchor string     `json:"pf_anchor,omitempty"`
+	PfToken  string     `json:"pf_token,omitempty"`
+
+	host `json:"-"` // Runner undo goes through; the package runner when loaded
+}
+
+func (t *TUN) state() *State {
+	return &State{
+		Name:           t.name,
+		PID:            os.Getpid(),
+		IsNode:         t.isNode,
+		Subnet:         t.subnet,
+		IPv6:           t.ipv6,
+		Subnet6:        t.subnet6,
+		NodeIP:         t.nodeIP,
+		Gateway:        t.gateway,
+		BypassIPs:      t.bypassIPs,
+		Routes:         t.routes,
+		ExcludeRoutes:  t.excludeRoutes,
+		Snapshot:       t.snapshot,
+		NetworkService: t.networkService,
+		OriginalDNS:    t.originalDNS,
+		UsedResolved:   t.usedResolved,
+		ResolvReplaced: t.resolvReplaced,
+		Sysctls:        t.sysctls,
+		EgressIface:    t.egressIface,
+		Firewall:       t.firewall,
+		NATRules:       t.natRules,
+		PfAnchor:       t.pfAnchor,
+		PfToken:        t.pfToken,
+		host:           t.host,
+	}
+}
+
+// undo removes routes, NAT rules and DNS overrides recorded in the state.
+// Failures are ignored since some entries vanish with the interface itself.
+func (st *State) undo() {
+	st.undoIPv6()
+	if !st.IsNode {
+		// Client: remove routes and restore DNS
+		routes := st.Routes
+		if len(routes) == 0 {
+			// State written before routes were recorded
+			routes = defaultRoutes
+		}
+		for _, prefix := range routes {
+			if st.Snapshot.existed(prefix) {
+				continue
+			}
+			args := routeCmd(false, prefix, st.Name, "")
+			st.run(args...)
+		}
+
+		nodeRouteExisted := false
+		if addr, err := netip.ParseAddr(st.NodeIP); err == nil {
+			nodeRouteExisted = st.Snapshot.existed(netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		if goos == "darwin" {
+			if !nodeRouteExisted {
+				st.run("route", "delete", "-host", st.NodeIP)
+			}
+			for _, ip := range st.BypassIPs {
+				st.run("route", "delete", "-host", ip)
+			}
+			for _, prefix := range st.ExcludeRoutes {
+				st.run("route", "delete", "-net", prefix.String())
+			}
+			restoreDNSDarwin(st)
+		} else {
+			if !nodeRouteExisted {
+				st.run("ip", "route", "del", st.NodeIP+"/32")
+			}
+			for _, ip := range st.BypassIPs {
+				st.run("ip", "route", "del", ip+"/32")
+			}
+			for _, prefix := range st.ExcludeRoutes {
+				st.run("ip", "route", "del", prefix.String(), "via", st.Gateway)
+			}
+			restoreDNSLinux(st)
+		}
+		st.restoreDefaultRoute()
+	} else {
+		// Node: cleanup NAT and routes
+		st.undoFirewall()
+		if goos == "linux" {
+			if !st.Firewall {
+				st.run(natArgs("iptables", "-D", masqueradeRule(st.Subnet, st.EgressIface))...)
+			}
+			st.run("ip", "route", "del", st.Subnet, "dev", st.Name)
+		} else if goos == "darwin" {
+			if !st.Firewall {
+				st.run("pfctl", "-d")
+			}
+			st.run("route", "delete", "-net", st.Subnet)
+		}
+		st.restoreSysctls(st.Sysctls)
+	}
+}
+
+func statePath(name string) string {
+	return filepath.Join(StateDir, name+".json")
+}
+
+// save writes the state file, replacing any earlier one
+func (st *State) save() error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return st.writeFile(statePath(st.Name), data, 0600)
+}
+
+// LoadState reads the state file recorded for an interface
+func LoadState(name string) (*State, error) {
+	data, err := os.ReadFile(statePath(name))
+	if err != nil {
+		return nil, err
+	}
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parse state %s: %w", name, err)
+	}
+	return st, nil
+}
+
+// remove deletes the state file
+func (st *State) remove() {
+	st.removeFile(statePath(st.Name))
+}
+
+// Cleanup undoes host changes left by an interface that was never closed
+// (e.g., after SIGKILL or a panic) and removes its state file.
+func Cleanup(name string) error {
+	st, err := LoadState(name)
+	if err != nil {
+		return err
+	}
+	st.undo()
+	st.remove()
+	return nil
+}
+
+// CleanupStale runs Cleanup for every recorded interface whose owning process
+// has exited and returns their names. Interfaces of running instances are left.
+func CleanupStale() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(StateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var cleaned []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		st, err := LoadState(name)
+		if err != nil {
+			return cleaned, fmt.Errorf("cleanup %s: %w", name, err)
+		}
+		if st.running() {
+			continue
+		}
+		if err := Cleanup(name); err != nil {
+			return cleaned, fmt.Errorf("cleanup %s: %w", name, err)
+		}
+		cleaned = append(cleaned, name)
+	}
+	return cleaned, nil
+}
+
+// running reports whether the process that recorded the state is still alive.
+// Our own PID means a crashed owner's PID was reused, so it counts as gone.
+func (st *State) running() bool {
+	if st.PID <= 0 || st.PID == os.Getpid() {
+		return false
+	}
+	proc, err := os.FindProcess(st.PID)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
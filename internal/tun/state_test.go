@@ -0,0 +1,154 @@
+package tun
+
+import (
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// diskRecorder records commands but writes and removes files for real, for
+// tests that point StateDir at a temporary directory
+type diskRecorder struct {
+	*recorder
+}
+
+func (diskRecorder) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	return ExecRunner{}.WriteFile(path, data, perm)
+}
+
+func (diskRecorder) Remove(path string) error {
+	return ExecRunner{}.Remove(path)
+}
+
+// useTestHost points StateDir at a fresh directory and routes package host
+// changes through a diskRecorder until the test ends
+func useTestHost(t *testing.T) *recorder {
+	t.Helper()
+	dir := StateDir
+	StateDir = t.TempDir()
+	r := newRecorder()
+	SetRunner(diskRecorder{r})
+	t.Cleanup(func() {
+		StateDir = dir
+		SetRunner(nil)
+	})
+	return r
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	useTestHost(t)
+
+	client := newTestTUN(nil, 0)
+	client.bypassIPs = []string{"203.0.113.11"}
+	client.routes = []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}
+	client.excludeRoutes = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+	client.snapshot = &RouteSnapshot{
+		DefaultGateway: "192.0.2.1",
+		DefaultIface:   "eth0",
+		HasDefault:     true,
+		Existing:       []netip.Prefix{netip.MustParsePrefix("203.0.113.10/32")},
+	}
+	client.networkService = "Wi-Fi"
+	client.originalDNS = []string{"192.0.2.53"}
+	client.resolvReplaced = true
+
+	node := newTestTUN(nil, 0)
+	node.name = "seras1"
+	node.isNode = true
+	node.ipv6 = true
+	node.subnet6 = "fd00:9::/64"
+	node.sysctls = map[string]string{"net.ipv4.ip_forward": "0"}
+	node.egressIface = "eth0"
+	node.firewall = true
+	node.natRules = [][]string{{"iptables", "-t", "nat", "POSTROUTING", "-s", "10.9.0.0/24", "-o", "eth0", "-j", "MASQUERADE"}}
+	node.pfAnchor = "com.seras/seras1"
+	node.pfToken = "123"
+
+	for _, tun := range []*TUN{client, node} {
+		want := tun.state()
+		if err := want.save(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(statePath(tun.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s state file mode %v, want 0600", tun.name, perm)
+		}
+
+		got, err := LoadState(tun.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s state round trip:\n got %+v\nwant %+v", tun.name, got, want)
+		}
+	}
+}
+
+func TestLoadStateRejectsMalformedFile(t *testing.T) {
+	useTestHost(t)
+	if err := os.WriteFile(statePath("seras0"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState("seras0"); err == nil {
+		t.Fatal("loaded a malformed state file")
+	}
+	if _, err := LoadState("missing0"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("LoadState of a missing file: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestCleanupUndoesAndRemovesState(t *testing.T) {
+	r := useTestHost(t)
+	node := newTestTUN(nil, 0)
+	node.isNode = true
+	node.sysctls = map[string]string{"net.ipv4.ip_forward": "0"}
+	if err := node.state().save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Cleanup(node.name); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(r.changes(), "sysctl -w net.ipv4.ip_forward=0") {
+		t.Fatalf("cleanup ran %q, want the sysctl restored", r.changes())
+	}
+	if _, err := os.Stat(statePath(node.name)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("state file left after cleanup: %v", err)
+	}
+	if err := Cleanup(node.name); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("second cleanup: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestCleanupStaleSkipsRunningOwners(t *testing.T) {
+	useTestHost(t)
+
+	crashed := newTestTUN(nil, 0).state()
+	crashed.Name, crashed.PID = "crashed0", 0
+	running := newTestTUN(nil, 0).state()
+	// The test binary's parent outlives the test
+	running.Name, running.PID = "running0", os.Getppid()
+	for _, st := range []*State{crashed, running} {
+		if err := st.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cleaned, err := CleanupStale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cleaned, []string{"crashed0"}) {
+		t.Fatalf("CleanupStale cleaned %q, want only crashed0", cleaned)
+	}
+	if _, err := LoadState("running0"); err != nil {
+		t.Fatalf("running owner's state: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package tun
+
+import (
+	"fmt"
+	"strings"
+)
+
+// setSysctl sets a kernel parameter, remembering its previous value when this
+// call is what changed it so Close can restore it. A value that already
+// matches is left alone and never restored.
+func (t *TUN) setSysctl(key, value string) error {
+	out, err := t.query("sysctl", "-n", key)
+	if err != nil {
+		return fmt.Errorf("read %s: %w (%s)", key, err, string(out))
+	}
+	prev := strings.TrimSpace(string(out))
+	if prev == value {
+		return nil
+	}
+	if out, err := t.run("sysctl", "-w", key+"="+value); err != nil {
+		return fmt.Errorf("set %s: %w (%s)", key, err, string(out))
+	}
+	if t.sysctls == nil {
+		t.sysctls = make(map[string]string)
+	}
+	if _, saved := t.sysctls[key]; !saved {
+		t.sysctls[key] = prev
+	}
+	return nil
+}
+
+// restoreSysctls writes back the values setSysctl replaced
+func (h host) restoreSysctls(saved map[string]string) {
+	for key, value := range saved {
+		if out, err := h.run("sysctl", "-w", key+"="+value); err != nil {
+			fmt.Printf("Warning: failed to restore %s: %v (%s)\n", key, err, string(out))
+		}
+	}
+}
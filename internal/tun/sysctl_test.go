@@ -0,0 +1,119 @@
+package tun
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// kernel answers sysctl commands from a map of parameters
+type kernel struct {
+	mu     sync.Mutex
+	params map[string]string
+}
+
+func (k *kernel) respond(cmd Command) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	args := cmd.Args
+	if len(args) != 3 || args[0] != "sysctl" {
+		return nil, nil
+	}
+	args = args[1:]
+	switch args[0] {
+	case "-n":
+		value, ok := k.params[args[1]]
+		if !ok {
+			return []byte("sysctl: cannot stat " + args[1]), errors.New("exit status 255")
+		}
+		return []byte(value + "\n"), nil
+	case "-w":
+		key, value, _ := strings.Cut(args[1], "=")
+		k.params[key] = value
+	}
+	return nil, nil
+}
+
+func (k *kernel) get(key string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.params[key]
+}
+
+// sysctlTUN returns a node TUN whose sysctls go to k
+func sysctlTUN(k *kernel) (*TUN, *recorder) {
+	r := newRecorder()
+	r.respond = k.respond
+	tun := newTestTUN(r, 0)
+	tun.isNode = true
+	return tun, r
+}
+
+func TestSysctlRestoresOriginalValue(t *testing.T) {
+	k := &kernel{params: map[string]string{"net.ipv4.ip_forward": "0"}}
+	tun, _ := sysctlTUN(k)
+
+	if err := tun.setSysctl("net.ipv4.ip_forward", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := k.get("net.ipv4.ip_forward"); got != "1" {
+		t.Fatalf("forwarding %s after setup, want 1", got)
+	}
+	// Setting it again keeps the value from before the first change
+	if err := tun.setSysctl("net.ipv4.ip_forward", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tun.host.restoreSysctls(tun.state().Sysctls)
+	if got := k.get("net.ipv4.ip_forward"); got != "0" {
+		t.Fatalf("forwarding %s after restore, want the original 0", got)
+	}
+}
+
+func TestSysctlLeavesMatchingValue(t *testing.T) {
+	k := &kernel{params: map[string]string{"net.ipv4.ip_forward": "1"}}
+	tun, r := sysctlTUN(k)
+
+	if err := tun.setSysctl("net.ipv4.ip_forward", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.changes()) != 0 || len(tun.sysctls) != 0 {
+		t.Fatalf("already enabled, but ran %q and saved %v", r.changes(), tun.sysctls)
+	}
+
+	// Another process enabled it, so it stays on after Close
+	tun.host.restoreSysctls(tun.state().Sysctls)
+	if got := k.get("net.ipv4.ip_forward"); got != "1" {
+		t.Fatalf("forwarding %s after restore, want it left at 1", got)
+	}
+}
+
+func TestSysctlReadFailure(t *testing.T) {
+	tun, r := sysctlTUN(&kernel{params: map[string]string{}})
+	if err := tun.setSysctl("net.ipv4.ip_forward", "1"); err == nil {
+		t.Fatal("set a parameter that couldn't be read")
+	}
+	if changes := r.changes(); slices.ContainsFunc(changes, func(c string) bool { return strings.HasPrefix(c, "sysctl -w") }) {
+		t.Fatalf("wrote a parameter it couldn't save: %q", changes)
+	}
+}
+
+func TestSetupNodeRestoresForwarding(t *testing.T) {
+	skipUnlessLinux(t)
+	k := &kernel{params: map[string]string{"net.ipv4.ip_forward": "0"}}
+	tun, _ := sysctlTUN(k)
+	tun.egressIface = "eth0"
+	if err := tun.setupNodeLinux(); err != nil {
+		t.Fatal(err)
+	}
+	if got := k.get("net.ipv4.ip_forward"); got != "1" {
+		t.Fatalf("forwarding %s after setup, want 1", got)
+	}
+
+	tun.state().undo()
+	if got := k.get("net.ipv4.ip_forward"); got != "0" {
+		t.Fatalf("forwarding %s after undo, want the original 0", got)
+	}
+}
@@ -1,14 +1,41 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
 	"os/exec"
-	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/songgao/water"
 )
 
+// DefaultMTU is used when no MTU is configured
+const DefaultMTU = 1300
+
+// maxNameLen is the longest interface name Linux accepts (IFNAMSIZ - 1)
+const maxNameLen = 15
+
+// Backoff between empty reads, so a wedged device doesn't spin a core
+const (
+	minEmptyReadBackoff = time.Millisecond
+	maxEmptyReadBackoff = 100 * time.Millisecond
+)
+
+// ErrClosed is returned by Read once the device is closed or gone
+var ErrClosed = errors.New("tun: device closed")
+
+// ErrTUNUnavailable is returned when the node can't create a TUN for lack of
+// the device or privileges, as in a container started without them
+var ErrTUNUnavailable = errors.New("tun: unavailable (in a container, run with --cap-add=NET_ADMIN --device /dev/net/tun)")
+
 type TUN struct {
 	dev            *water.Interface
 	name           string
@@ -16,21 +43,57 @@ type TUN struct {
 	peerIP         string
 	subnet         string // e.g., "11.0.0.0/24"
 	isNode         bool
-	nodeIP         string // for client cleanup
-	gateway        string // for client cleanup
-	dnsServers     []string // DNS servers to use
-	originalDNS    []string // Original DNS to restore
-	networkService string   // macOS network service name
+	nodeIP         string         // for client cleanup
+	gateway        string         // for client cleanup
+	bypassIPs      []string       // extra node hosts routed via gateway (client)
+	allowedIPs     []netip.Prefix // split tunnel prefixes (client, empty = full tunnel)
+	routes         []netip.Prefix // tunnel routes installed (client), removed on Close
+	excludeRoutes  []netip.Prefix // prefixes routed via gateway (client), removed on Close
+	snapshot       *RouteSnapshot // routing table before setup (client), restored on Close
+	dnsServers     []string       // DNS servers to use
+	originalDNS    []string       // Original DNS to restore
+	networkService string         // macOS network service name
+	resolvReplaced bool           // /etc/resolv.conf rewritten, original backed up (Linux)
+	usedResolved   bool           // DNS set via systemd-resolved (Linux)
+	mtu            int
+	ipv6           bool   // IPv6 addresses and routes installed
+	localIP6       string // TUN IPv6 address
+	subnet6        string // Node: NATed IPv6 VPN subnet
+	closed         atomic.Bool
+
+	// Node: kernel parameters setup changed, with their previous values
+	sysctls map[string]string
+	// Node: interface client traffic is NATed out of
+	egressIface string
+	// Node: firewall changes setup made, undone by Close
+	firewall bool       // Tracked in the fields below (false only in old state files)
+	natRules [][]string // iptables/ip6tables rules added, command first
+	pfAnchor string     // pf anchor loaded with NAT rules (macOS)
+	pfToken  string     // pf enable reference to release (macOS)
+
+	// Runner setup and Close go through; zero uses the package runner
+	host
 }
 
-// New creates TUN for client and routes all traffic through it
-func New(localIP, gateway, nodeIP, nodeVPNIP string) (*TUN, error) {
-	return NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"})
+const (
+	resolvConfPath   = "/etc/resolv.conf"
+	resolvBackupPath = "/etc/resolv.conf.seras-backup"
+)
+
+// New creates TUN for client and routes traffic for allowedIPs through it,
+// or all traffic when allowedIPs is empty.
+// A zero mtu selects DefaultMTU; an empty name lets the kernel pick one.
+func New(localIP, gateway, nodeIP, nodeVPNIP string, mtu int, name string, allowedIPs []netip.Prefix) (*TUN, error) {
+	return NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"}, mtu, name, allowedIPs)
 }
 
 // NewWithDNS creates TUN for client with custom DNS servers
-func NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string) (*TUN, error) {
-	dev, err := water.New(water.Config{DeviceType: water.TUN})
+func NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string, mtu int, name string, allowedIPs []netip.Prefix) (*TUN, error) {
+	cfg, err := deviceConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := water.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("create tun: %w", err)
 	}
@@ -44,41 +107,101 @@ func NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string)
 		nodeIP:     nodeIP,
 		gateway:    gateway,
 		dnsServers: dnsServers,
+		allowedIPs: collapsePrefixes(allowedIPs),
+		mtu:        mtuOrDefault(mtu),
 	}
 
 	if err := t.setupClient(gateway, nodeIP); err != nil {
+		// Take back whatever setup got as far as installing
+		st := t.state()
+		st.undo()
+		st.remove()
 		dev.Close()
 		return nil, fmt.Errorf("setup tun: %w", err)
 	}
 
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+
 	return t, nil
 }
 
-// NewNodeTUN creates TUN for node (exit node) with NAT and routing
-func NewNodeTUN(localIP, vpnSubnet string) (*TUN, error) {
-	dev, err := water.New(water.Config{DeviceType: water.TUN})
+// Probe checks that a TUN device can be created by opening one and closing it
+// again, without assigning addresses or installing routes
+func Probe(name string) error {
+	cfg, err := deviceConfig(name)
+	if err != nil {
+		return err
+	}
+	dev, err := water.New(cfg)
+	if err != nil {
+		return fmt.Errorf("create tun: %w", err)
+	}
+	return dev.Close()
+}
+
+// NewNodeTUN creates TUN for node (exit node) with NAT and routing.
+// A zero mtu selects DefaultMTU; an empty name lets the kernel pick one.
+// Client traffic is NATed out of egressIface, or the default route's
+// interface when it is empty.
+func NewNodeTUN(localIP, vpnSubnet string, mtu int, name, egressIface string) (*TUN, error) {
+	cfg, err := deviceConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPrerequisites(); err != nil {
+		return nil, err
+	}
+	dev, err := water.New(cfg)
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, fmt.Errorf("%w: create tun: %v", ErrTUNUnavailable, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("create tun: %w", err)
 	}
 
 	t := &TUN{
-		dev:     dev,
-		name:    dev.Name(),
-		localIP: localIP,
-		subnet:  vpnSubnet,
-		isNode:  true,
+		dev:         dev,
+		name:        dev.Name(),
+		localIP:     localIP,
+		subnet:      vpnSubnet,
+		isNode:      true,
+		mtu:         mtuOrDefault(mtu),
+		egressIface: egressIface,
+		firewall:    true,
 	}
 
 	if err := t.setupNode(); err != nil {
+		// Take back whatever setup got as far as installing
+		t.state().undo()
 		dev.Close()
 		return nil, fmt.Errorf("setup node tun: %w", err)
 	}
 
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+
 	return t, nil
 }
 
 func (t *TUN) setupClient(gateway, nodeIP string) error {
-	if runtime.GOOS == "darwin" {
+	// Note the routes setup is about to add that already exist, so Close
+	// leaves them in place
+	var prefixes []netip.Prefix
+	if addr, err := netip.ParseAddr(nodeIP); err == nil {
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	t.snapshot = t.snapshotRoutes(append(prefixes, t.tunnelRoutes(false)...))
+
+	// Record the node route before adding it, so CleanupStale can undo a
+	// setup that dies partway
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+
+	if goos == "darwin" {
 		return t.setupClientDarwin(gateway, nodeIP)
 	}
 	return t.setupClientLinux(gateway, nodeIP)
@@ -87,39 +210,135 @@ func (t *TUN) setupClient(gateway, nodeIP string) error {
 func (t *TUN) setupClientLinux(gateway, nodeIP string) error {
 	cmds := [][]string{
 		{"ip", "addr", "add", t.localIP + "/24", "dev", t.name},
-		{"ip", "link", "set", t.name, "mtu", "1300"},
+		{"ip", "link", "set", t.name, "mtu", strconv.Itoa(t.mtu)},
 		{"ip", "link", "set", t.name, "up"},
 		{"ip", "route", "add", nodeIP + "/32", "via", gateway},
-		{"ip", "route", "add", "0.0.0.0/1", "dev", t.name},
-		{"ip", "route", "add", "128.0.0.0/1", "dev", t.name},
 	}
 
 	for _, args := range cmds {
-		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		if out, err := t.run(args...); err != nil {
 			// Ignore "File exists" for routes (from previous run)
 			if !strings.Contains(string(out), "File exists") {
 				return fmt.Errorf("%v: %w (%s)", args, err, string(out))
 			}
 		}
 	}
+
+	if err := t.addTunnelRoutes(false); err != nil {
+		return err
+	}
+
+	// Setup DNS if servers specified
+	if len(t.dnsServers) > 0 {
+		if err := t.setupDNSLinux(); err != nil {
+			fmt.Printf("Warning: DNS setup failed: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
+func (t *TUN) setupDNSLinux() error {
+	// systemd-resolved manages resolv.conf through a symlink; configure the link instead
+	if target, err := os.Readlink(resolvConfPath); err == nil && strings.Contains(target, "systemd") {
+		if _, err := exec.LookPath("resolvectl"); err == nil {
+			// Reverting a link that was never changed is harmless, so record it first
+			t.usedResolved = true
+			if err := t.state().save(); err != nil {
+				fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+			}
+			args := append([]string{"dns", t.name}, t.dnsServers...)
+			if out, err := t.run(append([]string{"resolvectl"}, args...)...); err != nil {
+				return fmt.Errorf("resolvectl dns: %w (%s)", err, string(out))
+			}
+			// Route all lookups through the tunnel link
+			if out, err := t.run("resolvectl", "domain", t.name, "~."); err != nil {
+				return fmt.Errorf("resolvectl domain: %w (%s)", err, string(out))
+			}
+			fmt.Printf("DNS set to %v via systemd-resolved on %s\n", t.dnsServers, t.name)
+			return nil
+		}
+		fmt.Printf("Warning: %s is managed by systemd but resolvectl was not found, rewriting file\n", resolvConfPath)
+	}
+
+	original, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", resolvConfPath, err)
+	}
+
+	// Keep a copy on disk so the original survives a crash
+	if err := t.writeFile(resolvBackupPath, original, 0644); err != nil {
+		return fmt.Errorf("backup %s: %w", resolvConfPath, err)
+	}
+
+	// Restoring from the backup is harmless until the file is replaced
+	t.resolvReplaced = true
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+
+	if err := t.writeFile(resolvConfPath, t.resolvConf(), 0644); err != nil {
+		t.resolvReplaced = false
+		t.removeFile(resolvBackupPath)
+		// chattr +i makes the file immutable even for root
+		return fmt.Errorf("write %s (immutable?): %w", resolvConfPath, err)
+	}
+
+	fmt.Printf("DNS set to %v in %s\n", t.dnsServers, resolvConfPath)
+	return nil
+}
+
+// resolvConf renders the resolv.conf that points at the tunnel DNS servers
+func (t *TUN) resolvConf() []byte {
+	var b strings.Builder
+	b.WriteString("# Generated by seras, original saved to " + resolvBackupPath + "\n")
+	for _, server := range t.dnsServers {
+		b.WriteString("nameserver " + server + "\n")
+	}
+	return []byte(b.String())
+}
+
+func restoreDNSLinux(st *State) {
+	if st.UsedResolved {
+		st.run("resolvectl", "revert", st.Name)
+		fmt.Printf("DNS reverted on %s\n", st.Name)
+		return
+	}
+
+	if !st.ResolvReplaced {
+		return
+	}
+
+	original, err := os.ReadFile(resolvBackupPath)
+	if err != nil {
+		fmt.Printf("Warning: failed to read %s: %v\n", resolvBackupPath, err)
+		return
+	}
+	if err := st.writeFile(resolvConfPath, original, 0644); err != nil {
+		fmt.Printf("Warning: failed to restore %s: %v\n", resolvConfPath, err)
+		return
+	}
+	st.removeFile(resolvBackupPath)
+	fmt.Printf("DNS restored in %s\n", resolvConfPath)
+}
+
 func (t *TUN) setupClientDarwin(gateway, nodeIP string) error {
 	cmds := [][]string{
 		{"ifconfig", t.name, "inet", t.localIP, t.peerIP, "up"},
-		{"ifconfig", t.name, "mtu", "1300"},
+		{"ifconfig", t.name, "mtu", strconv.Itoa(t.mtu)},
 		{"route", "add", "-host", nodeIP, gateway},
-		{"route", "add", "-net", "0.0.0.0/1", t.peerIP},
-		{"route", "add", "-net", "128.0.0.0/1", t.peerIP},
 	}
 
 	for _, args := range cmds {
-		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		if out, err := t.run(args...); err != nil {
 			return fmt.Errorf("%v: %w (%s)", args, err, string(out))
 		}
 	}
 
+	if err := t.addTunnelRoutes(false); err != nil {
+		return err
+	}
+
 	// Setup DNS if servers specified
 	if len(t.dnsServers) > 0 {
 		if err := t.setupDNSDarwin(); err != nil {
@@ -132,13 +351,13 @@ func (t *TUN) setupClientDarwin(gateway, nodeIP string) error {
 
 func (t *TUN) setupDNSDarwin() error {
 	// Find active network service
-	t.networkService = getActiveNetworkService()
+	t.networkService = t.activeNetworkService()
 	if t.networkService == "" {
 		return fmt.Errorf("could not detect active network service")
 	}
 
 	// Save original DNS
-	out, err := exec.Command("networksetup", "-getdnsservers", t.networkService).Output()
+	out, err := t.query("networksetup", "-getdnsservers", t.networkService)
 	if err == nil {
 		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
 		for _, line := range lines {
@@ -149,9 +368,14 @@ func (t *TUN) setupDNSDarwin() error {
 		}
 	}
 
+	// Record the original DNS before replacing it
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+
 	// Set new DNS
 	args := append([]string{"-setdnsservers", t.networkService}, t.dnsServers...)
-	if out, err := exec.Command("networksetup", args...).CombinedOutput(); err != nil {
+	if out, err := t.run(append([]string{"networksetup"}, args...)...); err != nil {
 		return fmt.Errorf("set dns: %w (%s)", err, string(out))
 	}
 
@@ -159,40 +383,40 @@ func (t *TUN) setupDNSDarwin() error {
 	return nil
 }
 
-func (t *TUN) restoreDNSDarwin() {
-	if t.networkService == "" {
+func restoreDNSDarwin(st *State) {
+	if st.NetworkService == "" {
 		return
 	}
 
 	var args []string
-	if len(t.originalDNS) == 0 {
+	if len(st.OriginalDNS) == 0 {
 		// Restore to DHCP
-		args = []string{"-setdnsservers", t.networkService, "empty"}
+		args = []string{"-setdnsservers", st.NetworkService, "empty"}
 	} else {
-		args = append([]string{"-setdnsservers", t.networkService}, t.originalDNS...)
+		args = append([]string{"-setdnsservers", st.NetworkService}, st.OriginalDNS...)
 	}
 
-	exec.Command("networksetup", args...).Run()
-	fmt.Printf("DNS restored on %s\n", t.networkService)
+	st.run(append([]string{"networksetup"}, args...)...)
+	fmt.Printf("DNS restored on %s\n", st.NetworkService)
 }
 
-func getActiveNetworkService() string {
+func (h host) activeNetworkService() string {
 	// Try common services in order
 	services := []string{"Wi-Fi", "Ethernet", "USB 10/100/1000 LAN", "Thunderbolt Ethernet"}
 
 	for _, svc := range services {
-		out, err := exec.Command("networksetup", "-getinfo", svc).Output()
+		out, err := h.query("networksetup", "-getinfo", svc)
 		if err == nil && strings.Contains(string(out), "IP address:") {
 			return svc
 		}
 	}
 
 	// Fallback: try to get from route
-	out, _ := exec.Command("route", "-n", "get", "default").Output()
+	out, _ := h.query("route", "-n", "get", "default")
 	if strings.Contains(string(out), "interface:") {
 		// Try to match interface to service
 		for _, svc := range services {
-			out2, _ := exec.Command("networksetup", "-getinfo", svc).Output()
+			out2, _ := h.query("networksetup", "-getinfo", svc)
 			if len(out2) > 0 {
 				return svc
 			}
@@ -203,7 +427,7 @@ func getActiveNetworkService() string {
 }
 
 func (t *TUN) setupNode() error {
-	if runtime.GOOS == "darwin" {
+	if goos == "darwin" {
 		return t.setupNodeDarwin()
 	}
 	return t.setupNodeLinux()
@@ -215,14 +439,14 @@ func (t *TUN) setupNodeLinux() error {
 
 	cmds := [][]string{
 		{"ip", "addr", "add", t.localIP + "/24", "dev", t.name},
-		{"ip", "link", "set", t.name, "mtu", "1300"},
+		{"ip", "link", "set", t.name, "mtu", strconv.Itoa(t.mtu)},
 		{"ip", "link", "set", t.name, "up"},
-		// Route for VPN subnet through TUN
-		{"ip", "route", "add", t.subnet, "dev", t.name},
+		// Route for VPN subnet through TUN, replacing any stale one
+		{"ip", "route", "replace", t.subnet, "dev", t.name},
 	}
 
 	for _, args := range cmds {
-		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		if out, err := t.run(args...); err != nil {
 			// Ignore "File exists" errors for routes
 			if !strings.Contains(string(out), "File exists") {
 				return fmt.Errorf("%v: %w (%s)", args, err, string(out))
@@ -230,20 +454,23 @@ func (t *TUN) setupNodeLinux() error {
 		}
 	}
 
-	// Enable IP forwarding
-	if out, err := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").CombinedOutput(); err != nil {
-		return fmt.Errorf("enable ip forwarding: %w (%s)", err, string(out))
+	// Enable IP forwarding, restored on Close if it was off
+	if err := t.setSysctl("net.ipv4.ip_forward", "1"); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
 	}
 
-	// Setup NAT for VPN subnet (check if rule exists first)
-	if err := exec.Command("iptables", "-t", "nat", "-C", "POSTROUTING", "-s", t.subnet, "-j", "MASQUERADE").Run(); err != nil {
-		// Rule doesn't exist, add it
-		if out, err := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", t.subnet, "-j", "MASQUERADE").CombinedOutput(); err != nil {
-			return fmt.Errorf("setup nat: %w (%s)", err, string(out))
-		}
+	iface, err := t.egressInterface(t.egressIface)
+	if err != nil {
+		return err
+	}
+	t.egressIface = iface
+
+	// Setup NAT for VPN subnet
+	if err := t.addNATRule("iptables", masqueradeRule(t.subnet, t.egressIface)); err != nil {
+		return fmt.Errorf("setup nat: %w", err)
 	}
 
-	fmt.Printf("Node TUN setup complete: %s, subnet: %s, base: %s\n", t.name, t.subnet, subnetBase)
+	fmt.Printf("Node TUN setup complete: %s, subnet: %s, base: %s, egress: %s\n", t.name, t.subnet, subnetBase, t.egressIface)
 	return nil
 }
 
@@ -253,42 +480,228 @@ func (t *TUN) setupNodeDarwin() error {
 
 	cmds := [][]string{
 		{"ifconfig", t.name, "inet", t.localIP, peerIP, "up"},
-		{"ifconfig", t.name, "mtu", "1300"},
+		{"ifconfig", t.name, "mtu", strconv.Itoa(t.mtu)},
 		{"route", "add", "-net", t.subnet, "-interface", t.name},
 	}
 
 	for _, args := range cmds {
-		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		if out, err := t.run(args...); err != nil {
 			if !strings.Contains(string(out), "File exists") {
 				return fmt.Errorf("%v: %w (%s)", args, err, string(out))
 			}
 		}
 	}
 
-	// Enable IP forwarding
-	if out, err := exec.Command("sysctl", "-w", "net.inet.ip.forwarding=1").CombinedOutput(); err != nil {
-		return fmt.Errorf("enable ip forwarding: %w (%s)", err, string(out))
+	// Enable IP forwarding, restored on Close if it was off
+	if err := t.setSysctl("net.inet.ip.forwarding", "1"); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
+	}
+
+	iface, err := t.egressInterface(t.egressIface)
+	if err != nil {
+		return err
 	}
+	t.egressIface = iface
 
 	// Setup NAT with pfctl
-	natRule := fmt.Sprintf("nat on en0 from %s to any -> (en0)\n", t.subnet)
-	if err := setupPfNat(natRule); err != nil {
+	if err := t.loadPfNat(pfNatRules(t.egressIface, t.subnet, "")); err != nil {
 		fmt.Printf("Warning: NAT setup failed: %v\n", err)
 	}
 
 	return nil
 }
 
-func setupPfNat(natRule string) error {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf(`echo '%s' | pfctl -ef -`, natRule))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("pfctl: %w (%s)", err, string(out))
+// SetLocalIP replaces the client's TUN address (e.g., with one leased by the node)
+func (t *TUN) SetLocalIP(ip string) error {
+	if ip == t.localIP {
+		return nil
+	}
+
+	var cmds [][]string
+	if goos == "darwin" {
+		cmds = [][]string{
+			{"ifconfig", t.name, "inet", ip, t.peerIP, "up"},
+		}
+	} else {
+		cmds = [][]string{
+			{"ip", "addr", "del", t.localIP + "/24", "dev", t.name},
+			{"ip", "addr", "add", ip + "/24", "dev", t.name},
+		}
+	}
+
+	for _, args := range cmds {
+		if out, err := t.run(args...); err != nil {
+			return fmt.Errorf("%v: %w (%s)", args, err, string(out))
+		}
+	}
+
+	t.localIP = ip
+	return nil
+}
+
+// SetMTU changes the client's TUN MTU (e.g., to one recommended by the node)
+func (t *TUN) SetMTU(mtu int) error {
+	if mtu == t.mtu {
+		return nil
+	}
+
+	args := []string{"ip", "link", "set", t.name, "mtu", strconv.Itoa(mtu)}
+	if goos == "darwin" {
+		args = []string{"ifconfig", t.name, "mtu", strconv.Itoa(mtu)}
+	}
+	if out, err := t.run(args...); err != nil {
+		return fmt.Errorf("%v: %w (%s)", args, err, string(out))
+	}
+
+	t.mtu = mtu
+	return nil
+}
+
+// DNS returns the DNS servers the client's TUN points the host at
+func (t *TUN) DNS() []string {
+	return t.dnsServers
+}
+
+// SetDNS points the host at servers instead (e.g., ones recommended by the
+// node). The original settings setup recorded are still what Close restores.
+func (t *TUN) SetDNS(servers []string) error {
+	if slices.Equal(servers, t.dnsServers) {
+		return nil
+	}
+	t.dnsServers = servers
+
+	var err error
+	switch {
+	case t.usedResolved:
+		args := append([]string{"resolvectl", "dns", t.name}, servers...)
+		if out, runErr := t.run(args...); runErr != nil {
+			err = fmt.Errorf("resolvectl dns: %w (%s)", runErr, string(out))
+		}
+	case t.resolvReplaced:
+		// The backup already holds the original; only the live file changes
+		if writeErr := t.writeFile(resolvConfPath, t.resolvConf(), 0644); writeErr != nil {
+			err = fmt.Errorf("write %s: %w", resolvConfPath, writeErr)
+		}
+	case t.networkService != "":
+		args := append([]string{"networksetup", "-setdnsservers", t.networkService}, servers...)
+		if out, runErr := t.run(args...); runErr != nil {
+			err = fmt.Errorf("set dns: %w (%s)", runErr, string(out))
+		}
+	default:
+		// Setup left DNS alone, so this is the first change to it
+		if goos == "darwin" {
+			err = t.setupDNSDarwin()
+		} else {
+			err = t.setupDNSLinux()
+		}
+		if err == nil {
+			if saveErr := t.state().save(); saveErr != nil {
+				fmt.Printf("Warning: failed to save TUN state: %v\n", saveErr)
+			}
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNS set to %v on %s\n", servers, t.name)
+	return nil
+}
+
+// AddHostRoute routes ip via the original gateway so traffic to another
+// node (e.g., a failover candidate) doesn't loop through the tunnel
+func (t *TUN) AddHostRoute(ip string) error {
+	if ip == t.nodeIP {
+		return nil
+	}
+
+	args := []string{"ip", "route", "add", ip + "/32", "via", t.gateway}
+	if goos == "darwin" {
+		args = []string{"route", "add", "-host", ip, t.gateway}
+	}
+	if out, err := t.run(args...); err != nil {
+		// A route that was already there isn't ours to remove on Close
+		if strings.Contains(string(out), "File exists") {
+			return nil
+		}
+		return fmt.Errorf("%v: %w (%s)", args, err, string(out))
+	}
+
+	t.bypassIPs = append(t.bypassIPs, ip)
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
 	}
 	return nil
 }
 
+// AddExcludeRoute routes prefix via the original gateway so it bypasses the
+// tunnel. Only a route this call created is removed on Close; a prefix that
+// already has a route (e.g., the directly connected LAN) is left alone.
+func (t *TUN) AddExcludeRoute(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("exclude route %s: only IPv4 is supported", prefix)
+	}
+
+	// Longest prefix wins, so a narrower tunnel route would still capture part of it
+	for _, route := range t.routes {
+		if route.Bits() > prefix.Bits() && prefix.Contains(route.Addr()) {
+			fmt.Printf("Warning: tunnel route %s overrides part of excluded %s\n", route, prefix)
+		}
+	}
+
+	args := []string{"ip", "route", "add", prefix.String(), "via", t.gateway}
+	if goos == "darwin" {
+		args = []string{"route", "add", "-net", prefix.String(), t.gateway}
+	}
+	if out, err := t.run(args...); err != nil {
+		if strings.Contains(string(out), "File exists") {
+			return nil
+		}
+		return fmt.Errorf("%v: %w (%s)", args, err, string(out))
+	}
+
+	t.excludeRoutes = append(t.excludeRoutes, prefix)
+	if err := t.state().save(); err != nil {
+		fmt.Printf("Warning: failed to save TUN state: %v\n", err)
+	}
+	return nil
+}
+
+// addTunnelRoutes installs the client's tunnel routes for one address family,
+// recording each one so Close removes exactly what was added
+func (t *TUN) addTunnelRoutes(ipv6 bool) error {
+	for _, prefix := range t.tunnelRoutes(ipv6) {
+		if err := t.runCmds([][]string{routeCmd(true, prefix, t.name, t.peerIP)}); err != nil {
+			return err
+		}
+		t.routes = append(t.routes, prefix)
+	}
+	return nil
+}
+
+// Read reads one packet. It never returns an empty packet: empty reads are
+// retried with a growing backoff. Once the device is closed or reports EOF,
+// Read returns an error wrapping ErrClosed.
 func (t *TUN) Read(buf []byte) (int, error) {
-	return t.dev.Read(buf)
+	backoff := minEmptyReadBackoff
+	for {
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			if t.closed.Load() || errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
+				return 0, fmt.Errorf("%w: %v", ErrClosed, err)
+			}
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if t.closed.Load() {
+			return 0, ErrClosed
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxEmptyReadBackoff)
+	}
 }
 
 func (t *TUN) Write(buf []byte) (int, error) {
@@ -296,28 +709,10 @@ func (t *TUN) Write(buf []byte) (int, error) {
 }
 
 func (t *TUN) Close() error {
-	if !t.isNode {
-		// Client: remove routes and restore DNS
-		if runtime.GOOS == "darwin" {
-			exec.Command("route", "delete", "-net", "0.0.0.0/1").Run()
-			exec.Command("route", "delete", "-net", "128.0.0.0/1").Run()
-			exec.Command("route", "delete", "-host", t.nodeIP).Run()
-			t.restoreDNSDarwin()
-		} else {
-			exec.Command("ip", "route", "del", "0.0.0.0/1", "dev", t.name).Run()
-			exec.Command("ip", "route", "del", "128.0.0.0/1", "dev", t.name).Run()
-			exec.Command("ip", "route", "del", t.nodeIP+"/32").Run()
-		}
-	} else {
-		// Node: cleanup NAT and routes
-		if runtime.GOOS == "linux" {
-			exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING", "-s", t.subnet, "-j", "MASQUERADE").Run()
-			exec.Command("ip", "route", "del", t.subnet, "dev", t.name).Run()
-		} else if runtime.GOOS == "darwin" {
-			exec.Command("pfctl", "-d").Run()
-			exec.Command("route", "delete", "-net", t.subnet).Run()
-		}
-	}
+	t.closed.Store(true)
+	st := t.state()
+	st.undo()
+	st.remove()
 
 	return t.dev.Close()
 }
@@ -326,6 +721,52 @@ func (t *TUN) Name() string {
 	return t.name
 }
 
+// MTU returns the configured interface MTU
+func (t *TUN) MTU() int {
+	return t.mtu
+}
+
+func mtuOrDefault(mtu int) int {
+	if mtu <= 0 {
+		return DefaultMTU
+	}
+	return mtu
+}
+
+// deviceConfig builds the water config, requesting name where the platform allows it.
+// macOS only hands out utunN names, so the request is ignored there.
+func deviceConfig(name string) (water.Config, error) {
+	cfg := water.Config{DeviceType: water.TUN}
+	if name == "" {
+		return cfg, nil
+	}
+	if err := ValidateName(name); err != nil {
+		return cfg, err
+	}
+	if goos != "linux" {
+		fmt.Printf("Warning: TUN name %q ignored on %s, using an assigned name\n", name, goos)
+		return cfg, nil
+	}
+	cfg.Name = name
+	return cfg, nil
+}
+
+// ValidateName checks that name is usable as a network interface name
+func ValidateName(name string) error {
+	if len(name) == 0 || len(name) > maxNameLen {
+		return fmt.Errorf("TUN name must be 1-%d characters, got: %q", maxNameLen, name)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("TUN name must not be %q", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("TUN name may only contain letters, digits, '-', '_' and '.', got: %q", name)
+		}
+	}
+	return nil
+}
+
 // getSubnetBase returns base of subnet (e.g., "11.0.0.0/24" -> "11.0.0")
 func getSubnetBase(subnet string) string {
 	parts := strings.Split(subnet, "/")
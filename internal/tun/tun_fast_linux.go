@@ -3,39 +3,67 @@
 package tun
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/songgao/water"
 	"seras-protocol/internal/iouring"
 )
 
+// maxRingFailures is how many io_uring submissions in a row may fail before
+// the ring is abandoned for blocking I/O
+const maxRingFailures = 3
+
 // FastTUN wraps TUN with io_uring for async I/O on Linux
 type FastTUN struct {
 	*TUN
 	ring iouring.Ring
 	fd   int
+
+	// Consecutive failed submissions; past maxRingFailures, ringOff is set
+	// and I/O goes through the blocking TUN
+	ringFailures atomic.Int32
+	ringOff      atomic.Bool
+
+	// Reads kept in flight between ReadBatch calls; readNext is the oldest
+	reads     []pendingRead
+	readNext  int
+	readMu    sync.Mutex
+	done      chan struct{} // Closed by Close to release a waiting ReadBatch
+	closeOnce sync.Once
+}
+
+// pendingRead is a queued TUN read and the buffer it fills
+type pendingRead struct {
+	op  iouring.AsyncOp
+	buf []byte
 }
 
 // NewFast creates a TUN with io_uring acceleration
-func NewFast(localIP, gateway, nodeIP, nodeVPNIP string) (*FastTUN, error) {
-	return NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"})
+func NewFast(localIP, gateway, nodeIP, nodeVPNIP string, mtu int, name string, allowedIPs []netip.Prefix) (*FastTUN, error) {
+	return NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"}, mtu, name, allowedIPs)
 }
 
 // NewFastWithDNS creates a TUN with io_uring and custom DNS
-func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string) (*FastTUN, error) {
-	t, err := NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, dnsServers)
+func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string, mtu int, name string, allowedIPs []netip.Prefix) (*FastTUN, error) {
+	t, err := NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, dnsServers, mtu, name, allowedIPs)
 	if err != nil {
 		return nil, err
 	}
 
-	ft := &FastTUN{TUN: t, fd: -1}
+	ft := &FastTUN{TUN: t, fd: -1, done: make(chan struct{})}
 
 	// Try to enable io_uring
 	if iouring.IsSupported() {
 		fd := extractFD(t.dev)
 		if fd >= 0 {
-			ring, err := iouring.New(iouring.DefaultConfig())
+			ring, err := iouring.New(ringConfig())
 			if err == nil {
 				ft.ring = ring
 				ft.fd = fd
@@ -47,18 +75,18 @@ func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []str
 }
 
 // NewFastNode creates a node TUN with io_uring
-func NewFastNode(localIP, vpnSubnet string) (*FastTUN, error) {
-	t, err := NewNodeTUN(localIP, vpnSubnet)
+func NewFastNode(localIP, vpnSubnet string, mtu int, name, egressIface string) (*FastTUN, error) {
+	t, err := NewNodeTUN(localIP, vpnSubnet, mtu, name, egressIface)
 	if err != nil {
 		return nil, err
 	}
 
-	ft := &FastTUN{TUN: t, fd: -1}
+	ft := &FastTUN{TUN: t, fd: -1, done: make(chan struct{})}
 
 	if iouring.IsSupported() {
 		fd := extractFD(t.dev)
 		if fd >= 0 {
-			ring, err := iouring.New(iouring.DefaultConfig())
+			ring, err := iouring.New(ringConfig())
 			if err == nil {
 				ft.ring = ring
 				ft.fd = fd
@@ -69,10 +97,28 @@ func NewFastNode(localIP, vpnSubnet string) (*FastTUN, error) {
 	return ft, nil
 }
 
+// ringConfig batches submissions, so ReadBatch and WriteBatch cost one
+// io_uring_enter per batch instead of one per packet
+func ringConfig() iouring.Config {
+	cfg := iouring.DefaultConfig()
+	cfg.Batch = true
+	return cfg
+}
+
 // ReadAsync performs async read using io_uring
 func (t *FastTUN) ReadAsync(buf []byte) (iouring.AsyncOp, error) {
-	if t.ring != nil && t.fd >= 0 {
-		return t.ring.ReadAsync(t.fd, buf)
+	if t.HasIOURing() {
+		op, err := t.ring.ReadAsync(t.fd, buf)
+		if err == nil {
+			err = t.ring.Submit()
+		}
+		if err == nil {
+			t.ringFailures.Store(0)
+			return op, nil
+		}
+		if !t.ringFailed(err) {
+			return nil, err
+		}
 	}
 	// Fallback to blocking
 	n, err := t.TUN.Read(buf)
@@ -81,20 +127,202 @@ func (t *FastTUN) ReadAsync(buf []byte) (iouring.AsyncOp, error) {
 
 // WriteAsync performs async write using io_uring
 func (t *FastTUN) WriteAsync(buf []byte) (iouring.AsyncOp, error) {
-	if t.ring != nil && t.fd >= 0 {
-		return t.ring.WriteAsync(t.fd, buf)
+	if t.HasIOURing() {
+		op, err := t.ring.WriteAsync(t.fd, buf)
+		if err == nil {
+			err = t.ring.Submit()
+		}
+		if err == nil {
+			t.ringFailures.Store(0)
+			return op, nil
+		}
+		if !t.ringFailed(err) {
+			return nil, err
+		}
 	}
 	// Fallback to blocking
 	n, err := t.TUN.Write(buf)
 	return &immediateOp{n: n, err: err}, nil
 }
 
-// HasIOURing returns true if io_uring is active
+// HasIOURing returns true if io_uring is active. It turns false for good
+// once the ring keeps failing.
 func (t *FastTUN) HasIOURing() bool {
-	return t.ring != nil && t.fd >= 0
+	return t.ring != nil && t.fd >= 0 && !t.ringOff.Load()
+}
+
+// ringFailed counts a failed submission and reports whether the ring is now
+// off, after maxRingFailures in a row
+func (t *FastTUN) ringFailed(err error) bool {
+	if t.ringFailures.Add(1) < maxRingFailures {
+		return t.ringOff.Load()
+	}
+	if t.ringOff.CompareAndSwap(false, true) {
+		fmt.Printf("Warning: io_uring failed %d times in a row (%v), falling back to blocking TUN I/O\n",
+			maxRingFailures, err)
+	}
+	return true
+}
+
+// ReadBatch keeps len(bufs) reads in flight from the first call on, so
+// packets arriving while the caller is busy are already read when it returns
+func (t *FastTUN) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if !t.HasIOURing() {
+		return readOne(t.TUN, bufs, sizes)
+	}
+
+	t.readMu.Lock()
+	defer t.readMu.Unlock()
+	// Reads requeued below go to the kernel together on the way out
+	defer t.ring.Submit()
+
+	if t.reads == nil {
+		t.reads = make([]pendingRead, len(bufs))
+		for i := range t.reads {
+			t.reads[i].buf = make([]byte, t.mtu)
+			if err := t.submitRead(i); err != nil {
+				t.reads = nil
+				return t.readFailed(0, bufs, sizes, err)
+			}
+		}
+	}
+
+	count := 0
+	for count < len(bufs) {
+		r := &t.reads[t.readNext]
+		// Retry a read whose resubmission failed last time
+		if r.op == nil {
+			if err := t.submitRead(t.readNext); err != nil {
+				return t.readFailed(count, bufs, sizes, err)
+			}
+		}
+		// Block for the first packet only; take the rest if already read
+		if count == 0 {
+			if err := t.ring.Submit(); err != nil {
+				return t.readFailed(count, bufs, sizes, fmt.Errorf("submit TUN reads: %w", err))
+			}
+			select {
+			case <-r.op.Done():
+			case <-t.done:
+				return 0, ErrClosed
+			}
+		} else {
+			select {
+			case <-r.op.Done():
+			default:
+				return count, nil
+			}
+		}
+
+		n, err := r.op.Wait()
+		if err != nil && t.closed.Load() {
+			return count, fmt.Errorf("%w: %v", ErrClosed, err)
+		}
+		if err == nil && n > 0 {
+			sizes[count] = copy(bufs[count], r.buf[:n])
+			count++
+		} else if err == nil {
+			// An empty read means the device is going away; don't spin on it
+			time.Sleep(minEmptyReadBackoff)
+		}
+
+		if submitErr := t.submitRead(t.readNext); submitErr != nil {
+			return t.readFailed(count, bufs, sizes, submitErr)
+		}
+		t.readNext = (t.readNext + 1) % len(t.reads)
+
+		if err != nil {
+			if count > 0 {
+				return count, nil
+			}
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// submitRead queues a read into slot i, leaving its op nil on failure. The
+// read reaches the kernel with the next Submit.
+func (t *FastTUN) submitRead(i int) error {
+	t.reads[i].op = nil
+	op, err := t.ring.ReadAsync(t.fd, t.reads[i].buf)
+	if err != nil {
+		return fmt.Errorf("queue TUN read: %w", err)
+	}
+	t.reads[i].op = op
+	t.ringFailures.Store(0)
+	return nil
+}
+
+// readFailed handles a read that couldn't be queued after count packets were
+// taken. Once the ring is off, its reads still in flight are abandoned (the
+// packets they catch are lost) and reads block on the TUN instead.
+func (t *FastTUN) readFailed(count int, bufs [][]byte, sizes []int, err error) (int, error) {
+	if !t.ringFailed(err) {
+		return count, err
+	}
+	t.reads = nil
+	if count > 0 {
+		return count, nil
+	}
+	return readOne(t.TUN, bufs, sizes)
 }
 
+// WriteBatch queues a write per packet, submits them together and waits for
+// all of them
+func (t *FastTUN) WriteBatch(packets [][]byte) (int, error) {
+	if !t.HasIOURing() || len(packets) == 1 {
+		return writeEach(t.TUN, packets)
+	}
+
+	var err error
+	fallback := false
+	ops := make([]iouring.AsyncOp, 0, len(packets))
+	for _, packet := range packets {
+		op, queueErr := t.ring.WriteAsync(t.fd, packet)
+		if queueErr != nil {
+			if fallback = t.ringFailed(queueErr); !fallback {
+				err = fmt.Errorf("queue TUN write: %w", queueErr)
+			}
+			break
+		}
+		t.ringFailures.Store(0)
+		ops = append(ops, op)
+	}
+	if submitErr := t.ring.Submit(); submitErr != nil {
+		if t.ringFailed(submitErr) {
+			// Every queued write failed with the submission; write them all directly
+			return writeEach(t.TUN, packets)
+		}
+		return 0, fmt.Errorf("submit TUN writes: %w", submitErr)
+	}
+
+	written := 0
+	for _, op := range ops {
+		if _, writeErr := op.Wait(); writeErr != nil {
+			if err == nil {
+				err = writeErr
+			}
+			continue
+		}
+		written++
+	}
+
+	// The ring was just turned off; write what it didn't take directly
+	if fallback {
+		n, fallbackErr := writeEach(t.TUN, packets[len(ops):])
+		written += n
+		if err == nil {
+			err = fallbackErr
+		}
+	}
+	return written, err
+}
+
+var _ BatchDevice = (*FastTUN)(nil)
+
 func (t *FastTUN) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
 	if t.ring != nil {
 		t.ring.Close()
 	}
@@ -128,6 +356,10 @@ func (o *immediateOp) Wait() (int, error) {
 	return o.n, o.err
 }
 
+func (o *immediateOp) WaitContext(context.Context) (int, error) {
+	return o.n, o.err
+}
+
 func (o *immediateOp) Done() <-chan struct{} {
 	ch := make(chan struct{})
 	close(ch)
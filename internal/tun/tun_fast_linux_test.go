@@ -0,0 +1,212 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/songgao/water"
+	"seras-protocol/internal/iouring"
+)
+
+var errRing = errors.New("io_uring: completion queue overflow")
+
+// failingRing refuses to queue operations while fail is set, and completes
+// the ones it takes at once
+type failingRing struct {
+	fail   atomic.Bool
+	queued atomic.Int32
+}
+
+func (r *failingRing) queue(buf []byte) (iouring.AsyncOp, error) {
+	if r.fail.Load() {
+		return nil, errRing
+	}
+	r.queued.Add(1)
+	return &immediateOp{n: len(buf)}, nil
+}
+
+func (r *failingRing) ReadAsync(_ int, buf []byte) (iouring.AsyncOp, error)  { return r.queue(buf) }
+func (r *failingRing) WriteAsync(_ int, buf []byte) (iouring.AsyncOp, error) { return r.queue(buf) }
+func (r *failingRing) RecvAsync(_ int, buf []byte) (iouring.AsyncOp, error)  { return r.queue(buf) }
+func (r *failingRing) SendAsync(_ int, buf []byte) (iouring.AsyncOp, error)  { return r.queue(buf) }
+
+func (r *failingRing) RecvMsgAsync(_ int, buf []byte) (iouring.AsyncOp, *net.UDPAddr, error) {
+	op, err := r.queue(buf)
+	return op, &net.UDPAddr{}, err
+}
+
+func (r *failingRing) RecvMsgBatch(int, [][]byte, []int, chan<- iouring.RecvCompletion) error {
+	return errRing
+}
+
+func (r *failingRing) Submit() error { return nil }
+func (r *failingRing) Close() error  { return nil }
+
+// packetDev is a TUN device with packets waiting to be read, recording
+// what is written to it
+type packetDev struct {
+	mu      sync.Mutex
+	reads   [][]byte
+	written [][]byte
+}
+
+func (d *packetDev) Read(buf []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, d.reads[0])
+	d.reads = d.reads[1:]
+	return n, nil
+}
+
+func (d *packetDev) Write(buf []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written = append(d.written, slices.Clone(buf))
+	return len(buf), nil
+}
+
+func (d *packetDev) Close() error { return nil }
+
+// ringTUN returns a FastTUN over dev whose ring is ring
+func ringTUN(dev *packetDev, ring iouring.Ring) *FastTUN {
+	t := &TUN{dev: &water.Interface{ReadWriteCloser: dev}, name: "seras0", mtu: DefaultMTU}
+	return &FastTUN{TUN: t, ring: ring, fd: 99, done: make(chan struct{})}
+}
+
+// stdout returns what f prints
+func stdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() {
+		os.Stdout = saved
+		w.Close()
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestFastTUNFallsBackWhenRingFails(t *testing.T) {
+	tests := []struct {
+		name string
+		io   func(t *FastTUN) error // One read or write, checked against the device
+	}{
+		{"ReadAsync", func(t *FastTUN) error {
+			op, err := t.ReadAsync(make([]byte, DefaultMTU))
+			if err != nil {
+				return err
+			}
+			_, err = op.WaitContext(context.Background())
+			return err
+		}},
+		{"WriteAsync", func(t *FastTUN) error {
+			op, err := t.WriteAsync([]byte("packet"))
+			if err != nil {
+				return err
+			}
+			_, err = op.Wait()
+			return err
+		}},
+		{"ReadBatch", func(t *FastTUN) error {
+			bufs := [][]byte{make([]byte, DefaultMTU), make([]byte, DefaultMTU)}
+			_, err := t.ReadBatch(bufs, make([]int, len(bufs)))
+			return err
+		}},
+		{"WriteBatch", func(t *FastTUN) error {
+			_, err := t.WriteBatch([][]byte{[]byte("packet"), []byte("packet")})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &packetDev{}
+			for range 3 {
+				dev.reads = append(dev.reads, []byte("packet"))
+			}
+			ring := &failingRing{}
+			ring.fail.Store(true)
+			ft := ringTUN(dev, ring)
+
+			out := stdout(t, func() {
+				// The ring gets a few chances before it's given up on
+				for i := range maxRingFailures - 1 {
+					if err := tt.io(ft); !errors.Is(err, errRing) {
+						t.Errorf("failure %d: got %v, want the ring's error", i+1, err)
+					}
+					if !ft.HasIOURing() {
+						t.Fatalf("ring off after %d failures", i+1)
+					}
+				}
+				if err := tt.io(ft); err != nil {
+					t.Fatalf("I/O as the ring is given up: %v", err)
+				}
+				if ft.HasIOURing() {
+					t.Fatalf("ring still on after %d failures", maxRingFailures)
+				}
+
+				// From then on I/O goes straight to the device, even once the
+				// ring would work again
+				ring.fail.Store(false)
+				if err := tt.io(ft); err != nil {
+					t.Fatalf("I/O after the fallback: %v", err)
+				}
+			})
+			if ring.queued.Load() != 0 {
+				t.Fatalf("%d operations queued on the ring after it was given up", ring.queued.Load())
+			}
+			if n := strings.Count(out, "falling back to blocking"); n != 1 {
+				t.Fatalf("logged the fallback %d times, want once:\n%s", n, out)
+			}
+			if strings.HasPrefix(tt.name, "Read") && len(dev.reads) != 1 {
+				t.Fatalf("%d packets left unread, want 1", len(dev.reads))
+			}
+			if strings.HasPrefix(tt.name, "Write") && len(dev.written) == 0 {
+				t.Fatal("nothing written to the device")
+			}
+		})
+	}
+}
+
+func TestFastTUNRingRecoversBetweenFailures(t *testing.T) {
+	ring := &failingRing{}
+	ft := ringTUN(&packetDev{}, ring)
+	// Failures short of the limit, each run broken by a success, never add up
+	for range 3 {
+		ring.fail.Store(true)
+		for range maxRingFailures - 1 {
+			if _, err := ft.WriteAsync([]byte("packet")); !errors.Is(err, errRing) {
+				t.Fatalf("got %v, want the ring's error", err)
+			}
+		}
+		ring.fail.Store(false)
+		if _, err := ft.WriteAsync([]byte("packet")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ft.HasIOURing() {
+		t.Fatal("ring given up after failures that never ran to the limit")
+	}
+}
@@ -2,19 +2,21 @@
 
 package tun
 
+import "net/netip"
+
 // FastTUN wraps TUN (no io_uring on non-Linux)
 type FastTUN struct {
 	*TUN
 }
 
 // NewFast creates a TUN (no io_uring on this platform)
-func NewFast(localIP, gateway, nodeIP, nodeVPNIP string) (*FastTUN, error) {
-	return NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"})
+func NewFast(localIP, gateway, nodeIP, nodeVPNIP string, mtu int, name string, allowedIPs []netip.Prefix) (*FastTUN, error) {
+	return NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP, []string{"8.8.8.8", "1.1.1.1"}, mtu, name, allowedIPs)
 }
 
 // NewFastWithDNS creates a TUN with custom DNS
-func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string) (*FastTUN, error) {
-	t, err := NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, dnsServers)
+func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []string, mtu int, name string, allowedIPs []netip.Prefix) (*FastTUN, error) {
+	t, err := NewWithDNS(localIP, gateway, nodeIP, nodeVPNIP, dnsServers, mtu, name, allowedIPs)
 	if err != nil {
 		return nil, err
 	}
@@ -22,8 +24,8 @@ func NewFastWithDNS(localIP, gateway, nodeIP, nodeVPNIP string, dnsServers []str
 }
 
 // NewFastNode creates a node TUN
-func NewFastNode(localIP, vpnSubnet string) (*FastTUN, error) {
-	t, err := NewNodeTUN(localIP, vpnSubnet)
+func NewFastNode(localIP, vpnSubnet string, mtu int, name, egressIface string) (*FastTUN, error) {
+	t, err := NewNodeTUN(localIP, vpnSubnet, mtu, name, egressIface)
 	if err != nil {
 		return nil, err
 	}
@@ -34,3 +36,15 @@ func NewFastNode(localIP, vpnSubnet string) (*FastTUN, error) {
 func (t *FastTUN) HasIOURing() bool {
 	return false
 }
+
+// ReadBatch reads one packet; batching needs io_uring
+func (t *FastTUN) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return readOne(t.TUN, bufs, sizes)
+}
+
+// WriteBatch writes the packets one at a time
+func (t *FastTUN) WriteBatch(packets [][]byte) (int, error) {
+	return writeEach(t.TUN, packets)
+}
+
+var _ BatchDevice = (*FastTUN)(nil)
@@ -0,0 +1,191 @@
+package tun
+
+import (
+	"fmt"
+	"io/fs"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/songgao/water"
+)
+
+// recorder is a Runner that records host changes instead of making them.
+// Commands get whatever respond returns for them, or no output.
+type recorder struct {
+	mu      sync.Mutex
+	cmds    []Command
+	files   map[string][]byte
+	respond func(cmd Command) ([]byte, error)
+}
+
+func newRecorder() *recorder {
+	return &recorder{files: make(map[string][]byte)}
+}
+
+func (r *recorder) Run(cmd Command) ([]byte, error) {
+	r.mu.Lock()
+	r.cmds = append(r.cmds, cmd)
+	respond := r.respond
+	r.mu.Unlock()
+	if respond == nil {
+		return nil, nil
+	}
+	return respond(cmd)
+}
+
+func (r *recorder) WriteFile(path string, data []byte, _ fs.FileMode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[path] = slices.Clone(data)
+	return nil
+}
+
+func (r *recorder) Remove(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.files[path]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(r.files, path)
+	return nil
+}
+
+// changes returns the commands run that change the host, in order
+func (r *recorder) changes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cmds []string
+	for _, cmd := range r.cmds {
+		if !cmd.ReadOnly {
+			cmds = append(cmds, cmd.String())
+		}
+	}
+	return cmds
+}
+
+// defaultRouteVia answers the default route lookups egress detection makes
+func defaultRouteVia(iface string) func(cmd Command) ([]byte, error) {
+	return func(cmd Command) ([]byte, error) {
+		switch cmd.String() {
+		case "ip route show default":
+			return []byte("default via 192.0.2.1 dev " + iface + " proto dhcp\n"), nil
+		case "route -n get default":
+			return []byte("   route to: default\n  interface: " + iface + "\n"), nil
+		}
+		return nil, nil
+	}
+}
+
+// newTestTUN returns a TUN that has no device and makes host changes through
+// r, or the package runner when r is nil
+func newTestTUN(r Runner, mtu int) *TUN {
+	return &TUN{
+		name:    "seras0",
+		localIP: "10.9.0.2",
+		peerIP:  "10.9.0.1",
+		subnet:  "10.9.0.0/24",
+		nodeIP:  "203.0.113.10",
+		gateway: "192.0.2.1",
+		mtu:     mtuOrDefault(mtu),
+		host:    host{runner: r},
+	}
+}
+
+func TestSetupSetsMTU(t *testing.T) {
+	setups := map[string]struct {
+		setup func(t *TUN) error
+		want  string
+	}{
+		"client linux":  {func(t *TUN) error { return t.setupClientLinux(t.gateway, t.nodeIP) }, "ip link set seras0 mtu %d"},
+		"client darwin": {func(t *TUN) error { return t.setupClientDarwin(t.gateway, t.nodeIP) }, "ifconfig seras0 mtu %d"},
+		"node linux":    {(*TUN).setupNodeLinux, "ip link set seras0 mtu %d"},
+		"node darwin":   {(*TUN).setupNodeDarwin, "ifconfig seras0 mtu %d"},
+	}
+	for name, s := range setups {
+		for _, tt := range []struct{ mtu, want int }{{1420, 1420}, {0, DefaultMTU}} {
+			t.Run(name+"/"+strconv.Itoa(tt.mtu), func(t *testing.T) {
+				r := newRecorder()
+				r.respond = defaultRouteVia("eth0")
+				if err := s.setup(newTestTUN(r, tt.mtu)); err != nil {
+					t.Fatal(err)
+				}
+				want := fmt.Sprintf(s.want, tt.want)
+				if !slices.Contains(r.changes(), want) {
+					t.Fatalf("setup ran %q, missing %q", r.changes(), want)
+				}
+			})
+		}
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	r := newRecorder()
+	tun := newTestTUN(r, 0)
+
+	if err := tun.SetMTU(DefaultMTU); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.changes(); len(got) != 0 {
+		t.Fatalf("unchanged MTU ran %q", got)
+	}
+
+	if err := tun.SetMTU(1280); err != nil {
+		t.Fatal(err)
+	}
+	want := "ip link set seras0 mtu 1280"
+	if runtime.GOOS == "darwin" {
+		want = "ifconfig seras0 mtu 1280"
+	}
+	if got := r.changes(); !slices.Equal(got, []string{want}) {
+		t.Fatalf("SetMTU ran %q, want %q", got, want)
+	}
+	if tun.MTU() != 1280 {
+		t.Fatalf("MTU() = %d, want 1280", tun.MTU())
+	}
+}
+
+func TestDeviceConfigName(t *testing.T) {
+	skipUnlessLinux(t)
+	cfg, err := deviceConfig("seras-exit.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DeviceType != water.TUN || cfg.Name != "seras-exit.1" {
+		t.Fatalf("config %+v, want a TUN named seras-exit.1", cfg)
+	}
+
+	// Empty leaves the name to the kernel
+	if cfg, err := deviceConfig(""); err != nil || cfg.Name != "" {
+		t.Fatalf("deviceConfig(\"\") = %+v, %v", cfg, err)
+	}
+	if _, err := deviceConfig("bad name"); err == nil {
+		t.Fatal("deviceConfig accepted an invalid name")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"seras0", true},
+		{"wg_exit-2.a", true},
+		{"abcdefghijklmno", true},
+		{"abcdefghijklmnop", false},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"tun/0", false},
+		{"tun 0", false},
+		{"tun:0", false},
+		{"tün0", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("ValidateName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package tuntest provides an in-memory tun.Device for exercising packet
+// loops without root or a kernel TUN
+package tuntest
+
+import (
+	"sync"
+
+	"seras-protocol/internal/tun"
+)
+
+// Device is an in-memory tun.Device. Packets passed to Inject are returned by
+// Read; packets written by the code under test arrive on Written.
+type Device struct {
+	name    string
+	mtu     int
+	in      chan []byte
+	Written chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// Packs queued packets into one Read and splits Writes, as an offload TUN does
+	multiPacket bool
+	held        []byte // Packet that didn't fit the last multi-packet Read
+
+	// Reports io_uring, so clients move packets through ReadBatch and WriteBatch
+	batch bool
+}
+
+var (
+	_ tun.MultiPacketDevice = (*Device)(nil)
+	_ tun.BatchDevice       = (*Device)(nil)
+)
+
+// New creates a device buffering up to queue packets in each direction
+func New(name string, mtu, queue int) *Device {
+	return &Device{
+		name:    name,
+		mtu:     mtu,
+		in:      make(chan []byte, queue),
+		Written: make(chan []byte, queue),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Inject queues a packet for Read
+func (d *Device) Inject(packet []byte) {
+	d.in <- packet
+}
+
+// SetMultiPacket makes Read return every queued packet that fits in the
+// buffer, back to back, and Write split its buffer into packets.
+// Must be called before the device is used.
+func (d *Device) SetMultiPacket(multiPacket bool) {
+	d.multiPacket = multiPacket
+}
+
+// MultiPacket reports whether SetMultiPacket enabled packing
+func (d *Device) MultiPacket() bool {
+	return d.multiPacket
+}
+
+// SetBatch makes HasIOURing report true, so clients batch their TUN I/O.
+// Must be called before the device is used.
+func (d *Device) SetBatch(batch bool) {
+	d.batch = batch
+}
+
+// HasIOURing reports whether SetBatch enabled batching
+func (d *Device) HasIOURing() bool {
+	return d.batch
+}
+
+// ReadBatch blocks for the next injected packet, then takes any others
+// already queued, up to len(bufs)
+func (d *Device) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := d.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	for count := 1; count < len(bufs); count++ {
+		select {
+		case packet := <-d.in:
+			sizes[count] = copy(bufs[count], packet)
+		default:
+			return count, nil
+		}
+	}
+	return len(bufs), nil
+}
+
+// WriteBatch writes each packet in turn
+func (d *Device) WriteBatch(packets [][]byte) (int, error) {
+	for i, packet := range packets {
+		if _, err := d.Write(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// Read returns the next injected packet, or tun.ErrClosed once closed
+func (d *Device) Read(buf []byte) (int, error) {
+	var n int
+	if d.held != nil {
+		n, d.held = copy(buf, d.held), nil
+	} else {
+		select {
+		case packet := <-d.in:
+			n = copy(buf, packet)
+		case <-d.closed:
+			return 0, tun.ErrClosed
+		}
+	}
+	for d.multiPacket {
+		select {
+		case packet := <-d.in:
+			if n+len(packet) > len(buf) {
+				d.held = packet
+				return n, nil
+			}
+			n += copy(buf[n:], packet)
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// Write copies the packet to Written, or fails with tun.ErrClosed once closed
+func (d *Device) Write(buf []byte) (int, error) {
+	packets := [][]byte{buf}
+	if d.multiPacket {
+		var err error
+		if packets, err = tun.SplitPackets(buf, nil); err != nil {
+			return 0, err
+		}
+	}
+	for _, packet := range packets {
+		select {
+		case d.Written <- append([]byte(nil), packet...):
+		case <-d.closed:
+			return 0, tun.ErrClosed
+		}
+	}
+	return len(buf), nil
+}
+
+// Close unblocks pending reads and writes
+func (d *Device) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) MTU() int {
+	return d.mtu
+}
+
+// SetLocalIP is a no-op, so Device also satisfies the client's device
+func (d *Device) SetLocalIP(ip string) error {
+	return nil
+}
+
+// SetLocalIP6 is a no-op
+func (d *Device) SetLocalIP6(ip string) error {
+	return nil
+}
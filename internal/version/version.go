@@ -0,0 +1,39 @@
+// Package version identifies the build. Release builds set the variables at
+// link time:
+//
+//	go build -ldflags "-X seras-protocol/internal/version.Version=v1.2.0 -X seras-protocol/internal/version.Commit=$(git rev-parse --short HEAD)" ./cmd/...
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Version is the release, "dev" for untagged builds
+	Version = "dev"
+	// Commit is the git commit built; when unset, the revision the Go
+	// toolchain stamped into the binary is used instead
+	Commit = ""
+)
+
+// Revision returns the commit the binary was built from, or "unknown"
+func Revision() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// String describes the build as "<version> (commit <commit>, <go version>)"
+func String() string {
+	return fmt.Sprintf("%s (commit %s, %s)", Version, Revision(), runtime.Version())
+}
@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+// LoadConfigFile reads flat "KEY: value" (YAML-style) or "KEY=value" settings from path
+// and exports them as env vars. Variables already set in the environment win.
+// It returns the settings found in the file.
+func LoadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+
+	values, err := godotenv.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, fmt.Errorf("config file %s: set %s: %w", path, key, err)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,80 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a config file in a fresh directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seras.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// unsetEnv clears keys until the test ends, so values a file exports don't
+// leak into other tests
+func unsetEnv(t *testing.T, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func TestLoadConfigFileEnvWins(t *testing.T) {
+	unsetEnv(t, "SERAS_TEST_FILE_ONLY", "SERAS_TEST_BOTH", "SERAS_TEST_EQUALS")
+	t.Setenv("SERAS_TEST_BOTH", "from env")
+
+	path := writeConfig(t, "# profile\nSERAS_TEST_FILE_ONLY: from file\nSERAS_TEST_BOTH: \"from file\"\nSERAS_TEST_EQUALS=1\n")
+	values, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"SERAS_TEST_FILE_ONLY": "from file",
+		"SERAS_TEST_BOTH":      "from env",
+		"SERAS_TEST_EQUALS":    "1",
+	}
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	// The file's own values are returned for validation either way
+	if values["SERAS_TEST_BOTH"] != "from file" || len(values) != 3 {
+		t.Errorf("LoadConfigFile returned %v", values)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	unsetEnv(t, "SERAS_TEST_KEY")
+
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loaded a missing file")
+	}
+
+	for _, content := range []string{
+		"SERAS_TEST_KEY: \"unterminated\n",
+		"just some text\n",
+	} {
+		path := writeConfig(t, content)
+		_, err := LoadConfigFile(path)
+		if err == nil {
+			t.Errorf("loaded malformed file %q", content)
+			continue
+		}
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("error %q doesn't name the file", err)
+		}
+	}
+	if _, set := os.LookupEnv("SERAS_TEST_KEY"); set {
+		t.Error("malformed file exported settings")
+	}
+}
@@ -5,13 +5,20 @@ import (
 	"seras-protocol/pkg/taiga/msg"
 )
 
+// ConvertStringToConnType maps a connection type name to its protocol
 func ConvertStringToConnType(s string) (msg.Protocol, error) {
 	switch s {
 	case "wg":
 		return msg.Wg, nil
 	case "wss":
 		return msg.Wss, nil
+	case "udp":
+		return msg.Udp, nil
+	case "v2ray":
+		return msg.V2Ray, nil
+	case "tcp":
+		return msg.Tcp, nil
 	default:
-		return "", fmt.Errorf("invalid connection type")
+		return "", fmt.Errorf("connection type must be 'wg', 'wss', 'udp', 'v2ray' or 'tcp', got: %s", s)
 	}
 }
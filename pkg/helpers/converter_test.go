@@ -0,0 +1,40 @@
+package helpers
+
+import (
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestConvertStringToConnType(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    msg.Protocol
+		wantErr bool
+	}{
+		{in: "wg", want: msg.Wg},
+		{in: "wss", want: msg.Wss},
+		{in: "udp", want: msg.Udp},
+		{in: "v2ray", want: msg.V2Ray},
+		{in: "tcp", want: msg.Tcp},
+		{in: "quic", wantErr: true},
+		{in: "UDP", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ConvertStringToConnType(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ConvertStringToConnType(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ConvertStringToConnType(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ConvertStringToConnType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// maxKeyFileSize bounds what is read from a key file
+const maxKeyFileSize = 4096
+
+// ErrKeyFileMode is returned for key files other users could read or write
+var ErrKeyFileMode = errors.New("key file must not be accessible to group or others (chmod 600)")
+
+// LoadPrivateKey reads a private key (hex, base64 or bech32) from the file
+// named by name+"_FILE" or, failing that, from the env var name itself. The
+// file takes precedence.
+// The env var is removed once read so child processes do not inherit it.
+func LoadPrivateKey(name string) (msg.Key, error) {
+	var key msg.Key
+	var raw []byte
+	env := os.Getenv(name)
+	os.Unsetenv(name)
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := ReadKeyFile(path)
+		if err != nil {
+			return key, fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		raw = data
+	} else {
+		if env == "" {
+			return key, fmt.Errorf("%s is not set", name)
+		}
+		raw = []byte(env)
+	}
+	defer clear(raw)
+
+	key, err := msg.ParsePrivateKey(string(bytes.TrimSpace(raw)))
+	if err != nil {
+		return key, fmt.Errorf("%s: %w", name, err)
+	}
+	return key, nil
+}
+
+// ReadKeyFile returns the contents of a key file after checking that only
+// the current user can access it
+func ReadKeyFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Check the opened file, so it cannot be swapped after the check
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyFileInfo(info); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, maxKeyFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxKeyFileSize {
+		clear(data)
+		return nil, fmt.Errorf("%s: too large for a key file", path)
+	}
+	return data, nil
+}
+
+// WriteKeyFile writes key as hex to a new file only the current user can read.
+// An existing file is never overwritten.
+func WriteKeyFile(path string, key msg.Key) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	var out [2*len(msg.Key{}) + 1]byte
+	defer clear(out[:])
+	hex.Encode(out[:], key[:])
+	out[len(out)-1] = '\n'
+
+	if _, err := f.Write(out[:]); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkKeyFileInfo rejects key files that are not regular files, are
+// accessible to group or others, or belong to another user
+func checkKeyFileInfo(info fs.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return errors.New("key file is not a regular file")
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%w, has %04o", ErrKeyFileMode, info.Mode().Perm())
+	}
+	return checkOwner(info)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package helpers
+
+import "io/fs"
+
+// checkOwner is a no-op where file ownership is not a uid
+func checkOwner(info fs.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// writeKeyFile writes content to a key file with mode perm
+func writeKeyFile(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Set after creating, so the umask doesn't hide the bits under test
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newKey returns a fresh private key
+func newKey(t *testing.T) msg.Key {
+	t.Helper()
+	private, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestReadKeyFileMode(t *testing.T) {
+	tests := []struct {
+		perm os.FileMode
+		ok   bool
+	}{
+		{0600, true},
+		{0400, true},
+		{0640, false},
+		{0604, false},
+		{0644, false},
+		{0660, false},
+		{0602, false},
+	}
+	for _, tt := range tests {
+		path := writeKeyFile(t, "key", tt.perm)
+		data, err := ReadKeyFile(path)
+		if tt.ok && (err != nil || string(data) != "key") {
+			t.Errorf("mode %04o: got %q, %v; want the key", tt.perm, data, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrKeyFileMode) {
+			t.Errorf("mode %04o: got %v, want ErrKeyFileMode", tt.perm, err)
+		}
+	}
+}
+
+func TestReadKeyFileRejects(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"missing":   filepath.Join(dir, "missing"),
+		"directory": dir,
+		"too large": writeKeyFile(t, strings.Repeat("a", maxKeyFileSize+1), 0600),
+	}
+	for name, path := range tests {
+		if _, err := ReadKeyFile(path); err == nil {
+			t.Errorf("%s: read it as a key file", name)
+		}
+	}
+}
+
+func TestWriteKeyFile(t *testing.T) {
+	key := newKey(t)
+	path := filepath.Join(t.TempDir(), "client.key")
+	if err := WriteKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("written with mode %04o, want 0600", perm)
+	}
+
+	// What keygen writes, the loader reads back
+	t.Setenv("TEST_KEY_FILE", path)
+	got, err := LoadPrivateKey("TEST_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != key {
+		t.Fatal("loaded a different key than was written")
+	}
+
+	if err := WriteKeyFile(path, newKey(t)); err == nil {
+		t.Fatal("overwrote an existing key file")
+	}
+	if got, _ := LoadPrivateKey("TEST_KEY"); got != key {
+		t.Fatal("key file changed by a refused write")
+	}
+}
+
+func TestLoadPrivateKeyPrecedence(t *testing.T) {
+	fileKey, envKey := newKey(t), newKey(t)
+	keyFile := writeKeyFile(t, fileKey.Base64()+"\n", 0600)
+	openFile := writeKeyFile(t, fileKey.Hex(), 0644)
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		want    msg.Key
+		wantErr bool
+	}{
+		{"file wins over env", envKey.Hex(), keyFile, fileKey, false},
+		{"file only", "", keyFile, fileKey, false},
+		{"env only", envKey.Hex(), "", envKey, false},
+		{"open file is not skipped for env", envKey.Hex(), openFile, msg.Key{}, true},
+		{"neither", "", "", msg.Key{}, true},
+		{"bad env", "not a key", "", msg.Key{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetEnv(t, "TEST_KEY", "TEST_KEY_FILE")
+			if tt.env != "" {
+				os.Setenv("TEST_KEY", tt.env)
+			}
+			if tt.file != "" {
+				os.Setenv("TEST_KEY_FILE", tt.file)
+			}
+
+			got, err := LoadPrivateKey("TEST_KEY")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatal("loaded the wrong key")
+			}
+			if _, set := os.LookupEnv("TEST_KEY"); set {
+				t.Fatal("TEST_KEY left in the environment")
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package helpers
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// checkOwner rejects files not owned by the current user
+func checkOwner(info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("key file is owned by uid %d, not the current user (uid %d)", st.Uid, os.Geteuid())
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package helpers
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ownedInfo describes a 0600 regular file owned by uid
+type ownedInfo struct {
+	uid uint32
+}
+
+func (i ownedInfo) Name() string       { return "key" }
+func (i ownedInfo) Size() int64        { return 64 }
+func (i ownedInfo) Mode() fs.FileMode  { return 0600 }
+func (i ownedInfo) ModTime() time.Time { return time.Time{} }
+func (i ownedInfo) IsDir() bool        { return false }
+func (i ownedInfo) Sys() any           { return &syscall.Stat_t{Uid: i.uid} }
+
+func TestCheckKeyFileOwner(t *testing.T) {
+	self := uint32(os.Geteuid())
+	if err := checkKeyFileInfo(ownedInfo{uid: self}); err != nil {
+		t.Fatalf("own file: %v", err)
+	}
+	err := checkKeyFileInfo(ownedInfo{uid: self + 1})
+	if err == nil || !strings.Contains(err.Error(), "owned by uid") {
+		t.Fatalf("another user's file: got %v, want an ownership error", err)
+	}
+}
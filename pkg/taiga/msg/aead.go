@@ -0,0 +1,52 @@
+package msg
+
+import (
+	"crypto/cipher"
+	"sync"
+)
+
+// aeadCacheSize bounds the ciphers a session keeps: its sending key and its
+// current and previous receiving keys, with room for one rekey in flight
+const aeadCacheSize = 4
+
+// aeadEntry is one cached cipher and the key it was built from
+type aeadEntry struct {
+	key  Key
+	aead cipher.AEAD
+}
+
+// aeadCache reuses a suite's ciphers for keys that seal or open many
+// messages, so the key schedule isn't redone per packet. The oldest entry is
+// evicted once aeadCacheSize are held. Safe for concurrent use.
+type aeadCache struct {
+	suite   CipherSuite
+	mu      sync.Mutex
+	entries []aeadEntry
+}
+
+// get returns the cipher for key, building and caching it if needed
+func (c *aeadCache) get(key []byte) (cipher.AEAD, error) {
+	if len(key) != len(Key{}) {
+		return c.suite.NewAEAD(key)
+	}
+	k := Key(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries {
+		if entry.key == k {
+			return entry.aead, nil
+		}
+	}
+
+	aead, err := c.suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.entries) == aeadCacheSize {
+		copy(c.entries, c.entries[1:])
+		c.entries = c.entries[:aeadCacheSize-1]
+	}
+	c.entries = append(c.entries, aeadEntry{key: k, aead: aead})
+	return aead, nil
+}
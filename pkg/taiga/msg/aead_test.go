@@ -0,0 +1,124 @@
+package msg
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"seras-protocol/internal/bufpool"
+)
+
+// BenchmarkSeal seals with a stable key, building its cipher for every packet
+// or taking it from a session's cache, to show what reusing the cipher saves
+func BenchmarkSeal(b *testing.B) {
+	for _, size := range []int{64, 576, 1300} {
+		for _, reuse := range []bool{false, true} {
+			name := fmt.Sprintf("rebuilt/%dB", size)
+			if reuse {
+				name = fmt.Sprintf("reused/%dB", size)
+			}
+			b.Run(name, func(b *testing.B) {
+				key := make([]byte, len(Key{}))
+				var nonce Nonce
+				plaintext := make([]byte, size)
+				sealBuf := make([]byte, bufpool.Size)
+				cache := &aeadCache{suite: defaultSuite}
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					get := defaultSuite.NewAEAD
+					if reuse {
+						get = cache.get
+					}
+					aead, err := get(key)
+					if err != nil {
+						b.Fatal(err)
+					}
+					aead.Seal(sealBuf[:0], nonce[:], plaintext, nil)
+				}
+			})
+		}
+	}
+}
+
+// testKey returns a key whose bytes are all b
+func testKey(b byte) []byte {
+	key := make([]byte, len(Key{}))
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func TestAEADCacheReusesAndEvicts(t *testing.T) {
+	cache := &aeadCache{suite: defaultSuite}
+	first, err := cache.get(testKey(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cache.get(testKey(0)); again != first {
+		t.Fatal("built a second cipher for the same key")
+	}
+
+	// Filling the cache pushes out the oldest key, and only that one
+	for i := 1; i <= aeadCacheSize; i++ {
+		if _, err := cache.get(testKey(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.entries) != aeadCacheSize {
+		t.Fatalf("cache holds %d ciphers, want %d", len(cache.entries), aeadCacheSize)
+	}
+	for _, entry := range cache.entries {
+		if entry.key == Key(testKey(0)) {
+			t.Fatal("oldest key still cached")
+		}
+	}
+	if rebuilt, _ := cache.get(testKey(0)); rebuilt == first {
+		t.Fatal("evicted cipher came back")
+	}
+
+	// Keys of the wrong size are the suite's to reject, and never cached
+	if _, err := cache.get(make([]byte, 16)); err == nil {
+		t.Fatal("built a cipher from a 16-byte key")
+	}
+	if len(cache.entries) != aeadCacheSize {
+		t.Fatalf("cache holds %d ciphers after a bad key", len(cache.entries))
+	}
+}
+
+func TestAEADCacheConcurrentUse(t *testing.T) {
+	cache := &aeadCache{suite: defaultSuite}
+	var nonce Nonce
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := testKey(byte((g + i) % (2 * aeadCacheSize)))
+				aead, err := cache.get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Whatever came back seals and opens under this key
+				want, err := defaultSuite.NewAEAD(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				sealed := aead.Seal(nil, nonce[:], []byte("packet"), nil)
+				if _, err := want.Open(nil, nonce[:], sealed, nil); err != nil {
+					t.Errorf("cached cipher for key %d: %v", key[0], err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(cache.entries) > aeadCacheSize {
+		t.Fatalf("cache grew to %d ciphers", len(cache.entries))
+	}
+}
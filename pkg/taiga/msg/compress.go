@@ -0,0 +1,137 @@
+package msg
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Msg.Flags bits
+const (
+	FlagDeflate   uint32 = 1 << 0 // Data is DEFLATE-compressed
+	FlagStream    uint32 = 1 << 1 // Data is a StreamFrame rather than an IP packet
+	FlagPadded    uint32 = 1 << 2 // Data is padded and ends with its real length
+	FlagKeepalive uint32 = 1 << 3 // Carries nothing; sent to keep NAT mappings open
+	FlagDict      uint32 = 1 << 4 // Data is DEFLATE-compressed against the shared dictionary
+)
+
+// maxDecompressedSize caps inflated payloads at the largest possible IP packet
+const maxDecompressedSize = 65535
+
+// Compression selects how the encoder compresses Msg.Data
+type Compression string
+
+var (
+	CompressionNone    Compression = "none"
+	CompressionDeflate Compression = "deflate"
+	// CompressionDict primes DEFLATE with a dictionary of common packet
+	// headers, so small packets shrink too. Both ends must share it.
+	CompressionDict Compression = "deflate-dict"
+)
+
+// MaxDictionarySize is the DEFLATE window; bytes further back are never used
+const MaxDictionarySize = 32 << 10
+
+// dictionary is what CompressionDict primes DEFLATE with
+var dictionary atomic.Pointer[[]byte]
+
+func init() {
+	dictionary.Store(&defaultDictionary)
+}
+
+// SetDictionary replaces the built-in dictionary for every encoder and
+// decoder in the process; nil restores it. Only the last MaxDictionarySize
+// bytes are used. Peers compressing with CompressionDict must set the same
+// dictionary, or their packets decompress to garbage.
+func SetDictionary(dict []byte) {
+	if dict == nil {
+		dictionary.Store(&defaultDictionary)
+		return
+	}
+	if len(dict) > MaxDictionarySize {
+		dict = dict[len(dict)-MaxDictionarySize:]
+	}
+	dictionary.Store(&dict)
+}
+
+// ParseCompression converts a config string to a Compression
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionDeflate:
+		return CompressionDeflate, nil
+	case CompressionDict:
+		return CompressionDict, nil
+	default:
+		return "", fmt.Errorf("unsupported compression: %s", s)
+	}
+}
+
+// compressMsg returns msg with Data compressed, or msg unchanged when compression
+// is disabled or would not shrink the payload
+func compressMsg(msg *Msg, c Compression) (*Msg, error) {
+	if (c != CompressionDeflate && c != CompressionDict) || len(msg.Data) == 0 {
+		return msg, nil
+	}
+
+	var buf bytes.Buffer
+	var w *flate.Writer
+	var err error
+	flag := FlagDeflate
+	if c == CompressionDict {
+		// Only the exhaustive match search finds the dictionary's short
+		// header runs; packets this small keep it cheap
+		w, err = flate.NewWriterDict(&buf, flate.BestCompression, *dictionary.Load())
+		flag = FlagDict
+	} else {
+		w, err = flate.NewWriter(&buf, flate.BestSpeed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := w.Write(msg.Data); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+
+	// Incompressible payloads are sent as-is
+	if buf.Len() >= len(msg.Data) {
+		return msg, nil
+	}
+
+	compressed := *msg
+	compressed.Flags |= flag
+	compressed.Data = buf.Bytes()
+	return &compressed, nil
+}
+
+// decompressMsg inflates Data in place according to msg.Flags
+func decompressMsg(msg *Msg) error {
+	var r io.ReadCloser
+	switch {
+	case msg.Flags&FlagDict != 0:
+		r = flate.NewReaderDict(bytes.NewReader(msg.Data), *dictionary.Load())
+	case msg.Flags&FlagDeflate != 0:
+		r = flate.NewReader(bytes.NewReader(msg.Data))
+	default:
+		return nil
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to decompress data: %w", err)
+	}
+	if len(data) > maxDecompressedSize {
+		return fmt.Errorf("decompressed data exceeds %d bytes", maxDecompressedSize)
+	}
+
+	msg.Data = data
+	msg.Flags &^= FlagDeflate | FlagDict
+	return nil
+}
@@ -0,0 +1,378 @@
+package msg_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/netpkt"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// corpusSize is how many packets the small-packet corpus holds
+const corpusSize = 256
+
+// BenchmarkCompression seals a small-packet corpus with each compression and
+// reports the average sealed body, so the sizes can be compared
+func BenchmarkCompression(b *testing.B) {
+	corpus := smallPackets(corpusSize)
+	for _, c := range []msg.Compression{msg.CompressionNone, msg.CompressionDeflate, msg.CompressionDict} {
+		b.Run(string(c)+"/small", func(b *testing.B) {
+			client, node := sessionPair(b, msg.SuiteChaCha20Poly1305)
+			client.Compression = c
+			window := msg.NewReplayWindow()
+			sealBuf := make([]byte, bufpool.Size)
+			openBuf := make([]byte, bufpool.Size)
+			var plain, sealed int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				packet := corpus[i%len(corpus)]
+				rawMsg, err := client.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: packet}, sealBuf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				plain += len(packet)
+				sealed += len(rawMsg.Body)
+				// Opening checks the packet survives the round trip
+				cooked, err := node.DecryptBodyChecked(rawMsg, window, openBuf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(cooked.Body.Data) != len(packet) {
+					b.Fatalf("packet of %d bytes opened as %d", len(packet), len(cooked.Body.Data))
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(sealed)/float64(b.N), "sealedB/pkt")
+			b.ReportMetric(float64(plain)/float64(b.N), "plainB/pkt")
+		})
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	random := make([]byte, 1200)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	payloads := map[string][]byte{
+		"text":   []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", 20)),
+		"random": random,
+		"packet": smallPackets(1)[0],
+		"empty":  {},
+	}
+
+	for _, c := range []msg.Compression{msg.CompressionNone, msg.CompressionDeflate, msg.CompressionDict} {
+		for name, data := range payloads {
+			t.Run(string(c)+"/"+name, func(t *testing.T) {
+				encoder, decoder := ecdhPair(t)
+				encoder.Compression = c
+				plain, _ := ecdhPair(t)
+
+				rawMsg, err := encoder.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: data}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cooked, err := decoder.DecryptBody(rawMsg, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(cooked.Body.Data, data) {
+					t.Fatal("payload changed in the round trip")
+				}
+				if cooked.Body.Flags&(msg.FlagDeflate|msg.FlagDict) != 0 {
+					t.Fatalf("compression flags %#x left on the opened message", cooked.Body.Flags)
+				}
+
+				// Compared with the same payload sealed uncompressed
+				uncompressed, err := plain.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: data}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case c == msg.CompressionNone || name == "random" || name == "empty":
+					// Incompressible payloads are sent as they are, flag and all
+					if len(rawMsg.Body) != len(uncompressed.Body) {
+						t.Fatalf("sealed %d bytes, want the uncompressed %d", len(rawMsg.Body), len(uncompressed.Body))
+					}
+				case name == "text":
+					if len(rawMsg.Body) >= len(uncompressed.Body)/4 {
+						t.Fatalf("text sealed to %d bytes, barely below the uncompressed %d", len(rawMsg.Body), len(uncompressed.Body))
+					}
+				default:
+					if len(rawMsg.Body) > len(uncompressed.Body) {
+						t.Fatalf("sealed %d bytes, more than the uncompressed %d", len(rawMsg.Body), len(uncompressed.Body))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSessionCompressionRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("hello, tunnel ", 64))
+	for _, c := range []msg.Compression{msg.CompressionDeflate, msg.CompressionDict} {
+		client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+		client.Compression = c
+		rawMsg, err := client.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: data}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rawMsg.Body) >= len(data) {
+			t.Fatalf("%s: sealed %d bytes of %d compressible ones", c, len(rawMsg.Body), len(data))
+		}
+		cooked, err := node.DecryptBodyChecked(rawMsg, msg.NewReplayWindow(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cooked.Body.Data, data) {
+			t.Fatalf("%s: payload changed in the round trip", c)
+		}
+	}
+}
+
+// sealedSizes seals each of packets compressed with c and returns the body
+// sizes, checking every packet opens intact
+func sealedSizes(t *testing.T, c msg.Compression, packets [][]byte) []int {
+	t.Helper()
+	encoder, decoder := ecdhPair(t)
+	encoder.Compression = c
+	sizes := make([]int, len(packets))
+	for i, packet := range packets {
+		rawMsg, err := encoder.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: packet}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cooked, err := decoder.DecryptBody(rawMsg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cooked.Body.Data, packet) {
+			t.Fatalf("%s: packet %d changed in the round trip", c, i)
+		}
+		sizes[i] = len(rawMsg.Body)
+	}
+	return sizes
+}
+
+func TestDictionaryShrinksSmallPackets(t *testing.T) {
+	corpus := smallPackets(corpusSize)
+	none := sealedSizes(t, msg.CompressionNone, corpus)
+	deflate := sealedSizes(t, msg.CompressionDeflate, corpus)
+	dict := sealedSizes(t, msg.CompressionDict, corpus)
+
+	var noneTotal, deflateTotal, dictTotal, shrunk int
+	for i := range corpus {
+		if dict[i] > none[i] {
+			t.Fatalf("packet %d sealed to %d bytes with the dictionary, more than the uncompressed %d", i, dict[i], none[i])
+		}
+		if dict[i] < none[i] {
+			shrunk++
+		}
+		noneTotal += none[i]
+		deflateTotal += deflate[i]
+		dictTotal += dict[i]
+	}
+	t.Logf("sealed bytes per packet: none %.2f, deflate %.2f, deflate-dict %.2f",
+		float64(noneTotal)/corpusSize, float64(deflateTotal)/corpusSize, float64(dictTotal)/corpusSize)
+
+	// Plain DEFLATE can't shrink packets this small; the dictionary can
+	if deflateTotal != noneTotal {
+		t.Fatalf("deflate sealed the corpus to %d bytes, want the uncompressed %d", deflateTotal, noneTotal)
+	}
+	if saved := noneTotal - dictTotal; saved < 3*corpusSize {
+		t.Fatalf("dictionary saved %d bytes over %d packets, want at least 3 per packet", saved, corpusSize)
+	}
+	if shrunk < corpusSize/2 {
+		t.Fatalf("dictionary shrank %d of %d packets, want most", shrunk, corpusSize)
+	}
+}
+
+func TestSetDictionary(t *testing.T) {
+	t.Cleanup(func() { msg.SetDictionary(nil) })
+	rng := rand.New(rand.NewPCG(5, 6))
+	noise := func(n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		return data
+	}
+	payload := noise(200) // Incompressible on its own
+	packets := [][]byte{payload}
+	builtIn := sealedSizes(t, msg.CompressionDict, packets)[0]
+
+	// A dictionary holding the payload reduces it to a back-reference
+	msg.SetDictionary(payload)
+	custom := sealedSizes(t, msg.CompressionDict, packets)[0]
+	if custom >= builtIn-100 {
+		t.Fatalf("sealed %d bytes with a dictionary holding the payload, %d with the built-in one", custom, builtIn)
+	}
+
+	// A peer with another dictionary can't recover the payload
+	encoder, decoder := ecdhPair(t)
+	encoder.Compression = msg.CompressionDict
+	rawMsg, err := encoder.EncryptMsg(&msg.Msg{Timestamp: time.Now().Unix(), Data: payload}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.SetDictionary(noise(200))
+	if cooked, err := decoder.DecryptBody(rawMsg, nil); err == nil && bytes.Equal(cooked.Body.Data, payload) {
+		t.Fatal("opened a payload compressed against another dictionary")
+	}
+
+	// Only the last MaxDictionarySize bytes of a long dictionary count
+	msg.SetDictionary(append(noise(msg.MaxDictionarySize), payload...))
+	if got := sealedSizes(t, msg.CompressionDict, packets)[0]; got != custom {
+		t.Fatalf("sealed %d bytes with the payload at the end of a long dictionary, want %d", got, custom)
+	}
+	msg.SetDictionary(append(payload, noise(msg.MaxDictionarySize)...))
+	if got := sealedSizes(t, msg.CompressionDict, packets)[0]; got != builtIn {
+		t.Fatalf("sealed %d bytes with the payload cut from a long dictionary, want the uncompressed %d", got, builtIn)
+	}
+
+	// nil brings back the built-in dictionary
+	msg.SetDictionary(nil)
+	if got := sealedSizes(t, msg.CompressionDict, smallPackets(1))[0]; got >= sealedSizes(t, msg.CompressionNone, smallPackets(1))[0] {
+		t.Fatal("built-in dictionary not restored")
+	}
+}
+
+func TestDecompressRejectsOversizedPayload(t *testing.T) {
+	// A small message inflating past the largest IP packet
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 1<<20))
+	w.Close()
+
+	// An uncompressing encoder passes the flag through as set
+	encoder, decoder := ecdhPair(t)
+	rawMsg, err := encoder.EncryptMsg(&msg.Msg{Flags: msg.FlagDeflate, Timestamp: time.Now().Unix(), Data: buf.Bytes()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.DecryptBody(rawMsg, nil); err == nil {
+		t.Fatal("opened a payload inflating to 1 MiB")
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    msg.Compression
+		wantErr bool
+	}{
+		{"", msg.CompressionNone, false},
+		{"none", msg.CompressionNone, false},
+		{"deflate", msg.CompressionDeflate, false},
+		{"deflate-dict", msg.CompressionDict, false},
+		{"zstd", "", true},
+		{"DEFLATE", "", true},
+	}
+	for _, tt := range tests {
+		got, err := msg.ParseCompression(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseCompression(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// smallPackets returns n packets like those dominating interactive tunnel
+// traffic: mostly bare TCP ACKs, with SYNs, short pushes and DNS queries,
+// between varied addresses and ports. A fixed seed keeps runs comparable.
+func smallPackets(n int) [][]byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	packets := make([][]byte, n)
+	for i := range packets {
+		src := [4]byte{11, 0, 0, byte(2 + rng.IntN(50))}
+		dst := [4]byte{byte(1 + rng.IntN(223)), byte(rng.IntN(256)), byte(rng.IntN(256)), byte(1 + rng.IntN(254))}
+		switch kind := rng.IntN(10); {
+		case kind < 6:
+			packets[i] = tcpPacket(rng, src, dst, 0x10, nil, 0)
+		case kind < 7:
+			syn := []byte{0x02, 0x04, 0x05, 0xb4, 0x04, 0x02, 0x08, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x03, 0x03, 0x07}
+			packets[i] = tcpPacket(rng, src, dst, 0x02, syn, 0)
+		case kind < 9:
+			packets[i] = tcpPacket(rng, src, dst, 0x18, nil, 20+rng.IntN(60))
+		default:
+			packets[i] = dnsQuery(rng, src)
+		}
+		netpkt.Fix(packets[i])
+	}
+	return packets
+}
+
+// tcpPacket builds an IPv4 TCP packet with timestamps (or the given
+// options) and payload random bytes, as encrypted application data looks
+func tcpPacket(rng *rand.Rand, src, dst [4]byte, flags byte, options []byte, payload int) []byte {
+	if options == nil {
+		options = []byte{0x01, 0x01, 0x08, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(options[4:], rng.Uint32())
+		binary.BigEndian.PutUint32(options[8:], rng.Uint32())
+	}
+	tcpLen := 20 + len(options)
+	packet := make([]byte, 20+tcpLen+payload)
+	ipv4Header(packet, src, dst, 6, rng)
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(32768+rng.IntN(28000)))
+	binary.BigEndian.PutUint16(tcp[2:], []uint16{443, 443, 443, 80, 22}[rng.IntN(5)])
+	binary.BigEndian.PutUint32(tcp[4:], rng.Uint32())
+	binary.BigEndian.PutUint32(tcp[8:], rng.Uint32())
+	tcp[12] = byte(tcpLen/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], uint16(500+rng.IntN(64000)))
+	copy(tcp[20:], options)
+	for i := tcpLen; i < len(tcp); i++ {
+		tcp[i] = byte(rng.Uint32())
+	}
+	return packet
+}
+
+// dnsQuery builds an IPv4 UDP query for the A record of a random name
+func dnsQuery(rng *rand.Rand, src [4]byte) []byte {
+	name := make([]byte, 0, 32)
+	for _, label := range []int{3 + rng.IntN(8), 3 + rng.IntN(5), 3} {
+		name = append(name, byte(label))
+		for range label {
+			name = append(name, byte('a'+rng.IntN(26)))
+		}
+	}
+	name = append(name, 0)
+
+	packet := make([]byte, 20+8+12+len(name)+4)
+	ipv4Header(packet, src, [4]byte{1, 1, 1, 1}, 17, rng)
+	udp := packet[20:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(32768+rng.IntN(28000)))
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	dns := udp[8:]
+	binary.BigEndian.PutUint16(dns[0:], uint16(rng.Uint32()))
+	dns[2] = 0x01 // Recursion desired
+	dns[5] = 1    // One question
+	copy(dns[12:], name)
+	binary.BigEndian.PutUint16(dns[12+len(name):], 1)   // A
+	binary.BigEndian.PutUint16(dns[12+len(name)+2:], 1) // IN
+	return packet
+}
+
+// ipv4Header fills the IPv4 header at the start of packet, which is whole
+func ipv4Header(packet []byte, src, dst [4]byte, protocol byte, rng *rand.Rand) {
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:], uint16(rng.Uint32()))
+	packet[6] = 0x40 // Don't fragment
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+}
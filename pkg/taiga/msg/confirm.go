@@ -0,0 +1,168 @@
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+var (
+	// ErrNodeNotConfirmed is returned for a handshake ack not produced by the
+	// holder of the node's private key
+	ErrNodeNotConfirmed = errors.New("handshake ack not confirmed by node key")
+	// ErrClientNotProven is returned for a handshake not produced by the
+	// holder of the client's private key
+	ErrClientNotProven = errors.New("handshake not proven by client key")
+)
+
+// Key confirmation
+//
+// A handshake ack is encrypted to the client's public key, which anyone can
+// do, so decrypting it proves nothing about who answered. The node therefore
+// sets HandshakeAck.Confirm to an HMAC-SHA256 keyed by the static X25519
+// secret between the node and client keys, which only the node (or the
+// client itself) can compute. The MAC covers the transcript:
+//
+//   - the handshake header: version, type, ephemeral key and nonce, so the
+//     ack answers exactly one handshake
+//   - the client and node public keys
+//   - every other ack field, so none can be swapped in transit
+//
+// Variable-length fields are length-prefixed.
+//
+// The handshake is proven the same way in the other direction: anyone can
+// encrypt one naming any ClientPublicKey, so Handshake.Proof is an HMAC keyed
+// by the static secret between the node and Handshake.Prover under its own
+// label, over the handshake header, both public keys and every other
+// handshake field.
+
+// ConfirmHandshake sets ack.Confirm for the handshake carried under hsHeader
+// from clientPublicKey. d must hold the node's private key.
+func (d *Decoder) ConfirmHandshake(hsHeader *Header, clientPublicKey Key, ack *HandshakeAck) error {
+	nodePublicKey, err := PublicKeyFromPrivate(d.PrivateKey)
+	if err != nil {
+		return err
+	}
+	mac, err := handshakeConfirm(d.PrivateKey, clientPublicKey, hsHeader, clientPublicKey, nodePublicKey, ack)
+	if err != nil {
+		return err
+	}
+	ack.Confirm = mac
+	return nil
+}
+
+// VerifyHandshakeAck checks that ack was confirmed by nodePublicKey's holder
+// for the handshake sent under hsHeader. d must hold the client's private key.
+func (d *Decoder) VerifyHandshakeAck(hsHeader *Header, nodePublicKey Key, ack *HandshakeAck) error {
+	clientPublicKey, err := PublicKeyFromPrivate(d.PrivateKey)
+	if err != nil {
+		return err
+	}
+	mac, err := handshakeConfirm(d.PrivateKey, nodePublicKey, hsHeader, clientPublicKey, nodePublicKey, ack)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac[:], ack.Confirm[:]) {
+		return ErrNodeNotConfirmed
+	}
+	return nil
+}
+
+// verifyHandshake checks hs.Proof for the handshake carried under hsHeader.
+// d must hold the node's private key.
+func (d *Decoder) verifyHandshake(hsHeader *Header, hs *Handshake) error {
+	nodePublicKey, err := PublicKeyFromPrivate(d.PrivateKey)
+	if err != nil {
+		return err
+	}
+	mac, err := handshakeProof(d.PrivateKey, hs.Prover(), hsHeader, hs.ClientPublicKey, nodePublicKey, hs)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac[:], hs.Proof[:]) {
+		return ErrClientNotProven
+	}
+	return nil
+}
+
+// handshakeProof computes the prover's MAC from either side's static key
+func handshakeProof(privateKey, peerPublic Key, hsHeader *Header, clientPublicKey, nodePublicKey Key, hs *Handshake) (Key, error) {
+	h, err := transcriptMAC(privateKey, peerPublic, hsHeader, "handshake_proof", clientPublicKey, nodePublicKey)
+	if err != nil {
+		return Key{}, err
+	}
+	if hs.Session {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(hs.Timestamp)))
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(hs.Versions))))
+	for _, v := range hs.Versions {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		h.Write([]byte(v))
+	}
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(hs.Suites))))
+	for _, s := range hs.Suites {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(s)))
+	}
+	h.Write(hs.Relay[:])
+
+	var mac Key
+	copy(mac[:], h.Sum(nil))
+	return mac, nil
+}
+
+// handshakeConfirm computes the confirmation MAC from either side's static key
+func handshakeConfirm(privateKey, peerPublic Key, hsHeader *Header, clientPublicKey, nodePublicKey Key, ack *HandshakeAck) (Key, error) {
+	h, err := transcriptMAC(privateKey, peerPublic, hsHeader, "handshake_confirm", clientPublicKey, nodePublicKey)
+	if err != nil {
+		return Key{}, err
+	}
+	if ack.Success {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	for _, s := range []string{ack.Message, ack.AssignedIP, ack.AssignedIP6, string(ack.Version)} {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s))))
+		h.Write([]byte(s))
+	}
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(ack.Suite)))
+	h.Write(ack.SessionSeed[:])
+	h.Write(binary.BigEndian.AppendUint32(nil, ack.MTU))
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(ack.DNS))))
+	for _, s := range ack.DNS {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s))))
+		h.Write([]byte(s))
+	}
+
+	var mac Key
+	copy(mac[:], h.Sum(nil))
+	return mac, nil
+}
+
+// transcriptMAC returns an HMAC-SHA256 keyed by the static secret under label,
+// already fed the handshake header and both public keys
+func transcriptMAC(privateKey, peerPublic Key, hsHeader *Header, label string, clientPublicKey, nodePublicKey Key) (hash.Hash, error) {
+	if hsHeader == nil {
+		return nil, ErrMissingHeader
+	}
+	sharedSecret, err := computeShared(privateKey, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := hkdfExpand(sharedSecret, hsHeader.Version, label)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, macKey)
+	h.Write(hsHeader.AAD())
+	h.Write(hsHeader.Nonce[:])
+	h.Write(clientPublicKey[:])
+	h.Write(nodePublicKey[:])
+	return h, nil
+}
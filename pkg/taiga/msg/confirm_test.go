@@ -0,0 +1,93 @@
+package msg_test
+
+import (
+	"errors"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// confirmedAck returns a handshake from client to node and node's ack to it,
+// confirmed with confirmer's private key
+func confirmedAck(t *testing.T, client, node, confirmer msg.Key) (*msg.RawMsg, *msg.HandshakeAck) {
+	t.Helper()
+	clientPublic, err := msg.PublicKeyFromPrivate(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePublic, err := msg.PublicKeyFromPrivate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawHs, err := msg.NewEncoder(nodePublic).EncryptHandshake(&msg.Handshake{ClientPublicKey: clientPublic}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &msg.HandshakeAck{Success: true, Message: "ok", AssignedIP: "10.0.0.2", AssignedIP6: "fd00::2"}
+	if err := msg.NewDecoder(confirmer).ConfirmHandshake(rawHs.Header, clientPublic, ack); err != nil {
+		t.Fatal(err)
+	}
+	return rawHs, ack
+}
+
+// privateKey returns a fresh private key
+func privateKey(t *testing.T) msg.Key {
+	t.Helper()
+	private, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestHandshakeAckConfirmation(t *testing.T) {
+	client, node := privateKey(t), privateKey(t)
+	nodePublic, err := msg.PublicKeyFromPrivate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(rawHs *msg.RawMsg, ack *msg.HandshakeAck) error {
+		return msg.NewDecoder(client).VerifyHandshakeAck(rawHs.Header, nodePublic, ack)
+	}
+
+	rawHs, ack := confirmedAck(t, client, node, node)
+	if err := verify(rawHs, ack); err != nil {
+		t.Fatalf("genuine ack: %v", err)
+	}
+
+	// Any other key answering is caught
+	forgedHs, forged := confirmedAck(t, client, node, privateKey(t))
+	if err := verify(forgedHs, forged); !errors.Is(err, msg.ErrNodeNotConfirmed) {
+		t.Fatalf("ack from another key: got %v, want ErrNodeNotConfirmed", err)
+	}
+
+	// So is an ack moved to another handshake, or altered on the way
+	otherHs, _ := confirmedAck(t, client, node, node)
+	if err := verify(otherHs, ack); !errors.Is(err, msg.ErrNodeNotConfirmed) {
+		t.Fatalf("ack for another handshake: got %v, want ErrNodeNotConfirmed", err)
+	}
+	edits := map[string]func(a *msg.HandshakeAck){
+		"success":  func(a *msg.HandshakeAck) { a.Success = false },
+		"message":  func(a *msg.HandshakeAck) { a.Message = "ok!" },
+		"address":  func(a *msg.HandshakeAck) { a.AssignedIP = "10.0.0.3" },
+		"address6": func(a *msg.HandshakeAck) { a.AssignedIP6 = "" },
+		"suite":    func(a *msg.HandshakeAck) { a.Suite = msg.SuiteAES256GCM },
+		"confirm":  func(a *msg.HandshakeAck) { a.Confirm[0] ^= 1 },
+	}
+	for name, edit := range edits {
+		altered := *ack
+		edit(&altered)
+		if err := verify(rawHs, &altered); !errors.Is(err, msg.ErrNodeNotConfirmed) {
+			t.Errorf("altered %s: got %v, want ErrNodeNotConfirmed", name, err)
+		}
+	}
+
+	// Checked against the wrong node's key, even the genuine ack fails
+	wrongPublic, err := msg.PublicKeyFromPrivate(privateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.NewDecoder(client).VerifyHandshakeAck(rawHs.Header, wrongPublic, ack); !errors.Is(err, msg.ErrNodeNotConfirmed) {
+		t.Fatalf("wrong node key: got %v, want ErrNodeNotConfirmed", err)
+	}
+}
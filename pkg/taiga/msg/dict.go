@@ -0,0 +1,56 @@
+package msg
+
+import "bytes"
+
+// defaultDictionary primes CompressionDict with the headers small tunnel
+// packets are made of, so a bare TCP ACK compresses to a few back-references
+// instead of growing. DEFLATE codes nearer matches more cheaply, so the most
+// common shapes come last. Addresses use the 11.0.0.0/24 example subnet and
+// zero the fields that change per packet (IDs, checksums, sequence numbers).
+var defaultDictionary = bytes.Join([][]byte{
+	// IPv6 TCP ACK with timestamps, hop limit 64
+	{
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x20, 0x06, 0x40,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0xfd, 0x00, 0x5e, 0x7a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0x01, 0xbb, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x80, 0x10, 0x01, 0xf5, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x01, 0x08, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	},
+	// IPv4 UDP DNS query for an A record
+	{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+		0x0b, 0x00, 0x00, 0x02, 0x01, 0x01, 0x01, 0x01,
+		0xc0, 0x00, 0x00, 0x35, 0x00, 0x28, 0x00, 0x00,
+		0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	},
+	// IPv4 TCP SYN to port 443 with Linux's MSS, SACK, timestamp and
+	// window scale options
+	{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0x0b, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x00, 0x01, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xa0, 0x02, 0xfa, 0xf0, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x04, 0x05, 0xb4, 0x04, 0x02, 0x08, 0x0a,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x03, 0x07,
+	},
+	// IPv4 TCP push carrying the start of a TLS record
+	{
+		0x45, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0x0b, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x00, 0x01, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x80, 0x18, 0x01, 0xf5, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x01, 0x08, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x17, 0x03, 0x03, 0x00, 0x00,
+	},
+	// IPv4 TCP ACK with timestamps, the commonest packet on a busy tunnel
+	{
+		0x45, 0x00, 0x00, 0x34, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0x0b, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0xc0, 0x00, 0x01, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x80, 0x10, 0x01, 0xf5, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x01, 0x08, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	},
+}, nil)
@@ -0,0 +1,59 @@
+package msg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// typeLabel returns the HKDF info label separating keys per message type
+func typeLabel(t Type) (string, error) {
+	switch t {
+	case TypeData:
+		return "data", nil
+	case TypeHandshake:
+		return "handshake", nil
+	case TypeHandshakeAck:
+		return "handshake_ack", nil
+	case TypeSessionData:
+		return "session_data", nil
+	case TypeRekey:
+		return "rekey", nil
+	default:
+		return "", fmt.Errorf("no key label for message type %d", t)
+	}
+}
+
+// deriveKey derives suite's key for a message type from the ECDH shared secret.
+// The label binds the key to the protocol version and message type.
+func deriveKey(suite CipherSuite, sharedSecret []byte, version Version, t Type) ([]byte, error) {
+	label, err := typeLabel(t)
+	if err != nil {
+		return nil, err
+	}
+	return suite.DeriveKey(sharedSecret, version, label)
+}
+
+// hkdfExpand derives a key-sized output from secret under a version-bound label
+func hkdfExpand(secret []byte, version Version, label string) ([]byte, error) {
+	info := []byte(string(version) + "/" + label)
+
+	key := make([]byte, len(Key{}))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// checkVersion rejects messages from peers speaking another protocol version
+func (d *Decoder) checkVersion(header *Header) error {
+	if header == nil {
+		return ErrMissingHeader
+	}
+	if header.Version != d.Version {
+		return fmt.Errorf("protocol version mismatch: got %q, want %q", header.Version, d.Version)
+	}
+	return nil
+}
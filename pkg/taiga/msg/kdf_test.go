@@ -0,0 +1,84 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// kdfSecret stands in for an ECDH shared secret: bytes 0x00 to 0x1f
+func kdfSecret() []byte {
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	return secret
+}
+
+func TestDeriveKeyVectors(t *testing.T) {
+	tests := []struct {
+		version Version
+		t       Type
+		want    string
+	}{
+		{Version2, TypeData, "5f0a3b53a023e1553ac98d112bf75818c676e00cd63c158d58baab6d2e626189"},
+		{Version2, TypeHandshake, "2dda81c9c0b290e2cfcd7ca6ac4955457750057ad2331f27e0e6de4735d968fa"},
+		{Version1, TypeData, "514250b22d626cfaea84a59e19be3e2a4510d6bcd06b108d194723ab31922b4c"},
+		{Version1, TypeHandshake, "333de1f13e604ee096b958e63934269f992a5bcc699847084f3391841bfdd107"},
+	}
+	for _, tt := range tests {
+		key, err := deriveKey(chachaSuite{}, kdfSecret(), tt.version, tt.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key); got != tt.want {
+			t.Errorf("deriveKey(%s, %d) = %s, want %s", tt.version, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveKeyDiffersFromSHA256(t *testing.T) {
+	// Keys used to be the bare SHA-256 of the shared secret
+	legacy := sha256.Sum256(kdfSecret())
+	key, err := deriveKey(chachaSuite{}, kdfSecret(), Version2, TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, legacy[:]) {
+		t.Fatal("HKDF key equals the SHA-256 derivation")
+	}
+}
+
+func TestDeriveKeyIndependentPerType(t *testing.T) {
+	types := []Type{TypeData, TypeHandshake, TypeHandshakeAck, TypeSessionData, TypeRekey}
+	seen := make(map[string]Type)
+	for _, typ := range types {
+		key, err := deriveKey(chachaSuite{}, kdfSecret(), Version2, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, dup := seen[string(key)]; dup {
+			t.Fatalf("types %d and %d derive the same key", other, typ)
+		}
+		seen[string(key)] = typ
+	}
+
+	if _, err := deriveKey(chachaSuite{}, kdfSecret(), Version2, Type(0)); err == nil {
+		t.Fatal("derived a key for an unknown message type")
+	}
+}
+
+func TestDeriveKeyIndependentPerSuite(t *testing.T) {
+	chacha, err := deriveKey(chachaSuite{}, kdfSecret(), Version2, TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes, err := deriveKey(aesGCMSuite{}, kdfSecret(), Version2, TypeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(chacha, aes) {
+		t.Fatal("both suites derive the same key from one secret")
+	}
+}
@@ -0,0 +1,184 @@
+package msg
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Bech32 human-readable prefixes, so a private key is never accepted where a
+// public one is expected
+const (
+	PublicKeyHRP  = "seraspub"
+	PrivateKeyHRP = "seraspriv"
+)
+
+// ErrKeyEncoding is returned for keys that are not 32 bytes in a supported encoding
+var ErrKeyEncoding = errors.New("key must be 32 bytes as hex, base64 or bech32")
+
+// Hex returns the canonical encoding of the key
+func (k Key) Hex() string {
+	return hex.EncodeToString(k[:])
+}
+
+// Base64 returns the key in standard padded base64, as WireGuard writes keys
+func (k Key) Base64() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// Bech32 returns the key in bech32 with the given human-readable prefix
+func (k Key) Bech32(hrp string) string {
+	data := convertBits(k[:], 8, 5, true)
+	checksum := bech32Checksum(hrp, data)
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, b := range append(data, checksum...) {
+		sb.WriteByte(bech32Charset[b])
+	}
+	return sb.String()
+}
+
+// DecodeKey parses a key in hex, standard base64 or bech32, detecting the
+// encoding. A bech32 key must carry the given prefix. Errors never include
+// the input, which may be a private key.
+func DecodeKey(s, hrp string) (Key, error) {
+	var k Key
+	switch {
+	case len(s) == hex.EncodedLen(len(k)):
+		if _, err := hex.Decode(k[:], []byte(s)); err != nil {
+			return Key{}, ErrKeyEncoding
+		}
+	case len(s) == base64.StdEncoding.EncodedLen(len(k)):
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) != len(k) {
+			return Key{}, ErrKeyEncoding
+		}
+		copy(k[:], b)
+	case isBech32Key(s):
+		b, err := decodeBech32(s, hrp)
+		if err != nil {
+			return Key{}, err
+		}
+		if len(b) != len(k) {
+			return Key{}, ErrKeyEncoding
+		}
+		copy(k[:], b)
+	default:
+		return Key{}, ErrKeyEncoding
+	}
+	return k, nil
+}
+
+// ParsePrivateKey decodes a private key in any supported encoding
+func ParsePrivateKey(s string) (Key, error) {
+	return DecodeKey(s, PrivateKeyHRP)
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// isBech32Key reports whether s carries one of the key prefixes, so a swapped
+// private and public key get a clear error rather than a generic one
+func isBech32Key(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, PublicKeyHRP+"1") || strings.HasPrefix(s, PrivateKeyHRP+"1")
+}
+
+// decodeBech32 verifies a bech32 string (BIP 173) and returns its payload
+func decodeBech32(s, hrp string) ([]byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return nil, fmt.Errorf("%w: bech32 must not mix case", ErrKeyEncoding)
+	}
+	s = strings.ToLower(s)
+
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return nil, ErrKeyEncoding
+	}
+	if s[:sep] != hrp {
+		return nil, fmt.Errorf("%w: bech32 prefix must be %q, got %q", ErrKeyEncoding, hrp, s[:sep])
+	}
+
+	data := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return nil, fmt.Errorf("%w: invalid bech32 character %q", ErrKeyEncoding, c)
+		}
+		data = append(data, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), data...)) != 1 {
+		return nil, fmt.Errorf("%w: bech32 checksum mismatch", ErrKeyEncoding)
+	}
+
+	b := convertBits(data[:len(data)-6], 5, 8, false)
+	if b == nil {
+		return nil, fmt.Errorf("%w: invalid bech32 padding", ErrKeyEncoding)
+	}
+	return b, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range gen {
+			if (top>>i)&1 != 0 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+func bech32Checksum(hrp string, data []byte) []byte {
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(values) ^ 1
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte(mod>>(5*(5-i))) & 31
+	}
+	return checksum
+}
+
+// convertBits regroups data from fromBits- to toBits-wide values. Without
+// pad, leftover bits must be zero padding, else it returns nil.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) []byte {
+	var acc, bits uint
+	maxv := uint(1)<<toBits - 1
+	out := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		acc = acc<<fromBits | uint(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package msg_test
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// flipChar swaps the bech32 character at i for another valid one
+func flipChar(s string, i int) string {
+	c := byte('q')
+	if s[i] == 'q' {
+		c = 'p'
+	}
+	return s[:i] + string(c) + s[i+1:]
+}
+
+func TestKeyEncodingsRoundTrip(t *testing.T) {
+	private, public, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publics := []string{
+		public.Hex(),
+		strings.ToUpper(public.Hex()),
+		public.Base64(),
+		public.Bech32(msg.PublicKeyHRP),
+		strings.ToUpper(public.Bech32(msg.PublicKeyHRP)),
+	}
+	for _, s := range publics {
+		got, err := msg.ParsePublicKey(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if got != public {
+			t.Fatalf("%s decoded to %x, want %x", s, got, public)
+		}
+	}
+
+	for _, s := range []string{private.Hex(), private.Base64(), private.Bech32(msg.PrivateKeyHRP)} {
+		got, err := msg.ParsePrivateKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != private {
+			t.Fatal("private key changed in a round trip")
+		}
+	}
+
+	// Hex stays the canonical form, and WireGuard's base64 is what Base64 writes
+	if public.Hex() != hex.EncodeToString(public[:]) || public.Base64() != base64.StdEncoding.EncodeToString(public[:]) {
+		t.Fatal("Hex or Base64 differ from the standard encodings")
+	}
+	if !strings.HasPrefix(public.Bech32(msg.PublicKeyHRP), msg.PublicKeyHRP+"1") {
+		t.Fatalf("bech32 key %s lacks its prefix", public.Bech32(msg.PublicKeyHRP))
+	}
+}
+
+func TestDecodeKeyErrors(t *testing.T) {
+	private, public, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub32 := public.Bech32(msg.PublicKeyHRP)
+	short := public[:31]
+	long := append(public[:], 0)
+
+	tests := map[string]string{
+		"empty":                    "",
+		"hex one byte short":       hex.EncodeToString(short),
+		"hex one byte long":        hex.EncodeToString(long),
+		"hex odd length":           public.Hex()[:63],
+		"hex not hex":              strings.Repeat("zz", 32),
+		"base64 one byte short":    base64.StdEncoding.EncodeToString(short),
+		"base64 one byte long":     base64.StdEncoding.EncodeToString(long),
+		"base64 unpadded":          base64.RawStdEncoding.EncodeToString(public[:]),
+		"base64 url alphabet":      strings.NewReplacer("+", "-", "/", "_").Replace(public.Base64()) + "!",
+		"bech32 private as public": private.Bech32(msg.PrivateKeyHRP),
+		"bech32 mixed case":        strings.ToUpper(pub32[:10]) + pub32[10:],
+		"bech32 bad checksum":      flipChar(pub32, len(pub32)-1),
+		"bech32 flipped data":      flipChar(pub32, len(msg.PublicKeyHRP)+5),
+		"bech32 invalid char":      pub32[:len(pub32)-1] + "b",
+		"bech32 truncated":         pub32[:len(pub32)-8],
+	}
+	for name, s := range tests {
+		_, err := msg.ParsePublicKey(s)
+		if !errors.Is(err, msg.ErrKeyEncoding) {
+			t.Errorf("%s: got %v, want ErrKeyEncoding", name, err)
+			continue
+		}
+		if len(s) > 8 && strings.Contains(err.Error(), s) {
+			t.Errorf("%s: error repeats the input", name)
+		}
+	}
+
+	// The same goes for private keys, whose error must never echo them
+	if _, err := msg.ParsePrivateKey(pub32); !errors.Is(err, msg.ErrKeyEncoding) {
+		t.Errorf("public bech32 as private: got %v, want ErrKeyEncoding", err)
+	}
+	if _, err := msg.ParsePrivateKey(private.Hex()[:62]); err == nil || strings.Contains(err.Error(), private.Hex()[:62]) {
+		t.Errorf("short private key: got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package msg
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var ErrLowOrderKey = errors.New("public key is a low-order Curve25519 point")
+
+// lowOrderPoints are the encodings of Curve25519 points of order 1, 2, 4 and 8,
+// including non-canonical ones, that force the shared secret to a known value
+var lowOrderPoints = func() []Key {
+	encodings := []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+		"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+		"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"cdeb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b880",
+		"4c9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f11d7",
+		"d9ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		"daffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		"dbffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	}
+	points := make([]Key, len(encodings))
+	for i, enc := range encodings {
+		b, err := hex.DecodeString(enc)
+		if err != nil {
+			panic(err)
+		}
+		copy(points[i][:], b)
+	}
+	return points
+}()
+
+// Validate rejects public keys that are known low-order points.
+// The top bit is ignored, as X25519 does.
+func (k Key) Validate() error {
+	masked := k
+	masked[31] &= 0x7f
+	for _, p := range lowOrderPoints {
+		if subtle.ConstantTimeCompare(k[:], p[:]) == 1 || subtle.ConstantTimeCompare(masked[:], p[:]) == 1 {
+			return ErrLowOrderKey
+		}
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a hex, base64 or bech32 public key and validates it
+func ParsePublicKey(s string) (Key, error) {
+	k, err := DecodeKey(s, PublicKeyHRP)
+	if err != nil {
+		return Key{}, fmt.Errorf("public %w", err)
+	}
+	if err := k.Validate(); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Clamp canonicalizes a Curve25519 private scalar as defined in RFC 7748
+func (k *Key) Clamp() {
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+}
+
+// computeShared performs X25519 after rejecting low-order peer keys.
+// X25519 itself also fails on an all-zero result.
+func computeShared(privateKey, peerPublic Key) ([]byte, error) {
+	if err := peerPublic.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	sharedSecret, err := curve25519.X25519(privateKey[:], peerPublic[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	return sharedSecret, nil
+}
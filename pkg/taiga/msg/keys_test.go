@@ -0,0 +1,105 @@
+package msg_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// smallOrder is the classic list of Curve25519 points of small order
+// (libsodium's blocklist): the neutral element, the point of order 2, both
+// points of order 8, and non-canonical encodings of the same points
+var smallOrder = []string{
+	"0000000000000000000000000000000000000000000000000000000000000000",
+	"0100000000000000000000000000000000000000000000000000000000000000",
+	"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+	"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+}
+
+// lowOrderKeys returns smallOrder, and each point with the top bit set,
+// which X25519 ignores
+func lowOrderKeys(t *testing.T) []msg.Key {
+	t.Helper()
+	var keys []msg.Key
+	for _, enc := range smallOrder {
+		b, err := hex.DecodeString(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var k msg.Key
+		copy(k[:], b)
+		high := k
+		high[31] |= 0x80
+		keys = append(keys, k, high)
+	}
+	return keys
+}
+
+func TestValidateRejectsLowOrderPoints(t *testing.T) {
+	private, _, err := msg.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range lowOrderKeys(t) {
+		// Sanity check: each really does force the shared secret to zero
+		if shared, err := curve25519.X25519(private[:], k[:]); err == nil {
+			t.Fatalf("%x: X25519 gave %x, want the all-zero error", k, shared)
+		}
+		if err := k.Validate(); !errors.Is(err, msg.ErrLowOrderKey) {
+			t.Errorf("%x: Validate = %v, want ErrLowOrderKey", k, err)
+		}
+		if _, err := msg.ParsePublicKey(hex.EncodeToString(k[:])); !errors.Is(err, msg.ErrLowOrderKey) {
+			t.Errorf("%x: ParsePublicKey = %v, want ErrLowOrderKey", k, err)
+		}
+	}
+}
+
+func TestGeneratedKeysAreClampedAndValid(t *testing.T) {
+	for range 32 {
+		private, public, err := msg.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if private[0]&7 != 0 || private[31]&0x80 != 0 || private[31]&0x40 == 0 {
+			t.Fatalf("private key %x is not clamped", private)
+		}
+		if err := public.Validate(); err != nil {
+			t.Fatalf("generated public key %x: %v", public, err)
+		}
+		// Deriving from an unclamped copy gives the same public key
+		unclamped := private
+		unclamped[0] |= 7
+		unclamped[31] |= 0x80
+		if derived, err := msg.PublicKeyFromPrivate(unclamped); err != nil || derived != public {
+			t.Fatalf("PublicKeyFromPrivate of the unclamped key = %x, %v; want %x", derived, err, public)
+		}
+	}
+}
+
+func TestEncryptDecryptRejectLowOrderKeys(t *testing.T) {
+	encoder, decoder := ecdhPair(t)
+	rawMsg, err := encoder.EncryptMsg(testPacket(64), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range lowOrderKeys(t) {
+		forged := *rawMsg
+		header := *rawMsg.Header
+		header.EphemeralKey = k
+		forged.Header = &header
+		if _, err := decoder.DecryptBody(&forged, nil); !errors.Is(err, msg.ErrLowOrderKey) {
+			t.Errorf("ephemeral key %x: DecryptBody = %v, want ErrLowOrderKey", k, err)
+		}
+
+		if _, err := msg.NewEncoder(k).EncryptMsg(testPacket(64), nil); !errors.Is(err, msg.ErrLowOrderKey) {
+			t.Errorf("node key %x: EncryptMsg = %v, want ErrLowOrderKey", k, err)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package msg
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/kelindar/binary"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -15,34 +16,66 @@ type Protocol string
 var (
 	Wg    Protocol = "wg"
 	Wss   Protocol = "wss"
+	Udp   Protocol = "udp"
 	V2Ray Protocol = "v2ray"
+	Tcp   Protocol = "tcp"
 )
 
 type Version string
 
 var (
 	Version1 Version = "taiga_v1_alpha"
+	Version2 Version = "taiga_v2_alpha" // HKDF-SHA256 key derivation
 )
 
 type Key [32]byte
-type Nonce [12]byte // ChaCha20Poly1305 uses 12-byte nonce
+type Nonce [12]byte // Every cipher suite uses 12-byte nonces
 type Type uint8
 
 var (
 	TypeData         Type = 1
 	TypeHandshake    Type = 2
 	TypeHandshakeAck Type = 3
+	TypeSessionData  Type = 4 // Data sealed with the session key
+	TypeRekey        Type = 5 // Sender ratcheted its session key
 )
 
 // Handshake is sent by client to register its public key
 type Handshake struct {
 	ClientPublicKey Key
+	Session         bool      // Client asks for session mode instead of per-message ECDH
+	Timestamp       int64     // Unix time the client sent it; bounds how long it can be replayed
+	Versions        []Version // Protocol versions the client speaks, preferred first
+	Suites          []Suite   // Cipher suites the client speaks, preferred first
+	Proof           Key       // Transcript MAC proving the sender holds Prover's private key
+	// Static key of the node relaying a circuit, zero from clients. Each relay
+	// link then handshakes with its own ClientPublicKey, which Relay vouches for.
+	Relay Key
+}
+
+// Prover returns the key whose holder made the proof, and who the sender is
+// for access control: the relaying node, or else the client
+func (hs *Handshake) Prover() Key {
+	if hs.Relay != (Key{}) {
+		return hs.Relay
+	}
+	return hs.ClientPublicKey
 }
 
 // HandshakeAck is sent by node to confirm registration
 type HandshakeAck struct {
-	Success bool
-	Message string
+	Success     bool
+	Message     string
+	AssignedIP  string  // Client's VPN address leased by the node
+	AssignedIP6 string  // Client's IPv6 VPN address, empty if IPv6 is disabled
+	SessionSeed Key     // Session key material; zero when session mode was not granted
+	Confirm     Key     // Proves the node holds its private key; see ConfirmHandshake
+	Version     Version // Protocol version the node selected for the session
+	Suite       Suite   // Cipher suite the node selected for the session
+
+	// Network settings the node recommends; zero or empty leaves the client's own
+	MTU uint32   // TUN MTU
+	DNS []string // Resolver addresses
 }
 
 // NextHop describes routing to the next node in circuit
@@ -65,7 +98,17 @@ type Header struct {
 	Version      Version
 	Type         Type
 	EphemeralKey Key   // Sender's ephemeral public key for ECDH
-	Nonce        Nonce // 12-byte nonce for ChaCha20Poly1305
+	Nonce        Nonce // 12-byte AEAD nonce
+}
+
+// AAD returns the canonical header bytes authenticated alongside the ciphertext.
+// The nonce is omitted since the AEAD already binds it.
+func (h *Header) AAD() []byte {
+	aad := make([]byte, 0, len(h.Version)+2+len(h.EphemeralKey))
+	aad = append(aad, h.Version...)
+	aad = append(aad, 0, byte(h.Type))
+	aad = append(aad, h.EphemeralKey[:]...)
+	return aad
 }
 
 // RawMsg is the wire format
@@ -74,6 +117,63 @@ type RawMsg struct {
 	Body   []byte // encrypted Msg
 }
 
+// MaxMessageSize bounds an encoded message and its body: the largest IP packet
+// plus headroom for the headers of nested circuit layers. Anything larger is
+// rejected before it is decoded or decrypted.
+const MaxMessageSize = 128 << 10
+
+// LayerOverhead is the most one encryption layer adds around its payload:
+// header, AEAD tag and Msg framing including a NextHop
+const LayerOverhead = 256
+
+// FrameLimit returns the largest encoded message needed to carry an
+// mtu-sized packet through the given number of circuit layers
+func FrameLimit(mtu, layers int) int {
+	return min(mtu+layers*LayerOverhead, MaxMessageSize)
+}
+
+var (
+	ErrMissingHeader   = errors.New("message has no header")
+	ErrUnknownVersion  = errors.New("unknown protocol version")
+	ErrUnknownType     = errors.New("unknown message type")
+	ErrMessageTooLarge = errors.New("message exceeds MaxMessageSize")
+)
+
+// Decode unmarshals a wire message and validates its header
+func Decode(data []byte) (*RawMsg, error) {
+	if len(data) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(data))
+	}
+
+	rawMsg := &RawMsg{}
+	if err := unmarshal(data, rawMsg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	if err := rawMsg.Validate(); err != nil {
+		return nil, err
+	}
+	return rawMsg, nil
+}
+
+// Validate rejects a malformed header before any decryption is attempted.
+// The returned error wraps ErrMissingHeader, ErrUnknownVersion or ErrUnknownType.
+func (m *RawMsg) Validate() error {
+	if m.Header == nil {
+		return ErrMissingHeader
+	}
+	switch m.Header.Version {
+	case Version1, Version2:
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownVersion, m.Header.Version)
+	}
+	switch m.Header.Type {
+	case TypeData, TypeHandshake, TypeHandshakeAck, TypeSessionData, TypeRekey:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownType, m.Header.Type)
+	}
+	return nil
+}
+
 // CookedMsg is decrypted message
 type CookedMsg struct {
 	Header *Header
@@ -90,25 +190,34 @@ type Endpoint interface {
 type Encoder struct {
 	NodePublicKey Key // Public key of the target node
 	Version       Version
+	Suite         Suite         // Cipher suite data messages are sealed with
+	Compression   Compression   // Payload compression for data messages
+	Padding       Padding       // Payload padding for data messages
+	PadSize       int           // Length PaddingMax pads Data to
+	counter       atomic.Uint64 // Data nonce counter for replay protection
 }
 
 // Decoder decrypts received messages
 type Decoder struct {
-	PrivateKey Key
-	Version    Version
+	PrivateKey    Key
+	Version       Version
+	Suite         Suite         // Cipher suite data messages are opened with
+	TimestampSkew time.Duration // As Session.TimestampSkew
 }
 
 func NewEncoder(nodePublicKey Key) *Encoder {
 	return &Encoder{
 		NodePublicKey: nodePublicKey,
-		Version:       Version1,
+		Version:       Version2,
+		Compression:   CompressionNone,
+		Padding:       PaddingNone,
 	}
 }
 
 func NewDecoder(privateKey Key) *Decoder {
 	return &Decoder{
 		PrivateKey: privateKey,
-		Version:    Version1,
+		Version:    Version2,
 	}
 }
 
@@ -117,6 +226,7 @@ func GenerateKeyPair() (privateKey, publicKey Key, err error) {
 	if _, err = rand.Read(privateKey[:]); err != nil {
 		return Key{}, Key{}, fmt.Errorf("failed to generate private key: %w", err)
 	}
+	privateKey.Clamp()
 
 	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
 	if err != nil {
@@ -129,6 +239,7 @@ func GenerateKeyPair() (privateKey, publicKey Key, err error) {
 
 // PublicKeyFromPrivate derives public key from private key
 func PublicKeyFromPrivate(privateKey Key) (Key, error) {
+	privateKey.Clamp()
 	var publicKey Key
 	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
 	if err != nil {
@@ -138,8 +249,14 @@ func PublicKeyFromPrivate(privateKey Key) (Key, error) {
 	return publicKey, nil
 }
 
-// EncryptMsg encrypts a message for the target node
-func (e *Encoder) EncryptMsg(msg *Msg) (*RawMsg, error) {
+// EncryptMsg encrypts a message for the target node.
+// The ciphertext is written to dst[:0] when it fits (nil allocates), so the
+// returned Body aliases dst until the caller marshals it.
+func (e *Encoder) EncryptMsg(msg *Msg, dst []byte) (*RawMsg, error) {
+	if len(msg.Data) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes of data", ErrMessageTooLarge, len(msg.Data))
+	}
+
 	// Generate ephemeral key pair
 	var ephemeralPrivate, ephemeralPublic Key
 	if _, err := rand.Read(ephemeralPrivate[:]); err != nil {
@@ -154,34 +271,45 @@ func (e *Encoder) EncryptMsg(msg *Msg) (*RawMsg, error) {
 	copy(ephemeralPublic[:], pub)
 
 	// Compute shared secret
-	sharedSecret, err := curve25519.X25519(ephemeralPrivate[:], e.NodePublicKey[:])
+	sharedSecret, err := computeShared(ephemeralPrivate, e.NodePublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
 	// Derive encryption key
-	encKey := sha256.Sum256(sharedSecret)
-
-	// Generate random nonce
-	var nonce Nonce
-	if _, err := rand.Read(nonce[:]); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	suite, err := LookupSuite(e.Suite)
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := deriveKey(suite, sharedSecret, e.Version, TypeData)
+	if err != nil {
+		return nil, err
 	}
 
+	// Monotonic counter nonce so receivers can track replays
+	nonce := counterNonce(e.counter.Add(1))
+
 	// Create cipher
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := suite.NewAEAD(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compress payload before encryption
+	msg, err = compressMsg(msg, e.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
+	// Pad after compressing, so the compressed size is hidden too
+	msg = padMsg(msg, e.Padding, e.PadSize)
+
 	// Marshal and encrypt message
 	data, err := binary.Marshal(msg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	encryptedBody := cipher.Seal(nil, nonce[:], data, nil)
-
 	header := &Header{
 		Version:      e.Version,
 		Type:         TypeData,
@@ -189,43 +317,90 @@ func (e *Encoder) EncryptMsg(msg *Msg) (*RawMsg, error) {
 		Nonce:        nonce,
 	}
 
+	// Header is authenticated as additional data
+	encryptedBody := cipher.Seal(dst[:0], nonce[:], data, header.AAD())
 	return &RawMsg{Header: header, Body: encryptedBody}, nil
 }
 
-// DecryptBody decrypts a received message
-func (d *Decoder) DecryptBody(rawMsg *RawMsg) (*CookedMsg, error) {
+// DecryptBody decrypts a received message.
+// dst is scratch space for the plaintext (nil allocates); the result never aliases it.
+func (d *Decoder) DecryptBody(rawMsg *RawMsg, dst []byte) (*CookedMsg, error) {
+	if err := d.checkVersion(rawMsg.Header); err != nil {
+		return nil, err
+	}
+	if len(rawMsg.Body) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes of body", ErrMessageTooLarge, len(rawMsg.Body))
+	}
+
 	// Compute shared secret
-	sharedSecret, err := curve25519.X25519(d.PrivateKey[:], rawMsg.Header.EphemeralKey[:])
+	sharedSecret, err := computeShared(d.PrivateKey, rawMsg.Header.EphemeralKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
 	// Derive encryption key
-	encKey := sha256.Sum256(sharedSecret)
+	suite, err := LookupSuite(d.Suite)
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := deriveKey(suite, sharedSecret, d.Version, TypeData)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create cipher
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := suite.NewAEAD(encKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
 	// Decrypt
-	data, err := cipher.Open(nil, rawMsg.Header.Nonce[:], rawMsg.Body, nil)
+	data, err := cipher.Open(dst[:0], rawMsg.Header.Nonce[:], rawMsg.Body, rawMsg.Header.AAD())
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt body: %w", err)
 	}
 
 	// Unmarshal message
 	msg := &Msg{}
-	if err := binary.Unmarshal(data, msg); err != nil {
+	if err := unmarshal(data, msg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
 	}
 
+	if err := unpadMsg(msg); err != nil {
+		return nil, err
+	}
+	if err := decompressMsg(msg); err != nil {
+		return nil, err
+	}
+
 	return &CookedMsg{Header: rawMsg.Header, Body: msg}, nil
 }
 
-// EncryptHandshake encrypts a handshake message for the node
-func (e *Encoder) EncryptHandshake(hs *Handshake) (*RawMsg, error) {
+// DecryptBodyChecked decrypts a message and rejects replays, and timestamps
+// further than TimestampSkew from now when it is set. The window must be
+// dedicated to a single sender.
+func (d *Decoder) DecryptBodyChecked(rawMsg *RawMsg, window *ReplayWindow, dst []byte) (*CookedMsg, error) {
+	cookedMsg, err := d.DecryptBody(rawMsg, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.TimestampSkew > 0 {
+		if err := checkTimestamp(cookedMsg.Body.Timestamp, d.TimestampSkew); err != nil {
+			return nil, err
+		}
+	}
+
+	if !window.Accept(rawMsg.Header.Nonce.Counter()) {
+		return nil, ErrReplayedMsg
+	}
+
+	return cookedMsg, nil
+}
+
+// EncryptHandshake encrypts a handshake message for the node, setting
+// hs.Proof with proverPrivateKey, the key behind hs.Prover()
+func (e *Encoder) EncryptHandshake(hs *Handshake, proverPrivateKey Key) (*RawMsg, error) {
 	var ephemeralPrivate, ephemeralPublic Key
 	if _, err := rand.Read(ephemeralPrivate[:]); err != nil {
 		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
@@ -237,30 +412,26 @@ func (e *Encoder) EncryptHandshake(hs *Handshake) (*RawMsg, error) {
 	}
 	copy(ephemeralPublic[:], pub)
 
-	sharedSecret, err := curve25519.X25519(ephemeralPrivate[:], e.NodePublicKey[:])
+	sharedSecret, err := computeShared(ephemeralPrivate, e.NodePublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
-	encKey := sha256.Sum256(sharedSecret)
+	encKey, err := deriveKey(defaultSuite, sharedSecret, e.Version, TypeHandshake)
+	if err != nil {
+		return nil, err
+	}
 
 	var nonce Nonce
 	if _, err := rand.Read(nonce[:]); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := defaultSuite.NewAEAD(encKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
-	data, err := binary.Marshal(hs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal handshake: %w", err)
-	}
-
-	encryptedBody := cipher.Seal(nil, nonce[:], data, nil)
-
 	header := &Header{
 		Version:      e.Version,
 		Type:         TypeHandshake,
@@ -268,37 +439,72 @@ func (e *Encoder) EncryptHandshake(hs *Handshake) (*RawMsg, error) {
 		Nonce:        nonce,
 	}
 
+	if hs.Proof, err = handshakeProof(proverPrivateKey, e.NodePublicKey, header, hs.ClientPublicKey, e.NodePublicKey, hs); err != nil {
+		return nil, err
+	}
+
+	data, err := binary.Marshal(hs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal handshake: %w", err)
+	}
+
+	// Header is authenticated as additional data
+	encryptedBody := cipher.Seal(nil, nonce[:], data, header.AAD())
 	return &RawMsg{Header: header, Body: encryptedBody}, nil
 }
 
-// DecryptHandshake decrypts a handshake message
+// DecryptHandshake decrypts a handshake message in any supported version,
+// rejecting one whose timestamp is further than MaxClockSkew from now with
+// ErrStaleMsg and one whose proof fails with ErrClientNotProven
 func (d *Decoder) DecryptHandshake(rawMsg *RawMsg) (*Handshake, error) {
-	sharedSecret, err := curve25519.X25519(d.PrivateKey[:], rawMsg.Header.EphemeralKey[:])
+	if err := checkSupported(rawMsg.Header); err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := computeShared(d.PrivateKey, rawMsg.Header.EphemeralKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
-	encKey := sha256.Sum256(sharedSecret)
+	encKey, err := deriveKey(defaultSuite, sharedSecret, rawMsg.Header.Version, TypeHandshake)
+	if err != nil {
+		return nil, err
+	}
 
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := defaultSuite.NewAEAD(encKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
-	data, err := cipher.Open(nil, rawMsg.Header.Nonce[:], rawMsg.Body, nil)
+	data, err := cipher.Open(nil, rawMsg.Header.Nonce[:], rawMsg.Body, rawMsg.Header.AAD())
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt handshake: %w", err)
 	}
 
 	hs := &Handshake{}
-	if err := binary.Unmarshal(data, hs); err != nil {
+	if err := unmarshal(data, hs); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal handshake: %w", err)
 	}
+	if err := hs.ClientPublicKey.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid client public key: %w", err)
+	}
+	if hs.Relay != (Key{}) {
+		if err := hs.Relay.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid relay public key: %w", err)
+		}
+	}
+	if err := checkTimestamp(hs.Timestamp, MaxClockSkew); err != nil {
+		return nil, err
+	}
+	if err := d.verifyHandshake(rawMsg.Header, hs); err != nil {
+		return nil, err
+	}
 
 	return hs, nil
 }
 
-// EncryptHandshakeAck encrypts a handshake ack for the client
+// EncryptHandshakeAck encrypts a handshake ack for the client. e.Version
+// should be that of the handshake it answers, which the client can read.
 func (e *Encoder) EncryptHandshakeAck(ack *HandshakeAck) (*RawMsg, error) {
 	var ephemeralPrivate, ephemeralPublic Key
 	if _, err := rand.Read(ephemeralPrivate[:]); err != nil {
@@ -311,21 +517,24 @@ func (e *Encoder) EncryptHandshakeAck(ack *HandshakeAck) (*RawMsg, error) {
 	}
 	copy(ephemeralPublic[:], pub)
 
-	sharedSecret, err := curve25519.X25519(ephemeralPrivate[:], e.NodePublicKey[:])
+	sharedSecret, err := computeShared(ephemeralPrivate, e.NodePublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
-	encKey := sha256.Sum256(sharedSecret)
+	encKey, err := deriveKey(defaultSuite, sharedSecret, e.Version, TypeHandshakeAck)
+	if err != nil {
+		return nil, err
+	}
 
 	var nonce Nonce
 	if _, err := rand.Read(nonce[:]); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := defaultSuite.NewAEAD(encKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
 	data, err := binary.Marshal(ack)
@@ -333,8 +542,6 @@ func (e *Encoder) EncryptHandshakeAck(ack *HandshakeAck) (*RawMsg, error) {
 		return nil, fmt.Errorf("failed to marshal ack: %w", err)
 	}
 
-	encryptedBody := cipher.Seal(nil, nonce[:], data, nil)
-
 	header := &Header{
 		Version:      e.Version,
 		Type:         TypeHandshakeAck,
@@ -342,30 +549,39 @@ func (e *Encoder) EncryptHandshakeAck(ack *HandshakeAck) (*RawMsg, error) {
 		Nonce:        nonce,
 	}
 
+	// Header is authenticated as additional data
+	encryptedBody := cipher.Seal(nil, nonce[:], data, header.AAD())
 	return &RawMsg{Header: header, Body: encryptedBody}, nil
 }
 
-// DecryptHandshakeAck decrypts a handshake ack
+// DecryptHandshakeAck decrypts a handshake ack in any supported version
 func (d *Decoder) DecryptHandshakeAck(rawMsg *RawMsg) (*HandshakeAck, error) {
-	sharedSecret, err := curve25519.X25519(d.PrivateKey[:], rawMsg.Header.EphemeralKey[:])
+	if err := checkSupported(rawMsg.Header); err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := computeShared(d.PrivateKey, rawMsg.Header.EphemeralKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+		return nil, err
 	}
 
-	encKey := sha256.Sum256(sharedSecret)
+	encKey, err := deriveKey(defaultSuite, sharedSecret, rawMsg.Header.Version, TypeHandshakeAck)
+	if err != nil {
+		return nil, err
+	}
 
-	cipher, err := chacha20poly1305.New(encKey[:])
+	cipher, err := defaultSuite.NewAEAD(encKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
 
-	data, err := cipher.Open(nil, rawMsg.Header.Nonce[:], rawMsg.Body, nil)
+	data, err := cipher.Open(nil, rawMsg.Header.Nonce[:], rawMsg.Body, rawMsg.Header.AAD())
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt ack: %w", err)
 	}
 
 	ack := &HandshakeAck{}
-	if err := binary.Unmarshal(data, ack); err != nil {
+	if err := unmarshal(data, ack); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal ack: %w", err)
 	}
 
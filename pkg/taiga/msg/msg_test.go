@@ -0,0 +1,302 @@
+package msg_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelindar/binary"
+	"seras-protocol/internal/bufpool"
+	"seras-protocol/internal/transport/loopback"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// benchSizes are a minimal packet, the IPv4 minimum MTU and the default TUN MTU
+var benchSizes = []int{64, 576, 1300}
+
+// testPacket returns a data message carrying size bytes
+func testPacket(size int) *msg.Msg {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return &msg.Msg{Timestamp: time.Now().Unix(), Data: data}
+}
+
+// ecdhPair returns a client encoder and the node decoder for it
+func ecdhPair(tb testing.TB) (*msg.Encoder, *msg.Decoder) {
+	tb.Helper()
+	nodePrivate, nodePublic, err := msg.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return msg.NewEncoder(nodePublic), msg.NewDecoder(nodePrivate)
+}
+
+// sessionPair returns both ends of a session using suite
+func sessionPair(tb testing.TB, suite msg.Suite) (client, node *msg.Session) {
+	tb.Helper()
+	seed, err := msg.NewSessionSeed()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if client, err = msg.NewSessionWithSuite(seed, true, msg.Version2, suite); err != nil {
+		tb.Fatal(err)
+	}
+	if node, err = msg.NewSessionWithSuite(seed, false, msg.Version2, suite); err != nil {
+		tb.Fatal(err)
+	}
+	return client, node
+}
+
+// sealer is what the ECDH encoder and a session have in common
+type sealer interface {
+	EncryptMsg(msg *msg.Msg, dst []byte) (*msg.RawMsg, error)
+}
+
+// opener is what the ECDH decoder and a session have in common
+type opener interface {
+	DecryptBodyChecked(rawMsg *msg.RawMsg, window *msg.ReplayWindow, dst []byte) (*msg.CookedMsg, error)
+}
+
+// forSizes runs bench as a sub-benchmark for every size in benchSizes
+func forSizes(b *testing.B, name string, bench func(b *testing.B, size int)) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%s/%dB", name, size), func(b *testing.B) { bench(b, size) })
+	}
+}
+
+func BenchmarkEncryptMsg(b *testing.B) {
+	benchEncrypt := func(b *testing.B, newSealer func(b *testing.B) sealer, size int) {
+		s := newSealer(b)
+		message := testPacket(size)
+		sealBuf := make([]byte, bufpool.Size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.EncryptMsg(message, sealBuf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	forSizes(b, "ecdh", func(b *testing.B, size int) {
+		benchEncrypt(b, func(b *testing.B) sealer { encoder, _ := ecdhPair(b); return encoder }, size)
+	})
+	forSizes(b, "session", func(b *testing.B, size int) {
+		benchEncrypt(b, func(b *testing.B) sealer {
+			client, _ := sessionPair(b, msg.SuiteChaCha20Poly1305)
+			return client
+		}, size)
+	})
+}
+
+func BenchmarkDecryptBody(b *testing.B) {
+	forSizes(b, "ecdh", func(b *testing.B, size int) {
+		encoder, decoder := ecdhPair(b)
+		rawMsg, err := encoder.EncryptMsg(testPacket(size), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		openBuf := make([]byte, bufpool.Size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := decoder.DecryptBody(rawMsg, openBuf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkRoundTrip seals and opens each packet, checking it for replay as
+// the node does
+func BenchmarkRoundTrip(b *testing.B) {
+	benchRoundTrip := func(b *testing.B, s sealer, o opener, size int) {
+		window := msg.NewReplayWindow()
+		message := testPacket(size)
+		sealBuf := make([]byte, bufpool.Size)
+		openBuf := make([]byte, bufpool.Size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			rawMsg, err := s.EncryptMsg(message, sealBuf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := o.DecryptBodyChecked(rawMsg, window, openBuf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	forSizes(b, "ecdh", func(b *testing.B, size int) {
+		encoder, decoder := ecdhPair(b)
+		benchRoundTrip(b, encoder, decoder, size)
+	})
+	forSizes(b, "session", func(b *testing.B, size int) {
+		client, node := sessionPair(b, msg.SuiteChaCha20Poly1305)
+		benchRoundTrip(b, client, node, size)
+	})
+	forSizes(b, "session-aes256gcm", func(b *testing.B, size int) {
+		client, node := sessionPair(b, msg.SuiteAES256GCM)
+		benchRoundTrip(b, client, node, size)
+	})
+}
+
+// BenchmarkLoopback sends session messages the way the client does (encrypt,
+// marshal, send) to a loopback server that handles them the way the node
+// does (decode, decrypt), and reports packets/sec once all have arrived
+func BenchmarkLoopback(b *testing.B) {
+	forSizes(b, "session", func(b *testing.B, size int) {
+		client, node := sessionPair(b, msg.SuiteChaCha20Poly1305)
+		window := msg.NewReplayWindow()
+		openBuf := make([]byte, bufpool.Size)
+
+		var received sync.WaitGroup
+		var failure error
+		var failureOnce sync.Once
+		name := b.Name()
+		server := loopback.NewServer(name, func(_ *loopback.Connection, data []byte) {
+			defer received.Done()
+			rawMsg, err := msg.Decode(data)
+			if err == nil {
+				_, err = node.DecryptBodyChecked(rawMsg, window, openBuf)
+			}
+			if err != nil {
+				failureOnce.Do(func() { failure = err })
+			}
+		})
+		listening := make(chan struct{})
+		server.SetOnListening(func() { close(listening) })
+		go server.Start()
+		<-listening
+		defer server.Stop(context.Background())
+
+		transport, err := loopback.Dial(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer transport.Disconnect()
+
+		message := testPacket(size)
+		sealBuf := make([]byte, bufpool.Size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		received.Add(b.N)
+		for i := 0; i < b.N; i++ {
+			rawMsg, err := client.EncryptMsg(message, sealBuf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			data, err := binary.Marshal(rawMsg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := transport.Send(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+		received.Wait()
+		b.StopTimer()
+
+		if failure != nil {
+			b.Fatal(failure)
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+	})
+}
+
+// TestPipelineSizes runs every benchmarked size through the pipeline the
+// benchmarks time, so a broken path fails here rather than only in a
+// benchmark run
+func TestPipelineSizes(t *testing.T) {
+	encoder, decoder := ecdhPair(t)
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	pairs := map[string]struct {
+		s sealer
+		o opener
+	}{
+		"ecdh":    {encoder, decoder},
+		"session": {client, node},
+	}
+	for name, pair := range pairs {
+		window := msg.NewReplayWindow()
+		for _, size := range benchSizes {
+			sent := testPacket(size)
+			rawMsg, err := pair.s.EncryptMsg(sent, make([]byte, bufpool.Size))
+			if err != nil {
+				t.Fatalf("%s %dB: %v", name, size, err)
+			}
+			data, err := binary.Marshal(rawMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := msg.Decode(data)
+			if err != nil {
+				t.Fatalf("%s %dB: %v", name, size, err)
+			}
+			cooked, err := pair.o.DecryptBodyChecked(decoded, window, make([]byte, bufpool.Size))
+			if err != nil {
+				t.Fatalf("%s %dB: %v", name, size, err)
+			}
+			if !bytes.Equal(cooked.Body.Data, sent.Data) {
+				t.Fatalf("%s %dB: got %d bytes back, not what was sent", name, size, len(cooked.Body.Data))
+			}
+		}
+	}
+}
+
+func TestDecryptBodyRejectsTamperedHeader(t *testing.T) {
+	tamper := map[string]func(h *msg.Header){
+		"version":      func(h *msg.Header) { h.Version = msg.Version1 },
+		"type":         func(h *msg.Header) { h.Type = msg.TypeHandshake },
+		"ephemeralKey": func(h *msg.Header) { h.EphemeralKey[0] ^= 1 },
+		"nonce":        func(h *msg.Header) { h.Nonce[11] ^= 1 },
+	}
+	for field, change := range tamper {
+		t.Run(field, func(t *testing.T) {
+			encoder, decoder := ecdhPair(t)
+			rawMsg, err := encoder.EncryptMsg(testPacket(64), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decoder.DecryptBody(rawMsg, nil); err != nil {
+				t.Fatalf("untampered message: %v", err)
+			}
+
+			change(rawMsg.Header)
+			// A decoder expecting the tampered version gets as far as Open
+			decoder.Version = rawMsg.Header.Version
+			if _, err := decoder.DecryptBody(rawMsg, nil); err == nil {
+				t.Fatal("message with tampered header opened")
+			}
+		})
+	}
+}
+
+func TestSessionRejectsTamperedHeader(t *testing.T) {
+	tamper := map[string]func(h *msg.Header){
+		"type":         func(h *msg.Header) { h.Type = msg.TypeData },
+		"ephemeralKey": func(h *msg.Header) { h.EphemeralKey[0] ^= 1 },
+		"nonce":        func(h *msg.Header) { h.Nonce[11] ^= 1 },
+	}
+	for field, change := range tamper {
+		t.Run(field, func(t *testing.T) {
+			client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+			rawMsg, err := client.EncryptMsg(testPacket(64), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			change(rawMsg.Header)
+			if _, err := node.DecryptBodyChecked(rawMsg, msg.NewReplayWindow(), nil); err == nil {
+				t.Fatal("message with tampered header opened")
+			}
+		})
+	}
+}
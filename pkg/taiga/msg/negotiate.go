@@ -0,0 +1,59 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// SupportedVersions are the protocol versions this build speaks, preferred
+// first. A client offers them in its Handshake; the node picks one for the
+// session in its HandshakeAck.
+var SupportedVersions = []Version{Version2}
+
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// NegotiateVersion picks the first of supported that the peer offered
+func NegotiateVersion(offered, supported []Version) (Version, error) {
+	for _, v := range supported {
+		if slices.Contains(offered, v) {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("%w: offered %q, supported %q", ErrNoCommonVersion, offered, supported)
+}
+
+// OfferedVersions returns the versions a handshake sent under header offers.
+// A client that lists none speaks only the version it sent the handshake in.
+func (hs *Handshake) OfferedVersions(header *Header) []Version {
+	if len(hs.Versions) == 0 {
+		return []Version{header.Version}
+	}
+	return hs.Versions
+}
+
+// PinVersion returns the version the node selected for the session, which
+// must be one of those offered in the handshake sent under hsHeader. A node
+// that selects none speaks only the version of the handshake.
+func (ack *HandshakeAck) PinVersion(hsHeader *Header, offered []Version) (Version, error) {
+	if ack.Version == "" {
+		return hsHeader.Version, nil
+	}
+	if !slices.Contains(offered, ack.Version) {
+		return "", fmt.Errorf("node selected protocol version %q, which was not offered", ack.Version)
+	}
+	return ack.Version, nil
+}
+
+// checkSupported rejects handshake messages in a version this build can't
+// speak. Handshakes are accepted in any supported version, since the
+// session's version is only settled by them.
+func checkSupported(header *Header) error {
+	if header == nil {
+		return ErrMissingHeader
+	}
+	if !slices.Contains(SupportedVersions, header.Version) {
+		return fmt.Errorf("%w: %q", ErrUnknownVersion, header.Version)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package msg_test
+
+import (
+	"errors"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+const versionFuture msg.Version = "taiga_v9"
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		offered   []msg.Version
+		supported []msg.Version
+		want      msg.Version // Empty for no common version
+	}{
+		{"matching", []msg.Version{msg.Version2}, []msg.Version{msg.Version2}, msg.Version2},
+		{"partial overlap", []msg.Version{versionFuture, msg.Version2}, []msg.Version{msg.Version2, msg.Version1}, msg.Version2},
+		{"node's preference wins", []msg.Version{msg.Version1, msg.Version2}, []msg.Version{msg.Version2, msg.Version1}, msg.Version2},
+		{"no overlap", []msg.Version{versionFuture}, []msg.Version{msg.Version2, msg.Version1}, ""},
+		{"nothing offered", nil, []msg.Version{msg.Version2}, ""},
+	}
+	for _, tt := range tests {
+		got, err := msg.NegotiateVersion(tt.offered, tt.supported)
+		if tt.want == "" {
+			if !errors.Is(err, msg.ErrNoCommonVersion) {
+				t.Errorf("%s: got %q, %v; want ErrNoCommonVersion", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestOfferedVersions(t *testing.T) {
+	header := &msg.Header{Version: msg.Version2}
+	if got := (&msg.Handshake{}).OfferedVersions(header); len(got) != 1 || got[0] != msg.Version2 {
+		t.Fatalf("a handshake listing none offers %q, want its own version", got)
+	}
+	hs := &msg.Handshake{Versions: []msg.Version{versionFuture, msg.Version2}}
+	if got := hs.OfferedVersions(header); len(got) != 2 || got[0] != versionFuture {
+		t.Fatalf("offers %q, want what it lists", got)
+	}
+}
+
+func TestPinVersion(t *testing.T) {
+	hsHeader := &msg.Header{Version: msg.Version2}
+	offered := []msg.Version{versionFuture, msg.Version2}
+	tests := []struct {
+		selected msg.Version
+		want     msg.Version // Empty for a rejected selection
+	}{
+		{msg.Version2, msg.Version2},
+		{versionFuture, versionFuture},
+		{"", msg.Version2}, // An older node selects none
+		{msg.Version1, ""},
+	}
+	for _, tt := range tests {
+		got, err := (&msg.HandshakeAck{Version: tt.selected}).PinVersion(hsHeader, offered)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("selected %q: pinned %q, want an error for a version not offered", tt.selected, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("selected %q: got %q, %v; want %q", tt.selected, got, err, tt.want)
+		}
+	}
+}
+
+func TestVersionBindsKeys(t *testing.T) {
+	seed, err := msg.NewSessionSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := msg.NewSessionWithVersion(seed, true, msg.Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := msg.NewSessionWithVersion(seed, false, msg.Version1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawMsg := seal(t, client, 1)
+	if _, err := node.DecryptBodyChecked(rawMsg, msg.NewReplayWindow(), nil); err == nil {
+		t.Fatal("opened a message from a session pinned to another version")
+	}
+
+	// Per-message keys too, even with the header claiming the decoder's version
+	encoder, decoder := ecdhPair(t)
+	encoder.Version, decoder.Version = msg.Version1, msg.Version2
+	rawMsg, err = encoder.EncryptMsg(testPacket(64), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawMsg.Header.Version = msg.Version2
+	if _, err := decoder.DecryptBody(rawMsg, nil); err == nil {
+		t.Fatal("opened a message sealed for another version")
+	}
+}
@@ -0,0 +1,79 @@
+package msg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PaddingBucketSize is the granularity PaddingBucket rounds payloads up to
+const PaddingBucketSize = 256
+
+// padTrailerSize is the real payload length stored at the end of padded Data
+const padTrailerSize = 4
+
+// Padding selects how the encoder pads Msg.Data to hide packet sizes
+type Padding string
+
+var (
+	PaddingNone   Padding = "none"
+	PaddingBucket Padding = "bucket" // Round up to a multiple of PaddingBucketSize
+	PaddingMax    Padding = "max"    // Pad everything to PadSize (the MTU)
+)
+
+// ParsePadding converts a config string to a Padding
+func ParsePadding(s string) (Padding, error) {
+	switch Padding(s) {
+	case "", PaddingNone:
+		return PaddingNone, nil
+	case PaddingBucket:
+		return PaddingBucket, nil
+	case PaddingMax:
+		return PaddingMax, nil
+	default:
+		return "", fmt.Errorf("unsupported padding: %s", s)
+	}
+}
+
+// padMsg returns msg with Data padded according to p, followed by its real
+// length. Under PaddingMax, payloads that do not fit padSize only gain the
+// length trailer.
+func padMsg(msg *Msg, p Padding, padSize int) *Msg {
+	size := len(msg.Data) + padTrailerSize
+	switch p {
+	case PaddingBucket:
+		size = (size + PaddingBucketSize - 1) / PaddingBucketSize * PaddingBucketSize
+	case PaddingMax:
+		size = max(size, padSize)
+	default:
+		return msg
+	}
+
+	data := make([]byte, size)
+	copy(data, msg.Data)
+	binary.BigEndian.PutUint32(data[size-padTrailerSize:], uint32(len(msg.Data)))
+
+	padded := *msg
+	padded.Flags |= FlagPadded
+	padded.Data = data
+	return &padded
+}
+
+// unpadMsg trims padding from Data in place according to msg.Flags
+func unpadMsg(msg *Msg) error {
+	if msg.Flags&FlagPadded == 0 {
+		return nil
+	}
+
+	if len(msg.Data) < padTrailerSize {
+		return fmt.Errorf("padded data of %d bytes has no length", len(msg.Data))
+	}
+	trailer := len(msg.Data) - padTrailerSize
+	size := binary.BigEndian.Uint32(msg.Data[trailer:])
+	if uint64(size) > uint64(trailer) {
+		return fmt.Errorf("padded length %d exceeds data of %d bytes", size, trailer)
+	}
+
+	msg.Data = msg.Data[:size]
+	msg.Flags &^= FlagPadded
+	return nil
+}
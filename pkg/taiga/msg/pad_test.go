@@ -0,0 +1,141 @@
+package msg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// padTimestamp keeps the encoded Msg the same size from message to message
+const padTimestamp = 1700000000
+
+// sealedSize seals size bytes with padding p and checks they open intact
+func sealedSize(t *testing.T, p msg.Padding, padSize, size int) int {
+	t.Helper()
+	encoder, decoder := ecdhPair(t)
+	encoder.Padding = p
+	encoder.PadSize = padSize
+	data := bytes.Repeat([]byte{0x5A}, size)
+
+	rawMsg, err := encoder.EncryptMsg(&msg.Msg{Timestamp: padTimestamp, Data: data}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cooked, err := decoder.DecryptBody(rawMsg, nil)
+	if err != nil {
+		t.Fatalf("%s, %d bytes: %v", p, size, err)
+	}
+	if !bytes.Equal(cooked.Body.Data, data) {
+		t.Fatalf("%s: %d bytes opened as %d", p, size, len(cooked.Body.Data))
+	}
+	if cooked.Body.Flags&msg.FlagPadded != 0 {
+		t.Fatalf("%s: padded flag left on the opened message", p)
+	}
+	return len(rawMsg.Body)
+}
+
+func TestPaddingSizes(t *testing.T) {
+	// Sizes either side of where the 4-byte length trailer crosses a bucket
+	const fits = msg.PaddingBucketSize - 4
+
+	none := map[int]int{}
+	for _, size := range []int{0, 1, 100, fits, fits + 1} {
+		none[size] = sealedSize(t, msg.PaddingNone, 0, size)
+	}
+	if none[0] == none[1] || none[1] == none[100] {
+		t.Fatal("unpadded messages of different sizes sealed to the same length")
+	}
+
+	// Everything up to a bucket's worth seals alike, one more byte moves up a bucket
+	bucket := sealedSize(t, msg.PaddingBucket, 0, 0)
+	for _, size := range []int{1, 100, fits} {
+		if got := sealedSize(t, msg.PaddingBucket, 0, size); got != bucket {
+			t.Fatalf("bucketed %d bytes sealed to %d, want %d", size, got, bucket)
+		}
+	}
+	if got := sealedSize(t, msg.PaddingBucket, 0, fits+1); got != bucket+msg.PaddingBucketSize {
+		t.Fatalf("%d bytes sealed to %d, want the next bucket at %d", fits+1, got, bucket+msg.PaddingBucketSize)
+	}
+	if got := bucket - none[fits]; got != 4 {
+		t.Fatalf("a full bucket grew by %d bytes, want the 4-byte trailer", got)
+	}
+
+	// Max pads everything to PadSize; larger payloads only gain the trailer
+	const padSize = 1400
+	full := sealedSize(t, msg.PaddingMax, padSize, 0)
+	for _, size := range []int{1, fits + 1, padSize - 4} {
+		if got := sealedSize(t, msg.PaddingMax, padSize, size); got != full {
+			t.Fatalf("max-padded %d bytes sealed to %d, want %d", size, got, full)
+		}
+	}
+	unpadded := sealedSize(t, msg.PaddingNone, 0, padSize)
+	if got := sealedSize(t, msg.PaddingMax, padSize, padSize); got != unpadded+4 {
+		t.Fatalf("%d bytes sealed to %d under max padding, want %d", padSize, got, unpadded+4)
+	}
+}
+
+func TestSessionPadding(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	client.Padding = msg.PaddingBucket
+	window := msg.NewReplayWindow()
+
+	var lengths []int
+	for _, size := range []int{10, 200} {
+		data := bytes.Repeat([]byte{1}, size)
+		rawMsg, err := client.EncryptMsg(&msg.Msg{Timestamp: padTimestamp, Data: data}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, len(rawMsg.Body))
+		cooked, err := node.DecryptBodyChecked(rawMsg, window, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cooked.Body.Data, data) {
+			t.Fatalf("%d bytes opened as %d", size, len(cooked.Body.Data))
+		}
+	}
+	if lengths[0] != lengths[1] {
+		t.Fatalf("10 and 200 bytes sealed to %d and %d, want one bucket", lengths[0], lengths[1])
+	}
+}
+
+func TestUnpadRejectsBadLength(t *testing.T) {
+	tests := map[string][]byte{
+		"no trailer":      {1, 2},
+		"length too long": binary.BigEndian.AppendUint32(make([]byte, 10), 11),
+	}
+	for name, data := range tests {
+		// An unpadding encoder passes the flag through as set
+		encoder, decoder := ecdhPair(t)
+		rawMsg, err := encoder.EncryptMsg(&msg.Msg{Flags: msg.FlagPadded, Timestamp: padTimestamp, Data: data}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decoder.DecryptBody(rawMsg, nil); err == nil {
+			t.Errorf("%s: opened a malformed padded message", name)
+		}
+	}
+}
+
+func TestParsePadding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    msg.Padding
+		wantErr bool
+	}{
+		{"", msg.PaddingNone, false},
+		{"none", msg.PaddingNone, false},
+		{"bucket", msg.PaddingBucket, false},
+		{"max", msg.PaddingMax, false},
+		{"mtu", "", true},
+	}
+	for _, tt := range tests {
+		got, err := msg.ParsePadding(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePadding(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package msg_test
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestReplayWindowAccept(t *testing.T) {
+	w := msg.NewReplayWindow()
+	steps := []struct {
+		counter uint64
+		want    bool
+	}{
+		{1, true},
+		{1, false}, // Duplicate
+		{3, true},
+		{2, true}, // Out of order, inside the window
+		{2, false},
+		{3, false},
+		{100, true},
+		{100 - msg.ReplayWindowSize + 1, true}, // Oldest counter still tracked
+		{100 - msg.ReplayWindowSize, false},    // Just past the window
+		{4, false},                             // Unseen but too old
+	}
+	for i, step := range steps {
+		if got := w.Accept(step.counter); got != step.want {
+			t.Errorf("step %d: Accept(%d) = %v, want %v", i, step.counter, got, step.want)
+		}
+	}
+}
+
+func TestDecryptBodyCheckedRejectsReplays(t *testing.T) {
+	encoder, decoder := ecdhPair(t)
+	window := msg.NewReplayWindow()
+
+	var sealed []*msg.RawMsg
+	for i := 0; i < msg.ReplayWindowSize+6; i++ {
+		rawMsg, err := encoder.EncryptMsg(testPacket(64), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, rawMsg)
+	}
+
+	open := func(rawMsg *msg.RawMsg) error {
+		_, err := decoder.DecryptBodyChecked(rawMsg, window, nil)
+		return err
+	}
+
+	// Frames 1 and 0 arrive swapped; both are fresh
+	if err := open(sealed[1]); err != nil {
+		t.Fatalf("first frame: %v", err)
+	}
+	if err := open(sealed[0]); err != nil {
+		t.Fatalf("out-of-order frame: %v", err)
+	}
+
+	// Duplicates of either are rejected
+	for _, i := range []int{0, 1} {
+		if err := open(sealed[i]); !errors.Is(err, msg.ErrReplayedMsg) {
+			t.Fatalf("duplicate of frame %d: got %v, want ErrReplayedMsg", i, err)
+		}
+	}
+
+	// Once the newest frame moves the window on, an unseen frame that fell
+	// out of it is rejected too
+	if err := open(sealed[len(sealed)-1]); err != nil {
+		t.Fatalf("newest frame: %v", err)
+	}
+	if err := open(sealed[2]); !errors.Is(err, msg.ErrReplayedMsg) {
+		t.Fatalf("frame older than the window: got %v, want ErrReplayedMsg", err)
+	}
+	if err := open(sealed[len(sealed)-2]); err != nil {
+		t.Fatalf("late frame inside the window: %v", err)
+	}
+}
+
+func TestTimestampSkew(t *testing.T) {
+	const skew = msg.DefaultTimestampSkew
+	tests := []struct {
+		name   string
+		offset time.Duration // From now
+		skew   time.Duration
+		ok     bool
+	}{
+		{"now", 0, skew, true},
+		{"in window behind", -skew + 2*time.Second, skew, true},
+		{"in window ahead", skew - 2*time.Second, skew, true},
+		{"stale", -skew - 2*time.Second, skew, false},
+		{"future", skew + 2*time.Second, skew, false},
+		{"a day stale", -24 * time.Hour, skew, false},
+		{"an hour ahead", time.Hour, skew, false},
+		{"narrow window", -10 * time.Second, 5 * time.Second, false},
+		{"stale unchecked", -24 * time.Hour, 0, true},
+		{"future unchecked", time.Hour, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, decoder := ecdhPair(t)
+			decoder.TimestampSkew = tt.skew
+			client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+			node.TimestampSkew = tt.skew
+
+			for name, pair := range map[string]struct {
+				sealer
+				opener
+			}{"ECDH": {encoder, decoder}, "session": {client, node}} {
+				window := msg.NewReplayWindow()
+				message := &msg.Msg{Timestamp: time.Now().Add(tt.offset).Unix(), Data: []byte("packet")}
+				rawMsg, err := pair.EncryptMsg(message, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = pair.DecryptBodyChecked(rawMsg, window, nil)
+				if tt.ok && err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !tt.ok && !errors.Is(err, msg.ErrStaleMsg) {
+					t.Fatalf("%s: got %v, want ErrStaleMsg", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReorderStats(t *testing.T) {
+	const w = msg.ReplayWindowSize
+	tests := []struct {
+		name     string
+		counters []uint64
+		want     msg.ReorderStats
+	}{
+		{"in order", []uint64{1, 2, 3, 4, 5}, msg.ReorderStats{}},
+		{"pairs swapped", []uint64{2, 1, 4, 3, 6, 5}, msg.ReorderStats{Reordered: 3}},
+		{"one late, one lost", []uint64{1, 2, 5, 3, 6}, msg.ReorderStats{Reordered: 1, Gaps: 1}},
+		{"duplicates", []uint64{1, 2, 2, 1, 3, 3}, msg.ReorderStats{Duplicates: 3}},
+		{"older than the window", []uint64{1, w + 2, 2}, msg.ReorderStats{Late: 1, Gaps: w}},
+		{"straggler at the window's edge", []uint64{1, w + 1, 2}, msg.ReorderStats{Reordered: 1, Gaps: w - 2}},
+	}
+	for _, tt := range tests {
+		window := msg.NewReplayWindow()
+		for _, c := range tt.counters {
+			window.Accept(c)
+		}
+		if got := window.Stats(); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReorderStatsShuffled(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 100 {
+		// A window's worth of counters, shuffled, with some sent twice
+		counters := make([]uint64, msg.ReplayWindowSize)
+		for i := range counters {
+			counters[i] = uint64(i + 1)
+		}
+		rng.Shuffle(len(counters), func(i, j int) { counters[i], counters[j] = counters[j], counters[i] })
+		for range rng.Intn(8) {
+			at := rng.Intn(len(counters))
+			counters = slices.Insert(counters, at, counters[rng.Intn(len(counters))])
+		}
+
+		var want msg.ReorderStats
+		seen := make(map[uint64]bool)
+		var highest uint64
+		window := msg.NewReplayWindow()
+		for _, c := range counters {
+			switch {
+			case seen[c]:
+				want.Duplicates++
+			case c < highest:
+				want.Reordered++
+			}
+			seen[c] = true
+			highest = max(highest, c)
+			window.Accept(c)
+		}
+		// Every counter arrived in the end, so none is missing
+		if got := window.Stats(); got != want {
+			t.Fatalf("counters %v: got %+v, want %+v", counters, got, want)
+		}
+	}
+}
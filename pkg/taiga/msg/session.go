@@ -0,0 +1,365 @@
+package msg
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kelindar/binary"
+)
+
+// Default rekey policy for session mode
+const (
+	DefaultRekeyPackets  = 1 << 16
+	DefaultRekeyInterval = 2 * time.Minute
+)
+
+// MaxEpochSkip bounds how many rekeys a receiver will catch up on at once
+const MaxEpochSkip = 16
+
+var ErrStaleEpoch = errors.New("session message from an expired key epoch")
+
+// Rekey announces that the sender ratcheted its session key
+type Rekey struct {
+	Epoch uint32
+}
+
+// NewSessionSeed returns random key material for a new session
+func NewSessionSeed() (Key, error) {
+	var seed Key
+	if _, err := rand.Read(seed[:]); err != nil {
+		return Key{}, fmt.Errorf("failed to generate session seed: %w", err)
+	}
+	return seed, nil
+}
+
+// sendChain is the sending direction of a session
+type sendChain struct {
+	mu      sync.Mutex
+	chain   []byte // Chain key of the current epoch
+	key     []byte // Message key of the current epoch
+	epoch   uint32
+	counter uint64 // Nonce counter, kept across epochs so one ReplayWindow suffices
+	packets uint64 // Messages sealed in the current epoch
+	since   time.Time
+}
+
+// recvChain is the receiving direction of a session.
+// The previous epoch's key is kept so messages reordered around a rekey still open.
+type recvChain struct {
+	mu      sync.Mutex
+	chain   []byte
+	key     []byte
+	prevKey []byte // nil once a Rekey for the current epoch arrived
+	epoch   uint32
+	rekeyed uint32 // Epoch of the last Rekey accepted
+}
+
+// Session encrypts data with symmetric keys agreed at handshake instead of a
+// per-message ECDH. Each direction ratchets its key forward every
+// RekeyPackets messages or RekeyInterval, whichever comes first; old keys
+// cannot be derived from newer ones.
+type Session struct {
+	Version       Version
+	Compression   Compression
+	Padding       Padding
+	PadSize       int
+	RekeyPackets  uint64
+	RekeyInterval time.Duration
+	// Data messages stamped further than this from local time are rejected
+	// with ErrStaleMsg (0 = not checked). Replays are caught either way; the
+	// check also stops a captured frame being delivered much later.
+	TimestampSkew time.Duration
+	send          sendChain
+	recv          recvChain
+	aeads         aeadCache // Suite and ciphers for the current send and receive keys
+}
+
+// NewSession derives both directions from a seed shared through the handshake.
+// The client is the initiator; the node passes initiator false.
+func NewSession(seed Key, initiator bool) (*Session, error) {
+	return NewSessionWithVersion(seed, initiator, Version2)
+}
+
+// NewSessionWithVersion is NewSession for the protocol version negotiated in
+// the handshake, which the session's keys and headers are bound to
+func NewSessionWithVersion(seed Key, initiator bool, version Version) (*Session, error) {
+	return NewSessionWithSuite(seed, initiator, version, SuiteChaCha20Poly1305)
+}
+
+// NewSessionWithSuite is NewSessionWithVersion for the cipher suite
+// negotiated in the handshake
+func NewSessionWithSuite(seed Key, initiator bool, version Version, suite Suite) (*Session, error) {
+	impl, err := LookupSuite(suite)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		Version:       version,
+		Compression:   CompressionNone,
+		Padding:       PaddingNone,
+		RekeyPackets:  DefaultRekeyPackets,
+		RekeyInterval: DefaultRekeyInterval,
+		aeads:         aeadCache{suite: impl},
+	}
+
+	sendLabel, recvLabel := "session/node", "session/client"
+	if initiator {
+		sendLabel, recvLabel = recvLabel, sendLabel
+	}
+
+	if s.send.chain, err = impl.DeriveKey(seed[:], s.Version, sendLabel); err != nil {
+		return nil, err
+	}
+	if s.recv.chain, err = impl.DeriveKey(seed[:], s.Version, recvLabel); err != nil {
+		return nil, err
+	}
+	if s.send.key, err = deriveKey(impl, s.send.chain, s.Version, TypeSessionData); err != nil {
+		return nil, err
+	}
+	if s.recv.key, err = deriveKey(impl, s.recv.chain, s.Version, TypeSessionData); err != nil {
+		return nil, err
+	}
+	s.send.since = time.Now()
+	return s, nil
+}
+
+// RekeyDue reports whether the sending key has reached the rekey policy
+func (s *Session) RekeyDue() bool {
+	s.send.mu.Lock()
+	defer s.send.mu.Unlock()
+	return s.send.packets >= s.RekeyPackets || time.Since(s.send.since) >= s.RekeyInterval
+}
+
+// Rekey ratchets the sending key and returns the Rekey message announcing it.
+// The message is sealed with the new key.
+func (s *Session) Rekey() (*RawMsg, error) {
+	s.send.mu.Lock()
+	defer s.send.mu.Unlock()
+
+	chain, key, err := ratchet(s.aeads.suite, s.send.chain, s.Version)
+	if err != nil {
+		return nil, err
+	}
+	s.send.chain, s.send.key = chain, key
+	s.send.epoch++
+	s.send.packets = 0
+	s.send.since = time.Now()
+
+	data, err := binary.Marshal(&Rekey{Epoch: s.send.epoch})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rekey: %w", err)
+	}
+	return s.seal(TypeRekey, data, nil)
+}
+
+// EncryptMsg encrypts a message with the current sending key.
+// dst is used as in Encoder.EncryptMsg.
+func (s *Session) EncryptMsg(msg *Msg, dst []byte) (*RawMsg, error) {
+	if len(msg.Data) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes of data", ErrMessageTooLarge, len(msg.Data))
+	}
+
+	msg, err := compressMsg(msg, s.Compression)
+	if err != nil {
+		return nil, err
+	}
+	msg = padMsg(msg, s.Padding, s.PadSize)
+
+	data, err := binary.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	s.send.mu.Lock()
+	defer s.send.mu.Unlock()
+	s.send.packets++
+	return s.seal(TypeSessionData, data, dst)
+}
+
+// seal encrypts data under the current sending key. Must be called with send.mu held.
+func (s *Session) seal(t Type, data, dst []byte) (*RawMsg, error) {
+	aead, err := s.aeads.get(s.send.key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.send.counter++
+	header := &Header{
+		Version: s.Version,
+		Type:    t,
+		Nonce:   epochNonce(s.send.epoch, s.send.counter),
+	}
+
+	body := aead.Seal(dst[:0], header.Nonce[:], data, header.AAD())
+	return &RawMsg{Header: header, Body: body}, nil
+}
+
+// DecryptBodyChecked decrypts a session data message and rejects replays and,
+// when TimestampSkew is set, stale timestamps. A message from a newer epoch advances the receiving key,
+// so a lost Rekey does not stall the session.
+func (s *Session) DecryptBodyChecked(rawMsg *RawMsg, window *ReplayWindow, dst []byte) (*CookedMsg, error) {
+	if rawMsg.Header.Type != TypeSessionData {
+		return nil, fmt.Errorf("expected session data, got type %d", rawMsg.Header.Type)
+	}
+
+	data, err := s.open(rawMsg, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Msg{}
+	if err := unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	if err := unpadMsg(msg); err != nil {
+		return nil, err
+	}
+	if err := decompressMsg(msg); err != nil {
+		return nil, err
+	}
+
+	if s.TimestampSkew > 0 {
+		if err := checkTimestamp(msg.Timestamp, s.TimestampSkew); err != nil {
+			return nil, err
+		}
+	}
+	if !window.Accept(rawMsg.Header.Nonce.Counter()) {
+		return nil, ErrReplayedMsg
+	}
+
+	return &CookedMsg{Header: rawMsg.Header, Body: msg}, nil
+}
+
+// HandleRekey processes a Rekey message from the peer. Its counter goes
+// through window like data, and its epoch must be newer than the last Rekey
+// accepted, so a replayed Rekey is rejected. Once it is accepted, keys of
+// earlier epochs are discarded.
+func (s *Session) HandleRekey(rawMsg *RawMsg, window *ReplayWindow) error {
+	if rawMsg.Header.Type != TypeRekey {
+		return fmt.Errorf("expected rekey, got type %d", rawMsg.Header.Type)
+	}
+
+	data, err := s.open(rawMsg, nil)
+	if err != nil {
+		return err
+	}
+
+	rekey := &Rekey{}
+	if err := unmarshal(data, rekey); err != nil {
+		return fmt.Errorf("failed to unmarshal rekey: %w", err)
+	}
+	if rekey.Epoch != rawMsg.Header.Nonce.Epoch() {
+		return fmt.Errorf("rekey epoch %d does not match nonce epoch %d", rekey.Epoch, rawMsg.Header.Nonce.Epoch())
+	}
+
+	s.recv.mu.Lock()
+	defer s.recv.mu.Unlock()
+	if rekey.Epoch <= s.recv.rekeyed {
+		return fmt.Errorf("%w: rekey to epoch %d after epoch %d", ErrReplayedMsg, rekey.Epoch, s.recv.rekeyed)
+	}
+	if !window.Accept(rawMsg.Header.Nonce.Counter()) {
+		return ErrReplayedMsg
+	}
+	s.recv.rekeyed = rekey.Epoch
+	if s.recv.epoch == rekey.Epoch {
+		s.recv.prevKey = nil
+	}
+	return nil
+}
+
+// Epoch returns the current sending and receiving key epochs
+func (s *Session) Epoch() (send, recv uint32) {
+	s.send.mu.Lock()
+	send = s.send.epoch
+	s.send.mu.Unlock()
+
+	s.recv.mu.Lock()
+	recv = s.recv.epoch
+	s.recv.mu.Unlock()
+	return send, recv
+}
+
+// open authenticates and decrypts a session message, advancing the receiving
+// chain when the message comes from a newer epoch
+func (s *Session) open(rawMsg *RawMsg, dst []byte) ([]byte, error) {
+	if rawMsg.Header == nil {
+		return nil, ErrMissingHeader
+	}
+	if len(rawMsg.Body) > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes of body", ErrMessageTooLarge, len(rawMsg.Body))
+	}
+	if rawMsg.Header.Version != s.Version {
+		return nil, fmt.Errorf("protocol version mismatch: got %q, want %q", rawMsg.Header.Version, s.Version)
+	}
+
+	s.recv.mu.Lock()
+	defer s.recv.mu.Unlock()
+
+	epoch := rawMsg.Header.Nonce.Epoch()
+	switch {
+	case epoch == s.recv.epoch:
+		return s.openWith(s.recv.key, rawMsg, dst)
+	case epoch+1 == s.recv.epoch && s.recv.prevKey != nil:
+		return s.openWith(s.recv.prevKey, rawMsg, dst)
+	case epoch < s.recv.epoch:
+		return nil, ErrStaleEpoch
+	case epoch-s.recv.epoch > MaxEpochSkip:
+		return nil, fmt.Errorf("session epoch %d is too far ahead of %d", epoch, s.recv.epoch)
+	}
+
+	// Walk the chain forward, committing only once the message authenticates
+	chain, key, prevKey := s.recv.chain, s.recv.key, []byte(nil)
+	for e := s.recv.epoch; e < epoch; e++ {
+		var err error
+		prevKey = key
+		if chain, key, err = ratchet(s.aeads.suite, chain, s.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	// Not cached until it authenticates, so forged epochs can't churn the cache
+	aead, err := s.aeads.suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openAEAD(aead, rawMsg, dst)
+	if err != nil {
+		return nil, err
+	}
+	s.recv.chain, s.recv.key, s.recv.prevKey = chain, key, prevKey
+	s.recv.epoch = epoch
+	return data, nil
+}
+
+// openWith decrypts rawMsg with key, reusing its cached cipher
+func (s *Session) openWith(key []byte, rawMsg *RawMsg, dst []byte) ([]byte, error) {
+	aead, err := s.aeads.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, rawMsg, dst)
+}
+
+// openAEAD decrypts rawMsg with aead
+func openAEAD(aead cipher.AEAD, rawMsg *RawMsg, dst []byte) ([]byte, error) {
+	data, err := aead.Open(dst[:0], rawMsg.Header.Nonce[:], rawMsg.Body, rawMsg.Header.AAD())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt body: %w", err)
+	}
+	return data, nil
+}
+
+// ratchet advances a chain key one epoch and derives the new message key
+func ratchet(suite CipherSuite, chain []byte, version Version) (next, key []byte, err error) {
+	if next, err = suite.DeriveKey(chain, version, "ratchet"); err != nil {
+		return nil, nil, err
+	}
+	if key, err = deriveKey(suite, next, version, TypeSessionData); err != nil {
+		return nil, nil, err
+	}
+	return next, key, nil
+}
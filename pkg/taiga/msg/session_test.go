@@ -0,0 +1,176 @@
+package msg_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// seal encrypts a test packet tagged with id on s
+func seal(t *testing.T, s *msg.Session, id byte) *msg.RawMsg {
+	t.Helper()
+	packet := testPacket(64)
+	packet.Data[0] = id
+	rawMsg, err := s.EncryptMsg(packet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawMsg
+}
+
+// rekey ratchets s and returns the announcement
+func rekey(t *testing.T, s *msg.Session) *msg.RawMsg {
+	t.Helper()
+	rawMsg, err := s.Rekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawMsg
+}
+
+// open decrypts rawMsg on s and checks it carries the packet tagged id
+func open(t *testing.T, s *msg.Session, window *msg.ReplayWindow, rawMsg *msg.RawMsg, id byte) {
+	t.Helper()
+	cooked, err := s.DecryptBodyChecked(rawMsg, window, nil)
+	if err != nil {
+		t.Fatalf("packet %d: %v", id, err)
+	}
+	if cooked.Body.Data[0] != id {
+		t.Fatalf("opened packet %d, want %d", cooked.Body.Data[0], id)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	open(t, node, msg.NewReplayWindow(), seal(t, client, 1), 1)
+	open(t, client, msg.NewReplayWindow(), seal(t, node, 2), 2)
+
+	// Each direction has its own key
+	if _, err := client.DecryptBodyChecked(seal(t, client, 3), msg.NewReplayWindow(), nil); err == nil {
+		t.Fatal("client opened its own message")
+	}
+}
+
+func TestRekeyDue(t *testing.T) {
+	client, _ := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	client.RekeyPackets = 3
+	for i := range 3 {
+		if client.RekeyDue() {
+			t.Fatalf("rekey due after %d packets", i)
+		}
+		seal(t, client, byte(i))
+	}
+	if !client.RekeyDue() {
+		t.Fatal("rekey not due after RekeyPackets")
+	}
+	rekey(t, client)
+	if client.RekeyDue() {
+		t.Fatal("rekey still due after rekeying")
+	}
+
+	client.RekeyInterval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if !client.RekeyDue() {
+		t.Fatal("rekey not due after RekeyInterval")
+	}
+}
+
+func TestRekeyAdvancesEpoch(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	window := msg.NewReplayWindow()
+
+	before := seal(t, client, 0)
+	straggler := seal(t, client, 1)
+	announce := rekey(t, client)
+	after := seal(t, client, 2)
+	if send, _ := client.Epoch(); send != 1 {
+		t.Fatalf("client sending epoch %d after a rekey, want 1", send)
+	}
+	if before.Header.Nonce.Epoch() != 0 || after.Header.Nonce.Epoch() != 1 {
+		t.Fatalf("nonce epochs %d and %d, want 0 and 1", before.Header.Nonce.Epoch(), after.Header.Nonce.Epoch())
+	}
+
+	// Data from the new epoch advances the node, and the old key still
+	// opens a message reordered around the rekey
+	open(t, node, window, after, 2)
+	if _, recv := node.Epoch(); recv != 1 {
+		t.Fatalf("node receiving epoch %d, want 1", recv)
+	}
+	open(t, node, window, before, 0)
+
+	// Once the rekey arrives the old key is gone
+	if err := node.HandleRekey(announce, window); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.DecryptBodyChecked(straggler, window, nil); !errors.Is(err, msg.ErrStaleEpoch) {
+		t.Fatalf("epoch 0 after the rekey: got %v, want ErrStaleEpoch", err)
+	}
+	open(t, node, window, seal(t, client, 3), 3)
+}
+
+func TestMissedRekeys(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	window := msg.NewReplayWindow()
+	open(t, node, window, seal(t, client, 0), 0)
+
+	// Three announcements lost on the way: the next data message catches up
+	for range 3 {
+		rekey(t, client)
+	}
+	open(t, node, window, seal(t, client, 1), 1)
+	if _, recv := node.Epoch(); recv != 3 {
+		t.Fatalf("node receiving epoch %d, want 3", recv)
+	}
+
+	// Too far ahead to walk the chain to
+	for range msg.MaxEpochSkip + 1 {
+		rekey(t, client)
+	}
+	if _, err := node.DecryptBodyChecked(seal(t, client, 2), window, nil); err == nil {
+		t.Fatalf("opened a message %d epochs ahead", msg.MaxEpochSkip+1)
+	}
+	if _, recv := node.Epoch(); recv != 3 {
+		t.Fatalf("node receiving epoch %d after a rejected message, want 3", recv)
+	}
+}
+
+func TestForgedEpochDoesNotAdvance(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	rekey(t, client)
+	forged := seal(t, client, 0)
+	forged.Body[0] ^= 1
+	if _, err := node.DecryptBodyChecked(forged, msg.NewReplayWindow(), nil); err == nil {
+		t.Fatal("opened a tampered message")
+	}
+	if _, recv := node.Epoch(); recv != 0 {
+		t.Fatalf("tampered message moved the node to epoch %d", recv)
+	}
+}
+
+func TestReplayedRekey(t *testing.T) {
+	client, node := sessionPair(t, msg.SuiteChaCha20Poly1305)
+	window := msg.NewReplayWindow()
+	first := rekey(t, client)
+	second := rekey(t, client)
+
+	if err := node.HandleRekey(first, window); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.HandleRekey(first, window); !errors.Is(err, msg.ErrReplayedMsg) {
+		t.Fatalf("same rekey twice: got %v, want ErrReplayedMsg", err)
+	}
+	if err := node.HandleRekey(second, window); err != nil {
+		t.Fatal(err)
+	}
+	// Its key is gone too, so even a fresh window doesn't let it through
+	if err := node.HandleRekey(first, msg.NewReplayWindow()); !errors.Is(err, msg.ErrStaleEpoch) {
+		t.Fatalf("older rekey: got %v, want ErrStaleEpoch", err)
+	}
+
+	// A data message is not a rekey
+	if err := node.HandleRekey(seal(t, client, 0), window); err == nil {
+		t.Fatal("accepted a data message as a rekey")
+	}
+}
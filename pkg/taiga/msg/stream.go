@@ -0,0 +1,54 @@
+package msg
+
+import (
+	"fmt"
+
+	"github.com/kelindar/binary"
+)
+
+// StreamChunkSize is the most stream payload carried by one frame, small
+// enough that a frame fits a message under the default MTU
+const StreamChunkSize = 1024
+
+// StreamOp is what a StreamFrame does to its stream
+type StreamOp uint8
+
+const (
+	StreamOpen  StreamOp = 1 // Client: Data is the "host:port" to dial. Node: dial succeeded.
+	StreamData  StreamOp = 2 // Data is stream payload
+	StreamClose StreamOp = 3 // Stream ended; Data may hold a reason
+)
+
+// StreamFrame carries one operation on a proxied TCP stream, for clients
+// running without a TUN. Frames travel in Msg.Data with FlagStream set.
+type StreamFrame struct {
+	ID   uint32 // Chosen by the client, unique per connection
+	Op   StreamOp
+	Data []byte
+}
+
+// MarshalStreamFrame encodes a frame for Msg.Data
+func MarshalStreamFrame(f *StreamFrame) ([]byte, error) {
+	data, err := binary.Marshal(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal stream frame: %w", err)
+	}
+	return data, nil
+}
+
+// UnmarshalStreamFrame decodes a frame from Msg.Data
+func UnmarshalStreamFrame(data []byte) (*StreamFrame, error) {
+	f := &StreamFrame{}
+	if err := unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal stream frame: %w", err)
+	}
+	switch f.Op {
+	case StreamOpen, StreamData, StreamClose:
+	default:
+		return nil, fmt.Errorf("unknown stream op %d", f.Op)
+	}
+	if len(f.Data) > StreamChunkSize {
+		return nil, fmt.Errorf("stream frame of %d bytes exceeds %d", len(f.Data), StreamChunkSize)
+	}
+	return f, nil
+}
@@ -0,0 +1,165 @@
+package msg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite identifies the AEAD and key derivation a session's data is sealed
+// with. Handshakes and acks are always sealed with SuiteChaCha20Poly1305,
+// since the suite is only settled by them.
+type Suite uint16
+
+var (
+	// SuiteChaCha20Poly1305 is the default, and the zero value, so a client
+	// offering no suites and a node selecting none both mean it
+	SuiteChaCha20Poly1305 Suite = 0
+	// SuiteAES256GCM is for FIPS deployments and CPUs with AES instructions
+	SuiteAES256GCM Suite = 1
+)
+
+// SupportedSuites are the cipher suites this build speaks, preferred first
+var SupportedSuites = []Suite{SuiteChaCha20Poly1305, SuiteAES256GCM}
+
+var (
+	ErrUnknownSuite  = errors.New("unknown cipher suite")
+	ErrNoCommonSuite = errors.New("no common cipher suite")
+)
+
+// CipherSuite derives message keys and builds the ciphers that seal and open
+// messages with them. Every suite uses 32-byte keys and 12-byte nonces.
+type CipherSuite interface {
+	ID() Suite
+	// DeriveKey expands secret into a key under a version-bound label. Each
+	// suite labels its keys apart, so one secret never keys two algorithms.
+	DeriveKey(secret []byte, version Version, label string) ([]byte, error)
+	// NewAEAD returns the cipher whose Seal and Open use key
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+// chachaSuite is ChaCha20Poly1305 keyed with HKDF-SHA256
+type chachaSuite struct{}
+
+func (chachaSuite) ID() Suite { return SuiteChaCha20Poly1305 }
+
+// DeriveKey keeps the labels from before suites were negotiable, so existing
+// peers derive the same keys
+func (chachaSuite) DeriveKey(secret []byte, version Version, label string) ([]byte, error) {
+	return hkdfExpand(secret, version, label)
+}
+
+func (chachaSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// aesGCMSuite is AES-256-GCM keyed with HKDF-SHA256
+type aesGCMSuite struct{}
+
+func (aesGCMSuite) ID() Suite { return SuiteAES256GCM }
+
+func (aesGCMSuite) DeriveKey(secret []byte, version Version, label string) ([]byte, error) {
+	return hkdfExpand(secret, version, "aes256gcm/"+label)
+}
+
+func (aesGCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// defaultSuite seals handshakes and acks
+var defaultSuite CipherSuite = chachaSuite{}
+
+// LookupSuite returns the implementation of id
+func LookupSuite(id Suite) (CipherSuite, error) {
+	switch id {
+	case SuiteChaCha20Poly1305:
+		return chachaSuite{}, nil
+	case SuiteAES256GCM:
+		return aesGCMSuite{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSuite, id)
+	}
+}
+
+// String returns the suite's config name
+func (s Suite) String() string {
+	switch s {
+	case SuiteChaCha20Poly1305:
+		return "chacha20poly1305"
+	case SuiteAES256GCM:
+		return "aes256gcm"
+	default:
+		return fmt.Sprintf("suite(%d)", uint16(s))
+	}
+}
+
+// ParseSuites converts a comma-separated config list of suite names,
+// preferred first, to Suites. Empty means SupportedSuites.
+func ParseSuites(s string) ([]Suite, error) {
+	if s == "" {
+		return slices.Clone(SupportedSuites), nil
+	}
+	var list []Suite
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(SupportedSuites, func(suite Suite) bool { return suite.String() == name })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSuite, name)
+		}
+		if !slices.Contains(list, SupportedSuites[i]) {
+			list = append(list, SupportedSuites[i])
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no cipher suites in %q", s)
+	}
+	return list, nil
+}
+
+// NegotiateSuite picks the first of allowed that the peer offered
+func NegotiateSuite(offered, allowed []Suite) (Suite, error) {
+	for _, s := range allowed {
+		if slices.Contains(offered, s) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: offered %v, allowed %v", ErrNoCommonSuite, offered, allowed)
+}
+
+// OfferedSuites returns the suites a handshake offers. A client that lists
+// none speaks only ChaCha20Poly1305.
+func (hs *Handshake) OfferedSuites() []Suite {
+	if len(hs.Suites) == 0 {
+		return []Suite{SuiteChaCha20Poly1305}
+	}
+	return hs.Suites
+}
+
+// PinSuite returns the suite the node selected for the session, which must
+// be one of those offered in the handshake
+func (ack *HandshakeAck) PinSuite(offered []Suite) (Suite, error) {
+	if len(offered) == 0 {
+		offered = []Suite{SuiteChaCha20Poly1305}
+	}
+	if !slices.Contains(offered, ack.Suite) {
+		return 0, fmt.Errorf("node selected cipher suite %s, which was not offered", ack.Suite)
+	}
+	return ack.Suite, nil
+}
@@ -0,0 +1,168 @@
+package msg_test
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"seras-protocol/pkg/taiga/msg"
+)
+
+func TestSuiteRoundTrip(t *testing.T) {
+	for _, suite := range msg.SupportedSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			encoder, decoder := ecdhPair(t)
+			encoder.Suite, decoder.Suite = suite, suite
+			client, node := sessionPair(t, suite)
+			for name, pair := range map[string]struct {
+				sealer
+				opener
+			}{"ECDH": {encoder, decoder}, "session": {client, node}} {
+				window := msg.NewReplayWindow()
+				for _, size := range benchSizes {
+					message := testPacket(size)
+					rawMsg, err := pair.EncryptMsg(message, nil)
+					if err != nil {
+						t.Fatalf("%s: seal %d bytes: %v", name, size, err)
+					}
+					cooked, err := pair.DecryptBodyChecked(rawMsg, window, nil)
+					if err != nil {
+						t.Fatalf("%s: open %d bytes: %v", name, size, err)
+					}
+					if !bytes.Equal(cooked.Body.Data, message.Data) {
+						t.Fatalf("%s: %d bytes came back changed", name, size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSuiteMismatchRejected(t *testing.T) {
+	for _, sealed := range msg.SupportedSuites {
+		for _, opened := range msg.SupportedSuites {
+			if sealed == opened {
+				continue
+			}
+			encoder, decoder := ecdhPair(t)
+			encoder.Suite, decoder.Suite = sealed, opened
+			rawMsg, err := encoder.EncryptMsg(testPacket(64), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decoder.DecryptBody(rawMsg, nil); err == nil {
+				t.Errorf("ECDH: opened %s with %s", sealed, opened)
+			}
+
+			// Both ends of a session hold the same seed, so only the suite differs
+			seed, err := msg.NewSessionSeed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := msg.NewSessionWithSuite(seed, true, msg.Version2, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node, err := msg.NewSessionWithSuite(seed, false, msg.Version2, opened)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := node.DecryptBodyChecked(seal(t, client, 1), msg.NewReplayWindow(), nil); err == nil {
+				t.Errorf("session: opened %s with %s", sealed, opened)
+			}
+		}
+	}
+
+	// Suites this build doesn't know seal and open nothing
+	unknown := msg.Suite(99)
+	if _, err := msg.NewSessionWithSuite(msg.Key{}, true, msg.Version2, unknown); !errors.Is(err, msg.ErrUnknownSuite) {
+		t.Fatalf("session with %s: got %v, want ErrUnknownSuite", unknown, err)
+	}
+	encoder, _ := ecdhPair(t)
+	encoder.Suite = unknown
+	if _, err := encoder.EncryptMsg(testPacket(64), nil); !errors.Is(err, msg.ErrUnknownSuite) {
+		t.Fatalf("sealing with %s: got %v, want ErrUnknownSuite", unknown, err)
+	}
+}
+
+func TestParseSuites(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []msg.Suite // Nil for an error
+	}{
+		{"", msg.SupportedSuites},
+		{"aes256gcm", []msg.Suite{msg.SuiteAES256GCM}},
+		{"aes256gcm, chacha20poly1305", []msg.Suite{msg.SuiteAES256GCM, msg.SuiteChaCha20Poly1305}},
+		{"chacha20poly1305,chacha20poly1305", []msg.Suite{msg.SuiteChaCha20Poly1305}},
+		{"aes128gcm", nil},
+		{",", nil},
+	}
+	for _, tt := range tests {
+		got, err := msg.ParseSuites(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseSuites(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSuites(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNegotiateSuite(t *testing.T) {
+	chacha, aes := msg.SuiteChaCha20Poly1305, msg.SuiteAES256GCM
+	tests := []struct {
+		name    string
+		offered []msg.Suite
+		allowed []msg.Suite
+		want    msg.Suite
+		ok      bool
+	}{
+		{"matching", []msg.Suite{aes}, []msg.Suite{aes}, aes, true},
+		{"node's preference wins", []msg.Suite{chacha, aes}, []msg.Suite{aes, chacha}, aes, true},
+		{"partial overlap", []msg.Suite{chacha, aes}, []msg.Suite{aes}, aes, true},
+		{"nothing offered", (&msg.Handshake{}).OfferedSuites(), msg.SupportedSuites, chacha, true},
+		{"no overlap", []msg.Suite{aes}, []msg.Suite{chacha}, 0, false},
+		{"old client, AES-only node", (&msg.Handshake{}).OfferedSuites(), []msg.Suite{aes}, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := msg.NegotiateSuite(tt.offered, tt.allowed)
+		if !tt.ok {
+			if !errors.Is(err, msg.ErrNoCommonSuite) {
+				t.Errorf("%s: got %s, %v; want ErrNoCommonSuite", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %s, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestPinSuite(t *testing.T) {
+	tests := []struct {
+		offered  []msg.Suite
+		selected msg.Suite
+		ok       bool
+	}{
+		{[]msg.Suite{msg.SuiteAES256GCM}, msg.SuiteAES256GCM, true},
+		{[]msg.Suite{msg.SuiteAES256GCM}, msg.SuiteChaCha20Poly1305, false},
+		{nil, msg.SuiteChaCha20Poly1305, true},
+		{nil, msg.SuiteAES256GCM, false},
+	}
+	for _, tt := range tests {
+		got, err := (&msg.HandshakeAck{Suite: tt.selected}).PinSuite(tt.offered)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("offered %v, selected %s: pinned it, want an error", tt.offered, tt.selected)
+			}
+			continue
+		}
+		if err != nil || got != tt.selected {
+			t.Errorf("offered %v, selected %s: got %s, %v", tt.offered, tt.selected, got, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/kelindar/binary"
+)
+
+// ErrMalformed is returned for input whose length prefixes run past its end
+var ErrMalformed = errors.New("malformed encoding")
+
+// unmarshal decodes data into v like binary.Unmarshal, once every length
+// prefix in data is known to fit in the bytes that follow it. binary.Unmarshal
+// allocates whatever a prefix claims up front, so a few bytes of input could
+// otherwise ask for gigabytes, or make it slice with a negative length.
+func unmarshal(data []byte, v any) error {
+	if _, err := checkEncoding(data, reflect.TypeOf(v).Elem()); err != nil {
+		return err
+	}
+	return binary.Unmarshal(data, v)
+}
+
+// checkEncoding walks the encoding of a value of type t at the start of data,
+// laid out as kelindar/binary does, and returns the bytes after it
+func checkEncoding(data []byte, t reflect.Type) ([]byte, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: truncated %s", ErrMalformed, t)
+		}
+		return data[1:], nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, rest, err := readUvarint(data)
+		return rest, err
+
+	case reflect.String:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: %s of %d bytes in %d", ErrMalformed, t, n, len(rest))
+		}
+		return rest[n:], nil
+
+	case reflect.Slice:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		// Every element takes at least a byte
+		if n > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: %s of %d elements in %d bytes", ErrMalformed, t, n, len(rest))
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return rest[n:], nil
+		}
+		for range n {
+			if rest, err = checkEncoding(rest, t.Elem()); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+
+	case reflect.Array:
+		var err error
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Keys and nonces: a varint per byte
+			for range t.Len() {
+				if _, data, err = readUvarint(data); err != nil {
+					return nil, err
+				}
+			}
+			return data, nil
+		}
+		for range t.Len() {
+			if data, err = checkEncoding(data, t.Elem()); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+
+	case reflect.Pointer:
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: truncated %s", ErrMalformed, t)
+		}
+		if data[0] == 1 { // nil
+			return data[1:], nil
+		}
+		return checkEncoding(data[1:], t.Elem())
+
+	case reflect.Struct:
+		var err error
+		for _, f := range encodedFields(t) {
+			if data, err = checkEncoding(data, f); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: cannot check %s", ErrMalformed, t)
+}
+
+// fieldTypes caches encodedFields by struct type
+var fieldTypes sync.Map
+
+// encodedFields returns the types of the fields kelindar/binary encodes for
+// struct type t, in order
+func encodedFields(t reflect.Type) []reflect.Type {
+	if fields, ok := fieldTypes.Load(t); ok {
+		return fields.([]reflect.Type)
+	}
+	var fields []reflect.Type
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Name != "_" && f.Tag.Get("binary") != "-" {
+			fields = append(fields, f.Type)
+		}
+	}
+	fieldTypes.Store(t, fields)
+	return fields
+}
+
+// readUvarint reads a varint as kelindar/binary writes lengths and integers
+func readUvarint(data []byte) (uint64, []byte, error) {
+	var x uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		b := data[i]
+		if b < 0x80 {
+			return x | uint64(b)<<(7*i), data[i+1:], nil
+		}
+		x |= uint64(b&0x7f) << (7 * i)
+	}
+	return 0, nil, fmt.Errorf("%w: truncated varint", ErrMalformed)
+}
@@ -0,0 +1,116 @@
+package msg_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+
+	kbinary "github.com/kelindar/binary"
+	"seras-protocol/pkg/taiga/msg"
+)
+
+// frame returns a valid wire message with a one-byte body
+func frame(tb testing.TB) []byte {
+	tb.Helper()
+	data, err := kbinary.Marshal(&msg.RawMsg{
+		Header: &msg.Header{Version: msg.Version2, Type: msg.TypeData},
+		Body:   []byte{0x42},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// withLength replaces the one-byte length prefix at data[at] with n
+func withLength(data []byte, at int, n uint64) []byte {
+	out := append([]byte(nil), data[:at]...)
+	out = binary.AppendUvarint(out, n)
+	return append(out, data[at+1:]...)
+}
+
+// allocated returns the bytes f allocates
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestDecodeRejectsOversizedLengths(t *testing.T) {
+	valid := frame(t)
+	if _, err := msg.Decode(valid); err != nil {
+		t.Fatalf("valid frame: %v", err)
+	}
+
+	bodyLen := len(valid) - 2 // The body's length prefix, before its one byte
+	versionLen := 1           // After the header pointer's nil flag
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"body claims a terabyte", withLength(valid, bodyLen, 1<<40)},
+		{"body claims one byte too many", withLength(valid, bodyLen, 2)},
+		{"version claims more than a slice holds", withLength(valid, versionLen, 1<<63)},
+		{"version runs past the end", withLength(valid, versionLen, uint64(len(valid)))},
+	}
+	for _, tt := range tests {
+		var err error
+		n := allocated(func() { _, err = msg.Decode(tt.data) })
+		if !errors.Is(err, msg.ErrMalformed) {
+			t.Errorf("%s: got %v, want ErrMalformed", tt.name, err)
+		}
+		if n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes before rejecting it", tt.name, n)
+		}
+	}
+
+	// Every truncation fails cleanly
+	for i := range len(valid) - 1 {
+		if _, err := msg.Decode(valid[:i]); err == nil {
+			t.Errorf("decoded a frame cut to %d of %d bytes", i, len(valid))
+		}
+	}
+}
+
+func TestUnmarshalStreamFrameRejectsOversizedData(t *testing.T) {
+	data, err := msg.MarshalStreamFrame(&msg.StreamFrame{ID: 1, Op: msg.StreamData, Data: []byte{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	huge := withLength(data, len(data)-2, 1<<40)
+	if _, err := msg.UnmarshalStreamFrame(huge); !errors.Is(err, msg.ErrMalformed) {
+		t.Fatalf("got %v, want ErrMalformed", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	encoder, decoder := ecdhPair(f)
+	client, node := sessionPair(f, msg.SuiteChaCha20Poly1305)
+	f.Add(frame(f))
+	for _, s := range []sealer{encoder, client} {
+		rawMsg, err := s.EncryptMsg(testPacket(64), nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := kbinary.Marshal(rawMsg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rawMsg, err := msg.Decode(data)
+		if err != nil {
+			return
+		}
+		if len(rawMsg.Body) > len(data) {
+			t.Fatalf("decoded a %d byte body from %d bytes", len(rawMsg.Body), len(data))
+		}
+		decoder.DecryptBody(rawMsg, nil)
+		node.DecryptBodyChecked(rawMsg, msg.NewReplayWindow(), nil)
+	})
+}
@@ -1,13 +0,0 @@
-module seras-protocol
-
-go 1.24.0
-
-require (
-	github.com/gorilla/websocket v1.5.3
-	github.com/joho/godotenv v1.5.1
-	github.com/kelindar/binary v1.0.19
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	golang.org/x/crypto v0.45.0
-)
-
-require golang.org/x/sys v0.38.0 // indirect